@@ -0,0 +1,109 @@
+// Command pixatrace prints session traces captured with trace.enabled as text, one line per frame,
+// so two traces can be compared with diff. Binary payloads are hex dumped with -hex when the trace
+// captured them.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/trace"
+)
+
+func main() {
+	dumpHex := flag.Bool("hex", false, "hex dump captured binary payloads")
+	noTime := flag.Bool("no-time", false, "leave out timestamps and session IDs, to diff traces of different sessions")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] trace.pxtrace...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for _, path := range flag.Args() {
+		if err := printTrace(out, path, *dumpHex, *noTime); err != nil {
+			out.Flush()
+			log.Fatalf("%s: %v", path, err)
+		}
+	}
+}
+
+func printTrace(out io.Writer, path string, dumpHex, noTime bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := trace.NewReader(f)
+	if err != nil {
+		return err
+	}
+	h := r.Header()
+	if noTime {
+		fmt.Fprintf(out, "# device %q audio %t\n", h.DeviceID, h.Audio)
+	} else {
+		fmt.Fprintf(out, "# session %s device %q started %s audio %t\n", h.SessionID, h.DeviceID, h.StartedAt.UTC().Format(time.RFC3339Nano), h.Audio)
+	}
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !noTime {
+			fmt.Fprintf(out, "%12.6f ", rec.Offset.Seconds())
+		}
+		line := fmt.Sprintf("%-6s %-6s %6d %s", rec.Direction, rec.Opcode, rec.Length, describe(rec))
+		fmt.Fprintln(out, strings.TrimRight(line, " "))
+		if dumpHex && rec.Opcode == trace.Binary && len(rec.Data) > 0 {
+			for _, line := range strings.SplitAfter(strings.TrimSuffix(hex.Dump(rec.Data), "\n"), "\n") {
+				fmt.Fprintf(out, "    %s", line)
+			}
+			fmt.Fprintln(out)
+		}
+	}
+}
+
+// describe returns the payload of a frame as it is printed after its size
+func describe(rec trace.Record) string {
+	switch {
+	case rec.Opcode == trace.Close:
+		if len(rec.Data) < 2 {
+			return "no status"
+		}
+		return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rec.Data), quote(rec.Data[2:]))
+	case rec.Opcode == trace.Binary:
+		if rec.Truncated() {
+			return "(payload not captured)"
+		}
+		return ""
+	}
+	return quote(rec.Data)
+}
+
+// quote prints text payloads as they are when they fit on a line, and quoted otherwise
+func quote(data []byte) string {
+	s := string(data)
+	if utf8.ValidString(s) && !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+	return strconv.Quote(s)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// C clients get a struct per definition, an encoder per device message and a decoder per relay
+// event. Strings and byte fields are fixed size arrays, so nothing is allocated; objects of strings
+// point to key value pairs owned by the caller.
+
+func cStruct(name string) string {
+	return "pixa_" + snake(name)
+}
+
+func cTypeMacro(value string) string {
+	return "PIXA_TYPE_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(value))
+}
+
+// cHasTypeField reports whether the C struct carries the message type: events always do since they
+// are decoded, device messages only when the struct is shared by several types
+func cHasTypeField(s *structDef) bool {
+	return s.Direction == relayDirection || len(s.Types) > 1
+}
+
+func generateCHeader(p *protocol) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "/* %s */\n", generatedHeader)
+	b.WriteString(`#ifndef PIXA_PROTOCOL_H
+#define PIXA_PROTOCOL_H
+
+#include <stdbool.h>
+#include <stddef.h>
+#include <stdint.h>
+
+#include "pixa_json.h"
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+/* Sizes of the string and byte fields, including the terminating NUL of strings */
+#ifndef PIXA_MAX_STRING
+#define PIXA_MAX_STRING 256
+#endif
+#ifndef PIXA_MAX_BYTES
+#define PIXA_MAX_BYTES 64
+#endif
+#define PIXA_MAX_TYPE 32
+
+`)
+
+	for _, group := range []struct{ direction, comment string }{
+		{deviceDirection, "Control messages sent by the device"},
+		{relayDirection, "Events sent by the relay"},
+	} {
+		fmt.Fprintf(&b, "/* %s */\n", group.comment)
+		for _, s := range p.messages(group.direction) {
+			for _, t := range s.Types {
+				fmt.Fprintf(&b, "#define %s %q\n", cTypeMacro(t.Value), t.Value)
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	for _, s := range p.Structs {
+		if s.Description != "" {
+			fmt.Fprintf(&b, "/* %s is %s */\n", cStruct(s.Name), s.Description)
+		}
+		b.WriteString("typedef struct {\n")
+		if cHasTypeField(s) {
+			b.WriteString("    char type[PIXA_MAX_TYPE];\n")
+		}
+		for _, f := range s.Fields {
+			if doc := fieldComment(f); doc != "" {
+				fmt.Fprintf(&b, "    /* %s */\n", doc)
+			}
+			switch f.Kind {
+			case stringKind:
+				fmt.Fprintf(&b, "    char %s[PIXA_MAX_STRING];\n", f.JSON)
+			case intKind:
+				fmt.Fprintf(&b, "    int32_t %s;\n", f.JSON)
+			case int64Kind:
+				fmt.Fprintf(&b, "    int64_t %s;\n", f.JSON)
+			case boolKind:
+				fmt.Fprintf(&b, "    bool %s;\n", f.JSON)
+			case bytesKind:
+				fmt.Fprintf(&b, "    uint8_t %s[PIXA_MAX_BYTES];\n    size_t %s_len;\n", f.JSON, f.JSON)
+			case refKind:
+				fmt.Fprintf(&b, "    %s %s;\n", cStruct(f.Ref.Name), f.JSON)
+			case mapKind:
+				fmt.Fprintf(&b, "    const pixa_json_pair *%s;\n    size_t %s_len;\n", f.JSON, f.JSON)
+			}
+		}
+		fmt.Fprintf(&b, "} %s;\n\n", cStruct(s.Name))
+	}
+
+	b.WriteString("/* Encoders write the message as JSON into buf and return its length, or -1 if buf is too small */\n")
+	for _, s := range p.messages(deviceDirection) {
+		fmt.Fprintf(&b, "int pixa_encode_%s(const %s *m, char *buf, size_t cap);\n", snake(s.Name), cStruct(s.Name))
+	}
+	b.WriteString("\n/* Decoders parse an event and return 0, or -1 if json is not that event or misses a required field */\n")
+	for _, s := range p.messages(relayDirection) {
+		fmt.Fprintf(&b, "int pixa_decode_%s(const char *json, %s *out);\n", snake(s.Name), cStruct(s.Name))
+	}
+
+	b.WriteString(`
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* PIXA_PROTOCOL_H */
+`)
+	return b.Bytes(), nil
+}
+
+func generateCSource(p *protocol) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "/* %s */\n", generatedHeader)
+	b.WriteString("#include \"pixa_protocol.h\"\n\n#include <string.h>\n\n#include \"pixa_json.h\"\n")
+
+	for _, s := range p.messages(deviceDirection) {
+		fmt.Fprintf(&b, "\nint pixa_encode_%s(const %s *m, char *buf, size_t cap)\n{\n", snake(s.Name), cStruct(s.Name))
+		b.WriteString("    pixa_json_writer w;\n\n    pixa_json_begin(&w, buf, cap);\n")
+		if cHasTypeField(s) {
+			b.WriteString("    pixa_json_add_string(&w, \"type\", m->type);\n")
+		} else {
+			fmt.Fprintf(&b, "    pixa_json_add_string(&w, \"type\", %s);\n", cTypeMacro(s.Types[0].Value))
+		}
+		for _, f := range s.Fields {
+			var add string
+			switch f.Kind {
+			case stringKind:
+				add = fmt.Sprintf("pixa_json_add_string(&w, %q, m->%s);", f.JSON, f.JSON)
+			case intKind, int64Kind:
+				add = fmt.Sprintf("pixa_json_add_int64(&w, %q, m->%s);", f.JSON, f.JSON)
+			case boolKind:
+				add = fmt.Sprintf("pixa_json_add_bool(&w, %q, m->%s);", f.JSON, f.JSON)
+			case bytesKind:
+				add = fmt.Sprintf("pixa_json_add_base64(&w, %q, m->%s, m->%s_len);", f.JSON, f.JSON, f.JSON)
+			case mapKind:
+				add = fmt.Sprintf("pixa_json_add_string_map(&w, %q, m->%s, m->%s_len);", f.JSON, f.JSON, f.JSON)
+			case refKind:
+				return nil, fmt.Errorf("%s.%s: the C generator does not support nested objects in device messages", s.Name, f.JSON)
+			}
+			if f.Optional {
+				fmt.Fprintf(&b, "    if (%s) {\n        %s\n    }\n", cPresent("m->", f), add)
+			} else {
+				fmt.Fprintf(&b, "    %s\n", add)
+			}
+		}
+		b.WriteString("    return pixa_json_end(&w);\n}\n")
+	}
+
+	for _, s := range p.messages(relayDirection) {
+		for _, f := range s.Fields {
+			if f.Kind == mapKind {
+				return nil, fmt.Errorf("%s.%s: the C generator does not support objects of strings in relay events", s.Name, f.JSON)
+			}
+		}
+		fmt.Fprintf(&b, "\nint pixa_decode_%s(const char *json, %s *out)\n{\n", snake(s.Name), cStruct(s.Name))
+		b.WriteString("    memset(out, 0, sizeof(*out));\n")
+		b.WriteString("    if (pixa_json_get_string(json, \"type\", out->type, sizeof(out->type)) < 0) {\n        return -1;\n    }\n")
+		checks := make([]string, len(s.Types))
+		for i, t := range s.Types {
+			checks[i] = fmt.Sprintf("strcmp(out->type, %s) != 0", cTypeMacro(t.Value))
+		}
+		fmt.Fprintf(&b, "    if (%s) {\n        return -1;\n    }\n", strings.Join(checks, " && "))
+		writeCDecode(&b, s.Fields, "", "out->", true)
+		b.WriteString("    return 0;\n}\n")
+	}
+	return b.Bytes(), nil
+}
+
+// writeCDecode reads fields from json, descending into nested objects with dotted paths
+func writeCDecode(b *bytes.Buffer, fields []field, path, target string, required bool) {
+	for _, f := range fields {
+		name := target + f.JSON
+		key := path + f.JSON
+		var get string
+		switch f.Kind {
+		case stringKind:
+			get = fmt.Sprintf("pixa_json_get_string(json, %q, %s, sizeof(%s))", key, name, name)
+		case intKind:
+			get = fmt.Sprintf("pixa_json_get_int32(json, %q, &%s)", key, name)
+		case int64Kind:
+			get = fmt.Sprintf("pixa_json_get_int64(json, %q, &%s)", key, name)
+		case boolKind:
+			get = fmt.Sprintf("pixa_json_get_bool(json, %q, &%s)", key, name)
+		case bytesKind:
+			get = fmt.Sprintf("pixa_json_get_base64(json, %q, %s, sizeof(%s), &%s_len)", key, name, name, name)
+		case refKind:
+			writeCDecode(b, f.Ref.Fields, key+".", name+".", required && !f.Optional)
+			continue
+		}
+		if required && !f.Optional {
+			fmt.Fprintf(b, "    if (%s < 0) {\n        return -1;\n    }\n", get)
+		} else {
+			fmt.Fprintf(b, "    %s;\n", get)
+		}
+	}
+}
+
+// cPresent is the condition under which an optional field is encoded
+func cPresent(target string, f field) string {
+	switch f.Kind {
+	case stringKind:
+		return target + f.JSON + "[0] != '\\0'"
+	case bytesKind, mapKind:
+		return target + f.JSON + "_len > 0"
+	}
+	return target + f.JSON
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+)
+
+const generatedHeader = "Code generated by protogen from " + schemaPath + ". DO NOT EDIT."
+
+// goFlavor is what differs between the Go code generated for the relay and for TinyGo clients
+type goFlavor struct {
+	pkg string
+	// typeConst names the constant of a message type sent in the given direction
+	typeConst func(value, direction string) string
+	// structName names the Go type of a definition
+	structName func(name string) string
+	// typeField reports whether messages sent in the given direction carry their type field
+	typeField func(direction string) bool
+	// schemas generates the tables device messages are validated with
+	schemas bool
+}
+
+var serverFlavor = goFlavor{
+	pkg: "websocket",
+	typeConst: func(value, direction string) string {
+		if direction == deviceDirection {
+			return camel(value) + "Message"
+		}
+		return camel(value) + "Event"
+	},
+	structName: func(name string) string { return name },
+	// the relay reads the type of device messages from the envelope before decoding them
+	typeField: func(direction string) bool { return direction == relayDirection },
+	schemas:   true,
+}
+
+var tinyGoFlavor = goFlavor{
+	pkg:        "pixa",
+	typeConst:  func(value, _ string) string { return "Type" + camel(value) },
+	structName: exported,
+	typeField:  func(direction string) bool { return direction != "" },
+}
+
+func generateServer(p *protocol) ([]byte, error) {
+	return generateGo(p, serverFlavor, "Events sent to the device")
+}
+
+func generateTinyGo(p *protocol) ([]byte, error) {
+	return generateGo(p, tinyGoFlavor, "Events sent by the relay")
+}
+
+func generateGo(p *protocol, flavor goFlavor, eventsComment string) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// %s\n\npackage %s\n\n", generatedHeader, flavor.pkg)
+
+	for _, group := range []struct{ direction, comment string }{
+		{deviceDirection, "Control messages sent by the device"},
+		{relayDirection, eventsComment},
+	} {
+		fmt.Fprintf(&b, "// %s\nconst (\n", group.comment)
+		for _, s := range p.messages(group.direction) {
+			for _, t := range s.Types {
+				name := flavor.typeConst(t.Value, group.direction)
+				if t.Description != "" {
+					fmt.Fprintf(&b, "// %s %s\n", name, t.Description)
+				}
+				fmt.Fprintf(&b, "%s = %q\n", name, t.Value)
+			}
+		}
+		b.WriteString(")\n\n")
+	}
+
+	for _, s := range p.Structs {
+		name := flavor.structName(s.Name)
+		switch {
+		case s.Description != "":
+			fmt.Fprintf(&b, "// %s is %s\n", name, s.Description)
+		case flavor.pkg == tinyGoFlavor.pkg && s.Direction != "":
+			fmt.Fprintf(&b, "// %s is sent by the %s as %s\n", name, s.Direction, typeList(s.Types))
+		}
+		fmt.Fprintf(&b, "type %s struct {\n", name)
+		if flavor.typeField(s.Direction) {
+			b.WriteString("Type string `json:\"type\"`\n")
+		}
+		for _, f := range s.Fields {
+			if doc := fieldComment(f); doc != "" {
+				fmt.Fprintf(&b, "// %s is %s\n", camel(f.JSON), doc)
+			}
+			tag := f.JSON
+			if f.Optional {
+				tag += ",omitempty"
+			}
+			fmt.Fprintf(&b, "%s %s `json:%q`\n", camel(f.JSON), goType(f, flavor), tag)
+		}
+		b.WriteString("}\n\n")
+	}
+
+	if flavor.schemas {
+		if err := writeSchemas(&b, p, flavor); err != nil {
+			return nil, err
+		}
+	}
+	return format.Source(b.Bytes())
+}
+
+// schemaKinds are the fieldKind constants of the relay's validator for the kinds of fields
+var schemaKinds = map[string]string{
+	stringKind: "stringField",
+	intKind:    "intField",
+	int64Kind:  "int64Field",
+	boolKind:   "boolField",
+	bytesKind:  "bytesField",
+	mapKind:    "mapField",
+}
+
+// writeSchemas writes the table of the fields of every device message, by message type, which
+// the relay validates the messages it reads against
+func writeSchemas(b *bytes.Buffer, p *protocol, flavor goFlavor) error {
+	b.WriteString("// deviceSchemas are the schemas of the control messages sent by the device, by message type\n")
+	b.WriteString("var deviceSchemas = map[string]messageSchema{\n")
+	for _, s := range p.messages(deviceDirection) {
+		for _, t := range s.Types {
+			fmt.Fprintf(b, "%s: {since: %d, fields: []fieldSchema{\n", flavor.typeConst(t.Value, deviceDirection), s.Since)
+			for _, f := range s.Fields {
+				kind, ok := schemaKinds[f.Kind]
+				if !ok {
+					return fmt.Errorf("%s.%s: device messages cannot hold nested objects", s.Name, f.JSON)
+				}
+				fmt.Fprintf(b, "{name: %q, kind: %s, required: %t, since: %d", f.JSON, kind, !f.Optional, f.Since)
+				if len(f.Enum) > 0 {
+					fmt.Fprintf(b, ", enum: %#v", f.Enum)
+				}
+				b.WriteString("},\n")
+			}
+			b.WriteString("}},\n")
+		}
+	}
+	b.WriteString("}\n")
+	return nil
+}
+
+func goType(f field, flavor goFlavor) string {
+	switch f.Kind {
+	case refKind:
+		return flavor.structName(f.Ref.Name)
+	case bytesKind:
+		return "[]byte"
+	case mapKind:
+		return "map[string]string"
+	}
+	return f.Kind
+}
+
+// fieldComment describes a field from its description and the values it can take
+func fieldComment(f field) string {
+	switch {
+	case f.Description != "" && len(f.Enum) > 0:
+		return f.Description + ", " + enumComment(f.Enum)
+	case len(f.Enum) > 0:
+		return enumComment(f.Enum)
+	}
+	return f.Description
+}
+
+func typeList(types []messageType) string {
+	values := make([]string, len(types))
+	for i, t := range types {
+		values[i] = t.Value
+	}
+	return enumComment(values)
+}
@@ -0,0 +1,70 @@
+// Command protogen generates the relay's control protocol types, the TinyGo client types and the C
+// client stubs from protocol/protocol.schema.json, so firmware and relay stay in sync.
+//
+// Run it from the repository root, or through go generate in pkg/websocket:
+//
+//	go run ./cmd/protogen
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const schemaPath = "protocol/protocol.schema.json"
+
+// output is a generated file and the generator producing it
+type output struct {
+	path     string
+	generate func(*protocol) ([]byte, error)
+}
+
+var outputs = []output{
+	{"pkg/websocket/protocol_gen.go", generateServer},
+	{"sdk/tinygo/pixa/protocol_gen.go", generateTinyGo},
+	{"sdk/c/pixa_protocol.h", generateCHeader},
+	{"sdk/c/pixa_protocol.c", generateCSource},
+}
+
+func main() {
+	root := flag.String("root", ".", "repository root")
+	flag.Parse()
+
+	files, err := generate(*root)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for path, data := range files {
+		path = filepath.Join(*root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// generate returns the contents of every generated file, keyed by its path relative to root
+func generate(root string) (map[string][]byte, error) {
+	data, err := os.ReadFile(filepath.Join(root, schemaPath))
+	if err != nil {
+		return nil, err
+	}
+	p, err := parseSchema(data)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]byte, len(outputs))
+	for _, o := range outputs {
+		out, err := o.generate(p)
+		if err != nil {
+			return nil, err
+		}
+		files[o.path] = out
+	}
+	return files, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestGeneratedFilesUpToDate fails when the schema changed without regenerating the protocol code
+func TestGeneratedFilesUpToDate(t *testing.T) {
+	root := filepath.Join("..", "..")
+	files, err := generate(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range files {
+		got, err := os.ReadFile(filepath.Join(root, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s is out of date, run go generate ./pkg/websocket", path)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	for in, want := range map[string]string{"session_id": "SessionID", "audio_end_ms": "AudioEndMs", "playback.ack": "PlaybackAck"} {
+		if got := camel(in); got != want {
+			t.Errorf("camel(%q) = %q, expected %q", in, got, want)
+		}
+	}
+	if got := snake("sessionStatusEvent"); got != "session_status_event" {
+		t.Errorf("unexpected snake case %q", got)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// The generator understands the subset of JSON Schema the protocol is written in: every message is
+// an object in $defs whose "type" property is a const or an enum of message types, and whose other
+// properties are strings, integers, booleans, base64 encoded strings, objects of strings or
+// references to other $defs. x-since is the protocol version a message or property was introduced
+// in, 1 when it is not set.
+
+// Directions a message can be sent in
+const (
+	deviceDirection = "device"
+	relayDirection  = "relay"
+)
+
+type schemaFile struct {
+	Defs orderedDefs `json:"$defs"`
+}
+
+type schemaDef struct {
+	Description string       `json:"description"`
+	Direction   string       `json:"x-direction"`
+	Since       int          `json:"x-since"`
+	Properties  orderedProps `json:"properties"`
+	Required    []string     `json:"required"`
+}
+
+type schemaProp struct {
+	Type             string   `json:"type"`
+	Format           string   `json:"format"`
+	ContentEncoding  string   `json:"contentEncoding"`
+	Description      string   `json:"description"`
+	Const            string   `json:"const"`
+	Enum             []string `json:"enum"`
+	EnumDescriptions []string `json:"x-enum-descriptions"`
+	Ref              string   `json:"$ref"`
+	Since            int      `json:"x-since"`
+	// AdditionalProperties is the type of the values of an object with arbitrary keys
+	AdditionalProperties *schemaProp `json:"additionalProperties"`
+}
+
+type namedDef struct {
+	Name string
+	Def  schemaDef
+}
+
+type namedProp struct {
+	Name string
+	Prop schemaProp
+}
+
+// orderedDefs and orderedProps keep the order definitions and properties are written in, so the
+// generated code follows the schema
+type orderedDefs []namedDef
+type orderedProps []namedProp
+
+func (d *orderedDefs) UnmarshalJSON(data []byte) error {
+	return decodeOrdered(data, func(name string, raw json.RawMessage) error {
+		var def schemaDef
+		if err := json.Unmarshal(raw, &def); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*d = append(*d, namedDef{Name: name, Def: def})
+		return nil
+	})
+}
+
+func (p *orderedProps) UnmarshalJSON(data []byte) error {
+	return decodeOrdered(data, func(name string, raw json.RawMessage) error {
+		var prop schemaProp
+		if err := json.Unmarshal(raw, &prop); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*p = append(*p, namedProp{Name: name, Prop: prop})
+		return nil
+	})
+}
+
+func decodeOrdered(data []byte, member func(name string, raw json.RawMessage) error) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return fmt.Errorf("expected an object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		if err := member(tok.(string), raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Kinds of fields
+const (
+	stringKind = "string"
+	intKind    = "int"
+	int64Kind  = "int64"
+	boolKind   = "bool"
+	bytesKind  = "bytes"
+	refKind    = "ref"
+	// mapKind is an object of string values with arbitrary keys
+	mapKind = "map"
+)
+
+// protocol is the schema resolved into what the generators need
+type protocol struct {
+	// Structs are all definitions, messages and the types they reference, in schema order
+	Structs []*structDef
+}
+
+type structDef struct {
+	Name        string
+	Description string
+	// Direction is empty for types that are only referenced by messages
+	Direction string
+	// Since is the protocol version the message was introduced in
+	Since int
+	// Types are the message types sharing this struct
+	Types  []messageType
+	Fields []field
+}
+
+type messageType struct {
+	Value       string
+	Description string
+}
+
+type field struct {
+	JSON        string
+	Description string
+	Enum        []string
+	Kind        string
+	// Ref is the struct a ref field holds
+	Ref      *structDef
+	Optional bool
+	// Since is the protocol version the field was introduced in; older devices need not send it
+	Since int
+}
+
+func parseSchema(data []byte) (*protocol, error) {
+	var f schemaFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+
+	p := &protocol{}
+	byName := make(map[string]*structDef)
+	for _, d := range f.Defs {
+		s := &structDef{Name: d.Name, Description: d.Def.Description, Direction: d.Def.Direction, Since: max(d.Def.Since, 1)}
+		if s.Direction != "" && s.Direction != deviceDirection && s.Direction != relayDirection {
+			return nil, fmt.Errorf("%s: invalid x-direction %q", d.Name, s.Direction)
+		}
+		byName[d.Name] = s
+		p.Structs = append(p.Structs, s)
+	}
+
+	for i, d := range f.Defs {
+		s := p.Structs[i]
+		required := make(map[string]bool)
+		for _, r := range d.Def.Required {
+			required[r] = true
+		}
+		for _, np := range d.Def.Properties {
+			prop := np.Prop
+			if np.Name == "type" {
+				s.Types = messageTypes(prop)
+				continue
+			}
+			fd := field{JSON: np.Name, Description: prop.Description, Enum: prop.Enum, Optional: !required[np.Name], Since: max(prop.Since, s.Since)}
+			switch {
+			case prop.Ref != "":
+				ref, ok := byName[strings.TrimPrefix(prop.Ref, "#/$defs/")]
+				if !ok {
+					return nil, fmt.Errorf("%s.%s: unknown reference %s", d.Name, np.Name, prop.Ref)
+				}
+				fd.Kind, fd.Ref = refKind, ref
+			case prop.Type == "string" && prop.ContentEncoding == "base64":
+				fd.Kind = bytesKind
+			case prop.Type == "string":
+				fd.Kind = stringKind
+			case prop.Type == "integer" && prop.Format == "int64":
+				fd.Kind = int64Kind
+			case prop.Type == "integer":
+				fd.Kind = intKind
+			case prop.Type == "boolean":
+				fd.Kind = boolKind
+			case prop.Type == "object" && prop.AdditionalProperties != nil && prop.AdditionalProperties.Type == "string":
+				fd.Kind = mapKind
+			default:
+				return nil, fmt.Errorf("%s.%s: unsupported property type %q", d.Name, np.Name, prop.Type)
+			}
+			s.Fields = append(s.Fields, fd)
+		}
+		if s.Direction != "" && len(s.Types) == 0 {
+			return nil, fmt.Errorf("%s: messages need a type const or enum", d.Name)
+		}
+	}
+	return p, nil
+}
+
+func messageTypes(prop schemaProp) []messageType {
+	if prop.Const != "" {
+		return []messageType{{Value: prop.Const, Description: prop.Description}}
+	}
+	types := make([]messageType, len(prop.Enum))
+	for i, v := range prop.Enum {
+		types[i].Value = v
+		if i < len(prop.EnumDescriptions) {
+			types[i].Description = prop.EnumDescriptions[i]
+		}
+	}
+	return types
+}
+
+// messages returns the structs sent in the given direction
+func (p *protocol) messages(direction string) []*structDef {
+	var out []*structDef
+	for _, s := range p.Structs {
+		if s.Direction == direction {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// initialisms are kept upper case in Go names
+var initialisms = map[string]bool{"id": true, "url": true, "ip": true}
+
+// camel turns snake_case and dotted names into CamelCase
+func camel(name string) string {
+	var b strings.Builder
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '.' }) {
+		if initialisms[part] {
+			b.WriteString(strings.ToUpper(part))
+			continue
+		}
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+// snake turns camelCase into snake_case
+func snake(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func exported(name string) string {
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// enumComment renders the allowed values of an enum, e.g. "a" or "b"
+func enumComment(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = fmt.Sprintf("%q", v)
+	}
+	if len(quoted) == 1 {
+		return quoted[0]
+	}
+	return strings.Join(quoted[:len(quoted)-1], ", ") + " or " + quoted[len(quoted)-1]
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
-	"github.com/pixaverse-studios/websocket-server/internal/config"
-	"github.com/pixaverse-studios/websocket-server/internal/websocket"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/server"
 )
 
 func main() {
@@ -24,13 +26,10 @@ func main() {
 		log.Fatalf("Invalid configuration: %v", err)
 	}
 
-	// Create WebSocket handler
-	handler := websocket.NewHandler(cfg)
-
-	// Set up HTTP server
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", cfg.Server.Port),
-		Handler: handler,
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	srv, err := server.New(cfg, server.WithLogger(logger))
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
 	}
 
 	// Set up graceful shutdown
@@ -38,15 +37,7 @@ func main() {
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
-		log.Printf("Starting server on port %d", cfg.Server.Port)
-		var err error
-		if cfg.Server.EnableTLS {
-			log.Printf("TLS enabled, using certificate: %s", cfg.Server.CertFile)
-			err = server.ListenAndServeTLS(cfg.Server.CertFile, cfg.Server.KeyFile)
-		} else {
-			err = server.ListenAndServe()
-		}
-		if err != nil && err != http.ErrServerClosed {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Failed to start server: %v", err)
 		}
 	}()
@@ -55,8 +46,16 @@ func main() {
 	<-stop
 	log.Println("Shutting down server...")
 
-	// Perform cleanup
-	if err := server.Close(); err != nil {
+	// Let the mesh route around the relay and the sessions finish their answers, then close
+	// whatever is left
+	drainTimeout, _ := time.ParseDuration(cfg.Shutdown.DrainTimeout)
+	failDelay, _ := time.ParseDuration(cfg.Shutdown.HealthFailDelay)
+	ctx, cancel := context.WithTimeout(context.Background(), failDelay+drainTimeout+15*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error during server shutdown: %v", err)
+	}
+	if err := srv.Close(); err != nil {
 		log.Printf("Error during server shutdown: %v", err)
 	}
 }
@@ -0,0 +1,87 @@
+// Command simulate plays scripted conversations against a running relay and exits with status 1 if
+// any answer misses its expectations. It writes a JUnit report for CI with -report.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/simulator"
+)
+
+func main() {
+	defaults := config.Default().Audio
+	url := flag.String("url", "ws://localhost:8080/", "websocket URL of the relay")
+	report := flag.String("report", "", "write a JUnit XML report to this file")
+	sampleRate := flag.Int("sample-rate", defaults.SampleRate, "the relay's audio.sample_rate")
+	channels := flag.Int("channels", defaults.Channels, "the relay's audio.channels")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] script.yaml...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var scripts []*simulator.Script
+	for _, path := range flag.Args() {
+		script, err := simulator.LoadScript(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scripts = append(scripts, script)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	runner := simulator.New(*url, simulator.WithLogger(logger), simulator.WithAudioFormat(*sampleRate, *channels))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var results []simulator.ScriptResult
+	failed := 0
+	for _, script := range scripts {
+		result := runner.Run(ctx, script)
+		results = append(results, result)
+		for _, turn := range result.Turns {
+			switch {
+			case turn.Err != nil:
+				fmt.Fprintf(os.Stderr, "ERROR %s / %s: %v\n", result.Script, turn.Name, turn.Err)
+			case turn.Failed():
+				for _, f := range turn.Failures {
+					fmt.Fprintf(os.Stderr, "FAIL  %s / %s: %s\n", result.Script, turn.Name, f)
+				}
+			default:
+				fmt.Fprintf(os.Stderr, "ok    %s / %s (%s)\n", result.Script, turn.Name, turn.Latency)
+			}
+		}
+		if result.Failed() {
+			failed++
+		}
+	}
+
+	if *report != "" {
+		f, err := os.Create(*report)
+		if err != nil {
+			log.Fatalf("Could not write report: %v", err)
+		}
+		if err := simulator.WriteJUnit(f, results); err != nil {
+			log.Fatalf("Could not write report: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatalf("Could not write report: %v", err)
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d scripts failed\n", failed, len(results))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,77 @@
+// Command soak runs the relay against the mock provider and synthetic devices for a long time and
+// exits with status 1 if the process' heap, goroutines or file descriptors keep growing.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/ai"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/soak"
+)
+
+func main() {
+	duration := flag.Duration("duration", 24*time.Hour, "how long to run")
+	devices := flag.Int("devices", 10, "number of synthetic devices connected at the same time")
+	session := flag.Duration("session", 5*time.Minute, "how long each device stays connected before reconnecting")
+	sample := flag.Duration("sample", time.Minute, "how often the process is sampled")
+	warmup := flag.Duration("warmup", 10*time.Minute, "how long to run before the baseline is sampled")
+	maxHeap := flag.Uint64("max-heap-growth-mb", 64, "heap growth in MiB reported as a leak, 0 disables the check")
+	maxGoroutines := flag.Int("max-goroutine-growth", 50, "goroutine growth reported as a leak, 0 disables the check")
+	maxFDs := flag.Int("max-fd-growth", 50, "file descriptor growth reported as a leak, 0 disables the check")
+	var links []soak.Link
+	flag.Func("link", "simulated network of the devices, a profile (gprs, 2g, 3g, 4g) or settings like up=64,down=128,latency=300ms,jitter=100ms,loss=0.02; repeat to spread devices over several", func(spec string) error {
+		l, err := soak.ParseLink(spec)
+		links = append(links, l)
+		return err
+	})
+	flag.Parse()
+
+	// the soak test always talks to the mock provider, so no provider credentials are needed
+	os.Setenv("PIXA_AI_PROVIDER", ai.MockProvider)
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if err := config.ValidateConfig(cfg); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	runner := soak.New(cfg,
+		soak.WithLogger(logger),
+		soak.WithDevices(*devices),
+		soak.WithSessionLength(*session),
+		soak.WithSampleInterval(*sample),
+		soak.WithWarmup(*warmup),
+		soak.WithLinks(links...),
+		soak.WithThresholds(soak.Thresholds{
+			HeapBytes:  *maxHeap << 20,
+			Goroutines: *maxGoroutines,
+			FDs:        *maxFDs,
+		}),
+	)
+
+	// an interrupt ends the run early but still checks for leaks
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report, err := runner.Run(ctx, *duration)
+	if err != nil {
+		log.Fatalf("Soak test failed to run: %v", err)
+	}
+	if report.Failed() {
+		for _, f := range report.Failures {
+			fmt.Fprintln(os.Stderr, "LEAK:", f)
+		}
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "No leaks detected over %d connections, %d sessions failed\n", report.Connections, report.SessionErrors)
+}
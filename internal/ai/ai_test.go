@@ -1,15 +0,0 @@
-package ai
-
-import "testing"
-
-func TestAIProcessing(t *testing.T) {
-	t.Run("test AI model integration", func(t *testing.T) {
-		// TODO: Implement AI model integration test
-		t.Skip("Test not implemented")
-	})
-
-	t.Run("test response processing", func(t *testing.T) {
-		// TODO: Implement response processing test
-		t.Skip("Test not implemented")
-	})
-}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"sync"
+	"sync/atomic"
 )
 
 // this data structure can be used whenever you have a stream of random length byte arrays coming to you, and you want to
@@ -12,8 +13,19 @@ type BufferSizeController struct {
 	buffer                bytes.Buffer
 	mutex                 sync.Mutex
 	outputByteArrayLength int
+	// size mirrors buffer.Len() so it can be read while a send to outChan holds the mutex
+	size atomic.Int64
 
-	outChan chan []byte
+	outChan chan Chunk
+}
+
+// Chunk is a fixed length byte array taken from the stream, or what was left in the buffer when it
+// was flushed
+type Chunk struct {
+	Data []byte
+	// Last is set on the chunk sent by Flush, the end of the stream written so far, even when it is
+	// as long as the other chunks or empty
+	Last bool
 }
 
 func NewBufferSizeController(capacity int) BufferSizeController {
@@ -22,24 +34,39 @@ func NewBufferSizeController(capacity int) BufferSizeController {
 		mutex:                 sync.Mutex{},
 		outputByteArrayLength: capacity,
 
-		outChan: make(chan []byte),
+		outChan: make(chan Chunk),
 	}
 }
 
-func (ab *BufferSizeController) GetOutputChannel() <-chan []byte {
+func (ab *BufferSizeController) GetOutputChannel() <-chan Chunk {
 	return ab.outChan
 }
 
+// Len returns the number of bytes held in the internal buffer, waiting to be sent to the outChan
+func (ab *BufferSizeController) Len() int {
+	return int(ab.size.Load())
+}
+
 // this basically sends the leftover data from the internal buffer to the outChan
 func (ab *BufferSizeController) Flush() error {
 	ab.mutex.Lock()
 	defer ab.mutex.Unlock()
 
-	ab.outChan <- ab.buffer.Bytes()
+	ab.outChan <- Chunk{Data: ab.buffer.Bytes(), Last: true}
 	ab.buffer.Reset()
+	ab.size.Store(0)
 	return nil
 }
 
+// this drops whatever is left in the internal buffer without sending it
+func (ab *BufferSizeController) Reset() {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	ab.buffer.Reset()
+	ab.size.Store(0)
+}
+
 // this evaluates the state of the buffer makes sure that the buffer size is less than outputByteArrayLength
 // by making max possible number of chunks from the internal buffer and sends it to the outChan
 func (ab *BufferSizeController) makeChunksFromBuffer() error {
@@ -49,8 +76,9 @@ func (ab *BufferSizeController) makeChunksFromBuffer() error {
 		if err != nil {
 			return fmt.Errorf("Could not read bytes: %s", err)
 		}
+		ab.size.Store(int64(ab.buffer.Len()))
 		// send the data to the outChan
-		ab.outChan <- outBuf
+		ab.outChan <- Chunk{Data: outBuf}
 	}
 	return nil
 }
@@ -60,6 +88,7 @@ func (ab *BufferSizeController) processData(data []byte) error {
 	defer ab.mutex.Unlock()
 
 	ab.buffer.Write(data)
+	ab.size.Store(int64(ab.buffer.Len()))
 	return ab.makeChunksFromBuffer()
 }
 
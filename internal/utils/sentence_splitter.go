@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"strings"
+	"unicode"
+)
+
+// abbreviations that end in a period without ending the sentence
+var abbreviations = map[string]bool{
+	"mr": true, "mrs": true, "ms": true, "dr": true, "prof": true, "sr": true, "jr": true,
+	"st": true, "vs": true, "etc": true, "e.g": true, "i.e": true, "no": true, "approx": true,
+}
+
+// this data structure can be used whenever you have a stream of text fragments (like transcript deltas) and want
+// to get whole sentences out of it as soon as their end is known.
+// A sentence ends at . ! ? or … followed by whitespace, or immediately at the CJK full stops 。！？
+type SentenceSplitter struct {
+	pending []rune
+}
+
+// Write appends text to the splitter and returns the sentences it completed
+func (s *SentenceSplitter) Write(text string) []string {
+	s.pending = append(s.pending, []rune(text)...)
+
+	var sentences []string
+	start := 0
+	for i := 0; i < len(s.pending); i++ {
+		end, ok := s.boundary(i)
+		if !ok {
+			continue
+		}
+		if sentence := strings.TrimSpace(string(s.pending[start:end])); sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+		start = end
+		i = end - 1
+	}
+	s.pending = append([]rune(nil), s.pending[start:]...)
+	return sentences
+}
+
+// Flush returns whatever text is left in the splitter as the final sentence
+func (s *SentenceSplitter) Flush() string {
+	sentence := strings.TrimSpace(string(s.pending))
+	s.pending = nil
+	return sentence
+}
+
+// boundary reports whether a sentence ends at the punctuation at index i, returning the index right after it
+func (s *SentenceSplitter) boundary(i int) (int, bool) {
+	r := s.pending[i]
+	switch r {
+	case '。', '！', '？':
+		return s.skipClosers(i + 1), true
+	case '.', '!', '?', '…':
+	default:
+		return 0, false
+	}
+
+	end := s.skipClosers(i + 1)
+	// until the next character arrives we can't tell "3." from "3.14" or the end of a sentence
+	if end >= len(s.pending) || !unicode.IsSpace(s.pending[end]) {
+		return 0, false
+	}
+	if r == '.' && s.isAbbreviation(i) {
+		return 0, false
+	}
+	return end, true
+}
+
+// skipClosers moves past closing quotes and brackets that belong to the sentence
+func (s *SentenceSplitter) skipClosers(i int) int {
+	for i < len(s.pending) && strings.ContainsRune(`"')]}”’»`, s.pending[i]) {
+		i++
+	}
+	return i
+}
+
+// isAbbreviation reports whether the period at index i ends a known abbreviation or an initial
+func (s *SentenceSplitter) isAbbreviation(i int) bool {
+	start := i
+	for start > 0 && !unicode.IsSpace(s.pending[start-1]) {
+		start--
+	}
+	word := string(s.pending[start:i])
+	if len([]rune(word)) == 1 && unicode.IsUpper([]rune(word)[0]) {
+		return true
+	}
+	return abbreviations[strings.ToLower(strings.TrimLeft(word, `"'([{“‘«`))]
+}
@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// keepAlive returns the keepalive settings of cfg. Durations are validated with the config.
+func keepAlive(cfg config.SocketConfig) (time.Duration, net.KeepAliveConfig) {
+	if !cfg.KeepAlive {
+		return -1, net.KeepAliveConfig{}
+	}
+	idle, _ := time.ParseDuration(cfg.KeepAliveIdle)
+	interval, _ := time.ParseDuration(cfg.KeepAliveInterval)
+	return 0, net.KeepAliveConfig{Enable: true, Idle: idle, Interval: interval, Count: cfg.KeepAliveCount}
+}
+
+// tuneConn applies the buffer sizes and Nagle setting of cfg to a TCP connection
+func tuneConn(conn net.Conn, cfg config.SocketConfig) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcp.SetNoDelay(cfg.NoDelay); err != nil {
+		return err
+	}
+	if cfg.ReadBufferBytes > 0 {
+		if err := tcp.SetReadBuffer(cfg.ReadBufferBytes); err != nil {
+			return err
+		}
+	}
+	if cfg.WriteBufferBytes > 0 {
+		if err := tcp.SetWriteBuffer(cfg.WriteBufferBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Listen announces on addr like net.Listen, with the socket options of cfg applied to every
+// accepted connection
+func Listen(ctx context.Context, network, addr string, cfg config.SocketConfig) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	lc.KeepAlive, lc.KeepAliveConfig = keepAlive(cfg)
+	l, err := lc.Listen(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tunedListener{Listener: l, config: cfg}, nil
+}
+
+type tunedListener struct {
+	net.Listener
+	config config.SocketConfig
+}
+
+func (l *tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// an error would stop the server accepting; the connection works with the OS defaults
+	_ = tuneConn(conn, l.config)
+	return conn, nil
+}
+
+// DialContext returns a dial function with the socket options of cfg, for clients such as
+// websocket.Dialer that take one
+func DialContext(cfg config.SocketConfig) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := net.Dialer{}
+	d.KeepAlive, d.KeepAliveConfig = keepAlive(cfg)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := tuneConn(conn, cfg); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
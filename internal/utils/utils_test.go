@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+func TestSentenceSplitter(t *testing.T) {
+	t.Run("test streamed deltas", func(t *testing.T) {
+		var s SentenceSplitter
+		var got []string
+		for _, delta := range []string{"Hello there", ". How are", " you? The price is 3.", "50 dollars."} {
+			got = append(got, s.Write(delta)...)
+		}
+		want := []string{"Hello there.", "How are you?"}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+
+		got = s.Write(" Thanks")
+		if !reflect.DeepEqual(got, []string{"The price is 3.50 dollars."}) {
+			t.Fatalf("unexpected sentence: %q", got)
+		}
+		if rest := s.Flush(); rest != "Thanks" {
+			t.Fatalf("unexpected remainder: %q", rest)
+		}
+	})
+
+	t.Run("test abbreviations and initials", func(t *testing.T) {
+		var s SentenceSplitter
+		got := s.Write(`Dr. Smith met J. Doe, e.g. at noon. "Really?" she asked. `)
+		want := []string{"Dr. Smith met J. Doe, e.g. at noon.", `"Really?"`, "she asked."}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("test CJK punctuation", func(t *testing.T) {
+		var s SentenceSplitter
+		got := s.Write("你好。谢谢")
+		if !reflect.DeepEqual(got, []string{"你好。"}) {
+			t.Fatalf("unexpected sentences: %q", got)
+		}
+	})
+}
+
+func TestSocketOptions(t *testing.T) {
+	if d, ka := keepAlive(config.SocketConfig{}); d >= 0 || ka.Enable {
+		t.Fatalf("keepalive not disabled: %v %+v", d, ka)
+	}
+	cfg := config.SocketConfig{
+		KeepAlive:         true,
+		KeepAliveIdle:     "25s",
+		KeepAliveInterval: "5s",
+		KeepAliveCount:    3,
+		ReadBufferBytes:   64 << 10,
+		WriteBufferBytes:  64 << 10,
+		NoDelay:           true,
+	}
+	if _, ka := keepAlive(cfg); ka != (net.KeepAliveConfig{Enable: true, Idle: 25 * time.Second, Interval: 5 * time.Second, Count: 3}) {
+		t.Fatalf("keepalive configured as %+v", ka)
+	}
+
+	l, err := Listen(context.Background(), "tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	conn, err := DialContext(cfg)(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echoed %q: %v", buf, err)
+	}
+}
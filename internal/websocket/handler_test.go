@@ -1,15 +0,0 @@
-package websocket
-
-import "testing"
-
-func TestWebSocketHandler(t *testing.T) {
-	t.Run("test connection handling", func(t *testing.T) {
-		// TODO: Implement connection handling test
-		t.Skip("Test not implemented")
-	})
-
-	t.Run("test message relay", func(t *testing.T) {
-		// TODO: Implement message relay test
-		t.Skip("Test not implemented")
-	})
-}
@@ -0,0 +1,627 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/metrics"
+)
+
+func TestAIProcessing(t *testing.T) {
+	t.Run("test AI model integration", func(t *testing.T) {
+		// TODO: Implement AI model integration test
+		t.Skip("Test not implemented")
+	})
+
+	t.Run("test response processing", func(t *testing.T) {
+		// TODO: Implement response processing test
+		t.Skip("Test not implemented")
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	t.Run("test default providers", func(t *testing.T) {
+		names := NewDefaultRegistry().Names()
+		if len(names) != 3 || names[0] != AzureProvider || names[1] != MockProvider || names[2] != OpenAIProvider {
+			t.Fatalf("unexpected default providers: %v", names)
+		}
+	})
+
+	t.Run("test unknown provider", func(t *testing.T) {
+		if _, err := NewRegistry().New("missing", ProviderParams{}); err == nil {
+			t.Fatal("expected error for unknown provider")
+		}
+	})
+}
+
+func TestMockClient(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.AIConfig.Mock = config.MockConfig{TurnAfter: "100ms", ResponseLength: "200ms"}
+	c, err := NewMockClient(cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Initialize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendAudio(ctx, audio.FromPCM16(make([]byte, 3200), 16000, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []EventType
+	var played time.Duration
+	for {
+		select {
+		case e := <-c.GetEventsStream():
+			events = append(events, e.Type)
+			if e.Type != ResponseAudioDoneEventType {
+				continue
+			}
+			want := []EventType{SpeechStartedEventType, SpeechStoppedEventType, AudioBufferCommittedType,
+				InputTranscriptionCompletedType, AudioTranscriptDeltaEventType, AudioTranscriptDoneEventType, ResponseAudioDoneEventType}
+			if len(events) != len(want) {
+				t.Fatalf("unexpected events: %v", events)
+			}
+			for i := range want {
+				if events[i] != want[i] {
+					t.Fatalf("unexpected events: %v", events)
+				}
+			}
+			if played != 200*time.Millisecond {
+				t.Fatalf("expected 200ms of response audio, got %s", played)
+			}
+			return
+		case r := <-c.GetResponseStream():
+			if r.ItemID != "mock_item_1" || r.Audio.GetSampleRate() != 24000 {
+				t.Fatalf("unexpected response audio for %q at %d Hz", r.ItemID, r.Audio.GetSampleRate())
+			}
+			played += r.Audio.Duration()
+		case <-ctx.Done():
+			t.Fatalf("no response, events so far: %v", events)
+		}
+	}
+}
+
+func TestTimeoutError(t *testing.T) {
+	c, err := NewOpenAIClient(&config.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.timeoutError(OpAppend, time.Second, context.DeadlineExceeded)
+
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Op != OpAppend {
+		t.Fatalf("expected append timeout error, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected timeout error to match context.DeadlineExceeded")
+	}
+
+	other := errors.New("boom")
+	if c.timeoutError(OpAppend, time.Second, other) != other {
+		t.Fatal("expected non-timeout errors to be returned unchanged")
+	}
+}
+
+func TestNegotiateOutputFormat(t *testing.T) {
+	for _, tc := range []struct {
+		deviceRate int
+		want       AudioFormatOption
+	}{
+		{24000, PCM16Format},
+		{16000, PCM16Format},
+		{48000, PCM16Format},
+		{8000, G711ULawFormat},
+		{11025, G711ULawFormat},
+	} {
+		got := NegotiateOutputFormat(RealtimeAudioFormats, tc.deviceRate, audio.PCM16BIT)
+		if got != tc.want {
+			t.Errorf("device rate %d: got %s, want %s", tc.deviceRate, got.Name, tc.want.Name)
+		}
+	}
+}
+
+func TestNegotiateInputFormat(t *testing.T) {
+	for _, tc := range []struct {
+		codec      string
+		deviceRate int
+		channels   int
+		want       AudioFormatOption
+	}{
+		{"g711_ulaw", 8000, 1, G711ULawFormat},
+		{"g711_alaw", 8000, 1, G711ALawFormat},
+		// G.711 at other rates or in stereo is decoded and sent as pcm16
+		{"g711_ulaw", 16000, 1, PCM16Format},
+		{"g711_alaw", 8000, 2, PCM16Format},
+		{"opus", 24000, 1, PCM16Format},
+	} {
+		if got := NegotiateInputFormat(RealtimeAudioFormats, tc.codec, tc.deviceRate, tc.channels); got != tc.want {
+			t.Errorf("%s at %d Hz: got %s, want %s", tc.codec, tc.deviceRate, got.Name, tc.want.Name)
+		}
+	}
+
+	// audio sent in G.711 is resampled to its 8khz and compressed
+	a := audio.FromPCM16(audio.Int16ToPCM(make([]int16, 480)), 24000, 1)
+	if data := G711ALawFormat.Encode(a); len(data) != 160 || data[0] != 0xD5 {
+		t.Fatalf("unexpected A-law audio of %d bytes", len(data))
+	}
+	data := audio.Int16ToPCM([]int16{1, -1, 512})
+	if out := PCM16Format.Encode(audio.FromPCM16(data, 24000, 1)); &out[0] != &data[0] {
+		t.Fatal("expected 24kHz pcm16 device audio to be passed through")
+	}
+
+	// 44.1 kHz audio sent in 10ms chunks of 441 samples, which resample to 240 each
+	c := &OpenAIClient{session: SessionConfig{InputAudioFormat: PCM16Format}}
+	var samples int
+	for i := 0; i < 100; i++ {
+		a := c.resample(audio.FromPCM16(make([]byte, 441*2), 44100, 1))
+		samples += len(PCM16Format.Encode(a)) / 2
+	}
+	if samples < 23999 || samples > 24000 {
+		t.Fatalf("resampled a second of 44.1 kHz audio to %d samples", samples)
+	}
+}
+
+func TestDecodePassThrough(t *testing.T) {
+	data := audio.Int16ToPCM([]int16{1, -1, 512})
+	a := PCM16Format.Decode(data)
+	if out := a.AsPCM16(); &out[0] != &data[0] {
+		t.Fatal("expected 24kHz pcm16 provider audio to be passed through")
+	}
+}
+
+func TestAppendTracking(t *testing.T) {
+	t.Run("test ack window", func(t *testing.T) {
+		tracker := newAppendTracker(time.Second)
+		start := time.Unix(0, 0)
+		first := tracker.track("a", 1, start)
+		tracker.track("b", 1, start.Add(500*time.Millisecond))
+		if n := tracker.settle(start.Add(time.Second)); n != 1 {
+			t.Fatalf("expected 1 acknowledged chunk, got %d", n)
+		}
+		if _, ok := tracker.take(first); ok {
+			t.Fatal("acknowledged chunk is still pending")
+		}
+		if pending := tracker.drain(); len(pending) != 1 || pending[0].audio != "b" {
+			t.Fatalf("unexpected pending chunks: %+v", pending)
+		}
+	})
+
+	t.Run("test transient rejection is re-sent", func(t *testing.T) {
+		received := make(chan map[string]string, 4)
+		upgrader := websocket.Upgrader{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			for _, errType := range []string{"server_error", "invalid_request_error"} {
+				var event map[string]string
+				if err := conn.ReadJSON(&event); err != nil {
+					return
+				}
+				received <- event
+				conn.WriteJSON(ErrorEvent{
+					EventBase: EventBase{Type: ErrorEventType},
+					Error:     ErrorDetail{Type: errType, Message: "failed", EventID: event["event_id"]},
+				})
+			}
+			conn.ReadMessage()
+		}))
+		defer srv.Close()
+
+		cfg := &config.Config{}
+		cfg.Azure.ServiceURL = "ws" + strings.TrimPrefix(srv.URL, "http")
+		cfg.AIConfig.AppendAckWindow = "1m"
+		reg := metrics.NewRegistry()
+		c, err := NewOpenAIClient(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)), NewMetrics(reg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := c.connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		go c.watchServerEvents(ctx)
+
+		if err := c.AppendToAudioBuffer(ctx, "chunk"); err != nil {
+			t.Fatal(err)
+		}
+		first, retry := <-received, <-received
+		if retry["audio"] != "chunk" || retry["event_id"] == first["event_id"] {
+			t.Fatalf("expected the chunk to be re-sent with a new event ID, got %v after %v", retry, first)
+		}
+		// the second rejection is not transient, so the chunk is given up on
+		want := []string{
+			`pixa_provider_appends_total{provider="azure",result="retried"} 1`,
+			`pixa_provider_appends_total{provider="azure",result="rejected"} 1`,
+		}
+		var out strings.Builder
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			out.Reset()
+			reg.WriteTo(&out)
+			if strings.Contains(out.String(), want[0]) && strings.Contains(out.String(), want[1]) {
+				break
+			}
+		}
+		for _, line := range want {
+			if !strings.Contains(out.String(), line) {
+				t.Fatalf("missing %s in\n%s", line, out.String())
+			}
+		}
+		select {
+		case event := <-received:
+			t.Fatalf("unexpected append %v", event)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("test rejection after later appends is not re-sent out of order", func(t *testing.T) {
+		received := make(chan map[string]string, 4)
+		upgrader := websocket.Upgrader{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			var first map[string]string
+			for i := 0; ; i++ {
+				var event map[string]string
+				if err := conn.ReadJSON(&event); err != nil {
+					return
+				}
+				received <- event
+				// the first chunk is rejected once the second was appended
+				if i == 0 {
+					first = event
+				} else if i == 1 {
+					conn.WriteJSON(ErrorEvent{
+						EventBase: EventBase{Type: ErrorEventType},
+						Error:     ErrorDetail{Type: "server_error", Message: "failed", EventID: first["event_id"]},
+					})
+				}
+			}
+		}))
+		defer srv.Close()
+
+		cfg := &config.Config{}
+		cfg.Azure.ServiceURL = "ws" + strings.TrimPrefix(srv.URL, "http")
+		cfg.AIConfig.AppendAckWindow = "1m"
+		reg := metrics.NewRegistry()
+		c, err := NewOpenAIClient(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)), NewMetrics(reg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := c.connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		go c.watchServerEvents(ctx)
+
+		for _, chunk := range []string{"one", "two"} {
+			if err := c.AppendToAudioBuffer(ctx, chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := `pixa_provider_appends_total{provider="azure",result="rejected"} 1`
+		var out strings.Builder
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline) && !strings.Contains(out.String(), want); time.Sleep(10 * time.Millisecond) {
+			out.Reset()
+			reg.WriteTo(&out)
+		}
+		if !strings.Contains(out.String(), want) || strings.Contains(out.String(), `result="retried"`) {
+			t.Fatalf("expected the chunk to be dropped rather than retried, got\n%s", out.String())
+		}
+		if err := c.AppendToAudioBuffer(ctx, "three"); err != nil {
+			t.Fatal(err)
+		}
+		var order []string
+		for range 3 {
+			order = append(order, (<-received)["audio"])
+		}
+		if !slices.Equal(order, []string{"one", "two", "three"}) {
+			t.Fatalf("expected the appends in order, got %v", order)
+		}
+	})
+}
+
+func TestToolResponses(t *testing.T) {
+	received := make(chan map[string]interface{}, 3)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteJSON(map[string]string{"type": "response.created"})
+		conn.WriteJSON(map[string]string{"type": "response.function_call_arguments.done", "item_id": "item_1",
+			"call_id": "call_1", "name": "order_status", "arguments": `{"order_id":"A17"}`})
+		for i := 0; i < 3; i++ {
+			var event map[string]interface{}
+			if err := conn.ReadJSON(&event); err != nil {
+				return
+			}
+			received <- event
+			// the model finishes its response, after which the next requested one may start
+			conn.WriteJSON(map[string]string{"type": "response.done"})
+		}
+		conn.ReadMessage()
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{}
+	cfg.Azure.ServiceURL = "ws" + strings.TrimPrefix(srv.URL, "http")
+	cfg.AIConfig.AppendTimeout = "5s"
+	c, err := NewOpenAIClient(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go c.watchServerEvents(ctx)
+
+	e := <-c.GetEventsStream()
+	if e.Type != FunctionCallEventType || e.Call == nil || e.Call.CallID != "call_1" || e.Call.Name != "order_status" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	// both responses wait for the model to finish the one that called the tool
+	if err := c.Announce(ctx, "say you are checking"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendToolResult(ctx, "call_1", `{"status":"shipped"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	output := <-received
+	if output["type"] != "conversation.item.create" || output["item"].(map[string]interface{})["call_id"] != "call_1" {
+		t.Fatalf("expected the tool output first, got %v", output)
+	}
+	announce := <-received
+	if announce["type"] != "response.create" || announce["response"].(map[string]interface{})["instructions"] != "say you are checking" {
+		t.Fatalf("expected the announcement, got %v", announce)
+	}
+	result := <-received
+	if result["type"] != "response.create" || result["response"] != nil {
+		t.Fatalf("expected the response with the result, got %v", result)
+	}
+}
+
+func TestTenantTranscription(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.AIConfig.InputTranscriptionModel = "whisper-1"
+	cfg.AIConfig.Transcription = config.TranscriptionConfig{Language: "en", Phrases: []string{"Pixa"}}
+	cfg.Tenants = map[string]config.TenantConfig{
+		"acme": {Transcription: config.TranscriptionConfig{Prompt: "A burger restaurant.", Phrases: []string{"McFlurry", "Pixa"}}},
+	}
+
+	for tenantID, want := range map[string]string{
+		"":     "Vocabulary: Pixa.",
+		"ACME": "A burger restaurant. Vocabulary: Pixa, McFlurry.",
+	} {
+		c, err := NewDefaultRegistry().New(AzureProvider, ProviderParams{Config: cfg, TenantID: tenantID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := c.(*OpenAIClient).SessionConfig().Transcription
+		if tr.Model != "whisper-1" || tr.Language != "en" || TranscriptionPrompt(tr) != want {
+			t.Errorf("tenant %q: unexpected transcription %+v", tenantID, tr)
+		}
+	}
+}
+
+func TestTenantProxy(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage()
+	}))
+	defer srv.Close()
+
+	tunnels := make(chan string, 2)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		if user, pass, ok := (&http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}).BasicAuth(); !ok || user != "relay" || pass != "secret" {
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tunnels <- r.Host
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	}))
+	defer proxy.Close()
+
+	cfg := &config.Config{}
+	cfg.Azure.ServiceURL = "ws" + strings.TrimPrefix(srv.URL, "http")
+	cfg.Tenants = map[string]config.TenantConfig{
+		"acme": {Proxy: config.ProxyConfig{URL: proxy.URL, Username: "relay", Password: "secret"}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, tenantID := range []string{"", "ACME"} {
+		c, err := NewDefaultRegistry().New(AzureProvider, ProviderParams{Config: cfg, TenantID: tenantID, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.(*OpenAIClient).connect(ctx); err != nil {
+			t.Fatalf("tenant %q: %v", tenantID, err)
+		}
+		c.Close()
+	}
+	if len(tunnels) != 1 || <-tunnels != strings.TrimPrefix(srv.URL, "http://") {
+		t.Fatal("only the tenant's connection should go through its proxy")
+	}
+}
+
+func TestTenantRegion(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Azure = config.AzureConfig{ServiceURL: "wss://us.example.com/realtime", OpenAIKey: "global"}
+	cfg.OpenAI.ServiceURL = "wss://api.openai.com/v1/realtime"
+	cfg.Regions = map[string]config.RegionConfig{
+		"eu": {Azure: config.AzureConfig{ServiceURL: "wss://eu.example.com/realtime"}},
+	}
+	cfg.Tenants = map[string]config.TenantConfig{"acme": {Region: "EU"}}
+
+	for tenantID, want := range map[string]string{"": "wss://us.example.com/realtime", "acme": "wss://eu.example.com/realtime"} {
+		c, err := NewDefaultRegistry().New(AzureProvider, ProviderParams{Config: cfg, TenantID: tenantID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if oc := c.(*OpenAIClient); oc.url != want || oc.headers.Get("api-key") != "global" {
+			t.Errorf("tenant %q: connecting to %s", tenantID, oc.url)
+		}
+	}
+	// the region has no OpenAI endpoint, so the tenant's sessions must not fall back to the global one
+	if _, err := NewDefaultRegistry().New(OpenAIProvider, ProviderParams{Config: cfg, TenantID: "acme"}); err == nil {
+		t.Fatal("expected a provider without an endpoint in the region to fail")
+	}
+}
+
+func TestOpenAIRealtime(t *testing.T) {
+	requests := make(chan *http.Request, 2)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		requests <- r
+		conn.ReadMessage()
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{}
+	cfg.OpenAI = config.OpenAIConfig{
+		APIKey:     "sk-test",
+		ServiceURL: "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/realtime",
+		Model:      "gpt-4o-realtime-preview",
+		Project:    "proj_relay",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, model := range []string{"", "gpt-4o-mini-realtime-preview"} {
+		c, err := NewDefaultRegistry().New(OpenAIProvider, ProviderParams{Config: cfg, Model: model, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.(*OpenAIClient).connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+
+		r := <-requests
+		if model == "" {
+			model = cfg.OpenAI.Model
+		}
+		if got := r.URL.Query().Get("model"); r.URL.Path != "/v1/realtime" || got != model {
+			t.Errorf("expected model %q at /v1/realtime, got %q at %s", model, got, r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer sk-test" || r.Header.Get("OpenAI-Beta") != "realtime=v1" || r.Header.Get("OpenAI-Project") != "proj_relay" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		if r.Header.Get("api-key") != "" || r.Header.Get("OpenAI-Organization") != "" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+	}
+}
+
+func TestFrameLog(t *testing.T) {
+	elided := string(ElideAudio([]byte(`{"type":"response.audio_transcript.delta","delta":"hi","item":{"content":[{"type":"input_audio","audio":"AAAA"}]}}`)))
+	if want := `{"delta":"hi","item":{"content":[{"audio":"[3 bytes elided]","type":"input_audio"}]},"type":"response.audio_transcript.delta"}`; elided != want {
+		t.Fatalf("expected transcripts kept and audio elided, got %s", elided)
+	}
+	if got := string(ElideAudio([]byte("not json"))); got != `"not json"` {
+		t.Fatalf("expected frames that are not JSON as strings, got %s", got)
+	}
+
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage()
+		conn.WriteJSON(map[string]string{"type": "response.audio.delta", "item_id": "item_1", "delta": "AAAAAAAA"})
+		conn.ReadMessage()
+	}))
+	defer srv.Close()
+
+	var log strings.Builder
+	cfg := &config.Config{}
+	cfg.Azure.ServiceURL = "ws" + strings.TrimPrefix(srv.URL, "http")
+	cfg.AIConfig.AppendTimeout = "5s"
+	c, err := NewDefaultRegistry().New(AzureProvider, ProviderParams{Config: cfg, Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), FrameLog: slog.New(slog.NewJSONHandler(&log, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := c.(*OpenAIClient)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.watchServerEvents(ctx)
+	if err := client.AppendToAudioBuffer(ctx, "AAAAAAAAAAAA"); err != nil {
+		t.Fatal(err)
+	}
+	<-client.GetResponseStream()
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a sent and a received frame, got %q", log.String())
+	}
+	for i, want := range []string{`"direction":"sent","frame":{"audio":"[9 bytes elided]"`, `"direction":"received","frame":{"delta":"[6 bytes elided]"`} {
+		if !strings.Contains(lines[i], want) || !strings.Contains(lines[i], `"provider":"azure"`) {
+			t.Errorf("expected %s in %s", want, lines[i])
+		}
+	}
+}
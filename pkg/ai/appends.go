@@ -0,0 +1,104 @@
+package ai
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Outcomes of an appended audio chunk, as counted in pixa_provider_appends_total
+const (
+	// AppendAcknowledged chunks were not rejected within the ack window
+	AppendAcknowledged = "acknowledged"
+	// AppendRetried chunks were rejected with a transient error and sent again
+	AppendRetried = "retried"
+	// AppendRejected chunks were rejected for good, ran out of retries, or were rejected after later
+	// chunks were sent, so that they could not be sent again in order
+	AppendRejected = "rejected"
+	// AppendUnacknowledged chunks were still within the ack window when the connection ended, so
+	// whether the provider kept them is unknown
+	AppendUnacknowledged = "unacknowledged"
+)
+
+// maxAppendAttempts bounds how often a chunk is sent before it is given up on
+const maxAppendAttempts = 3
+
+// pendingAppend is an audio chunk the provider has not acknowledged yet
+type pendingAppend struct {
+	eventID  string
+	audio    string
+	sentAt   time.Time
+	attempts int
+}
+
+// appendTracker correlates appended audio chunks with the errors the provider reports for them.
+// The realtime API does not acknowledge appends, it only reports errors naming the event ID of the
+// append that caused them, so a chunk counts as acknowledged once it has been pending for the ack
+// window without an error.
+type appendTracker struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	nextID int
+	// pending is ordered by sentAt
+	pending []pendingAppend
+}
+
+func newAppendTracker(window time.Duration) *appendTracker {
+	return &appendTracker{window: window}
+}
+
+// track registers a chunk about to be sent and returns the event ID to send it with
+func (t *appendTracker) track(audio string, attempts int, now time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	id := "append_" + strconv.Itoa(t.nextID)
+	t.pending = append(t.pending, pendingAppend{eventID: id, audio: audio, sentAt: now, attempts: attempts})
+	return id
+}
+
+// forget removes a chunk that could not be sent at all
+func (t *appendTracker) forget(eventID string) {
+	t.take(eventID)
+}
+
+// take removes and returns the pending chunk sent with eventID
+func (t *appendTracker) take(eventID string) (pendingAppend, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, p := range t.pending {
+		if p.eventID == eventID {
+			t.pending = append(t.pending[:i], t.pending[i+1:]...)
+			return p, true
+		}
+	}
+	return pendingAppend{}, false
+}
+
+// settle acknowledges the chunks that have been pending for the ack window and returns how many
+func (t *appendTracker) settle(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for n < len(t.pending) && now.Sub(t.pending[n].sentAt) >= t.window {
+		n++
+	}
+	t.pending = append(t.pending[:0], t.pending[n:]...)
+	return n
+}
+
+// drain returns and forgets the chunks still pending
+func (t *appendTracker) drain() []pendingAppend {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pending := t.pending
+	t.pending = nil
+	return pending
+}
+
+// retryable reports whether an error the provider reported for an append is worth sending the
+// chunk again for: server side failures and rate limits are, malformed requests are not
+func retryable(detail ErrorDetail) bool {
+	return detail.Type == "server_error" || detail.Code == "rate_limit_exceeded"
+}
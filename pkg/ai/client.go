@@ -0,0 +1,83 @@
+package ai
+
+import (
+	"context"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// This package provides an interface to interact with the Speech-to-Speech LLM.
+
+// ResponseAudio is a chunk of the model's audio response
+type ResponseAudio struct {
+	// ItemID is the conversation item the audio belongs to
+	ItemID string
+	Audio  audio.Audio
+}
+
+type AIClient interface {
+	// Initialize configures the LLM and initalizes the communication channel with the LLM
+	Initialize(context.Context) error
+	// GetResponseStream returns a channel through which the LLM responses are streamed
+	GetResponseStream() <-chan ResponseAudio
+	// GetEventsStream returns a channel through which important model events (speech started, response done etc.) are streamed
+	GetEventsStream() <-chan Event
+	// Errors returns a channel which receives the error that ended the connection with the LLM, e.g. a *TimeoutError
+	Errors() <-chan error
+	// SendAudio is used to send audio packets to the LLM. It gives up once ctx is done or the append timeout expires.
+	SendAudio(context.Context, audio.Audio) error
+	// Truncate cuts the audio of an assistant item at audioEndMs, so the model's view of the conversation matches what the user actually heard
+	Truncate(ctx context.Context, itemID string, audioEndMs int64) error
+	// Close closes the connection with the LLM
+	Close()
+}
+
+// Responder is implemented by clients that can leave creating responses to the relay. When the
+// session is configured with ManualResponses, the model waits after each user turn until the relay
+// either asks for a response or answers the turn itself, as FAQ mode does with cached answers.
+type Responder interface {
+	// CreateResponse asks the model to respond to the user's last turn
+	CreateResponse(ctx context.Context) error
+	// AddAnswer adds an answer the relay gave in the model's place to the conversation
+	AddAnswer(ctx context.Context, text string) error
+}
+
+// ToolCaller is implemented by clients whose model can call the relay's tools, which are announced
+// in the session's Tools. Calls arrive as FunctionCallEventType events.
+type ToolCaller interface {
+	// SendToolResult gives the model the output of a call and has it respond with the result
+	SendToolResult(ctx context.Context, callID, output string) error
+	// Announce has the model say something following instructions, in its own words, such as
+	// that it is still working on a call
+	Announce(ctx context.Context, instructions string) error
+}
+
+// HistoryItem is a message of the conversation so far, given to a new model session
+type HistoryItem struct {
+	// Role is "user" or "assistant"
+	Role string
+	Text string
+}
+
+// HistoryLoader is implemented by clients whose conversation can be seeded with the messages of
+// an earlier model session, so a session switched to another model or persona, or reconnected,
+// keeps its context
+type HistoryLoader interface {
+	// LoadHistory adds the messages to the conversation, oldest first, without responding
+	LoadHistory(ctx context.Context, items []HistoryItem) error
+}
+
+// ContextAdder is implemented by clients that can tell the model about the circumstances of the
+// user's next turn, such as metadata sent by the device, without it being part of what was said
+type ContextAdder interface {
+	// AddContext adds text to the conversation as a system message
+	AddContext(ctx context.Context, text string) error
+}
+
+// EndpointingUpdater is implemented by clients whose turn detection can be tuned during the
+// session, as calibration to the noise around the device does
+type EndpointingUpdater interface {
+	// UpdateEndpointing replaces the session's endpointing settings
+	UpdateEndpointing(ctx context.Context, e config.EndpointingConfig) error
+}
@@ -0,0 +1,42 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pixaerrors "github.com/pixaverse-studios/websocket-server/pkg/errors"
+)
+
+// Provider operations that are bounded by a timeout
+const (
+	OpConnect  = "connect"
+	OpAppend   = "append"
+	OpResponse = "response"
+)
+
+// TimeoutError is returned when a provider operation does not complete within its configured timeout
+type TimeoutError struct {
+	Op string
+	// Limit is the timeout that was exceeded
+	Limit time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("provider %s timed out after %s", e.Op, e.Limit)
+}
+
+// Timeout reports that the error is a timeout, matching the net.Error convention
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// ErrorCode puts timeouts in the provider_timeout category
+func (e *TimeoutError) ErrorCode() pixaerrors.Code {
+	return pixaerrors.ProviderTimeout
+}
+
+// Unwrap lets errors.Is(err, context.DeadlineExceeded) match timeout errors
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
@@ -0,0 +1,62 @@
+package ai
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Directions of the frames in the provider frame log
+const (
+	FrameSent     = "sent"
+	FrameReceived = "received"
+)
+
+// ElideAudio returns a JSON frame of a realtime API with its base64 audio replaced by the number of
+// bytes left out, for logging frames without the audio. Frames that are not JSON are returned as a
+// JSON string.
+func ElideAudio(frame []byte) json.RawMessage {
+	var v any
+	if err := json.Unmarshal(frame, &v); err != nil {
+		quoted, _ := json.Marshal(string(frame))
+		return quoted
+	}
+	elided, err := json.Marshal(elide(v))
+	if err != nil {
+		quoted, _ := json.Marshal(string(frame))
+		return quoted
+	}
+	return elided
+}
+
+// elide replaces the audio in a decoded JSON value: the audio fields of appends and input audio
+// items, and the deltas of audio events, but not of transcripts
+func elide(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		typ, _ := v["type"].(string)
+		for key, value := range v {
+			s, ok := value.(string)
+			switch {
+			case ok && (key == "audio" || key == "delta" && strings.HasSuffix(typ, "audio.delta")):
+				v[key] = fmt.Sprintf("[%d bytes elided]", base64.StdEncoding.DecodedLen(len(s)))
+			case !ok:
+				v[key] = elide(value)
+			}
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = elide(value)
+		}
+	}
+	return v
+}
+
+// logFrame logs a frame exchanged with the server when the session's frames are logged
+func (c *OpenAIClient) logFrame(direction string, frame []byte) {
+	if c.frameLog == nil {
+		return
+	}
+	c.frameLog.Info("Provider frame", "provider", c.provider, "direction", direction, "frame", ElideAudio(frame))
+}
@@ -0,0 +1,65 @@
+package ai
+
+import (
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/metrics"
+)
+
+// Metrics are the provider metrics recorded by AI clients. A nil *Metrics records nothing.
+type Metrics struct {
+	operationDuration *metrics.HistogramVec
+	timeouts          *metrics.CounterVec
+	appends           *metrics.CounterVec
+	// sessionID is attached to operation durations as an exemplar, if set
+	sessionID string
+}
+
+// NewMetrics registers the provider metrics in the given registry
+func NewMetrics(reg *metrics.Registry) *Metrics {
+	return &Metrics{
+		operationDuration: reg.Histogram("pixa_provider_operation_duration_seconds",
+			"Duration of provider operations.", nil, "provider", "op"),
+		timeouts: reg.Counter("pixa_provider_timeouts_total",
+			"Provider operations that exceeded their timeout.", "provider", "op"),
+		appends: reg.Counter("pixa_provider_appends_total",
+			"Audio chunks appended to the provider by outcome.", "provider", "result"),
+	}
+}
+
+// ForSession returns metrics that link the operation durations they record to a session through
+// exemplars
+func (m *Metrics) ForSession(sessionID string) *Metrics {
+	if m == nil {
+		return nil
+	}
+	s := *m
+	s.sessionID = sessionID
+	return &s
+}
+
+func (m *Metrics) observe(provider, op string, start time.Time) {
+	if m == nil {
+		return
+	}
+	h := m.operationDuration.With(provider, op)
+	if m.sessionID == "" {
+		h.Observe(time.Since(start).Seconds())
+		return
+	}
+	h.ObserveWithExemplar(time.Since(start).Seconds(), "session_id", m.sessionID)
+}
+
+func (m *Metrics) timeout(provider, op string) {
+	if m == nil {
+		return
+	}
+	m.timeouts.With(provider, op).Inc()
+}
+
+func (m *Metrics) appendResult(provider, result string, n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.appends.With(provider, result).Add(float64(n))
+}
@@ -0,0 +1,269 @@
+package ai
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// MockProvider is the name under which the mock client is registered
+const MockProvider = "mock"
+
+const (
+	mockSampleRate = 24000
+	// mockChunk is the length of each response audio delta
+	mockChunk = 100 * time.Millisecond
+	mockTone  = 440
+)
+
+var errMockClosed = errors.New("mock client is closed")
+
+// mockToneChunk is one chunk of a 24khz pcm16 sine tone, an exact number of periods long so
+// consecutive chunks join up without clicks
+var mockToneChunk = func() []byte {
+	samples := int(mockChunk * mockSampleRate / time.Second)
+	data := make([]byte, samples*2)
+	for i := 0; i < samples; i++ {
+		v := 0.3 * math.Sin(2*math.Pi*mockTone*float64(i)/mockSampleRate)
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(int16(v*math.MaxInt16)))
+	}
+	return data
+}()
+
+// MockClient simulates a conversation without a model: every ai.mock.turn_after of uplink audio
+// counts as a user turn, which is answered in real time with ai.mock.response_length of tone and
+// a transcript. It exercises the same streams as a real provider, which makes it suitable for
+// load and soak tests.
+type MockClient struct {
+	logger  *slog.Logger
+	metrics *Metrics
+	// clock paces the response audio
+	clock clock.Clock
+
+	turnAfter      time.Duration
+	responseLength time.Duration
+
+	responseStream chan ResponseAudio
+	eventsStream   chan Event
+	errStream      chan error
+	// turns is signalled by SendAudio when a user turn is complete
+	turns chan struct{}
+	// manual waits for the relay to ask for each response; answers receives true when it does and
+	// false when it answered the turn itself
+	manual  bool
+	answers chan bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu sync.Mutex
+	// heard is the uplink audio received since the last turn
+	heard time.Duration
+	// truncated is the item the relay cut short, its remaining audio is not sent
+	truncated string
+}
+
+func NewMockClient(cfg *config.Config, logger *slog.Logger, metrics *Metrics) (*MockClient, error) {
+	turnAfter, err := time.ParseDuration(cfg.AIConfig.Mock.TurnAfter)
+	if err != nil || turnAfter <= 0 {
+		return nil, fmt.Errorf("invalid ai.mock.turn_after: %s", cfg.AIConfig.Mock.TurnAfter)
+	}
+	responseLength, err := time.ParseDuration(cfg.AIConfig.Mock.ResponseLength)
+	if err != nil || responseLength <= 0 {
+		return nil, fmt.Errorf("invalid ai.mock.response_length: %s", cfg.AIConfig.Mock.ResponseLength)
+	}
+	return &MockClient{
+		logger:         logger,
+		metrics:        metrics,
+		clock:          clock.Real(),
+		turnAfter:      turnAfter,
+		responseLength: responseLength,
+		responseStream: make(chan ResponseAudio),
+		eventsStream:   make(chan Event),
+		errStream:      make(chan error, 1),
+		turns:          make(chan struct{}, 1),
+		manual:         cfg.FAQ.Enabled,
+		answers:        make(chan bool, 1),
+		done:           make(chan struct{}),
+	}, nil
+}
+
+func (c *MockClient) Initialize(ctx context.Context) error {
+	c.metrics.observe(MockProvider, OpConnect, time.Now())
+	go c.run(ctx)
+	return nil
+}
+
+// emit delivers a value to one of the client's streams, it reports false once the client is shutting down
+func emitMock[T any](ctx context.Context, c *MockClient, stream chan T, v T) bool {
+	select {
+	case stream <- v:
+		return true
+	case <-c.done:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func (c *MockClient) run(ctx context.Context) {
+	for turn := 1; ; turn++ {
+		select {
+		case <-c.turns:
+		case <-c.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+		if !c.respond(ctx, turn) {
+			return
+		}
+	}
+}
+
+// respond plays out one turn the way the realtime API reports it
+func (c *MockClient) respond(ctx context.Context, turn int) bool {
+	start := time.Now()
+	itemID := fmt.Sprintf("mock_item_%d", turn)
+	transcript := fmt.Sprintf("This is mock response number %d.", turn)
+
+	for _, e := range []Event{
+		{Type: SpeechStartedEventType},
+		{Type: SpeechStoppedEventType},
+		{Type: AudioBufferCommittedType},
+		{Type: InputTranscriptionCompletedType, ItemID: fmt.Sprintf("mock_input_%d", turn), Text: fmt.Sprintf("mock turn %d", turn)},
+	} {
+		if !emitMock(ctx, c, c.eventsStream, e) {
+			return false
+		}
+	}
+	if c.manual {
+		select {
+		case create := <-c.answers:
+			if !create {
+				return true
+			}
+		case <-c.done:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+	if !emitMock(ctx, c, c.eventsStream, Event{Type: AudioTranscriptDeltaEventType, ItemID: itemID, Text: transcript}) {
+		return false
+	}
+	c.metrics.observe(MockProvider, OpResponse, start)
+
+	ticker := c.clock.NewTicker(mockChunk)
+	defer ticker.Stop()
+	for sent := time.Duration(0); sent < c.responseLength; sent += mockChunk {
+		if c.isTruncated(itemID) {
+			break
+		}
+		if !emitMock(ctx, c, c.responseStream, ResponseAudio{ItemID: itemID, Audio: audio.FromPCM16(mockToneChunk, mockSampleRate, 1)}) {
+			return false
+		}
+		select {
+		case <-ticker.C():
+		case <-c.done:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	return emitMock(ctx, c, c.eventsStream, Event{Type: AudioTranscriptDoneEventType, ItemID: itemID, Text: transcript}) &&
+		emitMock(ctx, c, c.eventsStream, Event{Type: ResponseAudioDoneEventType, ItemID: itemID})
+}
+
+func (c *MockClient) isTruncated(itemID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.truncated == itemID
+}
+
+func (c *MockClient) GetEventsStream() <-chan Event {
+	return c.eventsStream
+}
+
+func (c *MockClient) GetResponseStream() <-chan ResponseAudio {
+	return c.responseStream
+}
+
+func (c *MockClient) Errors() <-chan error {
+	return c.errStream
+}
+
+func (c *MockClient) SendAudio(ctx context.Context, a audio.Audio) error {
+	select {
+	case <-c.done:
+		return errMockClosed
+	default:
+	}
+	start := time.Now()
+
+	c.mu.Lock()
+	c.heard += a.Duration()
+	complete := c.heard >= c.turnAfter
+	if complete {
+		c.heard -= c.turnAfter
+	}
+	c.mu.Unlock()
+
+	if complete {
+		// a turn that arrives while the previous one is still queued is folded into it
+		select {
+		case c.turns <- struct{}{}:
+		default:
+		}
+	}
+	c.metrics.observe(MockProvider, OpAppend, start)
+	return nil
+}
+
+func (c *MockClient) Truncate(ctx context.Context, itemID string, audioEndMs int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.truncated = itemID
+	return nil
+}
+
+// CreateResponse lets the pending turn be answered
+func (c *MockClient) CreateResponse(ctx context.Context) error {
+	return c.answer(ctx, true)
+}
+
+// AddAnswer skips the response to the pending turn
+func (c *MockClient) AddAnswer(ctx context.Context, text string) error {
+	return c.answer(ctx, false)
+}
+
+// AddContext ignores the context, the mock's responses do not depend on the conversation
+func (c *MockClient) AddContext(ctx context.Context, text string) error {
+	return nil
+}
+
+func (c *MockClient) answer(ctx context.Context, create bool) error {
+	select {
+	case c.answers <- create:
+		return nil
+	case <-c.done:
+		return errMockClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *MockClient) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
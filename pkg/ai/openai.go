@@ -0,0 +1,806 @@
+package ai
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/utils"
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	pixaerrors "github.com/pixaverse-studios/websocket-server/pkg/errors"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// WebSocket configuration
+	writeWait = 10 * time.Second
+)
+
+// ChatGPTClient manages the WebSocket connection to the ChatGPT server
+type OpenAIClient struct {
+	conn    *websocket.Conn
+	logger  *slog.Logger
+	metrics *Metrics
+	headers http.Header
+	// frameLog logs the frames exchanged with the server; nil unless the session is sampled
+	frameLog *slog.Logger
+
+	mu        sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+
+	responseStream chan ResponseAudio
+	// eventsStream lets the client know when some important events happen in the model, like when the model has detected the start of speech, end of speech, completed the response etc. The client can use these to events to curate the behaviour of the system.
+	eventsStream chan Event
+	// errStream receives the error that ended the connection with the server
+	errStream chan error
+	aiconfig  config.AIConfig
+	// provider is the name the client is registered under, AzureProvider or OpenAIProvider
+	provider string
+	// url is the realtime endpoint, and modelParam its query parameter that selects the model
+	url        string
+	modelParam string
+	// model is the model asked for when the session overrides none; empty keeps the URL's
+	model string
+	// proxy routes the connection to the server, ai.proxy or that of the session's tenant
+	proxy   config.ProxyConfig
+	session SessionConfig
+
+	connectTimeout  time.Duration
+	appendTimeout   time.Duration
+	responseTimeout time.Duration
+	// appends tracks the audio chunks the server may still reject. appendMu keeps the chunks in the
+	// order they are sent, and lastAppend is the event ID of the last one sent.
+	appends    *appendTracker
+	appendMu   sync.Mutex
+	lastAppend string
+	// resampler converts the device's audio to the rate of the input format, at resampleQuality;
+	// nil until needed
+	resampler       *audio.Resampler
+	resampleQuality audio.ResampleQuality
+	// responsePendingSince is set when the user stops speaking, or with manual responses when one
+	// is requested, and cleared once the model starts to respond. It holds unix nanoseconds.
+	responsePendingSince atomic.Int64
+	// responseMu guards whether the model is responding and the responses the relay asked for
+	// meanwhile. The model gives one response at a time, so those are sent once it is done.
+	responseMu      sync.Mutex
+	responding      bool
+	queuedResponses []map[string]interface{}
+}
+
+func NewOpenAIClient(cfg *config.Config, logger *slog.Logger, metrics *Metrics) (*OpenAIClient, error) {
+	aiConfig := cfg.AIConfig
+	connectTimeout, _ := time.ParseDuration(aiConfig.ConnectTimeout)
+	appendTimeout, _ := time.ParseDuration(aiConfig.AppendTimeout)
+	responseTimeout, _ := time.ParseDuration(aiConfig.ResponseTimeout)
+	ackWindow, _ := time.ParseDuration(aiConfig.AppendAckWindow)
+
+	session, err := NewSessionConfig(cfg, RealtimeAudioFormats)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := http.Header{}
+	headers.Set("api-key", cfg.Azure.OpenAIKey)
+	return &OpenAIClient{
+		logger:          logger,
+		metrics:         metrics,
+		done:            make(chan struct{}),
+		headers:         headers,
+		responseStream:  make(chan ResponseAudio),
+		eventsStream:    make(chan Event),
+		errStream:       make(chan error, 1),
+		aiconfig:        aiConfig,
+		provider:        AzureProvider,
+		url:             cfg.Azure.ServiceURL,
+		modelParam:      "deployment",
+		proxy:           aiConfig.Proxy,
+		session:         session,
+		connectTimeout:  connectTimeout,
+		appendTimeout:   appendTimeout,
+		responseTimeout: responseTimeout,
+		appends:         newAppendTracker(ackWindow),
+	}, nil
+}
+
+// NewOpenAIRealtimeClient creates a client of the realtime API of OpenAI itself, for users without
+// an Azure deployment. It speaks the same protocol as the Azure client, authenticated with an API
+// key of the OpenAI platform and selecting the model by name.
+func NewOpenAIRealtimeClient(cfg *config.Config, logger *slog.Logger, metrics *Metrics) (*OpenAIClient, error) {
+	c, err := NewOpenAIClient(cfg, logger, metrics)
+	if err != nil {
+		return nil, err
+	}
+	c.headers = http.Header{}
+	c.headers.Set("Authorization", "Bearer "+cfg.OpenAI.APIKey)
+	c.headers.Set("OpenAI-Beta", "realtime=v1")
+	if cfg.OpenAI.Organization != "" {
+		c.headers.Set("OpenAI-Organization", cfg.OpenAI.Organization)
+	}
+	if cfg.OpenAI.Project != "" {
+		c.headers.Set("OpenAI-Project", cfg.OpenAI.Project)
+	}
+	c.provider = OpenAIProvider
+	c.url = cfg.OpenAI.ServiceURL
+	c.modelParam = "model"
+	c.model = cfg.OpenAI.Model
+	return c, nil
+}
+
+// SessionConfig returns the configuration the model session is set up with
+func (c *OpenAIClient) SessionConfig() SessionConfig {
+	return c.session
+}
+
+// withTimeout derives a context for a single operation; a zero timeout leaves ctx unbounded
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// ctx is used to cancel
+func (c *OpenAIClient) Initialize(ctx context.Context) error {
+	start := time.Now()
+	connectCtx, cancel := withTimeout(ctx, c.connectTimeout)
+	defer cancel()
+
+	err := c.connect(connectCtx)
+	if err != nil {
+		return fmt.Errorf("Could not connect to OpenAI server: %w", c.timeoutError(OpConnect, c.connectTimeout, err))
+	}
+	err = c.initializeSession(connectCtx)
+	if err != nil {
+		return fmt.Errorf("Could not initialize OpenAI session: %w", c.timeoutError(OpConnect, c.connectTimeout, err))
+	}
+	c.metrics.observe(c.provider, OpConnect, start)
+	go c.watchServerEvents(ctx)
+	return nil
+
+}
+
+func (c *OpenAIClient) connect(ctx context.Context) error {
+	proxy, err := proxyFunc(c.proxy)
+	if err != nil {
+		return err
+	}
+	dialer := websocket.Dialer{NetDialContext: utils.DialContext(c.aiconfig.Socket), Proxy: proxy}
+	serviceURL, err := c.serviceURL()
+	if err != nil {
+		return err
+	}
+	conn, resp, err := dialer.DialContext(ctx, serviceURL, c.headers)
+	if err != nil {
+		if resp != nil {
+			return pixaerrors.Errorf(pixaerrors.ProviderFailed, "websocket connection failed with status %d: %w", resp.StatusCode, err)
+		}
+		return pixaerrors.Wrap(pixaerrors.ProviderFailed, err, "websocket connection failed")
+	}
+
+	c.conn = conn
+	c.logger.Info("Connected to server", "url", serviceURL, "proxied", !c.proxy.Empty())
+	return nil
+}
+
+// proxyFunc returns the proxy selection of a dialer for p, nil to connect directly
+func proxyFunc(p config.ProxyConfig) (func(*http.Request) (*url.URL, error), error) {
+	if p.URL == "" {
+		if p.FromEnvironment {
+			return http.ProxyFromEnvironment, nil
+		}
+		return nil, nil
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	if p.Username != "" {
+		u.User = url.UserPassword(p.Username, p.Password)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// serviceURL returns the URL of the realtime endpoint, selecting the session's model if it
+// overrides the configured one
+func (c *OpenAIClient) serviceURL() (string, error) {
+	model := c.session.Model
+	if model == "" {
+		model = c.model
+	}
+	if model == "" {
+		return c.url, nil
+	}
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return "", fmt.Errorf("invalid service URL: %w", err)
+	}
+	q := u.Query()
+	q.Set(c.modelParam, model)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// timeoutError converts deadline errors into a *TimeoutError for op, counting it in the metrics
+func (c *OpenAIClient) timeoutError(op string, timeout time.Duration, err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		c.metrics.timeout(c.provider, op)
+		return &TimeoutError{Op: op, Limit: timeout}
+	}
+	return err
+}
+
+func (c *OpenAIClient) loadSystemPrompt() string {
+	if c.aiconfig.SystemPromptFilePath != "" {
+		byt, err := os.ReadFile(c.aiconfig.SystemPromptFilePath)
+		if err != nil {
+			return ""
+		}
+		return string(byt)
+	}
+	return ""
+}
+
+func (c *OpenAIClient) initializeSession(ctx context.Context) error {
+	if c.session.Instructions == "" {
+		c.session.Instructions = c.loadSystemPrompt()
+	}
+	session := map[string]interface{}{
+		"modalities":          []string{"audio", "text"},
+		"input_audio_format":  c.session.InputAudioFormat.Name,
+		"output_audio_format": c.session.OutputAudioFormat.Name,
+		"instructions":        c.session.Instructions,
+		// turn should be detected automatically
+		"turn_detection": c.turnDetection(),
+	}
+	if c.session.Voice != "" {
+		session["voice"] = c.session.Voice
+	}
+	if t := c.session.Transcription; t.Model != "" {
+		transcription := map[string]interface{}{"model": t.Model}
+		if t.Language != "" {
+			transcription["language"] = t.Language
+		}
+		if prompt := TranscriptionPrompt(t); prompt != "" {
+			transcription["prompt"] = prompt
+		}
+		session["input_audio_transcription"] = transcription
+	}
+	if len(c.session.Tools) > 0 {
+		tools := make([]map[string]interface{}, len(c.session.Tools))
+		for i, t := range c.session.Tools {
+			tools[i] = map[string]interface{}{
+				"type":        "function",
+				"name":        t.Name,
+				"description": t.Description,
+				"parameters":  t.Parameters,
+			}
+		}
+		session["tools"] = tools
+		session["tool_choice"] = "auto"
+	}
+	sessionEvent := map[string]interface{}{
+		"type":    "session.update",
+		"session": session,
+	}
+	c.logger.Debug("Initializing session", "output_audio_format", c.session.OutputAudioFormat.Name)
+	return c.writeJSON(ctx, sessionEvent)
+}
+
+// turnDetection configures the server's voice activity detection from the session's endpointing
+// settings, with the server's defaults for those left unset
+func (c *OpenAIClient) turnDetection() map[string]interface{} {
+	e := c.session.Endpointing
+	threshold := e.Threshold
+	if threshold <= 0 {
+		threshold = 0.5
+	}
+	prefix, err := time.ParseDuration(e.PrefixPadding)
+	if err != nil {
+		prefix = 300 * time.Millisecond
+	}
+	silence, err := time.ParseDuration(e.SilenceDuration)
+	if err != nil || silence <= 0 {
+		silence = 500 * time.Millisecond
+	}
+	return map[string]interface{}{
+		"type":                "server_vad",
+		"threshold":           threshold,
+		"prefix_padding_ms":   prefix.Milliseconds(),
+		"silence_duration_ms": silence.Milliseconds(),
+		"create_response":     !c.session.ManualResponses,
+	}
+}
+
+// UpdateEndpointing retunes the server's turn detection
+func (c *OpenAIClient) UpdateEndpointing(ctx context.Context, e config.EndpointingConfig) error {
+	ctx, cancel := withTimeout(ctx, c.appendTimeout)
+	defer cancel()
+	c.session.Endpointing = e
+	event := map[string]interface{}{
+		"type":    "session.update",
+		"session": map[string]interface{}{"turn_detection": c.turnDetection()},
+	}
+	return c.timeoutError(OpAppend, c.appendTimeout, c.writeJSON(ctx, event))
+}
+
+// writeJSON writes v to the server, giving up at the deadline of ctx
+func (c *OpenAIClient) writeJSON(ctx context.Context, v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	c.conn.SetWriteDeadline(deadline)
+	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return err
+	}
+	c.logFrame(FrameSent, data)
+	return nil
+}
+
+// emit delivers a value to one of the client's streams unless the client is shutting down
+func emit[T any](ctx context.Context, c *OpenAIClient, stream chan T, v T) {
+	select {
+	case stream <- v:
+	case <-ctx.Done():
+	case <-c.done:
+	}
+}
+
+func (c *OpenAIClient) processEvent(ctx context.Context, eventType EventType, msg []byte) error {
+	c.metrics.appendResult(c.provider, AppendAcknowledged, c.appends.settle(time.Now()))
+
+	switch eventType {
+	case ErrorEventType:
+		var errorEvent ErrorEvent
+		if err := json.Unmarshal(msg, &errorEvent); err != nil {
+			return fmt.Errorf("failed to parse error event: %v", err)
+		}
+		c.logger.Error("Received error event from OpenAI",
+			"type", errorEvent.Error.Type,
+			"code", errorEvent.Error.Code,
+			"message", errorEvent.Error.Message,
+			"event_id", errorEvent.Error.EventID)
+		if p, ok := c.appends.take(errorEvent.Error.EventID); ok {
+			return c.retryAppend(ctx, p, errorEvent.Error)
+		}
+		return pixaerrors.Errorf(pixaerrors.ProviderFailed, "server error: %s", errorEvent.Error.Message)
+
+	case SpeechStoppedEventType:
+		if !c.session.ManualResponses {
+			c.responsePendingSince.Store(time.Now().UnixNano())
+		}
+		var event SpeechEvent
+		json.Unmarshal(msg, &event)
+		emit(ctx, c, c.eventsStream, Event{Type: eventType, ItemID: event.ItemID, AudioMs: event.AudioEndMs})
+		return nil
+
+	case SpeechStartedEventType:
+		var event SpeechEvent
+		json.Unmarshal(msg, &event)
+		emit(ctx, c, c.eventsStream, Event{Type: eventType, ItemID: event.ItemID, AudioMs: event.AudioStartMs})
+		return nil
+
+	case AudioBufferCommittedType:
+		emit(ctx, c, c.eventsStream, Event{Type: eventType})
+		return nil
+
+	case ResponseCreatedEventType:
+		if since := c.responsePendingSince.Swap(0); since != 0 {
+			c.metrics.observe(c.provider, OpResponse, time.Unix(0, since))
+		}
+		c.responseMu.Lock()
+		c.responding = true
+		c.responseMu.Unlock()
+		return nil
+
+	case ResponseDoneEventType:
+		return c.responseDone(ctx)
+
+	case FunctionCallEventType:
+		var call FunctionCallArgumentsDoneEvent
+		if err := json.Unmarshal(msg, &call); err != nil {
+			return fmt.Errorf("failed to parse function call event: %v", err)
+		}
+		emit(ctx, c, c.eventsStream, Event{Type: eventType, ItemID: call.ItemID, Call: &call.FunctionCall})
+		return nil
+
+	case ResponseAudioDoneEventType:
+		var event ItemEvent
+		if err := json.Unmarshal(msg, &event); err != nil {
+			return fmt.Errorf("failed to parse audio done event: %v", err)
+		}
+		// send the remaining bytes
+		emit(ctx, c, c.eventsStream, Event{Type: eventType, ItemID: event.ItemID})
+		return nil
+	case AudioTranscriptDeltaEventType:
+		var delta ResponseAudioDeltaEvent
+		if err := json.Unmarshal(msg, &delta); err != nil {
+			return fmt.Errorf("failed to parse transcript delta event: %v", err)
+		}
+		emit(ctx, c, c.eventsStream, Event{Type: eventType, ItemID: delta.ItemID, Text: delta.Delta})
+		return nil
+
+	case AudioTranscriptDoneEventType:
+		var done AudioTranscriptDoneEvent
+		if err := json.Unmarshal(msg, &done); err != nil {
+			return fmt.Errorf("failed to parse transcript done event: %v", err)
+		}
+		emit(ctx, c, c.eventsStream, Event{Type: eventType, ItemID: done.ItemID, Text: done.Transcript})
+		return nil
+
+	case InputTranscriptionCompletedType:
+		var done InputTranscriptionCompletedEvent
+		if err := json.Unmarshal(msg, &done); err != nil {
+			return fmt.Errorf("failed to parse input transcription event: %v", err)
+		}
+		emit(ctx, c, c.eventsStream, Event{Type: eventType, ItemID: done.ItemID, Text: done.Transcript})
+		return nil
+
+	case ResponseAudioDeltaEventType:
+		var delta ResponseAudioDeltaEvent
+		if err := json.Unmarshal(msg, &delta); err != nil {
+			return fmt.Errorf("failed to parse delta event: %v", err)
+		}
+		data, err := base64.StdEncoding.DecodeString(delta.Delta)
+		if err != nil {
+			return fmt.Errorf("Could not decode base64 audio")
+		}
+
+		a := c.session.OutputAudioFormat.Decode(data)
+		emit(ctx, c, c.responseStream, ResponseAudio{ItemID: delta.ItemID, Audio: a})
+		return nil
+
+	default:
+		var resp map[string]interface{}
+		if err := json.Unmarshal(msg, &resp); err != nil {
+			return fmt.Errorf("failed to parse delta event: %v", err)
+		}
+		c.logger.Info("Unhandled event", "event json", resp)
+		return nil
+	}
+}
+
+// fail reports the error that ended the connection with the server
+func (c *OpenAIClient) fail(err error) {
+	select {
+	case c.errStream <- err:
+	default:
+	}
+}
+
+func (c *OpenAIClient) watchServerEvents(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.done:
+			return
+		default:
+			// while waiting for the model to respond, the read is bounded by the response timeout
+			var deadline time.Time
+			if since := c.responsePendingSince.Load(); since != 0 && c.responseTimeout > 0 {
+				deadline = time.Unix(0, since).Add(c.responseTimeout)
+			}
+			c.conn.SetReadDeadline(deadline)
+
+			_, msg, err := c.conn.ReadMessage()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					return
+				}
+				select {
+				case <-c.done:
+					return
+				default:
+				}
+
+				if !deadline.IsZero() {
+					err = c.timeoutError(OpResponse, c.responseTimeout, err)
+				}
+				c.logger.Error("failed to read message from openai server", "error", err)
+				if pending := c.appends.drain(); len(pending) > 0 {
+					c.metrics.appendResult(c.provider, AppendUnacknowledged, len(pending))
+					c.logger.Warn("Connection ended before the provider acknowledged audio chunks", "chunks", len(pending))
+				}
+				c.fail(err)
+				return
+			}
+			c.logFrame(FrameReceived, msg)
+
+			var baseEvent EventBase
+			if err := json.Unmarshal(msg, &baseEvent); err != nil {
+				c.logger.Error("failed to parse base event from openai server", "error", err)
+				continue
+			}
+			if err := c.processEvent(ctx, baseEvent.Type, msg); err != nil {
+				c.logger.Error("failed to process OpenAI event", "type", baseEvent.Type, "error", err)
+			}
+
+		}
+	}
+
+}
+
+func (c *OpenAIClient) GetEventsStream() <-chan Event {
+	return c.eventsStream
+}
+
+func (c *OpenAIClient) GetResponseStream() <-chan ResponseAudio {
+	return c.responseStream
+}
+
+func (c *OpenAIClient) Errors() <-chan error {
+	return c.errStream
+}
+
+func (c *OpenAIClient) SendAudio(ctx context.Context, a audio.Audio) error {
+	// The realtime API takes 1 channel audio in the session's input format: 24khz 16 bit pcm, or
+	// 8khz G.711 for devices that send it
+	if a.GetChannels() != 1 && a.GetChannels() == 2 {
+		a.StereoToMono()
+	}
+	data := c.session.InputAudioFormat.Encode(c.resample(a))
+
+	start := time.Now()
+	ctx, cancel := withTimeout(ctx, c.appendTimeout)
+	defer cancel()
+	if err := c.AppendToAudioBuffer(ctx, base64.StdEncoding.EncodeToString(data)); err != nil {
+		return c.timeoutError(OpAppend, c.appendTimeout, err)
+	}
+	c.metrics.observe(c.provider, OpAppend, start)
+	return nil
+
+}
+
+// resample converts uplink audio to the rate of the session's input format. The resampler is kept
+// from chunk to chunk, so devices can send audio at any rate in chunks of any length.
+func (c *OpenAIClient) resample(a audio.Audio) audio.Audio {
+	rate := c.session.InputAudioFormat.SampleRate
+	if a.GetSampleRate() == rate {
+		return a
+	}
+	if from, _ := c.resampler.Rates(); c.resampler == nil || from != a.GetSampleRate() {
+		c.resampler = audio.NewResamplerQuality(c.resampleQuality, a.GetSampleRate(), rate, a.GetChannels())
+	}
+	return c.resampler.Resample(a)
+}
+
+func (c *OpenAIClient) AppendToAudioBuffer(ctx context.Context, audio string) error {
+	_, err := c.appendAudio(ctx, audio, 1, "")
+	return err
+}
+
+// appendAudio sends a chunk with an event ID the server's errors can be correlated with. A chunk
+// re-sent for the rejected chunk retryOf is only sent if no chunk was sent after that one, as it
+// would otherwise land in the provider's buffer after later audio; sent reports whether it was.
+func (c *OpenAIClient) appendAudio(ctx context.Context, audio string, attempt int, retryOf string) (sent bool, err error) {
+	c.appendMu.Lock()
+	defer c.appendMu.Unlock()
+	if retryOf != "" && retryOf != c.lastAppend {
+		return false, nil
+	}
+	now := time.Now()
+	c.metrics.appendResult(c.provider, AppendAcknowledged, c.appends.settle(now))
+	eventID := c.appends.track(audio, attempt, now)
+	event := map[string]interface{}{
+		"event_id": eventID,
+		"type":     InputAudioBufferAppendEventType,
+		"audio":    audio,
+	}
+	if err := c.writeJSON(ctx, event); err != nil {
+		c.appends.forget(eventID)
+		return false, err
+	}
+	c.lastAppend = eventID
+	return true, nil
+}
+
+// retryAppend sends a chunk the server rejected again if the error was transient and no audio was
+// appended after it. Otherwise the chunk is dropped: sending it after later audio would put the
+// provider's buffer out of order, so the gap is logged instead.
+func (c *OpenAIClient) retryAppend(ctx context.Context, p pendingAppend, detail ErrorDetail) error {
+	if !retryable(detail) || p.attempts >= maxAppendAttempts {
+		c.metrics.appendResult(c.provider, AppendRejected, 1)
+		return pixaerrors.Errorf(pixaerrors.ProviderFailed, "audio chunk %s was rejected after %d attempts: %s", p.eventID, p.attempts, detail.Message)
+	}
+	ctx, cancel := withTimeout(ctx, c.appendTimeout)
+	defer cancel()
+	sent, err := c.appendAudio(ctx, p.audio, p.attempts+1, p.eventID)
+	if err != nil {
+		return fmt.Errorf("could not re-send audio chunk %s: %w", p.eventID, c.timeoutError(OpAppend, c.appendTimeout, err))
+	}
+	if !sent {
+		c.metrics.appendResult(c.provider, AppendRejected, 1)
+		c.logger.Warn("Dropping audio chunk rejected by the provider, later audio was already appended",
+			"event_id", p.eventID, "gap_bytes", base64.StdEncoding.DecodedLen(len(p.audio)))
+		return nil
+	}
+	c.metrics.appendResult(c.provider, AppendRetried, 1)
+	c.logger.Warn("Re-sent audio chunk rejected by the provider", "event_id", p.eventID, "attempt", p.attempts+1)
+	return nil
+}
+func (c *OpenAIClient) Truncate(ctx context.Context, itemID string, audioEndMs int64) error {
+	ctx, cancel := withTimeout(ctx, c.appendTimeout)
+	defer cancel()
+	event := map[string]interface{}{
+		"type":          ConversationItemTruncateType,
+		"item_id":       itemID,
+		"content_index": 0,
+		"audio_end_ms":  audioEndMs,
+	}
+	return c.timeoutError(OpAppend, c.appendTimeout, c.writeJSON(ctx, event))
+}
+
+func (c *OpenAIClient) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.conn != nil {
+			c.mu.Lock()
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			c.mu.Unlock()
+			c.conn.Close()
+		}
+	})
+}
+
+// CreateResponse asks the model to respond to the user's last turn. The wait for the response is
+// bounded by the response timeout.
+func (c *OpenAIClient) CreateResponse(ctx context.Context) error {
+	return c.createResponse(ctx, nil)
+}
+
+// createResponse asks the model for a response with the given overrides of the session's
+// settings, or queues the request while the model is still responding
+func (c *OpenAIClient) createResponse(ctx context.Context, response map[string]interface{}) error {
+	event := map[string]interface{}{"type": "response.create"}
+	if response != nil {
+		event["response"] = response
+	}
+	c.responseMu.Lock()
+	if c.responding {
+		c.queuedResponses = append(c.queuedResponses, event)
+		c.responseMu.Unlock()
+		return nil
+	}
+	c.responding = true
+	c.responseMu.Unlock()
+	return c.sendResponseCreate(ctx, event)
+}
+
+func (c *OpenAIClient) sendResponseCreate(ctx context.Context, event map[string]interface{}) error {
+	now := time.Now()
+	c.responsePendingSince.Store(now.UnixNano())
+	if c.responseTimeout > 0 {
+		// the event watcher may already be blocked in a read without a deadline
+		c.conn.SetReadDeadline(now.Add(c.responseTimeout))
+	}
+	if err := c.writeJSON(ctx, event); err != nil {
+		c.responsePendingSince.Store(0)
+		c.responseMu.Lock()
+		c.responding = false
+		c.responseMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// responseDone sends the next queued response request, if any
+func (c *OpenAIClient) responseDone(ctx context.Context) error {
+	c.responseMu.Lock()
+	if len(c.queuedResponses) == 0 {
+		c.responding = false
+		c.responseMu.Unlock()
+		return nil
+	}
+	event := c.queuedResponses[0]
+	c.queuedResponses = c.queuedResponses[1:]
+	c.responseMu.Unlock()
+
+	ctx, cancel := withTimeout(ctx, c.appendTimeout)
+	defer cancel()
+	if err := c.sendResponseCreate(ctx, event); err != nil {
+		return fmt.Errorf("could not send queued response request: %w", err)
+	}
+	return nil
+}
+
+// SendToolResult adds the output of a tool call to the conversation and has the model respond
+func (c *OpenAIClient) SendToolResult(ctx context.Context, callID, output string) error {
+	err := c.writeJSON(ctx, map[string]interface{}{
+		"type": "conversation.item.create",
+		"item": map[string]interface{}{
+			"type":    "function_call_output",
+			"call_id": callID,
+			"output":  output,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return c.createResponse(ctx, nil)
+}
+
+// Announce has the model respond following instructions on top of the session's, without calling
+// tools
+func (c *OpenAIClient) Announce(ctx context.Context, instructions string) error {
+	if c.session.Instructions != "" {
+		instructions = c.session.Instructions + "\n\n" + instructions
+	}
+	return c.createResponse(ctx, map[string]interface{}{
+		"instructions": instructions,
+		"tool_choice":  "none",
+	})
+}
+
+// AddContext adds text to the conversation as a system message
+func (c *OpenAIClient) AddContext(ctx context.Context, text string) error {
+	return c.writeJSON(ctx, map[string]interface{}{
+		"type": "conversation.item.create",
+		"item": map[string]interface{}{
+			"type": "message",
+			"role": "system",
+			"content": []map[string]interface{}{
+				{"type": "input_text", "text": text},
+			},
+		},
+	})
+}
+
+// AddAnswer adds the relay's answer to the conversation as an assistant message
+func (c *OpenAIClient) AddAnswer(ctx context.Context, text string) error {
+	return c.writeJSON(ctx, map[string]interface{}{
+		"type": "conversation.item.create",
+		"item": map[string]interface{}{
+			"type": "message",
+			"role": "assistant",
+			"content": []map[string]interface{}{
+				{"type": "text", "text": text},
+			},
+		},
+	})
+}
+
+// LoadHistory adds the messages of an earlier session to the conversation
+func (c *OpenAIClient) LoadHistory(ctx context.Context, items []HistoryItem) error {
+	for _, item := range items {
+		content := map[string]interface{}{"type": "input_text", "text": item.Text}
+		if item.Role == "assistant" {
+			content["type"] = "text"
+		}
+		err := c.writeJSON(ctx, map[string]interface{}{
+			"type": "conversation.item.create",
+			"item": map[string]interface{}{
+				"type":    "message",
+				"role":    item.Role,
+				"content": []map[string]interface{}{content},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package ai
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+const (
+	// AzureProvider is the name under which the Azure OpenAI realtime client is registered
+	AzureProvider = "azure"
+	// OpenAIProvider is the name under which the client of OpenAI's own realtime API is registered
+	OpenAIProvider = "openai"
+)
+
+// ProviderParams are passed to a ProviderFactory when a new session is started
+type ProviderParams struct {
+	Config  *config.Config
+	Logger  *slog.Logger
+	Metrics *Metrics
+	// Clock is the session's clock, for providers that pace themselves. It is nil for the real clock.
+	Clock clock.Clock
+	// Tools are the relay's tools the model can call, for providers that support them
+	Tools []ToolDefinition
+	// TenantID is the tenant the session belongs to, if any
+	TenantID string
+	// DeviceProfile is the profile of the session's device, if any, see config.DeviceProfile
+	DeviceProfile string
+	// Model overrides the configured model, for providers that let it be chosen; empty keeps it
+	Model string
+	// Instructions replace the system prompt of ai.system_prompt_filepath, to give the session
+	// another persona; empty keeps it
+	Instructions string
+	// Voice overrides ai.voice, for providers that let it be chosen; empty keeps it
+	Voice string
+	// TranscriptionModel overrides the model transcribing the user's speech; empty keeps it
+	TranscriptionModel string
+	// TranscribeOnly sets up a session that only transcribes the user's speech and never responds,
+	// for providers that support it
+	TranscribeOnly bool
+	// InputCodec is the codec of the device's audio, such as g711_ulaw, for providers that can take
+	// it directly; empty for pcm16. Audio is still sent to them as decoded PCM.
+	InputCodec string
+	// InputSampleRate is the rate of the device's audio, 0 for audio.sample_rate
+	InputSampleRate int
+	// FrameLog logs the raw frames exchanged with the provider, with their audio elided, for the
+	// sessions provider_log samples; nil logs none
+	FrameLog *slog.Logger
+	// ResampleQuality is how the device's audio is resampled to the provider's rate, for providers
+	// that resample it; empty interpolates linearly
+	ResampleQuality audio.ResampleQuality
+}
+
+// ProviderFactory creates a new AIClient for a single client session
+type ProviderFactory func(p ProviderParams) (AIClient, error)
+
+// Registry maps provider names to the factories used to create them. Embedding applications can
+// register their own providers and select them through the ai.provider config value.
+type Registry struct {
+	mu        sync.RWMutex
+	factories map[string]ProviderFactory
+}
+
+// NewRegistry creates an empty provider registry
+func NewRegistry() *Registry {
+	return &Registry{
+		factories: make(map[string]ProviderFactory),
+	}
+}
+
+// NewDefaultRegistry creates a registry with the providers that ship with the relay
+func NewDefaultRegistry() *Registry {
+	r := NewRegistry()
+	r.Register(AzureProvider, realtimeFactory(NewOpenAIClient))
+	r.Register(OpenAIProvider, realtimeFactory(NewOpenAIRealtimeClient))
+	r.Register(MockProvider, func(p ProviderParams) (AIClient, error) {
+		c, err := NewMockClient(p.Config, p.Logger, p.Metrics)
+		if err == nil && p.Clock != nil {
+			c.clock = p.Clock
+		}
+		return c, err
+	})
+	return r
+}
+
+// realtimeFactory returns the factory of a provider whose clients speak the realtime API, created
+// with newClient. Clients of tenants pinned to a region connect to the region's endpoint.
+func realtimeFactory(newClient func(*config.Config, *slog.Logger, *Metrics) (*OpenAIClient, error)) ProviderFactory {
+	return func(p ProviderParams) (AIClient, error) {
+		c, err := newClient(p.Config.ProviderConfigFor(p.TenantID), p.Logger, p.Metrics)
+		if region, _, _ := p.Config.RegionFor(p.TenantID); err == nil && region != "" && c.url == "" {
+			return nil, fmt.Errorf("%s has no endpoint in region %s", c.provider, region)
+		}
+		if err == nil {
+			c.session.Tools = p.Tools
+			c.session.Transcription = p.Config.TranscriptionFor(p.TenantID)
+			c.session.Endpointing = p.Config.EndpointingFor(p.DeviceProfile)
+			c.proxy = p.Config.ProxyFor(p.TenantID)
+			c.frameLog = p.FrameLog
+			c.resampleQuality = p.ResampleQuality
+			c.session.Model = p.Model
+			c.session.Instructions = p.Instructions
+			if p.Voice != "" {
+				c.session.Voice = p.Voice
+			}
+			if p.TranscriptionModel != "" {
+				c.session.Transcription.Model = p.TranscriptionModel
+			}
+			c.session.ManualResponses = c.session.ManualResponses || p.TranscribeOnly
+			if p.InputCodec != "" {
+				rate := cmp.Or(p.InputSampleRate, p.Config.Audio.SampleRate)
+				c.session.InputAudioFormat = NegotiateInputFormat(RealtimeAudioFormats, p.InputCodec, rate, p.Config.Audio.Channels)
+			}
+		}
+		return c, err
+	}
+}
+
+// Register adds a provider factory under the given name, replacing any existing one
+func (r *Registry) Register(name string, factory ProviderFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.factories[name] = factory
+}
+
+// New creates a client using the provider registered under name
+func (r *Registry) New(name string, p ProviderParams) (AIClient, error) {
+	r.mu.RLock()
+	factory, ok := r.factories[name]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown AI provider: %q", name)
+	}
+	return factory(p)
+}
+
+// Names returns the names of all registered providers in sorted order
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.factories))
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,157 @@
+package ai
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// AudioFormatOption is an audio format the provider can exchange audio in
+type AudioFormatOption struct {
+	// Name is the provider's identifier of the format
+	Name       string
+	Encoding   audio.AudioFormat
+	SampleRate int
+}
+
+var (
+	PCM16Format    = AudioFormatOption{Name: "pcm16", Encoding: audio.PCM16BIT, SampleRate: 24000}
+	G711ULawFormat = AudioFormatOption{Name: "g711_ulaw", Encoding: audio.ULAW, SampleRate: 8000}
+	G711ALawFormat = AudioFormatOption{Name: "g711_alaw", Encoding: audio.ALAW, SampleRate: 8000}
+)
+
+// RealtimeAudioFormats are the audio formats supported by the realtime API
+var RealtimeAudioFormats = []AudioFormatOption{PCM16Format, G711ULawFormat, G711ALawFormat}
+
+// Decode converts audio received in this format
+func (f AudioFormatOption) Decode(data []byte) audio.Audio {
+	switch f.Encoding {
+	case audio.ULAW:
+		return audio.FromULaw(data, f.SampleRate, 1)
+	case audio.ALAW:
+		return audio.FromALaw(data, f.SampleRate, 1)
+	default:
+		return audio.FromPCM16(data, f.SampleRate, 1)
+	}
+}
+
+// Encode converts audio to send in this format. The audio is resampled to the format's rate; it
+// must already be mono.
+func (f AudioFormatOption) Encode(a audio.Audio) []byte {
+	a.Resample(f.SampleRate)
+	switch f.Encoding {
+	case audio.ULAW:
+		return a.AsULaw()
+	case audio.ALAW:
+		return a.AsALaw()
+	default:
+		return a.AsPCM16()
+	}
+}
+
+// NegotiateInputFormat returns the option of a device's audio codec, for providers that take it as
+// it is, so the relay need not resample the device's audio. It falls back to pcm16 when no option
+// is in the codec at the device's rate.
+func NegotiateInputFormat(options []AudioFormatOption, codec string, deviceRate, deviceChannels int) AudioFormatOption {
+	for _, o := range options {
+		if o.Name == codec && o.SampleRate == deviceRate && deviceChannels == 1 {
+			return o
+		}
+	}
+	return PCM16Format
+}
+
+// NegotiateOutputFormat picks the option closest to the device's audio, so the relay has as little
+// resampling to do as possible. Sample rate matters most; between options of equal distance the
+// higher rate wins, and on a tie the one with the device's encoding.
+func NegotiateOutputFormat(options []AudioFormatOption, deviceRate int, deviceEncoding audio.AudioFormat) AudioFormatOption {
+	best := options[0]
+	bestScore := math.Inf(1)
+	for _, o := range options {
+		score := math.Abs(math.Log(float64(o.SampleRate) / float64(deviceRate)))
+		switch {
+		case score < bestScore:
+		case score == bestScore && o.SampleRate > best.SampleRate:
+		case score == bestScore && o.SampleRate == best.SampleRate && o.Encoding == deviceEncoding && best.Encoding != deviceEncoding:
+		default:
+			continue
+		}
+		best, bestScore = o, score
+	}
+	return best
+}
+
+// FindAudioFormat looks up an option by its provider name
+func FindAudioFormat(options []AudioFormatOption, name string) (AudioFormatOption, error) {
+	for _, o := range options {
+		if o.Name == name {
+			return o, nil
+		}
+	}
+	return AudioFormatOption{}, fmt.Errorf("unsupported audio format: %q", name)
+}
+
+// SessionConfig configures the model session created for a device
+type SessionConfig struct {
+	// Instructions are the system prompt; empty loads ai.system_prompt_filepath
+	Instructions string
+	// Model is the model to use instead of the configured one, if set: the Azure deployment, or
+	// the name of the OpenAI model
+	Model string
+	// Voice is the voice the model answers in; empty keeps the provider's default
+	Voice             string
+	InputAudioFormat  AudioFormatOption
+	OutputAudioFormat AudioFormatOption
+	// OutputAudioFormats are the formats the provider can produce, for reference
+	OutputAudioFormats []AudioFormatOption
+	// Transcription transcribes the user's speech when its model is set
+	Transcription config.TranscriptionConfig
+	// Endpointing tunes when the provider takes the user's turn to have ended
+	Endpointing config.EndpointingConfig
+	// ManualResponses leaves creating responses to the relay instead of responding as soon as
+	// the user stops speaking, see Responder
+	ManualResponses bool
+	// Tools are the relay's tools the model can call, see ToolCaller
+	Tools []ToolDefinition
+}
+
+// NewSessionConfig derives the session configuration from the relay config. The output format is
+// taken from ai.output_audio_format, or negotiated against the device's audio when set to "auto".
+func NewSessionConfig(cfg *config.Config, options []AudioFormatOption) (SessionConfig, error) {
+	sc := SessionConfig{
+		Voice:              cfg.AIConfig.Voice,
+		InputAudioFormat:   PCM16Format,
+		OutputAudioFormats: options,
+		Transcription:      cfg.TranscriptionFor(""),
+		Endpointing:        cfg.EndpointingFor(""),
+		ManualResponses:    cfg.FAQ.Enabled,
+	}
+
+	name := cfg.AIConfig.OutputAudioFormat
+	if name == "" || name == "auto" {
+		sc.OutputAudioFormat = NegotiateOutputFormat(options, cfg.Audio.SampleRate, audio.PCM16BIT)
+		return sc, nil
+	}
+	format, err := FindAudioFormat(options, name)
+	if err != nil {
+		return sc, err
+	}
+	sc.OutputAudioFormat = format
+	return sc, nil
+}
+
+// TranscriptionPrompt folds the phrases to favour into the transcription prompt, for providers that
+// take vocabulary hints as part of the prompt
+func TranscriptionPrompt(t config.TranscriptionConfig) string {
+	if len(t.Phrases) == 0 {
+		return t.Prompt
+	}
+	vocabulary := "Vocabulary: " + strings.Join(t.Phrases, ", ") + "."
+	if t.Prompt == "" {
+		return vocabulary
+	}
+	return t.Prompt + " " + vocabulary
+}
@@ -0,0 +1,119 @@
+package ai
+
+import "encoding/json"
+
+type EventType string
+
+const (
+	ErrorEventType                  EventType = "error"
+	InputAudioBufferAppendEventType EventType = "input_audio_buffer.append"
+	ConversationItemTruncateType    EventType = "conversation.item.truncate"
+
+	ResponseCreatedEventType    EventType = "response.created"
+	ResponseAudioDeltaEventType EventType = "response.audio.delta"
+	ResponseAudioDoneEventType  EventType = "response.audio.done"
+	ResponseDoneEventType       EventType = "response.done"
+
+	// FunctionCallEventType is emitted once the model has decided on the arguments of a tool call
+	FunctionCallEventType EventType = "response.function_call_arguments.done"
+
+	AudioTranscriptDeltaEventType EventType = "response.audio_transcript.delta"
+	AudioTranscriptDoneEventType  EventType = "response.audio_transcript.done"
+
+	InputTranscriptionCompletedType EventType = "conversation.item.input_audio_transcription.completed"
+
+	// this
+	SpeechStartedEventType      EventType = "input_audio_buffer.speech_started"
+	SpeechStoppedEventType      EventType = "input_audio_buffer.speech_stopped"
+	AudioBufferClearedEventType EventType = "input_audio_buffer.cleared"
+	AudioBufferCommittedType    EventType = "input_audio_buffer.committed"
+)
+
+// Event is an important event in the model that the relay reacts to
+type Event struct {
+	Type EventType
+	// ItemID is the conversation item the event refers to, if any
+	ItemID string
+	// Text is the transcript delta, or the full transcript once it is done
+	Text string
+	// Call is the tool the model calls, for function call events
+	Call *FunctionCall
+	// AudioMs is where in the audio sent to the model the user started or stopped speaking, for
+	// speech events of providers that report it
+	AudioMs int64
+}
+
+// FunctionCall is a call of one of the relay's tools by the model
+type FunctionCall struct {
+	// CallID identifies the call when sending its result
+	CallID string `json:"call_id"`
+	Name   string `json:"name"`
+	// Arguments are JSON encoded, as the model wrote them
+	Arguments string `json:"arguments"`
+}
+
+// ToolDefinition describes a tool the model can call
+type ToolDefinition struct {
+	Name        string
+	Description string
+	// Parameters is the JSON schema of the tool's arguments
+	Parameters json.RawMessage
+}
+
+// EventBase represents the base structure for all events
+type EventBase struct {
+	EventID *string   `json:"event_id,omitempty"`
+	Type    EventType `json:"type"`
+}
+
+// ItemEvent is the structure of server events that refer to a conversation item
+type ItemEvent struct {
+	EventBase
+	ItemID string `json:"item_id"`
+}
+
+// SpeechEvent is the structure of the server events on the user starting and stopping to speak
+type SpeechEvent struct {
+	ItemEvent
+	AudioStartMs int64 `json:"audio_start_ms"`
+	AudioEndMs   int64 `json:"audio_end_ms"`
+}
+
+// ResponseAudioDeltaEvent carries a chunk of base64 encoded response audio
+type ResponseAudioDeltaEvent struct {
+	ItemEvent
+	Delta string `json:"delta"`
+}
+
+// AudioTranscriptDoneEvent carries the full transcript of an assistant audio item
+type AudioTranscriptDoneEvent struct {
+	ItemEvent
+	Transcript string `json:"transcript"`
+}
+
+// FunctionCallArgumentsDoneEvent carries the arguments of a tool call
+type FunctionCallArgumentsDoneEvent struct {
+	ItemEvent
+	FunctionCall
+}
+
+// InputTranscriptionCompletedEvent carries the transcript of the user's speech
+type InputTranscriptionCompletedEvent struct {
+	ItemEvent
+	Transcript string `json:"transcript"`
+}
+
+// ErrorEvent represents an error from the server
+type ErrorEvent struct {
+	EventBase
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail contains detailed error information
+type ErrorDetail struct {
+	Type    string  `json:"type"`
+	Code    string  `json:"code"`
+	Message string  `json:"message"`
+	Param   *string `json:"param,omitempty"`
+	EventID string  `json:"event_id"`
+}
@@ -0,0 +1,297 @@
+// Package analytics aggregates finished sessions into per tenant, per day statistics standing for
+// cohorts of sessions, for tenants that do not allow records of their sessions to be kept: session
+// counts, a histogram of their durations and how often intents came up.
+package analytics
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/metrics"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+// dateFormat is the format of the days aggregates are kept by, in UTC
+const dateFormat = "2006-01-02"
+
+// IntentClassifier returns the intents of a session, for the intent frequencies. The relay does
+// not classify intents itself; embedding applications can plug in their own.
+type IntentClassifier func(store.SessionRecord) []string
+
+// Report holds the aggregates of a tenant's sessions over a range of days. Counts standing for
+// fewer than MinCohort sessions are withheld.
+type Report struct {
+	TenantID string `json:"tenant_id"`
+	// From and To are the first and last UTC day of the report, as "2006-01-02"
+	From      string `json:"from"`
+	To        string `json:"to"`
+	MinCohort int    `json:"min_cohort"`
+	// Sessions counts the sessions of the range. When they are too few, nothing is reported and
+	// Withheld is set.
+	Sessions int  `json:"sessions"`
+	Withheld bool `json:"withheld,omitempty"`
+	// Durations is the histogram of session durations
+	Durations []DurationBucket `json:"durations,omitempty"`
+	// Intents are the intents that came up in enough sessions, most frequent first
+	Intents []IntentCount `json:"intents,omitempty"`
+}
+
+// DurationBucket counts the sessions that lasted up to UpTo, and longer than the bucket before
+type DurationBucket struct {
+	// UpTo is empty for the last bucket, which holds the sessions longer than all bounds
+	UpTo     string `json:"up_to,omitempty"`
+	Count    int    `json:"count"`
+	Withheld bool   `json:"withheld,omitempty"`
+}
+
+type IntentCount struct {
+	Intent string `json:"intent"`
+	Count  int    `json:"count"`
+}
+
+// day holds the aggregates of a tenant's sessions that started on a day
+type day struct {
+	sessions  int
+	durations []int
+	intents   map[string]int
+}
+
+type dayKey struct {
+	tenantID string
+	date     string
+}
+
+// Aggregator is a store.TranscriptStore that aggregates the sessions saved to it and passes their
+// records on to the next store, unless their tenant is aggregate only. Nothing of a session is
+// kept but the aggregates it adds to. Without a next store no records are kept at all.
+type Aggregator struct {
+	config    *config.Config
+	next      store.TranscriptStore
+	classify  IntentClassifier
+	clock     clock.Clock
+	sessions  *metrics.CounterVec
+	bounds    []time.Duration
+	retention time.Duration
+	// key seeds the noise of reports, so that asking for the same report again gets the same noise
+	// rather than fresh noise to average away
+	key uint64
+
+	mu    sync.Mutex
+	days  map[dayKey]*day
+	swept time.Time
+}
+
+// Option configures an Aggregator
+type Option func(*Aggregator)
+
+// WithIntentClassifier sets the classifier of the intent frequencies. By default intents are not
+// counted.
+func WithIntentClassifier(c IntentClassifier) Option {
+	return func(a *Aggregator) {
+		a.classify = c
+	}
+}
+
+// WithClock sets the clock retention is measured on. It defaults to the real clock.
+func WithClock(c clock.Clock) Option {
+	return func(a *Aggregator) {
+		a.clock = c
+	}
+}
+
+// WithMetrics counts the aggregated sessions in the given registry, by whether their record was
+// kept
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(a *Aggregator) {
+		a.sessions = reg.Counter("pixa_aggregated_sessions_total",
+			"Sessions aggregated into the analytics, by whether their record was kept or discarded.", "record")
+	}
+}
+
+// New creates an aggregator passing the records of sessions on to next, which may be nil
+func New(cfg *config.Config, next store.TranscriptStore, opts ...Option) *Aggregator {
+	a := &Aggregator{
+		config: cfg,
+		next:   next,
+		clock:  clock.Real(),
+		key:    rand.Uint64(),
+		days:   make(map[dayKey]*day),
+	}
+	// the config is validated when it is loaded
+	for _, b := range cfg.Analytics.DurationBuckets {
+		d, _ := time.ParseDuration(b)
+		a.bounds = append(a.bounds, d)
+	}
+	a.retention, _ = time.ParseDuration(cfg.Analytics.Retention)
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// SaveSession aggregates a finished session, then saves its record in the next store unless the
+// session's tenant is aggregate only
+func (a *Aggregator) SaveSession(ctx context.Context, r store.SessionRecord) error {
+	a.add(r)
+	if a.next == nil || a.config.AggregateOnly(r.TenantID) {
+		a.counted("discarded")
+		return nil
+	}
+	if err := a.next.SaveSession(ctx, r); err != nil {
+		return err
+	}
+	a.counted("kept")
+	return nil
+}
+
+func (a *Aggregator) GetSession(ctx context.Context, id string) (store.SessionRecord, error) {
+	if a.next == nil {
+		return store.SessionRecord{}, store.ErrNotFound
+	}
+	return a.next.GetSession(ctx, id)
+}
+
+func (a *Aggregator) ListSessions(ctx context.Context, f store.SessionFilter) ([]store.SessionRecord, error) {
+	if a.next == nil {
+		return nil, nil
+	}
+	return a.next.ListSessions(ctx, f)
+}
+
+func (a *Aggregator) counted(record string) {
+	if a.sessions != nil {
+		a.sessions.With(record).Inc()
+	}
+}
+
+// add adds a session to the aggregates of the day it started
+func (a *Aggregator) add(r store.SessionRecord) {
+	var intents []string
+	if a.classify != nil {
+		intents = a.classify(r)
+	}
+	bucket := sort.Search(len(a.bounds), func(i int) bool { return r.Duration() <= a.bounds[i] })
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sweep()
+	key := dayKey{tenantID: r.TenantID, date: r.StartedAt.UTC().Format(dateFormat)}
+	d, ok := a.days[key]
+	if !ok {
+		d = &day{durations: make([]int, len(a.bounds)+1), intents: make(map[string]int)}
+		a.days[key] = d
+	}
+	d.sessions++
+	d.durations[bucket]++
+	// an intent counts once per session, so counts stand for sessions like the cohort size
+	seen := make(map[string]bool, len(intents))
+	for _, intent := range intents {
+		if !seen[intent] {
+			seen[intent] = true
+			d.intents[intent]++
+		}
+	}
+}
+
+// sweep drops the days past retention, at most once an hour
+func (a *Aggregator) sweep() {
+	now := a.clock.Now()
+	if a.retention <= 0 || now.Sub(a.swept) < time.Hour {
+		return
+	}
+	a.swept = now
+	oldest := now.Add(-a.retention).UTC().Format(dateFormat)
+	for key := range a.days {
+		if key.date < oldest {
+			delete(a.days, key)
+		}
+	}
+}
+
+// Report returns the aggregates of a tenant's sessions that started from the UTC day of from to
+// that of to, both included
+func (a *Aggregator) Report(tenantID string, from, to time.Time) Report {
+	cfg := a.config.Analytics
+	rep := Report{
+		TenantID:  tenantID,
+		From:      from.UTC().Format(dateFormat),
+		To:        to.UTC().Format(dateFormat),
+		MinCohort: cfg.MinCohort,
+	}
+
+	sessions := 0
+	durations := make([]int, len(a.bounds)+1)
+	intents := make(map[string]int)
+	a.mu.Lock()
+	for key, d := range a.days {
+		if key.tenantID != tenantID || key.date < rep.From || key.date > rep.To {
+			continue
+		}
+		sessions += d.sessions
+		for i, n := range d.durations {
+			durations[i] += n
+		}
+		for intent, n := range d.intents {
+			intents[intent] += n
+		}
+	}
+	a.mu.Unlock()
+
+	rep.Sessions = a.noisy(rep, "sessions", sessions)
+	if rep.Sessions < cfg.MinCohort {
+		rep.Sessions, rep.Withheld = 0, true
+		return rep
+	}
+	for i, n := range durations {
+		b := DurationBucket{Count: a.noisy(rep, "duration", n)}
+		if i < len(a.bounds) {
+			b.UpTo = cfg.DurationBuckets[i]
+		}
+		// empty buckets stand for no session
+		if b.Count > 0 && b.Count < cfg.MinCohort {
+			b.Count, b.Withheld = 0, true
+		}
+		rep.Durations = append(rep.Durations, b)
+	}
+	for intent, n := range intents {
+		if n = a.noisy(rep, "intent:"+intent, n); n >= cfg.MinCohort {
+			rep.Intents = append(rep.Intents, IntentCount{Intent: intent, Count: n})
+		}
+	}
+	sort.Slice(rep.Intents, func(i, j int) bool {
+		if rep.Intents[i].Count != rep.Intents[j].Count {
+			return rep.Intents[i].Count > rep.Intents[j].Count
+		}
+		return rep.Intents[i].Intent < rep.Intents[j].Intent
+	})
+	return rep
+}
+
+// noisy returns a count of a report with the Laplace noise of analytics.epsilon added. The noise
+// is drawn from the report's range and the count's name, so it is the same every time the report
+// is asked for.
+func (a *Aggregator) noisy(rep Report, name string, count int) int {
+	epsilon := a.config.Analytics.Epsilon
+	if epsilon <= 0 {
+		return count
+	}
+	h := fnv.New64a()
+	for _, s := range []string{rep.TenantID, rep.From, rep.To, name} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	rng := rand.New(rand.NewPCG(a.key, h.Sum64()))
+	u := rng.Float64() - 0.5
+	for u == -0.5 {
+		u = rng.Float64() - 0.5
+	}
+	noise := -math.Copysign(1/epsilon, u) * math.Log(1-2*math.Abs(u))
+	return max(0, int(math.Round(float64(count)+noise)))
+}
@@ -0,0 +1,81 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+func TestAggregator(t *testing.T) {
+	day := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	cfg := config.Default()
+	cfg.Analytics.MinCohort = 3
+	cfg.Analytics.DurationBuckets = []string{"1m", "5m"}
+	cfg.Analytics.Retention = "720h"
+	cfg.Tenants = map[string]config.TenantConfig{"acme": {AggregateOnly: true}}
+	next := store.NewMemoryStore(0)
+	classify := func(r store.SessionRecord) []string { return []string{r.Turns[0].Text, r.Turns[0].Text} }
+	clk := clock.NewFake(day.Add(48 * time.Hour))
+	a := New(cfg, next, WithIntentClassifier(classify), WithClock(clk))
+
+	// four short sessions asking for the menu, and one long one placing an order
+	for i, d := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 40 * time.Second, 10 * time.Minute} {
+		text := "menu"
+		if i == 4 {
+			text = "order"
+		}
+		for _, tenant := range []string{"acme", "globex"} {
+			r := store.SessionRecord{
+				ID:        fmt.Sprintf("%s-%d", tenant, i),
+				TenantID:  tenant,
+				StartedAt: day.Add(time.Duration(i) * time.Hour),
+				EndedAt:   day.Add(time.Duration(i)*time.Hour + d),
+				Turns:     []store.Turn{{Role: store.UserRole, Text: text}},
+			}
+			if err := a.SaveSession(context.Background(), r); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := a.GetSession(context.Background(), "acme-0"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected the records of an aggregate only tenant not to be kept, got %v", err)
+	}
+	if _, err := a.GetSession(context.Background(), "globex-0"); err != nil {
+		t.Fatalf("expected other tenants' records to be kept: %v", err)
+	}
+
+	rep := a.Report("acme", day, day)
+	if rep.Sessions != 5 || rep.Withheld || len(rep.Durations) != 3 {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	if b := rep.Durations; b[0].Count != 4 || b[0].UpTo != "1m" || !b[2].Withheld || b[2].Count != 0 || b[1].Count != 0 || b[1].Withheld {
+		t.Fatalf("unexpected durations %+v", b)
+	}
+	if len(rep.Intents) != 1 || rep.Intents[0] != (IntentCount{Intent: "menu", Count: 4}) {
+		t.Fatalf("expected only intents of a cohort to be reported, got %+v", rep.Intents)
+	}
+	if rep := a.Report("acme", day.Add(24*time.Hour), day.Add(24*time.Hour)); !rep.Withheld || rep.Sessions != 0 || rep.Durations != nil {
+		t.Fatalf("expected a report of too few sessions to be withheld, got %+v", rep)
+	}
+
+	// noise is the same each time a report is asked for
+	cfg.Analytics.Epsilon = 0.5
+	if first, again := a.Report("acme", day, day), a.Report("acme", day, day); !reflect.DeepEqual(first, again) {
+		t.Fatalf("expected the same noise for the same report, got %+v and %+v", first, again)
+	}
+	cfg.Analytics.Epsilon = 0
+
+	// days past retention are dropped
+	clk.Advance(31 * 24 * time.Hour)
+	a.SaveSession(context.Background(), store.SessionRecord{ID: "late", TenantID: "globex", StartedAt: clk.Now(), EndedAt: clk.Now(), Turns: []store.Turn{{Text: "menu"}}})
+	if rep := a.Report("acme", day, day); !rep.Withheld {
+		t.Fatalf("expected the aggregates past retention to be dropped, got %+v", rep)
+	}
+}
@@ -0,0 +1,69 @@
+// Package assets serves the audio clips the relay plays to devices itself, such as the filler
+// played while the model is thinking. Clips are 16 bit PCM WAV files in the assets directory.
+package assets
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+)
+
+// ErrNotFound is returned for clips that are not in the assets directory
+var ErrNotFound = errors.New("asset not found")
+
+// Manager loads audio clips from a directory and keeps them converted to the rates they are
+// asked for. It is safe for concurrent use.
+type Manager struct {
+	dir string
+
+	mu    sync.Mutex
+	clips map[clipKey][]byte
+}
+
+type clipKey struct {
+	name       string
+	sampleRate int
+}
+
+// NewManager creates a manager for the clips in dir
+func NewManager(dir string) *Manager {
+	return &Manager{dir: dir, clips: make(map[clipKey][]byte)}
+}
+
+// PCM16 returns the clip with the given file name as mono 16 bit PCM at sampleRate. The returned
+// slice is shared and must not be modified.
+func (m *Manager) PCM16(name string, sampleRate int) ([]byte, error) {
+	key := clipKey{name, sampleRate}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pcm, ok := m.clips[key]; ok {
+		return pcm, nil
+	}
+
+	if !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("invalid asset name %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(m.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	a, err := audio.FromWAV(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode asset %s: %w", name, err)
+	}
+	if a.GetChannels() == 2 {
+		a.StereoToMono()
+	}
+	a.Resample(sampleRate)
+
+	pcm := a.AsPCM16()
+	m.clips[key] = pcm
+	return pcm, nil
+}
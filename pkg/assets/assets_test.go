@@ -0,0 +1,67 @@
+package assets
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+)
+
+// wav encodes 16 bit PCM samples as a WAV file
+func wav(samples []int16, sampleRate, channels int) []byte {
+	data := make([]byte, 0, 44+2*len(samples))
+	data = append(data, "RIFF"...)
+	data = binary.LittleEndian.AppendUint32(data, uint32(36+2*len(samples)))
+	data = append(data, "WAVEfmt "...)
+	data = binary.LittleEndian.AppendUint32(data, 16)
+	data = binary.LittleEndian.AppendUint16(data, 1)
+	data = binary.LittleEndian.AppendUint16(data, uint16(channels))
+	data = binary.LittleEndian.AppendUint32(data, uint32(sampleRate))
+	data = binary.LittleEndian.AppendUint32(data, uint32(sampleRate*channels*2))
+	data = binary.LittleEndian.AppendUint16(data, uint16(channels*2))
+	data = binary.LittleEndian.AppendUint16(data, 16)
+	data = append(data, "data"...)
+	data = binary.LittleEndian.AppendUint32(data, uint32(2*len(samples)))
+	for _, s := range samples {
+		data = binary.LittleEndian.AppendUint16(data, uint16(s))
+	}
+	return data
+}
+
+func TestManager(t *testing.T) {
+	dir := t.TempDir()
+	// 100ms of stereo audio at 16kHz
+	stereo := make([]int16, 2*1600)
+	for i := range stereo {
+		stereo[i] = 1000
+	}
+	if err := os.WriteFile(filepath.Join(dir, "thinking.wav"), wav(stereo, 16000, 2), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(dir)
+
+	pcm, err := m.PCM16("thinking.wav", 8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pcm) != 800*2 {
+		t.Fatalf("expected 100ms of mono 8kHz audio, got %d bytes", len(pcm))
+	}
+	again, _ := m.PCM16("thinking.wav", 8000)
+	if &again[0] != &pcm[0] {
+		t.Fatal("converted clip was not cached")
+	}
+
+	if _, err := m.PCM16("missing.wav", 8000); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := m.PCM16("../thinking.wav", 8000); err == nil {
+		t.Fatal("asset outside the directory was loaded")
+	}
+	if _, err := audio.FromWAV([]byte("RIFF\x00\x00\x00\x00WAVE")); err == nil {
+		t.Fatal("WAV without data was decoded")
+	}
+}
@@ -1,6 +1,14 @@
 package audio
 
-import "testing"
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+)
 
 func TestAudioProcessing(t *testing.T) {
 	t.Run("test audio conversion", func(t *testing.T) {
@@ -13,3 +21,461 @@ func TestAudioProcessing(t *testing.T) {
 		t.Skip("Test not implemented")
 	})
 }
+
+func TestPCM16FastPath(t *testing.T) {
+	data := Int16ToPCM([]int16{0, 1000, -1000, 32767, -32768, 42})
+
+	t.Run("test matching format is passed through", func(t *testing.T) {
+		a := FromPCM16(data, 24000, 1)
+		a.Resample(24000)
+		if a.float32Data != nil {
+			t.Fatal("audio was decoded although it needs no conversion")
+		}
+		if out := a.AsPCM16(); &out[0] != &data[0] || len(out) != len(data) {
+			t.Fatal("expected the original PCM to be returned")
+		}
+		if a.Duration() != 250*time.Microsecond {
+			t.Fatalf("unexpected duration %s", a.Duration())
+		}
+	})
+
+	t.Run("test processed audio is re-encoded", func(t *testing.T) {
+		a := FromPCM16(data, 24000, 1)
+		a.Resample(12000)
+		if out := a.AsPCM16(); len(out) != len(data)/2 {
+			t.Fatalf("expected %d bytes after resampling, got %d", len(data)/2, len(out))
+		}
+
+		stereo := FromPCM16(data, 24000, 2)
+		stereo.StereoToMono()
+		if out := stereo.AsPCM16(); len(out) != len(data)/2 || &out[0] == &data[0] {
+			t.Fatal("expected downmixed audio to be re-encoded")
+		}
+	})
+}
+
+func TestG711(t *testing.T) {
+	t.Run("test μ-law expansion", func(t *testing.T) {
+		got := ULawToInt16([]byte{0xFF, 0x7F, 0x00, 0x80})
+		want := []int16{0, 0, -32124, 32124}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("sample %d: got %d, want %d", i, got[i], want[i])
+			}
+		}
+	})
+
+	t.Run("test A-law expansion", func(t *testing.T) {
+		got := ALawToInt16([]byte{0xD5, 0x55, 0xAA, 0x2A})
+		want := []int16{8, -8, 32256, -32256}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("sample %d: got %d, want %d", i, got[i], want[i])
+			}
+		}
+	})
+
+	t.Run("test compression", func(t *testing.T) {
+		codes := make([]byte, 256)
+		for i := range codes {
+			codes[i] = byte(i)
+		}
+		for i, got := range Int16ToALaw(ALawToInt16(codes)) {
+			if got != codes[i] {
+				t.Errorf("A-law code %#x compressed back to %#x", codes[i], got)
+			}
+		}
+		for i, got := range Int16ToULaw(ULawToInt16(codes)) {
+			// μ-law has a negative zero, compressed as the positive one
+			if got != codes[i] && codes[i] != 0x7F {
+				t.Errorf("μ-law code %#x compressed back to %#x", codes[i], got)
+			}
+		}
+		// other samples are compressed to a step near them
+		samples := []int16{1000, -1000, 32767, -32768}
+		a := FromPCM16(Int16ToPCM(samples), 8000, 1)
+		for _, got := range [][]int16{ULawToInt16(a.AsULaw()), ALawToInt16(a.AsALaw())} {
+			for i, want := range samples {
+				if diff := math.Abs(float64(got[i]) - float64(want)); diff > math.Abs(float64(want))*0.04 {
+					t.Errorf("sample %d: compressed to %d, want about %d", i, got[i], want)
+				}
+			}
+		}
+	})
+}
+
+func TestWidePCM(t *testing.T) {
+	// full scale, negative full scale, and 384 which rounds to 2 at 16 bit
+	pcm24 := []byte{0xFF, 0xFF, 0x7F, 0x00, 0x00, 0x80, 0x80, 0x01, 0x00}
+	pcm32 := []byte{0xFF, 0xFF, 0xFF, 0x7F, 0x00, 0x00, 0x00, 0x80, 0x00, 0x80, 0x01, 0x00}
+	want := Int16ToPCM([]int16{32767, -32768, 2})
+	for name, dec := range map[string]Decoder{"24": PCM24Decoder{}, "32": PCM32Decoder{}} {
+		in := pcm24
+		if name == "32" {
+			in = pcm32
+		}
+		got, err := dec.Decode(in)
+		if err != nil || !slices.Equal(got, want) {
+			t.Errorf("%s bit: got %v, %v, want %v", name, got, err, want)
+		}
+		if _, err := dec.Decode(in[:len(in)-1]); err == nil {
+			t.Errorf("%s bit: expected a partial sample to be refused", name)
+		}
+	}
+
+	var f32 []byte
+	for _, s := range []float32{0.25, -1.5, float32(math.NaN()), -1} {
+		f32 = binary.LittleEndian.AppendUint32(f32, math.Float32bits(s))
+	}
+	got, err := Float32Decoder{}.Decode(f32)
+	if want := Int16ToPCM([]int16{8192, -32768, 0, -32768}); err != nil || !slices.Equal(got, want) {
+		t.Errorf("float32: got %v, %v, want %v", got, err, want)
+	}
+	a := FromPCMFloat32(f32, 16000, 1)
+	if f := a.AsFloat32(); !slices.Equal(f, []float32{0.25, -1, 0, -1}) {
+		t.Errorf("expected float32 samples clipped and NaN silenced, got %v", f)
+	}
+
+	for _, a := range []Audio{FromPCM24(pcm24, 16000, 1), FromPCM32(pcm32, 16000, 1)} {
+		f := a.AsFloat32()
+		if len(f) != 3 || f[0] < 0.9999 || f[1] != -1 || math.Abs(float64(f[2])-384.0/(1<<23)) > 1e-9 {
+			t.Errorf("unexpected samples %v", f)
+		}
+	}
+
+	// the decoders give the samples as they are as well, not rounded to 16 bit
+	for name, c := range map[string]struct {
+		dec  SampleDecoder
+		in   []byte
+		want float32
+	}{
+		"24":      {PCM24Decoder{}, pcm24, 384.0 / (1 << 23)},
+		"32":      {PCM32Decoder{}, pcm32, 384.0 / (1 << 23)},
+		"float32": {Float32Decoder{}, binary.LittleEndian.AppendUint32(f32, math.Float32bits(0.1)), 0.1},
+	} {
+		a, err := c.dec.DecodeAudio(c.in, 16000, 1)
+		if f := a.AsFloat32(); err != nil || len(f) == 0 || math.Abs(float64(f[len(f)-1]-c.want)) > 1e-9 || a.GetSampleRate() != 16000 {
+			t.Errorf("%s: got %v, %v, want the last sample %v", name, f, err, c.want)
+		}
+		if _, err := c.dec.DecodeAudio(c.in[:len(c.in)-1], 16000, 1); err == nil {
+			t.Errorf("%s: expected a partial sample to be refused", name)
+		}
+	}
+}
+
+func TestResampler(t *testing.T) {
+	for _, from := range []int{8000, 16000, 22050, 44100, 48000} {
+		// a second of a 440 Hz tone, streamed in chunks of uneven length
+		tone := make([]int16, from)
+		for i := range tone {
+			tone[i] = int16(8000 * math.Sin(2*math.Pi*440*float64(i)/float64(from)))
+		}
+		r := NewResampler(from, 24000, 1)
+		var out []float32
+		for start, n := 0, 0; start < len(tone); start += n {
+			n = min(137+start%211, len(tone)-start)
+			a := r.Resample(FromPCM16(Int16ToPCM(tone[start:start+n]), from, 1))
+			if a.GetSampleRate() != 24000 {
+				t.Fatalf("%d Hz: resampled to %d Hz", from, a.GetSampleRate())
+			}
+			out = append(out, a.AsFloat32()...)
+		}
+		// what falls after the last frame received waits for the next chunk
+		if len(out) > 24000 || len(out) < 24000-24000/from-1 {
+			t.Fatalf("%d Hz: got %d samples for a second at 24 kHz", from, len(out))
+		}
+		// the chunks join into the tone at the new rate, without drift
+		for i, got := range out {
+			want := 8000 * math.Sin(2*math.Pi*440*float64(i)/24000) / 32768
+			if math.Abs(float64(got)-want) > 0.01 {
+				t.Fatalf("%d Hz: sample %d is %.4f, want %.4f", from, i, got, want)
+			}
+		}
+	}
+
+	a := FromPCM16(Int16ToPCM([]int16{1, 2, 3}), 24000, 1)
+	if out := NewResampler(24000, 24000, 1).Resample(a); out.AsPCM16()[0] != 1 || out.GetSampleRate() != 24000 {
+		t.Fatal("expected audio at the target rate to be passed through")
+	}
+	if out := NewSincResampler(24000, 24000, 1).Resample(a); out.AsPCM16()[0] != 1 {
+		t.Fatal("expected audio at the target rate to be passed through")
+	}
+}
+
+func TestSincResampler(t *testing.T) {
+	stream := func(r *Resampler, tone []int16, from int) []float32 {
+		var out []float32
+		for start, n := 0, 0; start < len(tone); start += n {
+			n = min(137+start%211, len(tone)-start)
+			a := r.Resample(FromPCM16(Int16ToPCM(tone[start:start+n]), from, 1))
+			out = append(out, a.AsFloat32()...)
+		}
+		return out
+	}
+	sine := func(freq float64, rate int) []int16 {
+		tone := make([]int16, rate)
+		for i := range tone {
+			tone[i] = int16(8000 * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)))
+		}
+		return tone
+	}
+
+	for _, from := range []int{8000, 16000, 22050, 44100, 48000} {
+		out := stream(NewSincResampler(from, 24000, 1), sine(440, from), from)
+		// the end of the stream waits for the audio after it, a few milliseconds
+		if len(out) > 24000 || len(out) < 24000-60 {
+			t.Fatalf("%d Hz: got %d samples for a second at 24 kHz", from, len(out))
+		}
+		// past the start, filtered from the silence before the stream, the tone comes through in
+		// time with the input
+		for i := 100; i < len(out); i++ {
+			want := 8000 * math.Sin(2*math.Pi*440*float64(i)/24000) / 32768
+			if math.Abs(float64(out[i])-want) > 0.005 {
+				t.Fatalf("%d Hz: sample %d is %.4f, want %.4f", from, i, out[i], want)
+			}
+		}
+	}
+
+	// an 18 kHz tone cannot be carried at 24 kHz; interpolating folds it back to 6 kHz, while the
+	// filter removes it
+	rms := func(s []float32) float64 {
+		var sum float64
+		for _, v := range s[100:] {
+			sum += float64(v) * float64(v)
+		}
+		return math.Sqrt(sum / float64(len(s)-100))
+	}
+	high := sine(18000, 48000)
+	linear, filtered := rms(stream(NewResampler(48000, 24000, 1), high, 48000)), rms(stream(NewSincResampler(48000, 24000, 1), high, 48000))
+	if linear < 0.05 || filtered > 0.001 {
+		t.Fatalf("expected the tone aliased by interpolation only, got %.4f and %.4f rms", linear, filtered)
+	}
+}
+
+func TestTestSignal(t *testing.T) {
+	const rate = 16000
+	sweep := TestSignal{From: 250, To: 4000, Duration: time.Second}
+	if f := sweep.Frequency(500 * time.Millisecond); math.Abs(f-1000) > 1e-6 {
+		t.Fatalf("sweep is at %.1f Hz halfway, want 1000 Hz, two octaves up in four", f)
+	}
+	if f := sweep.Frequency(2 * time.Second); f != 4000 {
+		t.Fatalf("sweep is at %.1f Hz after its end, want 4000 Hz", f)
+	}
+
+	tone := TestSignal{From: 1000, To: 1000, Duration: 100 * time.Millisecond}
+	samples, err := Pcm16ToInt16Slice(tone.PCM(rate, -6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1600 || samples[0] != 0 {
+		t.Fatalf("rendered %d samples starting at %d, want 1600 faded in from 0", len(samples), samples[0])
+	}
+	peak := int16(0)
+	for _, v := range samples {
+		peak = max(peak, v)
+	}
+	if want := int16(32767 / 2); math.Abs(float64(peak-want)) > 200 {
+		t.Fatalf("tone peaks at %d, want about %d at -6 dBFS", peak, want)
+	}
+	middle := samples[320:640]
+	if share := BandShare(middle, rate, 1000, 1000); share < 0.9 {
+		t.Fatalf("share of the tone at 1000 Hz is %.2f, want nearly all", share)
+	}
+	if share := BandShare(middle, rate, 2000, 3000); share > 0.1 {
+		t.Fatalf("share of the tone from 2000 to 3000 Hz is %.2f, want nearly none", share)
+	}
+	chirp, _ := Pcm16ToInt16Slice(TestSignal{From: 2000, To: 3000, Duration: 20 * time.Millisecond}.PCM(rate, -6))
+	if share := BandShare(chirp, rate, 2000, 3000); share < 0.9 {
+		t.Fatalf("share of a sweep from 2000 to 3000 Hz in its band is %.2f, want nearly all", share)
+	}
+	if share := BandShare(make([]int16, 320), rate, 1000, 1000); share != 0 {
+		t.Fatalf("share of silence is %.2f, want 0", share)
+	}
+}
+
+func TestDownmix(t *testing.T) {
+	// two frames of four channels
+	pcm := Int16ToPCM([]int16{100, 300, -200, 0, -4, 8, 12, 0})
+	tests := []struct {
+		mode string
+		to   int
+		want []int16
+	}{
+		{"average", 1, []int16{50, 4}},
+		{"left", 1, []int16{100, -4}},
+		{"right", 2, []int16{300, 300, 8, 8}},
+		{"2", 1, []int16{-200, 12}},
+	}
+	for _, tt := range tests {
+		channel, err := DownmixChannel(tt.mode)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.mode, err)
+		}
+		got, _ := Pcm16ToInt16Slice(Downmix(append(pcm, 1), 4, tt.to, channel))
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s to %d channels: got %v, want %v", tt.mode, tt.to, got, tt.want)
+		}
+	}
+
+	for _, mode := range []string{"", "center", "-1"} {
+		if _, err := DownmixChannel(mode); err == nil {
+			t.Errorf("expected downmix %q to be refused", mode)
+		}
+	}
+}
+
+func TestSpectralDenoiser(t *testing.T) {
+	const rate = 16000
+	// a second of noise, then a second of a 440 Hz tone over the noise, then noise again
+	rng := rand.New(rand.NewPCG(1, 2))
+	input := make([]int16, 3*rate)
+	for i := range input {
+		s := 1000 * rng.NormFloat64()
+		if i >= rate && i < 2*rate {
+			s += 8000 * math.Sin(2*math.Pi*440*float64(i)/rate)
+		}
+		input[i] = int16(s)
+	}
+	d := NewSpectralDenoiser(rate, 1, 20)
+	var out []int16
+	for start, n := 0, 0; start < len(input); start += n {
+		n = min(137+start%211, len(input)-start)
+		chunk := Int16ToPCM(input[start : start+n])
+		denoised := d.Denoise(chunk)
+		if len(denoised) != len(chunk) {
+			t.Fatalf("denoised a chunk of %d bytes to %d bytes", len(chunk), len(denoised))
+		}
+		samples, err := Pcm16ToInt16Slice(denoised)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, samples...)
+	}
+
+	level := func(s []int16) float64 {
+		var sum float64
+		for _, v := range s {
+			sum += float64(v) * float64(v)
+		}
+		return 10 * math.Log10(sum/float64(len(s)))
+	}
+	lag := d.Latency()
+	// the noise is learnt within the first half second and then suppressed
+	noise, denoised := level(input[rate/2:rate]), level(out[rate/2+lag:rate+lag])
+	if noise-denoised < 10 {
+		t.Errorf("noise lowered by %.1f dB, want at least 10 dB", noise-denoised)
+	}
+	// the tone is kept
+	tone, kept := level(input[rate+rate/4:2*rate-rate/4]), level(out[rate+rate/4+lag:2*rate-rate/4+lag])
+	if math.Abs(tone-kept) > 1 {
+		t.Errorf("tone changed by %.1f dB, want it kept", kept-tone)
+	}
+	// and the noise is suppressed again after it
+	if after := level(out[2*rate+rate/2+lag:]); noise-after < 10 {
+		t.Errorf("noise after the tone lowered by %.1f dB, want at least 10 dB", noise-after)
+	}
+}
+
+func TestConcealer(t *testing.T) {
+	const rate = 16000
+	// a 200 Hz tone, 80 samples a period
+	tone := func(i int) int16 { return int16(10000 * math.Sin(2*math.Pi*200*float64(i)/rate)) }
+	heard := make([]int16, 320)
+	for i := range heard {
+		heard[i] = tone(i)
+	}
+	pcm := Int16ToPCM(heard)
+
+	c := NewConcealer(rate, 1, true, 20*time.Millisecond, 40*time.Millisecond)
+	c.Observe(pcm)
+	out, err := Pcm16ToInt16Slice(c.Conceal(2 * 1600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the gap is cut to 40ms, and silent once faded after 20ms
+	if len(out) != 640 {
+		t.Fatalf("concealed %d samples, want 640", len(out))
+	}
+	for i, s := range out {
+		want := float64(tone(len(heard)+i)) * max(1-float64(i)/320, 0)
+		if math.Abs(float64(s)-want) > 10 {
+			t.Fatalf("sample %d of the gap is %d, want the tone faded to %.0f", i, s, want)
+		}
+	}
+
+	hold := NewConcealer(rate, 1, false, 20*time.Millisecond, 40*time.Millisecond)
+	hold.Observe(pcm)
+	out, _ = Pcm16ToInt16Slice(hold.Conceal(2 * 160))
+	if out[0] != heard[len(heard)-1] || out[80] != int16(float64(heard[len(heard)-1])*0.75) {
+		t.Errorf("held %d and %d, want the last sample %d faded", out[0], out[80], heard[len(heard)-1])
+	}
+
+	// nothing heard yet conceals with silence
+	out, _ = Pcm16ToInt16Slice(NewConcealer(rate, 1, true, 20*time.Millisecond, 40*time.Millisecond).Conceal(2 * 160))
+	for _, s := range out {
+		if s != 0 {
+			t.Fatalf("concealed %d before anything was heard, want silence", s)
+		}
+	}
+}
+
+func TestOggOpusWriter(t *testing.T) {
+	if got := oggChecksum([]byte("123456789")); got != 0x89a1897f {
+		t.Fatalf("Ogg CRC of the check string is %#x, want 0x89a1897f", got)
+	}
+	var out bytes.Buffer
+	w, err := NewOggOpusWriter(&out, 7, 16000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePacket(make([]byte, 300), 320); err != nil {
+		t.Fatal(err)
+	}
+
+	type page struct {
+		headerType byte
+		granule    uint64
+		seq        uint32
+		packet     []byte
+	}
+	var pages []page
+	for rest := out.Bytes(); len(rest) > 0; {
+		if len(rest) < 27 || string(rest[:4]) != "OggS" {
+			t.Fatalf("no Ogg page at %d bytes from the end", len(rest))
+		}
+		segments := int(rest[26])
+		size := 0
+		for _, n := range rest[27 : 27+segments] {
+			size += int(n)
+		}
+		p := slices.Clone(rest[:27+segments+size])
+		crc := binary.LittleEndian.Uint32(p[22:])
+		binary.LittleEndian.PutUint32(p[22:], 0)
+		if crc != oggChecksum(p) {
+			t.Fatalf("page %d has a wrong checksum", len(pages))
+		}
+		pages = append(pages, page{p[5], binary.LittleEndian.Uint64(p[6:]), binary.LittleEndian.Uint32(p[18:]), p[27+segments:]})
+		rest = rest[len(p):]
+	}
+	if len(pages) != 3 || pages[0].headerType != 2 || string(pages[0].packet[:8]) != "OpusHead" || string(pages[1].packet[:8]) != "OpusTags" {
+		t.Fatalf("expected the Opus headers and a packet, got %+v", pages)
+	}
+	if rate := binary.LittleEndian.Uint32(pages[0].packet[12:]); rate != 16000 || pages[0].packet[9] != 1 {
+		t.Fatalf("OpusHead gives %d channels at %d Hz", pages[0].packet[9], rate)
+	}
+	// 20ms at 16 kHz are 960 samples at the 48 kHz of Ogg/Opus granule positions
+	if p := pages[2]; p.seq != 2 || p.granule != 960 || len(p.packet) != 300 {
+		t.Fatalf("unexpected audio page %+v", p)
+	}
+}
+
+func TestStreamingWAVHeader(t *testing.T) {
+	header := StreamingWAVHeader(16000, 1)
+	a, err := FromWAV(append(header, Int16ToPCM([]int16{1, 2, 3})...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header) != 44 || a.GetSampleRate() != 16000 || a.GetChannels() != 1 || a.Duration() != 3*time.Second/16000 {
+		t.Fatalf("unexpected WAV stream %d bytes of header, %d Hz, %d channels", len(header), a.GetSampleRate(), a.GetChannels())
+	}
+}
@@ -0,0 +1,29 @@
+package audio
+
+// Decoder decodes the packets of a compressed audio stream, such as Opus, to 16 bit PCM. Codecs
+// carry state from packet to packet, so every stream needs a decoder of its own.
+type Decoder interface {
+	// Decode decodes a packet to interleaved 16 bit little endian PCM
+	Decode(packet []byte) ([]byte, error)
+}
+
+// SampleDecoder is a Decoder of audio finer than 16 bit PCM, which can also decode a packet to
+// its samples as they are, so they reach resampling and the provider without being rounded first
+type SampleDecoder interface {
+	Decoder
+	// DecodeAudio decodes a packet to audio of the given sample rate and channels
+	DecodeAudio(packet []byte, sampleRate, channels int) (Audio, error)
+}
+
+// DecoderFactory creates the decoder of a stream decoded to the given sample rate and channels
+type DecoderFactory func(sampleRate, channels int) (Decoder, error)
+
+// Encoder encodes 16 bit PCM to the packets of a compressed audio stream, such as Opus. Like
+// decoders, every stream needs an encoder of its own.
+type Encoder interface {
+	// Encode encodes one frame of interleaved 16 bit little endian PCM, 20ms long, to a packet
+	Encode(pcm []byte) ([]byte, error)
+}
+
+// EncoderFactory creates the encoder of a stream of the given sample rate and channels
+type EncoderFactory func(sampleRate, channels int) (Encoder, error)
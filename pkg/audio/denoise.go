@@ -0,0 +1,232 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"math/cmplx"
+)
+
+// Denoiser suppresses the background noise of a stream of 16 bit PCM, such as the machines of a
+// factory floor, while keeping speech. Denoisers learn the noise as the stream goes, so every
+// stream needs a denoiser of its own.
+type Denoiser interface {
+	// Denoise returns the next chunk of the stream with its noise suppressed, as interleaved 16 bit
+	// little endian PCM of the same length as pcm. The output may lag the input by a fixed delay.
+	Denoise(pcm []byte) []byte
+}
+
+// DenoiserFactory creates the denoiser of a stream at the given sample rate and channels
+type DenoiserFactory func(sampleRate, channels int) (Denoiser, error)
+
+const (
+	// denoiseFrame is the least audio the spectral denoiser analyses at once
+	denoiseFrame = 0.02
+	// noiseSmoothing is how much of a bin's smoothed power carries over from frame to frame
+	noiseSmoothing = 0.9
+	// noiseWarmup is how many frames the noise estimate follows the power of each bin before
+	// it tracks its minimum, so the first frame, which is half silence, does not set it too low
+	noiseWarmup = 4
+	// noiseRise is how much the noise estimate of a bin may grow per frame; it falls at once to
+	// quieter frames, so it follows the minimum of the bin's power rather than the speech in it
+	noiseRise = 1.02
+	// noiseBias makes up for the minimum of a bin's power lying below the mean of its noise
+	noiseBias = 1.5
+	// overSubtraction is how many times the noise estimate is taken off a bin's power, which
+	// leaves less of the noise that rises above its estimate
+	overSubtraction = 2
+	// gainSmoothing is how much of a bin's gain carries over from frame to frame, which keeps the
+	// residual noise from warbling
+	gainSmoothing = 0.4
+)
+
+// SpectralDenoiser is a pure Go denoiser that suppresses stationary noise, such as the hum of
+// machines or the fans of a kitchen, by spectral subtraction. It analyses overlapping frames of
+// at least 20ms, tracks the minimum of each frequency's power as the noise, and attenuates each
+// frequency by how much of its power is noise, by at most its max attenuation. Its output lags
+// the input by one frame. Deployments wanting to suppress noise that changes, such as chatter,
+// plug in a trained denoiser like RNNoise instead.
+type SpectralDenoiser struct {
+	size     int
+	hop      int
+	channels int
+	floor    float64
+	window   []float64
+	channel  []*denoiseChannel
+	// fresh holds the interleaved samples not yet analysed, and ready those denoised but not yet
+	// returned
+	fresh []int16
+	ready []int16
+}
+
+// denoiseChannel is the state of one channel of a spectral denoiser
+type denoiseChannel struct {
+	// frame holds the last frame of input and overlap the output that frames after it add to
+	frame   []float64
+	overlap []float64
+	power   []float64
+	noise   []float64
+	gain    []float64
+	// frames counts the frames analysed
+	frames int
+}
+
+// NewSpectralDenoiser creates a spectral denoiser of audio at sampleRate that lowers noise by at
+// most maxAttenuation dB
+func NewSpectralDenoiser(sampleRate, channels int, maxAttenuation float64) *SpectralDenoiser {
+	channels = max(channels, 1)
+	size := 1
+	for float64(size) < float64(sampleRate)*denoiseFrame {
+		size *= 2
+	}
+	d := &SpectralDenoiser{
+		size:     size,
+		hop:      size / 2,
+		channels: channels,
+		floor:    math.Pow(10, -maxAttenuation/20),
+		window:   make([]float64, size),
+		// the hop of silence makes up for the samples still waiting for their frame, so every
+		// chunk is returned at its own length
+		ready: make([]int16, size/2*channels),
+	}
+	// a square root Hann window for analysis and again for synthesis adds up to one at half
+	// overlap, so frames that are not attenuated are rebuilt as they were
+	for i := range d.window {
+		d.window[i] = math.Sqrt(0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(size)))
+	}
+	bins := size/2 + 1
+	for range channels {
+		d.channel = append(d.channel, &denoiseChannel{
+			frame:   make([]float64, size),
+			overlap: make([]float64, size),
+			power:   make([]float64, bins),
+			noise:   make([]float64, bins),
+			gain:    make([]float64, bins),
+		})
+	}
+	return d
+}
+
+// SpectralDenoisers returns a factory of spectral denoisers lowering noise by at most
+// maxAttenuation dB
+func SpectralDenoisers(maxAttenuation float64) DenoiserFactory {
+	return func(sampleRate, channels int) (Denoiser, error) {
+		return NewSpectralDenoiser(sampleRate, channels, maxAttenuation), nil
+	}
+}
+
+// Latency returns the number of frames the output lags the input by
+func (d *SpectralDenoiser) Latency() int {
+	return d.size
+}
+
+func (d *SpectralDenoiser) Denoise(pcm []byte) []byte {
+	n := len(pcm) / 2
+	for i := 0; i < n; i++ {
+		d.fresh = append(d.fresh, int16(binary.LittleEndian.Uint16(pcm[2*i:])))
+	}
+	step := d.hop * d.channels
+	for len(d.fresh) >= step {
+		d.process(d.fresh[:step])
+		d.fresh = append(d.fresh[:0], d.fresh[step:]...)
+	}
+	out := make([]byte, 2*n)
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint16(out[2*i:], uint16(d.ready[i]))
+	}
+	d.ready = append(d.ready[:0], d.ready[n:]...)
+	return out
+}
+
+// process denoises the next hop of interleaved samples into ready
+func (d *SpectralDenoiser) process(hop []int16) {
+	start := len(d.ready)
+	d.ready = append(d.ready, make([]int16, len(hop))...)
+	spectrum := make([]complex128, d.size)
+	for c, ch := range d.channel {
+		copy(ch.frame, ch.frame[d.hop:])
+		for i := 0; i < d.hop; i++ {
+			ch.frame[d.size-d.hop+i] = float64(hop[i*d.channels+c])
+		}
+		for i, s := range ch.frame {
+			spectrum[i] = complex(s*d.window[i], 0)
+		}
+		fft(spectrum, false)
+		ch.suppress(spectrum, d.floor)
+		fft(spectrum, true)
+
+		for i := range ch.overlap {
+			ch.overlap[i] += real(spectrum[i]) * d.window[i]
+		}
+		for i := 0; i < d.hop; i++ {
+			s := math.Round(max(min(ch.overlap[i], math.MaxInt16), math.MinInt16))
+			d.ready[start+i*d.channels+c] = int16(s)
+		}
+		copy(ch.overlap, ch.overlap[d.hop:])
+		clear(ch.overlap[d.size-d.hop:])
+	}
+}
+
+// suppress updates the noise estimate with a frame's spectrum and attenuates its noise
+func (ch *denoiseChannel) suppress(spectrum []complex128, floor float64) {
+	size := len(spectrum)
+	for k := range ch.power {
+		p := real(spectrum[k])*real(spectrum[k]) + imag(spectrum[k])*imag(spectrum[k])
+		if ch.frames == 0 {
+			ch.power[k], ch.gain[k] = p, 1
+		}
+		ch.power[k] = noiseSmoothing*ch.power[k] + (1-noiseSmoothing)*p
+		if ch.frames < noiseWarmup {
+			ch.noise[k] = ch.power[k]
+		} else {
+			ch.noise[k] = min(ch.power[k], ch.noise[k]*noiseRise)
+		}
+
+		g := floor
+		if p > 0 {
+			g = max(math.Sqrt(max(1-overSubtraction*noiseBias*ch.noise[k]/p, 0)), floor)
+		}
+		g = gainSmoothing*ch.gain[k] + (1-gainSmoothing)*g
+		ch.gain[k] = g
+		spectrum[k] *= complex(g, 0)
+		if k > 0 && k < size/2 {
+			spectrum[size-k] *= complex(g, 0)
+		}
+	}
+	ch.frames++
+}
+
+// fft transforms x in place with the radix-2 fast Fourier transform; len(x) must be a power of
+// two. The inverse transform is scaled by 1/len(x).
+func fft(x []complex128, inverse bool) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	sign := -1.0
+	if inverse {
+		sign = 1
+	}
+	for length := 2; length <= n; length <<= 1 {
+		w := cmplx.Rect(1, sign*2*math.Pi/float64(length))
+		for i := 0; i < n; i += length {
+			wk := complex(1, 0)
+			for k := 0; k < length/2; k++ {
+				a, b := x[i+k], x[i+k+length/2]*wk
+				x[i+k], x[i+k+length/2] = a+b, a-b
+				wk *= w
+			}
+		}
+	}
+	if inverse {
+		for i := range x {
+			x[i] /= complex(float64(n), 0)
+		}
+	}
+}
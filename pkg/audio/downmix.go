@@ -0,0 +1,55 @@
+package audio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// MixChannels is the channel of a downmix that averages all channels rather than taking one
+const MixChannels = -1
+
+// DownmixChannel returns the channel a downmix mode takes: MixChannels for "average", 0 for
+// "left", 1 for "right", or the 0-based channel of a number
+func DownmixChannel(mode string) (int, error) {
+	switch mode = strings.ToLower(strings.TrimSpace(mode)); mode {
+	case "average":
+		return MixChannels, nil
+	case "left":
+		return 0, nil
+	case "right":
+		return 1, nil
+	}
+	channel, err := strconv.Atoi(mode)
+	if err != nil || channel < 0 {
+		return 0, fmt.Errorf("invalid downmix %q: want average, left, right or a channel number", mode)
+	}
+	return channel, nil
+}
+
+// Downmix converts interleaved 16 bit PCM of from channels to to channels. Every channel of the
+// output is the given channel of the input, or the average of all input channels for
+// MixChannels, so a board with its only microphone on one channel need not be heard at half its
+// level. A trailing partial frame is dropped.
+func Downmix(pcm []byte, from, to, channel int) []byte {
+	frames := len(pcm) / (2 * from)
+	out := make([]byte, 2*frames*to)
+	for i := 0; i < frames; i++ {
+		in := pcm[2*from*i:]
+		var s float64
+		if channel == MixChannels {
+			for c := 0; c < from; c++ {
+				s += float64(int16(binary.LittleEndian.Uint16(in[2*c:])))
+			}
+			s = math.Round(s / float64(from))
+		} else {
+			s = float64(int16(binary.LittleEndian.Uint16(in[2*channel:])))
+		}
+		for c := 0; c < to; c++ {
+			binary.LittleEndian.PutUint16(out[2*(to*i+c):], uint16(int16(s)))
+		}
+	}
+	return out
+}
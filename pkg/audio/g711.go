@@ -0,0 +1,136 @@
+package audio
+
+// G.711 companding as specified in ITU-T G.711. Every byte holds a single 8 bit sample that expands to 16 bit linear PCM.
+
+const (
+	// ulawBias is added to the magnitude of samples before μ-law compression, and ulawClip is the
+	// largest magnitude that is compressed without overflowing
+	ulawBias = 0x84
+	ulawClip = 32635
+)
+
+// ULawToInt16 expands μ-law encoded samples to 16 bit linear PCM
+func ULawToInt16(data []byte) []int16 {
+	out := make([]int16, len(data))
+	for i, u := range data {
+		u = ^u
+		exponent := (u >> 4) & 0x07
+		mantissa := int32(u & 0x0F)
+		sample := ((mantissa << 3) + 0x84) << exponent
+		sample -= 0x84
+		if u&0x80 != 0 {
+			sample = -sample
+		}
+		out[i] = int16(sample)
+	}
+	return out
+}
+
+// ALawToInt16 expands A-law encoded samples to 16 bit linear PCM
+func ALawToInt16(data []byte) []int16 {
+	out := make([]int16, len(data))
+	for i, a := range data {
+		a ^= 0x55
+		exponent := (a >> 4) & 0x07
+		mantissa := int32(a & 0x0F)
+		var sample int32
+		if exponent == 0 {
+			sample = (mantissa << 4) + 8
+		} else {
+			sample = ((mantissa << 4) + 0x108) << (exponent - 1)
+		}
+		if a&0x80 == 0 {
+			sample = -sample
+		}
+		out[i] = int16(sample)
+	}
+	return out
+}
+
+// Int16ToULaw compresses 16 bit linear PCM to μ-law
+func Int16ToULaw(data []int16) []byte {
+	out := make([]byte, len(data))
+	for i, s := range data {
+		sample := int32(s)
+		var sign byte
+		if sample < 0 {
+			sample = -sample
+			sign = 0x80
+		}
+		sample = min(sample, ulawClip) + ulawBias
+		exponent := byte(7)
+		for mask := int32(0x4000); sample&mask == 0 && exponent > 0; mask >>= 1 {
+			exponent--
+		}
+		mantissa := byte(sample>>(exponent+3)) & 0x0F
+		out[i] = ^(sign | exponent<<4 | mantissa)
+	}
+	return out
+}
+
+// Int16ToALaw compresses 16 bit linear PCM to A-law
+func Int16ToALaw(data []int16) []byte {
+	out := make([]byte, len(data))
+	for i, s := range data {
+		sample := int32(s)
+		sign := byte(0x80)
+		if sample < 0 {
+			sample = -sample
+			sign = 0
+		}
+		sample = min(sample, 32767)
+		var code byte
+		if sample < 256 {
+			code = byte(sample >> 4)
+		} else {
+			exponent := byte(7)
+			for mask := int32(0x4000); sample&mask == 0 && exponent > 1; mask >>= 1 {
+				exponent--
+			}
+			code = exponent<<4 | byte(sample>>(exponent+3))&0x0F
+		}
+		out[i] = (sign | code) ^ 0x55
+	}
+	return out
+}
+
+// ULawDecoder decodes the audio frames of devices that send μ-law. G.711 keeps no state from frame
+// to frame, so a single decoder serves any number of streams.
+type ULawDecoder struct{}
+
+func (ULawDecoder) Decode(packet []byte) ([]byte, error) {
+	return Int16ToPCM(ULawToInt16(packet)), nil
+}
+
+// ALawDecoder decodes the audio frames of devices that send A-law, like ULawDecoder
+type ALawDecoder struct{}
+
+func (ALawDecoder) Decode(packet []byte) ([]byte, error) {
+	return Int16ToPCM(ALawToInt16(packet)), nil
+}
+
+func FromULaw(data []byte, sampleRate int, channels int) Audio {
+	return Audio{
+		float32Data: Int16ToFloat32(ULawToInt16(data)),
+		sampleRate:  sampleRate,
+		channels:    channels,
+	}
+}
+
+func FromALaw(data []byte, sampleRate int, channels int) Audio {
+	return Audio{
+		float32Data: Int16ToFloat32(ALawToInt16(data)),
+		sampleRate:  sampleRate,
+		channels:    channels,
+	}
+}
+
+// AsULaw encodes the audio as μ-law
+func (a *Audio) AsULaw() []byte {
+	return Int16ToULaw(Float32ToInt16(a.samples()))
+}
+
+// AsALaw encodes the audio as A-law
+func (a *Audio) AsALaw() []byte {
+	return Int16ToALaw(Float32ToInt16(a.samples()))
+}
@@ -0,0 +1,92 @@
+package audio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// oggCRC is the table of the CRC-32 of Ogg pages: polynomial 0x04c11db7, not reflected
+var oggCRC = func() (t [256]uint32) {
+	for i := range t {
+		r := uint32(i) << 24
+		for range 8 {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return t
+}()
+
+// OggOpusWriter writes an Ogg/Opus stream (RFC 7845) of the packets of an Opus encoder, one packet
+// a page so every packet can be played as soon as it is written
+type OggOpusWriter struct {
+	w      io.Writer
+	serial uint32
+	seq    uint32
+	rate   int
+	// granule is the position of the stream in samples at 48 kHz, as Ogg/Opus counts them
+	granule uint64
+}
+
+// NewOggOpusWriter starts an Ogg/Opus stream of audio encoded at sampleRate with the given
+// channels, writing its identification and comment headers
+func NewOggOpusWriter(w io.Writer, serial uint32, sampleRate, channels int) (*OggOpusWriter, error) {
+	o := &OggOpusWriter{w: w, serial: serial, rate: sampleRate}
+	head := append([]byte("OpusHead"), 1, byte(channels))
+	head = binary.LittleEndian.AppendUint16(head, 0)
+	head = binary.LittleEndian.AppendUint32(head, uint32(sampleRate))
+	head = append(head, 0, 0, 0)
+	if err := o.page(0x02, head); err != nil {
+		return nil, err
+	}
+	tags := binary.LittleEndian.AppendUint32([]byte("OpusTags"), 4)
+	tags = binary.LittleEndian.AppendUint32(append(tags, "pixa"...), 0)
+	if err := o.page(0, tags); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// WritePacket writes an Opus packet holding samples samples of each channel at the encoder's rate
+func (o *OggOpusWriter) WritePacket(packet []byte, samples int) error {
+	o.granule += uint64(samples * 48000 / o.rate)
+	return o.page(0, packet)
+}
+
+// page writes a page holding a single packet
+func (o *OggOpusWriter) page(headerType byte, packet []byte) error {
+	if len(packet) >= 255*255 {
+		return fmt.Errorf("Ogg packet of %d bytes", len(packet))
+	}
+	segments := len(packet)/255 + 1
+	p := make([]byte, 0, 27+segments+len(packet))
+	p = append(p, "OggS"...)
+	p = append(p, 0, headerType)
+	p = binary.LittleEndian.AppendUint64(p, o.granule)
+	p = binary.LittleEndian.AppendUint32(p, o.serial)
+	p = binary.LittleEndian.AppendUint32(p, o.seq)
+	p = append(p, 0, 0, 0, 0, byte(segments))
+	for range segments - 1 {
+		p = append(p, 255)
+	}
+	p = append(p, byte(len(packet)%255))
+	p = append(p, packet...)
+	binary.LittleEndian.PutUint32(p[22:], oggChecksum(p))
+	o.seq++
+	_, err := o.w.Write(p)
+	return err
+}
+
+// oggChecksum returns the CRC-32 of an Ogg page, whose own checksum is taken as zero
+func oggChecksum(p []byte) uint32 {
+	var crc uint32
+	for _, b := range p {
+		crc = crc<<8 ^ oggCRC[byte(crc>>24)^b]
+	}
+	return crc
+}
@@ -0,0 +1,154 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+
+	pixaerrors "github.com/pixaverse-studios/websocket-server/pkg/errors"
+)
+
+// Pcm24toFloat32 converts packed 24 bit little endian PCM, three bytes a sample, to samples in
+// [-1, 1). A trailing partial sample is dropped.
+func Pcm24toFloat32(data []byte) []float32 {
+	out := make([]float32, len(data)/3)
+	for i := range out {
+		out[i] = float32(pcm24(data[3*i:])) / (1 << 23)
+	}
+	return out
+}
+
+// Pcm32toFloat32 converts 32 bit little endian PCM to samples in [-1, 1). A trailing partial
+// sample is dropped.
+func Pcm32toFloat32(data []byte) []float32 {
+	out := make([]float32, len(data)/4)
+	for i := range out {
+		out[i] = float32(float64(int32(binary.LittleEndian.Uint32(data[4*i:]))) / (1 << 31))
+	}
+	return out
+}
+
+// PcmFloat32toFloat32 converts IEEE float32 little endian PCM, as WebAudio captures it, to
+// samples. Samples are clipped to [-1, 1], and those that are not numbers are silenced. A trailing
+// partial sample is dropped.
+func PcmFloat32toFloat32(data []byte) []float32 {
+	out := make([]float32, len(data)/4)
+	for i := range out {
+		s := math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+		if math.IsNaN(float64(s)) {
+			s = 0
+		}
+		out[i] = min(max(s, -1), 1)
+	}
+	return out
+}
+
+// pcm24 returns the packed 24 bit sample at the start of b, sign extended
+func pcm24(b []byte) int32 {
+	return int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+}
+
+// FromPCM24 wraps packed 24 bit PCM audio
+func FromPCM24(data []byte, sampleRate int, channels int) Audio {
+	return Audio{
+		float32Data: Pcm24toFloat32(data),
+		sampleRate:  sampleRate,
+		channels:    channels,
+	}
+}
+
+// FromPCM32 wraps 32 bit PCM audio
+func FromPCM32(data []byte, sampleRate int, channels int) Audio {
+	return Audio{
+		float32Data: Pcm32toFloat32(data),
+		sampleRate:  sampleRate,
+		channels:    channels,
+	}
+}
+
+// FromPCMFloat32 wraps float32 PCM audio. The samples are used as they are, without a conversion
+// to 16 bit.
+func FromPCMFloat32(data []byte, sampleRate int, channels int) Audio {
+	return Audio{
+		float32Data: PcmFloat32toFloat32(data),
+		sampleRate:  sampleRate,
+		channels:    channels,
+	}
+}
+
+// toPCM16 rounds a sample of the given bits to 16 bit little endian PCM at out
+func toPCM16(out []byte, sample int64, bits uint) {
+	s := (sample + 1<<(bits-17)) >> (bits - 16)
+	binary.LittleEndian.PutUint16(out, uint16(int16(min(s, math.MaxInt16))))
+}
+
+// PCM24Decoder decodes the audio frames of devices that send packed 24 bit PCM, rounding them to
+// 16 bit, or to their samples as they are with DecodeAudio. Like G.711 it keeps no state, so a
+// single decoder serves any number of streams.
+type PCM24Decoder struct{}
+
+func (PCM24Decoder) Decode(packet []byte) ([]byte, error) {
+	if len(packet)%3 != 0 {
+		return nil, pixaerrors.Errorf(pixaerrors.InvalidAudio, "24 bit PCM frame of %d bytes", len(packet))
+	}
+	out := make([]byte, len(packet)/3*2)
+	for i := 0; i < len(packet)/3; i++ {
+		toPCM16(out[2*i:], int64(pcm24(packet[3*i:])), 24)
+	}
+	return out, nil
+}
+
+// DecodeAudio decodes a frame to its samples with FromPCM24, without rounding them to 16 bit
+func (PCM24Decoder) DecodeAudio(packet []byte, sampleRate, channels int) (Audio, error) {
+	if len(packet)%3 != 0 {
+		return Audio{}, pixaerrors.Errorf(pixaerrors.InvalidAudio, "24 bit PCM frame of %d bytes", len(packet))
+	}
+	return FromPCM24(packet, sampleRate, channels), nil
+}
+
+// PCM32Decoder decodes the audio frames of devices that send 32 bit PCM, such as I2S microphones
+// with 24 bit samples in 32 bit slots, like PCM24Decoder
+type PCM32Decoder struct{}
+
+func (PCM32Decoder) Decode(packet []byte) ([]byte, error) {
+	if len(packet)%4 != 0 {
+		return nil, pixaerrors.Errorf(pixaerrors.InvalidAudio, "32 bit PCM frame of %d bytes", len(packet))
+	}
+	out := make([]byte, len(packet)/4*2)
+	for i := 0; i < len(packet)/4; i++ {
+		toPCM16(out[2*i:], int64(int32(binary.LittleEndian.Uint32(packet[4*i:]))), 32)
+	}
+	return out, nil
+}
+
+// DecodeAudio decodes a frame to its samples with FromPCM32, without rounding them to 16 bit
+func (PCM32Decoder) DecodeAudio(packet []byte, sampleRate, channels int) (Audio, error) {
+	if len(packet)%4 != 0 {
+		return Audio{}, pixaerrors.Errorf(pixaerrors.InvalidAudio, "32 bit PCM frame of %d bytes", len(packet))
+	}
+	return FromPCM32(packet, sampleRate, channels), nil
+}
+
+// Float32Decoder decodes the audio frames of devices that send float32 PCM, such as browsers
+// sending what WebAudio captures, rounding them to 16 bit like PCM24Decoder
+type Float32Decoder struct{}
+
+func (Float32Decoder) Decode(packet []byte) ([]byte, error) {
+	if len(packet)%4 != 0 {
+		return nil, pixaerrors.Errorf(pixaerrors.InvalidAudio, "float32 PCM frame of %d bytes", len(packet))
+	}
+	samples := PcmFloat32toFloat32(packet)
+	out := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		v := math.Round(float64(s) * 32768)
+		binary.LittleEndian.PutUint16(out[2*i:], uint16(int16(min(v, math.MaxInt16))))
+	}
+	return out, nil
+}
+
+// DecodeAudio decodes a frame to its samples with FromPCMFloat32, without rounding them to 16 bit
+func (Float32Decoder) DecodeAudio(packet []byte, sampleRate, channels int) (Audio, error) {
+	if len(packet)%4 != 0 {
+		return Audio{}, pixaerrors.Errorf(pixaerrors.InvalidAudio, "float32 PCM frame of %d bytes", len(packet))
+	}
+	return FromPCMFloat32(packet, sampleRate, channels), nil
+}
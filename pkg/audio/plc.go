@@ -0,0 +1,109 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// Pitch periods searched by waveform substitution, from 400 Hz down to 66 Hz, covering voices
+const (
+	minPitch = 2500 * time.Microsecond
+	maxPitch = 15 * time.Millisecond
+)
+
+// Concealer synthesizes audio for the gaps of lost frames from the 16 bit PCM heard before them.
+// Waveform substitution repeats the last pitch period heard, found by autocorrelation, so the
+// substitute continues the waveform where it stopped; zero-order hold holds the last sample.
+// Either fades out linearly, and is silent once faded. A nil *Concealer conceals nothing.
+type Concealer struct {
+	channels int
+	repeat   bool
+	// fade and limit are in frames of samples of all channels
+	fade   int
+	limit  int
+	minLag int
+	maxLag int
+	// history holds the last frames heard, interleaved
+	history []int16
+}
+
+// NewConcealer returns a concealer of audio of the given format. repeat chooses waveform
+// substitution over zero-order hold. No more than maxDuration is synthesized for a gap.
+func NewConcealer(sampleRate, channels int, repeat bool, fade, maxDuration time.Duration) *Concealer {
+	frames := func(d time.Duration) int { return int(d * time.Duration(sampleRate) / time.Second) }
+	return &Concealer{
+		channels: channels,
+		repeat:   repeat,
+		fade:     max(frames(fade), 1),
+		limit:    frames(maxDuration),
+		minLag:   max(frames(minPitch), 1),
+		maxLag:   max(frames(maxPitch), 1),
+	}
+}
+
+// Observe adds PCM heard to the history the concealment is synthesized from
+func (c *Concealer) Observe(pcm []byte) {
+	if c == nil {
+		return
+	}
+	for i := 0; i+1 < len(pcm); i += 2 {
+		c.history = append(c.history, int16(binary.LittleEndian.Uint16(pcm[i:])))
+	}
+	if keep := 2 * c.maxLag * c.channels; len(c.history) > keep {
+		c.history = append(c.history[:0], c.history[len(c.history)-keep:]...)
+	}
+}
+
+// Conceal returns PCM for a gap of size bytes, cut to whole frames and to the longest gap filled.
+// It is silence when nothing was heard yet.
+func (c *Concealer) Conceal(size int) []byte {
+	if c == nil {
+		return nil
+	}
+	frames := min(size/(2*c.channels), c.limit)
+	out := make([]byte, 2*frames*c.channels)
+	heard := len(c.history) / c.channels
+	if heard == 0 {
+		return out
+	}
+	lag := 1
+	if c.repeat {
+		lag = c.pitch(heard)
+	}
+	for i := 0; i < min(frames, c.fade); i++ {
+		gain := 1 - float64(i)/float64(c.fade)
+		from := (heard - lag + i%lag) * c.channels
+		for ch := 0; ch < c.channels; ch++ {
+			s := float64(c.history[from+ch]) * gain
+			binary.LittleEndian.PutUint16(out[2*(i*c.channels+ch):], uint16(int16(s)))
+		}
+	}
+	return out
+}
+
+// pitch returns the period, in frames, that best repeats the first channel of the history: the
+// lag at which the last period heard correlates best with the one before it. A history too short
+// to search is repeated whole.
+func (c *Concealer) pitch(heard int) int {
+	if heard < c.minLag*2 {
+		return heard
+	}
+	sample := func(i int) float64 { return float64(c.history[i*c.channels]) }
+	best, score := heard/2, -1.0
+	for lag := c.minLag; lag <= min(c.maxLag, heard/2); lag++ {
+		var corr, last, before float64
+		for i := heard - lag; i < heard; i++ {
+			corr += sample(i) * sample(i-lag)
+			last += sample(i) * sample(i)
+			before += sample(i-lag) * sample(i-lag)
+		}
+		if last == 0 || before == 0 {
+			continue
+		}
+		if corr /= math.Sqrt(last * before); corr > score {
+			best, score = lag, corr
+		}
+	}
+	return best
+}
@@ -1,21 +1,38 @@
 package audio
 
+import (
+	"math"
+	"time"
+)
+
 type AudioFormat int
 
 const (
 	PCM16BIT AudioFormat = iota
 	MP3
 	WAV
+	ULAW
+	ALAW
 )
 
 type Audio struct {
 	float32Data []float32
-	sampleRate  int
-	channels    int
+	// pcm16 is the 16 bit PCM the audio was created from. It is kept until the audio is processed,
+	// so audio that needs no conversion is relayed as it is, without ever being decoded.
+	pcm16      []byte
+	sampleRate int
+	channels   int
+}
+
+// samples returns the audio as float32 samples, decoding the PCM it was created from on first use
+func (a *Audio) samples() []float32 {
+	if a.float32Data == nil && a.pcm16 != nil {
+		a.float32Data = Pcm16toFloat32(a.pcm16)
+	}
+	return a.float32Data
 }
 
 //func FromMP3(){}
-//func FromWAV(){}
 
 func (a *Audio) GetChannels() int {
 	return a.channels
@@ -26,9 +43,15 @@ func (a *Audio) GetSampleRate() int {
 }
 
 func (a *Audio) AsFloat32() []float32 {
-	return a.float32Data
+	return a.samples()
 }
+
+// AsPCM16 encodes the audio as 16 bit PCM. Audio created with FromPCM16 that has not been
+// processed since returns the original data.
 func (a *Audio) AsPCM16() []byte {
+	if a.pcm16 != nil {
+		return a.pcm16
+	}
 	return Int16ToPCM(Float32ToInt16(a.float32Data))
 }
 
@@ -42,23 +65,30 @@ func (a *Audio) AsMP3() ([]byte, error) {
 	return nil, nil
 }
 
+// FromPCM16 wraps 16 bit PCM audio. The data is only decoded once the audio is processed, and is
+// not copied, so it must not be modified while the audio is in use.
 func FromPCM16(data []byte, sampleRate int, channels int) Audio {
 	return Audio{
-		float32Data: Pcm16toFloat32(data),
-		sampleRate:  sampleRate,
-		channels:    channels,
+		pcm16:      data[:len(data)&^1],
+		sampleRate: sampleRate,
+		channels:   channels,
 	}
 }
 
+// Resample converts the audio to targetSampleRate. Audio already at that rate is left untouched.
 func (a *Audio) Resample(targetSampleRate int) {
-	a.float32Data = ResampleAudio(a.float32Data, float64(a.sampleRate), float64(targetSampleRate))
+	if targetSampleRate == a.sampleRate {
+		return
+	}
+	a.float32Data = ResampleAudio(a.samples(), float64(a.sampleRate), float64(targetSampleRate))
+	a.pcm16 = nil
 	a.sampleRate = targetSampleRate
 }
 
 // Convert stereo to mono if input is 2 channels
 // Assuming interleaved stereo samples: [left1, right1, left2, right2, ...]
 func (a *Audio) StereoToMono() {
-	audioSlice := Float32ToInt16(a.float32Data)
+	audioSlice := Float32ToInt16(a.samples())
 
 	monoSlice := make([]int16, len(audioSlice)/2)
 	for i := 0; i < len(monoSlice); i++ {
@@ -70,5 +100,76 @@ func (a *Audio) StereoToMono() {
 	}
 
 	a.float32Data = Int16ToFloat32(monoSlice)
+	a.pcm16 = nil
 	a.channels = 1
 }
+
+// Duration returns the playback duration of the audio
+func (a *Audio) Duration() time.Duration {
+	if a.sampleRate <= 0 || a.channels <= 0 {
+		return 0
+	}
+	frames := len(a.float32Data) / a.channels
+	if a.float32Data == nil {
+		frames = len(a.pcm16) / 2 / a.channels
+	}
+	return time.Duration(frames) * time.Second / time.Duration(a.sampleRate)
+}
+
+// Resampler converts a stream of audio to another sample rate by linear interpolation, like
+// Resample, or by windowed-sinc filtering, see NewSincResampler. It carries its position and the
+// last frames from chunk to chunk, so chunks of any length join without clicks or drift whatever
+// the ratio of the rates, such as 44.1 to 24 kHz.
+type Resampler struct {
+	from, to int
+	channels int
+	// pos is where the next output frame falls, in input frames after last
+	pos  float64
+	last []float32
+	// sinc filters the audio instead of interpolating it; nil interpolates
+	sinc *sincFilter
+}
+
+// NewResampler creates a resampler of audio at from Hz to to Hz
+func NewResampler(from, to, channels int) *Resampler {
+	return &Resampler{from: from, to: to, channels: max(channels, 1)}
+}
+
+// Rates returns the sample rates the resampler converts between, zero for a nil resampler
+func (r *Resampler) Rates() (from, to int) {
+	if r == nil {
+		return 0, 0
+	}
+	return r.from, r.to
+}
+
+// Resample converts the next chunk of the stream. Audio already at the target rate is returned as
+// it is.
+func (r *Resampler) Resample(a Audio) Audio {
+	if r.from == r.to || r.from <= 0 || r.to <= 0 {
+		return a
+	}
+	if r.sinc != nil {
+		return Audio{float32Data: r.sinc.resample(a.samples()), sampleRate: r.to, channels: a.channels}
+	}
+	ch := r.channels
+	in := a.samples()
+	// x is the chunk after the last frame of the previous one
+	x := append(append(make([]float32, 0, len(r.last)+len(in)), r.last...), in...)
+	frames := len(x) / ch
+	step := float64(r.from) / float64(r.to)
+	out := make([]float32, 0, int(float64(frames)/step+1)*ch)
+	t := r.pos
+	for ; int(t)+1 < frames; t += step {
+		i, frac := int(t), float32(t-math.Floor(t))
+		for c := 0; c < ch; c++ {
+			s0, s1 := x[i*ch+c], x[(i+1)*ch+c]
+			out = append(out, s0+(s1-s0)*frac)
+		}
+	}
+	if frames > 0 {
+		r.last = append(r.last[:0], x[(frames-1)*ch:frames*ch]...)
+		r.pos = t - float64(frames-1)
+	}
+	return Audio{float32Data: out, sampleRate: r.to, channels: a.channels}
+}
@@ -0,0 +1,152 @@
+package audio
+
+import "math"
+
+// ResampleQuality picks how audio is converted between sample rates
+type ResampleQuality string
+
+const (
+	// ResampleLinear interpolates between neighbouring samples. It is cheap, but folds what lies
+	// above the new Nyquist frequency back into the audio when the rate goes down.
+	ResampleLinear ResampleQuality = "linear"
+	// ResampleSinc filters the audio with a windowed sinc, removing what the new rate cannot carry
+	// before it is resampled. It takes several times the CPU of linear interpolation.
+	ResampleSinc ResampleQuality = "sinc"
+)
+
+const (
+	// sincZeros is how many zero crossings of the sinc the filter spans on either side
+	sincZeros = 16
+	// sincRolloff places the cutoff a little below the Nyquist frequency of the lower rate, so the
+	// transition band of the filter falls below it
+	sincRolloff = 0.94
+	// sincMaxPhases caps the table of filter phases; rates whose ratio needs more have their taps
+	// computed for each sample instead
+	sincMaxPhases = 1024
+)
+
+// NewResamplerQuality creates a resampler of audio at from Hz to to Hz of the given quality;
+// anything but ResampleSinc interpolates linearly
+func NewResamplerQuality(q ResampleQuality, from, to, channels int) *Resampler {
+	if q == ResampleSinc {
+		return NewSincResampler(from, to, channels)
+	}
+	return NewResampler(from, to, channels)
+}
+
+// NewSincResampler creates a resampler of audio at from Hz to to Hz by polyphase windowed-sinc
+// filtering. Audio is held back by half the filter, 2ms at 8 kHz and under a millisecond from 44.1
+// kHz, until the audio after it arrives.
+func NewSincResampler(from, to, channels int) *Resampler {
+	r := NewResampler(from, to, channels)
+	if from > 0 && to > 0 && from != to {
+		r.sinc = newSincFilter(from, to, r.channels)
+	}
+	return r
+}
+
+// sincFilter is the state of a windowed-sinc resampler. Output sample n falls at input position
+// n*step/phases, which is kept as the integer pos into held and the phase of its fraction.
+type sincFilter struct {
+	step, phases int
+	channels     int
+	// cutoff is the cutoff frequency as a fraction of the input's Nyquist frequency; each output
+	// sample is filtered from the half input frames on either side of its position
+	cutoff float64
+	half   int
+	// table holds the taps of every phase, nil when there are too many phases
+	table [][]float32
+
+	held  []float32
+	pos   int
+	phase int
+}
+
+func newSincFilter(from, to, channels int) *sincFilter {
+	g := gcd(from, to)
+	f := &sincFilter{step: from / g, phases: to / g, channels: channels}
+	f.cutoff = min(1, float64(to)/float64(from)) * sincRolloff
+	f.half = int(math.Ceil(sincZeros / f.cutoff))
+	if f.phases <= sincMaxPhases {
+		f.table = make([][]float32, f.phases)
+		for p := range f.table {
+			f.table[p] = f.taps(p)
+		}
+	}
+	// the stream starts after half a filter of silence, so its first sample is filtered whole
+	f.pos = f.half - 1
+	f.held = make([]float32, f.pos*channels)
+	return f
+}
+
+// taps computes the filter of a phase, normalized so that it keeps the level of the audio. Tap j
+// weighs input frame pos-half+1+j.
+func (f *sincFilter) taps(phase int) []float32 {
+	frac := float64(phase) / float64(f.phases)
+	taps := make([]float32, 2*f.half)
+	var sum float64
+	w := make([]float64, len(taps))
+	for j := range taps {
+		d := float64(j-f.half+1) - frac
+		w[j] = f.cutoff * sinc(f.cutoff*d) * blackman(d/float64(f.half))
+		sum += w[j]
+	}
+	for j := range taps {
+		taps[j] = float32(w[j] / sum)
+	}
+	return taps
+}
+
+// resample filters the next chunk of interleaved samples to the output rate
+func (f *sincFilter) resample(in []float32) []float32 {
+	ch := f.channels
+	x := append(f.held, in...)
+	frames := len(x) / ch
+	out := make([]float32, 0, (frames*f.phases/f.step+1)*ch)
+	for f.pos+f.half < frames {
+		var h []float32
+		if f.table != nil {
+			h = f.table[f.phase]
+		} else {
+			h = f.taps(f.phase)
+		}
+		first := f.pos - f.half + 1
+		for c := 0; c < ch; c++ {
+			var acc float32
+			for j, w := range h {
+				acc += w * x[(first+j)*ch+c]
+			}
+			out = append(out, acc)
+		}
+		f.phase += f.step
+		f.pos += f.phase / f.phases
+		f.phase %= f.phases
+	}
+	// keep the frames the next output samples are filtered from
+	drop := min(f.pos-f.half+1, frames)
+	f.held = append(x[:0:0], x[drop*ch:frames*ch]...)
+	f.pos -= drop
+	return out
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// blackman is the Blackman window over -1 to 1
+func blackman(x float64) float64 {
+	if x <= -1 || x >= 1 {
+		return 0
+	}
+	return 0.42 + 0.5*math.Cos(math.Pi*x) + 0.08*math.Cos(2*math.Pi*x)
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
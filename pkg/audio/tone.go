@@ -0,0 +1,66 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// toneFade is how long test signals take to fade in and out, so they start and stop without a click
+const toneFade = 10 * time.Millisecond
+
+// TestSignal is a tone, or a sweep from one frequency to another, played to check an audio path
+type TestSignal struct {
+	// From and To are the frequencies at the start and the end, equal for a tone
+	From, To float64
+	Duration time.Duration
+}
+
+// Frequency returns the frequency of the signal at a time after its start. Sweeps are
+// exponential, taking as long for every octave.
+func (s TestSignal) Frequency(at time.Duration) float64 {
+	if s.From == s.To || s.Duration <= 0 {
+		return s.From
+	}
+	return s.From * math.Pow(s.To/s.From, min(max(at.Seconds()/s.Duration.Seconds(), 0), 1))
+}
+
+// PCM renders the signal as mono 16 bit PCM at the level given in dBFS
+func (s TestSignal) PCM(sampleRate int, levelDB float64) []byte {
+	n := int(s.Duration * time.Duration(sampleRate) / time.Second)
+	fade := float64(toneFade) * float64(sampleRate) / float64(time.Second)
+	amplitude := 32767 * math.Pow(10, levelDB/20)
+	out := make([]byte, 2*n)
+	phase := 0.0
+	for i := 0; i < n; i++ {
+		gain := min(float64(i)/fade, float64(n-1-i)/fade, 1)
+		binary.LittleEndian.PutUint16(out[2*i:], uint16(int16(math.Round(amplitude*gain*math.Sin(phase)))))
+		phase += 2 * math.Pi * s.Frequency(time.Duration(i)*time.Second/time.Duration(sampleRate)) / float64(sampleRate)
+	}
+	return out
+}
+
+// BandShare returns the share of the energy of samples that is between the frequencies low and
+// high, from 0 for none to 1 for a tone or a sweep within them. The power of every DFT bin of the
+// band, and of the bins either side of it, is measured by the Goertzel algorithm.
+func BandShare(samples []int16, sampleRate int, low, high float64) float64 {
+	n := len(samples)
+	var energy float64
+	for _, v := range samples {
+		energy += float64(v) * float64(v)
+	}
+	if energy == 0 {
+		return 0
+	}
+	step := float64(sampleRate) / float64(n)
+	var power float64
+	for k := max(int(low/step)-1, 1); k <= min(int(math.Ceil(high/step))+1, (n-1)/2); k++ {
+		coeff := 2 * math.Cos(2*math.Pi*float64(k)/float64(n))
+		var s1, s2 float64
+		for _, v := range samples {
+			s1, s2 = float64(v)+coeff*s1-s2, s1
+		}
+		power += s1*s1 + s2*s2 - coeff*s1*s2
+	}
+	return min(2*power/(float64(n)*energy), 1)
+}
@@ -0,0 +1,62 @@
+package audio
+
+import (
+	"encoding/binary"
+
+	pixaerrors "github.com/pixaverse-studios/websocket-server/pkg/errors"
+)
+
+// FromWAV reads a mono or stereo 16 bit PCM WAV file
+func FromWAV(data []byte) (Audio, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return Audio{}, pixaerrors.New(pixaerrors.InvalidAudio, "not a WAV file")
+	}
+
+	var channels, bits, format uint16
+	var sampleRate uint32
+	for rest := data[12:]; len(rest) >= 8; {
+		id, size := string(rest[0:4]), int(binary.LittleEndian.Uint32(rest[4:8]))
+		rest = rest[8:]
+		if size > len(rest) {
+			size = len(rest)
+		}
+		chunk := rest[:size]
+		switch id {
+		case "fmt ":
+			if len(chunk) < 16 {
+				return Audio{}, pixaerrors.New(pixaerrors.InvalidAudio, "short fmt chunk")
+			}
+			format = binary.LittleEndian.Uint16(chunk[0:2])
+			channels = binary.LittleEndian.Uint16(chunk[2:4])
+			sampleRate = binary.LittleEndian.Uint32(chunk[4:8])
+			bits = binary.LittleEndian.Uint16(chunk[14:16])
+		case "data":
+			if format != 1 || bits != 16 || (channels != 1 && channels != 2) || sampleRate == 0 {
+				return Audio{}, pixaerrors.Errorf(pixaerrors.UnsupportedMedia, "unsupported format %d, %d bits, %d channels", format, bits, channels)
+			}
+			return FromPCM16(chunk, int(sampleRate), int(channels)), nil
+		}
+		// chunks are padded to an even size
+		rest = rest[min(size+size&1, len(rest)):]
+	}
+	return Audio{}, pixaerrors.New(pixaerrors.InvalidAudio, "no data chunk")
+}
+
+// StreamingWAVHeader returns the header of a 16 bit PCM WAV stream of unknown length, as played
+// while it is still being written. Its sizes are the largest possible, which players take as
+// "until the stream ends".
+func StreamingWAVHeader(sampleRate, channels int) []byte {
+	h := make([]byte, 0, 44)
+	h = append(h, "RIFF"...)
+	h = binary.LittleEndian.AppendUint32(h, 0xFFFFFFFF)
+	h = append(h, "WAVEfmt "...)
+	h = binary.LittleEndian.AppendUint32(h, 16)
+	h = binary.LittleEndian.AppendUint16(h, 1)
+	h = binary.LittleEndian.AppendUint16(h, uint16(channels))
+	h = binary.LittleEndian.AppendUint32(h, uint32(sampleRate))
+	h = binary.LittleEndian.AppendUint32(h, uint32(sampleRate*channels*2))
+	h = binary.LittleEndian.AppendUint16(h, uint16(channels*2))
+	h = binary.LittleEndian.AppendUint16(h, 16)
+	h = append(h, "data"...)
+	return binary.LittleEndian.AppendUint32(h, 0xFFFFFFFF-36)
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/redis"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/websocket"
+)
+
+// APIKeyParam is the query parameter devices that cannot set headers carry their API key in
+const APIKeyParam = "api_key"
+
+// ErrUnknownKey is returned by key stores for keys they do not know
+var ErrUnknownKey = errors.New("unknown API key")
+
+// KeyIdentity is the identity an API key grants
+type KeyIdentity struct {
+	DeviceID string `json:"device_id"`
+	TenantID string `json:"tenant_id,omitempty"`
+}
+
+// KeyStore looks up the API keys of devices. Embedding applications can keep keys in their own
+// systems by implementing it.
+type KeyStore interface {
+	// Lookup returns the identity of a key, or ErrUnknownKey
+	Lookup(ctx context.Context, key string) (KeyIdentity, error)
+}
+
+// APIKeyAuth authenticates devices by the API key they present when connecting
+type APIKeyAuth struct {
+	header   string
+	required bool
+	keys     KeyStore
+}
+
+// NewAPIKeyAuth creates the API key auth of cfg. Keys are looked up in the store named in cfg
+// unless keys is set.
+func NewAPIKeyAuth(cfg config.APIKeyConfig, keys KeyStore) (*APIKeyAuth, error) {
+	if keys == nil {
+		var err error
+		if keys, err = NewKeyStore(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return &APIKeyAuth{header: cfg.Header, required: cfg.Required, keys: keys}, nil
+}
+
+// NewKeyStore creates the key store named in cfg
+func NewKeyStore(cfg config.APIKeyConfig) (KeyStore, error) {
+	switch cfg.Store {
+	case "file":
+		return NewFileKeyStore(cfg.File), nil
+	case "redis":
+		return NewRedisKeyStore(cfg.Redis)
+	case "memory", "":
+		return NewMemoryKeyStore(cfg.Keys), nil
+	}
+	return nil, fmt.Errorf("unknown API key store %q", cfg.Store)
+}
+
+// Middleware returns a websocket middleware looking up the API key of connecting devices and
+// attaching the device and tenant it belongs to to the request. Devices with unknown keys are
+// rejected before the upgrade.
+func (a *APIKeyAuth) Middleware() websocket.Middleware {
+	return websocket.Middleware{
+		OnConnect: func(r *http.Request) (*http.Request, error) {
+			key := r.Header.Get(a.header)
+			if key == "" {
+				key = r.URL.Query().Get(APIKeyParam)
+			}
+			if key == "" {
+				if a.required {
+					return nil, &websocket.RejectError{StatusCode: http.StatusUnauthorized, Reason: "API key required"}
+				}
+				return r, nil
+			}
+
+			id, err := a.keys.Lookup(r.Context(), key)
+			if errors.Is(err, ErrUnknownKey) {
+				return nil, &websocket.RejectError{StatusCode: http.StatusUnauthorized, Reason: err.Error()}
+			}
+			if err != nil {
+				return nil, &websocket.RejectError{StatusCode: http.StatusServiceUnavailable, Reason: "API keys unavailable"}
+			}
+			ctx := r.Context()
+			if id.DeviceID != "" {
+				ctx = websocket.WithDeviceID(ctx, id.DeviceID)
+			}
+			if id.TenantID != "" {
+				ctx = websocket.WithTenantID(ctx, id.TenantID)
+			}
+			return r.WithContext(ctx), nil
+		},
+	}
+}
+
+// MemoryKeyStore keeps a fixed set of keys in memory
+type MemoryKeyStore struct {
+	keys map[string]KeyIdentity
+}
+
+func NewMemoryKeyStore(keys []config.APIKey) *MemoryKeyStore {
+	m := &MemoryKeyStore{keys: make(map[string]KeyIdentity, len(keys))}
+	for _, k := range keys {
+		m.keys[k.Key] = KeyIdentity{DeviceID: k.DeviceID, TenantID: k.TenantID}
+	}
+	return m
+}
+
+func (m *MemoryKeyStore) Lookup(ctx context.Context, key string) (KeyIdentity, error) {
+	id, ok := m.keys[key]
+	if !ok {
+		return KeyIdentity{}, ErrUnknownKey
+	}
+	return id, nil
+}
+
+// FileKeyStore reads keys from a JSON array of the form of auth.api_keys.keys. The file is read
+// again when it changes, so keys can be issued and revoked without restarting the relay.
+type FileKeyStore struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	keys    *MemoryKeyStore
+}
+
+func NewFileKeyStore(path string) *FileKeyStore {
+	return &FileKeyStore{path: path}
+}
+
+func (f *FileKeyStore) Lookup(ctx context.Context, key string) (KeyIdentity, error) {
+	keys, err := f.load()
+	if err != nil {
+		return KeyIdentity{}, err
+	}
+	return keys.Lookup(ctx, key)
+}
+
+// load returns the keys of the file, reading it again if it changed since it was last read
+func (f *FileKeyStore) load() (*MemoryKeyStore, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read API key file: %w", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.keys != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.keys, nil
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read API key file: %w", err)
+	}
+	var keys []config.APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("could not parse API key file: %w", err)
+	}
+	f.keys, f.modTime, f.size = NewMemoryKeyStore(keys), info.ModTime(), info.Size()
+	return f.keys, nil
+}
+
+// RedisKeyStore looks keys up in Redis, where each key's identity is kept as JSON under the key
+// prefix followed by the key, so all the relays using the same server share them
+type RedisKeyStore struct {
+	prefix string
+	client *redis.Client
+}
+
+func NewRedisKeyStore(cfg config.RedisConfig) (*RedisKeyStore, error) {
+	client, err := redis.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth.api_keys.redis.timeout: %w", err)
+	}
+	return &RedisKeyStore{prefix: cfg.KeyPrefix, client: client}, nil
+}
+
+func (s *RedisKeyStore) Lookup(ctx context.Context, key string) (KeyIdentity, error) {
+	reply, err := s.client.Do(ctx, "GET", s.prefix+key)
+	if err != nil {
+		return KeyIdentity{}, err
+	}
+	v, ok := reply.(string)
+	if !ok {
+		return KeyIdentity{}, ErrUnknownKey
+	}
+	var id KeyIdentity
+	if err := json.Unmarshal([]byte(v), &id); err != nil {
+		return KeyIdentity{}, fmt.Errorf("invalid identity of API key in redis: %w", err)
+	}
+	return id, nil
+}
+
+// Close closes the idle connections
+func (s *RedisKeyStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,424 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/redis"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/websocket"
+)
+
+func TestClientCertAuth(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "devices"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0o600)
+
+	issue := func(serial int64, cn string) *x509.Certificate {
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			DNSNames:     []string{cn + ".devices.example.com"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := x509.ParseCertificate(der)
+		return cert
+	}
+
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: big.NewInt(3), RevocationTime: time.Now()}},
+	}, ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlFile := filepath.Join(dir, "crl.pem")
+	os.WriteFile(crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER}), 0o600)
+
+	a, err := NewClientCertAuth(config.ClientAuthConfig{
+		CAFile:         caFile,
+		CRLFile:        crlFile,
+		Required:       true,
+		IdentityFrom:   CommonNameIdentity,
+		AllowedDevices: []string{"speaker-1", "speaker-3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect := func(cert *x509.Certificate) (string, error) {
+		r := httptest.NewRequest("GET", "/", nil)
+		if cert != nil {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert, ca}}}
+		}
+		r, err := a.Middleware().OnConnect(r)
+		if err != nil {
+			return "", err
+		}
+		id, _ := websocket.RequestIdentity(r)
+		return id, nil
+	}
+
+	if id, err := connect(issue(2, "speaker-1")); err != nil || id != "speaker-1" {
+		t.Fatalf("expected speaker-1 to connect, got %q, %v", id, err)
+	}
+	if _, err := connect(issue(3, "speaker-3")); err == nil {
+		t.Fatal("expected revoked certificate to be rejected")
+	}
+	if _, err := connect(issue(4, "speaker-2")); err == nil {
+		t.Fatal("expected device missing from the allowlist to be rejected")
+	}
+	if _, err := connect(nil); err == nil {
+		t.Fatal("expected connection without a certificate to be rejected")
+	}
+
+	a.identityFrom, a.allowed = SubjectAltNameIdentity, nil
+	if id, _ := a.Identify(issue(5, "speaker-5")); id != "speaker-5.devices.example.com" {
+		t.Fatalf("unexpected identity from SAN: %q", id)
+	}
+}
+
+func TestURLSigner(t *testing.T) {
+	s, err := NewURLSigner(config.SignedURLConfig{
+		Secret:     "0123456789abcdef0123456789abcdef",
+		APIKey:     "backend",
+		BaseURL:    "wss://relay.example.com/",
+		DefaultTTL: "1m",
+		MaxTTL:     "5m",
+		Required:   true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mint := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/tokens", strings.NewReader(`{"device_id":"speaker-1","tenant_id":"acme","ttl":"1h"}`))
+	req.Header.Set("Authorization", "Bearer backend")
+	s.Handler().ServeHTTP(mint, req)
+	if mint.Code != 200 {
+		t.Fatalf("unexpected mint status %d: %s", mint.Code, mint.Body)
+	}
+	var minted mintResponse
+	json.NewDecoder(mint.Body).Decode(&minted)
+	if time.Until(minted.ExpiresAt) > 5*time.Minute {
+		t.Fatalf("ttl was not capped: %s", minted.ExpiresAt)
+	}
+
+	connect := func(u string) (*http.Request, error) {
+		return s.Middleware().OnConnect(httptest.NewRequest("GET", u, nil))
+	}
+	r, err := connect(minted.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device, tenant := websocket.RequestIdentity(r); device != "speaker-1" || tenant != "acme" {
+		t.Fatalf("unexpected identity %q/%q", device, tenant)
+	}
+	if _, err := connect(minted.URL); err == nil {
+		t.Fatal("expected a used token to be rejected")
+	}
+	if _, err := connect("/?token=" + minted.Token[:len(minted.Token)-2] + "AA"); err == nil {
+		t.Fatal("expected a tampered token to be rejected")
+	}
+	if _, err := connect("/"); err == nil {
+		t.Fatal("expected a connection without a token to be rejected")
+	}
+
+	tok, err := s.ConnectTokens(time.Hour)("speaker-2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(tok.ExpiresAt) > 5*time.Minute || !strings.Contains(tok.URL, tok.Token) {
+		t.Fatalf("unexpected connect token %+v", tok)
+	}
+	if r, err := connect(tok.URL); err != nil {
+		t.Fatal(err)
+	} else if device, _ := websocket.RequestIdentity(r); device != "speaker-2" {
+		t.Fatalf("unexpected identity %q", device)
+	}
+
+	unauthorized := httptest.NewRecorder()
+	s.Handler().ServeHTTP(unauthorized, httptest.NewRequest("POST", "/tokens", strings.NewReader(`{"device_id":"speaker-1"}`)))
+	if unauthorized.Code != http.StatusUnauthorized {
+		t.Fatalf("expected minting without the API key to be unauthorized, got %d", unauthorized.Code)
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	a, err := NewAPIKeyAuth(config.APIKeyConfig{
+		Header:   "X-Pixa-Api-Key",
+		Store:    "memory",
+		Keys:     []config.APIKey{{Key: "k1", DeviceID: "speaker-1", TenantID: "acme"}},
+		Required: true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect := func(u, key string) (*http.Request, error) {
+		req := httptest.NewRequest("GET", u, nil)
+		if key != "" {
+			req.Header.Set("X-Pixa-Api-Key", key)
+		}
+		return a.Middleware().OnConnect(req)
+	}
+	for _, r := range []struct{ url, key string }{{"/", "k1"}, {"/?api_key=k1", ""}} {
+		req, err := connect(r.url, r.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if device, tenant := websocket.RequestIdentity(req); device != "speaker-1" || tenant != "acme" {
+			t.Fatalf("unexpected identity %q/%q", device, tenant)
+		}
+	}
+	var rejected *websocket.RejectError
+	if _, err := connect("/", "k2"); !errors.As(err, &rejected) || rejected.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected an unknown key to be rejected, got %v", err)
+	}
+	if _, err := connect("/", ""); err == nil {
+		t.Fatal("expected a connection without a key to be rejected")
+	}
+}
+
+func TestFileKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	os.WriteFile(path, []byte(`[{"key": "k1", "device_id": "speaker-1"}]`), 0o600)
+	s := NewFileKeyStore(path)
+	ctx := context.Background()
+	if id, err := s.Lookup(ctx, "k1"); err != nil || id.DeviceID != "speaker-1" {
+		t.Fatalf("unexpected lookup: %+v, %v", id, err)
+	}
+
+	// revoking k1 and issuing k2 takes effect without a restart
+	os.WriteFile(path, []byte(`[{"key": "k2", "device_id": "speaker-2", "tenant_id": "acme"}]`), 0o600)
+	os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if _, err := s.Lookup(ctx, "k1"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected a revoked key to be unknown, got %v", err)
+	}
+	if id, err := s.Lookup(ctx, "k2"); err != nil || id.TenantID != "acme" {
+		t.Fatalf("unexpected lookup: %+v, %v", id, err)
+	}
+}
+
+func TestRedisKeyStore(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	keys := map[string]string{"test:k1": `{"device_id":"speaker-1","tenant_id":"acme"}`}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					cmd, err := redis.ReadReply(r)
+					if err != nil {
+						return
+					}
+					args := cmd.([]any)
+					v, ok := keys[args[1].(string)]
+					if args[0] != "GET" || !ok {
+						fmt.Fprint(conn, "$-1\r\n")
+						continue
+					}
+					fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+				}
+			}()
+		}
+	}()
+
+	s, err := NewRedisKeyStore(config.RedisConfig{Addr: ln.Addr().String(), KeyPrefix: "test:", Timeout: "1s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	if id, err := s.Lookup(ctx, "k1"); err != nil || id.DeviceID != "speaker-1" || id.TenantID != "acme" {
+		t.Fatalf("unexpected lookup: %+v, %v", id, err)
+	}
+	if _, err := s.Lookup(ctx, "k2"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected k2 to be unknown, got %v", err)
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	b64 := base64.RawURLEncoding.EncodeToString
+	keys := []map[string]string{{"kty": "RSA", "kid": "r1", "alg": "RS256", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())}}
+	fetches := 0
+	var entered, release chan struct{}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if release != nil {
+			entered <- struct{}{}
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	defer jwks.Close()
+
+	sign := func(alg, kid string, claims map[string]any) string {
+		header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+		payload, _ := json.Marshal(claims)
+		signed := b64(header) + "." + b64(payload)
+		digest := sha256.Sum256([]byte(signed))
+		var sig []byte
+		switch alg {
+		case "RS256":
+			sig, _ = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		case "ES256":
+			r, s, _ := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+		return signed + "." + b64(sig)
+	}
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{"iss": "https://id.example.com/", "aud": []string{"relay"}, "sub": "speaker-1", "tenant_id": "acme", "plan": "pro", "exp": time.Now().Add(time.Hour).Unix()}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	a, err := NewJWTAuth(config.JWTConfig{
+		Issuer:      "https://id.example.com/",
+		Audience:    "relay",
+		JWKSURL:     jwks.URL,
+		JWKSRefresh: "1h",
+		Leeway:      "30s",
+		DeviceClaim: "sub",
+		TenantClaim: "tenant_id",
+		Required:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect := func(u, token string) (*http.Request, error) {
+		req := httptest.NewRequest("GET", u, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return a.Middleware().OnConnect(req)
+	}
+	token := sign("RS256", "r1", claims(nil))
+	for _, c := range []struct{ url, token string }{{"/", token}, {"/?token=" + token, ""}} {
+		r, err := connect(c.url, c.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if device, tenant := websocket.RequestIdentity(r); device != "speaker-1" || tenant != "acme" {
+			t.Fatalf("unexpected identity %q/%q", device, tenant)
+		}
+		if got, ok := websocket.TokenClaimsFromContext(r.Context()); !ok || got["plan"] != "pro" {
+			t.Fatalf("unexpected claims %v", got)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("expected the keys to be fetched once, got %d", fetches)
+	}
+
+	var rejected *websocket.RejectError
+	for name, token := range map[string]string{
+		"an expired token":             sign("RS256", "r1", claims(map[string]any{"exp": time.Now().Add(-time.Minute).Unix()})),
+		"a token not valid yet":        sign("RS256", "r1", claims(map[string]any{"nbf": time.Now().Add(time.Minute).Unix()})),
+		"a token of another issuer":    sign("RS256", "r1", claims(map[string]any{"iss": "https://evil.example.com/"})),
+		"a token for another audience": sign("RS256", "r1", claims(map[string]any{"aud": "billing"})),
+		"a tampered token":             token[:strings.LastIndex(token, ".")] + "." + b64(make([]byte, 256)),
+		"an unsigned token":            b64([]byte(`{"alg":"none"}`)) + "." + strings.Split(token, ".")[1] + ".",
+		"a token of an unknown key":    sign("ES256", "e1", claims(nil)),
+	} {
+		if _, err := connect("/", token); !errors.As(err, &rejected) || rejected.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected %s to be rejected, got %v", name, err)
+		}
+	}
+	if _, err := connect("/", ""); err == nil {
+		t.Fatal("expected a connection without a token to be rejected")
+	}
+
+	// rotated keys are picked up once the keys may be fetched again
+	keys = append(keys, map[string]string{"kty": "EC", "kid": "e1", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))})
+	if _, err := connect("/", sign("ES256", "e1", claims(nil))); err == nil || fetches != 1 {
+		t.Fatalf("expected the keys not to be fetched again within a minute, got %v after %d fetches", err, fetches)
+	}
+	a.tried = a.tried.Add(-jwksRefetch)
+	if _, err := connect("/", sign("ES256", "e1", claims(nil))); err != nil || fetches != 2 {
+		t.Fatalf("expected the rotated key to be fetched, got %v after %d fetches", err, fetches)
+	}
+
+	// tokens of known keys are verified while a refresh of the keys is in flight
+	entered, release = make(chan struct{}), make(chan struct{})
+	a.fetched, a.tried = a.fetched.Add(-time.Hour), a.tried.Add(-jwksRefetch)
+	refreshed := make(chan error, 1)
+	go func() {
+		_, err := connect("/", token)
+		refreshed <- err
+	}()
+	<-entered
+	verified := make(chan error, 1)
+	go func() {
+		_, err := connect("/", sign("ES256", "e1", claims(nil)))
+		verified <- err
+	}()
+	select {
+	case err := <-verified:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("verifying a token of a known key waited for the refresh")
+	}
+	close(release)
+	if err := <-refreshed; err != nil || fetches != 3 {
+		t.Fatalf("expected the keys to be refreshed, got %v after %d fetches", err, fetches)
+	}
+}
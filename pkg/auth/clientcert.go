@@ -0,0 +1,163 @@
+// Package auth authenticates devices connecting to the relay and attaches their identity to the
+// connection request.
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/websocket"
+)
+
+// Identity sources of a client certificate
+const (
+	CommonNameIdentity     = "cn"
+	SubjectAltNameIdentity = "san"
+)
+
+// ClientCertAuth authenticates devices by the client certificate presented in the TLS handshake.
+// The device ID is taken from the certificate's common name or first subject alternative name.
+type ClientCertAuth struct {
+	roots        *x509.CertPool
+	revoked      map[string]bool
+	required     bool
+	identityFrom string
+	allowed      map[string]bool
+}
+
+// NewClientCertAuth loads the CAs and revocation list named in cfg
+func NewClientCertAuth(cfg config.ClientAuthConfig) (*ClientCertAuth, error) {
+	pemCerts, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read client CA file: %w", err)
+	}
+	a := &ClientCertAuth{
+		roots:        x509.NewCertPool(),
+		revoked:      make(map[string]bool),
+		required:     cfg.Required,
+		identityFrom: cfg.IdentityFrom,
+	}
+	if !a.roots.AppendCertsFromPEM(pemCerts) {
+		return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+	}
+	if len(cfg.AllowedDevices) > 0 {
+		a.allowed = make(map[string]bool, len(cfg.AllowedDevices))
+		for _, id := range cfg.AllowedDevices {
+			a.allowed[id] = true
+		}
+	}
+
+	if cfg.CRLFile != "" {
+		data, err := os.ReadFile(cfg.CRLFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CRL file: %w", err)
+		}
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse CRL: %w", err)
+		}
+		if err := a.checkCRLIssuer(crl, pemCerts); err != nil {
+			return nil, err
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			a.revoked[entry.SerialNumber.String()] = true
+		}
+	}
+	return a, nil
+}
+
+// checkCRLIssuer verifies the revocation list is signed by one of the CAs
+func (a *ClientCertAuth) checkCRLIssuer(crl *x509.RevocationList, pemCerts []byte) error {
+	for len(pemCerts) > 0 {
+		var block *pem.Block
+		block, pemCerts = pem.Decode(pemCerts)
+		if block == nil {
+			break
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if crl.CheckSignatureFrom(ca) == nil {
+			return nil
+		}
+	}
+	return errors.New("CRL is not signed by any of the client CAs")
+}
+
+// TLSConfig configures a TLS server to request client certificates and verify them against the CAs
+func (a *ClientCertAuth) TLSConfig(base *tls.Config) *tls.Config {
+	var c *tls.Config
+	if base != nil {
+		c = base.Clone()
+	} else {
+		c = &tls.Config{}
+	}
+	c.ClientCAs = a.roots
+	if a.required {
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return c
+}
+
+// Middleware returns a websocket middleware attaching the device identity of the verified client
+// certificate to the request
+func (a *ClientCertAuth) Middleware() websocket.Middleware {
+	return websocket.Middleware{
+		OnConnect: func(r *http.Request) (*http.Request, error) {
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+				if a.required {
+					return nil, &websocket.RejectError{StatusCode: http.StatusUnauthorized, Reason: "client certificate required"}
+				}
+				return r, nil
+			}
+
+			deviceID, err := a.Identify(r.TLS.VerifiedChains[0][0])
+			if err != nil {
+				return nil, &websocket.RejectError{StatusCode: http.StatusForbidden, Reason: err.Error()}
+			}
+			return r.WithContext(websocket.WithDeviceID(r.Context(), deviceID)), nil
+		},
+	}
+}
+
+// Identify returns the device ID of a verified client certificate, checking it is neither revoked
+// nor missing from the allowed devices
+func (a *ClientCertAuth) Identify(cert *x509.Certificate) (string, error) {
+	if a.revoked[cert.SerialNumber.String()] {
+		return "", errors.New("client certificate is revoked")
+	}
+
+	var id string
+	switch a.identityFrom {
+	case SubjectAltNameIdentity:
+		switch {
+		case len(cert.DNSNames) > 0:
+			id = cert.DNSNames[0]
+		case len(cert.URIs) > 0:
+			id = cert.URIs[0].String()
+		case len(cert.EmailAddresses) > 0:
+			id = cert.EmailAddresses[0]
+		}
+	default:
+		id = cert.Subject.CommonName
+	}
+	if id == "" {
+		return "", errors.New("client certificate carries no device identity")
+	}
+	if a.allowed != nil && !a.allowed[id] {
+		return "", errors.New("device is not allowed")
+	}
+	return id, nil
+}
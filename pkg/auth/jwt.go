@@ -0,0 +1,429 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/websocket"
+)
+
+const (
+	// jwksRefetch is how long after trying to fetch the keys they are tried again, for tokens
+	// signed with an unknown key or after a failure, so that tokens signed with garbage keys and
+	// outages of the identity provider do not hammer it
+	jwksRefetch = time.Minute
+	// jwksTimeout bounds fetching the keys
+	jwksTimeout = 10 * time.Second
+	// maxJWKS is the largest JWKS read
+	maxJWKS = 1 << 20
+)
+
+var (
+	ErrInvalidJWT = errors.New("invalid token")
+	ErrExpiredJWT = errors.New("token has expired")
+	// ErrUnavailableJWKS is returned when the signing keys cannot be fetched
+	ErrUnavailableJWKS = errors.New("token signing keys unavailable")
+)
+
+// JWTAuth authenticates devices by a JSON Web Token from the Authorization header as a bearer
+// token, or from the token query parameter for devices that cannot set headers. Tokens are signed
+// with RS, PS, ES or EdDSA algorithms by one of the keys the identity provider publishes as a JWKS.
+type JWTAuth struct {
+	issuer      string
+	audience    string
+	jwksURL     string
+	refresh     time.Duration
+	leeway      time.Duration
+	deviceClaim string
+	tenantClaim string
+	required    bool
+	client      *http.Client
+
+	mu   sync.Mutex
+	keys map[string]jwk
+	// fetched is when the keys were last fetched, and tried when they were last tried
+	fetched, tried time.Time
+	// fetching is closed once the fetch in flight ends; nil while the keys are not being fetched
+	fetching chan struct{}
+}
+
+// jwk is a public key of a JWKS
+type jwk struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// jwtHeader is the header of a token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// registeredClaims are the claims of a token that are validated
+type registeredClaims struct {
+	Issuer    string       `json:"iss"`
+	Audience  audience     `json:"aud"`
+	ExpiresAt *json.Number `json:"exp"`
+	NotBefore *json.Number `json:"nbf"`
+	IssuedAt  *json.Number `json:"iat"`
+}
+
+// audience is the aud claim, a single audience or an array of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// NewJWTAuth creates the JWT auth of cfg. The keys are fetched when the first token is verified.
+func NewJWTAuth(cfg config.JWTConfig) (*JWTAuth, error) {
+	if !strings.HasPrefix(cfg.JWKSURL, "https://") && !strings.HasPrefix(cfg.JWKSURL, "http://") {
+		return nil, fmt.Errorf("invalid JWKS URL %q", cfg.JWKSURL)
+	}
+	refresh, _ := time.ParseDuration(cfg.JWKSRefresh)
+	leeway, _ := time.ParseDuration(cfg.Leeway)
+	return &JWTAuth{
+		issuer:      cfg.Issuer,
+		audience:    cfg.Audience,
+		jwksURL:     cfg.JWKSURL,
+		refresh:     refresh,
+		leeway:      leeway,
+		deviceClaim: cfg.DeviceClaim,
+		tenantClaim: cfg.TenantClaim,
+		required:    cfg.Required,
+		client:      &http.Client{Timeout: jwksTimeout},
+	}, nil
+}
+
+// isJWT reports whether token has the three parts of a JWT in compact serialization
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify checks the token's signature, issuer, audience and validity period, returning its claims
+func (a *JWTAuth) Verify(ctx context.Context, token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidJWT
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidJWT
+	}
+	hash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidJWT, header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidJWT
+	}
+	key, err := a.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key.alg != "" && key.alg != header.Alg {
+		return nil, fmt.Errorf("%w: key is for %s", ErrInvalidJWT, key.alg)
+	}
+	if !verifySignature(header.Alg, hash, key.key, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidJWT)
+	}
+
+	var registered registeredClaims
+	var claims map[string]any
+	if decodeSegment(parts[1], &registered) != nil || decodeSegment(parts[1], &claims) != nil {
+		return nil, ErrInvalidJWT
+	}
+	now := time.Now()
+	if exp, ok := numericDate(registered.ExpiresAt); ok && now.After(exp.Add(a.leeway)) {
+		return nil, ErrExpiredJWT
+	}
+	if nbf, ok := numericDate(registered.NotBefore); ok && now.Before(nbf.Add(-a.leeway)) {
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidJWT)
+	}
+	if iat, ok := numericDate(registered.IssuedAt); ok && now.Before(iat.Add(-a.leeway)) {
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidJWT)
+	}
+	if a.issuer != "" && registered.Issuer != a.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidJWT)
+	}
+	if a.audience != "" && !slices.Contains(registered.Audience, a.audience) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidJWT)
+	}
+	return claims, nil
+}
+
+// Middleware returns a websocket middleware validating the JWT of connecting devices and
+// attaching the device and tenant of its claims, and the claims themselves, to the request.
+// Tokens in the query parameter that are not JWTs are left to signed URLs.
+func (a *JWTAuth) Middleware() websocket.Middleware {
+	return websocket.Middleware{
+		OnConnect: func(r *http.Request) (*http.Request, error) {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || !isJWT(token) {
+				token = r.URL.Query().Get(TokenParam)
+			}
+			if !isJWT(token) {
+				if a.required {
+					return nil, &websocket.RejectError{StatusCode: http.StatusUnauthorized, Reason: "token required"}
+				}
+				return r, nil
+			}
+
+			claims, err := a.Verify(r.Context(), token)
+			if errors.Is(err, ErrUnavailableJWKS) {
+				return nil, &websocket.RejectError{StatusCode: http.StatusServiceUnavailable, Reason: err.Error()}
+			}
+			if err != nil {
+				return nil, &websocket.RejectError{StatusCode: http.StatusUnauthorized, Reason: err.Error()}
+			}
+			ctx := websocket.WithTokenClaims(r.Context(), claims)
+			if id, _ := claims[a.deviceClaim].(string); id != "" {
+				ctx = websocket.WithDeviceID(ctx, id)
+			}
+			if id, _ := claims[a.tenantClaim].(string); a.tenantClaim != "" && id != "" {
+				ctx = websocket.WithTenantID(ctx, id)
+			}
+			return r.WithContext(ctx), nil
+		},
+	}
+}
+
+// key returns the key with the ID kid, fetching the keys when they are due for a refresh or when
+// the key is not known yet. Keys fetched before keep being used while the identity provider is
+// unreachable. The keys are fetched without holding the lock, so tokens of known keys are verified
+// while a fetch is in flight; lookups of a key not known yet wait for it.
+func (a *JWTAuth) key(ctx context.Context, kid string) (jwk, error) {
+	a.mu.Lock()
+	key, ok := a.find(kid)
+	if ok && time.Since(a.fetched) < a.refresh {
+		a.mu.Unlock()
+		return key, nil
+	}
+	var fetchErr error
+	switch {
+	case a.fetching != nil && !ok:
+		done := a.fetching
+		a.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return jwk{}, fmt.Errorf("%w: %v", ErrUnavailableJWKS, ctx.Err())
+		}
+		a.mu.Lock()
+		key, ok = a.find(kid)
+	case a.fetching == nil && time.Since(a.tried) >= jwksRefetch:
+		tried, done := time.Now(), make(chan struct{})
+		a.tried, a.fetching = tried, done
+		a.mu.Unlock()
+		keys, err := a.fetch(ctx)
+		a.mu.Lock()
+		a.fetching = nil
+		close(done)
+		if err == nil {
+			a.keys, a.fetched = keys, tried
+			key, ok = a.find(kid)
+		}
+		fetchErr = err
+	}
+	defer a.mu.Unlock()
+	if a.keys == nil {
+		if fetchErr != nil {
+			return jwk{}, fmt.Errorf("%w: %v", ErrUnavailableJWKS, fetchErr)
+		}
+		return jwk{}, ErrUnavailableJWKS
+	}
+	if !ok {
+		return jwk{}, fmt.Errorf("%w: unknown key %q", ErrInvalidJWT, kid)
+	}
+	return key, nil
+}
+
+// find returns the key with the ID kid, or the only key for tokens without a key ID
+func (a *JWTAuth) find(kid string) (jwk, bool) {
+	if key, ok := a.keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, true
+		}
+	}
+	return jwk{}, false
+}
+
+// fetch reads the signing keys of the JWKS by their key IDs, skipping encryption keys and keys of
+// types that are not supported
+func (a *JWTAuth) fetch(ctx context.Context) (map[string]jwk, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS request failed with status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, maxJWKS)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("could not parse JWKS: %w", err)
+	}
+	keys := make(map[string]jwk, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch k.Kty {
+		case "RSA":
+			n, e := decodeInt(k.N), decodeInt(k.E)
+			if n == nil || e == nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+				continue
+			}
+			key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			curve, ok := jwkCurves[k.Crv]
+			x, y := decodeInt(k.X), decodeInt(k.Y)
+			if !ok || x == nil || y == nil || !curve.IsOnCurve(x, y) {
+				continue
+			}
+			key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+				continue
+			}
+			key = ed25519.PublicKey(x)
+		default:
+			continue
+		}
+		keys[k.Kid] = jwk{alg: k.Alg, key: key}
+	}
+	return keys, nil
+}
+
+// jwtHashes are the hashes of the supported signing algorithms; EdDSA hashes as it signs
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// jwkCurves are the curves of EC keys
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// esCurves are the curves of the ES algorithms
+var esCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+// verifySignature checks the signature of a token, whose key must be of the algorithm's type
+func verifySignature(alg string, hash crypto.Hash, key crypto.PublicKey, signed, sig []byte) bool {
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+		case "PS":
+			return rsa.VerifyPSS(k, hash, digest, sig, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		// ES signatures are r and s, each as long as the curve's order
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if esCurves[alg] != k.Curve || len(sig) != 2*size {
+			return false
+		}
+		return ecdsa.Verify(k, digest, new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:]))
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(k, signed, sig)
+	}
+	return false
+}
+
+// decodeSegment decodes a base64url encoded JSON part of a token, keeping numbers as they are
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// decodeInt decodes a base64url encoded big endian integer of a JWK
+func decodeInt(s string) *big.Int {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	return new(big.Int).SetBytes(b)
+}
+
+// numericDate returns the time of a date claim in seconds since the epoch, if the token has it
+func numericDate(n *json.Number) (time.Time, bool) {
+	if n == nil {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(f*float64(time.Second))), true
+}
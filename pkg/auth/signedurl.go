@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/websocket"
+)
+
+// TokenParam is the query parameter signed connection URLs carry their token in
+const TokenParam = "token"
+
+var (
+	ErrInvalidToken = errors.New("invalid connection token")
+	ErrExpiredToken = errors.New("connection token has expired")
+	ErrUsedToken    = errors.New("connection token has already been used")
+)
+
+// Claims are what a connection token grants
+type Claims struct {
+	DeviceID  string `json:"d"`
+	TenantID  string `json:"t,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+	Nonce     string `json:"n"`
+}
+
+// NonceStore remembers the tokens that have been used. Deployments running several relays behind
+// a load balancer need a store shared between them for tokens to be single use.
+type NonceStore interface {
+	// Use marks the nonce as used until expires, returning false if it was used already
+	Use(nonce string, expires time.Time) bool
+}
+
+// URLSigner mints signed connection URLs and validates them when devices connect
+type URLSigner struct {
+	secret     []byte
+	apiKey     string
+	baseURL    *url.URL
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+	required   bool
+	nonces     NonceStore
+}
+
+// NewURLSigner creates a signer from cfg. Used tokens are remembered in memory unless nonces is set.
+func NewURLSigner(cfg config.SignedURLConfig, nonces NonceStore) (*URLSigner, error) {
+	base, err := url.Parse(cfg.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signed URL base_url: %w", err)
+	}
+	defaultTTL, _ := time.ParseDuration(cfg.DefaultTTL)
+	maxTTL, _ := time.ParseDuration(cfg.MaxTTL)
+	if nonces == nil {
+		nonces = NewMemoryNonceStore()
+	}
+	return &URLSigner{
+		secret:     []byte(cfg.Secret),
+		apiKey:     cfg.APIKey,
+		baseURL:    base,
+		defaultTTL: defaultTTL,
+		maxTTL:     maxTTL,
+		required:   cfg.Required,
+		nonces:     nonces,
+	}, nil
+}
+
+// Sign mints a token for the device, valid for ttl, capped at the configured maximum. A ttl of
+// zero uses the default.
+func (s *URLSigner) Sign(deviceID, tenantID string, ttl time.Duration) (string, Claims, error) {
+	if deviceID == "" {
+		return "", Claims{}, errors.New("device ID is required")
+	}
+	if ttl <= 0 {
+		ttl = s.defaultTTL
+	}
+	if s.maxTTL > 0 && ttl > s.maxTTL {
+		ttl = s.maxTTL
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", Claims{}, err
+	}
+	claims := Claims{
+		DeviceID:  deviceID,
+		TenantID:  tenantID,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+		Nonce:     hex.EncodeToString(nonce),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", Claims{}, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.mac(encoded)), claims, nil
+}
+
+// SignURL mints a connection URL for the device
+func (s *URLSigner) SignURL(deviceID, tenantID string, ttl time.Duration) (string, Claims, error) {
+	token, claims, err := s.Sign(deviceID, tenantID, ttl)
+	if err != nil {
+		return "", Claims{}, err
+	}
+	return s.connectURL(token), claims, nil
+}
+
+// ConnectTokens returns the minter of the connect tokens devices get from the connect info
+// endpoint: signed URLs valid for ttl
+func (s *URLSigner) ConnectTokens(ttl time.Duration) websocket.ConnectTokenFunc {
+	return func(deviceID, tenantID string) (websocket.ConnectToken, error) {
+		token, claims, err := s.Sign(deviceID, tenantID, ttl)
+		if err != nil {
+			return websocket.ConnectToken{}, err
+		}
+		return websocket.ConnectToken{URL: s.connectURL(token), Token: token, ExpiresAt: time.Unix(claims.ExpiresAt, 0)}, nil
+	}
+}
+
+func (s *URLSigner) connectURL(token string) string {
+	u := *s.baseURL
+	q := u.Query()
+	q.Set(TokenParam, token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Verify checks the token's signature and expiry and consumes it, so it cannot be used again
+func (s *URLSigner) Verify(token string) (Claims, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return Claims{}, ErrInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, s.mac(encoded)) {
+		return Claims{}, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.DeviceID == "" || claims.Nonce == "" {
+		return Claims{}, ErrInvalidToken
+	}
+
+	expires := time.Unix(claims.ExpiresAt, 0)
+	if time.Now().After(expires) {
+		return Claims{}, ErrExpiredToken
+	}
+	if !s.nonces.Use(claims.Nonce, expires) {
+		return Claims{}, ErrUsedToken
+	}
+	return claims, nil
+}
+
+func (s *URLSigner) mac(payload string) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// Middleware returns a websocket middleware validating the token of signed connection URLs and
+// attaching the device and tenant it was minted for to the request. Connections with a JWT in the
+// token parameter count as having no signed URL.
+func (s *URLSigner) Middleware() websocket.Middleware {
+	return websocket.Middleware{
+		OnConnect: func(r *http.Request) (*http.Request, error) {
+			token := r.URL.Query().Get(TokenParam)
+			// JWTs in the same parameter are left to JWT auth
+			if isJWT(token) {
+				token = ""
+			}
+			if token == "" {
+				if s.required {
+					return nil, &websocket.RejectError{StatusCode: http.StatusUnauthorized, Reason: "connection token required"}
+				}
+				return r, nil
+			}
+
+			claims, err := s.Verify(token)
+			if err != nil {
+				return nil, &websocket.RejectError{StatusCode: http.StatusUnauthorized, Reason: err.Error()}
+			}
+			ctx := websocket.WithDeviceID(r.Context(), claims.DeviceID)
+			if claims.TenantID != "" {
+				ctx = websocket.WithTenantID(ctx, claims.TenantID)
+			}
+			return r.WithContext(ctx), nil
+		},
+	}
+}
+
+type mintRequest struct {
+	DeviceID string `json:"device_id"`
+	TenantID string `json:"tenant_id"`
+	// TTL is a duration such as "30s"
+	TTL string `json:"ttl"`
+}
+
+type mintResponse struct {
+	URL       string    `json:"url"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Handler returns the HTTP handler backends mint connection URLs with. Requests authenticate with
+// the configured API key as a bearer token.
+func (s *URLSigner) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(key), []byte(s.apiKey)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req mintRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil {
+				http.Error(w, "invalid ttl", http.StatusBadRequest)
+				return
+			}
+		}
+
+		token, claims, err := s.Sign(req.DeviceID, req.TenantID, ttl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mintResponse{
+			URL:       s.connectURL(token),
+			Token:     token,
+			ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+		})
+	})
+}
+
+// MemoryNonceStore keeps used nonces in memory until they expire
+type MemoryNonceStore struct {
+	mu    sync.Mutex
+	used  map[string]time.Time
+	swept time.Time
+}
+
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{used: make(map[string]time.Time)}
+}
+
+func (m *MemoryNonceStore) Use(nonce string, expires time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.swept) > time.Minute {
+		for n, exp := range m.used {
+			if now.After(exp) {
+				delete(m.used, n)
+			}
+		}
+		m.swept = now
+	}
+	if _, ok := m.used[nonce]; ok {
+		return false
+	}
+	m.used[nonce] = expires
+	return true
+}
@@ -0,0 +1,61 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFake(start)
+	late := c.After(2 * time.Second)
+	early := c.After(time.Second)
+
+	c.Advance(500 * time.Millisecond)
+	select {
+	case <-early:
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	c.Advance(time.Second)
+	if at := <-early; !at.Equal(start.Add(1500 * time.Millisecond)) {
+		t.Fatalf("unexpected fire time %s", at)
+	}
+	if c.Waiters() != 1 {
+		t.Fatalf("expected 1 pending timer, got %d", c.Waiters())
+	}
+	c.Advance(time.Second)
+	<-late
+	if !c.Now().Equal(start.Add(2500 * time.Millisecond)) {
+		t.Fatalf("unexpected time %s", c.Now())
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFake(start)
+	ticker := c.NewTicker(time.Second)
+
+	c.Advance(1500 * time.Millisecond)
+	if at := <-ticker.C(); !at.Equal(start.Add(time.Second)) {
+		t.Fatalf("unexpected tick %s", at)
+	}
+
+	// Ticks are dropped for a receiver that falls behind
+	c.Advance(3 * time.Second)
+	<-ticker.C()
+	select {
+	case <-ticker.C():
+		t.Fatal("missed ticks were queued")
+	default:
+	}
+
+	ticker.Stop()
+	c.Advance(time.Second)
+	select {
+	case <-ticker.C():
+		t.Fatal("stopped ticker fired")
+	default:
+	}
+}
@@ -0,0 +1,2363 @@
+package config
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/version"
+	"github.com/spf13/viper"
+)
+
+type Config struct {
+	Server    ServerConfig    `mapstructure:"server"`
+	Websocket WebsocketConfig `mapstructure:"websocket"`
+	Audio     AudioConfig     `mapstructure:"audio"`
+	Azure     AzureConfig     `mapstructure:"azure"`
+	OpenAI    OpenAIConfig    `mapstructure:"openai"`
+	AIConfig  AIConfig        `mapstructure:"ai"`
+	Bandwidth BandwidthConfig `mapstructure:"bandwidth"`
+	Offline   OfflineConfig   `mapstructure:"offline"`
+	// ProviderQueue caps the provider sessions open at once, queueing the devices beyond it
+	ProviderQueue ProviderQueueConfig `mapstructure:"provider_queue"`
+	Reaper        ReaperConfig        `mapstructure:"reaper"`
+	Memory        MemoryConfig        `mapstructure:"memory"`
+	// Shutdown controls draining the sessions when the relay stops
+	Shutdown ShutdownConfig `mapstructure:"shutdown"`
+	// Transcripts controls keeping records of finished sessions
+	Transcripts TranscriptsConfig `mapstructure:"transcripts"`
+	Digest      DigestConfig      `mapstructure:"digest"`
+	Policy      PolicyConfig      `mapstructure:"policy"`
+	Auth        AuthConfig        `mapstructure:"auth"`
+	Encryption  EncryptionConfig  `mapstructure:"encryption"`
+	Admin       AdminConfig       `mapstructure:"admin"`
+	// RateLimit bounds how often devices and tenants connect
+	RateLimit RateLimitConfig `mapstructure:"rate_limit"`
+	// Assets locates the audio clips the relay plays itself
+	Assets AssetsConfig `mapstructure:"assets"`
+	Filler FillerConfig `mapstructure:"filler"`
+	FAQ    FAQConfig    `mapstructure:"faq"`
+	Tools  ToolsConfig  `mapstructure:"tools"`
+	// Translation controls the translation of captions for devices displaying another language
+	Translation TranslationConfig `mapstructure:"translation"`
+	// TurnProcessors bounds the processors embedding applications run after assistant turns
+	TurnProcessors TurnProcessorsConfig `mapstructure:"turn_processors"`
+	// PTT controls devices that send audio in push-to-talk mode
+	PTT  PTTConfig  `mapstructure:"ptt"`
+	Tags TagsConfig `mapstructure:"tags"`
+	// Versions sets the oldest devices the relay serves
+	Versions VersionsConfig `mapstructure:"versions"`
+	// Chaos injects faults for resilience testing, outside production only
+	Chaos ChaosConfig `mapstructure:"chaos"`
+	// Echo detects devices whose microphone picks up the assistant from their speaker
+	Echo EchoConfig `mapstructure:"echo"`
+	// Trace captures the wire traffic of sessions for debugging the protocol
+	Trace TraceConfig `mapstructure:"trace"`
+	// SpeechEstimate tells devices how long the assistant's answers play as they stream
+	SpeechEstimate SpeechEstimateConfig `mapstructure:"speech_estimate"`
+	// Endpointing decides when the user's turn ends; device profiles override it
+	Endpointing EndpointingConfig `mapstructure:"endpointing"`
+	// DeviceProfiles hold the settings of kinds of devices or groups of users, keyed by profile
+	// name. Keys are lower cased when read from the config file.
+	DeviceProfiles map[string]DeviceProfile `mapstructure:"device_profiles"`
+	// Calibration adapts sessions to the noise around their device
+	Calibration CalibrationConfig `mapstructure:"calibration"`
+	// Denoise suppresses the background noise in the audio from devices; device profiles override it
+	Denoise DenoiseConfig `mapstructure:"denoise"`
+	// AGC brings the level of the user's speech to a target; device profiles override it
+	AGC AGCConfig `mapstructure:"agc"`
+	// AEC cancels the response audio full duplex devices pick up from their speaker; device
+	// profiles override it
+	AEC AECConfig `mapstructure:"aec"`
+	// Jitter smooths the bursty delivery of the audio of devices on flaky links
+	Jitter JitterConfig `mapstructure:"jitter"`
+	// PLC fills the gaps of frames lost by devices sending frame headers
+	PLC PLCConfig `mapstructure:"plc"`
+	// Retranscribe transcribes the recorded audio of finished sessions again
+	Retranscribe RetranscribeConfig `mapstructure:"retranscribe"`
+	// AudioTest lets installers check the audio path of a device with a test tone
+	AudioTest AudioTestConfig `mapstructure:"audio_test"`
+	// Events publishes a normalized stream of session events, such as to Kafka
+	Events EventsConfig `mapstructure:"events"`
+	// Announcements plays scheduled announcements to groups of devices
+	Announcements AnnouncementsConfig `mapstructure:"announcements"`
+	// SpeakerVerification checks the user is the speaker a session is for before sensitive tools
+	// and personas are used
+	SpeakerVerification SpeakerVerificationConfig `mapstructure:"speaker_verification"`
+	// ProviderLog logs the raw frames exchanged with providers for a sample of sessions
+	ProviderLog ProviderLogConfig `mapstructure:"provider_log"`
+	// DeviceHello lets devices declare their audio in a message after they connect
+	DeviceHello DeviceHelloConfig `mapstructure:"device_hello"`
+	// Devices keeps the presence of devices, for the admin API
+	Devices DevicesConfig `mapstructure:"devices"`
+	// VADGate only sends the provider the audio of devices in which speech is detected
+	VADGate VADGateConfig `mapstructure:"vad_gate"`
+	// PipelineScheduler shares the CPU of the audio pipeline fairly between sessions
+	PipelineScheduler PipelineSchedulerConfig `mapstructure:"pipeline_scheduler"`
+	// VoiceGain brings the answers of every voice of the provider to the same loudness
+	VoiceGain VoiceGainConfig `mapstructure:"voice_gain"`
+	// Speaker classifies coarse attributes of the user's voice and applies policies to them
+	Speaker SpeakerConfig `mapstructure:"speaker"`
+	// Connect tells devices where and how to connect before they upgrade
+	Connect ConnectConfig `mapstructure:"connect"`
+	// Analytics aggregates finished sessions without keeping them
+	Analytics AnalyticsConfig `mapstructure:"analytics"`
+	// Regions hold the endpoints and storage tenants are pinned to for data residency, keyed by
+	// region name. Keys are lower cased when read from the config file.
+	Regions map[string]RegionConfig `mapstructure:"regions"`
+	// Tenants holds per tenant settings, keyed by tenant ID. Keys are lower cased when read from the config file.
+	Tenants map[string]TenantConfig `mapstructure:"tenants"`
+}
+
+type TranscriptsConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MaxSessions bounds how many session records are kept in memory; 0 means unbounded
+	MaxSessions int `mapstructure:"max_sessions"`
+}
+
+// RetranscribeConfig configures the jobs that transcribe the audio of finished sessions again,
+// from the traces captured with trace.audio, such as when a better transcription model ships
+type RetranscribeConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Provider is the registered provider that transcribes, ai.provider if empty
+	Provider string `mapstructure:"provider"`
+	// Concurrency is how many sessions a job transcribes at once
+	Concurrency int `mapstructure:"concurrency"`
+	// IdleTimeout ends the transcription of a session once the provider has sent nothing for this
+	// long after all of its audio
+	IdleTimeout string `mapstructure:"idle_timeout"`
+}
+
+// AnalyticsConfig controls the aggregate analytics of finished sessions: session counts, duration
+// histograms and intent frequencies per tenant and day, for tenants that do not allow their
+// transcripts to be stored. Counts standing for fewer sessions than MinCohort are withheld.
+type AnalyticsConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MinCohort is the fewest sessions a reported count may stand for
+	MinCohort int `mapstructure:"min_cohort"`
+	// DurationBuckets are the upper bounds of the session duration histogram, such as "1m"
+	DurationBuckets []string `mapstructure:"duration_buckets"`
+	// Epsilon adds Laplace noise of scale 1/epsilon to every reported count, so reports for
+	// overlapping ranges cannot be subtracted to single out a session; 0 adds none
+	Epsilon float64 `mapstructure:"epsilon"`
+	// Retention is how long the aggregates of a day are kept
+	Retention string `mapstructure:"retention"`
+}
+
+// AggregateOnly reports whether the tenant's sessions are only aggregated, not recorded
+func (c *Config) AggregateOnly(tenantID string) bool {
+	tenant, ok := c.Tenants[strings.ToLower(tenantID)]
+	return tenantID != "" && ok && tenant.AggregateOnly
+}
+
+// DigestConfig schedules the daily per tenant digest of finished sessions
+type DigestConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// SendAt is the UTC time of day ("15:04") the previous day's digest is sent at
+	SendAt string `mapstructure:"send_at"`
+	// TopIntents is how many of the most frequent intents are listed
+	TopIntents int        `mapstructure:"top_intents"`
+	SMTP       SMTPConfig `mapstructure:"smtp"`
+}
+
+type SMTPConfig struct {
+	// Addr is the host:port of the SMTP server
+	Addr     string `mapstructure:"addr"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	From     string `mapstructure:"from"`
+}
+
+// EncryptionConfig controls encrypting audio frames on top of TLS, for devices connecting through
+// TLS terminating proxies that are not trusted
+type EncryptionConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Required drops audio in both directions until the device has said hello
+	Required bool `mapstructure:"required"`
+	// SigningKeyFile is a PEM PKCS #8 Ed25519 private key the relay signs its hello with
+	SigningKeyFile string `mapstructure:"signing_key_file"`
+}
+
+type AuthConfig struct {
+	SignedURLs SignedURLConfig `mapstructure:"signed_urls"`
+	APIKeys    APIKeyConfig    `mapstructure:"api_keys"`
+	JWT        JWTConfig       `mapstructure:"jwt"`
+}
+
+// APIKeyConfig authenticates devices by an API key they present when connecting
+type APIKeyConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Header carries the key; devices that cannot set headers use the api_key query parameter
+	Header string `mapstructure:"header"`
+	// Store is where keys are looked up: memory for Keys, file or redis
+	Store string `mapstructure:"store"`
+	// Keys are the keys of the memory store
+	Keys []APIKey `mapstructure:"keys"`
+	// File is a JSON file of the file store's keys, read again whenever it changes
+	File string `mapstructure:"file"`
+	// Redis is the server of the redis store, which keeps each key's identity as JSON under the
+	// key prefix followed by the key
+	Redis RedisConfig `mapstructure:"redis"`
+	// Required rejects devices connecting without a key
+	Required bool `mapstructure:"required"`
+}
+
+// APIKey is a device API key and the identity it grants
+type APIKey struct {
+	Key      string `mapstructure:"key" json:"key"`
+	DeviceID string `mapstructure:"device_id" json:"device_id"`
+	TenantID string `mapstructure:"tenant_id" json:"tenant_id,omitempty"`
+}
+
+// JWTConfig authenticates devices by a JSON Web Token issued by an identity provider, signed with
+// one of the keys it publishes as a JWKS
+type JWTConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Issuer and Audience must match the iss and aud claims of tokens; empty ones are not checked
+	Issuer   string `mapstructure:"issuer"`
+	Audience string `mapstructure:"audience"`
+	// JWKSURL is where the identity provider publishes its signing keys
+	JWKSURL string `mapstructure:"jwks_url"`
+	// JWKSRefresh is how often the keys are fetched again. Tokens signed with a key that is not
+	// known yet fetch them sooner, at most once a minute.
+	JWKSRefresh string `mapstructure:"jwks_refresh"`
+	// Leeway is the clock skew allowed when checking the exp, nbf and iat claims
+	Leeway string `mapstructure:"leeway"`
+	// DeviceClaim and TenantClaim are the claims holding the identity of the device and its tenant
+	DeviceClaim string `mapstructure:"device_claim"`
+	TenantClaim string `mapstructure:"tenant_claim"`
+	// Required rejects devices connecting without a token
+	Required bool `mapstructure:"required"`
+}
+
+// SignedURLConfig controls short lived, single use connection URLs minted by backend systems
+type SignedURLConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Secret signs the URLs; set it through PIXA_AUTH_SIGNED_URLS_SECRET
+	Secret string `mapstructure:"secret"`
+	// APIKey authenticates backends minting URLs; set it through PIXA_AUTH_SIGNED_URLS_API_KEY
+	APIKey string `mapstructure:"api_key"`
+	// BaseURL is the websocket URL devices connect to, e.g. wss://relay.example.com/
+	BaseURL    string `mapstructure:"base_url"`
+	DefaultTTL string `mapstructure:"default_ttl"`
+	MaxTTL     string `mapstructure:"max_ttl"`
+	// Required rejects devices connecting without a signed URL
+	Required bool `mapstructure:"required"`
+}
+
+// PolicyConfig controls which addresses and countries devices can connect from
+type PolicyConfig struct {
+	PolicyRules `mapstructure:",squash"`
+	// GeoIPDatabase is the path of a MaxMind country database, required for country rules
+	GeoIPDatabase string `mapstructure:"geoip_database"`
+	// TrustedProxies are the CIDRs of proxies whose X-Forwarded-For header is trusted
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+}
+
+// PolicyRules are the connection rules applied globally or to a single tenant. Allow and deny
+// lists hold CIDRs or single addresses, countries are ISO 3166-1 alpha-2 codes.
+type PolicyRules struct {
+	Allow            []string `mapstructure:"allow"`
+	Deny             []string `mapstructure:"deny"`
+	AllowedCountries []string `mapstructure:"allowed_countries"`
+	BlockedCountries []string `mapstructure:"blocked_countries"`
+}
+
+// Empty reports whether no rule is set
+func (r PolicyRules) Empty() bool {
+	return len(r.Allow) == 0 && len(r.Deny) == 0 && len(r.AllowedCountries) == 0 && len(r.BlockedCountries) == 0
+}
+
+func (r PolicyRules) validate(name string, geoIP bool) error {
+	for _, list := range [][]string{r.Allow, r.Deny} {
+		for _, cidr := range list {
+			if _, err := netip.ParsePrefix(cidr); err != nil {
+				if _, err := netip.ParseAddr(cidr); err != nil {
+					return fmt.Errorf("invalid %s address or CIDR: %s", name, cidr)
+				}
+			}
+		}
+	}
+	if !geoIP && (len(r.AllowedCountries) > 0 || len(r.BlockedCountries) > 0) {
+		return fmt.Errorf("%s country rules require policy.geoip_database", name)
+	}
+	return nil
+}
+
+// TenantConfig holds the settings of a single tenant
+type TenantConfig struct {
+	Digest DigestTarget `mapstructure:"digest"`
+	// Policy rules of the tenant are applied on top of the global ones. A tenant allow list
+	// replaces the global one.
+	Policy PolicyRules `mapstructure:"policy"`
+	// Transcription settings of the tenant override the global ones; phrases are added to them
+	Transcription TranscriptionConfig `mapstructure:"transcription"`
+	// Proxy routes the tenant's provider connections, instead of ai.proxy
+	Proxy ProxyConfig `mapstructure:"proxy"`
+	// DeviceProfile is the profile of the tenant's devices that do not choose one
+	DeviceProfile string `mapstructure:"device_profile"`
+	// Region pins the tenant's provider traffic, traces and session records to one of regions
+	Region string `mapstructure:"region"`
+	// AggregateOnly keeps no records of the tenant's sessions, transcripts included; they only count
+	// towards the aggregate analytics
+	AggregateOnly bool `mapstructure:"aggregate_only"`
+}
+
+// DigestTarget is where a tenant's digest is delivered; either or both can be set
+type DigestTarget struct {
+	WebhookURL string   `mapstructure:"webhook_url"`
+	Emails     []string `mapstructure:"emails"`
+}
+
+// OfflineConfig controls buffering of uplink audio while the provider is unreachable
+type OfflineConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MaxBuffer bounds how much audio is buffered; the oldest audio is dropped beyond it
+	MaxBuffer string `mapstructure:"max_buffer"`
+	// OnRecovery is "replay" to send the buffered audio once the provider is back, or "discard"
+	OnRecovery    string `mapstructure:"on_recovery"`
+	RetryInterval string `mapstructure:"retry_interval"`
+	// MaxOutage ends the session when the provider stays unreachable for longer
+	MaxOutage string `mapstructure:"max_outage"`
+}
+
+// ProviderQueueConfig caps how many sessions the relay holds open with the provider at once, as
+// providers limit concurrent sessions. Devices connecting beyond the cap wait in line, told their
+// position, until a session ends.
+type ProviderQueueConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MaxSessions is the most provider sessions at once across the relay
+	MaxSessions int `mapstructure:"max_sessions"`
+	// MaxWaiting is the most devices waiting; devices connecting beyond it are refused
+	MaxWaiting int `mapstructure:"max_waiting"`
+	// MaxWait ends the sessions of devices that waited for longer
+	MaxWait string `mapstructure:"max_wait"`
+	// HoldAsset is the clip looped to waiting devices, from assets.dir; empty plays nothing
+	HoldAsset string `mapstructure:"hold_asset"`
+}
+
+// AssetsConfig locates the audio clips the relay plays to devices itself
+type AssetsConfig struct {
+	// Dir holds the clips as 16 bit PCM WAV files
+	Dir string `mapstructure:"dir"`
+}
+
+// FillerConfig controls the audio played to the device while the model is thinking, so the gap
+// between the end of the user's speech and the response does not feel like a hang
+type FillerConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Asset is the clip from the assets directory that is played, looped
+	Asset string `mapstructure:"asset"`
+	// Delay is how long after the user stops speaking the filler starts, so quick responses play without it
+	Delay string `mapstructure:"delay"`
+	// MaxDuration stops the filler if the model still has not responded
+	MaxDuration string `mapstructure:"max_duration"`
+}
+
+// FAQConfig controls FAQ mode, for kiosk deployments answering the same questions over and over:
+// answers are cached by question and played back without asking the model
+type FAQConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// TTL is how long a cached answer is served
+	TTL        string `mapstructure:"ttl"`
+	MaxEntries int    `mapstructure:"max_entries"`
+	// MinSimilarity is the share of words a question must have in common with a cached one to get
+	// its answer, from 0 to 1
+	MinSimilarity float64 `mapstructure:"min_similarity"`
+	// MaxAnswer bounds the length of the answers that are cached
+	MaxAnswer string `mapstructure:"max_answer"`
+}
+
+// TranslationConfig controls the translation of the assistant's captions into the display language
+// devices report, which can differ from the language spoken. Captions are only translated when the
+// embedding application sets a translator.
+type TranslationConfig struct {
+	// Timeout bounds the translation of a sentence; the sentence is sent as spoken once it is over
+	Timeout string `mapstructure:"timeout"`
+}
+
+// TurnProcessorsConfig bounds the turn processors of embedding applications, which run after every
+// completed assistant turn. Turns are only processed when the embedding application registers
+// processors.
+type TurnProcessorsConfig struct {
+	// Timeout bounds each processor's run on a turn; the chain goes on without it once it is over
+	Timeout string `mapstructure:"timeout"`
+	// Queue is how many turns of a session may wait for the processors; turns beyond it are
+	// not processed
+	Queue int `mapstructure:"queue"`
+}
+
+// PTTConfig controls push-to-talk devices, which stream their microphone continuously but only
+// want to be heard while their button is held
+type PTTConfig struct {
+	// PreBuffer is how much audio is kept while the button is up, to relay the audio captured
+	// between the press and the device reporting it; 0 relays from the report on
+	PreBuffer string `mapstructure:"pre_buffer"`
+	// EndSilence is the silence sent to the provider when the button is released, so it takes the
+	// turn as over
+	EndSilence string `mapstructure:"end_silence"`
+}
+
+// ToolsConfig controls how the relay runs the tools the model calls
+type ToolsConfig struct {
+	// Timeout bounds a tool call; the model is told the call failed once it is over
+	Timeout string `mapstructure:"timeout"`
+	// SlowAfter is how long a call may run before the model is asked to tell the user it is
+	// working on it, so the device does not sit in silence
+	SlowAfter string `mapstructure:"slow_after"`
+	// SlowInstructions tell the model what to say about a slow call
+	SlowInstructions string `mapstructure:"slow_instructions"`
+}
+
+// TagsConfig controls which session tags become metric labels. Tags are kept in session records
+// either way.
+type TagsConfig struct {
+	// MetricLabels are the tag keys sessions are counted by
+	MetricLabels []string `mapstructure:"metric_labels"`
+	// MaxLabelValues bounds the values counted per key; later values are counted as "other"
+	MaxLabelValues int `mapstructure:"max_label_values"`
+}
+
+// VersionsConfig sets the oldest protocol and firmware versions the relay serves, so old devices
+// can be told to upgrade before support for them is dropped
+type VersionsConfig struct {
+	// MinProtocol is the oldest protocol version served. Devices that do not report one speak version 1.
+	MinProtocol int `mapstructure:"min_protocol"`
+	// MinFirmware is the oldest firmware version served, e.g. "2.3.0". Devices that do not report
+	// a firmware version are taken to be older. Empty accepts any firmware.
+	MinFirmware string `mapstructure:"min_firmware"`
+	// RecommendedFirmware is the firmware version older devices are told to upgrade to while they
+	// are still served
+	RecommendedFirmware string `mapstructure:"recommended_firmware"`
+	// Enforce closes the sessions of devices below a minimum. Otherwise they are only told to
+	// upgrade, so a deprecation can be watched in metrics before it is enforced.
+	Enforce bool `mapstructure:"enforce"`
+}
+
+// ChaosConfig injects faults into sessions, to check how the relay and devices recover from them.
+// Probabilities are between 0 and 1 and drawn from the session's seed, so a seeded run fails the
+// same way again. It can only be enabled in the test and staging environments.
+type ChaosConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// DropEvents is the probability of dropping each provider event, such as a transcript or a
+	// tool call
+	DropEvents float64 `mapstructure:"drop_events"`
+	// DelayFrames is the probability of holding each audio frame from the device for FrameDelay
+	DelayFrames float64 `mapstructure:"delay_frames"`
+	FrameDelay  string  `mapstructure:"frame_delay"`
+	// CorruptFrames is the probability of flipping a bit of each audio frame, in either direction
+	CorruptFrames float64 `mapstructure:"corrupt_frames"`
+	// ProviderDisconnects and DeviceDisconnects are the probabilities of a session losing its
+	// provider or its device connection, once, at a random time within DisconnectWithin of its start
+	ProviderDisconnects float64 `mapstructure:"provider_disconnects"`
+	DeviceDisconnects   float64 `mapstructure:"device_disconnects"`
+	DisconnectWithin    string  `mapstructure:"disconnect_within"`
+}
+
+// EchoConfig controls the detection of relay loops: the assistant's audio leaking from the device's
+// speaker back into its microphone, so the assistant converses with itself. The loudness of the
+// audio relayed to the device is correlated with that of the audio received from it.
+type EchoConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Threshold is the correlation, in (0, 1], above which the uplink is taken to echo the downlink
+	Threshold float64 `mapstructure:"threshold"`
+	// Window is how much audio is correlated, MaxDelay how late the echo may come back
+	Window   string `mapstructure:"window"`
+	MaxDelay string `mapstructure:"max_delay"`
+	// MuteFor is how long the uplink is replaced with silence once a loop is detected; 0 only
+	// reports it
+	MuteFor string `mapstructure:"mute_for"`
+}
+
+// SpeechEstimateConfig controls speech.estimate events, which predict how long the assistant's
+// answer plays from the length of its transcript and the session's measured speech rate, so
+// devices can reopen the microphone or show a countdown
+type SpeechEstimateConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Interval is how often estimates are sent while an answer streams
+	Interval string `mapstructure:"interval"`
+	// CharsPerSecond is the speech rate assumed until the session's first answer was measured
+	CharsPerSecond float64 `mapstructure:"chars_per_second"`
+}
+
+// AdminConfig controls the admin API, which lets operators inspect the relay's live sessions
+type AdminConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// APIKey authenticates requests to the admin API as a bearer token
+	APIKey string `mapstructure:"api_key"`
+	// HeatSessions is how many finished sessions the heat report covers, besides the active ones
+	HeatSessions int `mapstructure:"heat_sessions"`
+	// Listen lets supervisors listen to the live audio of sessions
+	Listen bool `mapstructure:"listen"`
+}
+
+// ReaperConfig controls the background job that force-closes orphaned sessions: sessions whose
+// device or provider went away without the session ending
+type ReaperConfig struct {
+	Enabled  bool   `mapstructure:"enabled"`
+	Interval string `mapstructure:"interval"`
+	// DeviceTimeout reaps sessions whose device has sent nothing, not even a pong, for longer
+	DeviceTimeout string `mapstructure:"device_timeout"`
+	// ProviderTimeout reaps sessions that have been without a provider connection for longer
+	ProviderTimeout string `mapstructure:"provider_timeout"`
+	// TeardownTimeout reaps sessions still registered this long after they started closing. A
+	// reaped session still registered after another TeardownTimeout is dropped.
+	TeardownTimeout string `mapstructure:"teardown_timeout"`
+}
+
+// ShutdownConfig controls how the relay drains its sessions when it is stopped, and where the
+// report of the drain goes besides the logs
+type ShutdownConfig struct {
+	// DrainTimeout is how long sessions get to finish the answer being played before they are
+	// force-closed
+	DrainTimeout string `mapstructure:"drain_timeout"`
+	// WebhookURL receives the shutdown report as JSON, for deploy tooling; empty only logs it
+	WebhookURL string `mapstructure:"webhook_url"`
+	// HealthFailDelay is how long the readiness check fails before connections are refused, so
+	// load balancers and service meshes stop routing to the relay first
+	HealthFailDelay string `mapstructure:"health_fail_delay"`
+}
+
+// TraceConfig captures the wire traffic of sessions into trace files, to debug protocol mismatches
+// with device firmware. Read them with cmd/pixatrace.
+type TraceConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Dir receives a <session id>.pxtrace file per traced session
+	Dir string `mapstructure:"dir"`
+	// Audio keeps the payloads of binary frames; without it only their sizes are captured
+	Audio bool `mapstructure:"audio"`
+	// Devices restricts tracing to these device IDs; empty traces every session
+	Devices []string `mapstructure:"devices"`
+}
+
+// RateLimitConfig limits the connections of devices and tenants. Limits are counted in fixed
+// windows; a limit of 0 is unlimited.
+type RateLimitConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Window is the period the connection limits apply to
+	Window string `mapstructure:"window"`
+	// DeviceConnections bounds the connections of a device per window
+	DeviceConnections int `mapstructure:"device_connections"`
+	// TenantConnections bounds the connections of all devices of a tenant per window
+	TenantConnections int `mapstructure:"tenant_connections"`
+	// QuotaWindow is the period the tenant session quota applies to
+	QuotaWindow string `mapstructure:"quota_window"`
+	// TenantSessions is the quota of sessions of a tenant per quota window
+	TenantSessions int `mapstructure:"tenant_sessions"`
+	// Redis shares the counters between replicas; without it each replica counts on its own
+	Redis RedisConfig `mapstructure:"redis"`
+}
+
+// RedisConfig locates a Redis server
+type RedisConfig struct {
+	// Addr is the host:port of the server; empty disables Redis
+	Addr     string `mapstructure:"addr"`
+	Password string `mapstructure:"password"`
+	DB       int    `mapstructure:"db"`
+	// KeyPrefix namespaces the keys, so relays of several deployments can share a server
+	KeyPrefix string `mapstructure:"key_prefix"`
+	// Timeout bounds every command
+	Timeout string `mapstructure:"timeout"`
+	// FailOpen lets connections through while Redis is unreachable, instead of rejecting them
+	FailOpen bool `mapstructure:"fail_open"`
+}
+
+// MemoryConfig bounds the memory each session holds in buffers. A budget of 0 means unlimited.
+type MemoryConfig struct {
+	// SessionBudgetBytes bounds all of a session's buffers together
+	SessionBudgetBytes int64 `mapstructure:"session_budget_bytes"`
+	// DownlinkBytes bounds the response audio waiting to be written to the device
+	DownlinkBytes int64 `mapstructure:"downlink_bytes"`
+	// OfflineBytes bounds the uplink audio buffered while the provider is unreachable
+	OfflineBytes int64 `mapstructure:"offline_bytes"`
+	// ShedPolicy is what happens when a buffer would go over budget: "drop_oldest" drops its
+	// oldest audio, "drop_newest" drops the new audio and "close" ends the session
+	ShedPolicy string `mapstructure:"shed_policy"`
+}
+
+// BandwidthConfig caps the bytes moved over the device link, for deployments on metered connections.
+// A cap of 0 means unlimited.
+type BandwidthConfig struct {
+	SessionCapBytes int64 `mapstructure:"session_cap_bytes"`
+	MonthlyCapBytes int64 `mapstructure:"monthly_cap_bytes"`
+	// WarningThreshold is the fraction of a cap at which the device is warned
+	WarningThreshold float64 `mapstructure:"warning_threshold"`
+	// DowngradeThreshold is the fraction of a cap at which downlink audio is downgraded to
+	// DowngradeSampleRate. 0 disables the downgrade.
+	DowngradeThreshold  float64 `mapstructure:"downgrade_threshold"`
+	DowngradeSampleRate int     `mapstructure:"downgrade_sample_rate"`
+}
+
+type AIConfig struct {
+	// Provider is the name of the registered AI provider used for new sessions
+	Provider             string `mapstructure:"provider"`
+	SystemPromptFilePath string `mapstructure:"system_prompt_filepath"`
+	// OutputAudioFormat is the format the model responds in: pcm16, g711_ulaw, g711_alaw, or auto
+	// to pick the one closest to the device's audio
+	OutputAudioFormat string `mapstructure:"output_audio_format"`
+	// Voice is the voice the model answers in, such as "alloy"; empty keeps the provider's default
+	Voice string `mapstructure:"voice"`
+	// InputTranscriptionModel transcribes the user's speech, e.g. "whisper-1". Empty disables it.
+	InputTranscriptionModel string `mapstructure:"input_transcription_model"`
+	// Transcription tunes the transcription of the user's speech
+	Transcription TranscriptionConfig `mapstructure:"transcription"`
+	// ConnectTimeout bounds dialing the provider and setting up the session
+	ConnectTimeout string `mapstructure:"connect_timeout"`
+	// AppendTimeout bounds sending a single audio chunk to the provider
+	AppendTimeout string `mapstructure:"append_timeout"`
+	// AppendAckWindow is how long an appended audio chunk can still be rejected by the provider.
+	// Chunks rejected with a transient error within it are sent again.
+	AppendAckWindow string `mapstructure:"append_ack_window"`
+	// ResponseTimeout bounds the wait for the provider to start responding once the user stops speaking
+	ResponseTimeout string `mapstructure:"response_timeout"`
+	// RefreshDrainTimeout bounds the wait for the answer being given to finish when a session is
+	// switched to another model or persona; the switch cuts it once it is over
+	RefreshDrainTimeout string `mapstructure:"refresh_drain_timeout"`
+	// Mock configures the "mock" provider, which answers without a model and is used by the soak test
+	Mock MockConfig `mapstructure:"mock"`
+	// Socket tunes the TCP connections to the provider
+	Socket SocketConfig `mapstructure:"socket"`
+	// Proxy routes the connections to the provider, for networks that only allow egress through one
+	Proxy ProxyConfig `mapstructure:"proxy"`
+}
+
+// ProxyConfig routes outgoing connections through an HTTP or SOCKS5 proxy
+type ProxyConfig struct {
+	// URL is the proxy, as http://host:port or socks5://host:port; empty connects directly
+	URL string `mapstructure:"url"`
+	// Username and Password authenticate with the proxy, instead of credentials in the URL
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// FromEnvironment uses the proxy of the HTTPS_PROXY, HTTP_PROXY and NO_PROXY variables when no
+	// URL is set
+	FromEnvironment bool `mapstructure:"from_environment"`
+}
+
+// Empty reports whether p sets no proxy
+func (p ProxyConfig) Empty() bool {
+	return p.URL == "" && !p.FromEnvironment
+}
+
+func (p ProxyConfig) validate(name string) error {
+	if p.URL == "" {
+		if p.Username != "" || p.Password != "" {
+			return fmt.Errorf("%s credentials require %s.url", name, name)
+		}
+		return nil
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid %s.url: %s", name, p.URL)
+	}
+	if u.Scheme != "http" && u.Scheme != "socks5" {
+		return fmt.Errorf("%s.url must be an http or socks5 URL", name)
+	}
+	return nil
+}
+
+// ProxyFor returns the proxy of a tenant's provider connections: the tenant's, or ai.proxy if the
+// tenant sets none
+func (c *Config) ProxyFor(tenantID string) ProxyConfig {
+	if tenant, ok := c.Tenants[strings.ToLower(tenantID)]; tenantID != "" && ok && !tenant.Proxy.Empty() {
+		return tenant.Proxy
+	}
+	return c.AIConfig.Proxy
+}
+
+// RegionConfig holds the endpoints and storage of a region. The sessions of tenants pinned to it
+// only reach these; a provider without an endpoint in the region is not available to them.
+type RegionConfig struct {
+	// Azure and OpenAI are the provider endpoints in the region. Empty keys, and the model,
+	// organization and project of openai, keep the global ones.
+	Azure  AzureConfig  `mapstructure:"azure"`
+	OpenAI OpenAIConfig `mapstructure:"openai"`
+	// TraceDir is where the traces of the region's sessions are written, instead of trace.dir
+	TraceDir string `mapstructure:"trace_dir"`
+}
+
+// RegionFor returns the region a tenant is pinned to, if any. The name is returned even when the
+// region is not configured, in which case ok is false, so that callers can refuse the tenant's
+// sessions rather than serve them outside of the region.
+func (c *Config) RegionFor(tenantID string) (string, RegionConfig, bool) {
+	tenant, ok := c.Tenants[strings.ToLower(tenantID)]
+	if tenantID == "" || !ok || tenant.Region == "" {
+		return "", RegionConfig{}, false
+	}
+	name := strings.ToLower(tenant.Region)
+	region, ok := c.Regions[name]
+	return name, region, ok
+}
+
+// ProviderConfigFor returns the config a tenant's provider clients are created with: c, or for
+// tenants pinned to a region a copy with the provider endpoints of the region. Endpoints the region
+// does not have are left empty, so that connecting fails rather than leaving the region.
+func (c *Config) ProviderConfigFor(tenantID string) *Config {
+	tenant, ok := c.Tenants[strings.ToLower(tenantID)]
+	if tenantID == "" || !ok || tenant.Region == "" {
+		return c
+	}
+	region := c.Regions[strings.ToLower(tenant.Region)]
+	pinned := *c
+	pinned.Azure.ServiceURL = region.Azure.ServiceURL
+	pinned.Azure.OpenAIKey = cmp.Or(region.Azure.OpenAIKey, c.Azure.OpenAIKey)
+	pinned.OpenAI = OpenAIConfig{
+		APIKey:       cmp.Or(region.OpenAI.APIKey, c.OpenAI.APIKey),
+		ServiceURL:   region.OpenAI.ServiceURL,
+		Model:        cmp.Or(region.OpenAI.Model, c.OpenAI.Model),
+		Organization: cmp.Or(region.OpenAI.Organization, c.OpenAI.Organization),
+		Project:      cmp.Or(region.OpenAI.Project, c.OpenAI.Project),
+	}
+	return &pinned
+}
+
+// TraceDirFor returns the directory the traces of a tenant's sessions are written to
+func (c *Config) TraceDirFor(tenantID string) string {
+	if name, region, _ := c.RegionFor(tenantID); name != "" {
+		return region.TraceDir
+	}
+	return c.Trace.Dir
+}
+
+// TranscriptionConfig tunes the transcription of the user's speech, so domain specific terms such as
+// menu items or product names are recognized reliably
+type TranscriptionConfig struct {
+	// Model overrides ai.input_transcription_model
+	Model string `mapstructure:"model"`
+	// Language is the ISO-639-1 code of the language spoken, e.g. "en"; empty detects it
+	Language string `mapstructure:"language"`
+	// Prompt guides the transcription, e.g. with the topic or style of the conversation
+	Prompt string `mapstructure:"prompt"`
+	// Phrases are terms the transcription should favour
+	Phrases []string `mapstructure:"phrases"`
+}
+
+// TranscriptionFor returns the transcription settings of a tenant's sessions: the tenant's
+// settings on top of the global ones
+func (c *Config) TranscriptionFor(tenantID string) TranscriptionConfig {
+	t := c.AIConfig.Transcription
+	if t.Model == "" {
+		t.Model = c.AIConfig.InputTranscriptionModel
+	}
+	t.Phrases = append([]string(nil), t.Phrases...)
+
+	tenant, ok := c.Tenants[strings.ToLower(tenantID)]
+	if tenantID == "" || !ok {
+		return t
+	}
+	o := tenant.Transcription
+	if o.Model != "" {
+		t.Model = o.Model
+	}
+	if o.Language != "" {
+		t.Language = o.Language
+	}
+	if o.Prompt != "" {
+		t.Prompt = o.Prompt
+	}
+	for _, p := range o.Phrases {
+		if !slices.Contains(t.Phrases, p) {
+			t.Phrases = append(t.Phrases, p)
+		}
+	}
+	return t
+}
+
+func (t TranscriptionConfig) validate(name string) error {
+	if t.Language != "" && (len(t.Language) != 2 || strings.Trim(t.Language, "abcdefghijklmnopqrstuvwxyz") != "") {
+		return fmt.Errorf("invalid %s.language: %s", name, t.Language)
+	}
+	for _, p := range t.Phrases {
+		if strings.TrimSpace(p) == "" {
+			return fmt.Errorf("%s.phrases must not be empty", name)
+		}
+	}
+	return nil
+}
+
+// EndpointingConfig tunes when the user's turn is taken to have ended. In a device profile, empty
+// durations and a zero threshold keep the global endpointing settings.
+type EndpointingConfig struct {
+	// SilenceDuration is how long the user must be silent for the turn to end; users who pause
+	// mid-sentence need it longer
+	SilenceDuration string `mapstructure:"silence_duration"`
+	// PrefixPadding is how much audio from before the speech was detected the turn includes
+	PrefixPadding string `mapstructure:"prefix_padding"`
+	// Threshold is the voice activity detection threshold, in (0, 1]; higher needs louder speech
+	Threshold float64 `mapstructure:"threshold"`
+	// MaxUtterance ends a turn the user has spoken for this long; 0 leaves turns unbounded
+	MaxUtterance string `mapstructure:"max_utterance"`
+}
+
+func (e EndpointingConfig) validate(name string) error {
+	for field, value := range map[string]string{
+		"silence_duration": e.SilenceDuration,
+		"prefix_padding":   e.PrefixPadding,
+		"max_utterance":    e.MaxUtterance,
+	} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			return fmt.Errorf("invalid %s.%s: %s", name, field, value)
+		}
+	}
+	if e.Threshold < 0 || e.Threshold > 1 {
+		return fmt.Errorf("%s.threshold must be in (0, 1]", name)
+	}
+	return nil
+}
+
+// CalibrationConfig controls the calibration of sessions to the noise around their device: the
+// ambient noise is measured at the start of the session, and sets the session's voice activity
+// threshold and how much its gain control may amplify the user
+type CalibrationConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Duration is how much audio at the start of the session is measured
+	Duration string `mapstructure:"duration"`
+	// MinThreshold and MaxThreshold are the voice activity thresholds of quiet and of loud
+	// surroundings; noise floors in between get thresholds in between
+	MinThreshold float64 `mapstructure:"min_threshold"`
+	MaxThreshold float64 `mapstructure:"max_threshold"`
+	// TargetLevel is the level, in dBFS, gain control brings the user's speech to
+	TargetLevel float64 `mapstructure:"target_level"`
+	// MaxGain bounds the gain applied to the user's speech; 1 only attenuates loud speakers
+	MaxGain float64 `mapstructure:"max_gain"`
+	// NoiseCeiling is the level, in dBFS, the gain may lift the ambient noise to
+	NoiseCeiling float64 `mapstructure:"noise_ceiling"`
+}
+
+// DenoiseConfig controls the suppression of the background noise in the audio from devices, such
+// as the machines of a factory floor or the fans of a kitchen, before the provider hears it
+type DenoiseConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MaxAttenuation is how much the built-in denoiser lowers the noise at most, in dB
+	MaxAttenuation float64 `mapstructure:"max_attenuation"`
+}
+
+// AGCConfig controls the automatic gain control of the audio from devices, which brings the level
+// of the user's speech to a target, so that cheap microphones that pick up the user quietly are
+// transcribed as well as loud ones
+type AGCConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// TargetLevel is the level, in dBFS, the user's speech is brought to
+	TargetLevel float64 `mapstructure:"target_level"`
+	// MaxGain bounds how much the user's speech is amplified, and attenuated by its inverse
+	MaxGain float64 `mapstructure:"max_gain"`
+	// Attack is how fast the gain comes down when the level rises, and Release how fast it comes
+	// back up when the level falls
+	Attack  string `mapstructure:"attack"`
+	Release string `mapstructure:"release"`
+	// Gate is the level, in dBFS, below which the gain holds, so pauses and noise are not amplified
+	Gate float64 `mapstructure:"gate"`
+}
+
+// AECConfig controls the acoustic echo cancellation of full duplex devices, whose microphone picks
+// up the response audio they play: the response audio is taken as the reference of an adaptive
+// filter that learns how it comes back, and what it predicts is subtracted from the uplink
+type AECConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Tail is how long the echo of a sound goes on in the room, the length of the filter
+	Tail string `mapstructure:"tail"`
+	// MaxDelay is how late the echo may come back after the relay expects the device to play the
+	// response audio
+	MaxDelay string `mapstructure:"max_delay"`
+}
+
+// JitterConfig controls the jitter buffer of device audio, which holds frames arriving in bursts,
+// as over a busy Wi-Fi, and forwards them to the provider at the pace they were captured
+type JitterConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Delay is how long frames are held, which is how late a frame may be without a gap
+	Delay string `mapstructure:"delay"`
+	// MaxDelay is the longest a frame is held, beyond which the buffer catches up, such as with a
+	// device clock running fast
+	MaxDelay string `mapstructure:"max_delay"`
+}
+
+// PLCConfig controls the concealment of audio frames lost by devices sending frame headers: the gap
+// of the frames missing in the sequence is filled with audio synthesized from the frames before
+// it, which the provider hears as a brief fade rather than a click
+type PLCConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Mode is repeat, which repeats the last pitch period heard, or hold, which holds the last
+	// sample; both fade out
+	Mode string `mapstructure:"mode"`
+	// Fade is how long the concealment takes to fade to silence
+	Fade string `mapstructure:"fade"`
+	// MaxDuration is the longest gap filled; the rest of longer gaps, outages rather than
+	// glitches, is left out
+	MaxDuration string `mapstructure:"max_duration"`
+}
+
+// AudioTestConfig controls the test tones devices ask for with audio.test to check their audio
+// path: the relay plays a tone or sweep to the device and, if asked, verifies the device's
+// microphone hears it back
+type AudioTestConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MaxDuration is the longest test tone played
+	MaxDuration string `mapstructure:"max_duration"`
+	// MaxDelay is the longest the tone may take to come back from the device, through its
+	// playback buffer, speaker, microphone and uplink
+	MaxDelay string `mapstructure:"max_delay"`
+	// MinMatch is the share of the tone that must be heard back for the test to pass
+	MinMatch float64 `mapstructure:"min_match"`
+}
+
+// EventsConfig controls the normalized stream of session events published to Kafka, or to the
+// producer of the embedding application
+type EventsConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Topics are where each kind of event is produced; kinds without a topic are not published
+	Topics EventTopics `mapstructure:"topics"`
+	// Queue is how many events are held for the producer before new ones are dropped
+	Queue int `mapstructure:"queue"`
+	// Timeout bounds producing one event
+	Timeout string `mapstructure:"timeout"`
+	// Kafka are the brokers events are produced to when no producer is passed
+	Kafka KafkaConfig `mapstructure:"kafka"`
+}
+
+// KafkaConfig locates the brokers of a Kafka cluster
+type KafkaConfig struct {
+	// Brokers are the host:port of the brokers the cluster is looked up from; empty disables Kafka
+	Brokers  []string `mapstructure:"brokers"`
+	ClientID string   `mapstructure:"client_id"`
+	// Acks is -1 for the messages to be acknowledged once all in-sync replicas have them, or 1
+	// once the leader has
+	Acks int `mapstructure:"acks"`
+}
+
+// EventTopics are the topics of the kinds of session events
+type EventTopics struct {
+	// State receives sessions starting and ending and the provider going offline and recovering
+	State string `mapstructure:"state"`
+	// Transcript receives the turns of the transcripts
+	Transcript string `mapstructure:"transcript"`
+	// QoS receives the quality of service of sessions as they end
+	QoS string `mapstructure:"qos"`
+}
+
+// AnnouncementsConfig controls the announcements operators schedule through the admin API: asset
+// clips played to groups of devices while their sessions are idle
+type AnnouncementsConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Interval is how often the sessions announcements are due in are checked
+	Interval string `mapstructure:"interval"`
+	// IdleFor is how long a session must have been idle, with neither the user nor the assistant
+	// speaking, before an announcement is played to it
+	IdleFor string `mapstructure:"idle_for"`
+	// MaxConcurrent is the most announcements played at a time across the relay
+	MaxConcurrent int `mapstructure:"max_concurrent"`
+	// Retention is how long announcements are kept after their window ends
+	Retention string `mapstructure:"retention"`
+}
+
+// SpeakerVerificationConfig checks that the user of a session is the speaker it is for, such as
+// the account holder whose voice print was enrolled, from the first of their speech
+type SpeakerVerificationConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Sample is how much of the user's speech is sent to the verifier, once per session
+	Sample string `mapstructure:"sample"`
+	// Timeout bounds the verification; the speaker stays unverified once it is over
+	Timeout string `mapstructure:"timeout"`
+	// MinScore is how closely the voice must match for the speaker to be verified
+	MinScore float64 `mapstructure:"min_score"`
+	// ProtectedTools are refused to the model until the speaker is verified
+	ProtectedTools []string `mapstructure:"protected_tools"`
+	// Model and Instructions make up the provider profile sessions switch to once their speaker is
+	// verified, such as a persona handling the account; empty fields keep the session's own
+	Model        string `mapstructure:"model"`
+	Instructions string `mapstructure:"instructions"`
+}
+
+// ProviderLogConfig logs the raw frames sessions exchange with their provider, with audio elided,
+// to a log of their own, for debugging changes to the provider's schema without logging every
+// session
+type ProviderLogConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Sample is the fraction of sessions logged, between 0 and 1
+	Sample float64 `mapstructure:"sample"`
+	// SessionIDs are logged whatever the sample
+	SessionIDs []string `mapstructure:"session_ids"`
+	// Path is the file the frames are appended to as JSON lines; empty writes them to stderr
+	Path string `mapstructure:"path"`
+}
+
+// DeviceHelloConfig lets devices that cannot set headers or query parameters declare the audio
+// they send and take in a device.hello message, their first after they connect
+type DeviceHelloConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Timeout is how long the relay waits for the first message before it sets sessions up from
+	// their upgrade request
+	Timeout string `mapstructure:"timeout"`
+}
+
+// DevicesConfig keeps when each device was first and last seen and its latest sessions, so fleet
+// operators can spot devices that stopped connecting
+type DevicesConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// History is how many of its latest sessions are kept per device
+	History int `mapstructure:"history"`
+	// File is where the devices are saved to and loaded from, to keep them across restarts; empty
+	// keeps them in memory only
+	File string `mapstructure:"file"`
+	// SaveInterval is how often the devices are saved to File, besides when the server closes
+	SaveInterval string `mapstructure:"save_interval"`
+}
+
+// VADGateConfig gates the audio of always-listening devices with the relay's own voice activity
+// detection: audio is only sent to the provider while the user speaks, and for the silence after
+// that the provider needs to end the turn, which saves the upstream bandwidth and the input tokens of
+// the audio in between. Push-to-talk devices are gated by their button instead.
+type VADGateConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Threshold is how far above the noise floor audio must be to be taken as speech, in dB
+	Threshold float64 `mapstructure:"threshold"`
+	// MinLevel is the level below which audio is never taken as speech, in dBFS
+	MinLevel float64 `mapstructure:"min_level"`
+	// PreRoll is how much of the audio before speech is detected is sent along with it, so the
+	// start of the first word is not clipped
+	PreRoll string `mapstructure:"pre_roll"`
+	// Hangover is how long audio is still sent after speech was last detected. Empty takes the
+	// silence_duration of the device's endpointing, plus a margin, so the provider ends the turn.
+	Hangover string `mapstructure:"hangover"`
+}
+
+// PipelineSchedulerConfig bounds how many frames of device audio go through the pipeline at once.
+// When the relay runs out of CPU, frames wait for a slot, and the slot goes to the session that used
+// the pipeline least in the current second, so a session sending more audio than its share, such as
+// one catching up on a backlog, cannot starve the others.
+type PipelineSchedulerConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Slots is how many frames are processed at once; 0 takes the number of CPUs
+	Slots int `mapstructure:"slots"`
+	// StarvedAfter is how long a frame may wait for a slot before it is counted as starved
+	StarvedAfter string `mapstructure:"starved_after"`
+}
+
+// VoiceGainConfig normalizes the loudness of the answers of the provider, whose voices come back
+// at noticeably different levels, so switching a session to another persona does not blast or
+// whisper at the user. Each voice gets a gain of its own, from the table of gains or measured from
+// its answers, applied before the audio is sent on to the device.
+type VoiceGainConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// TargetLevel is the level, in dBFS, measured voices are brought to
+	TargetLevel float64 `mapstructure:"target_level"`
+	// MaxGain bounds how much a measured voice is amplified or attenuated, in dB
+	MaxGain float64 `mapstructure:"max_gain"`
+	// Measure measures the level of the voices that have no gain in Gains from their answers
+	Measure bool `mapstructure:"measure"`
+	// Gains are the gains of voices, in dB, keyed by voice name; "default" is the voice of
+	// sessions that ask for none. Keys are lower cased when read from the config file.
+	Gains map[string]float64 `mapstructure:"gains"`
+}
+
+// SpeakerConfig controls the classification of coarse attributes of the user's voice, such as
+// their age group, by the speaker classifier hook, and the policies applied to them
+type SpeakerConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Sample is how much of the user's speech is sent to the classifier, once per session
+	Sample string `mapstructure:"sample"`
+	// Timeout bounds the classification; the session goes on unclassified once it is over
+	Timeout string `mapstructure:"timeout"`
+	// MinConfidence is how sure the classifier must be for a policy to apply
+	MinConfidence float64 `mapstructure:"min_confidence"`
+	// Policies apply to the speakers of an age group: child, teen or adult
+	Policies map[string]SpeakerPolicy `mapstructure:"policies"`
+}
+
+// ConnectConfig controls GET /connect/info, which devices call before the websocket upgrade to
+// learn the URL to connect to, the protocol version and audio formats the relay serves, and a
+// connect token. Discovery can then be served apart from the relays handling media.
+type ConnectConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// URL is the websocket URL devices are sent to, e.g. wss://media.example.com/; by default it is
+	// the URL the request came to. With signed URLs enabled, devices get a signed auth.signed_urls.base_url.
+	URL string `mapstructure:"url"`
+	// TokenTTL is how long the connect token is valid, capped at auth.signed_urls.max_ttl
+	TokenTTL string `mapstructure:"token_ttl"`
+}
+
+// SpeakerPolicy is what is done in sessions whose speaker was classified into an age group
+type SpeakerPolicy struct {
+	// Action is log, restrict the session to Model and Instructions, or end it
+	Action string `mapstructure:"action"`
+	// Model and Instructions make up the provider profile a restricted session is switched to;
+	// empty fields keep the session's own
+	Model        string `mapstructure:"model"`
+	Instructions string `mapstructure:"instructions"`
+}
+
+// DeviceProfile holds the settings of a kind of device or group of users, such as the kiosks of a
+// clinic whose users speak slowly. Devices choose their profile with the X-Pixa-Device-Profile
+// header, or get the one of their tenant.
+type DeviceProfile struct {
+	Endpointing EndpointingConfig `mapstructure:"endpointing"`
+	// Denoise, AGC and AEC turn noise suppression, gain control and echo cancellation on or off
+	// for the profile's devices; unset keeps denoise.enabled, agc.enabled and aec.enabled
+	Denoise *bool `mapstructure:"denoise"`
+	AGC     *bool `mapstructure:"agc"`
+	AEC     *bool `mapstructure:"aec"`
+}
+
+// DeviceProfileFor returns the name of the profile of a device of a tenant that asked for
+// requested: requested if it is a configured profile, otherwise the tenant's. It is empty for
+// devices with no profile.
+func (c *Config) DeviceProfileFor(tenantID, requested string) string {
+	if requested = strings.ToLower(requested); requested != "" {
+		if _, ok := c.DeviceProfiles[requested]; ok {
+			return requested
+		}
+	}
+	if tenant, ok := c.Tenants[strings.ToLower(tenantID)]; tenantID != "" && ok {
+		return strings.ToLower(tenant.DeviceProfile)
+	}
+	return ""
+}
+
+// DenoiseFor reports whether the audio of devices of a profile is denoised
+func (c *Config) DenoiseFor(profile string) bool {
+	if p, ok := c.DeviceProfiles[strings.ToLower(profile)]; profile != "" && ok && p.Denoise != nil {
+		return *p.Denoise
+	}
+	return c.Denoise.Enabled
+}
+
+// AGCFor reports whether the audio of devices of a profile goes through gain control
+func (c *Config) AGCFor(profile string) bool {
+	if p, ok := c.DeviceProfiles[strings.ToLower(profile)]; profile != "" && ok && p.AGC != nil {
+		return *p.AGC
+	}
+	return c.AGC.Enabled
+}
+
+// AECFor reports whether the echo in the audio of devices of a profile is cancelled
+func (c *Config) AECFor(profile string) bool {
+	if p, ok := c.DeviceProfiles[strings.ToLower(profile)]; profile != "" && ok && p.AEC != nil {
+		return *p.AEC
+	}
+	return c.AEC.Enabled
+}
+
+// EndpointingFor returns the endpointing settings of a device profile: the profile's settings on
+// top of the global ones
+func (c *Config) EndpointingFor(profile string) EndpointingConfig {
+	e := c.Endpointing
+	p, ok := c.DeviceProfiles[strings.ToLower(profile)]
+	if profile == "" || !ok {
+		return e
+	}
+	o := p.Endpointing
+	if o.SilenceDuration != "" {
+		e.SilenceDuration = o.SilenceDuration
+	}
+	if o.PrefixPadding != "" {
+		e.PrefixPadding = o.PrefixPadding
+	}
+	if o.Threshold != 0 {
+		e.Threshold = o.Threshold
+	}
+	if o.MaxUtterance != "" {
+		e.MaxUtterance = o.MaxUtterance
+	}
+	return e
+}
+
+// MockConfig shapes the synthetic conversation of the mock provider
+type MockConfig struct {
+	// TurnAfter is how much uplink audio makes up one user turn
+	TurnAfter string `mapstructure:"turn_after"`
+	// ResponseLength is the length of the audio response to each turn
+	ResponseLength string `mapstructure:"response_length"`
+}
+
+type ServerConfig struct {
+	Port      int    `mapstructure:"port"`
+	CertFile  string `mapstructure:"cert_file"`
+	KeyFile   string `mapstructure:"key_file"`
+	EnableTLS bool   `mapstructure:"enable_tls"`
+	// Environment is what the relay is deployed as: "development", "test", "staging" or "production"
+	Environment string `mapstructure:"environment"`
+	// ClientAuth authenticates devices by their client certificate (mutual TLS)
+	ClientAuth ClientAuthConfig `mapstructure:"client_auth"`
+	// Socket tunes the TCP connections of devices
+	Socket SocketConfig `mapstructure:"socket"`
+}
+
+// SocketConfig tunes TCP connections, e.g. to keep cellular NAT mappings of idle devices alive
+type SocketConfig struct {
+	// KeepAlive enables TCP keepalive probes
+	KeepAlive bool `mapstructure:"keepalive"`
+	// KeepAliveIdle is how long a connection is idle before the first probe
+	KeepAliveIdle string `mapstructure:"keepalive_idle"`
+	// KeepAliveInterval is the time between unanswered probes
+	KeepAliveInterval string `mapstructure:"keepalive_interval"`
+	// KeepAliveCount is how many unanswered probes drop the connection
+	KeepAliveCount int `mapstructure:"keepalive_count"`
+	// ReadBufferBytes and WriteBufferBytes size the kernel socket buffers; 0 keeps the OS default
+	ReadBufferBytes  int `mapstructure:"read_buffer_bytes"`
+	WriteBufferBytes int `mapstructure:"write_buffer_bytes"`
+	// NoDelay disables Nagle's algorithm, sending small audio frames without waiting to batch them
+	NoDelay bool `mapstructure:"no_delay"`
+}
+
+func (s SocketConfig) validate(name string) error {
+	if s.KeepAlive {
+		for option, value := range map[string]string{
+			"keepalive_idle":     s.KeepAliveIdle,
+			"keepalive_interval": s.KeepAliveInterval,
+		} {
+			if d, err := time.ParseDuration(value); err != nil || d < time.Second {
+				return fmt.Errorf("invalid %s.%s: %s, must be at least 1s", name, option, value)
+			}
+		}
+		if s.KeepAliveCount < 1 {
+			return fmt.Errorf("%s.keepalive_count must be positive", name)
+		}
+	}
+	if s.ReadBufferBytes < 0 || s.WriteBufferBytes < 0 {
+		return fmt.Errorf("%s buffer sizes must not be negative", name)
+	}
+	return nil
+}
+
+// ClientAuthConfig maps device client certificates to device identities
+type ClientAuthConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// CAFile holds the PEM certificates device certificates must be issued by
+	CAFile string `mapstructure:"ca_file"`
+	// CRLFile is an optional PEM or DER revocation list issued by one of the CAs
+	CRLFile string `mapstructure:"crl_file"`
+	// Required rejects devices without a certificate; otherwise they can authenticate another way
+	Required bool `mapstructure:"required"`
+	// IdentityFrom is the certificate field the device ID is taken from: "cn" or "san"
+	IdentityFrom string `mapstructure:"identity_from"`
+	// AllowedDevices, when set, restricts connections to these device IDs
+	AllowedDevices []string `mapstructure:"allowed_devices"`
+}
+
+type WebsocketConfig struct {
+	PingInterval    string `mapstructure:"ping_interval"`
+	PongWait        string `mapstructure:"pong_wait"`
+	WriteWait       string `mapstructure:"write_wait"`
+	MaxMessageQueue int    `mapstructure:"max_message_queue"`
+	// FrameChecksum expects every binary frame from the device to start with a CRC32 of the rest
+	// of the frame. Frames that do not match are dropped and counted as corrupted.
+	FrameChecksum bool `mapstructure:"frame_checksum"`
+	// FrameReorder is how many frames from devices sending frame headers are held back waiting for
+	// a frame missing before them, for devices whose frames may arrive out of order. With 0 a gap
+	// is given up on at once.
+	FrameReorder int `mapstructure:"frame_reorder"`
+	// SessionIDs is the format of session IDs: hex (32 random hex digits), ulid or uuidv7, the
+	// latter two sorting by start time
+	SessionIDs string `mapstructure:"session_ids"`
+	// Duplex is the mode of devices that do not report one: full lets the user talk over the
+	// assistant, half mutes the device while the assistant speaks and for HalfDuplexTail after
+	Duplex         string `mapstructure:"duplex"`
+	HalfDuplexTail string `mapstructure:"half_duplex_tail"`
+	// AllowedOrigins are the browser origins allowed to connect: hosts such as app.example.com or
+	// origins such as https://app.example.com, with * wildcards as in *.example.com. Empty allows
+	// every origin; devices, which send no Origin header, are always allowed.
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+	// StrictOrigins rejects origins that are not allowed with 403; otherwise they are only logged
+	StrictOrigins bool `mapstructure:"strict_origins"`
+}
+
+type AudioFormat string
+
+const (
+	PCM16 AudioFormat = "pcm_16"
+	WAV   AudioFormat = "wav"
+	MP3   AudioFormat = "mp3"
+)
+
+// this is the configuration of the audio the hardware will be sending
+// this is also the configuration of the audio the harware expects to receive
+type AudioConfig struct {
+	SampleRate  int         `mapstructure:"sample_rate"`
+	Channels    int         `mapstructure:"channels"`
+	AudioFormat AudioFormat `mapstructure:"format"`
+	// Downmix is how devices sending more channels than audio.channels are mixed down: "average",
+	// "left", "right" or the 0-based channel to take
+	Downmix string `mapstructure:"downmix"`
+}
+
+type AzureConfig struct {
+	OpenAIKey  string `mapstructure:"openai_key"`
+	ServiceURL string `mapstructure:"service_url"`
+}
+
+// OpenAIConfig configures the "openai" provider, which connects to the realtime API of OpenAI
+// itself instead of an Azure deployment
+type OpenAIConfig struct {
+	APIKey string `mapstructure:"api_key"`
+	// ServiceURL is the realtime endpoint, and Model the model asked for
+	ServiceURL string `mapstructure:"service_url"`
+	Model      string `mapstructure:"model"`
+	// Organization and Project bill the usage to an organization and project of the account, if set
+	Organization string `mapstructure:"organization"`
+	Project      string `mapstructure:"project"`
+}
+
+// LoadConfig loads configuration from file and environment variables
+func LoadConfig() (*Config, error) {
+	v := viper.New()
+	setDefaults(v)
+
+	// Config file support
+	v.SetConfigName("config")
+	v.SetConfigType("yaml")
+	v.AddConfigPath(".")
+	v.AddConfigPath("./config")
+	v.AddConfigPath("/etc/pixa/")
+
+	// Environment variables support
+	v.SetEnvPrefix("PIXA")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
+	// Check for Azure OpenAI environment variables
+	if azureKey := os.Getenv("AZURE_OPENAI_KEY"); azureKey != "" {
+		v.Set("azure.openai_key", azureKey)
+	}
+	if azureURL := os.Getenv("AZURE_OPENAI_URL"); azureURL != "" {
+		v.Set("azure.service_url", azureURL)
+	}
+	if openAIKey := os.Getenv("OPENAI_API_KEY"); openAIKey != "" {
+		v.Set("openai.api_key", openAIKey)
+	}
+
+	// Read config file
+	if err := v.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+	}
+
+	var config Config
+	if err := v.Unmarshal(&config); err != nil {
+		return nil, fmt.Errorf("error unmarshaling config: %w", err)
+	}
+
+	// Validate required configurations
+	if config.AIConfig.Provider == "azure" {
+		if config.Azure.OpenAIKey == "" {
+			return nil, fmt.Errorf("AZURE_OPENAI_KEY environment variable is required")
+		}
+		if config.Azure.ServiceURL == "" {
+			return nil, fmt.Errorf("AZURE_OPENAI_URL environment variable or azure.service_url config is required")
+		}
+	}
+	if config.AIConfig.Provider == "openai" && config.OpenAI.APIKey == "" {
+		return nil, fmt.Errorf("OPENAI_API_KEY environment variable is required")
+	}
+
+	return &config, nil
+}
+
+// Default returns the configuration with every setting at its default, without reading a config
+// file or the environment
+func Default() *Config {
+	v := viper.New()
+	setDefaults(v)
+	var cfg Config
+	// the defaults are all of the types of their fields
+	_ = v.Unmarshal(&cfg)
+	return &cfg
+}
+
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("server.port", 8080)
+	v.SetDefault("server.enable_tls", false)
+	v.SetDefault("server.cert_file", "")
+	v.SetDefault("server.key_file", "")
+	v.SetDefault("server.environment", "production")
+	v.SetDefault("server.client_auth.enabled", false)
+	v.SetDefault("server.client_auth.required", true)
+	v.SetDefault("server.client_auth.identity_from", "cn")
+	v.SetDefault("encryption.enabled", false)
+	v.SetDefault("encryption.required", false)
+	v.SetDefault("auth.signed_urls.enabled", false)
+	v.SetDefault("auth.signed_urls.secret", "")
+	v.SetDefault("auth.signed_urls.api_key", "")
+	v.SetDefault("auth.signed_urls.base_url", "")
+	v.SetDefault("auth.signed_urls.default_ttl", "1m")
+	v.SetDefault("auth.signed_urls.max_ttl", "5m")
+	v.SetDefault("auth.signed_urls.required", true)
+	v.SetDefault("auth.api_keys.enabled", false)
+	v.SetDefault("auth.api_keys.header", "X-Pixa-Api-Key")
+	v.SetDefault("auth.api_keys.store", "memory")
+	v.SetDefault("auth.api_keys.file", "")
+	v.SetDefault("auth.api_keys.redis.addr", "")
+	v.SetDefault("auth.api_keys.redis.password", "")
+	v.SetDefault("auth.api_keys.redis.db", 0)
+	v.SetDefault("auth.api_keys.redis.key_prefix", "pixa:apikey:")
+	v.SetDefault("auth.api_keys.redis.timeout", "200ms")
+	v.SetDefault("auth.api_keys.required", true)
+	v.SetDefault("auth.jwt.enabled", false)
+	v.SetDefault("auth.jwt.issuer", "")
+	v.SetDefault("auth.jwt.audience", "")
+	v.SetDefault("auth.jwt.jwks_url", "")
+	v.SetDefault("auth.jwt.jwks_refresh", "1h")
+	v.SetDefault("auth.jwt.leeway", "30s")
+	v.SetDefault("auth.jwt.device_claim", "sub")
+	v.SetDefault("auth.jwt.tenant_claim", "tenant_id")
+	v.SetDefault("auth.jwt.required", true)
+	v.SetDefault("assets.dir", "")
+	v.SetDefault("filler.enabled", false)
+	v.SetDefault("filler.asset", "thinking.wav")
+	v.SetDefault("filler.delay", "400ms")
+	v.SetDefault("filler.max_duration", "10s")
+	v.SetDefault("faq.enabled", false)
+	v.SetDefault("faq.ttl", "24h")
+	v.SetDefault("faq.max_entries", 1000)
+	v.SetDefault("faq.min_similarity", 0.8)
+	v.SetDefault("faq.max_answer", "30s")
+	v.SetDefault("tags.metric_labels", []string{})
+	v.SetDefault("tags.max_label_values", 20)
+	v.SetDefault("versions.min_protocol", 1)
+	v.SetDefault("versions.min_firmware", "")
+	v.SetDefault("versions.recommended_firmware", "")
+	v.SetDefault("versions.enforce", false)
+	v.SetDefault("chaos.enabled", false)
+	v.SetDefault("chaos.drop_events", 0.0)
+	v.SetDefault("chaos.delay_frames", 0.0)
+	v.SetDefault("chaos.frame_delay", "200ms")
+	v.SetDefault("chaos.corrupt_frames", 0.0)
+	v.SetDefault("chaos.provider_disconnects", 0.0)
+	v.SetDefault("chaos.device_disconnects", 0.0)
+	v.SetDefault("chaos.disconnect_within", "60s")
+	v.SetDefault("echo.enabled", false)
+	v.SetDefault("echo.threshold", 0.8)
+	v.SetDefault("echo.window", "3s")
+	v.SetDefault("echo.max_delay", "1s")
+	v.SetDefault("echo.mute_for", "2s")
+	v.SetDefault("speech_estimate.enabled", false)
+	v.SetDefault("speech_estimate.interval", "500ms")
+	v.SetDefault("speech_estimate.chars_per_second", 15)
+	v.SetDefault("endpointing.silence_duration", "500ms")
+	v.SetDefault("endpointing.prefix_padding", "300ms")
+	v.SetDefault("endpointing.threshold", 0.5)
+	v.SetDefault("endpointing.max_utterance", "0s")
+	v.SetDefault("calibration.enabled", false)
+	v.SetDefault("calibration.duration", "2s")
+	v.SetDefault("calibration.min_threshold", 0.4)
+	v.SetDefault("calibration.max_threshold", 0.8)
+	v.SetDefault("calibration.target_level", -20)
+	v.SetDefault("calibration.max_gain", 4)
+	v.SetDefault("calibration.noise_ceiling", -50)
+	v.SetDefault("denoise.enabled", false)
+	v.SetDefault("denoise.max_attenuation", 20)
+	v.SetDefault("agc.enabled", false)
+	v.SetDefault("agc.target_level", -20)
+	v.SetDefault("agc.max_gain", 8)
+	v.SetDefault("agc.attack", "10ms")
+	v.SetDefault("agc.release", "1s")
+	v.SetDefault("agc.gate", -50)
+	v.SetDefault("aec.enabled", false)
+	v.SetDefault("aec.tail", "64ms")
+	v.SetDefault("aec.max_delay", "500ms")
+	v.SetDefault("jitter.enabled", false)
+	v.SetDefault("jitter.delay", "60ms")
+	v.SetDefault("jitter.max_delay", "300ms")
+	v.SetDefault("plc.enabled", false)
+	v.SetDefault("plc.mode", "repeat")
+	v.SetDefault("plc.fade", "60ms")
+	v.SetDefault("plc.max_duration", "200ms")
+	v.SetDefault("audio_test.enabled", false)
+	v.SetDefault("audio_test.max_duration", "10s")
+	v.SetDefault("audio_test.max_delay", "1s")
+	v.SetDefault("audio_test.min_match", 0.8)
+	v.SetDefault("events.enabled", false)
+	v.SetDefault("events.topics.state", "pixa.sessions")
+	v.SetDefault("events.topics.transcript", "pixa.transcripts")
+	v.SetDefault("events.topics.qos", "pixa.qos")
+	v.SetDefault("events.queue", 10000)
+	v.SetDefault("events.timeout", "5s")
+	v.SetDefault("events.kafka.brokers", []string{})
+	v.SetDefault("events.kafka.client_id", "pixa-relay")
+	v.SetDefault("events.kafka.acks", -1)
+	v.SetDefault("announcements.enabled", false)
+	v.SetDefault("announcements.interval", "1s")
+	v.SetDefault("announcements.idle_for", "5s")
+	v.SetDefault("announcements.max_concurrent", 100)
+	v.SetDefault("announcements.retention", "24h")
+	v.SetDefault("speaker_verification.enabled", false)
+	v.SetDefault("speaker_verification.sample", "3s")
+	v.SetDefault("speaker_verification.timeout", "3s")
+	v.SetDefault("speaker_verification.min_score", 0.8)
+	v.SetDefault("provider_log.enabled", false)
+	v.SetDefault("provider_log.sample", 0.0)
+	v.SetDefault("device_hello.enabled", false)
+	v.SetDefault("device_hello.timeout", "1s")
+	v.SetDefault("devices.enabled", false)
+	v.SetDefault("devices.history", 20)
+	v.SetDefault("devices.save_interval", "1m")
+	v.SetDefault("vad_gate.enabled", false)
+	v.SetDefault("vad_gate.threshold", 10)
+	v.SetDefault("vad_gate.min_level", -50)
+	v.SetDefault("vad_gate.pre_roll", "300ms")
+	v.SetDefault("pipeline_scheduler.enabled", false)
+	v.SetDefault("pipeline_scheduler.slots", 0)
+	v.SetDefault("pipeline_scheduler.starved_after", "100ms")
+	v.SetDefault("voice_gain.enabled", false)
+	v.SetDefault("voice_gain.target_level", -20)
+	v.SetDefault("voice_gain.max_gain", 12)
+	v.SetDefault("voice_gain.measure", true)
+	v.SetDefault("speaker.enabled", false)
+	v.SetDefault("speaker.sample", "3s")
+	v.SetDefault("speaker.timeout", "2s")
+	v.SetDefault("speaker.min_confidence", 0.7)
+	v.SetDefault("connect.enabled", false)
+	v.SetDefault("connect.token_ttl", "60s")
+	v.SetDefault("tools.timeout", "30s")
+	v.SetDefault("translation.timeout", "2s")
+	v.SetDefault("turn_processors.timeout", "5s")
+	v.SetDefault("turn_processors.queue", 16)
+	v.SetDefault("ptt.pre_buffer", "1s")
+	v.SetDefault("ptt.end_silence", "600ms")
+	v.SetDefault("tools.slow_after", "1s")
+	v.SetDefault("tools.slow_instructions", "You are looking something up for the user and it takes a moment. Tell them so in one short sentence, like \"Let me check that\", without answering yet.")
+	v.SetDefault("admin.enabled", false)
+	v.SetDefault("admin.api_key", "")
+	v.SetDefault("admin.heat_sessions", 200)
+	v.SetDefault("admin.listen", false)
+	v.SetDefault("websocket.ping_interval", "30s")
+	v.SetDefault("websocket.pong_wait", "60s")
+	v.SetDefault("websocket.write_wait", "10s")
+	v.SetDefault("websocket.max_message_queue", 256)
+	v.SetDefault("websocket.frame_checksum", false)
+	v.SetDefault("websocket.frame_reorder", 0)
+	v.SetDefault("websocket.session_ids", "hex")
+	v.SetDefault("websocket.duplex", "full")
+	v.SetDefault("websocket.half_duplex_tail", "300ms")
+	v.SetDefault("websocket.allowed_origins", []string{})
+	v.SetDefault("websocket.strict_origins", false)
+	v.SetDefault("audio.sample_rate", 16000)
+	v.SetDefault("audio.channels", 2)
+	v.SetDefault("audio.format", "pcm_16")
+	v.SetDefault("audio.downmix", "average")
+	v.SetDefault("bandwidth.session_cap_bytes", 0)
+	v.SetDefault("bandwidth.monthly_cap_bytes", 0)
+	v.SetDefault("bandwidth.warning_threshold", 0.8)
+	v.SetDefault("bandwidth.downgrade_threshold", 0)
+	v.SetDefault("bandwidth.downgrade_sample_rate", 8000)
+	v.SetDefault("offline.enabled", false)
+	v.SetDefault("offline.max_buffer", "30s")
+	v.SetDefault("offline.on_recovery", "discard")
+	v.SetDefault("offline.retry_interval", "2s")
+	v.SetDefault("offline.max_outage", "2m")
+	v.SetDefault("provider_queue.enabled", false)
+	v.SetDefault("provider_queue.max_sessions", 100)
+	v.SetDefault("provider_queue.max_waiting", 1000)
+	v.SetDefault("provider_queue.max_wait", "2m")
+	v.SetDefault("provider_queue.hold_asset", "")
+	v.SetDefault("reaper.enabled", true)
+	v.SetDefault("reaper.interval", "30s")
+	v.SetDefault("reaper.device_timeout", "3m")
+	v.SetDefault("reaper.provider_timeout", "5m")
+	v.SetDefault("reaper.teardown_timeout", "30s")
+	v.SetDefault("shutdown.drain_timeout", "30s")
+	v.SetDefault("trace.enabled", false)
+	v.SetDefault("trace.dir", "traces")
+	v.SetDefault("trace.audio", false)
+	v.SetDefault("rate_limit.enabled", false)
+	v.SetDefault("rate_limit.window", "1m")
+	v.SetDefault("rate_limit.device_connections", 10)
+	v.SetDefault("rate_limit.tenant_connections", 0)
+	v.SetDefault("rate_limit.quota_window", "24h")
+	v.SetDefault("rate_limit.tenant_sessions", 0)
+	v.SetDefault("rate_limit.redis.addr", "")
+	v.SetDefault("rate_limit.redis.password", "")
+	v.SetDefault("rate_limit.redis.db", 0)
+	v.SetDefault("rate_limit.redis.key_prefix", "pixa:ratelimit:")
+	v.SetDefault("rate_limit.redis.timeout", "200ms")
+	v.SetDefault("rate_limit.redis.fail_open", true)
+	v.SetDefault("shutdown.webhook_url", "")
+	v.SetDefault("shutdown.health_fail_delay", "0s")
+	v.SetDefault("memory.session_budget_bytes", 16<<20)
+	v.SetDefault("memory.downlink_bytes", 1<<20)
+	v.SetDefault("memory.offline_bytes", 8<<20)
+	v.SetDefault("memory.shed_policy", "drop_oldest")
+	v.SetDefault("transcripts.enabled", false)
+	v.SetDefault("transcripts.max_sessions", 10000)
+	v.SetDefault("retranscribe.enabled", false)
+	v.SetDefault("retranscribe.provider", "")
+	v.SetDefault("retranscribe.concurrency", 2)
+	v.SetDefault("retranscribe.idle_timeout", "10s")
+	v.SetDefault("analytics.enabled", false)
+	v.SetDefault("analytics.min_cohort", 10)
+	v.SetDefault("analytics.duration_buckets", []string{"30s", "1m", "2m", "5m", "10m", "30m"})
+	v.SetDefault("analytics.epsilon", 0)
+	v.SetDefault("analytics.retention", "2160h")
+	v.SetDefault("digest.enabled", false)
+	v.SetDefault("digest.send_at", "06:00")
+	v.SetDefault("digest.top_intents", 5)
+	v.SetDefault("ai.provider", "azure")
+	v.SetDefault("openai.service_url", "wss://api.openai.com/v1/realtime")
+	v.SetDefault("openai.model", "gpt-4o-realtime-preview")
+	v.SetDefault("ai.output_audio_format", "auto")
+	v.SetDefault("ai.voice", "")
+	v.SetDefault("ai.connect_timeout", "10s")
+	v.SetDefault("ai.append_timeout", "5s")
+	v.SetDefault("ai.append_ack_window", "2s")
+	v.SetDefault("ai.response_timeout", "30s")
+	v.SetDefault("ai.refresh_drain_timeout", "30s")
+	v.SetDefault("ai.mock.turn_after", "3s")
+	v.SetDefault("ai.mock.response_length", "2s")
+	for _, prefix := range []string{"server.socket", "ai.socket"} {
+		v.SetDefault(prefix+".keepalive", true)
+		v.SetDefault(prefix+".keepalive_idle", "15s")
+		v.SetDefault(prefix+".keepalive_interval", "15s")
+		v.SetDefault(prefix+".keepalive_count", 9)
+		v.SetDefault(prefix+".read_buffer_bytes", 0)
+		v.SetDefault(prefix+".write_buffer_bytes", 0)
+		v.SetDefault(prefix+".no_delay", true)
+	}
+	v.SetDefault("ai.proxy.url", "")
+	v.SetDefault("ai.proxy.username", "")
+	v.SetDefault("ai.proxy.password", "")
+	v.SetDefault("ai.proxy.from_environment", false)
+}
+
+// ValidateConfig validates the configuration values
+func ValidateConfig(cfg *Config) error {
+	if cfg.Server.Port < 1 || cfg.Server.Port > 65535 {
+		return fmt.Errorf("invalid port number: %d", cfg.Server.Port)
+	}
+	switch cfg.Server.Environment {
+	case "development", "test", "staging", "production":
+	default:
+		return fmt.Errorf("invalid server.environment: %s", cfg.Server.Environment)
+	}
+
+	if cfg.Server.EnableTLS {
+		if cfg.Server.CertFile == "" {
+			return fmt.Errorf("TLS enabled but cert_file is not specified")
+		}
+		if cfg.Server.KeyFile == "" {
+			return fmt.Errorf("TLS enabled but key_file is not specified")
+		}
+	}
+
+	if ca := cfg.Server.ClientAuth; ca.Enabled {
+		if !cfg.Server.EnableTLS {
+			return fmt.Errorf("client_auth requires TLS to be enabled")
+		}
+		if ca.CAFile == "" {
+			return fmt.Errorf("client_auth enabled but ca_file is not specified")
+		}
+		if ca.IdentityFrom != "cn" && ca.IdentityFrom != "san" {
+			return fmt.Errorf("invalid client_auth.identity_from: %s", ca.IdentityFrom)
+		}
+	}
+
+	switch cfg.Websocket.SessionIDs {
+	case "hex", "ulid", "uuidv7":
+	default:
+		return fmt.Errorf("invalid websocket.session_ids: %s", cfg.Websocket.SessionIDs)
+	}
+	if d := cfg.Websocket.Duplex; d != "full" && d != "half" {
+		return fmt.Errorf("invalid websocket.duplex: %s", d)
+	}
+	if d, err := time.ParseDuration(cfg.Websocket.HalfDuplexTail); err != nil || d < 0 {
+		return fmt.Errorf("invalid websocket.half_duplex_tail: %s", cfg.Websocket.HalfDuplexTail)
+	}
+	pingInterval, err := time.ParseDuration(cfg.Websocket.PingInterval)
+	if err != nil || pingInterval <= 0 {
+		return fmt.Errorf("invalid websocket.ping_interval: %s", cfg.Websocket.PingInterval)
+	}
+	pongWait, err := time.ParseDuration(cfg.Websocket.PongWait)
+	if err != nil {
+		return fmt.Errorf("invalid websocket.pong_wait: %s", cfg.Websocket.PongWait)
+	}
+	// a device must have time to answer a ping before the next one is due
+	if pongWait <= pingInterval {
+		return fmt.Errorf("websocket.pong_wait must be longer than websocket.ping_interval")
+	}
+	if cfg.Websocket.FrameReorder < 0 {
+		return fmt.Errorf("invalid websocket.frame_reorder: %d", cfg.Websocket.FrameReorder)
+	}
+	for _, p := range cfg.Websocket.AllowedOrigins {
+		if _, err := path.Match(p, ""); err != nil || p == "" {
+			return fmt.Errorf("invalid websocket.allowed_origins pattern: %q", p)
+		}
+	}
+	if cfg.Websocket.StrictOrigins && len(cfg.Websocket.AllowedOrigins) == 0 {
+		return fmt.Errorf("websocket.strict_origins requires websocket.allowed_origins")
+	}
+
+	if su := cfg.Auth.SignedURLs; su.Enabled {
+		if len(su.Secret) < 32 {
+			return fmt.Errorf("auth.signed_urls.secret must be at least 32 characters")
+		}
+		if su.APIKey == "" {
+			return fmt.Errorf("auth.signed_urls enabled but api_key is not specified")
+		}
+		if su.BaseURL == "" {
+			return fmt.Errorf("auth.signed_urls enabled but base_url is not specified")
+		}
+		for name, value := range map[string]string{
+			"auth.signed_urls.default_ttl": su.DefaultTTL,
+			"auth.signed_urls.max_ttl":     su.MaxTTL,
+		} {
+			if _, err := time.ParseDuration(value); err != nil {
+				return fmt.Errorf("invalid %s: %v", name, err)
+			}
+		}
+	}
+
+	if ak := cfg.Auth.APIKeys; ak.Enabled {
+		if ak.Header == "" {
+			return fmt.Errorf("auth.api_keys.header is not specified")
+		}
+		switch ak.Store {
+		case "memory":
+			for i, k := range ak.Keys {
+				if k.Key == "" || k.DeviceID == "" {
+					return fmt.Errorf("auth.api_keys.keys[%d] needs a key and a device_id", i)
+				}
+			}
+		case "file":
+			if ak.File == "" {
+				return fmt.Errorf("auth.api_keys.store is file but auth.api_keys.file is not specified")
+			}
+		case "redis":
+			if ak.Redis.Addr == "" {
+				return fmt.Errorf("auth.api_keys.store is redis but auth.api_keys.redis.addr is not specified")
+			}
+			if _, err := time.ParseDuration(ak.Redis.Timeout); err != nil {
+				return fmt.Errorf("invalid auth.api_keys.redis.timeout: %v", err)
+			}
+		default:
+			return fmt.Errorf("invalid auth.api_keys.store: %s", ak.Store)
+		}
+	}
+
+	if jc := cfg.Auth.JWT; jc.Enabled {
+		if jc.JWKSURL == "" {
+			return fmt.Errorf("auth.jwt enabled but jwks_url is not specified")
+		}
+		if jc.DeviceClaim == "" {
+			return fmt.Errorf("auth.jwt.device_claim is not specified")
+		}
+		for name, value := range map[string]string{
+			"auth.jwt.jwks_refresh": jc.JWKSRefresh,
+			"auth.jwt.leeway":       jc.Leeway,
+		} {
+			if d, err := time.ParseDuration(value); err != nil || d < 0 {
+				return fmt.Errorf("invalid %s: %q", name, value)
+			}
+		}
+	}
+
+	if f := cfg.Filler; f.Enabled {
+		if cfg.Assets.Dir == "" || f.Asset == "" {
+			return fmt.Errorf("filler requires assets.dir and filler.asset")
+		}
+		for name, value := range map[string]string{
+			"filler.delay":        f.Delay,
+			"filler.max_duration": f.MaxDuration,
+		} {
+			if _, err := time.ParseDuration(value); err != nil {
+				return fmt.Errorf("invalid %s: %v", name, err)
+			}
+		}
+	}
+
+	if f := cfg.FAQ; f.Enabled {
+		if (cfg.AIConfig.Provider == "azure" || cfg.AIConfig.Provider == "openai") && cfg.TranscriptionFor("").Model == "" {
+			return fmt.Errorf("faq requires ai.input_transcription_model to transcribe questions")
+		}
+		for name, value := range map[string]string{
+			"faq.ttl":        f.TTL,
+			"faq.max_answer": f.MaxAnswer,
+		} {
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s: %s", name, value)
+			}
+		}
+		if f.MinSimilarity <= 0 || f.MinSimilarity > 1 {
+			return fmt.Errorf("faq.min_similarity must be in (0, 1]")
+		}
+	}
+
+	for name, value := range map[string]string{
+		"tools.timeout":           cfg.Tools.Timeout,
+		"tools.slow_after":        cfg.Tools.SlowAfter,
+		"translation.timeout":     cfg.Translation.Timeout,
+		"turn_processors.timeout": cfg.TurnProcessors.Timeout,
+	} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s: %s", name, value)
+		}
+	}
+
+	for name, value := range map[string]string{
+		"ptt.pre_buffer":  cfg.PTT.PreBuffer,
+		"ptt.end_silence": cfg.PTT.EndSilence,
+	} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			return fmt.Errorf("invalid %s: %s", name, value)
+		}
+	}
+	if cfg.TurnProcessors.Queue <= 0 {
+		return fmt.Errorf("turn_processors.queue must be positive")
+	}
+
+	if len(cfg.Tags.MetricLabels) > 5 {
+		return fmt.Errorf("tags.metric_labels takes at most 5 keys")
+	}
+	if len(cfg.Tags.MetricLabels) > 0 && cfg.Tags.MaxLabelValues <= 0 {
+		return fmt.Errorf("tags.max_label_values must be positive")
+	}
+
+	if cfg.Versions.MinProtocol < 1 || cfg.Versions.MinProtocol > version.Protocol {
+		return fmt.Errorf("versions.min_protocol must be between 1 and %d", version.Protocol)
+	}
+	for name, value := range map[string]string{
+		"versions.min_firmware":         cfg.Versions.MinFirmware,
+		"versions.recommended_firmware": cfg.Versions.RecommendedFirmware,
+	} {
+		if value == "" {
+			continue
+		}
+		if _, err := version.ParseFirmware(value); err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+
+	if c := cfg.Chaos; c.Enabled {
+		if cfg.Server.Environment != "test" && cfg.Server.Environment != "staging" {
+			return fmt.Errorf("chaos can only be enabled in the test and staging environments, not %q", cfg.Server.Environment)
+		}
+		for name, p := range map[string]float64{
+			"chaos.drop_events":          c.DropEvents,
+			"chaos.delay_frames":         c.DelayFrames,
+			"chaos.corrupt_frames":       c.CorruptFrames,
+			"chaos.provider_disconnects": c.ProviderDisconnects,
+			"chaos.device_disconnects":   c.DeviceDisconnects,
+		} {
+			if p < 0 || p > 1 {
+				return fmt.Errorf("%s must be between 0 and 1", name)
+			}
+		}
+		for name, value := range map[string]string{
+			"chaos.frame_delay":       c.FrameDelay,
+			"chaos.disconnect_within": c.DisconnectWithin,
+		} {
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s: %s", name, value)
+			}
+		}
+	}
+
+	if e := cfg.Echo; e.Enabled {
+		if e.Threshold <= 0 || e.Threshold > 1 {
+			return fmt.Errorf("echo.threshold must be in (0, 1]")
+		}
+		for name, value := range map[string]string{
+			"echo.window":    e.Window,
+			"echo.max_delay": e.MaxDelay,
+		} {
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s: %s", name, value)
+			}
+		}
+		if d, err := time.ParseDuration(e.MuteFor); err != nil || d < 0 {
+			return fmt.Errorf("invalid echo.mute_for: %s", e.MuteFor)
+		}
+	}
+
+	if s := cfg.SpeechEstimate; s.Enabled {
+		if d, err := time.ParseDuration(s.Interval); err != nil || d <= 0 {
+			return fmt.Errorf("invalid speech_estimate.interval: %s", s.Interval)
+		}
+		if s.CharsPerSecond <= 0 {
+			return fmt.Errorf("speech_estimate.chars_per_second must be positive")
+		}
+	}
+
+	if cfg.Admin.Enabled && len(cfg.Admin.APIKey) < 16 {
+		return fmt.Errorf("admin.api_key must be at least 16 characters")
+	}
+	if cfg.Admin.HeatSessions < 0 {
+		return fmt.Errorf("admin.heat_sessions must not be negative")
+	}
+
+	if cfg.Encryption.Required && !cfg.Encryption.Enabled {
+		return fmt.Errorf("encryption.required needs encryption to be enabled")
+	}
+
+	if cfg.Audio.SampleRate <= 0 {
+		return fmt.Errorf("invalid sample rate: %d", cfg.Audio.SampleRate)
+	}
+
+	if cfg.Audio.Channels <= 0 {
+		return fmt.Errorf("invalid number of channels: %d", cfg.Audio.Channels)
+	}
+
+	if cfg.Audio.AudioFormat != PCM16 && cfg.Audio.AudioFormat != WAV && cfg.Audio.AudioFormat != MP3 {
+		return fmt.Errorf("invalid audio format: %s", cfg.Audio.AudioFormat)
+	}
+
+	if _, err := audio.DownmixChannel(cfg.Audio.Downmix); err != nil {
+		return fmt.Errorf("audio.downmix: %w", err)
+	}
+
+	if cfg.AIConfig.Provider == "" {
+		return fmt.Errorf("ai.provider is not specified")
+	}
+
+	if cfg.Bandwidth.SessionCapBytes < 0 || cfg.Bandwidth.MonthlyCapBytes < 0 {
+		return fmt.Errorf("bandwidth caps must not be negative")
+	}
+	if cfg.Bandwidth.DowngradeThreshold > 0 && cfg.Bandwidth.DowngradeSampleRate <= 0 {
+		return fmt.Errorf("invalid bandwidth.downgrade_sample_rate: %d", cfg.Bandwidth.DowngradeSampleRate)
+	}
+
+	if cfg.Offline.Enabled {
+		if cfg.Offline.OnRecovery != "replay" && cfg.Offline.OnRecovery != "discard" {
+			return fmt.Errorf("invalid offline.on_recovery: %s", cfg.Offline.OnRecovery)
+		}
+		for name, value := range map[string]string{
+			"offline.max_buffer":     cfg.Offline.MaxBuffer,
+			"offline.retry_interval": cfg.Offline.RetryInterval,
+			"offline.max_outage":     cfg.Offline.MaxOutage,
+		} {
+			if _, err := time.ParseDuration(value); err != nil {
+				return fmt.Errorf("invalid %s: %v", name, err)
+			}
+		}
+	}
+
+	if q := cfg.ProviderQueue; q.Enabled {
+		if q.MaxSessions < 1 {
+			return fmt.Errorf("provider_queue.max_sessions must be at least 1")
+		}
+		if q.MaxWaiting < 0 {
+			return fmt.Errorf("provider_queue.max_waiting must not be negative")
+		}
+		if d, err := time.ParseDuration(q.MaxWait); err != nil || d <= 0 {
+			return fmt.Errorf("invalid provider_queue.max_wait: %q", q.MaxWait)
+		}
+		if q.HoldAsset != "" && cfg.Assets.Dir == "" {
+			return fmt.Errorf("provider_queue.hold_asset requires assets.dir")
+		}
+	}
+
+	if m := cfg.Memory; m.SessionBudgetBytes < 0 || m.DownlinkBytes < 0 || m.OfflineBytes < 0 {
+		return fmt.Errorf("memory budgets must not be negative")
+	}
+	switch cfg.Memory.ShedPolicy {
+	case "", "drop_oldest", "drop_newest", "close":
+	default:
+		return fmt.Errorf("invalid memory.shed_policy: %s", cfg.Memory.ShedPolicy)
+	}
+
+	if d, err := time.ParseDuration(cfg.Shutdown.DrainTimeout); err != nil || d < 0 {
+		return fmt.Errorf("invalid shutdown.drain_timeout: %s", cfg.Shutdown.DrainTimeout)
+	}
+	if d, err := time.ParseDuration(cfg.Shutdown.HealthFailDelay); err != nil || d < 0 {
+		return fmt.Errorf("invalid shutdown.health_fail_delay: %s", cfg.Shutdown.HealthFailDelay)
+	}
+	if u := cfg.Shutdown.WebhookURL; u != "" && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		return fmt.Errorf("shutdown.webhook_url must be an http or https URL")
+	}
+
+	if cfg.Trace.Enabled && cfg.Trace.Dir == "" {
+		return fmt.Errorf("trace requires trace.dir")
+	}
+
+	if rl := cfg.RateLimit; rl.Enabled {
+		for name, value := range map[string]string{
+			"rate_limit.window":        rl.Window,
+			"rate_limit.quota_window":  rl.QuotaWindow,
+			"rate_limit.redis.timeout": rl.Redis.Timeout,
+		} {
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s: %s", name, value)
+			}
+		}
+		if rl.DeviceConnections < 0 || rl.TenantConnections < 0 || rl.TenantSessions < 0 {
+			return fmt.Errorf("rate_limit limits must not be negative")
+		}
+		if rl.Redis.DB < 0 {
+			return fmt.Errorf("invalid rate_limit.redis.db: %d", rl.Redis.DB)
+		}
+	}
+
+	if r := cfg.Reaper; r.Enabled {
+		durations := make(map[string]time.Duration)
+		for name, value := range map[string]string{
+			"reaper.interval":         r.Interval,
+			"reaper.device_timeout":   r.DeviceTimeout,
+			"reaper.provider_timeout": r.ProviderTimeout,
+			"reaper.teardown_timeout": r.TeardownTimeout,
+		} {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", name, err)
+			}
+			if d <= 0 {
+				return fmt.Errorf("%s must be positive", name)
+			}
+			durations[name] = d
+		}
+		// a live session must never look orphaned
+		if durations["reaper.device_timeout"] <= pongWait {
+			return fmt.Errorf("reaper.device_timeout must be longer than websocket.pong_wait")
+		}
+		if maxOutage, err := time.ParseDuration(cfg.Offline.MaxOutage); cfg.Offline.Enabled && err == nil && durations["reaper.provider_timeout"] <= maxOutage {
+			return fmt.Errorf("reaper.provider_timeout must be longer than offline.max_outage")
+		}
+		if maxWait, err := time.ParseDuration(cfg.ProviderQueue.MaxWait); cfg.ProviderQueue.Enabled && err == nil && durations["reaper.provider_timeout"] <= maxWait {
+			return fmt.Errorf("reaper.provider_timeout must be longer than provider_queue.max_wait")
+		}
+	}
+
+	if cfg.Digest.Enabled {
+		if !cfg.Transcripts.Enabled {
+			return fmt.Errorf("digest requires transcripts to be enabled")
+		}
+		if _, err := time.Parse("15:04", cfg.Digest.SendAt); err != nil {
+			return fmt.Errorf("invalid digest.send_at: %v", err)
+		}
+	}
+
+	if a := cfg.Analytics; a.Enabled {
+		if a.MinCohort < 1 {
+			return fmt.Errorf("analytics.min_cohort must be at least 1")
+		}
+		var previous time.Duration
+		for _, b := range a.DurationBuckets {
+			d, err := time.ParseDuration(b)
+			if err != nil || d <= previous {
+				return fmt.Errorf("analytics.duration_buckets must be increasing durations: %s", b)
+			}
+			previous = d
+		}
+		if a.Epsilon < 0 {
+			return fmt.Errorf("analytics.epsilon must not be negative")
+		}
+		if d, err := time.ParseDuration(a.Retention); err != nil || d <= 0 {
+			return fmt.Errorf("invalid analytics.retention: %s", a.Retention)
+		}
+	}
+
+	geoIP := cfg.Policy.GeoIPDatabase != ""
+	if err := cfg.Policy.validate("policy", geoIP); err != nil {
+		return err
+	}
+	for _, cidr := range cfg.Policy.TrustedProxies {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return fmt.Errorf("invalid policy.trusted_proxies CIDR: %s", cidr)
+		}
+	}
+	for id, tenant := range cfg.Tenants {
+		if err := tenant.Policy.validate("tenants."+id+".policy", geoIP); err != nil {
+			return err
+		}
+		if err := tenant.Transcription.validate("tenants." + id + ".transcription"); err != nil {
+			return err
+		}
+		if err := tenant.Proxy.validate("tenants." + id + ".proxy"); err != nil {
+			return err
+		}
+		if p := strings.ToLower(tenant.DeviceProfile); p != "" {
+			if _, ok := cfg.DeviceProfiles[p]; !ok {
+				return fmt.Errorf("tenants.%s.device_profile: unknown device profile %s", id, p)
+			}
+		}
+		if r := strings.ToLower(tenant.Region); r != "" {
+			if _, ok := cfg.Regions[r]; !ok {
+				return fmt.Errorf("tenants.%s.region: unknown region %s", id, r)
+			}
+		}
+		if tenant.AggregateOnly && !cfg.Analytics.Enabled {
+			return fmt.Errorf("tenants.%s.aggregate_only requires analytics to be enabled", id)
+		}
+	}
+	for name, region := range cfg.Regions {
+		for key, value := range map[string]string{"azure.service_url": region.Azure.ServiceURL, "openai.service_url": region.OpenAI.ServiceURL} {
+			if value == "" {
+				continue
+			}
+			if u, err := url.Parse(value); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+				return fmt.Errorf("regions.%s.%s must be a ws or wss URL", name, key)
+			}
+		}
+		if (cfg.AIConfig.Provider == "azure" && region.Azure.ServiceURL == "") || (cfg.AIConfig.Provider == "openai" && region.OpenAI.ServiceURL == "") {
+			return fmt.Errorf("regions.%s has no %s.service_url for ai.provider", name, cfg.AIConfig.Provider)
+		}
+		if cfg.Trace.Enabled && region.TraceDir == "" {
+			return fmt.Errorf("regions.%s.trace_dir is required with trace enabled", name)
+		}
+	}
+	if err := cfg.Endpointing.validate("endpointing"); err != nil {
+		return err
+	}
+	for name, profile := range cfg.DeviceProfiles {
+		if err := profile.Endpointing.validate("device_profiles." + name + ".endpointing"); err != nil {
+			return err
+		}
+	}
+
+	if c := cfg.Calibration; c.Enabled {
+		if d, err := time.ParseDuration(c.Duration); err != nil || d <= 0 {
+			return fmt.Errorf("invalid calibration.duration: %s", c.Duration)
+		}
+		if c.MinThreshold <= 0 || c.MinThreshold > c.MaxThreshold || c.MaxThreshold > 1 {
+			return fmt.Errorf("calibration thresholds must satisfy 0 < min_threshold <= max_threshold <= 1")
+		}
+		if c.TargetLevel >= 0 || c.NoiseCeiling >= 0 {
+			return fmt.Errorf("calibration.target_level and calibration.noise_ceiling must be below 0 dBFS")
+		}
+		if c.MaxGain < 1 {
+			return fmt.Errorf("calibration.max_gain must be at least 1")
+		}
+	}
+	if cfg.Denoise.MaxAttenuation <= 0 {
+		return fmt.Errorf("denoise.max_attenuation must be positive")
+	}
+	// device profiles may turn gain control and echo cancellation on with them disabled, so they
+	// are always validated
+	agc := cfg.AGC
+	for name, value := range map[string]string{"agc.attack": agc.Attack, "agc.release": agc.Release} {
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s: %s", name, value)
+		}
+	}
+	if agc.Gate >= agc.TargetLevel || agc.TargetLevel >= 0 {
+		return fmt.Errorf("agc levels must satisfy gate < target_level < 0 dBFS")
+	}
+	if agc.MaxGain < 1 {
+		return fmt.Errorf("agc.max_gain must be at least 1")
+	}
+	for name, value := range map[string]string{"aec.tail": cfg.AEC.Tail, "aec.max_delay": cfg.AEC.MaxDelay} {
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s: %s", name, value)
+		}
+	}
+	if j := cfg.Jitter; j.Enabled {
+		delay, err := time.ParseDuration(j.Delay)
+		if err != nil || delay <= 0 {
+			return fmt.Errorf("invalid jitter.delay: %s", j.Delay)
+		}
+		if d, err := time.ParseDuration(j.MaxDelay); err != nil || d < delay {
+			return fmt.Errorf("invalid jitter.max_delay: %s, must be at least jitter.delay", j.MaxDelay)
+		}
+	}
+	if p := cfg.PLC; p.Enabled {
+		if p.Mode != "repeat" && p.Mode != "hold" {
+			return fmt.Errorf("invalid plc.mode: %s", p.Mode)
+		}
+		for name, value := range map[string]string{"plc.fade": p.Fade, "plc.max_duration": p.MaxDuration} {
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s: %s", name, value)
+			}
+		}
+	}
+	if at := cfg.AudioTest; at.Enabled {
+		for name, value := range map[string]string{"audio_test.max_duration": at.MaxDuration, "audio_test.max_delay": at.MaxDelay} {
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s: %s", name, value)
+			}
+		}
+		if at.MinMatch <= 0 || at.MinMatch > 1 {
+			return fmt.Errorf("audio_test.min_match must be in (0, 1], got %v", at.MinMatch)
+		}
+	}
+	if ev := cfg.Events; ev.Enabled {
+		if d, err := time.ParseDuration(ev.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid events.timeout: %s", ev.Timeout)
+		}
+		if ev.Queue < 1 {
+			return fmt.Errorf("events.queue must be at least 1")
+		}
+		if len(ev.Kafka.Brokers) > 0 && ev.Kafka.Acks != -1 && ev.Kafka.Acks != 1 {
+			return fmt.Errorf("events.kafka.acks must be -1 or 1, got %d", ev.Kafka.Acks)
+		}
+	}
+	if an := cfg.Announcements; an.Enabled {
+		if cfg.Assets.Dir == "" {
+			return fmt.Errorf("announcements require assets.dir")
+		}
+		for name, value := range map[string]string{"announcements.interval": an.Interval, "announcements.idle_for": an.IdleFor, "announcements.retention": an.Retention} {
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s: %s", name, value)
+			}
+		}
+		if an.MaxConcurrent < 1 {
+			return fmt.Errorf("announcements.max_concurrent must be at least 1")
+		}
+	}
+	if sv := cfg.SpeakerVerification; sv.Enabled {
+		for name, value := range map[string]string{"speaker_verification.sample": sv.Sample, "speaker_verification.timeout": sv.Timeout} {
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s: %s", name, value)
+			}
+		}
+		if sv.MinScore < 0 || sv.MinScore > 1 {
+			return fmt.Errorf("speaker_verification.min_score must be between 0 and 1")
+		}
+	}
+	if sp := cfg.Speaker; sp.Enabled {
+		for name, value := range map[string]string{"speaker.sample": sp.Sample, "speaker.timeout": sp.Timeout} {
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s: %s", name, value)
+			}
+		}
+		if sp.MinConfidence < 0 || sp.MinConfidence > 1 {
+			return fmt.Errorf("speaker.min_confidence must be between 0 and 1")
+		}
+		for group, p := range sp.Policies {
+			if group != "child" && group != "teen" && group != "adult" {
+				return fmt.Errorf("invalid age group %q in speaker.policies", group)
+			}
+			switch p.Action {
+			case "log", "end":
+			case "restrict":
+				if p.Model == "" && p.Instructions == "" {
+					return fmt.Errorf("speaker.policies.%s restricts sessions but sets neither model nor instructions", group)
+				}
+			default:
+				return fmt.Errorf("invalid speaker.policies.%s.action: %s", group, p.Action)
+			}
+		}
+	}
+	if c := cfg.Connect; c.Enabled {
+		if d, err := time.ParseDuration(c.TokenTTL); err != nil || d <= 0 {
+			return fmt.Errorf("invalid connect.token_ttl: %s", c.TokenTTL)
+		}
+		if c.URL != "" {
+			if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+				return fmt.Errorf("connect.url must be a ws or wss URL: %s", c.URL)
+			}
+		}
+	}
+	if pl := cfg.ProviderLog; pl.Enabled && (pl.Sample < 0 || pl.Sample > 1) {
+		return fmt.Errorf("provider_log.sample must be between 0 and 1")
+	}
+	if dh := cfg.DeviceHello; dh.Enabled {
+		if d, err := time.ParseDuration(dh.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid device_hello.timeout: %s", dh.Timeout)
+		}
+	}
+	if d := cfg.Devices; d.Enabled {
+		if d.History < 0 {
+			return fmt.Errorf("devices.history must not be negative")
+		}
+		if interval, err := time.ParseDuration(d.SaveInterval); d.File != "" && (err != nil || interval <= 0) {
+			return fmt.Errorf("invalid devices.save_interval: %s", d.SaveInterval)
+		}
+	}
+	if g := cfg.VADGate; g.Enabled {
+		if d, err := time.ParseDuration(g.PreRoll); err != nil || d < 0 {
+			return fmt.Errorf("invalid vad_gate.pre_roll: %s", g.PreRoll)
+		}
+		if d, err := time.ParseDuration(g.Hangover); g.Hangover != "" && (err != nil || d <= 0) {
+			return fmt.Errorf("invalid vad_gate.hangover: %s", g.Hangover)
+		}
+		if g.Threshold < 0 {
+			return fmt.Errorf("vad_gate.threshold must not be negative")
+		}
+	}
+	if ps := cfg.PipelineScheduler; ps.Enabled {
+		if ps.Slots < 0 {
+			return fmt.Errorf("pipeline_scheduler.slots must not be negative")
+		}
+		if d, err := time.ParseDuration(ps.StarvedAfter); err != nil || d <= 0 {
+			return fmt.Errorf("invalid pipeline_scheduler.starved_after: %s", ps.StarvedAfter)
+		}
+	}
+	if vg := cfg.VoiceGain; vg.Enabled {
+		if vg.TargetLevel >= 0 {
+			return fmt.Errorf("voice_gain.target_level must be below 0 dBFS")
+		}
+		if vg.MaxGain < 0 {
+			return fmt.Errorf("voice_gain.max_gain must not be negative")
+		}
+	}
+	if err := cfg.AIConfig.Transcription.validate("ai.transcription"); err != nil {
+		return err
+	}
+
+	if err := cfg.Server.Socket.validate("server.socket"); err != nil {
+		return err
+	}
+	if err := cfg.AIConfig.Socket.validate("ai.socket"); err != nil {
+		return err
+	}
+	if err := cfg.AIConfig.Proxy.validate("ai.proxy"); err != nil {
+		return err
+	}
+
+	switch cfg.AIConfig.OutputAudioFormat {
+	case "", "auto", "pcm16", "g711_ulaw", "g711_alaw":
+	default:
+		return fmt.Errorf("invalid ai.output_audio_format: %s", cfg.AIConfig.OutputAudioFormat)
+	}
+
+	for name, value := range map[string]string{
+		"ai.connect_timeout":       cfg.AIConfig.ConnectTimeout,
+		"ai.append_timeout":        cfg.AIConfig.AppendTimeout,
+		"ai.append_ack_window":     cfg.AIConfig.AppendAckWindow,
+		"ai.response_timeout":      cfg.AIConfig.ResponseTimeout,
+		"ai.refresh_drain_timeout": cfg.AIConfig.RefreshDrainTimeout,
+	} {
+		if _, err := time.ParseDuration(value); err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+
+	if rt := cfg.Retranscribe; rt.Enabled {
+		if !cfg.Transcripts.Enabled {
+			return fmt.Errorf("retranscribe requires transcripts.enabled to keep session records")
+		}
+		if cfg.Trace.Dir == "" {
+			return fmt.Errorf("retranscribe requires trace.dir to read the recorded audio from")
+		}
+		if rt.Concurrency < 1 {
+			return fmt.Errorf("invalid retranscribe.concurrency: %d", rt.Concurrency)
+		}
+		if d, err := time.ParseDuration(rt.IdleTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid retranscribe.idle_timeout: %s", rt.IdleTimeout)
+		}
+	}
+
+	if cfg.AIConfig.Provider == "openai" {
+		if u, err := url.Parse(cfg.OpenAI.ServiceURL); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			return fmt.Errorf("openai.service_url must be a ws or wss URL")
+		}
+		if cfg.OpenAI.Model == "" {
+			return fmt.Errorf("openai.model is not specified")
+		}
+	}
+
+	if cfg.AIConfig.Provider == "mock" {
+		for name, value := range map[string]string{
+			"ai.mock.turn_after":      cfg.AIConfig.Mock.TurnAfter,
+			"ai.mock.response_length": cfg.AIConfig.Mock.ResponseLength,
+		} {
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s: %s", name, value)
+			}
+		}
+	}
+
+	return nil
+}
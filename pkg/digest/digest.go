@@ -0,0 +1,114 @@
+// Package digest aggregates a day of finished sessions per tenant and delivers the digest to the
+// tenant's webhook or email recipients.
+package digest
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+// Digest summarizes a tenant's sessions over a day
+type Digest struct {
+	TenantID string `json:"tenant_id"`
+	// Date is the UTC day the digest covers, as "2006-01-02"
+	Date                   string           `json:"date"`
+	Sessions               int              `json:"sessions"`
+	AverageDurationSeconds float64          `json:"average_duration_seconds"`
+	TopIntents             []IntentCount    `json:"top_intents,omitempty"`
+	Flagged                []FlaggedSession `json:"flagged,omitempty"`
+	// Analytics aggregates the analytics of the sessions
+	Analytics Analytics `json:"analytics"`
+}
+
+// Analytics aggregates the conversation analytics of a day of sessions. Ratios and rates are
+// weighted by talk time, latencies by the number of answers.
+type Analytics struct {
+	UserTalkSeconds      float64 `json:"user_talk_seconds"`
+	AssistantTalkSeconds float64 `json:"assistant_talk_seconds"`
+	UserTalkRatio        float64 `json:"user_talk_ratio"`
+	Interruptions        int     `json:"interruptions"`
+	Responses            int     `json:"responses"`
+	ResponseLatencyMs    float64 `json:"response_latency_ms"`
+	UserWPM              float64 `json:"user_wpm"`
+	AssistantWPM         float64 `json:"assistant_wpm"`
+}
+
+type IntentCount struct {
+	Intent string `json:"intent"`
+	Count  int    `json:"count"`
+}
+
+type FlaggedSession struct {
+	ID       string `json:"id"`
+	DeviceID string `json:"device_id,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// IntentClassifier returns the intents of a session, for the top intents of the digest.
+// The relay does not classify intents itself; embedding applications can plug in their own.
+type IntentClassifier func(store.SessionRecord) []string
+
+// Build aggregates the records of a tenant's day into a digest
+func Build(tenantID string, day time.Time, records []store.SessionRecord, classify IntentClassifier, topIntents int) Digest {
+	d := Digest{
+		TenantID: tenantID,
+		Date:     day.UTC().Format("2006-01-02"),
+		Sessions: len(records),
+	}
+
+	var total time.Duration
+	var userTalk, assistantTalk, latency, userWords, assistantWords float64
+	intents := make(map[string]int)
+	for _, r := range records {
+		total += r.Duration()
+		a := r.Analytics
+		userTalk += float64(a.UserTalkMs)
+		assistantTalk += float64(a.AssistantTalkMs)
+		userWords += a.UserWPM * float64(a.UserTalkMs)
+		assistantWords += a.AssistantWPM * float64(a.AssistantTalkMs)
+		latency += a.ResponseLatencyMs * float64(a.Responses)
+		d.Analytics.Interruptions += a.Interruptions
+		d.Analytics.Responses += a.Responses
+		if r.Flagged {
+			d.Flagged = append(d.Flagged, FlaggedSession{ID: r.ID, DeviceID: r.DeviceID, Reason: r.FlagReason})
+		}
+		if classify != nil {
+			for _, intent := range classify(r) {
+				intents[intent]++
+			}
+		}
+	}
+	if len(records) > 0 {
+		d.AverageDurationSeconds = total.Seconds() / float64(len(records))
+	}
+	d.Analytics.UserTalkSeconds = userTalk / 1000
+	d.Analytics.AssistantTalkSeconds = assistantTalk / 1000
+	if userTalk+assistantTalk > 0 {
+		d.Analytics.UserTalkRatio = userTalk / (userTalk + assistantTalk)
+	}
+	if d.Analytics.Responses > 0 {
+		d.Analytics.ResponseLatencyMs = latency / float64(d.Analytics.Responses)
+	}
+	if userTalk > 0 {
+		d.Analytics.UserWPM = userWords / userTalk
+	}
+	if assistantTalk > 0 {
+		d.Analytics.AssistantWPM = assistantWords / assistantTalk
+	}
+
+	for intent, count := range intents {
+		d.TopIntents = append(d.TopIntents, IntentCount{Intent: intent, Count: count})
+	}
+	sort.Slice(d.TopIntents, func(i, j int) bool {
+		if d.TopIntents[i].Count != d.TopIntents[j].Count {
+			return d.TopIntents[i].Count > d.TopIntents[j].Count
+		}
+		return d.TopIntents[i].Intent < d.TopIntents[j].Intent
+	})
+	if topIntents > 0 && len(d.TopIntents) > topIntents {
+		d.TopIntents = d.TopIntents[:topIntents]
+	}
+	return d
+}
@@ -0,0 +1,71 @@
+package digest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+type recordingSender struct {
+	digests []Digest
+}
+
+func (s *recordingSender) Send(ctx context.Context, target config.DigestTarget, d Digest) error {
+	s.digests = append(s.digests, d)
+	return nil
+}
+
+func TestDigest(t *testing.T) {
+	day := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	st := store.NewMemoryStore(0)
+	for i, r := range []store.SessionRecord{
+		{ID: "a", TenantID: "acme", StartedAt: day.Add(time.Hour), EndedAt: day.Add(time.Hour + 30*time.Second)},
+		{ID: "b", TenantID: "acme", StartedAt: day.Add(2 * time.Hour), EndedAt: day.Add(2*time.Hour + 90*time.Second), Flagged: true, FlagReason: "timeout"},
+		{ID: "c", TenantID: "acme", StartedAt: day.Add(26 * time.Hour), EndedAt: day.Add(27 * time.Hour)},
+	} {
+		r.Turns = []store.Turn{{Role: store.UserRole, Text: []string{"menu", "order", "menu"}[i]}}
+		r.Analytics = store.Analytics{UserTalkMs: 1000 * int64(i+1), AssistantTalkMs: 3000, Interruptions: i, Responses: 1, ResponseLatencyMs: 400 * float64(i+1), UserWPM: 120}
+		st.SaveSession(context.Background(), r)
+	}
+
+	cfg := &config.Config{
+		Digest:  config.DigestConfig{TopIntents: 5},
+		Tenants: map[string]config.TenantConfig{"acme": {Digest: config.DigestTarget{WebhookURL: "http://example.invalid"}}},
+	}
+	sender := &recordingSender{}
+	classify := func(r store.SessionRecord) []string { return []string{r.Turns[0].Text} }
+	s := NewScheduler(cfg, st, WithSenders(sender), WithIntentClassifier(classify))
+
+	if err := s.SendDigests(context.Background(), day); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.digests) != 1 {
+		t.Fatalf("expected one digest, got %d", len(sender.digests))
+	}
+	d := sender.digests[0]
+	if d.Sessions != 2 || d.AverageDurationSeconds != 60 || d.Date != "2026-10-01" {
+		t.Fatalf("unexpected digest: %+v", d)
+	}
+	if a := d.Analytics; a.UserTalkSeconds != 3 || a.UserTalkRatio != 1/3.0 || a.Interruptions != 1 || a.Responses != 2 || a.ResponseLatencyMs != 600 || a.UserWPM != 120 {
+		t.Fatalf("unexpected analytics: %+v", a)
+	}
+	if len(d.Flagged) != 1 || d.Flagged[0].ID != "b" {
+		t.Fatalf("unexpected flagged sessions: %+v", d.Flagged)
+	}
+	if len(d.TopIntents) != 2 || d.TopIntents[0].Intent != "menu" {
+		t.Fatalf("unexpected top intents: %+v", d.TopIntents)
+	}
+}
+
+func TestNextRun(t *testing.T) {
+	now := time.Date(2026, 10, 1, 7, 0, 0, 0, time.UTC)
+	if got := nextRun(now, "06:00"); !got.Equal(time.Date(2026, 10, 2, 6, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected next run: %s", got)
+	}
+	if got := nextRun(now, "08:30"); !got.Equal(time.Date(2026, 10, 1, 8, 30, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected next run: %s", got)
+	}
+}
@@ -0,0 +1,129 @@
+package digest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+// Scheduler sends the previous day's digest to every tenant with a digest target once a day
+type Scheduler struct {
+	config   *config.Config
+	store    store.TranscriptStore
+	senders  []Sender
+	classify IntentClassifier
+	logger   *slog.Logger
+	clock    clock.Clock
+}
+
+// Option configures a Scheduler
+type Option func(*Scheduler)
+
+// WithLogger sets the scheduler's logger. By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Scheduler) {
+		s.logger = logger
+	}
+}
+
+// WithClock sets the clock the daily runs are scheduled on. It defaults to the real clock.
+func WithClock(c clock.Clock) Option {
+	return func(s *Scheduler) {
+		s.clock = c
+	}
+}
+
+// WithIntentClassifier sets the classifier used for the top intents of the digests
+func WithIntentClassifier(c IntentClassifier) Option {
+	return func(s *Scheduler) {
+		s.classify = c
+	}
+}
+
+// WithSenders replaces the default webhook and SMTP senders
+func WithSenders(senders ...Sender) Option {
+	return func(s *Scheduler) {
+		s.senders = senders
+	}
+}
+
+// NewScheduler creates a digest scheduler reading session records from st
+func NewScheduler(cfg *config.Config, st store.TranscriptStore, opts ...Option) *Scheduler {
+	s := &Scheduler{
+		config:  cfg,
+		store:   st,
+		senders: []Sender{WebhookSender{}, SMTPSender{Config: cfg.Digest.SMTP}},
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		clock:   clock.Real(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Run sends digests every day at the configured time until ctx is done
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		now := s.clock.Now()
+		next := nextRun(now.UTC(), s.config.Digest.SendAt)
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.clock.After(next.Sub(now)):
+		}
+
+		day := next.AddDate(0, 0, -1)
+		if err := s.SendDigests(ctx, day); err != nil {
+			s.logger.Error("Could not send digests", "date", day.Format("2006-01-02"), "error", err)
+		}
+	}
+}
+
+// SendDigests builds and sends the digest of the given UTC day to every tenant with a digest target
+func (s *Scheduler) SendDigests(ctx context.Context, day time.Time) error {
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 1)
+
+	var errs []error
+	for tenantID, tenant := range s.config.Tenants {
+		target := tenant.Digest
+		if target.WebhookURL == "" && len(target.Emails) == 0 {
+			continue
+		}
+		records, err := s.store.ListSessions(ctx, store.SessionFilter{TenantID: tenantID, From: start, To: end})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		d := Build(tenantID, start, records, s.classify, s.config.Digest.TopIntents)
+		for _, sender := range s.senders {
+			if err := sender.Send(ctx, target, d); err != nil {
+				s.logger.Error("Could not deliver digest", "tenant_id", tenantID, "error", err)
+				errs = append(errs, err)
+			}
+		}
+		s.logger.Info("Sent digest", "tenant_id", tenantID, "date", d.Date, "sessions", d.Sessions)
+	}
+	return errors.Join(errs...)
+}
+
+// nextRun returns the next time after now at the "15:04" time of day sendAt
+func nextRun(now time.Time, sendAt string) time.Time {
+	t, err := time.Parse("15:04", sendAt)
+	if err != nil {
+		t = time.Date(0, 1, 1, 6, 0, 0, 0, time.UTC)
+	}
+	next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
@@ -0,0 +1,98 @@
+package digest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// Sender delivers a digest to one kind of target
+type Sender interface {
+	Send(ctx context.Context, target config.DigestTarget, d Digest) error
+}
+
+// WebhookSender posts the digest as JSON to the tenant's webhook URL
+type WebhookSender struct {
+	Client *http.Client
+}
+
+func (s WebhookSender) Send(ctx context.Context, target config.DigestTarget, d Digest) error {
+	if target.WebhookURL == "" {
+		return nil
+	}
+	body, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not post digest: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("digest webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SMTPSender emails the digest to the tenant's recipients
+type SMTPSender struct {
+	Config config.SMTPConfig
+}
+
+func (s SMTPSender) Send(ctx context.Context, target config.DigestTarget, d Digest) error {
+	if len(target.Emails) == 0 {
+		return nil
+	}
+	if s.Config.Addr == "" {
+		return fmt.Errorf("digest emails configured but digest.smtp.addr is not set")
+	}
+
+	var auth smtp.Auth
+	if s.Config.Username != "" {
+		host, _, _ := net.SplitHostPort(s.Config.Addr)
+		auth = smtp.PlainAuth("", s.Config.Username, s.Config.Password, host)
+	}
+	return smtp.SendMail(s.Config.Addr, auth, s.Config.From, target.Emails, formatEmail(s.Config.From, target.Emails, d))
+}
+
+func formatEmail(from string, to []string, d Digest) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: Pixa session digest for %s (%s)\r\n", d.TenantID, d.Date)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	fmt.Fprintf(&b, "Sessions: %d\r\n", d.Sessions)
+	fmt.Fprintf(&b, "Average duration: %.1fs\r\n", d.AverageDurationSeconds)
+	if len(d.TopIntents) > 0 {
+		b.WriteString("\r\nTop intents:\r\n")
+		for _, i := range d.TopIntents {
+			fmt.Fprintf(&b, "  %s: %d\r\n", i.Intent, i.Count)
+		}
+	}
+	if len(d.Flagged) > 0 {
+		b.WriteString("\r\nFlagged sessions:\r\n")
+		for _, f := range d.Flagged {
+			fmt.Fprintf(&b, "  %s (device %s): %s\r\n", f.ID, f.DeviceID, f.Reason)
+		}
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,194 @@
+// Package errors sorts the failures of the relay into categories, for embedding applications to
+// branch on without matching error messages. Each category has the close code devices see when
+// their session ends for it, so what an application logs agrees with what the device was told.
+//
+// The package is meant to be imported under another name, such as pixaerrors, next to the
+// standard library's errors.
+package errors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// Code is the category of a failure
+type Code string
+
+// Failures of connections the relay refuses, before or right after the upgrade. Their close
+// codes are 4000 plus the HTTP status the upgrade is refused with, such as 4415 for a codec the
+// relay has no decoder for.
+const (
+	InvalidRequest   Code = "invalid_request"
+	Unauthenticated  Code = "unauthenticated"
+	Forbidden        Code = "forbidden"
+	UnsupportedMedia Code = "unsupported_media"
+	UpgradeRequired  Code = "upgrade_required"
+	RateLimited      Code = "rate_limited"
+	Unavailable      Code = "unavailable"
+)
+
+// Failures that end sessions
+const (
+	// PolicyViolation is a session closed for breaking a policy, such as a bandwidth cap or a
+	// speaker policy (1008)
+	PolicyViolation Code = "policy_violation"
+	// Overloaded is a session closed to protect the relay, such as one over its memory budget or
+	// reaped, which the device may retry later (1013)
+	Overloaded Code = "overloaded"
+	// Restarting is a session closed because the relay shuts down (1012)
+	Restarting Code = "restarting"
+	// Unresponsive is a device that stopped answering pings (1001)
+	Unresponsive Code = "unresponsive"
+	// InvalidAudio is audio that could not be decoded (1007)
+	InvalidAudio Code = "invalid_audio"
+	// ProviderTimeout is a provider operation that did not complete within its timeout (1011)
+	ProviderTimeout Code = "provider_timeout"
+	// ProviderFailed is a provider that could not be reached or reported an error (1011)
+	ProviderFailed Code = "provider_failed"
+	// Internal is any other failure (1011)
+	Internal Code = "internal"
+)
+
+// statuses are the HTTP statuses of the codes of refused connections
+var statuses = map[Code]int{
+	InvalidRequest:   http.StatusBadRequest,
+	Unauthenticated:  http.StatusUnauthorized,
+	Forbidden:        http.StatusForbidden,
+	UnsupportedMedia: http.StatusUnsupportedMediaType,
+	UpgradeRequired:  http.StatusUpgradeRequired,
+	RateLimited:      http.StatusTooManyRequests,
+	Unavailable:      http.StatusServiceUnavailable,
+}
+
+// closeCodes are the close codes of the codes ending sessions
+var closeCodes = map[Code]int{
+	PolicyViolation: websocket.ClosePolicyViolation,
+	Overloaded:      websocket.CloseTryAgainLater,
+	Restarting:      websocket.CloseServiceRestart,
+	Unresponsive:    websocket.CloseGoingAway,
+	InvalidAudio:    websocket.CloseInvalidFramePayloadData,
+}
+
+// ForStatus returns the code of a connection refused with an HTTP status, Internal for server
+// errors it has no code of its own for, and InvalidRequest for client errors
+func ForStatus(status int) Code {
+	for c, s := range statuses {
+		if s == status {
+			return c
+		}
+	}
+	if status >= 500 {
+		return Internal
+	}
+	return InvalidRequest
+}
+
+// Status returns the HTTP status a connection failing with the code is refused with
+func (c Code) Status() int {
+	if s, ok := statuses[c]; ok {
+		return s
+	}
+	if c == Overloaded || c == Restarting {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// CloseCode returns the close code of a session ending with the code
+func (c Code) CloseCode() int {
+	if s, ok := statuses[c]; ok {
+		return 4000 + s
+	}
+	if cc, ok := closeCodes[c]; ok {
+		return cc
+	}
+	return websocket.CloseInternalServerErr
+}
+
+// Error is a failure of a category. Errors of the same code match with errors.Is, so sentinel
+// errors can be compared by category and message alike.
+type Error struct {
+	Code    Code
+	Message string
+	// Err is the error that caused it, if any
+	Err error
+}
+
+// New returns an error of the code
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Errorf returns an error of the code, formatted as with fmt.Errorf. An error wrapped with %w is
+// kept as the cause.
+func Errorf(code Code, format string, args ...any) *Error {
+	err := fmt.Errorf(format, args...)
+	return &Error{Code: code, Message: err.Error(), Err: errors.Unwrap(err)}
+}
+
+// Wrap returns an error of the code caused by err, with message in front of its own
+func Wrap(code Code, err error, message string) *Error {
+	return &Error{Code: code, Message: message + ": " + err.Error(), Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is an *Error of the same code and, unless it has none, message
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code && (t.Message == "" || t.Message == e.Message)
+}
+
+// ErrorCode returns the code of the error
+func (e *Error) ErrorCode() Code {
+	return e.Code
+}
+
+// Coder is implemented by the errors of other packages that fall into a category, such as the
+// provider timeouts of the ai package. Embedding applications can implement it for their own.
+type Coder interface {
+	ErrorCode() Code
+}
+
+// CodeOf returns the code of the first error in err's chain that has one, Internal if none does,
+// or "" for a nil err
+func CodeOf(err error) Code {
+	if err == nil {
+		return ""
+	}
+	var c Coder
+	if errors.As(err, &c) {
+		return c.ErrorCode()
+	}
+	return Internal
+}
+
+// HasCode reports whether any error in err's chain has the code
+func HasCode(err error, code Code) bool {
+	if err == nil {
+		return false
+	}
+	if c, ok := err.(Coder); ok && c.ErrorCode() == code {
+		return true
+	}
+	switch u := err.(type) {
+	case interface{ Unwrap() error }:
+		return HasCode(u.Unwrap(), code)
+	case interface{ Unwrap() []error }:
+		for _, err := range u.Unwrap() {
+			if HasCode(err, code) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package errors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// timeout is an error of another package with a code of its own
+type timeout struct{}
+
+func (timeout) Error() string   { return "timed out" }
+func (timeout) ErrorCode() Code { return ProviderTimeout }
+func (timeout) Unwrap() error   { return context.DeadlineExceeded }
+
+func TestCodes(t *testing.T) {
+	for _, tc := range []struct {
+		code   Code
+		status int
+		close  int
+	}{
+		{UnsupportedMedia, http.StatusUnsupportedMediaType, 4415},
+		{UpgradeRequired, http.StatusUpgradeRequired, 4426},
+		{PolicyViolation, http.StatusInternalServerError, 1008},
+		{Overloaded, http.StatusServiceUnavailable, 1013},
+		{Restarting, http.StatusServiceUnavailable, 1012},
+		{ProviderTimeout, http.StatusInternalServerError, 1011},
+	} {
+		if s, c := tc.code.Status(), tc.code.CloseCode(); s != tc.status || c != tc.close {
+			t.Errorf("%s: expected status %d and close code %d, got %d and %d", tc.code, tc.status, tc.close, s, c)
+		}
+	}
+	if c := ForStatus(http.StatusTooManyRequests); c != RateLimited {
+		t.Fatalf("expected 429 to be %s, got %s", RateLimited, c)
+	}
+	if c := ForStatus(http.StatusConflict); c != InvalidRequest {
+		t.Fatalf("expected other client errors to be %s, got %s", InvalidRequest, c)
+	}
+	if c := ForStatus(http.StatusBadGateway); c != Internal {
+		t.Fatalf("expected other server errors to be %s, got %s", Internal, c)
+	}
+}
+
+func TestError(t *testing.T) {
+	sentinel := New(Overloaded, "memory budget exceeded")
+	err := fmt.Errorf("session ended: %w", New(Overloaded, "memory budget exceeded"))
+	if !errors.Is(err, sentinel) || !errors.Is(err, &Error{Code: Overloaded}) {
+		t.Fatal("expected errors of the same code and message to match")
+	}
+	if errors.Is(err, New(Overloaded, "session reaped")) || errors.Is(err, &Error{Code: Restarting}) {
+		t.Fatal("expected errors of another message or code not to match")
+	}
+	if c := CodeOf(err); c != Overloaded {
+		t.Fatalf("expected %s, got %s", Overloaded, c)
+	}
+	if c := CodeOf(io.EOF); c != Internal {
+		t.Fatalf("expected errors without a code to be %s, got %s", Internal, c)
+	}
+	if c := CodeOf(nil); c != "" {
+		t.Fatalf("expected no code for no error, got %s", c)
+	}
+
+	wrapped := Wrap(ProviderFailed, io.ErrUnexpectedEOF, "websocket connection failed")
+	if wrapped.Error() != "websocket connection failed: unexpected EOF" || !errors.Is(wrapped, io.ErrUnexpectedEOF) {
+		t.Fatalf("cause not wrapped: %v", wrapped)
+	}
+	formatted := Errorf(ProviderFailed, "connection failed with status %d: %w", 502, io.EOF)
+	if formatted.Error() != "connection failed with status 502: EOF" || !errors.Is(formatted, io.EOF) {
+		t.Fatalf("cause not kept: %v", formatted)
+	}
+
+	// a provider timeout under a failure of the provider has both codes
+	err = Wrap(ProviderFailed, fmt.Errorf("connect: %w", timeout{}), "could not create provider")
+	if !HasCode(err, ProviderFailed) || !HasCode(err, ProviderTimeout) || HasCode(err, Overloaded) {
+		t.Fatalf("unexpected codes of %v", err)
+	}
+	if !HasCode(errors.Join(io.EOF, timeout{}), ProviderTimeout) {
+		t.Fatal("code of a joined error not found")
+	}
+}
@@ -0,0 +1,220 @@
+// Package events publishes a normalized stream of what happens in sessions, for customers feeding
+// conversations into their data lakes: session state changes, transcripts and quality of service.
+// Every event is JSON, keyed by its session ID so that a Kafka producer keeps the events of a
+// session in order on one partition, and written to the topic of its kind.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/metrics"
+)
+
+// Types of events
+const (
+	SessionStarted    = "session.started"
+	SessionEnded      = "session.ended"
+	ProviderOffline   = "provider.offline"
+	ProviderRecovered = "provider.recovered"
+	TurnTranscribed   = "turn.transcribed"
+	SessionQoS        = "session.qos"
+)
+
+// Kinds of events, which route them to topics
+const (
+	KindState      = "state"
+	KindTranscript = "transcript"
+	KindQoS        = "qos"
+)
+
+// Outcomes of events, as counted in pixa_events_total
+const (
+	Published = "published"
+	Failed    = "failed"
+	// Dropped events found the queue full
+	Dropped = "dropped"
+)
+
+// kinds are the kinds of the event types
+var kinds = map[string]string{
+	SessionStarted:    KindState,
+	SessionEnded:      KindState,
+	ProviderOffline:   KindState,
+	ProviderRecovered: KindState,
+	TurnTranscribed:   KindTranscript,
+	SessionQoS:        KindQoS,
+}
+
+// Event is something that happened in a session
+type Event struct {
+	Type      string    `json:"type"`
+	SessionID string    `json:"session_id"`
+	DeviceID  string    `json:"device_id,omitempty"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	At        time.Time `json:"at"`
+	// Data depends on the type: a SessionStart, SessionEnd, ProviderState, store.Turn or QoS
+	Data any `json:"data,omitempty"`
+}
+
+// SessionStart is the data of session.started
+type SessionStart struct {
+	CorrelationID   string            `json:"correlation_id,omitempty"`
+	Tags            map[string]string `json:"tags,omitempty"`
+	ProtocolVersion int               `json:"protocol_version"`
+	FirmwareVersion string            `json:"firmware_version,omitempty"`
+	Codec           string            `json:"codec"`
+	SampleRate      int               `json:"sample_rate"`
+}
+
+// SessionEnd is the data of session.ended
+type SessionEnd struct {
+	DurationMs int64 `json:"duration_ms"`
+	Turns      int   `json:"turns"`
+	// Flagged sessions ended with an error, see FlagReason
+	Flagged    bool   `json:"flagged,omitempty"`
+	FlagReason string `json:"flag_reason,omitempty"`
+}
+
+// ProviderState is the data of provider.offline and provider.recovered
+type ProviderState struct {
+	Reason string `json:"reason,omitempty"`
+	// Action, BufferedMs and DroppedMs are what happened to the audio buffered during the outage
+	Action     string `json:"action,omitempty"`
+	BufferedMs int64  `json:"buffered_ms,omitempty"`
+	DroppedMs  int64  `json:"dropped_ms,omitempty"`
+}
+
+// QoS is the data of session.qos, sent as the session ends: how its audio frames fared and the
+// latency of each stage of its pipeline, as in the admin API's heat report
+type QoS struct {
+	AudioFrames     int64 `json:"audio_frames"`
+	CorruptedFrames int64 `json:"corrupted_frames"`
+	// Lost, Reordered and Late count frames going by their headers, for devices sending them
+	Lost      int64 `json:"lost,omitempty"`
+	Reordered int64 `json:"reordered,omitempty"`
+	Late      int64 `json:"late,omitempty"`
+	// Stages are the latencies of the pipeline stages, by stage
+	Stages map[string]StageQoS `json:"stages,omitempty"`
+}
+
+// StageQoS is the latency of a pipeline stage over a session
+type StageQoS struct {
+	Samples uint64  `json:"samples"`
+	MeanMs  float64 `json:"mean_ms"`
+	P95Ms   float64 `json:"p95_ms"`
+	MaxMs   float64 `json:"max_ms"`
+}
+
+// Producer writes a message to a topic, such as a kafka.Producer. Messages with the same key must
+// go to the same partition, in the order they are produced. Embedding applications can wrap the
+// client of another broker, or the Kafka client they already use.
+type Producer interface {
+	Produce(ctx context.Context, topic string, key, value []byte) error
+}
+
+// message is an event waiting to be produced
+type message struct {
+	kind, topic string
+	key, value  []byte
+}
+
+// Publisher queues events and produces them in the background, so that sessions never wait on
+// the producer. A nil *Publisher publishes nothing.
+type Publisher struct {
+	producer Producer
+	topics   map[string]string
+	timeout  time.Duration
+	queue    chan message
+	logger   *slog.Logger
+	events   *metrics.CounterVec
+}
+
+// Option configures a Publisher
+type Option func(*Publisher)
+
+// WithLogger sets the publisher's logger. By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(p *Publisher) {
+		p.logger = logger
+	}
+}
+
+// WithMetrics counts the events published, failed and dropped in pixa_events_total
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(p *Publisher) {
+		p.events = reg.Counter("pixa_events_total", "Session events, by kind and outcome.", "kind", "outcome")
+	}
+}
+
+// New creates a publisher producing to the configured topics. Kinds without a topic are not
+// published.
+func New(cfg config.EventsConfig, producer Producer, opts ...Option) *Publisher {
+	timeout, _ := time.ParseDuration(cfg.Timeout)
+	p := &Publisher{
+		producer: producer,
+		topics:   map[string]string{KindState: cfg.Topics.State, KindTranscript: cfg.Topics.Transcript, KindQoS: cfg.Topics.QoS},
+		timeout:  timeout,
+		queue:    make(chan message, max(cfg.Queue, 1)),
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Publish queues an event. Events of kinds without a topic are left out, and events that find the
+// queue full are dropped.
+func (p *Publisher) Publish(e Event) {
+	if p == nil {
+		return
+	}
+	kind := kinds[e.Type]
+	topic := p.topics[kind]
+	if topic == "" {
+		return
+	}
+	value, err := json.Marshal(e)
+	if err != nil {
+		p.logger.Error("Could not encode event", "type", e.Type, "session_id", e.SessionID, "error", err)
+		return
+	}
+	select {
+	case p.queue <- message{kind: kind, topic: topic, key: []byte(e.SessionID), value: value}:
+	default:
+		p.count(kind, Dropped)
+		p.logger.Warn("Dropping event, the queue is full", "type", e.Type, "session_id", e.SessionID)
+	}
+}
+
+// Run produces the queued events, one at a time so that the events of a session stay in order,
+// until ctx is done. Events still queued then are dropped.
+func (p *Publisher) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-p.queue:
+			pctx, cancel := context.WithTimeout(ctx, p.timeout)
+			err := p.producer.Produce(pctx, m.topic, m.key, m.value)
+			cancel()
+			if err != nil {
+				p.count(m.kind, Failed)
+				p.logger.Error("Could not produce event", "topic", m.topic, "session_id", string(m.key), "error", err)
+				continue
+			}
+			p.count(m.kind, Published)
+		}
+	}
+}
+
+func (p *Publisher) count(kind, outcome string) {
+	if p.events != nil {
+		p.events.With(kind, outcome).Inc()
+	}
+}
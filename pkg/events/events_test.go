@@ -0,0 +1,92 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/metrics"
+)
+
+// fakeProducer hands the messages produced to the test, failing those of the fail topic
+type fakeProducer struct {
+	produced chan producedMessage
+	fail     string
+}
+
+type producedMessage struct {
+	topic, key string
+	event      map[string]any
+}
+
+func (f *fakeProducer) Produce(_ context.Context, topic string, key, value []byte) error {
+	if topic == f.fail {
+		return errors.New("broker unavailable")
+	}
+	var event map[string]any
+	if err := json.Unmarshal(value, &event); err != nil {
+		return err
+	}
+	f.produced <- producedMessage{topic, string(key), event}
+	return nil
+}
+
+func TestPublisher(t *testing.T) {
+	cfg := config.EventsConfig{Topics: config.EventTopics{State: "sessions", Transcript: "transcripts", QoS: "sessions"}, Queue: 3, Timeout: "1s"}
+	reg := metrics.NewRegistry()
+	producer := &fakeProducer{produced: make(chan producedMessage, 10), fail: "transcripts"}
+	p := New(cfg, producer, WithMetrics(reg))
+
+	at := time.Unix(1700000000, 0).UTC()
+	p.Publish(Event{Type: SessionStarted, SessionID: "s1", TenantID: "acme", At: at, Data: SessionStart{Codec: "pcm16", SampleRate: 16000}})
+	p.Publish(Event{Type: TurnTranscribed, SessionID: "s1", At: at})
+	p.Publish(Event{Type: SessionQoS, SessionID: "s1", At: at, Data: QoS{AudioFrames: 50}})
+	// the queue is full
+	p.Publish(Event{Type: SessionEnded, SessionID: "s1", At: at})
+	// unknown types have no topic
+	p.Publish(Event{Type: "session.unknown", SessionID: "s1", At: at})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+	for _, want := range []string{SessionStarted, SessionQoS} {
+		select {
+		case m := <-producer.produced:
+			if m.topic != "sessions" || m.key != "s1" || m.event["type"] != want {
+				t.Fatalf("expected %s keyed by session to sessions, got %+v", want, m)
+			}
+			if want == SessionStarted && m.event["data"].(map[string]any)["sample_rate"] != 16000.0 {
+				t.Fatalf("expected the session's sample rate, got %v", m.event["data"])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s was not produced", want)
+		}
+	}
+
+	var out strings.Builder
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(out.String(), `outcome="failed"`); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the failed transcript was not counted in\n%s", out.String())
+		}
+		out.Reset()
+		reg.WriteTo(&out)
+	}
+	for _, want := range []string{
+		`pixa_events_total{kind="state",outcome="published"} 1`,
+		`pixa_events_total{kind="qos",outcome="published"} 1`,
+		`pixa_events_total{kind="transcript",outcome="failed"} 1`,
+		`pixa_events_total{kind="state",outcome="dropped"} 1`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %s in\n%s", want, out.String())
+		}
+	}
+
+	// a nil publisher publishes nothing
+	var none *Publisher
+	none.Publish(Event{Type: SessionStarted, SessionID: "s2"})
+}
@@ -0,0 +1,462 @@
+// Package kafka is a minimal Kafka producer for session events, speaking the Kafka protocol to the
+// brokers directly so that the relay needs no Kafka client. It looks the partitions of topics up
+// with Metadata v1 and writes every message as a record batch of its own with Produce v3, which
+// brokers from 0.11 on accept.
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// API keys and versions of the requests the producer sends
+const (
+	apiProduce  = 0
+	apiMetadata = 3
+
+	produceVersion  = 3
+	metadataVersion = 1
+)
+
+// maxResponse bounds the responses read from a broker
+const maxResponse = 16 << 20
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Error is an error code returned by a broker
+type Error int16
+
+func (e Error) Error() string {
+	return "kafka: broker error code " + strconv.Itoa(int(e))
+}
+
+// Producer produces messages to the brokers of a Kafka cluster, to the partition of their key. It
+// implements events.Producer and is safe for concurrent use.
+type Producer struct {
+	config config.KafkaConfig
+
+	mu sync.Mutex
+	// brokers are the addresses of the cluster's brokers by node ID, as of the last metadata
+	brokers map[int32]string
+	// leaders are the leaders of the partitions of topics, by partition
+	leaders map[string][]int32
+	conns   map[string]*brokerConn
+}
+
+// brokerConn is a connection to a broker. Requests on it are sent one at a time.
+type brokerConn struct {
+	mu          sync.Mutex
+	conn        net.Conn
+	r           *bufio.Reader
+	correlation int32
+}
+
+// New creates a producer for the brokers of cfg. Connections are opened when needed.
+func New(cfg config.KafkaConfig) *Producer {
+	return &Producer{config: cfg, brokers: make(map[int32]string), leaders: make(map[string][]int32), conns: make(map[string]*brokerConn)}
+}
+
+// Close closes the connections to the brokers
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, c := range p.conns {
+		c.conn.Close()
+		delete(p.conns, addr)
+	}
+	return nil
+}
+
+// Produce writes a message to the partition of its key, waiting for the brokers to acknowledge it
+// as set by kafka.acks. Keys are partitioned like the Java client's default partitioner, so other
+// producers of the same keys write to the same partitions. After a failure the partitions of the
+// topic are looked up again, in case its leaders moved.
+func (p *Producer) Produce(ctx context.Context, topic string, key, value []byte) error {
+	leaders, err := p.partitions(ctx, topic)
+	if err != nil {
+		return err
+	}
+	partition := int32(murmur2(key)&0x7fffffff) % int32(len(leaders))
+	if err := p.produce(ctx, topic, partition, leaders[partition], key, value); err != nil {
+		p.mu.Lock()
+		delete(p.leaders, topic)
+		p.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (p *Producer) produce(ctx context.Context, topic string, partition, leader int32, key, value []byte) error {
+	p.mu.Lock()
+	addr, ok := p.brokers[leader]
+	p.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("kafka: no broker for the leader of %s/%d", topic, partition)
+	}
+
+	var req []byte
+	req = binary.BigEndian.AppendUint16(req, 0xffff) // no transactional ID
+	req = binary.BigEndian.AppendUint16(req, uint16(int16(p.config.Acks)))
+	req = binary.BigEndian.AppendUint32(req, uint32(timeoutMs(ctx)))
+	req = binary.BigEndian.AppendUint32(req, 1)
+	req = appendString(req, topic)
+	req = binary.BigEndian.AppendUint32(req, 1)
+	req = binary.BigEndian.AppendUint32(req, uint32(partition))
+	batch := recordBatch(time.Now(), key, value)
+	req = binary.BigEndian.AppendUint32(req, uint32(len(batch)))
+	req = append(req, batch...)
+
+	resp, err := p.roundTrip(ctx, addr, apiProduce, produceVersion, req)
+	if err != nil {
+		return err
+	}
+	d := decoder{b: resp}
+	for range d.count() {
+		d.string()
+		for range d.count() {
+			d.int32()
+			code := d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+			if d.err == nil && code != 0 {
+				return fmt.Errorf("kafka: producing to %s/%d: %w", topic, partition, Error(code))
+			}
+		}
+	}
+	return d.err
+}
+
+// partitions returns the leaders of the partitions of topic, looking them up if they are not known
+func (p *Producer) partitions(ctx context.Context, topic string) ([]int32, error) {
+	p.mu.Lock()
+	leaders, ok := p.leaders[topic]
+	p.mu.Unlock()
+	if ok {
+		return leaders, nil
+	}
+
+	var req []byte
+	req = binary.BigEndian.AppendUint32(req, 1)
+	req = appendString(req, topic)
+	var lastErr error
+	for _, addr := range p.config.Brokers {
+		resp, err := p.roundTrip(ctx, addr, apiMetadata, metadataVersion, req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return p.readMetadata(topic, resp)
+	}
+	return nil, lastErr
+}
+
+// readMetadata keeps the brokers and the partition leaders of a metadata response
+func (p *Producer) readMetadata(topic string, resp []byte) ([]int32, error) {
+	d := decoder{b: resp}
+	brokers := make(map[int32]string)
+	for range d.count() {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.int32() // controller
+	var leaders []int32
+	var topicErr Error
+	for range d.count() {
+		code := d.int16()
+		name := d.string()
+		d.int8() // internal
+		for range d.count() {
+			d.int16()
+			index := d.int32()
+			leader := d.int32()
+			d.skipInt32s() // replicas
+			d.skipInt32s() // in-sync replicas
+			if name == topic && index >= 0 && index < 1<<16 {
+				for int(index) >= len(leaders) {
+					leaders = append(leaders, -1)
+				}
+				leaders[index] = leader
+			}
+		}
+		if name == topic {
+			topicErr = Error(code)
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if topicErr != 0 {
+		return nil, fmt.Errorf("kafka: looking up %s: %w", topic, topicErr)
+	}
+	if len(leaders) == 0 {
+		return nil, fmt.Errorf("kafka: topic %s has no partitions", topic)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, addr := range brokers {
+		p.brokers[id] = addr
+	}
+	p.leaders[topic] = leaders
+	return leaders, nil
+}
+
+// roundTrip sends a request to the broker at addr and returns the body of its response.
+// Connections that fail are closed rather than reused.
+func (p *Producer) roundTrip(ctx context.Context, addr string, apiKey, apiVersion int16, body []byte) ([]byte, error) {
+	c, err := p.conn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp, err := c.roundTrip(ctx, p.config.ClientID, apiKey, apiVersion, body)
+	if err != nil {
+		c.conn.Close()
+		p.mu.Lock()
+		if p.conns[addr] == c {
+			delete(p.conns, addr)
+		}
+		p.mu.Unlock()
+	}
+	return resp, err
+}
+
+// conn returns the connection to the broker at addr, dialing it if there is none
+func (p *Producer) conn(ctx context.Context, addr string) (*brokerConn, error) {
+	p.mu.Lock()
+	c, ok := p.conns[addr]
+	p.mu.Unlock()
+	if ok {
+		return c, nil
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: %w", err)
+	}
+	c = &brokerConn{conn: conn, r: bufio.NewReader(conn)}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if other, ok := p.conns[addr]; ok {
+		conn.Close()
+		return other, nil
+	}
+	p.conns[addr] = c
+	return c, nil
+}
+
+// roundTrip writes a request with a v1 header and reads its response, within the deadline of ctx
+func (c *brokerConn) roundTrip(ctx context.Context, clientID string, apiKey, apiVersion int16, body []byte) ([]byte, error) {
+	if d, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(d)
+	} else {
+		c.conn.SetDeadline(time.Time{})
+	}
+	c.correlation++
+
+	req := make([]byte, 4, 14+len(clientID)+len(body))
+	req = binary.BigEndian.AppendUint16(req, uint16(apiKey))
+	req = binary.BigEndian.AppendUint16(req, uint16(apiVersion))
+	req = binary.BigEndian.AppendUint32(req, uint32(c.correlation))
+	req = appendString(req, clientID)
+	req = append(req, body...)
+	binary.BigEndian.PutUint32(req, uint32(len(req)-4))
+	if _, err := c.conn.Write(req); err != nil {
+		return nil, fmt.Errorf("kafka: %w", err)
+	}
+
+	var header [8]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, fmt.Errorf("kafka: %w", err)
+	}
+	size := int32(binary.BigEndian.Uint32(header[:4]))
+	if size < 4 || size > maxResponse {
+		return nil, fmt.Errorf("kafka: invalid response size %d", size)
+	}
+	if correlation := int32(binary.BigEndian.Uint32(header[4:])); correlation != c.correlation {
+		return nil, fmt.Errorf("kafka: response %d to request %d", correlation, c.correlation)
+	}
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return nil, fmt.Errorf("kafka: %w", err)
+	}
+	return resp, nil
+}
+
+// recordBatch encodes a v2 record batch holding a single record
+func recordBatch(at time.Time, key, value []byte) []byte {
+	var record []byte
+	record = append(record, 0)              // attributes
+	record = binary.AppendVarint(record, 0) // timestamp delta
+	record = binary.AppendVarint(record, 0) // offset delta
+	record = appendBytes(record, key)
+	record = appendBytes(record, value)
+	record = binary.AppendVarint(record, 0) // headers
+
+	// the CRC covers the batch from its attributes on
+	var tail []byte
+	tail = binary.BigEndian.AppendUint16(tail, 0) // attributes: no compression, create time
+	tail = binary.BigEndian.AppendUint32(tail, 0) // last offset delta
+	ms := at.UnixMilli()
+	tail = binary.BigEndian.AppendUint64(tail, uint64(ms))
+	tail = binary.BigEndian.AppendUint64(tail, uint64(ms))
+	tail = binary.BigEndian.AppendUint64(tail, 0xffffffffffffffff) // no producer ID
+	tail = binary.BigEndian.AppendUint16(tail, 0xffff)             // nor epoch
+	tail = binary.BigEndian.AppendUint32(tail, 0xffffffff)         // nor sequence
+	tail = binary.BigEndian.AppendUint32(tail, 1)
+	tail = binary.AppendVarint(tail, int64(len(record)))
+	tail = append(tail, record...)
+
+	var batch []byte
+	batch = binary.BigEndian.AppendUint64(batch, 0) // base offset
+	batch = binary.BigEndian.AppendUint32(batch, uint32(4+1+4+len(tail)))
+	batch = binary.BigEndian.AppendUint32(batch, 0xffffffff) // partition leader epoch
+	batch = append(batch, 2)                                 // magic
+	batch = binary.BigEndian.AppendUint32(batch, crc32.Checksum(tail, castagnoli))
+	return append(batch, tail...)
+}
+
+// timeoutMs is how long the brokers may take to acknowledge a message, the time left to ctx
+func timeoutMs(ctx context.Context) int32 {
+	d, ok := ctx.Deadline()
+	if !ok {
+		return 30000
+	}
+	return int32(max(time.Until(d).Milliseconds(), 1))
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// appendBytes appends the varint length and content of a record's key or value, null when nil
+func appendBytes(b, data []byte) []byte {
+	if data == nil {
+		return binary.AppendVarint(b, -1)
+	}
+	b = binary.AppendVarint(b, int64(len(data)))
+	return append(b, data...)
+}
+
+// murmur2 is the hash the Java client's default partitioner partitions keys by
+func murmur2(data []byte) uint32 {
+	const seed, m, r = 0x9747b28c, 0x5bd1e995, 24
+	h := uint32(seed) ^ uint32(len(data))
+	for len(data) >= 4 {
+		k := binary.LittleEndian.Uint32(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+		data = data[4:]
+	}
+	switch len(data) {
+	case 3:
+		h ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// errShort is the error of responses that end early
+var errShort = errors.New("kafka: short response")
+
+// decoder reads the fields of a response, keeping the first error
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.b) < n {
+		d.err = errShort
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a string, empty when it is null
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// count reads the length of an array, 0 when it is null or the response ended
+func (d *decoder) count() int {
+	n := d.int32()
+	if d.err != nil || n < 0 {
+		return 0
+	}
+	// every element takes at least a byte, so longer arrays are corrupt
+	if int(n) > len(d.b) {
+		d.err = errShort
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) skipInt32s() {
+	d.take(4 * d.count())
+}
@@ -0,0 +1,264 @@
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// fakeBroker is a single broker leading every partition of its topics. It answers Metadata v1 and
+// Produce v3 requests, keeping the records produced by partition and failing the produce of
+// partitions set in fail.
+type fakeBroker struct {
+	t          *testing.T
+	host       string
+	port       int32
+	partitions int
+
+	mu       sync.Mutex
+	records  map[int32][]record
+	fail     map[int32]int16
+	metadata int
+}
+
+type record struct {
+	topic, key, value string
+}
+
+func (b *fakeBroker) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				var size [4]byte
+				if _, err := io.ReadFull(r, size[:]); err != nil {
+					return
+				}
+				req := make([]byte, binary.BigEndian.Uint32(size[:]))
+				if _, err := io.ReadFull(r, req); err != nil {
+					return
+				}
+				d := decoder{b: req}
+				apiKey, apiVersion, correlation := d.int16(), d.int16(), d.int32()
+				d.string() // client ID
+				var resp []byte
+				switch {
+				case apiKey == apiMetadata && apiVersion == metadataVersion:
+					resp = b.metadataResponse(&d)
+				case apiKey == apiProduce && apiVersion == produceVersion:
+					resp = b.produceResponse(&d)
+				default:
+					b.t.Errorf("unexpected request %d v%d", apiKey, apiVersion)
+					return
+				}
+				out := binary.BigEndian.AppendUint32(nil, uint32(4+len(resp)))
+				out = binary.BigEndian.AppendUint32(out, uint32(correlation))
+				if _, err := conn.Write(append(out, resp...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (b *fakeBroker) metadataResponse(d *decoder) []byte {
+	var topics []string
+	for range d.count() {
+		topics = append(topics, d.string())
+	}
+	b.mu.Lock()
+	b.metadata++
+	b.mu.Unlock()
+
+	var resp []byte
+	resp = binary.BigEndian.AppendUint32(resp, 1)
+	resp = binary.BigEndian.AppendUint32(resp, 7) // node ID
+	resp = appendString(resp, b.host)
+	resp = binary.BigEndian.AppendUint32(resp, uint32(b.port))
+	resp = binary.BigEndian.AppendUint16(resp, 0xffff) // no rack
+	resp = binary.BigEndian.AppendUint32(resp, 7)      // controller
+	resp = binary.BigEndian.AppendUint32(resp, uint32(len(topics)))
+	for _, topic := range topics {
+		resp = binary.BigEndian.AppendUint16(resp, 0)
+		resp = appendString(resp, topic)
+		resp = append(resp, 0)
+		resp = binary.BigEndian.AppendUint32(resp, uint32(b.partitions))
+		for i := range b.partitions {
+			resp = binary.BigEndian.AppendUint16(resp, 0)
+			resp = binary.BigEndian.AppendUint32(resp, uint32(i))
+			resp = binary.BigEndian.AppendUint32(resp, 7) // leader
+			resp = binary.BigEndian.AppendUint32(resp, 1)
+			resp = binary.BigEndian.AppendUint32(resp, 7)
+			resp = binary.BigEndian.AppendUint32(resp, 1)
+			resp = binary.BigEndian.AppendUint32(resp, 7)
+		}
+	}
+	return resp
+}
+
+func (b *fakeBroker) produceResponse(d *decoder) []byte {
+	if d.int16() != -1 {
+		b.t.Error("expected no transactional ID")
+	}
+	if acks := d.int16(); acks != -1 {
+		b.t.Errorf("expected acks from all replicas, got %d", acks)
+	}
+	d.int32() // timeout
+
+	var resp []byte
+	topics := d.count()
+	resp = binary.BigEndian.AppendUint32(resp, uint32(topics))
+	for range topics {
+		topic := d.string()
+		resp = appendString(resp, topic)
+		partitions := d.count()
+		resp = binary.BigEndian.AppendUint32(resp, uint32(partitions))
+		for range partitions {
+			partition := d.int32()
+			batch := d.take(int(d.int32()))
+			key, value, err := readBatch(batch)
+			if err != nil {
+				b.t.Errorf("invalid record batch: %v", err)
+			}
+			b.mu.Lock()
+			code := b.fail[partition]
+			if code == 0 {
+				b.records[partition] = append(b.records[partition], record{topic, key, value})
+			}
+			b.mu.Unlock()
+			resp = binary.BigEndian.AppendUint32(resp, uint32(partition))
+			resp = binary.BigEndian.AppendUint16(resp, uint16(code))
+			resp = binary.BigEndian.AppendUint64(resp, 0)
+			resp = binary.BigEndian.AppendUint64(resp, 0xffffffffffffffff)
+		}
+	}
+	return binary.BigEndian.AppendUint32(resp, 0) // throttle time
+}
+
+// readBatch checks a record batch as a broker would and returns the key and value of its record
+func readBatch(batch []byte) (key, value string, err error) {
+	d := decoder{b: batch}
+	d.int64() // base offset
+	if n := d.int32(); int(n) != len(d.b) {
+		return "", "", errors.New("batch length " + strconv.Itoa(int(n)) + " of " + strconv.Itoa(len(d.b)) + " bytes")
+	}
+	d.int32() // partition leader epoch
+	if magic := d.int8(); magic != 2 {
+		return "", "", errors.New("magic " + strconv.Itoa(int(magic)))
+	}
+	if crc := uint32(d.int32()); crc != crc32.Checksum(d.b, crc32.MakeTable(crc32.Castagnoli)) {
+		return "", "", errors.New("CRC mismatch")
+	}
+	d.take(2 + 4 + 8 + 8 + 8 + 2 + 4)
+	if n := d.int32(); n != 1 {
+		return "", "", errors.New(strconv.Itoa(int(n)) + " records")
+	}
+	varint := func() int {
+		v, n := binary.Varint(d.b)
+		d.take(n)
+		return int(v)
+	}
+	varint() // length
+	d.int8()
+	varint()
+	varint()
+	key = string(d.take(varint()))
+	value = string(d.take(varint()))
+	if varint() != 0 || len(d.b) != 0 {
+		return "", "", errors.New("trailing headers or bytes")
+	}
+	return key, value, d.err
+}
+
+func newFakeBroker(t *testing.T, partitions int) (*fakeBroker, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	addr := ln.Addr().(*net.TCPAddr)
+	b := &fakeBroker{t: t, host: addr.IP.String(), port: int32(addr.Port), partitions: partitions, records: make(map[int32][]record), fail: make(map[int32]int16)}
+	go b.serve(ln)
+	return b, ln.Addr().String()
+}
+
+func TestProducer(t *testing.T) {
+	broker, addr := newFakeBroker(t, 4)
+	// the first broker is down, the cluster is looked up from the next
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	down.Close()
+	p := New(config.KafkaConfig{Brokers: []string{down.Addr().String(), addr}, ClientID: "pixa-relay", Acks: -1})
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, m := range []record{
+		{"pixa.sessions", "session-1", `{"type":"session.started"}`},
+		{"pixa.sessions", "session-2", `{"type":"session.started"}`},
+		{"pixa.sessions", "session-1", `{"type":"session.ended"}`},
+	} {
+		if err := p.Produce(ctx, m.topic, []byte(m.key), []byte(m.value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// keys go to the partitions of the Java client's default partitioner, the events of a session
+	// in the order they were produced
+	broker.mu.Lock()
+	want := int32(murmur2([]byte("session-1"))&0x7fffffff) % 4
+	got := broker.records[want]
+	if len(got) < 2 || got[0].key != "session-1" || got[0].value != `{"type":"session.started"}` || got[len(got)-1].value != `{"type":"session.ended"}` {
+		t.Fatalf("expected the events of session-1 in order on partition %d, got %v", want, broker.records)
+	}
+	if broker.metadata != 1 {
+		t.Fatalf("expected the topic to be looked up once, got %d", broker.metadata)
+	}
+	broker.fail[want] = 6 // NOT_LEADER_OR_FOLLOWER
+	broker.mu.Unlock()
+
+	var kafkaErr Error
+	if err := p.Produce(ctx, "pixa.sessions", []byte("session-1"), []byte("{}")); !errors.As(err, &kafkaErr) || kafkaErr != 6 {
+		t.Fatalf("expected the broker's error, got %v", err)
+	}
+	broker.mu.Lock()
+	delete(broker.fail, want)
+	broker.mu.Unlock()
+	if err := p.Produce(ctx, "pixa.sessions", []byte("session-1"), []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if broker.metadata != 2 {
+		t.Fatalf("expected the topic to be looked up again after a failure, got %d lookups", broker.metadata)
+	}
+}
+
+func TestMurmur2(t *testing.T) {
+	// hashes of the Java client's Utils.murmur2
+	for key, want := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+	} {
+		if got := int32(murmur2([]byte(key))); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", key, got, want)
+		}
+	}
+}
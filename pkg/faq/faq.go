@@ -0,0 +1,227 @@
+// Package faq caches the assistant's answers by question for FAQ mode, where kiosks answer the
+// same questions over and over: a question close enough to one answered before gets the cached
+// audio and text back without asking the model.
+package faq
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// fillers are words that do not change what is being asked
+var fillers = map[string]bool{
+	"um": true, "uh": true, "er": true, "hey": true, "hi": true, "please": true, "so": true,
+	"well": true, "okay": true, "ok": true, "the": true, "a": true, "an": true,
+}
+
+// Answer is a cached answer to a question
+type Answer struct {
+	// Question is the question as first asked
+	Question string `json:"question"`
+	Text     string `json:"text"`
+	// Audio is mono 16 bit PCM at SampleRate
+	Audio      []byte    `json:"-"`
+	SampleRate int       `json:"sample_rate"`
+	CreatedAt  time.Time `json:"created_at"`
+	Hits       int64     `json:"hits"`
+}
+
+// Entry is a cached answer and the tenant it belongs to
+type Entry struct {
+	TenantID string `json:"tenant_id,omitempty"`
+	Answer
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type key struct {
+	tenantID   string
+	normalized string
+}
+
+type entry struct {
+	answer Answer
+	words  map[string]bool
+}
+
+// Cache holds the answers of each tenant, keyed by normalized question. It is safe for concurrent use.
+type Cache struct {
+	ttl           time.Duration
+	maxEntries    int
+	minSimilarity float64
+	clock         clock.Clock
+
+	mu      sync.Mutex
+	entries map[key]*entry
+}
+
+// NewCache creates an empty cache configured by cfg, whose answers expire on clk
+func NewCache(cfg config.FAQConfig, clk clock.Clock) *Cache {
+	ttl, _ := time.ParseDuration(cfg.TTL)
+	return &Cache{
+		ttl:           ttl,
+		maxEntries:    cfg.MaxEntries,
+		minSimilarity: cfg.MinSimilarity,
+		clock:         clk,
+		entries:       make(map[key]*entry),
+	}
+}
+
+// Normalize reduces a question to the words that matter: lower cased, without punctuation or filler words
+func Normalize(question string) string {
+	return strings.Join(words(question), " ")
+}
+
+func words(question string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(question), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	})
+	out := fields[:0]
+	for _, w := range fields {
+		if w = strings.Trim(w, "'"); w != "" && !fillers[w] {
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+func wordSet(words []string) map[string]bool {
+	set := make(map[string]bool, len(words))
+	for _, w := range words {
+		set[w] = true
+	}
+	return set
+}
+
+// similarity is the share of the words of either question that both have in common
+func similarity(a, b map[string]bool) float64 {
+	common := 0
+	for w := range a {
+		if b[w] {
+			common++
+		}
+	}
+	union := len(a) + len(b) - common
+	if union == 0 {
+		return 0
+	}
+	return float64(common) / float64(union)
+}
+
+func (c *Cache) expired(e *entry, now time.Time) bool {
+	return c.ttl > 0 && now.Sub(e.answer.CreatedAt) >= c.ttl
+}
+
+// Lookup returns the cached answer to the tenant's question, or to the closest question asked
+// before if it is similar enough
+func (c *Cache) Lookup(tenantID, question string) (Answer, bool) {
+	w := words(question)
+	if len(w) == 0 {
+		return Answer{}, false
+	}
+	normalized := strings.Join(w, " ")
+	now := c.clock.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	best, ok := c.entries[key{tenantID, normalized}]
+	if !ok {
+		set := wordSet(w)
+		bestScore := c.minSimilarity
+		for k, e := range c.entries {
+			if k.tenantID != tenantID || c.expired(e, now) {
+				continue
+			}
+			if score := similarity(set, e.words); score >= bestScore {
+				best, bestScore = e, score
+			}
+		}
+	}
+	if best == nil || c.expired(best, now) {
+		return Answer{}, false
+	}
+	best.answer.Hits++
+	return best.answer, true
+}
+
+// Store caches the answer to the tenant's question, evicting expired answers and, if the cache is
+// still full, the oldest one
+func (c *Cache) Store(tenantID, question string, a Answer) {
+	w := words(question)
+	if len(w) == 0 {
+		return
+	}
+	now := c.clock.Now()
+	a.Question = question
+	a.CreatedAt = now
+	a.Hits = 0
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := key{tenantID, strings.Join(w, " ")}
+	if _, ok := c.entries[k]; !ok && c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		c.evict(now)
+	}
+	c.entries[k] = &entry{answer: a, words: wordSet(w)}
+}
+
+// evict makes room for one entry
+func (c *Cache) evict(now time.Time) {
+	var oldest key
+	var oldestAt time.Time
+	for k, e := range c.entries {
+		if c.expired(e, now) {
+			delete(c.entries, k)
+			continue
+		}
+		if oldestAt.IsZero() || e.answer.CreatedAt.Before(oldestAt) {
+			oldest, oldestAt = k, e.answer.CreatedAt
+		}
+	}
+	if len(c.entries) >= c.maxEntries {
+		delete(c.entries, oldest)
+	}
+}
+
+// Purge removes the tenant's cached answer to question and returns how many answers were removed.
+// An empty question removes all of the tenant's answers, and an empty tenant and question empty
+// the cache.
+func (c *Cache) Purge(tenantID, question string) int {
+	normalized := Normalize(question)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	purged := 0
+	for k := range c.entries {
+		all := tenantID == "" && question == ""
+		if all || (k.tenantID == tenantID && (question == "" || k.normalized == normalized)) {
+			delete(c.entries, k)
+			purged++
+		}
+	}
+	return purged
+}
+
+// Entries returns the answers that have not expired, newest first
+func (c *Cache) Entries() []Entry {
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := make([]Entry, 0, len(c.entries))
+	for k, e := range c.entries {
+		if c.expired(e, now) {
+			continue
+		}
+		var expiresAt time.Time
+		if c.ttl > 0 {
+			expiresAt = e.answer.CreatedAt.Add(c.ttl)
+		}
+		entries = append(entries, Entry{TenantID: k.tenantID, Answer: e.answer, ExpiresAt: expiresAt})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CreatedAt.After(entries[j].CreatedAt) })
+	return entries
+}
@@ -0,0 +1,49 @@
+package faq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+func TestCache(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	c := NewCache(config.FAQConfig{TTL: "1h", MaxEntries: 2, MinSimilarity: 0.6}, clk)
+
+	if got := Normalize("Um, what are the opening hours?"); got != "what are opening hours" {
+		t.Fatalf("unexpected normalized question %q", got)
+	}
+
+	c.Store("acme", "What are the opening hours?", Answer{Text: "We open at nine."})
+	for _, q := range []string{"what are the opening hours", "So, what are the opening hours, please?", "what are your opening hours"} {
+		if a, ok := c.Lookup("acme", q); !ok || a.Text != "We open at nine." {
+			t.Fatalf("no answer for %q", q)
+		}
+	}
+	if _, ok := c.Lookup("acme", "where is the toilet"); ok {
+		t.Fatal("unrelated question got an answer")
+	}
+	if _, ok := c.Lookup("other", "what are the opening hours"); ok {
+		t.Fatal("answer leaked to another tenant")
+	}
+
+	clk.Advance(time.Minute)
+	c.Store("acme", "Where is the toilet?", Answer{Text: "Down the hall."})
+	c.Store("acme", "Do you sell tickets?", Answer{Text: "At the desk."})
+	if _, ok := c.Lookup("acme", "what are the opening hours"); ok || len(c.Entries()) != 2 {
+		t.Fatal("expected the oldest answer to be evicted")
+	}
+
+	if n := c.Purge("acme", "where is the toilet"); n != 1 {
+		t.Fatalf("expected one answer purged, got %d", n)
+	}
+	clk.Advance(time.Hour)
+	if _, ok := c.Lookup("acme", "do you sell tickets"); ok {
+		t.Fatal("expired answer was served")
+	}
+	if n := c.Purge("", ""); n != 1 {
+		t.Fatalf("expected the expired answer to be purged, got %d", n)
+	}
+}
@@ -0,0 +1,370 @@
+// Package metrics implements the counters, gauges and histograms the relay exposes, along with an
+// HTTP handler serving them in the Prometheus text exposition format, or in the OpenMetrics format,
+// with histogram exemplars, to scrapers that ask for it.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultBuckets are histogram buckets suited to latencies measured in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// maxExemplarRunes bounds the combined length of an exemplar's label names and values, as
+// OpenMetrics requires
+const maxExemplarRunes = 128
+
+// OpenMetricsType is the content type of the OpenMetrics text format
+const OpenMetricsType = "application/openmetrics-text"
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+// Registry holds a set of metric families and renders them for scraping
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		families: make(map[string]*family),
+	}
+}
+
+// family is a named metric along with all its label combinations
+type family struct {
+	name       string
+	help       string
+	typ        metricType
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is a single label combination of a family
+type series struct {
+	labelValues []string
+
+	mu      sync.Mutex
+	value   float64
+	counts  []uint64
+	sum     float64
+	samples uint64
+	// exemplars holds the last exemplar observed in each bucket of a histogram, +Inf last
+	exemplars []*exemplar
+}
+
+// exemplar is an observation of a histogram kept with labels pointing at where it came from,
+// such as the session it was made in
+type exemplar struct {
+	labels []string
+	value  float64
+	at     time.Time
+}
+
+func (r *Registry) register(name, help string, typ metricType, buckets []float64, labelNames []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.families[name]; ok {
+		if f.typ != typ {
+			panic(fmt.Sprintf("metrics: %s already registered as a %s", name, f.typ))
+		}
+		return f
+	}
+	f := &family{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*series),
+	}
+	r.families[name] = f
+	return f
+}
+
+func (f *family) with(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.typ == histogramType {
+			s.counts = make([]uint64, len(f.buckets))
+			s.exemplars = make([]*exemplar, len(f.buckets)+1)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter registers (or returns the already registered) counter family with the given name
+func (r *Registry) Counter(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{f: r.register(name, help, counterType, nil, labelNames)}
+}
+
+// Gauge registers (or returns the already registered) gauge family with the given name
+func (r *Registry) Gauge(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{f: r.register(name, help, gaugeType, nil, labelNames)}
+}
+
+// Histogram registers (or returns the already registered) histogram family with the given name.
+// If buckets is nil, DefaultBuckets are used.
+func (r *Registry) Histogram(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{f: r.register(name, help, histogramType, buckets, labelNames)}
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct{ f *family }
+
+// With returns the counter for the given label values
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	return &Counter{s: v.f.with(labelValues)}
+}
+
+// Counter is a monotonically increasing value
+type Counter struct{ s *series }
+
+// Inc increments the counter by one
+func (c *Counter) Inc() { c.Add(1) }
+
+// Add increments the counter by delta, which must not be negative
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.s.mu.Lock()
+	c.s.value += delta
+	c.s.mu.Unlock()
+}
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct{ f *family }
+
+// With returns the gauge for the given label values
+func (v *GaugeVec) With(labelValues ...string) *Gauge {
+	return &Gauge{s: v.f.with(labelValues)}
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct{ s *series }
+
+// Set sets the gauge to value
+func (g *Gauge) Set(value float64) {
+	g.s.mu.Lock()
+	g.s.value = value
+	g.s.mu.Unlock()
+}
+
+// Add adds delta to the gauge
+func (g *Gauge) Add(delta float64) {
+	g.s.mu.Lock()
+	g.s.value += delta
+	g.s.mu.Unlock()
+}
+
+// Inc increments the gauge by one
+func (g *Gauge) Inc() { g.Add(1) }
+
+// Dec decrements the gauge by one
+func (g *Gauge) Dec() { g.Add(-1) }
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct{ f *family }
+
+// With returns the histogram for the given label values
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	return &Histogram{s: v.f.with(labelValues), buckets: v.f.buckets}
+}
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Observe records a single observation
+func (h *Histogram) Observe(value float64) {
+	h.observe(value, nil)
+}
+
+// ObserveWithExemplar records an observation along with an exemplar, label name and value pairs
+// such as "session_id", id, that let dashboards link the bucket it falls in to where it came from.
+// Each bucket keeps its latest exemplar. Exemplars are only exposed in the OpenMetrics format, and
+// dropped if their labels are longer than OpenMetrics allows.
+func (h *Histogram) ObserveWithExemplar(value float64, labels ...string) {
+	n := 0
+	for _, l := range labels {
+		n += utf8.RuneCountInString(l)
+	}
+	if len(labels)%2 != 0 || n > maxExemplarRunes {
+		h.observe(value, nil)
+		return
+	}
+	h.observe(value, &exemplar{labels: labels, value: value, at: time.Now()})
+}
+
+func (h *Histogram) observe(value float64, e *exemplar) {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	bucket := len(h.buckets)
+	for i, upper := range h.buckets {
+		if value <= upper {
+			h.s.counts[i]++
+			bucket = min(bucket, i)
+		}
+	}
+	h.s.sum += value
+	h.s.samples++
+	if e != nil {
+		h.s.exemplars[bucket] = e
+	}
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	return r.write(w, false)
+}
+
+// WriteOpenMetrics writes all metrics in the OpenMetrics text format, histograms with their exemplars
+func (r *Registry) WriteOpenMetrics(w io.Writer) (int64, error) {
+	return r.write(w, true)
+}
+
+func (r *Registry) write(w io.Writer, openMetrics bool) (int64, error) {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	var b strings.Builder
+	for _, f := range families {
+		f.write(&b, openMetrics)
+	}
+	if openMetrics {
+		b.WriteString("# EOF\n")
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// write renders the family. In OpenMetrics, counters are named without their _total suffix, which
+// only their samples carry, and histogram buckets carry their exemplars.
+func (f *family) write(b *strings.Builder, openMetrics bool) {
+	f.mu.Lock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].labelValues, "\xff") < strings.Join(all[j].labelValues, "\xff")
+	})
+
+	name, sample := f.name, f.name
+	if openMetrics && f.typ == counterType {
+		name = strings.TrimSuffix(f.name, "_total")
+		sample = name + "_total"
+	}
+	fmt.Fprintf(b, "# HELP %s %s\n", name, f.help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, f.typ)
+	for _, s := range all {
+		s.mu.Lock()
+		switch f.typ {
+		case histogramType:
+			for i, upper := range f.buckets {
+				fmt.Fprintf(b, "%s_bucket%s %d", f.name, f.labels(s.labelValues, "le", formatFloat(upper)), s.counts[i])
+				writeExemplar(b, openMetrics, s.exemplars[i])
+			}
+			fmt.Fprintf(b, "%s_bucket%s %d", f.name, f.labels(s.labelValues, "le", "+Inf"), s.samples)
+			writeExemplar(b, openMetrics, s.exemplars[len(f.buckets)])
+			fmt.Fprintf(b, "%s_sum%s %s\n", f.name, f.labels(s.labelValues), formatFloat(s.sum))
+			fmt.Fprintf(b, "%s_count%s %d\n", f.name, f.labels(s.labelValues), s.samples)
+		default:
+			fmt.Fprintf(b, "%s%s %s\n", sample, f.labels(s.labelValues), formatFloat(s.value))
+		}
+		s.mu.Unlock()
+	}
+}
+
+// writeExemplar ends a bucket line, with its exemplar in OpenMetrics
+func writeExemplar(b *strings.Builder, openMetrics bool, e *exemplar) {
+	if openMetrics && e != nil {
+		pairs := make([]string, 0, len(e.labels)/2)
+		for i := 0; i+1 < len(e.labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", e.labels[i], e.labels[i+1]))
+		}
+		fmt.Fprintf(b, " # {%s} %s %.3f", strings.Join(pairs, ","), formatFloat(e.value), float64(e.at.UnixMilli())/1000)
+	}
+	b.WriteByte('\n')
+}
+
+// labels renders the label set of a series, with optional extra name/value pairs appended
+func (f *family) labels(values []string, extra ...string) string {
+	if len(values) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(values)+len(extra)/2)
+	for i, name := range f.labelNames {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// Handler returns an HTTP handler serving the registry's metrics. Scrapers that accept OpenMetrics,
+// as Prometheus does, are served OpenMetrics with exemplars; others the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.Header.Get("Accept"), OpenMetricsType) {
+			w.Header().Set("Content-Type", OpenMetricsType+"; version=1.0.0; charset=utf-8")
+			r.WriteOpenMetrics(w)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Run("test text exposition", func(t *testing.T) {
+		reg := NewRegistry()
+		reg.Counter("requests_total", "Requests.", "code").With("200").Add(3)
+		reg.Gauge("sessions", "Sessions.").With().Set(2)
+		h := reg.Histogram("latency_seconds", "Latency.", []float64{0.1, 1})
+		h.With().Observe(0.05)
+		h.With().Observe(0.5)
+
+		var b strings.Builder
+		reg.WriteTo(&b)
+		out := b.String()
+
+		for _, want := range []string{
+			"# TYPE requests_total counter\n",
+			`requests_total{code="200"} 3` + "\n",
+			"sessions 2\n",
+			`latency_seconds_bucket{le="0.1"} 1` + "\n",
+			`latency_seconds_bucket{le="1"} 2` + "\n",
+			`latency_seconds_bucket{le="+Inf"} 2` + "\n",
+			"latency_seconds_count 2\n",
+		} {
+			if !strings.Contains(out, want) {
+				t.Errorf("missing %q in output:\n%s", want, out)
+			}
+		}
+	})
+
+	t.Run("test re-registration returns same family", func(t *testing.T) {
+		reg := NewRegistry()
+		reg.Counter("c", "C.").With().Inc()
+		reg.Counter("c", "C.").With().Inc()
+
+		var b strings.Builder
+		reg.WriteTo(&b)
+		if !strings.Contains(b.String(), "c 2\n") {
+			t.Fatalf("expected shared counter, got:\n%s", b.String())
+		}
+	})
+}
+
+func TestOpenMetrics(t *testing.T) {
+	reg := NewRegistry()
+	reg.Counter("requests_total", "Requests.").With().Inc()
+	h := reg.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}, "op").With("send")
+	h.ObserveWithExemplar(0.05, "session_id", "s1")
+	h.ObserveWithExemplar(0.07, "session_id", "s2")
+	h.ObserveWithExemplar(5, "session_id", "s3")
+	h.ObserveWithExemplar(0.5, "session_id", strings.Repeat("x", 200))
+
+	var b strings.Builder
+	reg.WriteOpenMetrics(&b)
+	out := b.String()
+	for _, want := range []string{
+		"# TYPE requests counter\n",
+		"requests_total 1\n",
+		`latency_seconds_bucket{op="send",le="0.1"} 2 # {session_id="s2"} 0.07 `,
+		`latency_seconds_bucket{op="send",le="+Inf"} 4 # {session_id="s3"} 5 `,
+		`latency_seconds_bucket{op="send",le="1"} 3` + "\n",
+		"# EOF\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+
+	// the Prometheus text format has no exemplars
+	b.Reset()
+	reg.WriteTo(&b)
+	if strings.Contains(b.String(), "session_id") || strings.Contains(b.String(), "EOF") {
+		t.Fatalf("unexpected exemplars in text format:\n%s", b.String())
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;q=0.5")
+	rec := httptest.NewRecorder()
+	reg.Handler().ServeHTTP(rec, req)
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, OpenMetricsType) || !strings.Contains(rec.Body.String(), "# EOF") {
+		t.Fatalf("expected OpenMetrics, got %q", ct)
+	}
+}
@@ -0,0 +1,43 @@
+package policy
+
+import (
+	"net/netip"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// CountryResolver returns the ISO 3166-1 alpha-2 code of the country an address is located in, or
+// an empty string if it is not known
+type CountryResolver interface {
+	Country(addr netip.Addr) (string, error)
+}
+
+// GeoIP resolves countries from a MaxMind GeoIP2 or GeoLite2 country database
+type GeoIP struct {
+	reader *maxminddb.Reader
+}
+
+// OpenGeoIP opens the MaxMind database at path
+func OpenGeoIP(path string) (*GeoIP, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoIP{reader: reader}, nil
+}
+
+func (g *GeoIP) Country(addr netip.Addr) (string, error) {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := g.reader.Lookup(addr.AsSlice(), &record); err != nil {
+		return "", err
+	}
+	return record.Country.ISOCode, nil
+}
+
+func (g *GeoIP) Close() error {
+	return g.reader.Close()
+}
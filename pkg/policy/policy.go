@@ -0,0 +1,322 @@
+// Package policy decides whether a device is allowed to connect based on the address it connects
+// from, with global and per tenant allow lists, deny lists and country rules.
+package policy
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/metrics"
+	"github.com/pixaverse-studios/websocket-server/pkg/websocket"
+)
+
+// Rules that can reject a connection
+const (
+	DenyListRule  = "denylist"
+	AllowListRule = "allowlist"
+	CountryRule   = "country"
+)
+
+// Decision is the outcome of evaluating a connection request
+type Decision struct {
+	Allowed bool
+	// Rule is the rule that rejected the connection
+	Rule    string
+	Reason  string
+	Addr    netip.Addr
+	Country string
+}
+
+// AuditEvent records a rejected connection
+type AuditEvent struct {
+	Time     time.Time
+	Rule     string
+	Reason   string
+	Addr     netip.Addr
+	Country  string
+	DeviceID string
+	TenantID string
+}
+
+// Auditor receives an event for every rejected connection
+type Auditor func(AuditEvent)
+
+// rules is the parsed form of config.PolicyRules
+type rules struct {
+	allow            []netip.Prefix
+	deny             []netip.Prefix
+	allowedCountries map[string]bool
+	blockedCountries map[string]bool
+}
+
+// Engine evaluates the connection policy
+type Engine struct {
+	global         rules
+	tenants        map[string]rules
+	trustedProxies []netip.Prefix
+	countries      CountryResolver
+
+	logger    *slog.Logger
+	audit     Auditor
+	rejection *metrics.CounterVec
+}
+
+// Option configures an Engine
+type Option func(*Engine)
+
+// WithLogger sets the engine's logger. By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(e *Engine) {
+		e.logger = logger
+	}
+}
+
+// WithAuditor sets the function rejected connections are reported to. By default they are logged.
+func WithAuditor(a Auditor) Option {
+	return func(e *Engine) {
+		e.audit = a
+	}
+}
+
+// WithMetrics counts rejected connections in the given registry
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(e *Engine) {
+		e.rejection = reg.Counter("pixa_policy_rejections_total", "Connections rejected by the connection policy.", "rule")
+	}
+}
+
+// WithCountryResolver sets the resolver country rules are evaluated with, instead of the GeoIP
+// database named in the config
+func WithCountryResolver(r CountryResolver) Option {
+	return func(e *Engine) {
+		e.countries = r
+	}
+}
+
+// New creates an engine for the policy in cfg, opening the configured GeoIP database unless a
+// country resolver is passed in
+func New(cfg *config.Config, opts ...Option) (*Engine, error) {
+	e := &Engine{
+		tenants: make(map[string]rules),
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if e.audit == nil {
+		e.audit = e.logAudit
+	}
+
+	var err error
+	if e.global, err = parseRules(cfg.Policy.PolicyRules); err != nil {
+		return nil, err
+	}
+	for id, tenant := range cfg.Tenants {
+		if e.tenants[id], err = parseRules(tenant.Policy); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", id, err)
+		}
+	}
+	if e.trustedProxies, err = parsePrefixes(cfg.Policy.TrustedProxies); err != nil {
+		return nil, err
+	}
+
+	if e.countries == nil && cfg.Policy.GeoIPDatabase != "" {
+		if e.countries, err = OpenGeoIP(cfg.Policy.GeoIPDatabase); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// Enabled reports whether cfg sets any connection rule
+func Enabled(cfg *config.Config) bool {
+	if !cfg.Policy.Empty() {
+		return true
+	}
+	for _, tenant := range cfg.Tenants {
+		if !tenant.Policy.Empty() {
+			return true
+		}
+	}
+	return false
+}
+
+// Close releases the engine's GeoIP database
+func (e *Engine) Close() error {
+	if c, ok := e.countries.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Middleware returns a websocket middleware rejecting connections the policy does not allow. It
+// should be registered after any middleware authenticating the device, so the policy of the
+// authenticated tenant applies.
+func (e *Engine) Middleware() websocket.Middleware {
+	return websocket.Middleware{
+		OnConnect: func(r *http.Request) (*http.Request, error) {
+			deviceID, tenantID := websocket.RequestIdentity(r)
+			d := e.Evaluate(r, tenantID)
+			if d.Allowed {
+				return r, nil
+			}
+
+			if e.rejection != nil {
+				e.rejection.With(d.Rule).Inc()
+			}
+			e.audit(AuditEvent{
+				Time:     time.Now(),
+				Rule:     d.Rule,
+				Reason:   d.Reason,
+				Addr:     d.Addr,
+				Country:  d.Country,
+				DeviceID: deviceID,
+				TenantID: tenantID,
+			})
+			return nil, &websocket.RejectError{StatusCode: http.StatusForbidden, Reason: "connection not allowed by policy"}
+		},
+	}
+}
+
+// Evaluate decides whether the request may connect under the global policy and the policy of the
+// given tenant
+func (e *Engine) Evaluate(r *http.Request, tenantID string) Decision {
+	addr, ok := e.clientAddr(r)
+	if !ok {
+		return Decision{Rule: AllowListRule, Reason: "unknown client address"}
+	}
+	d := Decision{Addr: addr}
+	// tenant keys are lower cased when the config is read
+	tenant := e.tenants[strings.ToLower(tenantID)]
+
+	if contains(e.global.deny, addr) || contains(tenant.deny, addr) {
+		d.Rule, d.Reason = DenyListRule, "address is denied"
+		return d
+	}
+	allow := e.global.allow
+	if len(tenant.allow) > 0 {
+		allow = tenant.allow
+	}
+	if len(allow) > 0 && !contains(allow, addr) {
+		d.Rule, d.Reason = AllowListRule, "address is not allowed"
+		return d
+	}
+
+	allowedCountries := e.global.allowedCountries
+	if len(tenant.allowedCountries) > 0 {
+		allowedCountries = tenant.allowedCountries
+	}
+	if len(allowedCountries) > 0 || len(e.global.blockedCountries) > 0 || len(tenant.blockedCountries) > 0 {
+		if e.countries != nil {
+			country, err := e.countries.Country(addr)
+			if err != nil {
+				e.logger.Warn("Could not resolve country", "addr", addr, "error", err)
+			}
+			d.Country = country
+		}
+		if e.global.blockedCountries[d.Country] || tenant.blockedCountries[d.Country] {
+			d.Rule, d.Reason = CountryRule, "country is blocked"
+			return d
+		}
+		// addresses whose country is unknown are rejected when only some countries are allowed
+		if len(allowedCountries) > 0 && !allowedCountries[d.Country] {
+			d.Rule, d.Reason = CountryRule, "country is not allowed"
+			return d
+		}
+	}
+
+	d.Allowed = true
+	return d
+}
+
+// clientAddr returns the address of the device. When the request comes from a trusted proxy, the
+// last address in X-Forwarded-For not belonging to a trusted proxy is used.
+func (e *Engine) clientAddr(r *http.Request) (netip.Addr, bool) {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr := ap.Addr().Unmap()
+	if !contains(e.trustedProxies, addr) {
+		return addr, true
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !contains(e.trustedProxies, addr) {
+			break
+		}
+	}
+	return addr, true
+}
+
+func (e *Engine) logAudit(ev AuditEvent) {
+	e.logger.Warn("Connection rejected by policy",
+		"rule", ev.Rule,
+		"reason", ev.Reason,
+		"addr", ev.Addr,
+		"country", ev.Country,
+		"device_id", ev.DeviceID,
+		"tenant_id", ev.TenantID,
+	)
+}
+
+func parseRules(r config.PolicyRules) (rules, error) {
+	var p rules
+	var err error
+	if p.allow, err = parsePrefixes(r.Allow); err != nil {
+		return p, err
+	}
+	if p.deny, err = parsePrefixes(r.Deny); err != nil {
+		return p, err
+	}
+	p.allowedCountries = countrySet(r.AllowedCountries)
+	p.blockedCountries = countrySet(r.BlockedCountries)
+	return p, nil
+}
+
+// parsePrefixes parses CIDRs, treating single addresses as a prefix of their full length
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if p, err := netip.ParsePrefix(s); err == nil {
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or CIDR: %s", s)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func countrySet(codes []string) map[string]bool {
+	set := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		set[strings.ToUpper(c)] = true
+	}
+	return set
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
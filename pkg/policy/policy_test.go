@@ -0,0 +1,65 @@
+package policy
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+type staticCountries map[string]string
+
+func (c staticCountries) Country(addr netip.Addr) (string, error) {
+	return c[addr.String()], nil
+}
+
+func TestEngine(t *testing.T) {
+	cfg := &config.Config{
+		Policy: config.PolicyConfig{
+			PolicyRules: config.PolicyRules{
+				Deny:             []string{"10.0.0.66"},
+				Allow:            []string{"10.0.0.0/8", "192.0.2.0/24"},
+				BlockedCountries: []string{"kp"},
+			},
+			TrustedProxies: []string{"172.16.0.0/12"},
+		},
+		Tenants: map[string]config.TenantConfig{
+			"acme": {Policy: config.PolicyRules{Allow: []string{"198.51.100.0/24"}, AllowedCountries: []string{"DE"}}},
+		},
+	}
+	countries := staticCountries{"10.0.0.1": "US", "10.0.0.2": "KP", "198.51.100.7": "DE", "198.51.100.8": "FR"}
+	e, err := New(cfg, WithCountryResolver(countries))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote, forwarded, tenant string
+		rule                      string
+	}{
+		{remote: "10.0.0.1:1234"},
+		{remote: "10.0.0.66:1234", rule: DenyListRule},
+		{remote: "203.0.113.1:1234", rule: AllowListRule},
+		{remote: "10.0.0.2:1234", rule: CountryRule},
+		{remote: "[::ffff:192.0.2.1]:1234"},
+		{remote: "172.16.0.1:1234", forwarded: "10.0.0.66, 172.16.0.2", rule: DenyListRule},
+		{remote: "172.16.0.1:1234", forwarded: "10.0.0.1"},
+		// untrusted peers cannot spoof their address
+		{remote: "203.0.113.1:1234", forwarded: "10.0.0.1", rule: AllowListRule},
+		{remote: "198.51.100.7:1234", tenant: "ACME"},
+		{remote: "198.51.100.8:1234", tenant: "acme", rule: CountryRule},
+		{remote: "10.0.0.1:1234", tenant: "acme", rule: AllowListRule},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		d := e.Evaluate(r, tt.tenant)
+		if d.Allowed != (tt.rule == "") || d.Rule != tt.rule {
+			t.Errorf("%s via %q for tenant %q: got %+v, expected rule %q", tt.remote, tt.forwarded, tt.tenant, d, tt.rule)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Package ratelimit limits how often devices and tenants connect, and enforces the session quotas
+// of tenants. Counters are kept in process memory, or in Redis so that the limits hold across all
+// the replicas of a deployment instead of multiplying by their number.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/metrics"
+	"github.com/pixaverse-studios/websocket-server/pkg/websocket"
+)
+
+// Limits that can reject a connection
+const (
+	DeviceLimit = "device"
+	TenantLimit = "tenant"
+	QuotaLimit  = "quota"
+)
+
+// Store counts events in windows. Stores shared by several relays make them count together.
+type Store interface {
+	// Incr adds one to the counter at key, which expires ttl after its first event, and returns
+	// the new count
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+}
+
+// Decision is the outcome of checking a connection against the limits
+type Decision struct {
+	Allowed bool
+	// Limit is the limit that rejected the connection
+	Limit string
+	// RetryAfter is how long until the rejecting limit's window ends
+	RetryAfter time.Duration
+}
+
+// Limiter enforces the connection limits and session quotas of config.RateLimitConfig
+type Limiter struct {
+	config      config.RateLimitConfig
+	window      time.Duration
+	quotaWindow time.Duration
+	store       Store
+	clock       clock.Clock
+
+	logger      *slog.Logger
+	rejection   *metrics.CounterVec
+	storeErrors *metrics.CounterVec
+}
+
+// Option configures a Limiter
+type Option func(*Limiter)
+
+// WithLogger sets the limiter's logger. By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(l *Limiter) {
+		l.logger = logger
+	}
+}
+
+// WithMetrics counts rejected connections and store failures in the given registry
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(l *Limiter) {
+		l.rejection = reg.Counter("pixa_rate_limit_rejections_total", "Connections rejected by a rate limit or quota.", "limit")
+		l.storeErrors = reg.Counter("pixa_rate_limit_store_errors_total", "Rate limit checks that failed to reach the counter store.")
+	}
+}
+
+// WithStore sets the store the counters are kept in, instead of the one named in the config
+func WithStore(s Store) Option {
+	return func(l *Limiter) {
+		l.store = s
+	}
+}
+
+// WithClock sets the clock windows are aligned on. It defaults to the real clock.
+func WithClock(c clock.Clock) Option {
+	return func(l *Limiter) {
+		l.clock = c
+	}
+}
+
+// New creates a limiter for the limits in cfg. Counters are kept in Redis when
+// rate_limit.redis.addr is set and no store is passed in, otherwise in memory.
+func New(cfg *config.Config, opts ...Option) (*Limiter, error) {
+	l := &Limiter{
+		config: cfg.RateLimit,
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		clock:  clock.Real(),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	var err error
+	if l.window, err = time.ParseDuration(l.config.Window); err != nil {
+		return nil, fmt.Errorf("invalid rate_limit.window: %w", err)
+	}
+	if l.quotaWindow, err = time.ParseDuration(l.config.QuotaWindow); err != nil {
+		return nil, fmt.Errorf("invalid rate_limit.quota_window: %w", err)
+	}
+	if l.store == nil {
+		if l.config.Redis.Addr != "" {
+			l.store, err = NewRedisStore(l.config.Redis)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			l.store = NewMemoryStore(l.clock)
+		}
+	}
+	return l, nil
+}
+
+// Close releases the limiter's connections to its store
+func (l *Limiter) Close() error {
+	if c, ok := l.store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Middleware returns a websocket middleware rejecting connections over a limit with 429 Too Many
+// Requests. It should be registered after the middleware authenticating devices and the connection
+// policy, so limits count authenticated identities and only the connections otherwise allowed.
+func (l *Limiter) Middleware() websocket.Middleware {
+	return websocket.Middleware{
+		OnConnect: func(r *http.Request) (*http.Request, error) {
+			deviceID, tenantID := websocket.RequestIdentity(r)
+			d, err := l.Check(r.Context(), deviceID, tenantID)
+			if err != nil {
+				if l.storeErrors != nil {
+					l.storeErrors.With().Inc()
+				}
+				if l.config.Redis.FailOpen {
+					l.logger.Warn("Could not check rate limits, letting the connection through", "error", err, "device_id", deviceID, "tenant_id", tenantID)
+					return r, nil
+				}
+				l.logger.Error("Could not check rate limits", "error", err, "device_id", deviceID, "tenant_id", tenantID)
+				return nil, &websocket.RejectError{StatusCode: http.StatusServiceUnavailable, Reason: "rate limits unavailable"}
+			}
+			if d.Allowed {
+				return r, nil
+			}
+
+			if l.rejection != nil {
+				l.rejection.With(d.Limit).Inc()
+			}
+			l.logger.Warn("Connection rejected by rate limit", "limit", d.Limit, "retry_after", d.RetryAfter, "device_id", deviceID, "tenant_id", tenantID)
+			return nil, &websocket.RejectError{StatusCode: http.StatusTooManyRequests, Reason: "too many connections", RetryAfter: d.RetryAfter}
+		},
+	}
+}
+
+// Check counts a connection of the device and tenant and decides whether it is allowed. Devices
+// and tenants that are not identified are not limited. A connection rejected by a limit is not
+// counted by the limits checked after it.
+func (l *Limiter) Check(ctx context.Context, deviceID, tenantID string) (Decision, error) {
+	// tenant keys are lower cased when the config is read
+	tenantID = strings.ToLower(tenantID)
+	checks := []struct {
+		limit  string
+		id     string
+		max    int
+		window time.Duration
+	}{
+		{DeviceLimit, deviceID, l.config.DeviceConnections, l.window},
+		{TenantLimit, tenantID, l.config.TenantConnections, l.window},
+		{QuotaLimit, tenantID, l.config.TenantSessions, l.quotaWindow},
+	}
+	now := l.clock.Now()
+	for _, c := range checks {
+		if c.id == "" || c.max <= 0 {
+			continue
+		}
+		start := now.Truncate(c.window)
+		key := fmt.Sprintf("%s:%s:%d", c.limit, c.id, start.Unix())
+		n, err := l.store.Incr(ctx, key, c.window)
+		if err != nil {
+			return Decision{}, fmt.Errorf("could not count %s connections: %w", c.limit, err)
+		}
+		if n > int64(c.max) {
+			return Decision{Limit: c.limit, RetryAfter: start.Add(c.window).Sub(now)}, nil
+		}
+	}
+	return Decision{Allowed: true}, nil
+}
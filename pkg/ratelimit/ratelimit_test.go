@@ -0,0 +1,194 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/redis"
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/websocket"
+)
+
+func limitConfig() *config.Config {
+	return &config.Config{RateLimit: config.RateLimitConfig{
+		Enabled:           true,
+		Window:            "1m",
+		DeviceConnections: 2,
+		TenantConnections: 3,
+		QuotaWindow:       "24h",
+		TenantSessions:    4,
+		Redis:             config.RedisConfig{KeyPrefix: "test:", Timeout: "1s"},
+	}}
+}
+
+func TestLimiter(t *testing.T) {
+	c := clock.NewFake(time.Date(2026, 1, 2, 10, 0, 30, 0, time.UTC))
+	l, err := New(limitConfig(), WithClock(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	tests := []struct {
+		device, tenant string
+		limit          string
+	}{
+		{device: "a", tenant: "acme"},
+		{device: "a", tenant: "ACME"},
+		{device: "a", tenant: "acme", limit: DeviceLimit},
+		{device: "b", tenant: "acme"},
+		{device: "c", tenant: "acme", limit: TenantLimit},
+		// anonymous devices of no tenant are not limited
+		{}, {}, {},
+	}
+	for i, tt := range tests {
+		d, err := l.Check(ctx, tt.device, tt.tenant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Allowed != (tt.limit == "") || d.Limit != tt.limit {
+			t.Errorf("connection %d of %q for %q: got %+v, expected limit %q", i, tt.device, tt.tenant, d, tt.limit)
+		}
+		if !d.Allowed && d.RetryAfter != 30*time.Second {
+			t.Errorf("connection %d rejected for %s", i, d.RetryAfter)
+		}
+	}
+
+	// a new window lifts the connection limits, not the daily quota
+	c.Advance(time.Minute)
+	if d, _ := l.Check(ctx, "d", "acme"); !d.Allowed {
+		t.Fatalf("connection in the next window rejected: %+v", d)
+	}
+	if d, _ := l.Check(ctx, "e", "acme"); d.Limit != QuotaLimit || d.RetryAfter != 14*time.Hour-90*time.Second {
+		t.Fatalf("connection over the quota: %+v", d)
+	}
+}
+
+// fakeRedis answers the commands of a RedisStore, counting in memory
+type fakeRedis struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	ttls     map[string]string
+}
+
+func (f *fakeRedis) serve(t *testing.T, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				cmd, err := redis.ReadReply(r)
+				if err != nil {
+					return
+				}
+				args := cmd.([]any)
+				switch args[0] {
+				case "AUTH":
+					if args[1] != "secret" {
+						fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+						continue
+					}
+					fmt.Fprint(conn, "+OK\r\n")
+				case "SELECT":
+					fmt.Fprint(conn, "+OK\r\n")
+				case "EVAL":
+					key := args[3].(string)
+					f.mu.Lock()
+					f.counters[key]++
+					f.ttls[key] = args[4].(string)
+					n := f.counters[key]
+					f.mu.Unlock()
+					fmt.Fprintf(conn, ":%d\r\n", n)
+				default:
+					t.Errorf("unexpected command %v", args)
+					fmt.Fprint(conn, "-ERR unknown command\r\n")
+				}
+			}
+		}()
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	redis := &fakeRedis{counters: make(map[string]int64), ttls: make(map[string]string)}
+	go redis.serve(t, ln)
+
+	cfg := limitConfig()
+	cfg.RateLimit.Redis.Addr = ln.Addr().String()
+	cfg.RateLimit.Redis.Password = "secret"
+	cfg.RateLimit.Redis.DB = 2
+	c := clock.NewFake(time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC))
+	// two replicas share the device's limit
+	var replicas []*Limiter
+	for i := 0; i < 2; i++ {
+		l, err := New(cfg, WithClock(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		replicas = append(replicas, l)
+	}
+	for i, allowed := range []bool{true, true, false} {
+		d, err := replicas[i%2].Check(context.Background(), "a", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Allowed != allowed {
+			t.Fatalf("connection %d: got %+v", i, d)
+		}
+	}
+	key := fmt.Sprintf("test:device:a:%d", c.Now().Unix())
+	if redis.counters[key] != 3 || redis.ttls[key] != "60000" {
+		t.Fatalf("counters %v with expiries %v", redis.counters, redis.ttls)
+	}
+
+	cfg.RateLimit.Redis.Password = "wrong"
+	l, err := New(cfg, WithClock(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Check(context.Background(), "a", ""); err == nil {
+		t.Fatal("check with a rejected password should fail")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	cfg := limitConfig()
+	cfg.RateLimit.DeviceConnections = 1
+	l, err := New(cfg, WithStore(NewMemoryStore(clock.Real())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := websocket.NewHandler(cfg, websocket.WithMiddleware(l.Middleware()))
+
+	connect := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		r.Header.Set(websocket.DeviceIDHeader, "a")
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+	if rec := connect(); rec.Code == http.StatusTooManyRequests {
+		t.Fatal("first connection rate limited")
+	}
+	rec := connect()
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("connection over the limit answered %d with Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
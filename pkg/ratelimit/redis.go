@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/redis"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// incrScript increments a counter and sets its expiry when it is created, in one step so that
+// counters of crashed relays cannot be left without one
+const incrScript = `local n = redis.call('INCR', KEYS[1])
+if n == 1 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+return n`
+
+// RedisStore keeps counters in Redis, so that all the relays using the same server count together
+type RedisStore struct {
+	config config.RedisConfig
+	client *redis.Client
+}
+
+// NewRedisStore creates a store on the server of cfg. Connections are opened when needed.
+func NewRedisStore(cfg config.RedisConfig) (*RedisStore, error) {
+	client, err := redis.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate_limit.redis.timeout: %w", err)
+	}
+	return &RedisStore{config: cfg, client: client}, nil
+}
+
+// Incr adds one to the counter at key, under the configured key prefix
+func (s *RedisStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	reply, err := s.client.Do(ctx, "EVAL", incrScript, "1", s.config.KeyPrefix+key, strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	return n, nil
+}
+
+// Close closes the idle connections
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
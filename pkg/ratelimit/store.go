@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+)
+
+// sweepEvery is how often a MemoryStore forgets its expired counters
+const sweepEvery = time.Minute
+
+type memoryCounter struct {
+	n       int64
+	expires time.Time
+}
+
+// MemoryStore keeps counters in process memory. Relays using it each count on their own.
+type MemoryStore struct {
+	clock clock.Clock
+
+	mu       sync.Mutex
+	counters map[string]memoryCounter
+	swept    time.Time
+}
+
+// NewMemoryStore creates an empty store expiring counters on clock c
+func NewMemoryStore(c clock.Clock) *MemoryStore {
+	return &MemoryStore{clock: c, counters: make(map[string]memoryCounter), swept: c.Now()}
+}
+
+// Incr adds one to the counter at key
+func (s *MemoryStore) Incr(_ context.Context, key string, ttl time.Duration) (int64, error) {
+	now := s.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept) >= sweepEvery {
+		for k, c := range s.counters {
+			if !now.Before(c.expires) {
+				delete(s.counters, k)
+			}
+		}
+		s.swept = now
+	}
+	c, ok := s.counters[key]
+	if !ok || !now.Before(c.expires) {
+		c = memoryCounter{expires: now.Add(ttl)}
+	}
+	c.n++
+	s.counters[key] = c
+	return c.n, nil
+}
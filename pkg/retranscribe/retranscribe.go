@@ -0,0 +1,571 @@
+// Package retranscribe transcribes the recorded audio of finished sessions again, such as when a
+// better transcription model ships, and keeps the new transcripts in the session records next to
+// the original ones. The audio is read from the session traces captured with trace.audio and
+// transcribed by a provider of the AI registry, set up to transcribe without ever responding.
+package retranscribe
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/ai"
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/metrics"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+	"github.com/pixaverse-studios/websocket-server/pkg/trace"
+)
+
+// Outcomes of the sessions of a job
+const (
+	Transcribed = "transcribed"
+	// Skipped sessions have no recorded audio, or already a transcript of the job's version
+	Skipped = "skipped"
+	Failed  = "failed"
+)
+
+// States of a job
+const (
+	Running  = "running"
+	Finished = "finished"
+	// Cancelled jobs were stopped by the relay shutting down
+	Cancelled = "cancelled"
+)
+
+// trailingSilence is how much longer than the provider's endpointing silence the audio of a
+// session is followed by silence, so the provider ends the user's last turn
+const trailingSilence = time.Second
+
+// checksumSize is the length of the CRC32 header of binary frames with websocket.frame_checksum
+const checksumSize = 4
+
+// frameHeaderSize is the length of the header of binary frames from devices that send frame
+// headers, see websocket.FrameHeaderSize
+const frameHeaderSize = 16
+
+var (
+	// errNoAudio is returned for sessions without a trace of their audio
+	errNoAudio = errors.New("no recorded audio")
+	// errEncrypted is returned for sessions whose device encrypted its audio frames, which the
+	// traces keep as they were sent
+	errEncrypted = errors.New("audio frames are encrypted")
+)
+
+// decoders decode the recorded audio of devices that sent G.711, named like the provider formats,
+// or 24 bit, 32 bit or float32 PCM. Other codecs keep state from frame to frame, so their recordings cannot be
+// decoded here.
+var decoders = map[string]audio.Decoder{
+	ai.G711ULawFormat.Name: audio.ULawDecoder{},
+	ai.G711ALawFormat.Name: audio.ALawDecoder{},
+	"pcm24":                audio.PCM24Decoder{},
+	"pcm32":                audio.PCM32Decoder{},
+	"float32":              audio.Float32Decoder{},
+}
+
+// Job selects the sessions to transcribe again and how. Zero filter fields match every session.
+type Job struct {
+	// Version names the new transcripts, such as after the model making them. Sessions that already
+	// have a transcript of the version are skipped, so an interrupted job can be run again.
+	Version string `json:"version"`
+	// Provider is the registered provider that transcribes, retranscribe.provider if empty
+	Provider string `json:"provider,omitempty"`
+	// Model is the transcription model, such as whisper-1; empty keeps the configured one
+	Model    string    `json:"model,omitempty"`
+	TenantID string    `json:"tenant_id,omitempty"`
+	DeviceID string    `json:"device_id,omitempty"`
+	From     time.Time `json:"from,omitzero"`
+	To       time.Time `json:"to,omitzero"`
+}
+
+// Status is the progress of a job
+type Status struct {
+	ID string `json:"id"`
+	Job
+	State      string    `json:"state"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+	// Sessions matched the job's filter, and were transcribed, skipped or failed so far
+	Sessions    int `json:"sessions"`
+	Transcribed int `json:"transcribed"`
+	Skipped     int `json:"skipped"`
+	Failed      int `json:"failed"`
+	// Errors are why sessions failed, by session ID
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// Runner runs the re-transcription jobs of a relay
+type Runner struct {
+	config    *config.Config
+	store     store.TranscriptStore
+	providers *ai.Registry
+	logger    *slog.Logger
+	outcomes  *metrics.CounterVec
+
+	idleTimeout time.Duration
+	mu          sync.Mutex
+	jobs        map[string]*Status
+	lastID      int
+}
+
+// Option configures a Runner
+type Option func(*Runner)
+
+// WithLogger sets the runner's logger. By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(r *Runner) {
+		r.logger = logger
+	}
+}
+
+// WithMetrics counts the sessions of jobs by outcome in the given registry
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(r *Runner) {
+		r.outcomes = reg.Counter("pixa_retranscribed_sessions_total", "Sessions of re-transcription jobs, by outcome.", "outcome")
+	}
+}
+
+// New creates a runner transcribing the sessions of st with the providers of the registry
+func New(cfg *config.Config, st store.TranscriptStore, providers *ai.Registry, opts ...Option) *Runner {
+	r := &Runner{
+		config:    cfg,
+		store:     st,
+		providers: providers,
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		jobs:      make(map[string]*Status),
+	}
+	r.idleTimeout, _ = time.ParseDuration(cfg.Retranscribe.IdleTimeout)
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Start validates a job and runs it in the background until it is done or ctx is
+func (r *Runner) Start(ctx context.Context, job Job) (Status, error) {
+	status, err := r.newJob(job)
+	if err != nil {
+		return Status{}, err
+	}
+	s, _ := r.Job(status.ID)
+	go r.run(ctx, status)
+	return s, nil
+}
+
+// Run runs a job and returns how it went
+func (r *Runner) Run(ctx context.Context, job Job) (Status, error) {
+	status, err := r.newJob(job)
+	if err != nil {
+		return Status{}, err
+	}
+	r.run(ctx, status)
+	s, _ := r.Job(status.ID)
+	return s, nil
+}
+
+// Job returns the status of a job
+func (r *Runner) Job(id string) (Status, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.jobs[id]
+	if !ok {
+		return Status{}, false
+	}
+	out := *s
+	out.Errors = make(map[string]string, len(s.Errors))
+	for k, v := range s.Errors {
+		out.Errors[k] = v
+	}
+	return out, true
+}
+
+func (r *Runner) newJob(job Job) (*Status, error) {
+	if job.Version == "" {
+		return nil, fmt.Errorf("version is not specified")
+	}
+	if job.Provider == "" {
+		job.Provider = r.config.Retranscribe.Provider
+	}
+	if job.Provider == "" {
+		job.Provider = r.config.AIConfig.Provider
+	}
+	if !slices.Contains(r.providers.Names(), job.Provider) {
+		return nil, fmt.Errorf("unknown provider %q", job.Provider)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastID++
+	s := &Status{ID: strconv.Itoa(r.lastID), Job: job, State: Running, StartedAt: time.Now(), Errors: map[string]string{}}
+	r.jobs[s.ID] = s
+	return s, nil
+}
+
+// run transcribes the sessions of a job, retranscribe.concurrency at a time
+func (r *Runner) run(ctx context.Context, status *Status) {
+	job := status.Job
+	logger := r.logger.With("job", status.ID, "version", job.Version)
+	records, err := r.store.ListSessions(ctx, store.SessionFilter{TenantID: job.TenantID, DeviceID: job.DeviceID, From: job.From, To: job.To})
+	if err != nil {
+		logger.Error("Could not list sessions to transcribe", "error", err)
+	}
+	r.mu.Lock()
+	status.Sessions = len(records)
+	r.mu.Unlock()
+	logger.Info("Transcribing sessions again", "sessions", len(records), "provider", job.Provider, "model", job.Model)
+
+	ids := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < max(r.config.Retranscribe.Concurrency, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				outcome, err := r.session(ctx, job, id)
+				if r.outcomes != nil {
+					r.outcomes.With(outcome).Inc()
+				}
+				r.mu.Lock()
+				switch outcome {
+				case Transcribed:
+					status.Transcribed++
+				case Skipped:
+					status.Skipped++
+				default:
+					status.Failed++
+					status.Errors[id] = err.Error()
+				}
+				r.mu.Unlock()
+				if err != nil && outcome == Failed {
+					logger.Warn("Could not transcribe session again", "session_id", id, "error", err)
+				}
+			}
+		}()
+	}
+feed:
+	for _, rec := range records {
+		select {
+		case ids <- rec.ID:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(ids)
+	wg.Wait()
+
+	r.mu.Lock()
+	status.State = Finished
+	if ctx.Err() != nil {
+		status.State = Cancelled
+	}
+	status.FinishedAt = time.Now()
+	done := *status
+	r.mu.Unlock()
+	logger.Info("Transcription job done", "state", done.State, "transcribed", done.Transcribed, "skipped", done.Skipped, "failed", done.Failed)
+}
+
+// session transcribes a session again, unless it already has a transcript of the job's version.
+// The record is read again just before it is saved, so records changed meanwhile are kept.
+func (r *Runner) session(ctx context.Context, job Job, id string) (string, error) {
+	rec, err := r.store.GetSession(ctx, id)
+	if err != nil {
+		return Failed, err
+	}
+	if _, ok := rec.Transcript(job.Version); ok {
+		return Skipped, nil
+	}
+	dec, ok := decoders[rec.AudioCodec]
+	if rec.AudioCodec != "" && !ok {
+		return Failed, fmt.Errorf("audio frames are %s encoded", rec.AudioCodec)
+	}
+	frames, err := r.readAudio(rec, dec)
+	if errors.Is(err, errNoAudio) {
+		return Skipped, nil
+	}
+	if err != nil {
+		return Failed, err
+	}
+	version, err := r.transcribe(ctx, job, rec, frames)
+	if err != nil {
+		return Failed, err
+	}
+
+	if rec, err = r.store.GetSession(ctx, id); err != nil {
+		return Failed, err
+	}
+	rec.Transcripts = append(rec.Transcripts, version)
+	if err := r.store.SaveSession(ctx, rec); err != nil {
+		return Failed, err
+	}
+	return Transcribed, nil
+}
+
+// frame is an audio frame of a session's trace
+type frame struct {
+	offset time.Duration
+	pcm    []byte
+}
+
+// readAudio returns the audio frames the device sent in a session, from its trace, decoded with dec
+// unless it is nil and mixed down to audio.channels as they were in the session. The headers of
+// frames are stripped, and frames are kept in the order they arrived.
+func (r *Runner) readAudio(rec store.SessionRecord, dec audio.Decoder) ([]frame, error) {
+	headers := rec.Frames != nil
+	channels, channel := rec.InputChannels, audio.MixChannels
+	if channels > 0 && rec.Downmix != "" {
+		var err error
+		if channel, err = audio.DownmixChannel(rec.Downmix); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Open(filepath.Join(r.config.TraceDirFor(rec.TenantID), rec.ID+".pxtrace"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoAudio
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tr, err := trace.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	if !tr.Header().Audio {
+		return nil, errNoAudio
+	}
+
+	var frames []frame
+	for {
+		rec, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rec.Direction != trace.FromDevice {
+			continue
+		}
+		if rec.Opcode == trace.Text {
+			var msg struct {
+				Type string `json:"type"`
+			}
+			if json.Unmarshal(rec.Data, &msg) == nil && msg.Type == "session.hello" {
+				return nil, errEncrypted
+			}
+			continue
+		}
+		if rec.Opcode != trace.Binary || rec.Truncated() {
+			continue
+		}
+		pcm := rec.Data
+		if r.config.Websocket.FrameChecksum {
+			if len(pcm) < checksumSize || binary.BigEndian.Uint32(pcm) != crc32.ChecksumIEEE(pcm[checksumSize:]) {
+				continue
+			}
+			pcm = pcm[checksumSize:]
+		}
+		if headers {
+			if len(pcm) < frameHeaderSize || pcm[0] != 1 {
+				continue
+			}
+			pcm = pcm[frameHeaderSize:]
+		}
+		if dec != nil {
+			if pcm, err = dec.Decode(pcm); err != nil {
+				continue
+			}
+		}
+		if channels > 0 {
+			pcm = audio.Downmix(pcm, channels, r.config.Audio.Channels, channel)
+		}
+		frames = append(frames, frame{offset: rec.Offset, pcm: pcm})
+	}
+	if len(frames) == 0 {
+		return nil, errNoAudio
+	}
+	return frames, nil
+}
+
+// transcription collects the user's turns from the events of the provider
+type transcription struct {
+	mu        sync.Mutex
+	startedAt time.Time
+	// marks place the audio sent to the provider in the session, in the order it was sent
+	marks []mark
+	// speaking is the turn the user is speaking, nil between turns; ended are the turns waiting for
+	// their transcript, oldest first
+	speaking *store.Turn
+	ended    []store.Turn
+	turns    []store.Turn
+	// events is signalled on every event of the provider
+	events chan struct{}
+}
+
+// mark is where in the session the audio sent to the provider from sentMs on was recorded
+type mark struct {
+	sentMs int64
+	offset time.Duration
+}
+
+// sent records that audio recorded at offset is sent after sentMs of audio
+func (t *transcription) sent(sentMs int64, offset time.Duration) {
+	t.mu.Lock()
+	t.marks = append(t.marks, mark{sentMs: sentMs, offset: offset})
+	t.mu.Unlock()
+}
+
+// at returns when in the session, in ms since it started, the audio the provider heard at audioMs
+// was recorded. Providers that do not say where they heard speech get the audio sent last, which
+// is late by how long they took to report it. It must be called with mu held.
+func (t *transcription) at(audioMs int64) int64 {
+	if len(t.marks) == 0 {
+		return 0
+	}
+	m := t.marks[len(t.marks)-1]
+	if audioMs > 0 {
+		i, _ := slices.BinarySearchFunc(t.marks, audioMs, func(m mark, ms int64) int { return cmp.Compare(m.sentMs, ms+1) })
+		m = t.marks[max(i-1, 0)]
+		return m.offset.Milliseconds() + audioMs - m.sentMs
+	}
+	return m.offset.Milliseconds()
+}
+
+func (t *transcription) handle(e ai.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch e.Type {
+	case ai.SpeechStartedEventType:
+		t.speaking = &store.Turn{Role: store.UserRole, StartMs: t.at(e.AudioMs)}
+	case ai.SpeechStoppedEventType:
+		if t.speaking != nil {
+			t.speaking.EndMs = t.at(e.AudioMs)
+			t.ended = append(t.ended, *t.speaking)
+			t.speaking = nil
+		}
+	case ai.InputTranscriptionCompletedType:
+		turn := store.Turn{Role: store.UserRole, StartMs: t.at(0)}
+		if len(t.ended) > 0 {
+			turn, t.ended = t.ended[0], t.ended[1:]
+		}
+		if text := strings.TrimSpace(e.Text); text != "" {
+			turn.ItemID = e.ItemID
+			turn.Text = text
+			turn.At = t.startedAt.Add(time.Duration(turn.StartMs) * time.Millisecond)
+			t.turns = append(t.turns, turn)
+		}
+	}
+	select {
+	case t.events <- struct{}{}:
+	default:
+	}
+}
+
+// pending reports whether the provider still owes transcripts of turns it heard
+func (t *transcription) pending() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.speaking != nil || len(t.ended) > 0
+}
+
+// transcribe sends the audio of a session to a new provider session and collects the transcripts
+// of the user's turns. It returns once the provider has transcribed every turn it heard, or has
+// been idle for retranscribe.idle_timeout after the audio.
+func (r *Runner) transcribe(ctx context.Context, job Job, rec store.SessionRecord, frames []frame) (store.TranscriptVersion, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	client, err := r.providers.New(job.Provider, ai.ProviderParams{
+		Config:             r.config,
+		Logger:             r.logger.With("session_id", rec.ID),
+		TenantID:           rec.TenantID,
+		TranscriptionModel: job.Model,
+		TranscribeOnly:     true,
+	})
+	if err != nil {
+		return store.TranscriptVersion{}, err
+	}
+	if err := client.Initialize(ctx); err != nil {
+		return store.TranscriptVersion{}, err
+	}
+	defer client.Close()
+
+	t := &transcription{startedAt: rec.StartedAt, events: make(chan struct{}, 1)}
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-client.GetEventsStream():
+				t.handle(e)
+			case <-client.GetResponseStream():
+			case err := <-client.Errors():
+				failed <- err
+				return
+			}
+		}
+	}()
+
+	// records of sessions from before devices could choose their rate do not keep it
+	rate, channels := cmp.Or(rec.SampleRate, r.config.Audio.SampleRate), r.config.Audio.Channels
+	var sent time.Duration
+	end := frames[0].offset
+	for _, f := range frames {
+		t.sent(sent.Milliseconds(), f.offset)
+		a := audio.FromPCM16(f.pcm, rate, channels)
+		if err := client.SendAudio(ctx, a); err != nil {
+			return store.TranscriptVersion{}, err
+		}
+		sent += a.Duration()
+		end = f.offset + a.Duration()
+	}
+	silence, _ := time.ParseDuration(r.config.EndpointingFor(r.config.DeviceProfileFor(rec.TenantID, "")).SilenceDuration)
+	samples := int((silence + trailingSilence).Seconds() * float64(rate))
+	t.sent(sent.Milliseconds(), end)
+	if err := client.SendAudio(ctx, audio.FromPCM16(make([]byte, samples*channels*2), rate, channels)); err != nil {
+		return store.TranscriptVersion{}, err
+	}
+
+	idle := time.NewTimer(r.idleTimeout)
+	defer idle.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-t.events:
+			if !t.pending() {
+				// the transcript of the last turn may still be followed by that of a turn the
+				// provider has not reported yet, give it a moment
+				idle.Reset(min(r.idleTimeout, time.Second))
+				continue
+			}
+			idle.Reset(r.idleTimeout)
+		case <-idle.C:
+			waiting = false
+		case err := <-failed:
+			return store.TranscriptVersion{}, err
+		case <-ctx.Done():
+			return store.TranscriptVersion{}, ctx.Err()
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return store.TranscriptVersion{
+		Version:   job.Version,
+		Provider:  job.Provider,
+		Model:     job.Model,
+		CreatedAt: time.Now(),
+		Turns:     t.turns,
+	}, nil
+}
@@ -0,0 +1,131 @@
+package retranscribe
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/ai"
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+	"github.com/pixaverse-studios/websocket-server/pkg/trace"
+)
+
+// transcriber hears speech in frames that are not silent, and transcribes each turn once it is
+// followed by silence
+type transcriber struct {
+	params   ai.ProviderParams
+	events   chan ai.Event
+	sent     time.Duration
+	speaking bool
+}
+
+func (c *transcriber) Initialize(context.Context) error              { return nil }
+func (c *transcriber) GetResponseStream() <-chan ai.ResponseAudio    { return nil }
+func (c *transcriber) GetEventsStream() <-chan ai.Event              { return c.events }
+func (c *transcriber) Errors() <-chan error                          { return nil }
+func (c *transcriber) Truncate(context.Context, string, int64) error { return nil }
+func (c *transcriber) Close()                                        {}
+
+func (c *transcriber) SendAudio(ctx context.Context, a audio.Audio) error {
+	silent := !slices.ContainsFunc(a.AsPCM16(), func(b byte) bool { return b != 0 })
+	at := c.sent.Milliseconds()
+	c.sent += a.Duration()
+	switch {
+	case !silent && !c.speaking:
+		c.speaking = true
+		c.events <- ai.Event{Type: ai.SpeechStartedEventType, AudioMs: at}
+	case silent && c.speaking:
+		c.speaking = false
+		c.events <- ai.Event{Type: ai.SpeechStoppedEventType, AudioMs: at}
+		c.events <- ai.Event{Type: ai.InputTranscriptionCompletedType, ItemID: "item", Text: c.params.TranscriptionModel + " turn"}
+	}
+	return nil
+}
+
+func TestRetranscribe(t *testing.T) {
+	cfg := config.Default()
+	dir := t.TempDir()
+	started := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	f, err := os.Create(filepath.Join(dir, "s1.pxtrace"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := trace.NewWriter(f, trace.Header{SessionID: "s1", StartedAt: started, Audio: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// frames of 100ms, recorded a second apart
+	silence := make([]byte, cfg.Audio.SampleRate*cfg.Audio.Channels*2/10)
+	speech := bytes.Repeat([]byte{1}, len(silence))
+	for i, frame := range [][]byte{silence, speech, speech, silence, speech} {
+		w.Write(started.Add(time.Duration(i)*time.Second), trace.FromDevice, trace.Binary, frame)
+	}
+	w.Write(started.Add(time.Second), trace.ToDevice, trace.Binary, speech)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	st := store.NewMemoryStore(0)
+	ctx := context.Background()
+	for _, id := range []string{"s1", "s2"} {
+		st.SaveSession(ctx, store.SessionRecord{ID: id, TenantID: "acme", StartedAt: started})
+	}
+	providers := ai.NewRegistry()
+	var params []ai.ProviderParams
+	providers.Register("fake", func(p ai.ProviderParams) (ai.AIClient, error) {
+		params = append(params, p)
+		return &transcriber{params: p, events: make(chan ai.Event, 8)}, nil
+	})
+	cfg.Trace.Dir = dir
+	cfg.Retranscribe.Concurrency = 1
+	cfg.Retranscribe.IdleTimeout = "50ms"
+	r := New(cfg, st, providers)
+
+	if _, err := r.Run(ctx, Job{Provider: "fake"}); err == nil {
+		t.Fatal("expected jobs without a version to be rejected")
+	}
+	if _, err := r.Run(ctx, Job{Version: "v2", Provider: "unknown"}); err == nil {
+		t.Fatal("expected jobs with an unknown provider to be rejected")
+	}
+	status, err := r.Run(ctx, Job{Version: "v2", Provider: "fake", Model: "whisper"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != Finished || status.Sessions != 2 || status.Transcribed != 1 || status.Skipped != 1 || status.Failed != 0 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	if len(params) != 1 || !params[0].TranscribeOnly || params[0].TenantID != "acme" {
+		t.Fatalf("unexpected provider params: %+v", params)
+	}
+
+	rec, _ := st.GetSession(ctx, "s1")
+	v, ok := rec.Transcript("v2")
+	if !ok || v.Provider != "fake" || v.Model != "whisper" {
+		t.Fatalf("expected a v2 transcript, got %+v", rec.Transcripts)
+	}
+	if len(v.Turns) != 2 {
+		t.Fatalf("expected both turns to be transcribed, got %+v", v.Turns)
+	}
+	first, last := v.Turns[0], v.Turns[1]
+	if first.Text != "whisper turn" || first.StartMs != 1000 || first.EndMs != 3000 || !first.At.Equal(started.Add(time.Second)) {
+		t.Fatalf("unexpected turn: %+v", first)
+	}
+	// the last turn is ended by the silence after the audio
+	if last.StartMs != 4000 || last.EndMs != 4100 {
+		t.Fatalf("unexpected turn: %+v", last)
+	}
+
+	status, _ = r.Run(ctx, Job{Version: "v2", Provider: "fake"})
+	if status.Transcribed != 0 || status.Skipped != 2 {
+		t.Fatalf("expected the transcribed session to be skipped, got %+v", status)
+	}
+	if got, ok := r.Job(status.ID); !ok || got.Skipped != 2 {
+		t.Fatalf("unexpected job status: %+v", got)
+	}
+}
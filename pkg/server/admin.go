@@ -0,0 +1,496 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/analytics"
+	"github.com/pixaverse-studios/websocket-server/pkg/faq"
+	"github.com/pixaverse-studios/websocket-server/pkg/retranscribe"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+	"github.com/pixaverse-studios/websocket-server/pkg/websocket"
+)
+
+// adminHandler serves the admin API: a view of the live sessions for operators
+type adminHandler struct {
+	apiKey   string
+	sessions *websocket.SessionManager
+	heat     *websocket.HeatHistory
+	// refresh switches a session to another model or persona, see websocket.Handler.RefreshProvider
+	refresh func(sessionID string, p websocket.ProviderProfile) error
+	// listen streams the live audio of a session, see websocket.Handler.Listen; nil unless
+	// admin.listen is set
+	listen func(w http.ResponseWriter, r *http.Request, sessionID string)
+	// faq is nil unless FAQ mode is enabled
+	faq *faq.Cache
+	// transcripts is nil unless session records are kept
+	transcripts store.TranscriptStore
+	// retranscribe is nil unless re-transcription is enabled; its jobs run until jobs is cancelled
+	retranscribe *retranscribe.Runner
+	jobs         context.Context
+	// analytics is nil unless analytics are enabled
+	analytics *analytics.Aggregator
+	// devices is nil unless the presence of devices is kept
+	devices store.DeviceStore
+	// announcements is nil unless announcements are enabled; announce schedules them, see
+	// websocket.Handler.ScheduleAnnouncement
+	announcements *websocket.Announcements
+	announce      func(websocket.Announcement) (websocket.AnnouncementStatus, error)
+}
+
+func (a *adminHandler) register(mux *http.ServeMux) {
+	mux.Handle("GET /admin/sessions", a.authorize(a.listSessions))
+	mux.Handle("GET /admin/sessions/{id}", a.authorize(a.getSession))
+	mux.Handle("POST /admin/sessions/{id}/provider", a.authorize(a.refreshProvider))
+	mux.Handle("GET /admin/heat", a.authorize(a.heatReport))
+	if a.listen != nil {
+		mux.Handle("GET /admin/sessions/{id}/listen", a.authorize(a.listenSession))
+	}
+	if a.transcripts != nil {
+		mux.Handle("GET /admin/records", a.authorize(a.listRecords))
+		mux.Handle("GET /admin/records/{id}", a.authorize(a.getRecord))
+		mux.Handle("GET /admin/records/{id}/subtitles", a.authorize(a.getSubtitles))
+		mux.Handle("GET /admin/transcripts/search", a.authorize(a.searchTranscripts))
+	}
+	if a.devices != nil {
+		mux.Handle("GET /admin/devices", a.authorize(a.listDevices))
+		mux.Handle("GET /admin/devices/{id}", a.authorize(a.getDevice))
+	}
+	if a.retranscribe != nil {
+		mux.Handle("POST /admin/retranscribe", a.authorize(a.startRetranscribe))
+		mux.Handle("GET /admin/retranscribe/{id}", a.authorize(a.getRetranscribe))
+	}
+	if a.analytics != nil {
+		mux.Handle("GET /admin/analytics", a.authorize(a.analyticsReport))
+	}
+	if a.announcements != nil {
+		mux.Handle("POST /admin/announcements", a.authorize(a.scheduleAnnouncement))
+		mux.Handle("GET /admin/announcements", a.authorize(a.listAnnouncements))
+		mux.Handle("GET /admin/announcements/{id}", a.authorize(a.getAnnouncement))
+		mux.Handle("DELETE /admin/announcements/{id}", a.authorize(a.cancelAnnouncement))
+	}
+	if a.faq != nil {
+		mux.Handle("GET /admin/faq", a.authorize(a.listFAQ))
+		mux.Handle("DELETE /admin/faq", a.authorize(a.purgeFAQ))
+	}
+}
+
+// authorize rejects requests without the admin API key as bearer token, or as the password of
+// basic auth, which browsers ask for, so a supervisor can open a session's stream in a tab
+func (a *adminHandler) authorize(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, key, ok = r.BasicAuth()
+		}
+		if !ok || subtle.ConstantTimeCompare([]byte(key), []byte(a.apiKey)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="pixa admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// listSessions returns the active sessions, oldest first. The tenant_id and tag parameters filter
+// them, see queryTags.
+func (a *adminHandler) listSessions(w http.ResponseWriter, r *http.Request) {
+	tags, err := queryTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tenantID := r.URL.Query().Get("tenant_id")
+	sessions := a.sessions.List()
+	infos := make([]websocket.SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		info := s.Info()
+		if (tenantID == "" || info.TenantID == tenantID) && store.MatchTags(info.Tags, tags) {
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].StartedAt.Before(infos[j].StartedAt) })
+	writeJSON(w, struct {
+		Sessions []websocket.SessionInfo `json:"sessions"`
+	}{infos})
+}
+
+func (a *adminHandler) getSession(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.sessions.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s.Info())
+}
+
+// listenSession streams the live audio of a session, until it ends or the supervisor hangs up
+func (a *adminHandler) listenSession(w http.ResponseWriter, r *http.Request) {
+	a.listen(w, r, r.PathValue("id"))
+}
+
+// refreshProvider switches a session to the model or persona of the provider profile in the body,
+// without the device reconnecting
+func (a *adminHandler) refreshProvider(w http.ResponseWriter, r *http.Request) {
+	var p websocket.ProviderProfile
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&p); err != nil {
+		http.Error(w, "invalid provider profile: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := r.PathValue("id")
+	switch err := a.refresh(id, p); {
+	case errors.Is(err, websocket.ErrSessionNotFound):
+		http.Error(w, "session not found", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		// the switch happens once the answer being given is over
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// heatReport ranks the pipeline stages by their latency across the active sessions and the recently
+// finished ones. The tenant_id parameter narrows the sessions and limit the number of stages and
+// queues listed.
+func (a *adminHandler) heatReport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit: "+v, http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	tenantID := q.Get("tenant_id")
+	var heats []websocket.SessionHeat
+	for _, s := range a.sessions.List() {
+		if tenantID == "" || s.TenantID == tenantID {
+			heats = append(heats, s.Heat())
+		}
+	}
+	for _, h := range a.heat.Recent() {
+		if tenantID == "" || h.TenantID == tenantID {
+			heats = append(heats, h)
+		}
+	}
+	report := websocket.NewHeatReport(heats, time.Now())
+	if limit > 0 {
+		report.Stages = report.Stages[:min(limit, len(report.Stages))]
+		report.Queues = report.Queues[:min(limit, len(report.Queues))]
+	}
+	writeJSON(w, report)
+}
+
+// listRecords exports the records of finished sessions, ordered by start time. They are filtered
+// by the tenant_id, device_id and tag parameters and by from and to, RFC 3339 bounds of the start time.
+func (a *adminHandler) listRecords(w http.ResponseWriter, r *http.Request) {
+	f, err := recordFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	records, err := a.transcripts.ListSessions(r.Context(), f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, struct {
+		Records []store.SessionRecord `json:"records"`
+	}{records})
+}
+
+// recordFilter reads the filter of session records from the tenant_id, device_id and tag
+// parameters and from and to, RFC 3339 bounds of the start time
+func recordFilter(r *http.Request) (store.SessionFilter, error) {
+	q := r.URL.Query()
+	f := store.SessionFilter{TenantID: q.Get("tenant_id"), DeviceID: q.Get("device_id")}
+	var err error
+	if f.Tags, err = queryTags(r); err != nil {
+		return f, err
+	}
+	for name, bound := range map[string]*time.Time{"from": &f.From, "to": &f.To} {
+		if v := q.Get(name); v != "" {
+			if *bound, err = time.Parse(time.RFC3339, v); err != nil {
+				return f, fmt.Errorf("invalid %s: %s", name, v)
+			}
+		}
+	}
+	return f, nil
+}
+
+// searchLimit is how many hits a transcript search returns by default, and maxSearchLimit how many
+// at most
+const (
+	searchLimit    = 20
+	maxSearchLimit = 100
+)
+
+// searchTranscripts finds the records of finished sessions whose transcript has the words of the
+// q parameter, the most recent first. The records searched are filtered as those listed, and by
+// role; offset and limit page through the hits.
+func (a *adminHandler) searchTranscripts(w http.ResponseWriter, r *http.Request) {
+	f, err := recordFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	query := store.SearchQuery{Text: q.Get("q"), Filter: f, Role: q.Get("role"), Limit: searchLimit}
+	if query.Role != "" && query.Role != store.UserRole && query.Role != store.AssistantRole {
+		http.Error(w, "invalid role: "+query.Role, http.StatusBadRequest)
+		return
+	}
+	for name, value := range map[string]*int{"offset": &query.Offset, "limit": &query.Limit} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || name == "limit" && (n < 1 || n > maxSearchLimit) {
+				http.Error(w, "invalid "+name+": "+v, http.StatusBadRequest)
+				return
+			}
+			*value = n
+		}
+	}
+	result, err := store.Search(r.Context(), a.transcripts, query)
+	if errors.Is(err, store.ErrEmptySearch) {
+		http.Error(w, "q is not specified", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// getRecord returns the record of a finished session, its timeline of turns included
+func (a *adminHandler) getRecord(w http.ResponseWriter, r *http.Request) {
+	record, err := a.transcripts.GetSession(r.Context(), r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "record not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, record)
+}
+
+// listDevices lists the devices seen, those seen longest ago first. They are filtered by the
+// tenant_id parameter, by seen_before, an RFC 3339 time, or silent_for, a duration the devices
+// have not been seen for, and by offline=true for devices without a live session.
+func (a *adminHandler) listDevices(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := store.DeviceFilter{TenantID: q.Get("tenant_id"), Offline: q.Get("offline") == "true"}
+	if v := q.Get("seen_before"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid seen_before: "+v, http.StatusBadRequest)
+			return
+		}
+		f.SeenBefore = t
+	}
+	if v := q.Get("silent_for"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid silent_for: "+v, http.StatusBadRequest)
+			return
+		}
+		f.SeenBefore = time.Now().Add(-d)
+	}
+	devices, err := a.devices.ListDevices(r.Context(), f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, struct {
+		Devices []store.Device `json:"devices"`
+	}{devices})
+}
+
+// getDevice returns the presence of a device, its connection history included
+func (a *adminHandler) getDevice(w http.ResponseWriter, r *http.Request) {
+	device, err := a.devices.GetDevice(r.Context(), r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, device)
+}
+
+// subtitleTypes are the content types of the subtitle formats
+var subtitleTypes = map[string]string{
+	store.SRT:    "application/x-subrip; charset=utf-8",
+	store.WebVTT: "text/vtt; charset=utf-8",
+}
+
+// getSubtitles exports the transcript of a finished session as subtitles, in the format named by
+// the format parameter: vtt, the default, or srt
+func (a *adminHandler) getSubtitles(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = store.WebVTT
+	}
+	contentType, ok := subtitleTypes[format]
+	if !ok {
+		http.Error(w, "invalid format: "+format, http.StatusBadRequest)
+		return
+	}
+	record, err := a.transcripts.GetSession(r.Context(), r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "record not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", record.ID+"."+format))
+	store.WriteSubtitles(w, record, format)
+}
+
+// startRetranscribe starts a job transcribing the recorded audio of the sessions selected by the
+// body again. It returns the job's status, to be followed at /admin/retranscribe/{id}.
+func (a *adminHandler) startRetranscribe(w http.ResponseWriter, r *http.Request) {
+	var job retranscribe.Job
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&job); err != nil {
+		http.Error(w, "invalid job: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	status, err := a.retranscribe.Start(a.jobs, job)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Location", "/admin/retranscribe/"+status.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
+
+func (a *adminHandler) getRetranscribe(w http.ResponseWriter, r *http.Request) {
+	status, ok := a.retranscribe.Job(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, status)
+}
+
+// analyticsReport returns the aggregate analytics of the tenant_id parameter's sessions, from and
+// to UTC days as "2006-01-02", both included. They default to the 30 days up to today.
+func (a *adminHandler) analyticsReport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to := time.Now().UTC()
+	from := to.AddDate(0, 0, -29)
+	for name, bound := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := q.Get(name); v != "" {
+			var err error
+			if *bound, err = time.Parse("2006-01-02", v); err != nil {
+				http.Error(w, "invalid "+name+": "+v, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if to.Before(from) {
+		http.Error(w, "to is before from", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, a.analytics.Report(q.Get("tenant_id"), from, to))
+}
+
+// scheduleAnnouncement schedules the announcement in the body. It returns its status, to be
+// followed at /admin/announcements/{id}.
+func (a *adminHandler) scheduleAnnouncement(w http.ResponseWriter, r *http.Request) {
+	var an websocket.Announcement
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&an); err != nil {
+		http.Error(w, "invalid announcement: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	status, err := a.announce(an)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Location", "/admin/announcements/"+status.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(status)
+}
+
+func (a *adminHandler) listAnnouncements(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, struct {
+		Announcements []websocket.AnnouncementStatus `json:"announcements"`
+	}{a.announcements.List()})
+}
+
+func (a *adminHandler) getAnnouncement(w http.ResponseWriter, r *http.Request) {
+	status, ok := a.announcements.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "announcement not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, status)
+}
+
+// cancelAnnouncement stops an announcement from reaching more devices
+func (a *adminHandler) cancelAnnouncement(w http.ResponseWriter, r *http.Request) {
+	if err := a.announcements.Cancel(r.PathValue("id")); err != nil {
+		http.Error(w, "announcement not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// queryTags reads the tags to filter by from tag parameters in key:value form, which can be repeated
+func queryTags(r *http.Request) (map[string]string, error) {
+	values := r.URL.Query()["tag"]
+	if len(values) == 0 {
+		return nil, nil
+	}
+	tags := make(map[string]string, len(values))
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, ":")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid tag %q, expected key:value", v)
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// listFAQ returns the cached answers, newest first
+func (a *adminHandler) listFAQ(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, struct {
+		Entries []faq.Entry `json:"entries"`
+	}{a.faq.Entries()})
+}
+
+// purgeFAQ removes cached answers, for when an answer is wrong or out of date. The tenant_id and
+// question parameters narrow what is removed, see faq.Cache.Purge.
+func (a *adminHandler) purgeFAQ(w http.ResponseWriter, r *http.Request) {
+	n := a.faq.Purge(r.URL.Query().Get("tenant_id"), r.URL.Query().Get("question"))
+	writeJSON(w, struct {
+		Purged int `json:"purged"`
+	}{n})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+// WithDeviceStore sets the store the presence of devices is kept in. By default it is kept in
+// memory when devices are enabled in the config, and saved to devices.file if set.
+func WithDeviceStore(st store.DeviceStore) Option {
+	return func(s *Server) {
+		s.devices = st
+	}
+}
+
+// loadDevices creates the in-memory device store, with the devices saved to devices.file if any
+func (s *Server) loadDevices() (*store.MemoryDeviceStore, error) {
+	devices := store.NewMemoryDeviceStore(s.config.Devices.History)
+	if s.config.Devices.File == "" {
+		return devices, nil
+	}
+	f, err := os.Open(s.config.Devices.File)
+	if errors.Is(err, fs.ErrNotExist) {
+		return devices, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open devices file: %w", err)
+	}
+	defer f.Close()
+	if err := devices.Load(f); err != nil {
+		return nil, fmt.Errorf("could not load devices file: %w", err)
+	}
+	return devices, nil
+}
+
+// saveDevices writes the devices to devices.file. The snapshot is written next to it and renamed
+// over it, so a crash midway leaves the last one whole.
+func (s *Server) saveDevices() error {
+	path := s.config.Devices.File
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := s.deviceSnapshots.Save(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// runDeviceSnapshots saves the devices every devices.save_interval until the jobs are stopped
+func (s *Server) runDeviceSnapshots() {
+	interval, _ := time.ParseDuration(s.config.Devices.SaveInterval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.jobs.Done():
+			return
+		case <-ticker.C:
+			if err := s.saveDevices(); err != nil {
+				s.logger.Error("Could not save devices", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Health statuses, named as in grpc.health.v1 so meshes and dashboards read them alike
+const (
+	healthServing    = "SERVING"
+	healthNotServing = "NOT_SERVING"
+)
+
+// envoyImmediateFail makes Envoy eject the instance at the first failed check, instead of after
+// the unhealthy threshold of its health checker. Istio sidecars honour it as well.
+const envoyImmediateFail = "x-envoy-immediate-health-check-fail"
+
+// liveness answers /healthz: the relay is up. It only fails when the process cannot answer at all,
+// so a draining relay is not restarted before its sessions are done.
+func (s *Server) liveness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthServing)
+}
+
+// readiness answers /readyz: the relay takes new sessions. It fails from the start of a shutdown,
+// shutdown.health_fail_delay before connections are refused, so the mesh routes around the
+// relay before devices are turned away.
+func (s *Server) readiness(w http.ResponseWriter, r *http.Request) {
+	if s.unready.Load() || s.handler.Draining() {
+		w.Header().Set(envoyImmediateFail, "true")
+		writeHealth(w, http.StatusServiceUnavailable, healthNotServing)
+		return
+	}
+	writeHealth(w, http.StatusOK, healthServing)
+}
+
+func writeHealth(w http.ResponseWriter, code int, status string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+	}{status})
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+func TestHealthChecks(t *testing.T) {
+	cfg := config.Default()
+	cfg.Shutdown.HealthFailDelay = "5s"
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	s, err := New(cfg, WithClock(clk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	check := func(path string, wantCode int, wantStatus string) *http.Response {
+		t.Helper()
+		resp, err := client.Get("http://" + ln.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Status string `json:"status"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != wantCode || body.Status != wantStatus {
+			t.Fatalf("expected %s to answer %d %s, got %d %s", path, wantCode, wantStatus, resp.StatusCode, body.Status)
+		}
+		return resp
+	}
+
+	check("/healthz", http.StatusOK, healthServing)
+	if resp := check("/readyz", http.StatusOK, healthServing); resp.Header.Get(envoyImmediateFail) != "" {
+		t.Fatal("expected no immediate health check failure while ready")
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	for deadline := time.Now().Add(5 * time.Second); clk.Waiters() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("shutdown did not wait for shutdown.health_fail_delay")
+		}
+	}
+
+	// for health_fail_delay the relay still answers, but is no longer ready
+	if resp := check("/readyz", http.StatusServiceUnavailable, healthNotServing); resp.Header.Get(envoyImmediateFail) != "true" {
+		t.Fatalf("expected %s to be set once shutting down", envoyImmediateFail)
+	}
+	check("/healthz", http.StatusOK, healthServing)
+	clk.Advance(4 * time.Second)
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown stopped listening before health_fail_delay: %v", err)
+	default:
+	}
+	check("/readyz", http.StatusServiceUnavailable, healthNotServing)
+
+	clk.Advance(time.Second)
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish after health_fail_delay")
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Fatalf("expected the server to be closed, got %v", err)
+	}
+	if _, err := client.Get("http://" + ln.Addr().String() + "/healthz"); err == nil {
+		t.Fatal("expected connections to be refused once shut down")
+	}
+}
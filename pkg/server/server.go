@@ -0,0 +1,506 @@
+// Package server wires the websocket relay into an HTTP server so it can be run standalone or
+// embedded in another Go service.
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/utils"
+	"github.com/pixaverse-studios/websocket-server/pkg/analytics"
+	"github.com/pixaverse-studios/websocket-server/pkg/auth"
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/digest"
+	"github.com/pixaverse-studios/websocket-server/pkg/events"
+	"github.com/pixaverse-studios/websocket-server/pkg/events/kafka"
+	"github.com/pixaverse-studios/websocket-server/pkg/metrics"
+	"github.com/pixaverse-studios/websocket-server/pkg/policy"
+	"github.com/pixaverse-studios/websocket-server/pkg/ratelimit"
+	"github.com/pixaverse-studios/websocket-server/pkg/retranscribe"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+	"github.com/pixaverse-studios/websocket-server/pkg/websocket"
+)
+
+// Server runs the relay's websocket handler on an HTTP listener
+type Server struct {
+	config     *config.Config
+	logger     *slog.Logger
+	metrics    *metrics.Registry
+	handler    *websocket.Handler
+	httpServer *http.Server
+	// transcripts keeps records of finished sessions; nil when transcripts are disabled
+	transcripts store.TranscriptStore
+	digests     *digest.Scheduler
+	signer      *auth.URLSigner
+	nonces      auth.NonceStore
+	keys        auth.KeyStore
+	policy      *policy.Engine
+	limiter     *ratelimit.Limiter
+	// unready fails the readiness check once a shutdown starts
+	unready atomic.Bool
+	// clock times shutdown.health_fail_delay
+	clock clock.Clock
+	// retranscribe is nil unless re-transcription is enabled
+	retranscribe *retranscribe.Runner
+	// analytics aggregates the sessions saved by the handler; nil unless analytics are enabled
+	analytics *analytics.Aggregator
+	// producer and events publish the events of sessions; events is nil unless they are enabled
+	// and a producer was passed or Kafka brokers set. kafka is the producer to them, if it is.
+	producer events.Producer
+	events   *events.Publisher
+	kafka    *kafka.Producer
+	// frameLog is the file of provider_log.path; nil unless provider frames are logged to a file
+	frameLog *os.File
+	// devices keeps the presence of devices; nil unless devices are enabled or a store was passed.
+	// deviceSnapshots is the in-memory store saved to devices.file, nil when there is none.
+	devices         store.DeviceStore
+	deviceSnapshots *store.MemoryDeviceStore
+
+	// jobs is cancelled to stop the background jobs started by ListenAndServe
+	jobs        context.Context
+	stopJobs    context.CancelFunc
+	handlerOpts []websocket.Option
+	digestOpts  []digest.Option
+	// analyticsOpts configure the aggregator
+	analyticsOpts []analytics.Option
+	// regionStores keep the records of tenants pinned to a region, by region
+	regionStores map[string]store.TranscriptStore
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithLogger sets the logger used by the server and the handler. By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithMetricsRegistry sets the registry the server's metrics are recorded in, so they can be
+// exposed alongside the embedding application's own metrics
+func WithMetricsRegistry(reg *metrics.Registry) Option {
+	return func(s *Server) {
+		s.metrics = reg
+	}
+}
+
+// WithHandlerOptions passes options through to the websocket handler
+func WithHandlerOptions(opts ...websocket.Option) Option {
+	return func(s *Server) {
+		s.handlerOpts = append(s.handlerOpts, opts...)
+	}
+}
+
+// WithTranscriptStore sets the store session records are kept in. By default they are kept in
+// memory when transcripts are enabled in the config.
+func WithTranscriptStore(st store.TranscriptStore) Option {
+	return func(s *Server) {
+		s.transcripts = st
+	}
+}
+
+// WithNonceStore sets the store used signed connection URLs are remembered in, so they stay single
+// use across several relays. By default they are remembered in memory.
+func WithNonceStore(n auth.NonceStore) Option {
+	return func(s *Server) {
+		s.nonces = n
+	}
+}
+
+// WithKeyStore sets the store the API keys of devices are looked up in. By default the store named
+// in auth.api_keys is used.
+func WithKeyStore(k auth.KeyStore) Option {
+	return func(s *Server) {
+		s.keys = k
+	}
+}
+
+// WithRegionTranscriptStore sets the store the records of tenants pinned to region are kept in, such
+// as a bucket in the region. Records of a region without a store are kept in memory, unless a store
+// is set with WithTranscriptStore, in which case the region's sessions are refused.
+func WithRegionTranscriptStore(region string, st store.TranscriptStore) Option {
+	return func(s *Server) {
+		if s.regionStores == nil {
+			s.regionStores = make(map[string]store.TranscriptStore)
+		}
+		s.regionStores[strings.ToLower(region)] = st
+	}
+}
+
+// WithDigestOptions passes options through to the digest scheduler
+func WithDigestOptions(opts ...digest.Option) Option {
+	return func(s *Server) {
+		s.digestOpts = append(s.digestOpts, opts...)
+	}
+}
+
+// WithAnalyticsOptions passes options through to the analytics aggregator, such as its intent
+// classifier
+func WithAnalyticsOptions(opts ...analytics.Option) Option {
+	return func(s *Server) {
+		s.analyticsOpts = append(s.analyticsOpts, opts...)
+	}
+}
+
+// WithClock sets the clock shutdown.health_fail_delay is waited on. It defaults to the real clock.
+func WithClock(c clock.Clock) Option {
+	return func(s *Server) {
+		s.clock = c
+	}
+}
+
+// WithEventProducer publishes the normalized stream of session events through p when
+// events.enabled is set, rather than to the brokers of events.kafka
+func WithEventProducer(p events.Producer) Option {
+	return func(s *Server) {
+		s.producer = p
+	}
+}
+
+// New creates a new relay server from the given configuration
+func New(cfg *config.Config, opts ...Option) (*Server, error) {
+	s := &Server{
+		config:  cfg,
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		metrics: metrics.NewRegistry(),
+		clock:   clock.Real(),
+	}
+	s.jobs, s.stopJobs = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	inMemory := s.transcripts == nil
+	if s.transcripts == nil && cfg.Transcripts.Enabled {
+		s.transcripts = store.NewMemoryStore(cfg.Transcripts.MaxSessions)
+	}
+	if s.transcripts != nil && len(cfg.Regions) > 0 {
+		regions := make(map[string]store.TranscriptStore)
+		for name := range cfg.Regions {
+			if st, ok := s.regionStores[name]; ok {
+				regions[name] = st
+			} else if inMemory {
+				regions[name] = store.NewMemoryStore(cfg.Transcripts.MaxSessions)
+			}
+		}
+		s.transcripts = store.NewRegionStore(s.transcripts, regions, func(tenantID string) string {
+			region, _, _ := cfg.RegionFor(tenantID)
+			return region
+		})
+	}
+
+	if s.devices == nil && cfg.Devices.Enabled {
+		devices, err := s.loadDevices()
+		if err != nil {
+			return nil, err
+		}
+		s.devices = devices
+		if cfg.Devices.File != "" {
+			s.deviceSnapshots = devices
+		}
+	}
+
+	handlerOpts := []websocket.Option{
+		websocket.WithLogger(s.logger),
+		websocket.WithMetrics(s.metrics),
+	}
+	if s.devices != nil {
+		handlerOpts = append(handlerOpts, websocket.WithDeviceStore(s.devices))
+	}
+	var tlsConfig *tls.Config
+	if cfg.Server.ClientAuth.Enabled {
+		certAuth, err := auth.NewClientCertAuth(cfg.Server.ClientAuth)
+		if err != nil {
+			return nil, fmt.Errorf("could not set up client certificate auth: %w", err)
+		}
+		tlsConfig = certAuth.TLSConfig(nil)
+		handlerOpts = append(handlerOpts, websocket.WithMiddleware(certAuth.Middleware()))
+	}
+	if cfg.Encryption.Enabled && cfg.Encryption.SigningKeyFile != "" {
+		key, err := loadSigningKey(cfg.Encryption.SigningKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		handlerOpts = append(handlerOpts, websocket.WithSigningKey(key))
+	}
+	if cfg.Auth.SignedURLs.Enabled {
+		signer, err := auth.NewURLSigner(cfg.Auth.SignedURLs, s.nonces)
+		if err != nil {
+			return nil, err
+		}
+		s.signer = signer
+		handlerOpts = append(handlerOpts, websocket.WithMiddleware(signer.Middleware()))
+	}
+	if cfg.Auth.APIKeys.Enabled {
+		keyAuth, err := auth.NewAPIKeyAuth(cfg.Auth.APIKeys, s.keys)
+		if err != nil {
+			return nil, fmt.Errorf("could not set up API key auth: %w", err)
+		}
+		handlerOpts = append(handlerOpts, websocket.WithMiddleware(keyAuth.Middleware()))
+	}
+	if len(cfg.Regions) > 0 {
+		handlerOpts = append(handlerOpts, websocket.WithRegionCheck(s.checkRegion))
+	}
+	if cfg.Connect.Enabled && s.signer != nil {
+		ttl, _ := time.ParseDuration(cfg.Connect.TokenTTL)
+		handlerOpts = append(handlerOpts, websocket.WithConnectTokens(s.signer.ConnectTokens(ttl)))
+	}
+	if cfg.Auth.JWT.Enabled {
+		jwtAuth, err := auth.NewJWTAuth(cfg.Auth.JWT)
+		if err != nil {
+			return nil, fmt.Errorf("could not set up JWT auth: %w", err)
+		}
+		handlerOpts = append(handlerOpts, websocket.WithMiddleware(jwtAuth.Middleware()))
+	}
+	// the handler saves through the aggregator, so that only live sessions are aggregated and not
+	// the records re-transcription saves again
+	if cfg.Analytics.Enabled {
+		analyticsOpts := append([]analytics.Option{analytics.WithMetrics(s.metrics)}, s.analyticsOpts...)
+		s.analytics = analytics.New(cfg, s.transcripts, analyticsOpts...)
+		handlerOpts = append(handlerOpts, websocket.WithTranscriptStore(s.analytics))
+	} else if s.transcripts != nil {
+		handlerOpts = append(handlerOpts, websocket.WithTranscriptStore(s.transcripts))
+	}
+	if cfg.Events.Enabled && s.producer == nil && len(cfg.Events.Kafka.Brokers) > 0 {
+		s.kafka = kafka.New(cfg.Events.Kafka)
+		s.producer = s.kafka
+	}
+	if cfg.Events.Enabled && s.producer != nil {
+		s.events = events.New(cfg.Events, s.producer, events.WithLogger(s.logger), events.WithMetrics(s.metrics))
+		handlerOpts = append(handlerOpts, websocket.WithEvents(s.events))
+	} else if cfg.Events.Enabled {
+		s.logger.Warn("Session events are enabled but no Kafka brokers or event producer were set, they are not published")
+	}
+	if cfg.ProviderLog.Enabled {
+		w := io.Writer(os.Stderr)
+		if cfg.ProviderLog.Path != "" {
+			f, err := os.OpenFile(cfg.ProviderLog.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+			if err != nil {
+				return nil, fmt.Errorf("could not open provider frame log: %w", err)
+			}
+			s.frameLog, w = f, f
+		}
+		handlerOpts = append(handlerOpts, websocket.WithProviderFrameLog(slog.New(slog.NewJSONHandler(w, nil))))
+	}
+	handlerOpts = append(handlerOpts, s.handlerOpts...)
+	// the connection policy runs after any middleware passed in, so it sees authenticated tenants
+	if policy.Enabled(cfg) {
+		engine, err := policy.New(cfg, policy.WithLogger(s.logger), policy.WithMetrics(s.metrics))
+		if err != nil {
+			return nil, fmt.Errorf("could not create connection policy: %w", err)
+		}
+		s.policy = engine
+		handlerOpts = append(handlerOpts, websocket.WithMiddleware(engine.Middleware()))
+	}
+	// rate limits only count the connections the policy allows
+	if cfg.RateLimit.Enabled {
+		limiter, err := ratelimit.New(cfg, ratelimit.WithLogger(s.logger), ratelimit.WithMetrics(s.metrics))
+		if err != nil {
+			return nil, fmt.Errorf("could not create rate limiter: %w", err)
+		}
+		s.limiter = limiter
+		handlerOpts = append(handlerOpts, websocket.WithMiddleware(limiter.Middleware()))
+	}
+	s.handler = websocket.NewHandler(cfg, handlerOpts...)
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", s.metrics.Handler())
+	mux.HandleFunc("GET /healthz", s.liveness)
+	mux.HandleFunc("GET /readyz", s.readiness)
+	if s.signer != nil {
+		mux.Handle("POST /tokens", s.signer.Handler())
+	}
+	if cfg.Connect.Enabled {
+		mux.Handle("GET /connect/info", s.handler.ConnectInfoHandler())
+	}
+	if cfg.Retranscribe.Enabled && s.transcripts != nil {
+		s.retranscribe = retranscribe.New(cfg, s.transcripts, s.handler.Providers(), retranscribe.WithLogger(s.logger), retranscribe.WithMetrics(s.metrics))
+	}
+	if cfg.Admin.Enabled {
+		admin := &adminHandler{apiKey: cfg.Admin.APIKey, sessions: s.handler.Sessions(), heat: s.handler.HeatHistory(), refresh: s.handler.RefreshProvider, faq: s.handler.FAQ(), transcripts: s.transcripts}
+		admin.retranscribe, admin.jobs = s.retranscribe, s.jobs
+		admin.analytics = s.analytics
+		if cfg.Admin.Listen {
+			admin.listen = s.handler.Listen
+		}
+		admin.devices = s.devices
+		if admin.announcements = s.handler.Announcements(); admin.announcements != nil {
+			admin.announce = s.handler.ScheduleAnnouncement
+		}
+		admin.register(mux)
+	}
+	mux.Handle("/", s.handler)
+
+	if cfg.Digest.Enabled && s.transcripts != nil {
+		digestOpts := append([]digest.Option{digest.WithLogger(s.logger)}, s.digestOpts...)
+		s.digests = digest.NewScheduler(cfg, s.transcripts, digestOpts...)
+	}
+
+	s.httpServer = &http.Server{
+		Addr:      fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+	return s, nil
+}
+
+// URLSigner returns the signer of connection URLs, so backends embedding the relay can mint them
+// directly. It is nil unless signed URLs are enabled.
+func (s *Server) URLSigner() *auth.URLSigner {
+	return s.signer
+}
+
+// Analytics returns the aggregator of the analytics of finished sessions, or nil if analytics are
+// disabled
+func (s *Server) Analytics() *analytics.Aggregator {
+	return s.analytics
+}
+
+// Metrics returns the registry the server's metrics are recorded in
+func (s *Server) Metrics() *metrics.Registry {
+	return s.metrics
+}
+
+// Handler returns the websocket handler, so it can be mounted on an existing mux instead of
+// using ListenAndServe
+func (s *Server) Handler() *websocket.Handler {
+	return s.handler
+}
+
+// Transcripts returns the store session records are kept in, or nil if transcripts are disabled
+func (s *Server) Transcripts() store.TranscriptStore {
+	return s.transcripts
+}
+
+// Devices returns the store the presence of devices is kept in, or nil if it is not kept
+func (s *Server) Devices() store.DeviceStore {
+	return s.devices
+}
+
+// Sessions returns the manager tracking the server's active sessions
+func (s *Server) Sessions() *websocket.SessionManager {
+	return s.handler.Sessions()
+}
+
+// ListenAndServe starts accepting connections, using TLS when it is enabled in the config. It
+// blocks until the server is shut down, in which case it returns http.ErrServerClosed. The digest
+// scheduler and the session reaper, if enabled, run until then.
+func (s *Server) ListenAndServe() error {
+	defer s.stopJobs()
+	s.startJobs()
+
+	l, err := utils.Listen(context.Background(), "tcp", s.httpServer.Addr, s.config.Server.Socket)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("Starting server", "port", s.config.Server.Port)
+	if s.config.Server.EnableTLS {
+		s.logger.Info("TLS enabled", "cert_file", s.config.Server.CertFile)
+		return s.httpServer.ServeTLS(l, s.config.Server.CertFile, s.config.Server.KeyFile)
+	}
+	return s.httpServer.Serve(l)
+}
+
+// Serve is like ListenAndServe but accepts connections on l instead of the configured port. The
+// socket options of server.socket are not applied to l.
+func (s *Server) Serve(l net.Listener) error {
+	defer s.stopJobs()
+	s.startJobs()
+
+	s.logger.Info("Starting server", "addr", l.Addr().String())
+	if s.config.Server.EnableTLS {
+		return s.httpServer.ServeTLS(l, s.config.Server.CertFile, s.config.Server.KeyFile)
+	}
+	return s.httpServer.Serve(l)
+}
+
+func (s *Server) startJobs() {
+	if s.digests != nil {
+		go s.digests.Run(s.jobs)
+	}
+	if s.config.Reaper.Enabled {
+		go s.handler.RunReaper(s.jobs)
+	}
+	if s.events != nil {
+		go s.events.Run(s.jobs)
+	}
+	if s.handler.Announcements() != nil {
+		go s.handler.RunAnnouncements(s.jobs)
+	}
+	if s.deviceSnapshots != nil {
+		go s.runDeviceSnapshots()
+	}
+}
+
+// Close immediately closes the listener and all active connections
+func (s *Server) Close() error {
+	s.stopJobs()
+	err := s.httpServer.Close()
+	if s.policy != nil {
+		s.policy.Close()
+	}
+	if s.limiter != nil {
+		s.limiter.Close()
+	}
+	if s.frameLog != nil {
+		s.frameLog.Close()
+	}
+	if s.kafka != nil {
+		s.kafka.Close()
+	}
+	if s.deviceSnapshots != nil {
+		if err := s.saveDevices(); err != nil {
+			s.logger.Error("Could not save devices", "error", err)
+		}
+	}
+	return err
+}
+
+// checkRegion reports whether the records and traces of a region's sessions can be kept in the
+// region
+func (s *Server) checkRegion(ctx context.Context, region string) error {
+	if rs, ok := s.transcripts.(*store.RegionStore); ok && rs.Region(region) == nil {
+		return store.ErrRegionUnavailable
+	}
+	if s.config.Trace.Enabled {
+		if err := os.MkdirAll(s.config.Regions[region].TraceDir, 0o750); err != nil {
+			return fmt.Errorf("trace directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// loadSigningKey reads a PEM PKCS #8 Ed25519 private key
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse signing key: %w", err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key in %s is not an Ed25519 key", path)
+	}
+	return edKey, nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/websocket"
+)
+
+// ShutdownReport summarizes a shutdown of the relay: how its sessions were drained and how long
+// it took. It is logged and posted to shutdown.webhook_url.
+type ShutdownReport struct {
+	// Instance is the host name of the relay that shut down
+	Instance string `json:"instance"`
+	websocket.DrainReport
+}
+
+// Shutdown fails the readiness check for shutdown.health_fail_delay, stops accepting connections,
+// drains the active sessions for up to shutdown.drain_timeout and reports how the drain went.
+// Sessions still running when ctx is done are left to Close, which is still to be called.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.unready.Store(true)
+	if delay, _ := time.ParseDuration(s.config.Shutdown.HealthFailDelay); delay > 0 {
+		s.logger.Info("Failing health checks before shutting down", "delay", delay)
+		select {
+		case <-s.clock.After(delay):
+		case <-ctx.Done():
+		}
+	}
+	s.stopJobs()
+	err := s.httpServer.Shutdown(ctx)
+
+	timeout, _ := time.ParseDuration(s.config.Shutdown.DrainTimeout)
+	report := ShutdownReport{DrainReport: s.handler.Drain(ctx, timeout)}
+	report.Instance, _ = os.Hostname()
+	s.logger.Info("Shutdown report",
+		"clean", report.Clean,
+		"sessions", report.Sessions,
+		"sessions_drained", report.SessionsDrained,
+		"sessions_force_closed", report.SessionsForceClosed,
+		"sessions_unfinished", report.SessionsUnfinished,
+		"bytes_flushed", report.BytesFlushed,
+		"records_finalized", report.RecordsFinalized,
+		"duration_ms", report.DurationMs)
+	if url := s.config.Shutdown.WebhookURL; url != "" {
+		// the shutdown may have used up ctx, the report gets a bounded context of its own
+		postCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := postShutdownReport(postCtx, url, report); err != nil {
+			s.logger.Error("Could not post shutdown report", "error", err)
+		}
+	}
+	return err
+}
+
+func postShutdownReport(ctx context.Context, url string, report ShutdownReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("shutdown webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
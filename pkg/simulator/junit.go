@@ -0,0 +1,96 @@
+package simulator
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Errors    int         `xml:"errors,attr"`
+	Time      string      `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// WriteJUnit writes results as a JUnit XML report: a test suite per script and a test case per
+// turn, with the assistant's answers and latencies as the cases' output
+func WriteJUnit(w io.Writer, results []ScriptResult) error {
+	report := junitSuites{Name: "simulator"}
+	var total time.Duration
+	for _, result := range results {
+		suite := junitSuite{
+			Name:      result.Script,
+			Time:      seconds(result.Duration),
+			Timestamp: result.StartedAt.UTC().Format("2006-01-02T15:04:05"),
+		}
+		for _, turn := range result.Turns {
+			c := junitCase{
+				Name:      turn.Name,
+				Classname: result.Script,
+				Time:      seconds(turn.Duration),
+				SystemOut: fmt.Sprintf("transcript: %s\nlatency: %s", turn.Transcript, turn.Latency.Round(time.Millisecond)),
+			}
+			switch {
+			case turn.Err != nil:
+				c.Error = &junitMessage{Message: turn.Err.Error()}
+				suite.Errors++
+			case len(turn.Failures) > 0:
+				c.Failure = &junitMessage{Message: turn.Failures[0], Body: strings.Join(turn.Failures, "\n")}
+				suite.Failures++
+			}
+			suite.Cases = append(suite.Cases, c)
+		}
+		suite.Tests = len(suite.Cases)
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+		report.Errors += suite.Errors
+		report.Suites = append(report.Suites, suite)
+		total += result.Duration
+	}
+	report.Time = seconds(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
@@ -0,0 +1,145 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/spf13/viper"
+)
+
+// Script is a scripted conversation: the user's utterances, played to the relay one after the
+// other over a single session, and what the assistant is expected to answer to each
+type Script struct {
+	Name     string `mapstructure:"name"`
+	DeviceID string `mapstructure:"device_id"`
+	TenantID string `mapstructure:"tenant_id"`
+	// Headers are added to the connection request, e.g. X-Pixa-Tags. Their names are read lower
+	// cased, which makes no difference to HTTP.
+	Headers map[string]string `mapstructure:"headers"`
+	// TrailingSilence is streamed after every utterance, so the provider detects the end of the
+	// turn the way it would with a real device
+	TrailingSilence string `mapstructure:"trailing_silence"`
+	// Settle is how long the assistant must stay quiet for its answer to count as complete
+	Settle string `mapstructure:"settle"`
+	Turns  []Turn `mapstructure:"turns"`
+
+	trailingSilence time.Duration
+	settle          time.Duration
+}
+
+// Turn is one utterance of the user and the expectations on the assistant's answer
+type Turn struct {
+	Name string `mapstructure:"name"`
+	// Audio is a 16 bit PCM WAV file with the utterance, relative to the script
+	Audio string `mapstructure:"audio"`
+	// Expect are regular expressions the answer's transcript must match, Reject ones it must not
+	Expect []string `mapstructure:"expect"`
+	Reject []string `mapstructure:"reject"`
+	// MaxLatency bounds the time from the end of the utterance to the first audio of the answer
+	MaxLatency string `mapstructure:"max_latency"`
+	// Timeout bounds the wait for the answer to be complete
+	Timeout string `mapstructure:"timeout"`
+
+	utterance  audio.Audio
+	expect     []*regexp.Regexp
+	reject     []*regexp.Regexp
+	maxLatency time.Duration
+	timeout    time.Duration
+}
+
+// LoadScript reads a script from a YAML or JSON file and the utterances it refers to
+func LoadScript(path string) (*Script, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("could not read script %s: %w", path, err)
+	}
+	var s Script
+	if err := v.Unmarshal(&s); err != nil {
+		return nil, fmt.Errorf("could not read script %s: %w", path, err)
+	}
+	if s.Name == "" {
+		s.Name = filepath.Base(path)
+	}
+	if err := s.prepare(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("script %s: %w", s.Name, err)
+	}
+	return &s, nil
+}
+
+// prepare validates the script and loads its utterances from dir
+func (s *Script) prepare(dir string) error {
+	var err error
+	if s.trailingSilence, err = parseDuration("trailing_silence", s.TrailingSilence, "1s"); err != nil {
+		return err
+	}
+	if s.settle, err = parseDuration("settle", s.Settle, "1500ms"); err != nil {
+		return err
+	}
+	if len(s.Turns) == 0 {
+		return errors.New("no turns")
+	}
+	for i := range s.Turns {
+		t := &s.Turns[i]
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("turn %d", i+1)
+		}
+		if err := t.prepare(dir); err != nil {
+			return fmt.Errorf("%s: %w", t.Name, err)
+		}
+	}
+	return nil
+}
+
+func (t *Turn) prepare(dir string) error {
+	if t.Audio == "" {
+		return errors.New("no audio")
+	}
+	path := t.Audio
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if t.utterance, err = audio.FromWAV(data); err != nil {
+		return fmt.Errorf("could not decode %s: %w", t.Audio, err)
+	}
+	for _, list := range []struct {
+		patterns []string
+		into     *[]*regexp.Regexp
+	}{{t.Expect, &t.expect}, {t.Reject, &t.reject}} {
+		for _, p := range list.patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", p, err)
+			}
+			*list.into = append(*list.into, re)
+		}
+	}
+	if t.maxLatency, err = parseDuration("max_latency", t.MaxLatency, "0s"); err != nil {
+		return err
+	}
+	if t.timeout, err = parseDuration("timeout", t.Timeout, "30s"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseDuration parses a duration of the script, def standing in for an empty value
+func parseDuration(name, value, def string) (time.Duration, error) {
+	if value == "" {
+		value = def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, value)
+	}
+	return d, nil
+}
@@ -0,0 +1,366 @@
+// Package simulator drives relay sessions with scripted conversations for QA. It plays pre-rendered
+// user utterances to the relay the way a device would, checks the assistant's answers against
+// transcript patterns and latency budgets, and reports the results in the JUnit format CI systems
+// display.
+package simulator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/websocket"
+	"github.com/pixaverse-studios/websocket-server/sdk/tinygo/pixa"
+)
+
+const (
+	// frameInterval is how much audio the simulator sends per binary frame
+	frameInterval = 20 * time.Millisecond
+	writeWait     = 5 * time.Second
+)
+
+// errNotRun fails the turns left when a conversation is cut short
+var errNotRun = errors.New("not run, the conversation ended before this turn")
+
+// Runner plays scripts against a relay
+type Runner struct {
+	url        string
+	logger     *slog.Logger
+	sampleRate int
+	channels   int
+}
+
+// Option configures a Runner
+type Option func(*Runner)
+
+// WithLogger sets the logger the runner reports progress to. By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(r *Runner) {
+		r.logger = logger
+	}
+}
+
+// WithAudioFormat sets the format the relay expects device audio in, its audio.sample_rate and
+// audio.channels. It defaults to the relay's default format.
+func WithAudioFormat(sampleRate, channels int) Option {
+	return func(r *Runner) {
+		r.sampleRate, r.channels = sampleRate, channels
+	}
+}
+
+// New creates a runner for the relay listening at url, e.g. ws://localhost:8080/
+func New(url string, opts ...Option) *Runner {
+	defaults := config.Default().Audio
+	r := &Runner{
+		url:        url,
+		logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		sampleRate: defaults.SampleRate,
+		channels:   defaults.Channels,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// ScriptResult is the outcome of playing a script
+type ScriptResult struct {
+	Script    string
+	StartedAt time.Time
+	Duration  time.Duration
+	Turns     []TurnResult
+	// Err is set when the conversation could not be carried out, e.g. because the connection failed
+	Err error
+}
+
+// Failed reports whether any turn failed or the conversation could not be carried out
+func (r ScriptResult) Failed() bool {
+	if r.Err != nil {
+		return true
+	}
+	for _, t := range r.Turns {
+		if t.Failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// TurnResult is the outcome of one turn
+type TurnResult struct {
+	Name string
+	// Transcript is the assistant's answer, its sentences joined with spaces
+	Transcript string
+	// Latency is the time from the end of the utterance to the first answer audio received after
+	// it, 0 if there was none
+	Latency  time.Duration
+	Duration time.Duration
+	// Failures describes every expectation that was not met
+	Failures []string
+	// Err is set when the turn could not be played
+	Err error
+}
+
+// Failed reports whether the turn failed
+func (t TurnResult) Failed() bool {
+	return t.Err != nil || len(t.Failures) > 0
+}
+
+// message is a message received from the relay
+type message struct {
+	at     time.Time
+	binary bool
+	data   []byte
+}
+
+// Run plays script over one session and checks the answers
+func (r *Runner) Run(ctx context.Context, script *Script) (result ScriptResult) {
+	result = ScriptResult{Script: script.Name, StartedAt: time.Now()}
+	defer func() { result.Duration = time.Since(result.StartedAt) }()
+	logger := r.logger.With("script", script.Name)
+
+	header := make(http.Header)
+	for name, value := range script.Headers {
+		header.Set(name, value)
+	}
+	if script.DeviceID != "" {
+		header.Set(websocket.DeviceIDHeader, script.DeviceID)
+	}
+	if script.TenantID != "" {
+		header.Set(websocket.TenantIDHeader, script.TenantID)
+	}
+	conn, _, err := gorilla.DefaultDialer.DialContext(ctx, r.url, header)
+	if err != nil {
+		result.Err = fmt.Errorf("could not connect: %w", err)
+		result.Turns = notRun(script.Turns, result.Err)
+		return result
+	}
+	defer conn.Close()
+
+	messages := make(chan message, 256)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			typ, data, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case messages <- message{at: time.Now(), binary: typ == gorilla.BinaryMessage, data: data}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	s := &session{runner: r, conn: conn, messages: messages, readErr: readErr, script: script}
+	for i, turn := range script.Turns {
+		logger.Info("Playing turn", "turn", turn.Name)
+		t := s.play(ctx, turn)
+		result.Turns = append(result.Turns, t)
+		if t.Err != nil {
+			result.Err = fmt.Errorf("%s: %w", turn.Name, t.Err)
+			result.Turns = append(result.Turns, notRun(script.Turns[i+1:], errNotRun)...)
+			break
+		}
+		logger.Info("Turn finished", "turn", turn.Name, "latency", t.Latency, "failures", len(t.Failures), "transcript", t.Transcript)
+	}
+	conn.WriteControl(gorilla.CloseMessage, gorilla.FormatCloseMessage(gorilla.CloseNormalClosure, ""), time.Now().Add(writeWait))
+	return result
+}
+
+// notRun returns the results of turns that could not be played because of err
+func notRun(turns []Turn, err error) []TurnResult {
+	results := make([]TurnResult, len(turns))
+	for i, t := range turns {
+		results[i] = TurnResult{Name: t.Name, Err: err}
+	}
+	return results
+}
+
+// session is a conversation in progress
+type session struct {
+	runner   *Runner
+	conn     *gorilla.Conn
+	messages <-chan message
+	readErr  <-chan error
+	script   *Script
+}
+
+// answer collects the assistant's answer to a turn
+type answer struct {
+	utteranceEnd time.Time
+	firstAudio   time.Time
+	lastActivity time.Time
+	sentences    []string
+}
+
+func (a *answer) receive(m message) {
+	a.lastActivity = m.at
+	if m.binary {
+		if a.firstAudio.IsZero() && !a.utteranceEnd.IsZero() {
+			a.firstAudio = m.at
+		}
+		return
+	}
+	var sentence pixa.SentenceCompletedEvent
+	if json.Unmarshal(m.data, &sentence) == nil && sentence.Type == pixa.TypeSentenceCompleted {
+		a.sentences = append(a.sentences, sentence.Text)
+	}
+}
+
+// play streams a turn's utterance followed by the trailing silence in real time, waits for the
+// answer to settle and checks it
+func (s *session) play(ctx context.Context, turn Turn) (result TurnResult) {
+	result = TurnResult{Name: turn.Name}
+	start := time.Now()
+	defer func() { result.Duration = time.Since(start) }()
+
+	s.drain()
+	ans := &answer{}
+	if err := s.stream(ctx, s.runner.uplink(turn.utterance), ans); err != nil {
+		result.Err = err
+		return result
+	}
+	ans.utteranceEnd = time.Now()
+	if err := s.stream(ctx, s.runner.silence(s.script.trailingSilence), ans); err != nil {
+		result.Err = err
+		return result
+	}
+
+	deadline := time.NewTimer(turn.timeout - time.Since(ans.utteranceEnd))
+	defer deadline.Stop()
+	poll := time.NewTicker(frameInterval)
+	defer poll.Stop()
+	complete := false
+	for !complete {
+		select {
+		case <-ctx.Done():
+			result.Err = ctx.Err()
+			return result
+		case err := <-s.readErr:
+			result.Err = fmt.Errorf("connection lost: %w", err)
+			return result
+		case m := <-s.messages:
+			ans.receive(m)
+		case <-poll.C:
+			complete = !ans.lastActivity.IsZero() && time.Since(ans.lastActivity) >= s.script.settle
+		case <-deadline.C:
+			result.Failures = append(result.Failures, fmt.Sprintf("no complete answer within %s", turn.timeout))
+			complete = true
+		}
+	}
+
+	result.Transcript = strings.Join(ans.sentences, " ")
+	if !ans.firstAudio.IsZero() {
+		result.Latency = ans.firstAudio.Sub(ans.utteranceEnd)
+	}
+	result.Failures = append(result.Failures, turn.check(result.Transcript, ans.firstAudio.IsZero(), result.Latency)...)
+	return result
+}
+
+// check returns the expectations of the turn an answer does not meet
+func (t Turn) check(transcript string, noAudio bool, latency time.Duration) []string {
+	var failures []string
+	for _, re := range t.expect {
+		if !re.MatchString(transcript) {
+			failures = append(failures, fmt.Sprintf("answer %q does not match %q", transcript, re))
+		}
+	}
+	for _, re := range t.reject {
+		if re.MatchString(transcript) {
+			failures = append(failures, fmt.Sprintf("answer %q matches %q", transcript, re))
+		}
+	}
+	if t.maxLatency > 0 {
+		if noAudio {
+			failures = append(failures, "no answer audio")
+		} else if latency > t.maxLatency {
+			failures = append(failures, fmt.Sprintf("first answer audio after %s, the budget is %s", latency.Round(time.Millisecond), t.maxLatency))
+		}
+	}
+	return failures
+}
+
+// drain discards what is left of the previous answer
+func (s *session) drain() {
+	for {
+		select {
+		case <-s.messages:
+		default:
+			return
+		}
+	}
+}
+
+// stream sends pcm in frames paced in real time, collecting the relay's messages in between
+func (s *session) stream(ctx context.Context, pcm []byte, ans *answer) error {
+	frameBytes := s.runner.bytesFor(frameInterval)
+	next := time.Now()
+	for len(pcm) > 0 {
+		n := min(len(pcm), frameBytes)
+		s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := s.conn.WriteMessage(gorilla.BinaryMessage, pcm[:n]); err != nil {
+			return fmt.Errorf("could not send audio: %w", err)
+		}
+		pcm = pcm[n:]
+		next = next.Add(frameInterval)
+
+		wait := time.NewTimer(time.Until(next))
+		for waiting := true; waiting; {
+			select {
+			case <-ctx.Done():
+				wait.Stop()
+				return ctx.Err()
+			case err := <-s.readErr:
+				wait.Stop()
+				return fmt.Errorf("connection lost: %w", err)
+			case m := <-s.messages:
+				ans.receive(m)
+			case <-wait.C:
+				waiting = false
+			}
+		}
+	}
+	return nil
+}
+
+// uplink converts an utterance to the relay's device audio format
+func (r *Runner) uplink(utterance audio.Audio) []byte {
+	if utterance.GetChannels() == 2 {
+		utterance.StereoToMono()
+	}
+	utterance.Resample(r.sampleRate)
+	mono := utterance.AsPCM16()
+	if r.channels == 1 {
+		return mono
+	}
+	pcm := make([]byte, 0, len(mono)*r.channels)
+	for i := 0; i+1 < len(mono); i += 2 {
+		for c := 0; c < r.channels; c++ {
+			pcm = append(pcm, mono[i], mono[i+1])
+		}
+	}
+	return pcm
+}
+
+// silence returns d of silent device audio
+func (r *Runner) silence(d time.Duration) []byte {
+	return make([]byte, r.bytesFor(d))
+}
+
+func (r *Runner) bytesFor(d time.Duration) int {
+	return int(d*time.Duration(r.sampleRate)/time.Second) * r.channels * 2
+}
@@ -0,0 +1,106 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/websocket"
+	"github.com/pixaverse-studios/websocket-server/pkg/websocket/websockettest"
+)
+
+// toneWAV encodes d of a mono 16 bit tone at 16khz as a WAV file
+func toneWAV(d time.Duration) []byte {
+	const rate = 16000
+	pcm := make([]byte, int(d*rate/time.Second)*2)
+	for i := 0; i < len(pcm)/2; i++ {
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(int16(8000*math.Sin(2*math.Pi*300*float64(i)/rate))))
+	}
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(36+len(pcm)))
+	b.WriteString("WAVEfmt ")
+	for _, v := range []any{uint32(16), uint16(1), uint16(1), uint32(rate), uint32(rate * 2), uint16(2), uint16(16)} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(len(pcm)))
+	b.Write(pcm)
+	return b.Bytes()
+}
+
+func TestSimulator(t *testing.T) {
+	srv := websockettest.NewTestServer(t,
+		websockettest.WithConfig(func(cfg *config.Config) {
+			cfg.AIConfig.Mock.TurnAfter = "400ms"
+			cfg.AIConfig.Mock.ResponseLength = "300ms"
+		}),
+		// the simulator paces audio and measures latency in real time
+		websockettest.WithHandlerOptions(websocket.WithClock(clock.Real())),
+	)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "question.wav"), toneWAV(400*time.Millisecond), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	scriptPath := filepath.Join(dir, "order.yaml")
+	os.WriteFile(scriptPath, []byte(`
+name: order status
+device_id: qa-sim
+trailing_silence: 0s
+settle: 300ms
+turns:
+  - name: first question
+    audio: question.wav
+    expect: ["mock response number 1"]
+    max_latency: 2s
+    timeout: 5s
+  - name: follow up
+    audio: question.wav
+    expect: ["number 2"]
+    reject: ["(?i)mock response number 2"]
+    timeout: 5s
+`), 0o644)
+	script, err := LoadScript(scriptPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := New(srv.URL, WithAudioFormat(srv.Config.Audio.SampleRate, srv.Config.Audio.Channels)).Run(context.Background(), script)
+	if result.Err != nil || len(result.Turns) != 2 {
+		t.Fatalf("conversation failed: %v (%+v)", result.Err, result.Turns)
+	}
+	first, second := result.Turns[0], result.Turns[1]
+	if first.Failed() || first.Transcript != "This is mock response number 1." || first.Latency <= 0 {
+		t.Fatalf("unexpected first turn %+v", first)
+	}
+	if len(second.Failures) != 1 || !strings.Contains(second.Failures[0], "matches") {
+		t.Fatalf("expected the follow up to fail its reject pattern, got %+v", second)
+	}
+
+	var report bytes.Buffer
+	if err := WriteJUnit(&report, []ScriptResult{result}); err != nil {
+		t.Fatal(err)
+	}
+	var parsed junitSuites
+	if err := xml.Unmarshal(report.Bytes(), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Tests != 2 || parsed.Failures != 1 || len(parsed.Suites) != 1 || parsed.Suites[0].Cases[1].Failure == nil {
+		t.Fatalf("unexpected report:\n%s", report.String())
+	}
+
+	unreachable := New("ws://127.0.0.1:1/").Run(context.Background(), script)
+	if unreachable.Err == nil || len(unreachable.Turns) != 2 || unreachable.Turns[1].Err == nil {
+		t.Fatalf("expected every turn to error without a relay, got %+v", unreachable)
+	}
+}
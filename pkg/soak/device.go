@@ -0,0 +1,145 @@
+package soak
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// frameInterval is how much audio a synthetic device sends per binary frame
+	frameInterval = 20 * time.Millisecond
+	// ackInterval is how often a synthetic device reports what it has played
+	ackInterval = 500 * time.Millisecond
+	// retryDelay is how long a device waits before reconnecting after a failed session
+	retryDelay = time.Second
+	writeWait  = 5 * time.Second
+)
+
+// runDevice keeps one synthetic device connected until ctx is done, reconnecting after every
+// session. The device connects over link, or directly if it is nil.
+func (r *Runner) runDevice(ctx context.Context, url, id string, link *Link) {
+	frame := r.deviceFrame()
+	dialer := &websocket.Dialer{NetDialContext: r.dialer(link), HandshakeTimeout: 45 * time.Second}
+	for ctx.Err() == nil {
+		if err := r.runSession(ctx, dialer, url+"?device_id="+id, frame); err != nil {
+			r.sessionErrors.Add(1)
+			r.logger.Debug("Soak device session failed", "device_id", id, "error", err)
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// runSession streams audio in real time for one session length, acknowledging the audio it
+// receives as played, then closes the connection normally
+func (r *Runner) runSession(ctx context.Context, dialer *websocket.Dialer, url string, frame []byte) error {
+	conn, _, err := dialer.DialContext(ctx, url, nil)
+	if err != nil {
+		r.dialErrors.Add(1)
+		return err
+	}
+	defer conn.Close()
+	r.connections.Add(1)
+
+	// sentMs is the downlink audio the relay reports as sent, the device plays it instantly
+	var sentMs atomic.Int64
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			typ, data, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if typ == websocket.BinaryMessage {
+				r.bytesReceived.Add(int64(len(data)))
+				continue
+			}
+			var status struct {
+				Type   string `json:"type"`
+				Cursor struct {
+					SentMs int64 `json:"sent_ms"`
+				} `json:"cursor"`
+			}
+			if json.Unmarshal(data, &status) == nil && status.Type == "session.status" {
+				sentMs.Store(status.Cursor.SentMs)
+			}
+		}
+	}()
+
+	sessionEnd := time.NewTimer(r.sessionLength)
+	defer sessionEnd.Stop()
+	frames := time.NewTicker(frameInterval)
+	defer frames.Stop()
+	acks := time.NewTicker(ackInterval)
+	defer acks.Stop()
+
+	for {
+		select {
+		case <-frames.C:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+				return err
+			}
+		case <-acks.C:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			ack := map[string]interface{}{"type": "playback.ack", "played_ms": sentMs.Load()}
+			if err := conn.WriteJSON(ack); err != nil {
+				return err
+			}
+		case err := <-readErr:
+			return err
+		case <-sessionEnd.C:
+			return closeSession(conn, readErr)
+		case <-ctx.Done():
+			return closeSession(conn, readErr)
+		}
+	}
+}
+
+// closeSession closes the connection normally and waits for the relay to close its side
+func closeSession(conn *websocket.Conn, readErr <-chan error) error {
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")); err != nil {
+		return err
+	}
+	select {
+	case err := <-readErr:
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			return nil
+		}
+		return err
+	case <-time.After(writeWait):
+		return nil
+	}
+}
+
+// deviceFrame is one frame of speech-like audio in the configured device format: a low tone,
+// since the mock provider only counts how much audio it hears. It carries a checksum if the relay
+// expects one.
+func (r *Runner) deviceFrame() []byte {
+	rate := r.config.Audio.SampleRate
+	channels := r.config.Audio.Channels
+	samples := int(frameInterval * time.Duration(rate) / time.Second)
+	data := make([]byte, samples*channels*2)
+	for i := 0; i < samples; i++ {
+		v := int16(0.2 * math.MaxInt16 * math.Sin(2*math.Pi*220*float64(i)/float64(rate)))
+		for c := 0; c < channels; c++ {
+			binary.LittleEndian.PutUint16(data[(i*channels+c)*2:], uint16(v))
+		}
+	}
+	if r.config.Websocket.FrameChecksum {
+		return append(binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(data)), data...)
+	}
+	return data
+}
@@ -0,0 +1,387 @@
+package soak
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// segmentSize is the most a simulated link carries in one segment, the MSS of an ethernet path
+	segmentSize = 1460
+	// sendBuffer is how much a device may have queued on its link before its writes block, like the
+	// socket buffer of a real connection
+	sendBuffer = 64 << 10
+	// minRTO is the shortest time TCP waits before retransmitting a lost segment
+	minRTO = 200 * time.Millisecond
+)
+
+// Link is the network between a synthetic device and the relay. It is simulated on the device's
+// side of the connection, so the relay sees the traffic of a device on a slow mobile link. Rates
+// are in bytes per second; zero leaves a direction unlimited.
+type Link struct {
+	UplinkRate   int
+	DownlinkRate int
+	// Burst is how many bytes a direction may send at once after it was idle, the size of its
+	// token bucket; zero allows 100ms of traffic
+	Burst int
+	// Latency delays every segment one way, and Jitter adds up to as much again at random
+	Latency time.Duration
+	Jitter  time.Duration
+	// Loss is the share of segments lost. TCP retransmits them, so a lost segment holds up the
+	// stream behind it for a retransmission timeout.
+	Loss float64
+}
+
+// Profiles are links of common classes of mobile networks, by name
+var Profiles = map[string]Link{
+	"gprs": {UplinkRate: 2_500, DownlinkRate: 5_000, Latency: 500 * time.Millisecond, Jitter: 200 * time.Millisecond, Loss: 0.02},
+	"2g":   {UplinkRate: 12_000, DownlinkRate: 25_000, Latency: 300 * time.Millisecond, Jitter: 100 * time.Millisecond, Loss: 0.01},
+	"3g":   {UplinkRate: 48_000, DownlinkRate: 180_000, Latency: 100 * time.Millisecond, Jitter: 40 * time.Millisecond, Loss: 0.005},
+	"4g":   {UplinkRate: 625_000, DownlinkRate: 1_250_000, Latency: 40 * time.Millisecond, Jitter: 10 * time.Millisecond, Loss: 0.001},
+}
+
+// ParseLink parses a link of the form "3g", "up=64,down=128,latency=300ms,jitter=100ms,loss=0.02"
+// or a profile with some of its values replaced, "3g,loss=0.05". Rates are in kbit/s and burst in
+// bytes.
+func ParseLink(spec string) (Link, error) {
+	var l Link
+	for i, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			p, known := Profiles[strings.ToLower(field)]
+			if i > 0 || !known {
+				return Link{}, fmt.Errorf("unknown link profile %q", field)
+			}
+			l = p
+			continue
+		}
+		var err error
+		switch key {
+		case "up", "down":
+			var kbps float64
+			if kbps, err = strconv.ParseFloat(value, 64); err == nil && kbps >= 0 {
+				rate := int(kbps * 1000 / 8)
+				if key == "up" {
+					l.UplinkRate = rate
+				} else {
+					l.DownlinkRate = rate
+				}
+			}
+		case "burst":
+			l.Burst, err = strconv.Atoi(value)
+		case "latency":
+			l.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			l.Jitter, err = time.ParseDuration(value)
+		case "loss":
+			if l.Loss, err = strconv.ParseFloat(value, 64); err == nil && (l.Loss < 0 || l.Loss >= 1) {
+				err = fmt.Errorf("must be at least 0 and below 1")
+			}
+		default:
+			return Link{}, fmt.Errorf("unknown link setting %q", key)
+		}
+		if err != nil {
+			return Link{}, fmt.Errorf("invalid link %s %q: %v", key, value, err)
+		}
+	}
+	return l, nil
+}
+
+// rto is how long a lost segment holds up the stream
+func (l Link) rto() time.Duration {
+	return max(minRTO, 2*(l.Latency+l.Jitter))
+}
+
+// segment is a piece of the byte stream on a link, or the error that ended it
+type segment struct {
+	data []byte
+	err  error
+	at   time.Time
+}
+
+// shaper carries one direction of a link: segments pass a token bucket at the direction's rate,
+// then wait in a delay queue until their delivery time and are handed to deliver in order
+type shaper struct {
+	rate    int
+	burst   int
+	latency time.Duration
+	jitter  time.Duration
+	loss    float64
+	rto     time.Duration
+	lost    *atomic.Int64
+
+	queued  chan segment
+	delayed chan segment
+	deliver func(segment) error
+	done    <-chan struct{}
+}
+
+func newShaper(l Link, rate int, lost *atomic.Int64, done <-chan struct{}, deliver func(segment) error) *shaper {
+	burst := l.Burst
+	if burst <= 0 {
+		burst = max(rate/10, segmentSize)
+	}
+	s := &shaper{
+		rate:    rate,
+		burst:   burst,
+		latency: l.Latency,
+		jitter:  l.Jitter,
+		loss:    l.Loss,
+		rto:     l.rto(),
+		lost:    lost,
+		queued:  make(chan segment, sendBuffer/segmentSize),
+		delayed: make(chan segment, 1024),
+		deliver: deliver,
+		done:    done,
+	}
+	go s.shape()
+	go s.release()
+	return s
+}
+
+// sleep waits for d, reporting false if the link was closed meanwhile
+func (s *shaper) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// shape takes segments through the token bucket and schedules their delivery
+func (s *shaper) shape() {
+	tokens := float64(s.burst)
+	last := time.Now()
+	var prev time.Time
+	for {
+		var seg segment
+		select {
+		case seg = <-s.queued:
+		case <-s.done:
+			return
+		}
+		if n := float64(len(seg.data)); s.rate > 0 && n > 0 {
+			now := time.Now()
+			tokens = min(float64(s.burst), tokens+now.Sub(last).Seconds()*float64(s.rate))
+			last = now
+			if need := n - tokens; need > 0 {
+				wait := time.Duration(need / float64(s.rate) * float64(time.Second))
+				if !s.sleep(wait) {
+					return
+				}
+				last, tokens = last.Add(wait), n
+			}
+			tokens -= n
+		}
+
+		seg.at = time.Now().Add(s.latency)
+		if s.jitter > 0 {
+			seg.at = seg.at.Add(rand.N(s.jitter))
+		}
+		if seg.data != nil && s.loss > 0 && rand.Float64() < s.loss {
+			s.lost.Add(1)
+			seg.at = seg.at.Add(s.rto)
+		}
+		// the stream is delivered in order, however the segments were delayed
+		if seg.at.Before(prev) {
+			seg.at = prev
+		}
+		prev = seg.at
+		select {
+		case s.delayed <- seg:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// release hands segments over once they are due
+func (s *shaper) release() {
+	for {
+		select {
+		case seg := <-s.delayed:
+			if !s.sleep(time.Until(seg.at)) {
+				return
+			}
+			if err := s.deliver(seg); err != nil {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// linkConn is a connection whose traffic goes over a simulated link
+type linkConn struct {
+	net.Conn
+	up   *shaper
+	down *shaper
+
+	// readable holds the segments that arrived from the relay, pending what is left of the one
+	// being read
+	readable chan segment
+	pending  []byte
+	readErr  error
+
+	readDeadline  atomic.Pointer[time.Time]
+	writeDeadline atomic.Pointer[time.Time]
+
+	// writeErr is set once writing to the relay failed
+	writeErr  atomic.Pointer[error]
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newLinkConn wraps a connection to the relay in a simulated link, counting lost segments in lost
+func newLinkConn(conn net.Conn, l Link, lost *atomic.Int64) *linkConn {
+	c := &linkConn{
+		Conn:     conn,
+		readable: make(chan segment, sendBuffer/segmentSize),
+		done:     make(chan struct{}),
+	}
+	c.up = newShaper(l, l.UplinkRate, lost, c.done, func(seg segment) error {
+		_, err := conn.Write(seg.data)
+		if err != nil {
+			c.writeErr.Store(&err)
+		}
+		return err
+	})
+	c.down = newShaper(l, l.DownlinkRate, lost, c.done, func(seg segment) error {
+		select {
+		case c.readable <- seg:
+			return seg.err
+		case <-c.done:
+			return net.ErrClosed
+		}
+	})
+	go c.receive()
+	return c
+}
+
+// receive reads what the relay sends into the downlink
+func (c *linkConn) receive() {
+	for {
+		buf := make([]byte, segmentSize)
+		n, err := c.Conn.Read(buf)
+		if n > 0 {
+			select {
+			case c.down.queued <- segment{data: buf[:n]}:
+			case <-c.done:
+				return
+			}
+		}
+		if err != nil {
+			select {
+			case c.down.queued <- segment{err: err}:
+			case <-c.done:
+			}
+			return
+		}
+	}
+}
+
+// deadline returns a channel closed at the deadline, nil without one
+func deadline(d *time.Time) (<-chan time.Time, func()) {
+	if d == nil || d.IsZero() {
+		return nil, func() {}
+	}
+	t := time.NewTimer(time.Until(*d))
+	return t.C, func() { t.Stop() }
+}
+
+func (c *linkConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		expired, stop := deadline(c.readDeadline.Load())
+		defer stop()
+		select {
+		case seg := <-c.readable:
+			if seg.err != nil {
+				c.readErr = seg.err
+				return 0, seg.err
+			}
+			c.pending = seg.data
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		case <-c.done:
+			return 0, net.ErrClosed
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *linkConn) Write(b []byte) (int, error) {
+	expired, stop := deadline(c.writeDeadline.Load())
+	defer stop()
+	for written := 0; written < len(b); {
+		if err := c.writeErr.Load(); err != nil {
+			return written, *err
+		}
+		n := min(len(b)-written, segmentSize)
+		seg := segment{data: append([]byte(nil), b[written:written+n]...)}
+		select {
+		case c.up.queued <- seg:
+			written += n
+		case <-expired:
+			return written, os.ErrDeadlineExceeded
+		case <-c.done:
+			return written, net.ErrClosed
+		}
+	}
+	return len(b), nil
+}
+
+func (c *linkConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *linkConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Store(&t)
+	return nil
+}
+
+func (c *linkConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Store(&t)
+	return nil
+}
+
+func (c *linkConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// dialer returns the dialer of a device connecting over l, or the default dialer for a nil link
+func (r *Runner) dialer(l *Link) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if l == nil {
+		return nil
+	}
+	link := *l
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return newLinkConn(conn, link, &r.segmentsLost), nil
+	}
+}
@@ -0,0 +1,359 @@
+// Package soak runs the relay in-process against the mock AI provider and a fleet of synthetic
+// devices for hours, sampling the process' heap, goroutines and file descriptors to catch slow
+// leaks that short tests miss.
+package soak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/ai"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/server"
+)
+
+// Thresholds is how much the process may grow between the baseline sample and a later one before
+// it is reported as a leak. A zero threshold disables the check.
+type Thresholds struct {
+	HeapBytes  uint64
+	Goroutines int
+	FDs        int
+}
+
+// Sample is a snapshot of the process taken after a garbage collection
+type Sample struct {
+	At         time.Time
+	HeapBytes  uint64
+	Goroutines int
+	// FDs is the number of open file descriptors, or -1 where it cannot be counted
+	FDs int
+	// Sessions is the number of sessions active on the relay
+	Sessions int
+}
+
+// Report is the outcome of a soak run
+type Report struct {
+	// Idle is sampled before the devices connect and Drained after they disconnected, the two should match
+	Idle    Sample
+	Drained Sample
+	// Baseline is sampled once the warmup is over, every later sample is compared to it
+	Baseline Sample
+	Samples  []Sample
+
+	Connections   int64
+	DialErrors    int64
+	BytesReceived int64
+	// SessionErrors counts the sessions that did not end normally, SegmentsLost the segments the
+	// simulated links lost
+	SessionErrors int64
+	SegmentsLost  int64
+
+	// Failures describes every threshold that was exceeded
+	Failures []string
+}
+
+// Failed reports whether a leak was detected
+func (r *Report) Failed() bool {
+	return len(r.Failures) > 0
+}
+
+// sustainedSamples is how many samples in a row must exceed a threshold while the devices are
+// connected, so short spikes are not reported as leaks
+const sustainedSamples = 3
+
+// Runner runs a soak test
+type Runner struct {
+	config *config.Config
+	logger *slog.Logger
+
+	devices        int
+	sessionLength  time.Duration
+	sampleInterval time.Duration
+	warmup         time.Duration
+	thresholds     Thresholds
+	// links are the networks the devices connect over, in turn; empty connects them directly
+	links []Link
+
+	connections   atomic.Int64
+	dialErrors    atomic.Int64
+	bytesReceived atomic.Int64
+	sessionErrors atomic.Int64
+	segmentsLost  atomic.Int64
+}
+
+// Option configures a Runner
+type Option func(*Runner)
+
+// WithLogger sets the logger samples and failures are logged to. By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(r *Runner) {
+		r.logger = logger
+	}
+}
+
+// WithDevices sets the number of synthetic devices connected at the same time
+func WithDevices(n int) Option {
+	return func(r *Runner) {
+		r.devices = n
+	}
+}
+
+// WithSessionLength sets how long each device stays connected before it reconnects
+func WithSessionLength(d time.Duration) Option {
+	return func(r *Runner) {
+		r.sessionLength = d
+	}
+}
+
+// WithSampleInterval sets how often the process is sampled
+func WithSampleInterval(d time.Duration) Option {
+	return func(r *Runner) {
+		r.sampleInterval = d
+	}
+}
+
+// WithWarmup sets how long the devices run before the baseline is sampled, so caches and pools
+// have filled up
+func WithWarmup(d time.Duration) Option {
+	return func(r *Runner) {
+		r.warmup = d
+	}
+}
+
+// WithThresholds sets the growth that is reported as a leak
+func WithThresholds(t Thresholds) Option {
+	return func(r *Runner) {
+		r.thresholds = t
+	}
+}
+
+// WithLinks has the devices connect over simulated links with the given bandwidth, latency and
+// loss, such as Profiles["2g"], to check the relay with devices on slow mobile networks. Devices
+// are given the links in turn. By default devices connect directly.
+func WithLinks(links ...Link) Option {
+	return func(r *Runner) {
+		r.links = links
+	}
+}
+
+// New creates a soak test runner. The relay is run with a copy of cfg that uses the mock
+// provider and plain, unauthenticated connections so the synthetic devices can connect.
+func New(cfg *config.Config, opts ...Option) *Runner {
+	c := *cfg
+	c.AIConfig.Provider = ai.MockProvider
+	c.Server.EnableTLS = false
+	c.Server.ClientAuth.Enabled = false
+	c.Auth.SignedURLs.Enabled = false
+
+	r := &Runner{
+		config:         &c,
+		logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		devices:        10,
+		sessionLength:  5 * time.Minute,
+		sampleInterval: time.Minute,
+		warmup:         10 * time.Minute,
+		thresholds: Thresholds{
+			HeapBytes:  64 << 20,
+			Goroutines: 50,
+			FDs:        50,
+		},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Run starts the relay and the devices and samples the process until duration has passed or ctx
+// is done. The error is only set when the run could not be carried out, leaks are reported in
+// the Report.
+func (r *Runner) Run(ctx context.Context, duration time.Duration) (*Report, error) {
+	if duration <= r.warmup {
+		return nil, fmt.Errorf("duration %s must be longer than the warmup %s", duration, r.warmup)
+	}
+
+	srv, err := server.New(r.config, server.WithLogger(r.logger))
+	if err != nil {
+		return nil, fmt.Errorf("could not create relay: %w", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("could not listen: %w", err)
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(l) }()
+	defer srv.Close()
+	url := "ws://" + l.Addr().String() + "/"
+
+	report := &Report{}
+	report.Idle = r.sample(srv)
+	r.logger.Info("Soak test started", "devices", r.devices, "duration", duration, "idle", report.Idle)
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	devicesCtx, stopDevices := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for i := 0; i < r.devices; i++ {
+		wg.Add(1)
+		var link *Link
+		if len(r.links) > 0 {
+			link = &r.links[i%len(r.links)]
+		}
+		go func(id string) {
+			defer wg.Done()
+			r.runDevice(devicesCtx, url, id, link)
+		}(fmt.Sprintf("soak-%d", i))
+	}
+
+	r.watch(ctx, srv, serveErr, report)
+
+	stopDevices()
+	wg.Wait()
+	r.drain(srv)
+	report.Drained = r.sample(srv)
+
+	report.Connections = r.connections.Load()
+	report.DialErrors = r.dialErrors.Load()
+	report.BytesReceived = r.bytesReceived.Load()
+	report.SessionErrors = r.sessionErrors.Load()
+	report.SegmentsLost = r.segmentsLost.Load()
+	drained := r.compare("after disconnecting", report.Idle, report.Drained)
+	for _, metric := range []string{heapMetric, goroutineMetric, fdMetric} {
+		if failure, ok := drained[metric]; ok {
+			report.Failures = append(report.Failures, failure)
+		}
+	}
+	for _, f := range report.Failures {
+		r.logger.Error("Leak detected", "failure", f)
+	}
+	r.logger.Info("Soak test finished", "drained", report.Drained, "connections", report.Connections,
+		"dial_errors", report.DialErrors, "bytes_received", report.BytesReceived,
+		"session_errors", report.SessionErrors, "segments_lost", report.SegmentsLost)
+	return report, nil
+}
+
+// watch samples the process until ctx is done, recording sustained growth over the baseline
+func (r *Runner) watch(ctx context.Context, srv *server.Server, serveErr <-chan error, report *Report) {
+	ticker := time.NewTicker(r.sampleInterval)
+	defer ticker.Stop()
+	warmedUp := time.After(r.warmup)
+	// exceeded counts the consecutive samples each failure was seen in
+	exceeded := make(map[string]int)
+	reported := make(map[string]bool)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-serveErr:
+			if !errors.Is(err, http.ErrServerClosed) {
+				report.Failures = append(report.Failures, fmt.Sprintf("relay stopped: %v", err))
+			}
+			return
+		case <-warmedUp:
+			report.Baseline = r.sample(srv)
+			r.logger.Info("Soak test baseline", "sample", report.Baseline)
+		case <-ticker.C:
+			if report.Baseline.At.IsZero() {
+				continue
+			}
+			s := r.sample(srv)
+			report.Samples = append(report.Samples, s)
+			r.logger.Info("Soak test sample", "sample", s,
+				"heap_growth", int64(s.HeapBytes)-int64(report.Baseline.HeapBytes),
+				"goroutine_growth", s.Goroutines-report.Baseline.Goroutines)
+
+			growth := r.compare("under load", report.Baseline, s)
+			for _, metric := range []string{heapMetric, goroutineMetric, fdMetric} {
+				failure, ok := growth[metric]
+				if !ok {
+					exceeded[metric] = 0
+					continue
+				}
+				exceeded[metric]++
+				if exceeded[metric] >= sustainedSamples && !reported[metric] {
+					reported[metric] = true
+					report.Failures = append(report.Failures, failure)
+				}
+			}
+		}
+	}
+}
+
+// Metrics checked against the thresholds
+const (
+	heapMetric      = "heap"
+	goroutineMetric = "goroutines"
+	fdMetric        = "fds"
+)
+
+// compare describes the thresholds exceeded between from and to by metric
+func (r *Runner) compare(phase string, from, to Sample) map[string]string {
+	failures := make(map[string]string)
+	if t := r.thresholds.HeapBytes; t > 0 && to.HeapBytes > from.HeapBytes && to.HeapBytes-from.HeapBytes > t {
+		failures[heapMetric] = fmt.Sprintf("heap grew by %d bytes %s (from %d to %d, threshold %d)",
+			to.HeapBytes-from.HeapBytes, phase, from.HeapBytes, to.HeapBytes, t)
+	}
+	if t := r.thresholds.Goroutines; t > 0 && to.Goroutines-from.Goroutines > t {
+		failures[goroutineMetric] = fmt.Sprintf("goroutines grew by %d %s (from %d to %d, threshold %d)",
+			to.Goroutines-from.Goroutines, phase, from.Goroutines, to.Goroutines, t)
+	}
+	if t := r.thresholds.FDs; t > 0 && from.FDs >= 0 && to.FDs >= 0 && to.FDs-from.FDs > t {
+		failures[fdMetric] = fmt.Sprintf("file descriptors grew by %d %s (from %d to %d, threshold %d)",
+			to.FDs-from.FDs, phase, from.FDs, to.FDs, t)
+	}
+	return failures
+}
+
+// drain waits for the relay to finish tearing down the sessions of the disconnected devices
+func (r *Runner) drain(srv *server.Server) {
+	deadline := time.Now().Add(10 * time.Second)
+	for srv.Sessions().Count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	// give the handler goroutines a moment to return after the sessions were removed
+	time.Sleep(200 * time.Millisecond)
+}
+
+func (r *Runner) sample(srv *server.Server) Sample {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return Sample{
+		At:         time.Now(),
+		HeapBytes:  m.HeapAlloc,
+		Goroutines: runtime.NumGoroutine(),
+		FDs:        openFDs(),
+		Sessions:   srv.Sessions().Count(),
+	}
+}
+
+// openFDs counts the process' open file descriptors on systems with procfs
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	// one of them is the directory being read
+	return len(entries) - 1
+}
+
+// LogValue groups a sample's fields in log records
+func (s Sample) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("heap_bytes", s.HeapBytes),
+		slog.Int("goroutines", s.Goroutines),
+		slog.Int("fds", s.FDs),
+		slog.Int("sessions", s.Sessions),
+	)
+}
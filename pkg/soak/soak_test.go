@@ -0,0 +1,117 @@
+package soak
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+func TestRunner(t *testing.T) {
+	t.Run("test short run", func(t *testing.T) {
+		t.Setenv("PIXA_AI_PROVIDER", "mock")
+		cfg, err := config.LoadConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.AIConfig.Mock.TurnAfter = "300ms"
+		cfg.AIConfig.Mock.ResponseLength = "300ms"
+
+		r := New(cfg,
+			WithDevices(3),
+			WithSessionLength(700*time.Millisecond),
+			WithWarmup(300*time.Millisecond),
+			WithSampleInterval(200*time.Millisecond),
+		)
+		report, err := r.Run(context.Background(), 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Failed() {
+			t.Fatalf("unexpected leaks: %v", report.Failures)
+		}
+		if report.Connections < 6 || report.DialErrors != 0 {
+			t.Fatalf("expected devices to reconnect without errors, got %d connections and %d dial errors", report.Connections, report.DialErrors)
+		}
+		if report.BytesReceived == 0 {
+			t.Fatal("expected response audio from the mock provider")
+		}
+		if report.Drained.Sessions != 0 {
+			t.Fatalf("expected all sessions to be closed, got %d", report.Drained.Sessions)
+		}
+	})
+
+	t.Run("test links", func(t *testing.T) {
+		l, err := ParseLink("3g,up=64,loss=0.05")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := Profiles["3g"]; l.UplinkRate != 8000 || l.DownlinkRate != want.DownlinkRate || l.Latency != want.Latency || l.Loss != 0.05 {
+			t.Fatalf("unexpected link %+v", l)
+		}
+		for _, spec := range []string{"5g", "loss=2", "up=64,3g", "mtu=1500"} {
+			if _, err := ParseLink(spec); err == nil {
+				t.Errorf("expected %q to be refused", spec)
+			}
+		}
+
+		// 6000 bytes at 20000 bytes per second after a burst of 2000 take 200ms, plus the latency
+		client, server := net.Pipe()
+		defer server.Close()
+		var lost atomic.Int64
+		conn := newLinkConn(client, Link{UplinkRate: 20000, DownlinkRate: 20000, Burst: 2000, Latency: 50 * time.Millisecond}, &lost)
+		defer conn.Close()
+		data := bytes.Repeat([]byte("pixa"), 1500)
+		start := time.Now()
+		go conn.Write(data)
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(server, got); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < 240*time.Millisecond || !bytes.Equal(got, data) {
+			t.Fatalf("uplink delivered %d bytes in %s", len(got), elapsed)
+		}
+
+		start = time.Now()
+		go server.Write(data)
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < 240*time.Millisecond || !bytes.Equal(got, data) {
+			t.Fatalf("downlink delivered %d bytes in %s", len(got), elapsed)
+		}
+
+		// lost segments hold up the stream for a retransmission timeout
+		client, server = net.Pipe()
+		defer server.Close()
+		conn = newLinkConn(client, Link{Loss: 0.999}, &lost)
+		defer conn.Close()
+		start = time.Now()
+		go conn.Write([]byte("hello"))
+		if _, err := io.ReadFull(server, got[:5]); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < minRTO || lost.Load() != 1 {
+			t.Fatalf("expected a retransmitted segment, got %d lost, delivered in %s", lost.Load(), elapsed)
+		}
+		conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, err := conn.Read(got); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected the read deadline to expire, got %v", err)
+		}
+	})
+
+	t.Run("test thresholds", func(t *testing.T) {
+		r := New(&config.Config{}, WithThresholds(Thresholds{Goroutines: 5}))
+		failures := r.compare("under load", Sample{Goroutines: 10, FDs: -1}, Sample{Goroutines: 20, FDs: 40})
+		if _, ok := failures[goroutineMetric]; !ok || len(failures) != 1 {
+			t.Fatalf("unexpected failures: %v", failures)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package store
+
+import "strings"
+
+// Analytics are conversation statistics of a session, for CX analytics. They are computed from the
+// turns whose timing is known; StartMs and EndMs of the others are not recorded.
+type Analytics struct {
+	// UserTalkMs and AssistantTalkMs are how long each side spoke
+	UserTalkMs      int64 `json:"user_talk_ms"`
+	AssistantTalkMs int64 `json:"assistant_talk_ms"`
+	// UserTalkRatio is the user's share of the talk time, 0 when nobody spoke
+	UserTalkRatio float64 `json:"user_talk_ratio"`
+	// Interruptions counts the answers the user cut off by speaking over them
+	Interruptions int `json:"interruptions"`
+	// Responses counts the answers given right after a user turn, ResponseLatencyMs averages the
+	// time from the end of the turn to the start of the answer
+	Responses         int     `json:"responses"`
+	ResponseLatencyMs float64 `json:"response_latency_ms"`
+	// UserWPM and AssistantWPM are the speech rates, in words per minute of talk time
+	UserWPM      float64 `json:"user_wpm"`
+	AssistantWPM float64 `json:"assistant_wpm"`
+}
+
+// Analyze computes the analytics of a session from its turns and the number of times the user
+// interrupted the assistant
+func Analyze(turns []Turn, interruptions int) Analytics {
+	a := Analytics{Interruptions: interruptions}
+	var userWords, assistantWords int
+	var latency int64
+	var previous *Turn
+	for i := range turns {
+		t := &turns[i]
+		if t.EndMs <= 0 || t.EndMs < t.StartMs {
+			previous = nil
+			continue
+		}
+		talk := t.EndMs - t.StartMs
+		words := len(strings.Fields(t.Text))
+		switch t.Role {
+		case UserRole:
+			a.UserTalkMs += talk
+			userWords += words
+		case AssistantRole:
+			a.AssistantTalkMs += talk
+			assistantWords += words
+			if previous != nil && previous.Role == UserRole && t.StartMs >= previous.EndMs {
+				a.Responses++
+				latency += t.StartMs - previous.EndMs
+			}
+		}
+		previous = t
+	}
+	if total := a.UserTalkMs + a.AssistantTalkMs; total > 0 {
+		a.UserTalkRatio = float64(a.UserTalkMs) / float64(total)
+	}
+	if a.Responses > 0 {
+		a.ResponseLatencyMs = float64(latency) / float64(a.Responses)
+	}
+	a.UserWPM = wordsPerMinute(userWords, a.UserTalkMs)
+	a.AssistantWPM = wordsPerMinute(assistantWords, a.AssistantTalkMs)
+	return a
+}
+
+func wordsPerMinute(words int, talkMs int64) float64 {
+	if talkMs <= 0 {
+		return 0
+	}
+	return float64(words) * 60000 / float64(talkMs)
+}
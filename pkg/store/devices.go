@@ -0,0 +1,193 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Connection is a session of a device, as kept in its connection history
+type Connection struct {
+	SessionID   string    `json:"session_id"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// DisconnectedAt is nil while the session is live, and for sessions a restart of the relay cut
+	// off before their end was recorded
+	DisconnectedAt  *time.Time `json:"disconnected_at,omitempty"`
+	FirmwareVersion string     `json:"firmware_version,omitempty"`
+	// Error is what ended the session, if it ended with an error
+	Error string `json:"error,omitempty"`
+}
+
+// Device is the presence of a device: when it was seen and its latest connections
+type Device struct {
+	ID        string    `json:"id"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	// LastSeen is when the device last connected or disconnected
+	LastSeen time.Time `json:"last_seen"`
+	// Online counts the device's live sessions
+	Online int `json:"online"`
+	// Connections counts all its sessions
+	Connections int64 `json:"connections"`
+	// History holds its latest sessions, the latest first
+	History []Connection `json:"history,omitempty"`
+}
+
+// DeviceFilter selects devices. Zero fields match every device.
+type DeviceFilter struct {
+	TenantID string
+	// SeenBefore selects devices last seen before it, such as devices that stopped connecting
+	SeenBefore time.Time
+	// Offline selects devices without live sessions
+	Offline bool
+}
+
+// Match reports whether the device is selected by the filter
+func (f DeviceFilter) Match(d Device) bool {
+	if f.TenantID != "" && d.TenantID != f.TenantID {
+		return false
+	}
+	if !f.SeenBefore.IsZero() && !d.LastSeen.Before(f.SeenBefore) {
+		return false
+	}
+	return !f.Offline || d.Online == 0
+}
+
+// DeviceStore keeps the presence of devices. Implementations must be safe for concurrent use.
+type DeviceStore interface {
+	// DeviceConnected records a session of a device starting
+	DeviceConnected(ctx context.Context, deviceID, tenantID string, c Connection) error
+	// DeviceDisconnected records the end of a session DeviceConnected was told of, c carrying its
+	// DisconnectedAt and Error
+	DeviceDisconnected(ctx context.Context, deviceID string, c Connection) error
+	GetDevice(ctx context.Context, id string) (Device, error)
+	// ListDevices returns the matching devices, those seen longest ago first
+	ListDevices(ctx context.Context, f DeviceFilter) ([]Device, error)
+}
+
+// MemoryDeviceStore is a DeviceStore that keeps devices in memory. It can be saved to and loaded
+// from a JSON snapshot, to keep devices across restarts.
+type MemoryDeviceStore struct {
+	mu      sync.RWMutex
+	devices map[string]*Device
+	history int
+}
+
+// NewMemoryDeviceStore creates an in-memory device store keeping up to history connections per
+// device. A history of 0 keeps none.
+func NewMemoryDeviceStore(history int) *MemoryDeviceStore {
+	return &MemoryDeviceStore{devices: make(map[string]*Device), history: history}
+}
+
+func (s *MemoryDeviceStore) DeviceConnected(ctx context.Context, deviceID, tenantID string, c Connection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.devices[deviceID]
+	if !ok {
+		d = &Device{ID: deviceID, FirstSeen: c.ConnectedAt}
+		s.devices[deviceID] = d
+	}
+	if tenantID != "" {
+		d.TenantID = tenantID
+	}
+	d.LastSeen = c.ConnectedAt
+	d.Online++
+	d.Connections++
+	if s.history > 0 {
+		d.History = append([]Connection{c}, d.History[:min(len(d.History), s.history-1)]...)
+	}
+	return nil
+}
+
+func (s *MemoryDeviceStore) DeviceDisconnected(ctx context.Context, deviceID string, c Connection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.devices[deviceID]
+	if !ok {
+		return ErrNotFound
+	}
+	if c.DisconnectedAt != nil && c.DisconnectedAt.After(d.LastSeen) {
+		d.LastSeen = *c.DisconnectedAt
+	}
+	d.Online = max(d.Online-1, 0)
+	for i, h := range d.History {
+		if h.SessionID == c.SessionID {
+			d.History[i] = c
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryDeviceStore) GetDevice(ctx context.Context, id string) (Device, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d, ok := s.devices[id]
+	if !ok {
+		return Device{}, ErrNotFound
+	}
+	return d.clone(), nil
+}
+
+func (s *MemoryDeviceStore) ListDevices(ctx context.Context, f DeviceFilter) ([]Device, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var out []Device
+	for _, d := range s.devices {
+		if f.Match(*d) {
+			out = append(out, d.clone())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].LastSeen.Equal(out[j].LastSeen) {
+			return out[i].LastSeen.Before(out[j].LastSeen)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+// Save writes a JSON snapshot of the devices to w
+func (s *MemoryDeviceStore) Save(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	devices := make([]*Device, 0, len(s.devices))
+	for _, d := range s.devices {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return json.NewEncoder(w).Encode(devices)
+}
+
+// Load replaces the devices with those of a snapshot written by Save. The sessions that were live
+// then are not any more, so the devices are loaded offline.
+func (s *MemoryDeviceStore) Load(r io.Reader) error {
+	var devices []*Device
+	if err := json.NewDecoder(r).Decode(&devices); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.devices = make(map[string]*Device, len(devices))
+	for _, d := range devices {
+		d.Online = 0
+		d.History = d.History[:min(len(d.History), s.history)]
+		s.devices[d.ID] = d
+	}
+	return nil
+}
+
+func (d *Device) clone() Device {
+	c := *d
+	c.History = append([]Connection(nil), d.History...)
+	return c
+}
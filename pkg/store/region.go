@@ -0,0 +1,99 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrRegionUnavailable is returned when the records of a tenant's region cannot be kept there
+var ErrRegionUnavailable = errors.New("no transcript store in region")
+
+// RegionStore keeps the records of sessions in the store of the region their tenant is pinned to,
+// for data residency, and the records of other tenants in a default store. A record is never kept
+// outside of its region: saving one for a region without a store fails.
+type RegionStore struct {
+	def     TranscriptStore
+	regions map[string]TranscriptStore
+	// regionOf returns the region a tenant is pinned to, empty for none
+	regionOf func(tenantID string) string
+}
+
+// NewRegionStore creates a store keeping the records of tenants pinned to a region in the region's
+// store of regions, and the others in def
+func NewRegionStore(def TranscriptStore, regions map[string]TranscriptStore, regionOf func(tenantID string) string) *RegionStore {
+	return &RegionStore{def: def, regions: regions, regionOf: regionOf}
+}
+
+// Region returns the store of a region, nil if it has none
+func (s *RegionStore) Region(region string) TranscriptStore {
+	return s.regions[region]
+}
+
+func (s *RegionStore) storeOf(tenantID string) (TranscriptStore, error) {
+	region := s.regionOf(tenantID)
+	if region == "" {
+		return s.def, nil
+	}
+	st, ok := s.regions[region]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrRegionUnavailable, region)
+	}
+	return st, nil
+}
+
+func (s *RegionStore) SaveSession(ctx context.Context, r SessionRecord) error {
+	st, err := s.storeOf(r.TenantID)
+	if err != nil {
+		return err
+	}
+	return st.SaveSession(ctx, r)
+}
+
+// GetSession looks a record up in the default store, then in those of the regions
+func (s *RegionStore) GetSession(ctx context.Context, id string) (SessionRecord, error) {
+	for _, st := range s.stores() {
+		r, err := st.GetSession(ctx, id)
+		if !errors.Is(err, ErrNotFound) {
+			return r, err
+		}
+	}
+	return SessionRecord{}, ErrNotFound
+}
+
+// ListSessions lists the records of the filter's tenant from its region's store, or those of all
+// stores when the filter selects no tenant
+func (s *RegionStore) ListSessions(ctx context.Context, f SessionFilter) ([]SessionRecord, error) {
+	if f.TenantID != "" {
+		st, err := s.storeOf(f.TenantID)
+		if err != nil {
+			return nil, err
+		}
+		return st.ListSessions(ctx, f)
+	}
+	var out []SessionRecord
+	for _, st := range s.stores() {
+		records, err := st.ListSessions(ctx, f)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, records...)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].StartedAt.Before(out[j].StartedAt) })
+	return out, nil
+}
+
+// stores returns the default store followed by those of the regions, in the order of their names
+func (s *RegionStore) stores() []TranscriptStore {
+	names := make([]string, 0, len(s.regions))
+	for name := range s.regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stores := []TranscriptStore{s.def}
+	for _, name := range names {
+		stores = append(stores, s.regions[name])
+	}
+	return stores
+}
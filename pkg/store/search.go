@@ -0,0 +1,183 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ErrEmptySearch is returned for searches without any words to look for
+var ErrEmptySearch = errors.New("search has no words")
+
+// SearchQuery looks for the records whose transcript has every one of the words of Text, in any
+// case. Words in double quotes are looked for as a phrase, and a word ending in * matches every
+// word it begins, as in "complain*" for complained and complaints.
+type SearchQuery struct {
+	Text string
+	// Filter narrows the records searched, such as to a tenant or a range of start times
+	Filter SessionFilter
+	// Role limits the search to the turns of the user or of the assistant; empty searches both
+	Role string
+	// Offset skips the first hits and Limit bounds how many are returned, 0 for all of them
+	Offset int
+	Limit  int
+}
+
+// SearchHit is a record found by a search, with the turns the words were found in
+type SearchHit struct {
+	SessionID string    `json:"session_id"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	DeviceID  string    `json:"device_id,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	Turns     []Turn    `json:"turns"`
+}
+
+// SearchResult is a page of hits, the most recent sessions first, and how many there are in all
+type SearchResult struct {
+	Hits  []SearchHit `json:"hits"`
+	Total int         `json:"total"`
+}
+
+// TranscriptSearcher is implemented by transcript stores that search records themselves, such as
+// with the full-text index of a database. The records of other stores are listed and searched by
+// Search.
+type TranscriptSearcher interface {
+	SearchTranscripts(ctx context.Context, q SearchQuery) (SearchResult, error)
+}
+
+// Search searches the records of st, with its own search if it has one
+func Search(ctx context.Context, st TranscriptStore, q SearchQuery) (SearchResult, error) {
+	if s, ok := st.(TranscriptSearcher); ok {
+		return s.SearchTranscripts(ctx, q)
+	}
+	terms := searchTerms(q.Text)
+	if len(terms) == 0 {
+		return SearchResult{}, ErrEmptySearch
+	}
+	records, err := st.ListSessions(ctx, q.Filter)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	var hits []SearchHit
+	for i := len(records) - 1; i >= 0; i-- {
+		if hit, ok := searchRecord(records[i], terms, q.Role); ok {
+			hits = append(hits, hit)
+		}
+	}
+	return page(hits, q), nil
+}
+
+// SearchTranscripts searches the store of the filter's tenant, or every store when the filter
+// selects no tenant, so each store searches its records with its own search
+func (s *RegionStore) SearchTranscripts(ctx context.Context, q SearchQuery) (SearchResult, error) {
+	if q.Filter.TenantID != "" {
+		st, err := s.storeOf(q.Filter.TenantID)
+		if err != nil {
+			return SearchResult{}, err
+		}
+		return Search(ctx, st, q)
+	}
+	// every store is asked for the hits up to the end of the page, which are merged
+	each := q
+	each.Offset = 0
+	if q.Limit > 0 {
+		each.Limit = q.Offset + q.Limit
+	}
+	var hits []SearchHit
+	total := 0
+	for _, st := range s.stores() {
+		r, err := Search(ctx, st, each)
+		if err != nil {
+			return SearchResult{}, err
+		}
+		hits = append(hits, r.Hits...)
+		total += r.Total
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].StartedAt.After(hits[j].StartedAt) })
+	result := page(hits, SearchQuery{Offset: q.Offset, Limit: q.Limit})
+	result.Total = total
+	return result, nil
+}
+
+// page returns the page of the hits the query asks for
+func page(hits []SearchHit, q SearchQuery) SearchResult {
+	result := SearchResult{Total: len(hits)}
+	hits = hits[min(max(q.Offset, 0), len(hits)):]
+	if q.Limit > 0 {
+		hits = hits[:min(q.Limit, len(hits))]
+	}
+	result.Hits = append([]SearchHit{}, hits...)
+	return result
+}
+
+// searchTerm is a word or a phrase looked for, as lower cased words; prefix matches words that
+// begin with its last word
+type searchTerm struct {
+	words  []string
+	prefix bool
+}
+
+// searchTerms splits the text of a search into its words and quoted phrases
+func searchTerms(text string) []searchTerm {
+	var terms []searchTerm
+	for i, part := range strings.Split(text, `"`) {
+		if i%2 == 1 {
+			if words := searchWords(part); len(words) > 0 {
+				terms = append(terms, searchTerm{words: words})
+			}
+			continue
+		}
+		for _, field := range strings.Fields(part) {
+			prefix := strings.HasSuffix(field, "*")
+			for _, w := range searchWords(field) {
+				terms = append(terms, searchTerm{words: []string{w}, prefix: prefix})
+			}
+		}
+	}
+	return terms
+}
+
+// searchWords returns the lower cased words of text
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	})
+}
+
+// in reports whether the term is among words
+func (t searchTerm) in(words []string) bool {
+	last := len(t.words) - 1
+	for i := 0; i+last < len(words); i++ {
+		if slices.Equal(words[i:i+last], t.words[:last]) &&
+			(words[i+last] == t.words[last] || t.prefix && strings.HasPrefix(words[i+last], t.words[last])) {
+			return true
+		}
+	}
+	return false
+}
+
+// searchRecord looks for every term in the turns of a record of the given role
+func searchRecord(r SessionRecord, terms []searchTerm, role string) (SearchHit, bool) {
+	found := make([]bool, len(terms))
+	hit := SearchHit{SessionID: r.ID, TenantID: r.TenantID, DeviceID: r.DeviceID, StartedAt: r.StartedAt}
+	for _, turn := range r.Turns {
+		if role != "" && turn.Role != role {
+			continue
+		}
+		words := searchWords(turn.Text)
+		matched := false
+		for i, t := range terms {
+			if t.in(words) {
+				found[i], matched = true, true
+			}
+		}
+		if matched {
+			hit.Turns = append(hit.Turns, turn)
+		}
+	}
+	return hit, !slices.Contains(found, false)
+}
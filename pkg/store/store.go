@@ -0,0 +1,249 @@
+// Package store defines where the relay keeps records of finished sessions and their transcripts.
+package store
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when a record does not exist
+var ErrNotFound = errors.New("not found")
+
+// Roles of a transcript turn
+const (
+	UserRole      = "user"
+	AssistantRole = "assistant"
+)
+
+// Turn is a single utterance in a session's transcript
+type Turn struct {
+	Role   string    `json:"role"`
+	ItemID string    `json:"item_id,omitempty"`
+	Text   string    `json:"text"`
+	At     time.Time `json:"at"`
+	// Metadata is what the device said about a user turn, such as its location or the screen shown
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// StartMs and EndMs place the turn's speech in the session, in ms since it started. EndMs is 0
+	// when the timing is not known.
+	StartMs int64 `json:"start_ms,omitempty"`
+	EndMs   int64 `json:"end_ms,omitempty"`
+	// Sentences are the sentences of an assistant turn with their timing, as captioned on the device
+	Sentences []Sentence `json:"sentences,omitempty"`
+}
+
+// Sentence is a sentence of an assistant turn, placed in the session like its turn
+type Sentence struct {
+	Text    string `json:"text"`
+	StartMs int64  `json:"start_ms"`
+	EndMs   int64  `json:"end_ms"`
+}
+
+// SessionRecord is what the relay keeps of a finished session
+type SessionRecord struct {
+	ID        string    `json:"id"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	DeviceID  string    `json:"device_id,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	Turns     []Turn    `json:"turns"`
+	// CorrelationID is the ID the device connected with to tie the session to the customer's systems
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// Seed is the session's random seed, to reproduce it
+	Seed uint64 `json:"seed,omitempty"`
+	// AudioFrames counts the binary frames received from the device, CorruptedFrames those that
+	// failed their checksum
+	AudioFrames     int64 `json:"audio_frames,omitempty"`
+	CorruptedFrames int64 `json:"corrupted_frames,omitempty"`
+	// Frames counts the anomalies of the audio frames of devices that sent frame headers, nil for
+	// devices that sent raw frames
+	Frames *FrameStats `json:"frames,omitempty"`
+	// Flagged marks sessions that need attention, e.g. because they ended with an error
+	Flagged    bool   `json:"flagged,omitempty"`
+	FlagReason string `json:"flag_reason,omitempty"`
+	// Tags label the session, e.g. with a campaign or store ID
+	Tags map[string]string `json:"tags,omitempty"`
+	// ProtocolVersion and FirmwareVersion are the versions the device reported
+	ProtocolVersion int    `json:"protocol_version,omitempty"`
+	FirmwareVersion string `json:"firmware_version,omitempty"`
+	// Analytics are the talk time, speech rate and response statistics of the conversation
+	Analytics Analytics `json:"analytics"`
+	// AudioCodec is the codec of the device's audio frames when they were compressed
+	AudioCodec string `json:"audio_codec,omitempty"`
+	// SampleRate is the rate of the device's audio, which devices may choose per session
+	SampleRate int `json:"sample_rate,omitempty"`
+	// InputChannels are the channels of the device's audio and Downmix how they were mixed down to
+	// audio.channels, when the device sent other than audio.channels or chose a downmix
+	InputChannels int    `json:"input_channels,omitempty"`
+	Downmix       string `json:"downmix,omitempty"`
+	// Verification is whether the user was verified as the speaker the session is for, if they were
+	// checked
+	Verification *SpeakerVerification `json:"verification,omitempty"`
+	// Speaker is how the user's voice was classified, and the policy applied, if it was
+	Speaker *SpeakerClassification `json:"speaker,omitempty"`
+	// Transcripts are later transcripts of what the user said, made again from the session's
+	// recorded audio; Turns keeps the original one
+	Transcripts []TranscriptVersion `json:"transcripts,omitempty"`
+}
+
+// FrameStats counts the audio frames of a session that were lost, put back in order, dropped as
+// late or duplicates, or dropped for an invalid header, going by the headers of its frames
+type FrameStats struct {
+	Lost      int64 `json:"lost"`
+	Reordered int64 `json:"reordered"`
+	Late      int64 `json:"late"`
+	Invalid   int64 `json:"invalid"`
+}
+
+// SpeakerVerification is how the speaker verifier matched the user's voice
+type SpeakerVerification struct {
+	Verified bool `json:"verified"`
+	// SpeakerID is the enrolled speaker matched, when the verifier tells
+	SpeakerID string  `json:"speaker_id,omitempty"`
+	Score     float64 `json:"score"`
+	// Error is set when the verification failed
+	Error string    `json:"error,omitempty"`
+	At    time.Time `json:"at"`
+}
+
+// SpeakerClassification is what the speaker classifier found about the user's voice
+type SpeakerClassification struct {
+	// AgeGroup is child, teen or adult, empty when the classifier could not tell
+	AgeGroup   string  `json:"age_group,omitempty"`
+	Confidence float64 `json:"confidence"`
+	// Action is the speaker policy applied: log, restrict or end, empty for none
+	Action string    `json:"action,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// TranscriptVersion is a transcript of the user's turns made again from a session's recorded audio,
+// such as by a better model than the one that transcribed the session live
+type TranscriptVersion struct {
+	// Version names the transcript, such as after the model that made it
+	Version   string    `json:"version"`
+	Provider  string    `json:"provider"`
+	Model     string    `json:"model,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Turns are the user's turns, placed in the session like those of the original transcript
+	Turns []Turn `json:"turns"`
+}
+
+// Transcript returns the later transcript of the given version, if the record has one
+func (r SessionRecord) Transcript(version string) (TranscriptVersion, bool) {
+	for _, t := range r.Transcripts {
+		if t.Version == version {
+			return t, true
+		}
+	}
+	return TranscriptVersion{}, false
+}
+
+// Duration returns how long the session lasted
+func (r SessionRecord) Duration() time.Duration {
+	return r.EndedAt.Sub(r.StartedAt)
+}
+
+// SessionFilter selects session records. Zero fields match everything.
+type SessionFilter struct {
+	TenantID string
+	DeviceID string
+	// From and To bound the session start time to [From, To)
+	From time.Time
+	To   time.Time
+	// Tags selects records carrying all of the given tags
+	Tags map[string]string
+}
+
+// Match reports whether the record is selected by the filter
+func (f SessionFilter) Match(r SessionRecord) bool {
+	if f.TenantID != "" && r.TenantID != f.TenantID {
+		return false
+	}
+	if f.DeviceID != "" && r.DeviceID != f.DeviceID {
+		return false
+	}
+	if !f.From.IsZero() && r.StartedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !r.StartedAt.Before(f.To) {
+		return false
+	}
+	return MatchTags(r.Tags, f.Tags)
+}
+
+// MatchTags reports whether tags has every tag of want
+func MatchTags(tags, want map[string]string) bool {
+	for k, v := range want {
+		if got, ok := tags[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// TranscriptStore keeps session records. Implementations must be safe for concurrent use.
+type TranscriptStore interface {
+	SaveSession(ctx context.Context, r SessionRecord) error
+	GetSession(ctx context.Context, id string) (SessionRecord, error)
+	// ListSessions returns the matching records ordered by start time
+	ListSessions(ctx context.Context, f SessionFilter) ([]SessionRecord, error)
+}
+
+// MemoryStore is a TranscriptStore that keeps records in memory
+type MemoryStore struct {
+	mu          sync.RWMutex
+	records     map[string]SessionRecord
+	order       []string
+	maxSessions int
+}
+
+// NewMemoryStore creates an in-memory store holding up to maxSessions records; the oldest records
+// are evicted beyond it. A maxSessions of 0 means unbounded.
+func NewMemoryStore(maxSessions int) *MemoryStore {
+	return &MemoryStore{
+		records:     make(map[string]SessionRecord),
+		maxSessions: maxSessions,
+	}
+}
+
+func (s *MemoryStore) SaveSession(ctx context.Context, r SessionRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.records[r.ID]; !ok {
+		s.order = append(s.order, r.ID)
+	}
+	s.records[r.ID] = r
+	for s.maxSessions > 0 && len(s.order) > s.maxSessions {
+		delete(s.records, s.order[0])
+		s.order = s.order[1:]
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetSession(ctx context.Context, id string) (SessionRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, ok := s.records[id]
+	if !ok {
+		return SessionRecord{}, ErrNotFound
+	}
+	return r, nil
+}
+
+func (s *MemoryStore) ListSessions(ctx context.Context, f SessionFilter) ([]SessionRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var out []SessionRecord
+	for _, id := range s.order {
+		if r := s.records[id]; f.Match(r) {
+			out = append(out, r)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].StartedAt.Before(out[j].StartedAt) })
+	return out, nil
+}
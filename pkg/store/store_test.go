@@ -0,0 +1,265 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	day := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("test filtering", func(t *testing.T) {
+		s := NewMemoryStore(0)
+		s.SaveSession(ctx, SessionRecord{ID: "a", TenantID: "acme", StartedAt: day.Add(time.Hour)})
+		s.SaveSession(ctx, SessionRecord{ID: "b", TenantID: "acme", StartedAt: day.Add(25 * time.Hour)})
+		s.SaveSession(ctx, SessionRecord{ID: "c", TenantID: "other", StartedAt: day.Add(2 * time.Hour)})
+
+		got, _ := s.ListSessions(ctx, SessionFilter{TenantID: "acme", From: day, To: day.Add(24 * time.Hour)})
+		if len(got) != 1 || got[0].ID != "a" {
+			t.Fatalf("unexpected records: %+v", got)
+		}
+	})
+
+	t.Run("test tag filtering", func(t *testing.T) {
+		s := NewMemoryStore(0)
+		s.SaveSession(ctx, SessionRecord{ID: "a", Tags: map[string]string{"campaign": "summer", "store": "17"}})
+		s.SaveSession(ctx, SessionRecord{ID: "b", Tags: map[string]string{"campaign": "winter", "store": "17"}})
+		s.SaveSession(ctx, SessionRecord{ID: "c"})
+
+		got, _ := s.ListSessions(ctx, SessionFilter{Tags: map[string]string{"campaign": "summer", "store": "17"}})
+		if len(got) != 1 || got[0].ID != "a" {
+			t.Fatalf("unexpected records: %+v", got)
+		}
+		if got, _ := s.ListSessions(ctx, SessionFilter{Tags: map[string]string{"store": "17"}}); len(got) != 2 {
+			t.Fatalf("unexpected records: %+v", got)
+		}
+	})
+
+	t.Run("test regions", func(t *testing.T) {
+		def, eu := NewMemoryStore(0), NewMemoryStore(0)
+		regionOf := func(tenantID string) string {
+			return map[string]string{"acme": "eu", "globex": "apac"}[tenantID]
+		}
+		s := NewRegionStore(def, map[string]TranscriptStore{"eu": eu}, regionOf)
+		s.SaveSession(ctx, SessionRecord{ID: "a", TenantID: "acme", StartedAt: day.Add(time.Hour)})
+		s.SaveSession(ctx, SessionRecord{ID: "b", TenantID: "other", StartedAt: day})
+		if err := s.SaveSession(ctx, SessionRecord{ID: "c", TenantID: "globex"}); !errors.Is(err, ErrRegionUnavailable) {
+			t.Fatalf("expected a record of a region without a store to be refused, got %v", err)
+		}
+		if _, err := def.GetSession(ctx, "a"); err != ErrNotFound {
+			t.Fatal("expected the record of a pinned tenant to stay out of the default store")
+		}
+		if r, err := s.GetSession(ctx, "a"); err != nil || r.TenantID != "acme" {
+			t.Fatalf("unexpected record %+v, %v", r, err)
+		}
+		if got, _ := s.ListSessions(ctx, SessionFilter{}); len(got) != 2 || got[0].ID != "b" {
+			t.Fatalf("unexpected records: %+v", got)
+		}
+		if got, _ := s.ListSessions(ctx, SessionFilter{TenantID: "acme"}); len(got) != 1 || got[0].ID != "a" {
+			t.Fatalf("unexpected records: %+v", got)
+		}
+	})
+
+	t.Run("test search", func(t *testing.T) {
+		def, eu := NewMemoryStore(0), NewMemoryStore(0)
+		s := NewRegionStore(def, map[string]TranscriptStore{"eu": eu}, func(tenantID string) string {
+			return map[string]string{"acme": "eu"}[tenantID]
+		})
+		turns := func(user, assistant string) []Turn {
+			return []Turn{{Role: UserRole, Text: user}, {Role: AssistantRole, Text: assistant}}
+		}
+		s.SaveSession(ctx, SessionRecord{ID: "a", TenantID: "acme", StartedAt: day, Turns: turns("My order arrived broken.", "Sorry to hear that!")})
+		s.SaveSession(ctx, SessionRecord{ID: "b", TenantID: "other", StartedAt: day.Add(time.Hour), Turns: turns("I want to complain about the noise", "Noted, the order is on its way.")})
+		s.SaveSession(ctx, SessionRecord{ID: "c", TenantID: "acme", StartedAt: day.Add(2 * time.Hour), Turns: turns("Where is my ORDER?", "It arrived broken, I am told.")})
+
+		ids := func(r SearchResult) string {
+			var out []string
+			for _, h := range r.Hits {
+				out = append(out, h.SessionID)
+			}
+			return strings.Join(out, ",")
+		}
+		for _, tc := range []struct {
+			name string
+			q    SearchQuery
+			want string
+		}{
+			{"words in any case, most recent first", SearchQuery{Text: "order"}, "c,b,a"},
+			{"every word", SearchQuery{Text: "order broken"}, "c,a"},
+			{"phrase", SearchQuery{Text: `"order arrived"`}, "a"},
+			{"prefix", SearchQuery{Text: "complain*"}, "b"},
+			{"role", SearchQuery{Text: "broken", Role: UserRole}, "a"},
+			{"tenant", SearchQuery{Text: "order", Filter: SessionFilter{TenantID: "acme"}}, "c,a"},
+			{"time range", SearchQuery{Text: "order", Filter: SessionFilter{From: day.Add(time.Hour)}}, "c,b"},
+			{"page", SearchQuery{Text: "order", Offset: 1, Limit: 1}, "b"},
+		} {
+			r, err := Search(ctx, s, tc.q)
+			if err != nil || ids(r) != tc.want {
+				t.Fatalf("%s: expected %s, got %q, %v", tc.name, tc.want, ids(r), err)
+			}
+		}
+		r, _ := Search(ctx, s, SearchQuery{Text: "order", Limit: 1})
+		if r.Total != 3 || len(r.Hits[0].Turns) != 1 || r.Hits[0].Turns[0].Role != UserRole {
+			t.Fatalf("unexpected result %+v", r)
+		}
+		if _, err := Search(ctx, s, SearchQuery{Text: ` "" `}); !errors.Is(err, ErrEmptySearch) {
+			t.Fatalf("expected a search without words to be refused, got %v", err)
+		}
+	})
+
+	t.Run("test eviction", func(t *testing.T) {
+		s := NewMemoryStore(2)
+		for _, id := range []string{"a", "b", "c"} {
+			s.SaveSession(ctx, SessionRecord{ID: id})
+		}
+		if _, err := s.GetSession(ctx, "a"); err != ErrNotFound {
+			t.Fatalf("expected oldest record to be evicted, got %v", err)
+		}
+		if _, err := s.GetSession(ctx, "c"); err != nil {
+			t.Fatalf("expected newest record to be kept, got %v", err)
+		}
+	})
+}
+
+func TestMemoryDeviceStore(t *testing.T) {
+	ctx := context.Background()
+	day := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	connect := func(s *MemoryDeviceStore, device, session string, at time.Time) {
+		s.DeviceConnected(ctx, device, "acme", Connection{SessionID: session, ConnectedAt: at})
+	}
+	disconnect := func(s *MemoryDeviceStore, device, session string, at time.Time, reason string) {
+		s.DeviceDisconnected(ctx, device, Connection{SessionID: session, ConnectedAt: at.Add(-time.Minute), DisconnectedAt: &at, Error: reason})
+	}
+
+	t.Run("test presence", func(t *testing.T) {
+		s := NewMemoryDeviceStore(2)
+		connect(s, "lamp", "s1", day)
+		disconnect(s, "lamp", "s1", day.Add(time.Minute), "")
+		connect(s, "lamp", "s2", day.Add(time.Hour))
+		connect(s, "lamp", "s3", day.Add(2*time.Hour))
+		disconnect(s, "lamp", "s3", day.Add(3*time.Hour), "session reaped: idle")
+
+		d, err := s.GetDevice(ctx, "lamp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Online != 1 || d.Connections != 3 || !d.FirstSeen.Equal(day) || !d.LastSeen.Equal(day.Add(3*time.Hour)) {
+			t.Fatalf("unexpected device: %+v", d)
+		}
+		if len(d.History) != 2 || d.History[0].SessionID != "s3" || d.History[0].Error == "" || d.History[1].DisconnectedAt != nil {
+			t.Fatalf("unexpected history: %+v", d.History)
+		}
+		if _, err := s.GetDevice(ctx, "fan"); err != ErrNotFound {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+		if err := s.DeviceDisconnected(ctx, "fan", Connection{SessionID: "s4"}); err != ErrNotFound {
+			t.Fatalf("expected ErrNotFound for an unknown device, got %v", err)
+		}
+	})
+
+	t.Run("test filtering", func(t *testing.T) {
+		s := NewMemoryDeviceStore(0)
+		connect(s, "a", "s1", day.Add(time.Hour))
+		connect(s, "b", "s2", day)
+		disconnect(s, "b", "s2", day.Add(time.Minute), "")
+		connect(s, "c", "s3", day.Add(48*time.Hour))
+
+		got, _ := s.ListDevices(ctx, DeviceFilter{})
+		if len(got) != 3 || got[0].ID != "b" || got[2].ID != "c" {
+			t.Fatalf("expected the devices seen longest ago first, got %+v", got)
+		}
+		if got, _ := s.ListDevices(ctx, DeviceFilter{SeenBefore: day.Add(24 * time.Hour), Offline: true}); len(got) != 1 || got[0].ID != "b" {
+			t.Fatalf("unexpected devices: %+v", got)
+		}
+		if got, _ := s.ListDevices(ctx, DeviceFilter{TenantID: "other"}); len(got) != 0 {
+			t.Fatalf("unexpected devices: %+v", got)
+		}
+	})
+
+	t.Run("test snapshots", func(t *testing.T) {
+		s := NewMemoryDeviceStore(5)
+		connect(s, "lamp", "s1", day)
+		var buf strings.Builder
+		if err := s.Save(&buf); err != nil {
+			t.Fatal(err)
+		}
+		loaded := NewMemoryDeviceStore(5)
+		if err := loaded.Load(strings.NewReader(buf.String())); err != nil {
+			t.Fatal(err)
+		}
+		d, err := loaded.GetDevice(ctx, "lamp")
+		if err != nil || d.Online != 0 || d.Connections != 1 || len(d.History) != 1 || !d.LastSeen.Equal(day) {
+			t.Fatalf("expected the device loaded offline, got %+v, %v", d, err)
+		}
+	})
+}
+
+func TestSubtitles(t *testing.T) {
+	start := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	r := SessionRecord{ID: "s1", StartedAt: start, Turns: []Turn{
+		{Role: UserRole, Text: "Where is\nmy order?", StartMs: 1000, EndMs: 2500},
+		{Role: AssistantRole, Text: "It ships today. Tracking <soon> & more.", Sentences: []Sentence{
+			{Text: "It ships today.", StartMs: 3000, EndMs: 4200},
+			{Text: "Tracking <soon> & more.", StartMs: 4200, EndMs: 4300},
+		}},
+		// recorded without timing, shown for its reading time up to its transcription
+		{Role: UserRole, Text: "Thanks", At: start.Add(3723 * time.Second)},
+	}}
+
+	var srt strings.Builder
+	if err := WriteSubtitles(&srt, r, SRT); err != nil {
+		t.Fatal(err)
+	}
+	want := "1\n00:00:01,000 --> 00:00:02,500\nUser: Where is my order?\n\n" +
+		"2\n00:00:03,000 --> 00:00:04,200\nAssistant: It ships today.\n\n" +
+		"3\n00:00:04,200 --> 00:00:04,700\nAssistant: Tracking <soon> & more.\n\n" +
+		"4\n01:02:02,000 --> 01:02:03,000\nUser: Thanks\n\n"
+	if srt.String() != want {
+		t.Fatalf("unexpected SRT:\n%s", srt.String())
+	}
+
+	var vtt strings.Builder
+	if err := WriteSubtitles(&vtt, r, WebVTT); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(vtt.String(), "WEBVTT\n\n00:00:01.000 --> 00:00:02.500\n<v User>Where is my order?\n\n") ||
+		!strings.Contains(vtt.String(), "<v Assistant>Tracking &lt;soon&gt; &amp; more.\n") {
+		t.Fatalf("unexpected WebVTT:\n%s", vtt.String())
+	}
+
+	if err := WriteSubtitles(&vtt, r, "ass"); err == nil {
+		t.Fatal("expected an unknown format to fail")
+	}
+}
+
+func TestAnalytics(t *testing.T) {
+	a := Analyze([]Turn{
+		{Role: UserRole, Text: "where is my order", StartMs: 1000, EndMs: 3000},
+		{Role: AssistantRole, Text: "it ships on friday", StartMs: 3800, EndMs: 6800},
+		{Role: UserRole, Text: "thanks", StartMs: 7000, EndMs: 8000},
+		{Role: AssistantRole, Text: "you are welcome", StartMs: 8400, EndMs: 9400},
+		// untimed turns do not count, and break the pairing of questions and answers
+		{Role: UserRole, Text: "one more thing"},
+		{Role: AssistantRole, Text: "sure thing", StartMs: 12000, EndMs: 12500},
+	}, 1)
+	want := Analytics{
+		UserTalkMs:        3000,
+		AssistantTalkMs:   4500,
+		UserTalkRatio:     0.4,
+		Interruptions:     1,
+		Responses:         2,
+		ResponseLatencyMs: 600,
+		UserWPM:           100,
+		AssistantWPM:      120,
+	}
+	if a != want {
+		t.Fatalf("got %+v, want %+v", a, want)
+	}
+	if (Analyze(nil, 0) != Analytics{}) {
+		t.Fatal("expected empty analytics without turns")
+	}
+}
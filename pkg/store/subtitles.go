@@ -0,0 +1,87 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Subtitle formats a session record can be written in
+const (
+	SRT    = "srt"
+	WebVTT = "vtt"
+)
+
+// cue is a subtitle shown from start to end, in ms since the session started
+type cue struct {
+	start, end int64
+	speaker    string
+	text       string
+}
+
+// cues returns the subtitles of a session, one per sentence of the assistant and per user turn.
+// Turns recorded without their timing are shown for the time it takes to read them, up to when
+// they were transcribed.
+func cues(r SessionRecord) []cue {
+	var list []cue
+	for _, t := range r.Turns {
+		speaker := "User"
+		if t.Role == AssistantRole {
+			speaker = "Assistant"
+		}
+		switch {
+		case len(t.Sentences) > 0:
+			for _, s := range t.Sentences {
+				list = append(list, cue{start: s.StartMs, end: s.EndMs, speaker: speaker, text: s.Text})
+			}
+		case t.EndMs > 0:
+			list = append(list, cue{start: t.StartMs, end: t.EndMs, speaker: speaker, text: t.Text})
+		default:
+			end := t.At.Sub(r.StartedAt).Milliseconds()
+			list = append(list, cue{start: max(end-readingTime(t.Text), 0), end: end, speaker: speaker, text: t.Text})
+		}
+	}
+	for i := range list {
+		list[i].text = strings.Join(strings.Fields(list[i].text), " ")
+		// a cue is shown for at least half a second, even if its audio was cut short
+		list[i].end = max(list[i].end, list[i].start+500)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].start < list[j].start })
+	return list
+}
+
+// readingTime estimates how long text takes to read, in ms
+func readingTime(text string) int64 {
+	return min(max(int64(len(text))*1000/15, 1000), 7000)
+}
+
+// WriteSubtitles writes the transcript of a session as subtitles in the given format, SRT or
+// WebVTT. Cue times are offsets from the session start, the timeline of any recording of the
+// session's audio.
+func WriteSubtitles(w io.Writer, r SessionRecord, format string) error {
+	var b strings.Builder
+	switch format {
+	case SRT:
+		for i, c := range cues(r) {
+			fmt.Fprintf(&b, "%d\n%s --> %s\n%s: %s\n\n", i+1, timestamp(c.start, ','), timestamp(c.end, ','), c.speaker, c.text)
+		}
+	case WebVTT:
+		b.WriteString("WEBVTT\n\n")
+		escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+		for _, c := range cues(r) {
+			fmt.Fprintf(&b, "%s --> %s\n<v %s>%s\n\n", timestamp(c.start, '.'), timestamp(c.end, '.'), c.speaker, escape.Replace(c.text))
+		}
+	default:
+		return fmt.Errorf("unknown subtitle format %q", format)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// timestamp formats ms as hours:minutes:seconds, with sep before the milliseconds
+func timestamp(ms int64, sep byte) string {
+	d := time.Duration(ms) * time.Millisecond
+	return fmt.Sprintf("%02d:%02d:%02d%c%03d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, sep, ms%1000)
+}
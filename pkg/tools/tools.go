@@ -0,0 +1,75 @@
+// Package tools holds the functions the model can call during a session, which the relay runs on
+// its side. Embedding applications register their tools and pass the registry to the handler with
+// websocket.WithTools.
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Tool is a function the model can call
+type Tool struct {
+	Name        string
+	Description string
+	// Parameters is the JSON schema of the tool's arguments
+	Parameters json.RawMessage
+	// Run executes a call with the JSON arguments the model wrote and returns what the model is
+	// told, usually JSON. It should give up once ctx is done.
+	Run func(ctx context.Context, arguments json.RawMessage) (string, error)
+}
+
+// Registry maps tool names to tools. It is safe for concurrent use.
+type Registry struct {
+	mu    sync.RWMutex
+	tools map[string]Tool
+}
+
+// NewRegistry creates an empty tool registry
+func NewRegistry() *Registry {
+	return &Registry{tools: make(map[string]Tool)}
+}
+
+// Register adds a tool, replacing any existing one with the same name
+func (r *Registry) Register(t Tool) error {
+	if t.Name == "" {
+		return errors.New("tool needs a name")
+	}
+	if t.Run == nil {
+		return fmt.Errorf("tool %s needs a Run function", t.Name)
+	}
+	if len(t.Parameters) == 0 {
+		t.Parameters = json.RawMessage(`{"type":"object","properties":{}}`)
+	}
+	if !json.Valid(t.Parameters) {
+		return fmt.Errorf("tool %s has invalid parameters schema", t.Name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tools[t.Name] = t
+	return nil
+}
+
+// Get returns the tool registered under name
+func (r *Registry) Get(name string) (Tool, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.tools[name]
+	return t, ok
+}
+
+// List returns all registered tools sorted by name
+func (r *Registry) List() []Tool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]Tool, 0, len(r.tools))
+	for _, t := range r.tools {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
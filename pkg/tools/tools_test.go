@@ -0,0 +1,31 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	run := func(context.Context, json.RawMessage) (string, error) { return `{}`, nil }
+	for _, bad := range []Tool{{Run: run}, {Name: "no_run"}, {Name: "bad_schema", Run: run, Parameters: json.RawMessage(`{`)}} {
+		if err := r.Register(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad.Name)
+		}
+	}
+	if err := r.Register(Tool{Name: "order_status", Run: run}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(Tool{Name: "weather", Run: run}); err != nil {
+		t.Fatal(err)
+	}
+
+	tool, ok := r.Get("order_status")
+	if !ok || !json.Valid(tool.Parameters) {
+		t.Fatal("expected the tool with a default parameters schema")
+	}
+	if list := r.List(); len(list) != 2 || list[0].Name != "order_status" || list[1].Name != "weather" {
+		t.Fatalf("unexpected tools %v", list)
+	}
+}
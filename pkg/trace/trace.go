@@ -0,0 +1,281 @@
+// Package trace reads and writes captures of the wire traffic of a session: every websocket frame
+// between a device and the relay, in both directions, timestamped from the start of the session.
+// Binary frame payloads are optional, so traces of audio sessions stay small.
+//
+// A trace starts with the magic "PXTRACE", a version byte, a flags byte, the start of the session
+// in unix nanoseconds as a big endian int64 and the session and device IDs as uvarint length
+// prefixed strings. Each frame follows as its offset from the start in nanoseconds (uvarint), its
+// direction and opcode (one byte each), its length and the length of its captured payload
+// (uvarints), and the captured payload.
+package trace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	magic   = "PXTRACE"
+	version = 1
+
+	// flagAudio is set in traces that kept binary payloads
+	flagAudio = 1 << 0
+
+	// maxCaptured bounds the payload read for a frame, so corrupt traces do not exhaust memory
+	maxCaptured = 64 << 20
+)
+
+// ErrClosed is returned for frames written to a closed trace
+var ErrClosed = errors.New("trace closed")
+
+// Direction is the way a frame went
+type Direction byte
+
+const (
+	FromDevice Direction = iota
+	ToDevice
+)
+
+func (d Direction) String() string {
+	switch d {
+	case FromDevice:
+		return "device"
+	case ToDevice:
+		return "relay"
+	}
+	return fmt.Sprintf("direction(%d)", byte(d))
+}
+
+// Opcode is the websocket opcode of a frame; the values are those of RFC 6455 and gorilla/websocket
+type Opcode byte
+
+const (
+	Text   Opcode = 1
+	Binary Opcode = 2
+	Close  Opcode = 8
+	Ping   Opcode = 9
+	Pong   Opcode = 10
+)
+
+func (o Opcode) String() string {
+	switch o {
+	case Text:
+		return "text"
+	case Binary:
+		return "binary"
+	case Close:
+		return "close"
+	case Ping:
+		return "ping"
+	case Pong:
+		return "pong"
+	}
+	return fmt.Sprintf("opcode(%d)", byte(o))
+}
+
+// Header describes the session a trace was captured from
+type Header struct {
+	SessionID string
+	DeviceID  string
+	StartedAt time.Time
+	// Audio is set when binary payloads were captured
+	Audio bool
+}
+
+// Record is a captured frame
+type Record struct {
+	// Offset is when the frame was sent or received, from the start of the session
+	Offset    time.Duration
+	Direction Direction
+	Opcode    Opcode
+	// Length is the size of the frame's payload, which Data holds all of unless it was left out
+	Length int
+	Data   []byte
+}
+
+// Truncated reports whether the payload of the frame was left out of the trace
+func (r Record) Truncated() bool {
+	return len(r.Data) < r.Length
+}
+
+// Writer captures frames into a trace. It is safe for concurrent use. Frames are buffered until
+// the trace is closed.
+type Writer struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	dst    io.Writer
+	header Header
+	closed bool
+	// err is the first write error, after which frames are dropped
+	err error
+}
+
+// NewWriter starts a trace on w with the given header
+func NewWriter(w io.Writer, h Header) (*Writer, error) {
+	tw := &Writer{w: bufio.NewWriter(w), dst: w, header: h}
+	var flags byte
+	if h.Audio {
+		flags |= flagAudio
+	}
+	buf := append([]byte(magic), version, flags)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.StartedAt.UnixNano()))
+	buf = appendString(buf, h.SessionID)
+	buf = appendString(buf, h.DeviceID)
+	if _, err := tw.w.Write(buf); err != nil {
+		return nil, err
+	}
+	return tw, nil
+}
+
+// Write captures a frame sent or received at at. The payload of binary frames is left out unless
+// the trace captures audio.
+func (w *Writer) Write(at time.Time, dir Direction, op Opcode, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if w.err != nil {
+		return w.err
+	}
+	captured := data
+	if op == Binary && !w.header.Audio {
+		captured = nil
+	}
+	buf := binary.AppendUvarint(nil, uint64(max(at.Sub(w.header.StartedAt), 0)))
+	buf = append(buf, byte(dir), byte(op))
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	buf = binary.AppendUvarint(buf, uint64(len(captured)))
+	if _, err := w.w.Write(buf); err != nil {
+		w.err = err
+		return err
+	}
+	if _, err := w.w.Write(captured); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+// Close flushes the trace and closes the underlying writer if it is an io.Closer. It returns the
+// first error the trace ran into.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	w.closed = true
+	err := w.err
+	if ferr := w.w.Flush(); err == nil {
+		err = ferr
+	}
+	if c, ok := w.dst.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Reader reads the frames of a trace
+type Reader struct {
+	r      *bufio.Reader
+	header Header
+}
+
+// NewReader reads the header of the trace in r
+func NewReader(r io.Reader) (*Reader, error) {
+	tr := &Reader{r: bufio.NewReader(r)}
+	fixed := make([]byte, len(magic)+2+8)
+	if _, err := io.ReadFull(tr.r, fixed); err != nil {
+		return nil, fmt.Errorf("could not read trace header: %w", err)
+	}
+	if string(fixed[:len(magic)]) != magic {
+		return nil, errors.New("not a trace file")
+	}
+	if v := fixed[len(magic)]; v != version {
+		return nil, fmt.Errorf("unsupported trace version %d", v)
+	}
+	tr.header.Audio = fixed[len(magic)+1]&flagAudio != 0
+	tr.header.StartedAt = time.Unix(0, int64(binary.BigEndian.Uint64(fixed[len(magic)+2:])))
+	var err error
+	if tr.header.SessionID, err = tr.readString(); err != nil {
+		return nil, fmt.Errorf("could not read trace header: %w", err)
+	}
+	if tr.header.DeviceID, err = tr.readString(); err != nil {
+		return nil, fmt.Errorf("could not read trace header: %w", err)
+	}
+	return tr, nil
+}
+
+// Header returns the header of the trace
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Next returns the next frame of the trace, or io.EOF after the last one. A trace cut off in the
+// middle of a frame returns io.ErrUnexpectedEOF.
+func (r *Reader) Next() (Record, error) {
+	offset, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return Record{}, err
+	}
+	var rec Record
+	rec.Offset = time.Duration(offset)
+	kind := make([]byte, 2)
+	if _, err := io.ReadFull(r.r, kind); err != nil {
+		return Record{}, unexpected(err)
+	}
+	rec.Direction, rec.Opcode = Direction(kind[0]), Opcode(kind[1])
+	length, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return Record{}, unexpected(err)
+	}
+	captured, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return Record{}, unexpected(err)
+	}
+	if captured > length || captured > maxCaptured {
+		return Record{}, fmt.Errorf("corrupt trace: %d bytes captured of a %d byte frame", captured, length)
+	}
+	rec.Length = int(length)
+	rec.Data = make([]byte, captured)
+	if _, err := io.ReadFull(r.r, rec.Data); err != nil {
+		return Record{}, unexpected(err)
+	}
+	return rec, nil
+}
+
+func (r *Reader) readString() (string, error) {
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return "", err
+	}
+	if n > 1<<16 {
+		return "", fmt.Errorf("corrupt trace: %d byte string", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// unexpected turns the end of the trace in the middle of a frame into io.ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package trace
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	start := time.Unix(1700000000, 500)
+	audio := []byte{1, 2, 3, 4}
+	for _, withAudio := range []bool{false, true} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, Header{SessionID: "abc", DeviceID: "dev-1", StartedAt: start, Audio: withAudio})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(start.Add(time.Millisecond), FromDevice, Text, []byte(`{"type":"ptt.begin"}`))
+		w.Write(start.Add(20*time.Millisecond), FromDevice, Binary, audio)
+		w.Write(start.Add(time.Second), ToDevice, Close, []byte{0x03, 0xe8})
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write(start, ToDevice, Ping, nil); !errors.Is(err, ErrClosed) {
+			t.Fatalf("write after close: %v", err)
+		}
+
+		r, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := r.Header(); h.SessionID != "abc" || h.DeviceID != "dev-1" || !h.StartedAt.Equal(start) || h.Audio != withAudio {
+			t.Fatalf("header read as %+v", h)
+		}
+		var got []Record
+		for {
+			rec, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, rec)
+		}
+		if len(got) != 3 || got[0].Offset != time.Millisecond || string(got[0].Data) != `{"type":"ptt.begin"}` || got[2].Direction != ToDevice || got[2].Opcode != Close {
+			t.Fatalf("frames read as %+v", got)
+		}
+		if bin := got[1]; bin.Length != len(audio) || bin.Truncated() == withAudio || (withAudio && !bytes.Equal(bin.Data, audio)) {
+			t.Fatalf("audio frame read as %+v with audio %t", bin, withAudio)
+		}
+
+		// a trace cut off in a frame, as by a crash, reads up to that frame
+		r, _ = NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+		r.Next()
+		r.Next()
+		if _, err := r.Next(); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("cut off trace: %v", err)
+		}
+	}
+
+	if _, err := NewReader(bytes.NewReader([]byte("RIFF....WAVEfmt "))); err == nil {
+		t.Fatal("a WAV file read as a trace")
+	}
+}
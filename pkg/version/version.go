@@ -0,0 +1,57 @@
+// Package version compares the protocol and firmware versions devices report, so the relay can
+// tell old devices to upgrade before support for them is dropped.
+package version
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Protocol is the version of the control protocol and audio framing this relay speaks. Devices
+// that do not report a protocol version are taken to speak version 1.
+const Protocol = 1
+
+// Firmware is a dotted numeric firmware version such as "2.3.1". A leading "v" and anything from
+// the first "-" or "+" on, e.g. a pre-release or build suffix, are ignored.
+type Firmware []int
+
+// ParseFirmware reads a firmware version
+func ParseFirmware(s string) (Firmware, error) {
+	trimmed := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(trimmed, "-+"); i >= 0 {
+		trimmed = trimmed[:i]
+	}
+	if trimmed == "" {
+		return nil, fmt.Errorf("invalid firmware version %q", s)
+	}
+	parts := strings.Split(trimmed, ".")
+	v := make(Firmware, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid firmware version %q", s)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+// Less reports whether v is older than w. Missing components count as 0, so "2.3" and "2.3.0"
+// are the same version.
+func (v Firmware) Less(w Firmware) bool {
+	for i := 0; i < max(len(v), len(w)); i++ {
+		a, b := component(v, i), component(w, i)
+		if a != b {
+			return a < b
+		}
+	}
+	return false
+}
+
+func component(v Firmware, i int) int {
+	if i < len(v) {
+		return v[i]
+	}
+	return 0
+}
@@ -0,0 +1,37 @@
+package version
+
+import "testing"
+
+func TestFirmware(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{"1.2.3", "1.2.4", true},
+		{"1.10.0", "1.9.9", false},
+		{"2.3", "2.3.0", false},
+		{"2.3.0", "2.3", false},
+		{"v2.3.0-beta.1", "2.3.1", true},
+		{"2.3.0+build7", "2.3.0", false},
+		{"1", "1.0.1", true},
+	}
+	for _, tt := range tests {
+		a, err := ParseFirmware(tt.a)
+		if err != nil {
+			t.Fatalf("ParseFirmware(%q): %v", tt.a, err)
+		}
+		b, err := ParseFirmware(tt.b)
+		if err != nil {
+			t.Fatalf("ParseFirmware(%q): %v", tt.b, err)
+		}
+		if got := a.Less(b); got != tt.less {
+			t.Errorf("%s < %s = %v, want %v", tt.a, tt.b, got, tt.less)
+		}
+	}
+
+	for _, s := range []string{"", "v", "1..2", "1.x", "-1"} {
+		if _, err := ParseFirmware(s); err == nil {
+			t.Errorf("ParseFirmware(%q) did not fail", s)
+		}
+	}
+}
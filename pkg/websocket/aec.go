@@ -0,0 +1,355 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+const (
+	// aecBin is the resolution of the loudness envelopes the delay of the echo is found with
+	aecBin = 10 * time.Millisecond
+	// aecWindow is how much audio is correlated to find the delay, and aecCheckEvery how often
+	aecWindow     = 2 * time.Second
+	aecCheckEvery = 500 * time.Millisecond
+	// aecMinCorrelation is how closely the loudness of the uplink must follow the response audio
+	// for the delay to be taken
+	aecMinCorrelation = 0.5
+	// aecMargin extends the filter before the delay found, which is only as exact as aecBin
+	aecMargin = 2 * aecBin
+	// aecDrift is how far the uplink may drift from when it was received before its position is
+	// taken again from the session clock
+	aecDrift = time.Second
+	// aecStep is the step size of the filter's adaptation
+	aecStep = 0.5
+	// doubleTalkRatio is how many times the power of the echo the filter expects the uplink must
+	// have for the user to be taken to talk over the assistant, which stops the filter adapting
+	doubleTalkRatio = 4
+	// doubleTalkHold is how long the filter stops adapting once the user talked
+	doubleTalkHold = 100 * time.Millisecond
+	// erleDecay is how much of the power measured for the ERLE carries over from frame to frame,
+	// so it tells how well the echo is cancelled of late
+	erleDecay = 0.99
+)
+
+// EchoCancellation is the state of a session's echo cancellation, as shown in the admin API
+type EchoCancellation struct {
+	// DelayMs is how late the echo comes back, -1 until it was found
+	DelayMs int64 `json:"delay_ms"`
+	// ERLEDB is by how much the echo was lowered, in dB, 0 until it was
+	ERLEDB float64 `json:"erle_db"`
+}
+
+// echoCanceller cancels the response audio a full duplex device picks up from its speaker. The
+// response audio is kept, at the uplink's rate, on a timeline of when the device plays it, and the
+// uplink on one of when it was captured. Their loudness is correlated every aecCheckEvery to find
+// how far the echo lags, and an NLMS filter over aec.tail from there learns how the response audio
+// comes back; what it predicts is subtracted from the uplink. The filter stops adapting while the
+// uplink is much louder than the echo it expects, when the user talks over the assistant. A nil
+// *echoCanceller cancels nothing.
+type echoCanceller struct {
+	sampleRate int
+	channels   int
+	taps       int
+	maxLag     int64
+
+	mu     sync.Mutex
+	origin time.Time
+	// ref is a ring of the response audio, by position on the timeline, and refEnd the position
+	// after the last of it; down is its loudness
+	ref       []int16
+	refEnd    int64
+	down      envelope
+	resampler *audio.Resampler
+
+	// micPos is the position after the last uplink audio, and up its loudness
+	micPos   int64
+	anchored bool
+	up       envelope
+	checked  int64
+	// delay is how many samples the echo lags the response audio by, -1 until it was found, and
+	// coupling how loud the echo is next to the response audio
+	delay    int64
+	coupling float64
+	// start is how many samples the first tap of the filter lags the uplink by, weights are the
+	// taps of every channel and heldUntil the position until which they stay as they are
+	start     int64
+	weights   [][]float64
+	heldUntil int64
+	// heard and left are the recent power of the uplink with echo and after its cancellation, for
+	// the ERLE
+	heard float64
+	left  float64
+}
+
+// newEchoCanceller returns the echo cancellation of a session of a device with the given profile
+// and duplex mode that sends audio at sampleRate, or nil if its echo is not cancelled. Half duplex
+// devices are not heard while the assistant speaks, so they have no echo to cancel.
+func newEchoCanceller(cfg *config.Config, profile, mode string, sampleRate int, now time.Time) *echoCanceller {
+	if mode != FullDuplex || !cfg.AECFor(profile) || sampleRate <= 0 {
+		return nil
+	}
+	tail, _ := time.ParseDuration(cfg.AEC.Tail)
+	maxDelay, _ := time.ParseDuration(cfg.AEC.MaxDelay)
+	channels := max(cfg.Audio.Channels, 1)
+	a := &echoCanceller{
+		sampleRate: sampleRate,
+		channels:   channels,
+		origin:     now,
+		down:       newEnvelope(int((aecWindow + maxDelay + aecCheckEvery + echoHorizon) / aecBin)),
+		up:         newEnvelope(int((aecWindow + aecCheckEvery) / aecBin)),
+		delay:      -1,
+		weights:    make([][]float64, channels),
+	}
+	a.taps = int(a.samples(tail + 2*aecMargin))
+	a.maxLag = a.samples(maxDelay)
+	a.ref = make([]int16, a.samples(maxDelay+tail+aecWindow+echoHorizon))
+	for c := range a.weights {
+		a.weights[c] = make([]float64, a.taps)
+	}
+	return a
+}
+
+// samples returns how many samples of audio play for d
+func (a *echoCanceller) samples(d time.Duration) int64 {
+	return int64(d) * int64(a.sampleRate) / int64(time.Second)
+}
+
+// position returns the position on the timeline of the time t
+func (a *echoCanceller) position(t time.Time) int64 {
+	return a.samples(t.Sub(a.origin))
+}
+
+// bin returns the envelope bin of a position
+func (a *echoCanceller) bin(pos int64) int64 {
+	return pos * int64(time.Second) / int64(a.sampleRate) / int64(aecBin)
+}
+
+// reference returns the response audio the device plays at pos, 0 where it plays none
+func (a *echoCanceller) reference(pos int64) float64 {
+	if pos < 0 || pos >= a.refEnd || pos < a.refEnd-int64(len(a.ref)) {
+		return 0
+	}
+	return float64(a.ref[pos%int64(len(a.ref))])
+}
+
+// downlink records response audio at sampleRate sent to the device at now. The device plays it
+// once what was sent before has played.
+func (a *echoCanceller) downlink(now time.Time, pcm []byte, sampleRate int) {
+	if a == nil || sampleRate <= 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if from, _ := a.resampler.Rates(); from != sampleRate {
+		a.resampler = audio.NewResampler(sampleRate, a.sampleRate, 1)
+	}
+	resampled := a.resampler.Resample(audio.FromPCM16(pcm, sampleRate, 1))
+	samples := resampled.AsPCM16()
+	start := max(a.position(now), a.refEnd)
+	for pos := a.refEnd; pos < start && pos < a.refEnd+int64(len(a.ref)); pos++ {
+		a.ref[pos%int64(len(a.ref))] = 0
+	}
+	n := int64(len(samples) / 2)
+	for i := int64(0); i < n; i++ {
+		s := int16(binary.LittleEndian.Uint16(samples[2*i:]))
+		a.ref[(start+i)%int64(len(a.ref))] = s
+		a.down.add(a.bin(start+i), float64(s)*float64(s), 1)
+	}
+	a.refEnd = start + n
+}
+
+// stopPlayback forgets the response audio the device has not played yet, when it is interrupted
+func (a *echoCanceller) stopPlayback(now time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if pos := a.position(now); pos < a.refEnd {
+		a.refEnd = max(pos, 0)
+		a.down.clearAfter(a.bin(a.refEnd))
+	}
+}
+
+// cancel subtracts the echo of the response audio from audio received from the device at now,
+// captured over the time before
+func (a *echoCanceller) cancel(now time.Time, pcm []byte) []byte {
+	if a == nil {
+		return pcm
+	}
+	frames := int64(len(pcm) / 2 / a.channels)
+	if frames == 0 {
+		return pcm
+	}
+
+	a.mu.Lock()
+	captured := a.position(now) - frames
+	if drift := a.micPos - captured; !a.anchored || drift > a.samples(aecDrift) || -drift > a.samples(aecDrift) {
+		a.micPos, a.anchored = captured, true
+	}
+	first := a.micPos
+	for i := int64(0); i < frames; i++ {
+		var sum float64
+		for c := 0; c < a.channels; c++ {
+			s := float64(int16(binary.LittleEndian.Uint16(pcm[2*(int(i)*a.channels+c):])))
+			sum += s * s
+		}
+		a.up.add(a.bin(first+i), sum/float64(a.channels), 1)
+	}
+	a.micPos += frames
+	if a.micPos-a.checked >= a.samples(aecCheckEvery) {
+		a.checked = a.micPos
+		a.findDelay()
+	}
+	if a.delay < 0 {
+		a.mu.Unlock()
+		return pcm
+	}
+	// x holds the response audio the filter sees over the frame, the taps before its first sample
+	// and then one more for each sample
+	x := make([]float64, int(frames)+a.taps-1)
+	var power float64
+	for i := range x {
+		x[i] = a.reference(first - a.start - int64(a.taps) + 1 + int64(i))
+		power += x[i] * x[i]
+	}
+	coupling := a.coupling
+	a.mu.Unlock()
+	if power == 0 {
+		return pcm
+	}
+
+	// the user talks over the assistant when the uplink is much louder than the echo
+	var heard float64
+	for i := 0; i+1 < len(pcm); i += 2 {
+		s := float64(int16(binary.LittleEndian.Uint16(pcm[i:])))
+		heard += s * s
+	}
+	echo := coupling * coupling * power / float64(len(x)) * float64(frames) * float64(a.channels)
+	if heard > doubleTalkRatio*echo {
+		a.heldUntil = first + frames + a.samples(doubleTalkHold)
+	}
+	adapt := first >= a.heldUntil
+
+	out := make([]byte, len(pcm))
+	var left float64
+	for c, w := range a.weights {
+		// window is the power of the response audio under the taps of the current sample
+		var window float64
+		for _, v := range x[:a.taps] {
+			window += v * v
+		}
+		for i := 0; i < int(frames); i++ {
+			if i > 0 {
+				window += x[i+a.taps-1]*x[i+a.taps-1] - x[i-1]*x[i-1]
+			}
+			taps := x[i : i+a.taps]
+			var predicted float64
+			for k, weight := range w {
+				predicted += weight * taps[a.taps-1-k]
+			}
+			offset := 2 * (i*a.channels + c)
+			mic := float64(int16(binary.LittleEndian.Uint16(pcm[offset:])))
+			e := mic - predicted
+			if adapt {
+				step := aecStep * e / (window + float64(a.taps))
+				for k := range w {
+					w[k] += step * taps[a.taps-1-k]
+				}
+			}
+			left += e * e
+			binary.LittleEndian.PutUint16(out[offset:], uint16(int16(min(max(math.Round(e), math.MinInt16), math.MaxInt16))))
+		}
+	}
+	if adapt {
+		a.mu.Lock()
+		a.heard = erleDecay*a.heard + heard
+		a.left = erleDecay*a.left + left
+		a.mu.Unlock()
+	}
+	return out
+}
+
+// findDelay correlates the loudness of the uplink over the last aecWindow with that of the
+// response audio, and takes the delay at which it follows it best if it does closely enough.
+// Checks over mostly silent response audio are skipped.
+func (a *echoCanceller) findDelay() {
+	end := a.bin(a.micPos)
+	n := int64(aecWindow / aecBin)
+	up := make([]float64, n)
+	for i := range up {
+		up[i] = a.up.rms(end - n + int64(i))
+	}
+	var best *echoLoop
+	var bestDown []float64
+	for lag := int64(0); lag <= a.bin(a.maxLag); lag++ {
+		down := make([]float64, n)
+		audible := 0
+		for i := range down {
+			down[i] = a.down.rms(end - n + int64(i) - lag)
+			if down[i] >= echoSilence {
+				audible++
+			}
+		}
+		if int64(audible) < n/2 {
+			continue
+		}
+		r, ok := pearson(up, down)
+		if ok && (best == nil || r > best.correlation) {
+			best = &echoLoop{correlation: r, delay: time.Duration(lag) * aecBin}
+			bestDown = down
+		}
+	}
+	if best == nil || best.correlation < aecMinCorrelation {
+		return
+	}
+	// the echo scales the response audio by about the least squares fit of their loudness
+	var cross, square float64
+	for i, d := range bestDown {
+		cross += up[i] * d
+		square += d * d
+	}
+	a.coupling = cross / square
+	a.delay = a.samples(best.delay)
+	start := max(a.delay-a.samples(aecMargin), 0)
+	// the taps keep what they learnt of the echo where it still falls under them
+	if shift := int(start - a.start); shift != 0 {
+		for _, w := range a.weights {
+			moved := make([]float64, len(w))
+			for k := range moved {
+				if j := k + shift; j >= 0 && j < len(w) {
+					moved[k] = w[j]
+				}
+			}
+			copy(w, moved)
+		}
+	}
+	a.start = start
+}
+
+// status returns the state of the echo cancellation, nil without it
+func (a *echoCanceller) status() *EchoCancellation {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := &EchoCancellation{DelayMs: -1}
+	if a.delay >= 0 {
+		s.DelayMs = a.delay * 1000 / int64(a.sampleRate)
+	}
+	if a.heard > 0 && a.left > 0 {
+		s.ERLEDB = math.Round(100*math.Log10(a.heard/a.left)) / 10
+	}
+	return s
+}
+
+// cancelEcho subtracts the echo of the response audio from an audio frame from the device
+func (h *Handler) cancelEcho(session *Session, pcm []byte) []byte {
+	return session.aec.cancel(session.clock.Now(), pcm)
+}
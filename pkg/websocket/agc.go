@@ -0,0 +1,114 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// gainControl brings the level of the device's audio to agc.target_level. It follows the level
+// sample by sample, coming down within agc.attack when it rises and back up within agc.release
+// when it falls, so loud onsets are not clipped and the gain does not pump between words. Below
+// agc.gate the gain holds, so pauses and noise are not amplified. It runs after calibration, which
+// measures the noise as the device picks it up, and replaces calibration's gain control. It is
+// only used by the session's read pump, except for its gain. A nil *gainControl changes nothing.
+type gainControl struct {
+	targetRMS float64
+	minGain   float64
+	maxGain   float64
+	gateRMS   float64
+	// attack and release are how much of the way to a sample's power the level moves per sample
+	attack   float64
+	release  float64
+	channels int
+
+	// power is the mean square of the audio, following attack and release, and recent follows it
+	// within attack either way, for the gate to close as soon as the user pauses. gain is the gain
+	// applied; applied holds its bits for the admin API.
+	power   float64
+	recent  float64
+	gain    float64
+	applied atomic.Uint64
+}
+
+// newGainControl returns the gain control of a session of a device with the given profile that
+// sends audio at sampleRate, or nil if its audio is not gain controlled
+func newGainControl(cfg *config.Config, profile string, sampleRate int) *gainControl {
+	if !cfg.AGCFor(profile) || sampleRate <= 0 {
+		return nil
+	}
+	a := cfg.AGC
+	attack, _ := time.ParseDuration(a.Attack)
+	release, _ := time.ParseDuration(a.Release)
+	maxGain := max(a.MaxGain, 1)
+	g := &gainControl{
+		targetRMS: fromDBFS(a.TargetLevel),
+		minGain:   1 / maxGain,
+		maxGain:   maxGain,
+		gateRMS:   fromDBFS(a.Gate),
+		attack:    smoothing(attack, sampleRate),
+		release:   smoothing(release, sampleRate),
+		channels:  max(cfg.Audio.Channels, 1),
+		gain:      1,
+	}
+	g.applied.Store(math.Float64bits(1))
+	return g
+}
+
+// smoothing returns how much of the way a one-pole filter at sampleRate moves per sample to settle
+// within d
+func smoothing(d time.Duration, sampleRate int) float64 {
+	if samples := d.Seconds() * float64(sampleRate); samples > 1 {
+		return 1 - math.Exp(-1/samples)
+	}
+	return 1
+}
+
+// apply brings a frame from the device towards the target level
+func (g *gainControl) apply(pcm []byte) []byte {
+	if g == nil {
+		return pcm
+	}
+	out := make([]byte, len(pcm))
+	frame := 2 * g.channels
+	for i := 0; i+frame <= len(pcm); i += frame {
+		var power float64
+		for c := 0; c < g.channels; c++ {
+			s := float64(int16(binary.LittleEndian.Uint16(pcm[i+2*c:])))
+			power += s * s
+		}
+		power /= float64(g.channels)
+		if power > g.power {
+			g.power += g.attack * (power - g.power)
+		} else {
+			g.power += g.release * (power - g.power)
+		}
+		g.recent += g.attack * (power - g.recent)
+		if math.Sqrt(g.recent) > g.gateRMS {
+			g.gain = min(max(g.targetRMS/math.Sqrt(g.power), g.minGain), g.maxGain)
+		}
+		for c := 0; c < g.channels; c++ {
+			s := float64(int16(binary.LittleEndian.Uint16(pcm[i+2*c:]))) * g.gain
+			binary.LittleEndian.PutUint16(out[i+2*c:], uint16(int16(min(max(s, math.MinInt16), math.MaxInt16))))
+		}
+	}
+	g.applied.Store(math.Float64bits(g.gain))
+	return out
+}
+
+// gainDB returns the gain last applied, in dB, rounded to a tenth
+func (g *gainControl) gainDB() float64 {
+	return math.Round(200*math.Log10(math.Float64frombits(g.applied.Load()))) / 10
+}
+
+// info returns the gain for the admin API, nil without gain control
+func (g *gainControl) info() *float64 {
+	if g == nil {
+		return nil
+	}
+	gain := g.gainDB()
+	return &gain
+}
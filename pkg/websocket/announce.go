@@ -0,0 +1,444 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+// announceChunk is the length of each frame of an announcement written to the device
+const announceChunk = 100 * time.Millisecond
+
+// States of an announcement
+const (
+	// AnnouncementScheduled announcements wait for their window to open
+	AnnouncementScheduled = "scheduled"
+	AnnouncementActive    = "active"
+	// AnnouncementFinished announcements are past their window; deliveries still playing finish
+	AnnouncementFinished  = "finished"
+	AnnouncementCancelled = "cancelled"
+)
+
+// States of the delivery of an announcement to a device. Delivered, interrupted and expired are the
+// results counted in pixa_announcement_deliveries_total.
+const (
+	DeliveryPending = "pending"
+	// DeliveryWaking deliveries asked the device waker to connect the device
+	DeliveryWaking    = "waking"
+	DeliveryPlaying   = "playing"
+	DeliveryDelivered = "delivered"
+	// DeliveryInterrupted is the result of playing cut by the user or the assistant speaking, or
+	// the session ending; the delivery is pending again and retried while the window is open
+	DeliveryInterrupted = "interrupted"
+	// DeliveryExpired deliveries were not delivered by the end of the window
+	DeliveryExpired = "expired"
+)
+
+// ErrAnnouncementNotFound is returned for announcements that are not scheduled on the relay
+var ErrAnnouncementNotFound = errors.New("announcement not found")
+
+// DeviceWaker asks a device that is not connected to connect to the relay, such as with a push
+// notification, so that it can be delivered an announcement
+type DeviceWaker func(ctx context.Context, deviceID string) error
+
+// WithDeviceWaker lets the relay have the devices listed by an announcement that are not
+// connected called up. Devices connect to the relay, not the other way around, so without a waker
+// announcements only reach the devices that connect during their window.
+func WithDeviceWaker(w DeviceWaker) Option {
+	return func(h *Handler) {
+		h.waker = w
+	}
+}
+
+// Announcement is a clip played to a group of devices within a time window. Devices are targeted
+// by their tenant, tags and IDs; zero fields match every device. Sessions of unknown devices are
+// never targeted, as deliveries are tracked by device.
+type Announcement struct {
+	// Asset is the clip from the assets directory that is played
+	Asset    string            `json:"asset"`
+	TenantID string            `json:"tenant_id,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	// DeviceIDs limits the announcement to these devices, which are woken up if they are not
+	// connected and the handler has a device waker
+	DeviceIDs []string `json:"device_ids,omitempty"`
+	// NotBefore opens the window, now if zero; NotAfter closes it
+	NotBefore time.Time `json:"not_before,omitzero"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// Delivery is the progress of an announcement to a device
+type Delivery struct {
+	State string `json:"state"`
+	// SessionID is the session the announcement was last played in
+	SessionID   string    `json:"session_id,omitempty"`
+	DeliveredAt time.Time `json:"delivered_at,omitzero"`
+	// Attempts counts the times the announcement started playing to the device
+	Attempts int `json:"attempts,omitempty"`
+	// Error is why waking the device or playing to it last failed
+	Error string `json:"error,omitempty"`
+}
+
+// AnnouncementStatus is the progress of an announcement
+type AnnouncementStatus struct {
+	ID string `json:"id"`
+	Announcement
+	State     string    `json:"state"`
+	CreatedAt time.Time `json:"created_at"`
+	// Deliveries are by device ID, for the devices targeted so far
+	Deliveries map[string]Delivery `json:"deliveries"`
+}
+
+// Announcements holds the announcements scheduled on a relay. It is safe for concurrent use.
+type Announcements struct {
+	mu     sync.Mutex
+	lastID int
+	items  map[string]*AnnouncementStatus
+	// idleSince is when each session was first seen idle, by session ID
+	idleSince map[string]time.Time
+	// playing counts the announcements playing across the relay
+	playing int
+}
+
+func newAnnouncements() *Announcements {
+	return &Announcements{items: make(map[string]*AnnouncementStatus), idleSince: make(map[string]time.Time)}
+}
+
+// Get returns the status of an announcement
+func (a *Announcements) Get(id string) (AnnouncementStatus, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.items[id]
+	if !ok {
+		return AnnouncementStatus{}, false
+	}
+	return s.snapshot(), true
+}
+
+// List returns the status of every announcement, the earliest scheduled first
+func (a *Announcements) List() []AnnouncementStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make([]AnnouncementStatus, 0, len(a.items))
+	for _, s := range a.items {
+		out = append(out, s.snapshot())
+	}
+	slices.SortFunc(out, func(x, y AnnouncementStatus) int {
+		n, _ := strconv.Atoi(x.ID)
+		m, _ := strconv.Atoi(y.ID)
+		return n - m
+	})
+	return out
+}
+
+// Cancel stops an announcement from being delivered any further. Deliveries playing finish.
+func (a *Announcements) Cancel(id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.items[id]
+	if !ok {
+		return ErrAnnouncementNotFound
+	}
+	if s.State == AnnouncementScheduled || s.State == AnnouncementActive {
+		s.State = AnnouncementCancelled
+	}
+	return nil
+}
+
+func (s *AnnouncementStatus) snapshot() AnnouncementStatus {
+	out := *s
+	out.Tags = maps.Clone(s.Tags)
+	out.DeviceIDs = slices.Clone(s.DeviceIDs)
+	out.Deliveries = maps.Clone(s.Deliveries)
+	return out
+}
+
+// targets reports whether the announcement is for a session
+func (s *AnnouncementStatus) targets(session *Session) bool {
+	if session.DeviceID == "" || (s.TenantID != "" && session.TenantID != s.TenantID) {
+		return false
+	}
+	if len(s.DeviceIDs) > 0 && !slices.Contains(s.DeviceIDs, session.DeviceID) {
+		return false
+	}
+	return store.MatchTags(session.Tags(), s.Tags)
+}
+
+// Announcements returns the announcements scheduled on the handler, or nil if they are disabled
+func (h *Handler) Announcements() *Announcements {
+	return h.announcements
+}
+
+// ScheduleAnnouncement schedules an announcement and returns its status
+func (h *Handler) ScheduleAnnouncement(a Announcement) (AnnouncementStatus, error) {
+	if h.announcements == nil {
+		return AnnouncementStatus{}, errors.New("announcements are disabled")
+	}
+	now := h.clock.Now()
+	switch {
+	case a.Asset == "" || !filepath.IsLocal(a.Asset):
+		return AnnouncementStatus{}, fmt.Errorf("invalid asset %q", a.Asset)
+	case a.NotAfter.IsZero():
+		return AnnouncementStatus{}, errors.New("not_after is not specified")
+	case !a.NotAfter.After(now) || !a.NotAfter.After(a.NotBefore):
+		return AnnouncementStatus{}, errors.New("not_after must be in the future and after not_before")
+	}
+	// the clip is checked now rather than when the first device is due
+	if _, err := h.assets.PCM16(a.Asset, h.config.Audio.SampleRate); err != nil {
+		return AnnouncementStatus{}, err
+	}
+	if a.NotBefore.IsZero() {
+		a.NotBefore = now
+	}
+	an := h.announcements
+	an.mu.Lock()
+	defer an.mu.Unlock()
+	an.lastID++
+	s := &AnnouncementStatus{ID: strconv.Itoa(an.lastID), Announcement: a, State: AnnouncementScheduled, CreatedAt: now, Deliveries: make(map[string]Delivery)}
+	for _, id := range a.DeviceIDs {
+		s.Deliveries[id] = Delivery{State: DeliveryPending}
+	}
+	an.items[s.ID] = s
+	h.logger.Info("Scheduled announcement", "announcement", s.ID, "asset", a.Asset, "not_before", a.NotBefore, "not_after", a.NotAfter)
+	return s.snapshot(), nil
+}
+
+// RunAnnouncements delivers the scheduled announcements every announcements interval until ctx is
+// done. The relay server runs it when announcements are enabled; embedding applications serving
+// the handler themselves can run it alongside.
+func (h *Handler) RunAnnouncements(ctx context.Context) {
+	if h.announcements == nil {
+		return
+	}
+	interval, _ := time.ParseDuration(h.config.Announcements.Interval)
+	ticker := h.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			h.announce(ctx)
+		}
+	}
+}
+
+// announce starts playing the announcements due to the sessions idle for long enough, and
+// finishes the announcements past their window
+func (h *Handler) announce(ctx context.Context) {
+	cfg := h.config.Announcements
+	idleFor, _ := time.ParseDuration(cfg.IdleFor)
+	retention, _ := time.ParseDuration(cfg.Retention)
+	now := h.clock.Now()
+	sessions := h.sessions.List()
+	an := h.announcements
+
+	an.mu.Lock()
+	defer an.mu.Unlock()
+	connected := make(map[string]bool, len(sessions))
+	idle := make(map[string]bool, len(sessions))
+	idleSince := make(map[string]time.Time, len(sessions))
+	for _, session := range sessions {
+		connected[session.DeviceID] = true
+		if !session.idle() {
+			continue
+		}
+		since, ok := an.idleSince[session.ID]
+		if !ok {
+			since = now
+		}
+		idleSince[session.ID] = since
+		idle[session.ID] = now.Sub(since) >= idleFor
+	}
+	an.idleSince = idleSince
+
+	ids := make([]string, 0, len(an.items))
+	for id := range an.items {
+		ids = append(ids, id)
+	}
+	// the earliest scheduled announcements are played first
+	slices.SortFunc(ids, func(x, y string) int {
+		n, _ := strconv.Atoi(x)
+		m, _ := strconv.Atoi(y)
+		return n - m
+	})
+	for _, id := range ids {
+		s := an.items[id]
+		switch {
+		case s.State == AnnouncementFinished || s.State == AnnouncementCancelled:
+			if now.Sub(s.NotAfter) > retention {
+				delete(an.items, id)
+			}
+			continue
+		case !now.Before(s.NotAfter):
+			h.finishAnnouncement(s)
+			continue
+		case now.Before(s.NotBefore):
+			continue
+		}
+		s.State = AnnouncementActive
+		for _, session := range sessions {
+			if !idle[session.ID] || an.playing >= cfg.MaxConcurrent || !s.targets(session) {
+				continue
+			}
+			d := s.Deliveries[session.DeviceID]
+			if d.State == DeliveryPlaying || d.State == DeliveryDelivered {
+				continue
+			}
+			d.State, d.SessionID, d.Error = DeliveryPlaying, session.ID, ""
+			d.Attempts++
+			s.Deliveries[session.DeviceID] = d
+			an.playing++
+			// a session plays one announcement at a time
+			idle[session.ID] = false
+			session.announcing.Store(true)
+			go h.playAnnouncement(ctx, session, s.ID, s.Asset)
+		}
+		if h.waker == nil {
+			continue
+		}
+		for _, deviceID := range s.DeviceIDs {
+			if d := s.Deliveries[deviceID]; d.State == DeliveryPending && !connected[deviceID] {
+				d.State, d.Error = DeliveryWaking, ""
+				s.Deliveries[deviceID] = d
+				go h.wakeDevice(ctx, s.ID, deviceID)
+			}
+		}
+	}
+}
+
+// finishAnnouncement closes the window of an announcement, expiring the devices it did not reach
+func (h *Handler) finishAnnouncement(s *AnnouncementStatus) {
+	s.State = AnnouncementFinished
+	delivered := 0
+	for deviceID, d := range s.Deliveries {
+		switch d.State {
+		case DeliveryDelivered:
+			delivered++
+		case DeliveryPending, DeliveryWaking:
+			d.State = DeliveryExpired
+			s.Deliveries[deviceID] = d
+			h.metrics.announcementDelivery(DeliveryExpired)
+		}
+	}
+	h.logger.Info("Announcement finished", "announcement", s.ID, "devices", len(s.Deliveries), "delivered", delivered)
+}
+
+// wakeDevice asks the device waker to connect a device. The device stays waking until it connects
+// and the announcement is played to it, or the window ends.
+func (h *Handler) wakeDevice(ctx context.Context, id, deviceID string) {
+	err := h.waker(ctx, deviceID)
+	if err == nil {
+		return
+	}
+	h.logger.Warn("Could not wake device for announcement", "announcement", id, "device_id", deviceID, "error", err)
+	h.updateDelivery(id, deviceID, func(d *Delivery) {
+		if d.State == DeliveryWaking {
+			d.Error = err.Error()
+		}
+	})
+}
+
+// updateDelivery changes the delivery of an announcement to a device, if both are still tracked
+func (h *Handler) updateDelivery(id, deviceID string, update func(d *Delivery)) {
+	an := h.announcements
+	an.mu.Lock()
+	defer an.mu.Unlock()
+	s, ok := an.items[id]
+	if !ok {
+		return
+	}
+	d, ok := s.Deliveries[deviceID]
+	if !ok {
+		return
+	}
+	update(&d)
+	s.Deliveries[deviceID] = d
+}
+
+// playAnnouncement writes an announcement to the device in real time. It is cut when the user or
+// the assistant starts speaking, and played again from the start once the session is idle again.
+// Like the filler it bypasses the audio cursor.
+func (h *Handler) playAnnouncement(ctx context.Context, session *Session, id, asset string) {
+	logger := session.Client.logger.With("announcement", id)
+	state, failure := DeliveryInterrupted, ""
+	defer func() {
+		session.announcing.Store(false)
+		h.metrics.announcementDelivery(state)
+		an := h.announcements
+		an.mu.Lock()
+		defer an.mu.Unlock()
+		an.playing--
+		// the session is idle for idle_for again before the next announcement
+		delete(an.idleSince, session.ID)
+		s, ok := an.items[id]
+		if !ok {
+			return
+		}
+		d := s.Deliveries[session.DeviceID]
+		switch {
+		case state == DeliveryDelivered:
+			d.State, d.DeliveredAt = DeliveryDelivered, session.clock.Now()
+		case s.State == AnnouncementFinished:
+			d.State = DeliveryExpired
+		default:
+			d.State = DeliveryPending
+		}
+		d.Error = failure
+		s.Deliveries[session.DeviceID] = d
+	}()
+
+	pcm, err := h.assets.PCM16(asset, session.DownlinkSampleRate())
+	if err != nil {
+		logger.Error("Could not load announcement audio", "asset", asset, "error", err)
+		failure = err.Error()
+		return
+	}
+	logger.Info("Playing announcement", "asset", asset)
+	frameBytes := int(announceChunk*time.Duration(session.DownlinkSampleRate())/time.Second) * 2
+	ticker := session.clock.NewTicker(announceChunk)
+	defer ticker.Stop()
+	for pos := 0; pos < len(pcm); pos += frameBytes {
+		if !session.quiet() {
+			logger.Info("Announcement interrupted", "played", time.Duration(pos/2)*time.Second/time.Duration(session.DownlinkSampleRate()))
+			return
+		}
+		if _, err := h.writeAudio(session, pcm[pos:min(pos+frameBytes, len(pcm))], sourceAnnouncement, pos+frameBytes >= len(pcm)); err != nil {
+			logger.Error("Could not write announcement to client", "error", err)
+			failure = err.Error()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+	state = DeliveryDelivered
+	logger.Info("Announcement delivered")
+}
+
+// quiet reports whether neither the user nor the assistant is speaking, and no audio test runs
+func (s *Session) quiet() bool {
+	select {
+	case <-s.answerDone():
+	default:
+		return false
+	}
+	s.transcriptMu.Lock()
+	speaking := !s.timeline.speechStart.IsZero() && s.timeline.speechEnd.IsZero()
+	s.transcriptMu.Unlock()
+	return !speaking && s.audioTest.Load() == nil
+}
+
+// idle reports whether the session is quiet and not playing an announcement
+func (s *Session) idle() bool {
+	return !s.announcing.Load() && s.quiet()
+}
@@ -0,0 +1,208 @@
+package websocket
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+)
+
+const (
+	// testToneChunk is the length of each frame of a test signal written to the device, and the
+	// resolution the audio heard back is compared at
+	testToneChunk = 20 * time.Millisecond
+	// testToneMatch is the share of a bin's energy that must be at the frequencies played for the
+	// bin to count as heard back
+	testToneMatch = 0.5
+	// testToneCorrelation is how closely the loudness heard back must follow the signal's
+	testToneCorrelation = 0.5
+)
+
+// Results of audio tests, as counted in pixa_audio_tests_total
+const (
+	AudioTestPassed = "passed"
+	AudioTestFailed = "failed"
+	// AudioTestPlayed is a test that played its signal without verifying it
+	AudioTestPlayed = "played"
+)
+
+// audioTest is a test signal played to a device, and the audio from the device while it plays.
+// The playout goroutine writes the signal and the read pump records the device's audio.
+type audioTest struct {
+	signal   audio.TestSignal
+	pcm      []byte
+	downRate int
+	verify   bool
+
+	mu sync.Mutex
+	// started is when the first frame of the signal was written to the device
+	started time.Time
+	// heard is the first channel of the device's audio as 16 bit PCM, from heardAt on, at upRate
+	heard   []byte
+	heardAt time.Time
+	upRate  int
+}
+
+// handleAudioTest starts the audio test the device asked for, unless one is running
+func (h *Handler) handleAudioTest(ctx context.Context, session *Session, msg audioTestMessage) {
+	cfg := h.config.AudioTest
+	if !cfg.Enabled {
+		session.Client.logger.Info("Ignoring audio test, audio tests are disabled")
+		return
+	}
+	maxDuration, _ := time.ParseDuration(cfg.MaxDuration)
+	duration := min(cmp.Or(time.Duration(msg.DurationMs)*time.Millisecond, 2*time.Second), maxDuration)
+	rate := session.DownlinkSampleRate()
+	// frequencies are kept below the Nyquist frequency of the downlink
+	nyquist := float64(rate) / 2 * 0.9
+	signal := audio.TestSignal{From: float64(cmp.Or(msg.FrequencyHz, 1000)), Duration: duration}
+	signal.To = signal.From
+	if msg.Kind == "sweep" {
+		signal.From, signal.To = float64(cmp.Or(msg.FromHz, 300)), float64(cmp.Or(msg.ToHz, 3400))
+	}
+	signal.From, signal.To = min(max(signal.From, 50), nyquist), min(max(signal.To, 50), nyquist)
+	level := float64(min(cmp.Or(msg.LevelDb, -12), 0))
+
+	t := &audioTest{signal: signal, pcm: signal.PCM(rate, level), downRate: rate, verify: msg.Verify}
+	if !session.audioTest.CompareAndSwap(nil, t) {
+		session.Client.logger.Info("Ignoring audio test, one is running")
+		return
+	}
+	session.Client.logger.Info("Starting audio test", "from_hz", signal.From, "to_hz", signal.To, "duration", duration, "verify", msg.Verify)
+	go h.runAudioTest(ctx, session, t)
+}
+
+// runAudioTest plays the test signal in real time, then waits for it to come back from the device
+// and reports the result
+func (h *Handler) runAudioTest(ctx context.Context, session *Session, t *audioTest) {
+	defer session.audioTest.Store(nil)
+	session.stopFiller()
+
+	frameBytes := int(testToneChunk*time.Duration(t.downRate)/time.Second) * 2
+	ticker := session.clock.NewTicker(testToneChunk)
+	defer ticker.Stop()
+	for pos := 0; pos < len(t.pcm); pos += frameBytes {
+		if pos == 0 {
+			t.mu.Lock()
+			t.started = session.clock.Now()
+			t.mu.Unlock()
+		}
+		if _, err := h.writeAudio(session, t.pcm[pos:min(pos+frameBytes, len(t.pcm))], sourceAudioTest, pos+frameBytes >= len(t.pcm)); err != nil {
+			session.Client.logger.Error("Could not write test tone to client", "error", err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+
+	result := audioTestResultEvent{Type: AudioTestResultEvent}
+	outcome := AudioTestPlayed
+	if t.verify {
+		maxDelay, _ := time.ParseDuration(h.config.AudioTest.MaxDelay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-session.clock.After(maxDelay):
+		}
+		result = t.result(maxDelay, h.config.AudioTest.MinMatch)
+		outcome = AudioTestFailed
+		if result.Passed {
+			outcome = AudioTestPassed
+		}
+	}
+	h.metrics.audioTest(outcome)
+	session.Client.logger.Info("Audio test finished", "result", outcome, "latency_ms", result.LatencyMs, "level_db", result.LevelDb, "matched_percent", result.MatchedPercent)
+	if err := session.Client.Send(result); err != nil {
+		session.Client.logger.Error("Could not send audio test result to client", "error", err)
+	}
+}
+
+// hearTest records the device's audio, decoded and mixed down, while an audio test runs, and
+// silences it, so the provider does not take the test signal for the user. channels is that of
+// the audio, and now when it arrived.
+func (s *Session) hearTest(now time.Time, pcm []byte, channels int) []byte {
+	t := s.audioTest.Load()
+	if t == nil {
+		return pcm
+	}
+	if t.verify {
+		t.mu.Lock()
+		frames := len(pcm) / (2 * channels)
+		if t.heardAt.IsZero() {
+			t.heardAt, t.upRate = now.Add(-time.Duration(frames)*time.Second/time.Duration(s.sampleRate)), s.sampleRate
+		}
+		for i := 0; i < frames; i++ {
+			t.heard = append(t.heard, pcm[2*channels*i:2*channels*i+2]...)
+		}
+		t.mu.Unlock()
+	}
+	return make([]byte, len(pcm))
+}
+
+// result compares the audio heard from the device with the signal played. The delay the signal
+// came back at is the one at which the loudness of the audio heard best follows that of the
+// signal; at that delay, every bin of the signal is heard back if most of the energy heard is at
+// the frequencies played during it.
+func (t *audioTest) result(maxDelay time.Duration, minMatch float64) audioTestResultEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := audioTestResultEvent{Type: AudioTestResultEvent, Verified: true}
+	downBin := 2 * int(testToneChunk*time.Duration(t.downRate)/time.Second)
+	bins := (len(t.pcm) + downBin - 1) / downBin
+	// bins of silence after the signal, so its end is correlated as well as its start
+	window := bins + 5
+	down := make([]float64, window)
+	for b := range bins {
+		down[b] = rms(t.pcm[b*downBin : min((b+1)*downBin, len(t.pcm))])
+	}
+	heard := func(b int) []byte {
+		if t.upRate == 0 {
+			return nil
+		}
+		offset := t.heardAt.Sub(t.started)
+		from := 2 * int((time.Duration(b)*testToneChunk-offset)*time.Duration(t.upRate)/time.Second)
+		to := from + 2*int(testToneChunk*time.Duration(t.upRate)/time.Second)
+		from, to = min(max(from, 0), len(t.heard)), min(max(to, 0), len(t.heard))
+		return t.heard[from:to]
+	}
+
+	best, score := 0, -1.0
+	for k := 0; k <= int(maxDelay/testToneChunk); k++ {
+		up := make([]float64, window)
+		for b := range up {
+			up[b] = rms(heard(b + k))
+		}
+		if c, ok := pearson(down, up); ok && c > score {
+			best, score = k, c
+		}
+	}
+	matched := 0
+	var back []byte
+	for b := range bins {
+		pcm := heard(b + best)
+		at := time.Duration(b) * testToneChunk
+		if audio.BandShare(samplesOf(pcm), t.upRate, t.signal.Frequency(at), t.signal.Frequency(at+testToneChunk)) >= testToneMatch {
+			matched++
+		}
+		back = append(back, pcm...)
+	}
+	result.LatencyMs = (time.Duration(best) * testToneChunk).Milliseconds()
+	result.LevelDb = int(math.Round(toDBFS(rms(back))))
+	if bins > 0 {
+		result.MatchedPercent = matched * 100 / bins
+	}
+	result.Passed = score >= testToneCorrelation && float64(matched) >= minMatch*float64(bins)
+	return result
+}
+
+// samplesOf returns the samples of 16 bit PCM
+func samplesOf(pcm []byte) []int16 {
+	samples, _ := audio.Pcm16ToInt16Slice(pcm[:len(pcm)&^1])
+	return samples
+}
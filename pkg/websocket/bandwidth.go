@@ -0,0 +1,202 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	pixaerrors "github.com/pixaverse-studios/websocket-server/pkg/errors"
+)
+
+// UsageStore keeps track of how many bytes each device has used over the device link per month.
+// Implementations must be safe for concurrent use.
+type UsageStore interface {
+	// Add records n bytes for the device in the given month ("2006-01") and returns the new total
+	Add(deviceID, month string, n int64) (int64, error)
+	// Get returns the bytes recorded for the device in the given month
+	Get(deviceID, month string) (int64, error)
+}
+
+// MemoryUsageStore is a UsageStore that keeps usage in memory
+type MemoryUsageStore struct {
+	mu    sync.Mutex
+	usage map[string]int64
+}
+
+// NewMemoryUsageStore creates an empty in-memory usage store
+func NewMemoryUsageStore() *MemoryUsageStore {
+	return &MemoryUsageStore{usage: make(map[string]int64)}
+}
+
+func (s *MemoryUsageStore) Add(deviceID, month string, n int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usage[deviceID+"/"+month] += n
+	return s.usage[deviceID+"/"+month], nil
+}
+
+func (s *MemoryUsageStore) Get(deviceID, month string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.usage[deviceID+"/"+month], nil
+}
+
+// bandwidth scopes a cap applies to
+const (
+	sessionScope = "session"
+	monthlyScope = "monthly"
+)
+
+// bandwidthLevel is how close a session is to one of its caps
+type bandwidthLevel int
+
+const (
+	levelNormal bandwidthLevel = iota
+	levelWarning
+	levelDowngrade
+	levelExceeded
+)
+
+// bandwidthMeter counts the bytes a session moves over the device link and reports when the
+// session crosses the warning, downgrade and cutoff levels of its caps
+type bandwidthMeter struct {
+	cfg      config.BandwidthConfig
+	store    UsageStore
+	deviceID string
+	// now tells the month usage is counted in, time.Now if nil
+	now func() time.Time
+
+	mu       sync.Mutex
+	inBytes  int64
+	outBytes int64
+	level    bandwidthLevel
+}
+
+// bandwidthCrossing describes the level a session has just reached for one of its caps
+type bandwidthCrossing struct {
+	level     bandwidthLevel
+	scope     string
+	usedBytes int64
+	capBytes  int64
+}
+
+func newBandwidthMeter(cfg config.BandwidthConfig, store UsageStore, deviceID string) *bandwidthMeter {
+	return &bandwidthMeter{cfg: cfg, store: store, deviceID: deviceID}
+}
+
+func (m *bandwidthMeter) month() string {
+	now := time.Now
+	if m.now != nil {
+		now = m.now
+	}
+	return now().UTC().Format("2006-01")
+}
+
+// add counts n bytes in the given direction. ok is true when the session reached a new level.
+func (m *bandwidthMeter) add(n int, inbound bool) (crossing bandwidthCrossing, ok bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if inbound {
+		m.inBytes += int64(n)
+	} else {
+		m.outBytes += int64(n)
+	}
+
+	crossing = bandwidthCrossing{
+		level:     m.levelFor(m.inBytes+m.outBytes, m.cfg.SessionCapBytes),
+		scope:     sessionScope,
+		usedBytes: m.inBytes + m.outBytes,
+		capBytes:  m.cfg.SessionCapBytes,
+	}
+
+	if m.store != nil && m.deviceID != "" {
+		monthly, storeErr := m.store.Add(m.deviceID, m.month(), int64(n))
+		if storeErr != nil {
+			err = storeErr
+		} else if level := m.levelFor(monthly, m.cfg.MonthlyCapBytes); level > crossing.level {
+			crossing = bandwidthCrossing{level: level, scope: monthlyScope, usedBytes: monthly, capBytes: m.cfg.MonthlyCapBytes}
+		}
+	}
+
+	if crossing.level <= m.level {
+		return crossing, false, err
+	}
+	m.level = crossing.level
+	return crossing, true, err
+}
+
+func (m *bandwidthMeter) levelFor(used, limit int64) bandwidthLevel {
+	if limit <= 0 {
+		return levelNormal
+	}
+	ratio := float64(used) / float64(limit)
+	switch {
+	case ratio >= 1:
+		return levelExceeded
+	case m.cfg.DowngradeThreshold > 0 && ratio >= m.cfg.DowngradeThreshold:
+		return levelDowngrade
+	case m.cfg.WarningThreshold > 0 && ratio >= m.cfg.WarningThreshold:
+		return levelWarning
+	}
+	return levelNormal
+}
+
+// totals returns the bytes received from and sent to the device
+func (m *bandwidthMeter) totals() (in, out int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.inBytes, m.outBytes
+}
+
+// countLinkBytes records traffic over the device link and enforces the session's bandwidth caps
+func (h *Handler) countLinkBytes(session *Session, n int, inbound bool) {
+	h.metrics.linkTraffic(inbound, n)
+	if !inbound {
+		h.bytesOut.Add(int64(n))
+	}
+
+	crossing, ok, err := session.bandwidth.add(n, inbound)
+	if err != nil {
+		session.Client.logger.Error("Could not record bandwidth usage", "error", err)
+	}
+	if !ok {
+		return
+	}
+
+	client := session.Client
+	switch crossing.level {
+	case levelWarning:
+		h.metrics.bandwidthCap(crossing.scope, "warning")
+		client.logger.Info("Bandwidth cap warning", "scope", crossing.scope, "used_bytes", crossing.usedBytes)
+		client.Send(newBandwidthEvent(BandwidthWarningEvent, crossing))
+
+	case levelDowngrade:
+		h.metrics.bandwidthCap(crossing.scope, "downgrade")
+		rate := h.config.Bandwidth.DowngradeSampleRate
+		if rate >= session.DownlinkSampleRate() {
+			return
+		}
+		client.logger.Info("Downgrading downlink audio", "scope", crossing.scope, "sample_rate", rate)
+		session.setDownlinkSampleRate(rate)
+		event := newBandwidthEvent(BandwidthDowngradedEvent, crossing)
+		event.SampleRate = rate
+		client.Send(event)
+
+	case levelExceeded:
+		h.metrics.bandwidthCap(crossing.scope, "exceeded")
+		client.logger.Info("Bandwidth cap exceeded, closing session", "scope", crossing.scope, "used_bytes", crossing.usedBytes)
+		client.Send(newBandwidthEvent(BandwidthExceededEvent, crossing))
+		client.closeFor(pixaerrors.New(pixaerrors.PolicyViolation, "bandwidth cap exceeded"))
+		session.Close()
+	}
+}
+
+func newBandwidthEvent(eventType string, c bandwidthCrossing) bandwidthEvent {
+	return bandwidthEvent{
+		Type:      eventType,
+		Scope:     c.scope,
+		UsedBytes: c.usedBytes,
+		CapBytes:  c.capBytes,
+	}
+}
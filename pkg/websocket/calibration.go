@@ -0,0 +1,235 @@
+package websocket
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/ai"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+const (
+	// calibrationBin is the resolution of the loudness measured during calibration
+	calibrationBin = 20 * time.Millisecond
+	// noiseFloorPercentile is the share of the calibration bins quieter than the noise floor. Bins
+	// above it are taken to be the user or passing sounds; the floor is what remains.
+	noiseFloorPercentile = 0.2
+	// quietFloorDBFS and loudFloorDBFS are the noise floors that get the lowest and the highest
+	// voice activity threshold, those of a quiet office and of a busy lobby
+	quietFloorDBFS = -60
+	loudFloorDBFS  = -30
+	// silenceDBFS is the level of digital silence
+	silenceDBFS = -96
+	// speechAboveFloor is how far above the noise floor a frame must be, in dB, for gain control to
+	// take it as speech
+	speechAboveFloor = 10
+	// minGain bounds how much gain control attenuates loud speakers
+	minGain = 0.5
+	// gainAttack is how much of the way to its target the gain moves with each frame of speech
+	gainAttack = 0.2
+)
+
+// CalibrationResult is what a session's calibration found about the surroundings of its device
+type CalibrationResult struct {
+	// NoiseFloorDBFS is the level of the ambient noise, in dBFS
+	NoiseFloorDBFS float64 `json:"noise_floor_dbfs"`
+	// Threshold is the voice activity threshold set for the session
+	Threshold float64 `json:"vad_threshold"`
+	// MaxGain is the most gain control amplifies the user, so the noise stays under the ceiling
+	MaxGain float64 `json:"max_gain"`
+}
+
+// calibration measures the ambient noise in the first calibration.duration of a session's audio
+// and then adapts the session to it: the provider's voice activity threshold is raised for loud
+// surroundings, and gain control brings the user's speech to calibration.target_level without
+// lifting the noise above calibration.noise_ceiling. Audio is relayed as usual while it is
+// measured. It is only used by the session's read pump, except for its result. A nil *calibration
+// changes nothing.
+type calibration struct {
+	window       time.Duration
+	minThreshold float64
+	maxThreshold float64
+	targetRMS    float64
+	maxGain      float64
+	ceilingRMS   float64
+	sampleRate   int
+	channels     int
+
+	// levels are the RMS of the bins measured so far, heard how much audio was measured and
+	// pending the audio of the bin being filled
+	levels  []float64
+	heard   time.Duration
+	pending []byte
+
+	// floorRMS is the noise floor, and gain and speechRMS the state of gain control, once
+	// calibrated
+	floorRMS  float64
+	gain      float64
+	speechRMS float64
+	amplify   bool
+
+	mu     sync.Mutex
+	result *CalibrationResult
+}
+
+// newCalibration returns the calibration of a session whose device sends audio at sampleRate, or
+// nil if it is disabled. Without amplify it only sets the voice activity threshold, for sessions
+// whose gain is controlled by agc.
+func newCalibration(cfg *config.Config, sampleRate int, amplify bool) *calibration {
+	c := cfg.Calibration
+	if !c.Enabled {
+		return nil
+	}
+	window, _ := time.ParseDuration(c.Duration)
+	return &calibration{
+		window:       window,
+		minThreshold: c.MinThreshold,
+		maxThreshold: c.MaxThreshold,
+		targetRMS:    fromDBFS(c.TargetLevel),
+		maxGain:      max(c.MaxGain, 1),
+		ceilingRMS:   fromDBFS(c.NoiseCeiling),
+		sampleRate:   sampleRate,
+		channels:     cfg.Audio.Channels,
+		gain:         1,
+		amplify:      amplify,
+	}
+}
+
+func toDBFS(rms float64) float64 {
+	if rms <= 0 {
+		return silenceDBFS
+	}
+	return max(20*math.Log10(rms/32768), silenceDBFS)
+}
+
+func fromDBFS(dbfs float64) float64 {
+	return 32768 * math.Pow(10, dbfs/20)
+}
+
+// rms returns the loudness of 16 bit PCM, in sample units
+func rms(pcm []byte) float64 {
+	n := len(pcm) / 2
+	if n == 0 {
+		return 0
+	}
+	var sum float64
+	for i := 0; i < n; i++ {
+		s := float64(int16(binary.LittleEndian.Uint16(pcm[2*i:])))
+		sum += s * s
+	}
+	return math.Sqrt(sum / float64(n))
+}
+
+// process measures a frame from the device while calibrating, and applies gain control once
+// calibrated. It returns the frame to relay, and the result when the frame completed calibration.
+func (c *calibration) process(pcm []byte) ([]byte, *CalibrationResult) {
+	if c == nil || c.sampleRate <= 0 || c.channels <= 0 {
+		return pcm, nil
+	}
+	if c.calibrated() != nil {
+		if !c.amplify {
+			return pcm, nil
+		}
+		return c.applyGain(pcm), nil
+	}
+
+	perBin := max(c.sampleRate*int(calibrationBin/time.Millisecond)/1000, 1) * c.channels * 2
+	c.pending = append(c.pending, pcm...)
+	for len(c.pending) >= perBin {
+		c.levels = append(c.levels, rms(c.pending[:perBin]))
+		c.pending = c.pending[perBin:]
+	}
+	c.heard += time.Duration(len(pcm)/2/c.channels) * time.Second / time.Duration(c.sampleRate)
+	if c.heard < c.window || len(c.levels) == 0 {
+		return pcm, nil
+	}
+
+	slices.Sort(c.levels)
+	c.floorRMS = c.levels[int(float64(len(c.levels)-1)*noiseFloorPercentile)]
+	c.levels, c.pending = nil, nil
+	floor := toDBFS(c.floorRMS)
+	loudness := min(max((floor-quietFloorDBFS)/(loudFloorDBFS-quietFloorDBFS), 0), 1)
+	result := &CalibrationResult{
+		NoiseFloorDBFS: math.Round(floor*10) / 10,
+		Threshold:      math.Round((c.minThreshold+loudness*(c.maxThreshold-c.minThreshold))*100) / 100,
+		MaxGain:        c.maxGain,
+	}
+	if c.floorRMS > 0 {
+		result.MaxGain = min(max(c.ceilingRMS/c.floorRMS, 1), c.maxGain)
+	}
+	c.maxGain = result.MaxGain
+	c.mu.Lock()
+	c.result = result
+	c.mu.Unlock()
+	return pcm, result
+}
+
+// applyGain brings the level of the user's speech towards the target. The gain follows frames well
+// above the noise floor only, so pauses do not ramp up the noise.
+func (c *calibration) applyGain(pcm []byte) []byte {
+	if level := rms(pcm); level > c.floorRMS*math.Pow(10, speechAboveFloor/20.0) && level > 0 {
+		if c.speechRMS == 0 {
+			c.speechRMS = level
+		}
+		c.speechRMS += gainAttack * (level - c.speechRMS)
+		target := min(max(c.targetRMS/c.speechRMS, minGain), c.maxGain)
+		c.gain += gainAttack * (target - c.gain)
+	}
+	if math.Abs(c.gain-1) < 0.01 {
+		return pcm
+	}
+	out := make([]byte, len(pcm))
+	for i := 0; i+1 < len(pcm); i += 2 {
+		s := float64(int16(binary.LittleEndian.Uint16(pcm[i:]))) * c.gain
+		binary.LittleEndian.PutUint16(out[i:], uint16(int16(min(max(s, math.MinInt16), math.MaxInt16))))
+	}
+	return out
+}
+
+// calibrated returns what calibration found, nil until it is done
+func (c *calibration) calibrated() *CalibrationResult {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.result
+}
+
+// calibrate passes a frame from the device through the session's calibration. When the frame
+// completes it, the provider's voice activity threshold is set from the noise measured.
+func (h *Handler) calibrate(ctx context.Context, session *Session, pcm []byte) []byte {
+	pcm, result := session.calibration.process(pcm)
+	if result == nil {
+		return pcm
+	}
+	h.metrics.noiseFloor(result.NoiseFloorDBFS)
+	session.Client.logger.Info("Calibrated to ambient noise",
+		"noise_floor_dbfs", result.NoiseFloorDBFS, "vad_threshold", result.Threshold, "max_gain", result.MaxGain)
+	session.uplinkMu.Lock()
+	provider := session.provider
+	session.uplinkMu.Unlock()
+	if provider != nil {
+		h.applyCalibration(ctx, session, provider)
+	}
+	return pcm
+}
+
+// applyCalibration sets the voice activity threshold calibration found on a provider. Providers
+// connected before calibration is done get it when it is; those connected after, when they are.
+func (h *Handler) applyCalibration(ctx context.Context, session *Session, provider ai.AIClient) {
+	result := session.calibration.calibrated()
+	updater, ok := provider.(ai.EndpointingUpdater)
+	if result == nil || !ok {
+		return
+	}
+	e := h.config.EndpointingFor(session.deviceProfile)
+	e.Threshold = result.Threshold
+	if err := updater.UpdateEndpointing(ctx, e); err != nil {
+		session.Client.logger.Error("Could not apply calibration to provider", "error", err)
+	}
+}
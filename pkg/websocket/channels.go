@@ -0,0 +1,86 @@
+package websocket
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+)
+
+// InputChannelsHeader carries the number of interleaved channels of the audio the device sends,
+// for devices that do not capture audio.channels, such as I2S microphone boards that only emit
+// stereo. Devices that cannot set headers use the channels query parameter.
+const InputChannelsHeader = "X-Pixa-Input-Channels"
+
+// DownmixHeader carries how the device's channels are mixed down to audio.channels: "average",
+// "left", "right" or the 0-based channel to take, such as the one its only microphone is on.
+// Devices that cannot set headers use the downmix query parameter.
+const DownmixHeader = "X-Pixa-Downmix"
+
+// MaxInputChannels is the most channels a device may send
+const MaxInputChannels = 8
+
+// downmix converts the device's audio to audio.channels right after it is decoded, so the rest
+// of the pipeline and the providers never see the device's channels. A nil *downmix changes
+// nothing, as when the device sends audio.channels and did not choose a downmix.
+type downmix struct {
+	from    int
+	to      int
+	channel int
+	// mode is the downmix as the device or audio.downmix named it
+	mode string
+}
+
+// inputDownmix returns the downmix of the audio the device sends. Channel counts and downmixes
+// the relay cannot apply are refused, so the device learns at upgrade time rather than from a
+// provider hearing silence or interleaved noise.
+func (h *Handler) inputDownmix(r *http.Request) (*downmix, error) {
+	to := h.config.Audio.Channels
+	from := to
+	if value := strings.TrimSpace(headerOrQuery(r, InputChannelsHeader, "channels")); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > MaxInputChannels {
+			return nil, &RejectError{StatusCode: http.StatusBadRequest, Reason: fmt.Sprintf("unsupported input channels %q", value)}
+		}
+		from = n
+	}
+	mode := strings.ToLower(strings.TrimSpace(headerOrQuery(r, DownmixHeader, "downmix")))
+	if mode == "" {
+		if from == to {
+			return nil, nil
+		}
+		mode = cmp.Or(h.config.Audio.Downmix, "average")
+	}
+	channel, err := audio.DownmixChannel(mode)
+	if err != nil || channel >= from {
+		return nil, &RejectError{StatusCode: http.StatusBadRequest, Reason: fmt.Sprintf("unsupported downmix %q of %d channels", mode, from)}
+	}
+	return &downmix{from: from, to: to, channel: channel, mode: mode}, nil
+}
+
+// apply mixes a decoded frame from the device down to audio.channels
+func (d *downmix) apply(pcm []byte) []byte {
+	if d == nil {
+		return pcm
+	}
+	return audio.Downmix(pcm, d.from, d.to, d.channel)
+}
+
+// channels returns the number of channels the device sends, 0 when it sends audio.channels
+func (d *downmix) channels() int {
+	if d == nil {
+		return 0
+	}
+	return d.from
+}
+
+// name returns the downmix, empty when the audio is not mixed down
+func (d *downmix) name() string {
+	if d == nil {
+		return ""
+	}
+	return d.mode
+}
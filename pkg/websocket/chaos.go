@@ -0,0 +1,134 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// Faults the chaos layer injects
+const (
+	FaultDropEvent          = "drop_event"
+	FaultDelayFrame         = "delay_frame"
+	FaultCorruptFrame       = "corrupt_frame"
+	FaultProviderDisconnect = "provider_disconnect"
+	FaultDeviceDisconnect   = "device_disconnect"
+)
+
+// errChaosDisconnect ends a provider connection cut by the chaos layer
+var errChaosDisconnect = errors.New("provider connection cut by fault injection")
+
+// faultInjector injects the faults of chaos.* into sessions. A nil *faultInjector injects nothing.
+type faultInjector struct {
+	cfg              config.ChaosConfig
+	frameDelay       time.Duration
+	disconnectWithin time.Duration
+	metrics          *handlerMetrics
+}
+
+func newFaultInjector(cfg config.ChaosConfig, metrics *handlerMetrics) *faultInjector {
+	if !cfg.Enabled {
+		return nil
+	}
+	f := &faultInjector{cfg: cfg, metrics: metrics}
+	f.frameDelay, _ = time.ParseDuration(cfg.FrameDelay)
+	f.disconnectWithin, _ = time.ParseDuration(cfg.DisconnectWithin)
+	return f
+}
+
+// chance reports whether an event of probability p happens, drawn from the session's seed
+func (s *Session) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	s.randMu.Lock()
+	defer s.randMu.Unlock()
+	return s.rand.Float64() < p
+}
+
+// inject reports whether the fault of probability p hits the session, and counts it
+func (f *faultInjector) inject(session *Session, fault string, p float64) bool {
+	if !session.chance(p) {
+		return false
+	}
+	f.metrics.faultInjected(fault)
+	session.Client.logger.Debug("Injecting fault", "fault", fault)
+	return true
+}
+
+// dropEvent reports whether a provider event is to be dropped
+func (f *faultInjector) dropEvent(session *Session) bool {
+	return f != nil && f.inject(session, FaultDropEvent, f.cfg.DropEvents)
+}
+
+// delayFrame holds an audio frame from the device if the fault hits it
+func (f *faultInjector) delayFrame(ctx context.Context, session *Session) {
+	if f == nil || !f.inject(session, FaultDelayFrame, f.cfg.DelayFrames) {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-session.clock.After(f.frameDelay):
+	}
+}
+
+// corruptFrame returns frame with a bit flipped if the fault hits it. The frame itself is left
+// alone, it may still be referenced elsewhere.
+func (f *faultInjector) corruptFrame(session *Session, frame []byte) []byte {
+	if f == nil || len(frame) == 0 || !f.inject(session, FaultCorruptFrame, f.cfg.CorruptFrames) {
+		return frame
+	}
+	session.randMu.Lock()
+	bit := session.rand.IntN(len(frame) * 8)
+	session.randMu.Unlock()
+	corrupted := bytes.Clone(frame)
+	corrupted[bit/8] ^= 1 << (bit % 8)
+	return corrupted
+}
+
+// scheduleDisconnects decides when, if at all, the session loses its provider and its device
+// connection. The channels of disconnects that do not happen never fire.
+func (f *faultInjector) scheduleDisconnects(session *Session) {
+	if f == nil {
+		return
+	}
+	session.chaosProviderCut = f.disconnectAfter(session, f.cfg.ProviderDisconnects)
+	session.chaosDeviceCut = f.disconnectAfter(session, f.cfg.DeviceDisconnects)
+}
+
+func (f *faultInjector) disconnectAfter(session *Session, p float64) <-chan time.Time {
+	if !session.chance(p) {
+		return nil
+	}
+	session.randMu.Lock()
+	after := time.Duration(session.rand.Int64N(int64(f.disconnectWithin)))
+	session.randMu.Unlock()
+	return session.clock.After(after)
+}
+
+// cutProvider returns the channel that fires when the session's provider connection is due to
+// be cut
+func (f *faultInjector) cutProvider(session *Session) <-chan time.Time {
+	if f == nil {
+		return nil
+	}
+	return session.chaosProviderCut
+}
+
+// cutDevice drops the device connection without a close frame once its scheduled disconnect is
+// due, as a lost network would
+func (f *faultInjector) cutDevice(ctx context.Context, session *Session) {
+	if f == nil || session.chaosDeviceCut == nil {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-session.chaosDeviceCut:
+		f.metrics.faultInjected(FaultDeviceDisconnect)
+		session.Client.logger.Info("Injecting fault", "fault", FaultDeviceDisconnect)
+		session.Client.conn.Close()
+	}
+}
@@ -0,0 +1,29 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// checksumSize is the length of the CRC32 header of binary frames when frame checksums are enabled
+const checksumSize = 4
+
+// checkFrame validates and strips the checksum of a binary frame from the device. The checksum is
+// the big endian CRC32 (IEEE) of the rest of the frame, so it covers encrypted frames as they
+// were sent: a frame that fails it was damaged on the way, a frame that passes it but cannot be
+// decrypted or played points at the device.
+func (h *Handler) checkFrame(session *Session, data []byte) ([]byte, bool) {
+	session.audioFrames.Add(1)
+	if !h.config.Websocket.FrameChecksum {
+		return data, true
+	}
+	if len(data) >= checksumSize && binary.BigEndian.Uint32(data) == crc32.ChecksumIEEE(data[checksumSize:]) {
+		return data[checksumSize:], true
+	}
+
+	corrupted := session.corruptedFrames.Add(1)
+	h.metrics.corruptedFrame()
+	session.Client.logger.Debug("Dropping audio frame that failed its checksum",
+		"size", len(data), "corrupted_frames", corrupted)
+	return nil, false
+}
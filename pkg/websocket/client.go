@@ -0,0 +1,314 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	pixaerrors "github.com/pixaverse-studios/websocket-server/pkg/errors"
+	"github.com/pixaverse-studios/websocket-server/pkg/trace"
+)
+
+// sendQueue is how many messages can wait for the write pump of a client
+const sendQueue = 64
+
+// ErrClientClosed is returned for messages sent to a client whose connection is closed
+var ErrClientClosed = errors.New("client connection closed")
+
+// Client represents a WebSocket client connection
+type Client struct {
+	conn   *websocket.Conn
+	logger *slog.Logger
+	// mu is held by the write pump while it writes, so closing waits for the write in progress
+	mu        sync.Mutex
+	config    *config.Config
+	closeOnce sync.Once
+	// outbox queues the messages for the write pump, the only goroutine writing to conn except
+	// for closing it. closed stops the pump once the connection is closed.
+	outbox     chan outbound
+	closed     chan struct{}
+	closedOnce sync.Once
+	// onWrite is called with the size of every message written to the client, by the goroutine that
+	// sent it once it is written, so that it can send messages of its own
+	onWrite func(n int)
+	// onPong is called with the round trip of every ping the client answers
+	onPong func(rtt time.Duration)
+	// clock drives the keepalive, the real clock if nil. Socket write deadlines always use real time.
+	clock clock.Clock
+	// lastPong is when the client last answered a ping, in unix nanoseconds of clock
+	lastPong atomic.Int64
+	// lastPing is when the oldest unanswered ping was sent, in unix nanoseconds of clock; 0 once
+	// it is answered
+	lastPing atomic.Int64
+	// pingInterval and pongWait override websocket.ping_interval and websocket.pong_wait when set
+	pingInterval time.Duration
+	pongWait     time.Duration
+	// readWait is how long the connection may go without a message or pong before reads fail, in
+	// real time; 0 until the keepalive starts
+	readWait time.Duration
+	// readInterrupted is set once reads are interrupted, so the deadline is not pushed back again
+	readInterrupted atomic.Bool
+	// closeErr is the failure the connection was first closed for, if any
+	closeErr atomic.Pointer[pixaerrors.Error]
+	// trace captures the frames of the connection when the session is traced
+	trace *trace.Writer
+}
+
+// outbound is a message waiting for the write pump
+type outbound struct {
+	messageType int
+	data        []byte
+	// written receives the result of writing the message
+	written chan error
+}
+
+// NewClient creates a new WebSocket client and starts its write pump
+func NewClient(conn *websocket.Conn, logger *slog.Logger, cfg *config.Config) *Client {
+	c := &Client{
+		conn:   conn,
+		logger: logger,
+		config: cfg,
+		outbox: make(chan outbound, sendQueue),
+		closed: make(chan struct{}),
+	}
+	go c.writePump()
+	return c
+}
+
+// Close closes the WebSocket connection and cleans up resources
+func (c *Client) Close() {
+	c.closeWith(websocket.CloseNormalClosure, "")
+}
+
+// closeWith closes the connection with the given close code and reason. Only the first close
+// frame is sent, so a more specific close code set earlier is not overwritten.
+func (c *Client) closeWith(code int, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeWait, _ := time.ParseDuration(c.config.Websocket.WriteWait)
+
+	c.stopWritePump()
+	if c.conn != nil {
+		c.closeOnce.Do(func() {
+			payload := websocket.FormatCloseMessage(code, reason)
+			c.conn.WriteControl(websocket.CloseMessage, payload, time.Now().Add(writeWait))
+			c.traceFrame(trace.ToDevice, websocket.CloseMessage, payload)
+		})
+		c.conn.Close()
+	}
+}
+
+// abort closes the connection without waiting for writes in progress, for connections whose
+// session is stuck
+func (c *Client) abort(code int, reason string) {
+	if c.conn == nil {
+		return
+	}
+	writeWait, _ := time.ParseDuration(c.config.Websocket.WriteWait)
+	c.stopWritePump()
+	c.closeOnce.Do(func() {
+		// WriteControl and Close are safe to call concurrently with a blocked writer
+		payload := websocket.FormatCloseMessage(code, reason)
+		c.conn.WriteControl(websocket.CloseMessage, payload, time.Now().Add(writeWait))
+		c.traceFrame(trace.ToDevice, websocket.CloseMessage, payload)
+	})
+	c.conn.Close()
+}
+
+// maxCloseReason is the longest reason that fits in a close frame
+const maxCloseReason = 123
+
+// closeFor closes the connection for a failure, with the close code of its code and its message
+// as the reason. The first failure is kept as the error the session ended with.
+func (c *Client) closeFor(err *pixaerrors.Error) {
+	c.closeErr.CompareAndSwap(nil, err)
+	c.closeWith(err.Code.CloseCode(), closeReason(err))
+}
+
+// abortFor aborts the connection for a failure, like closeFor
+func (c *Client) abortFor(err *pixaerrors.Error) {
+	c.closeErr.CompareAndSwap(nil, err)
+	c.abort(err.Code.CloseCode(), closeReason(err))
+}
+
+func closeReason(err *pixaerrors.Error) string {
+	if len(err.Message) > maxCloseReason {
+		return err.Message[:maxCloseReason]
+	}
+	return err.Message
+}
+
+// Err returns the failure the relay closed the connection for, or nil if it is open or was closed
+// normally or by the device. Its code tells embedding applications why the session ended.
+func (c *Client) Err() error {
+	if err := c.closeErr.Load(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// stopWritePump stops the write pump; messages sent afterwards fail with ErrClientClosed
+func (c *Client) stopWritePump() {
+	if c.closed != nil {
+		c.closedOnce.Do(func() { close(c.closed) })
+	}
+}
+
+// writePump writes the queued messages to the connection one at a time, in the order they were
+// sent, until the connection is closed. Gorilla connections support a single concurrent writer,
+// so the session's goroutines and the ping ticker all write through it.
+func (c *Client) writePump() {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case m := <-c.outbox:
+			m.written <- c.write(m.messageType, m.data)
+		}
+	}
+}
+
+// write writes a single message to the connection. It is only called by the write pump.
+func (c *Client) write(messageType int, data []byte) error {
+	c.mu.Lock()
+	writeWait, _ := time.ParseDuration(c.config.Websocket.WriteWait)
+	var err error
+	if messageType == websocket.PingMessage {
+		err = c.conn.WriteControl(messageType, data, time.Now().Add(writeWait))
+	} else {
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		err = c.conn.WriteMessage(messageType, data)
+	}
+	c.mu.Unlock()
+
+	if err == nil {
+		c.traceFrame(trace.ToDevice, messageType, data)
+	}
+	return err
+}
+
+// send queues a message for the write pump and waits until it is written, so frames keep their
+// pace and write errors reach the sender
+func (c *Client) send(messageType int, data []byte) error {
+	m := outbound{messageType: messageType, data: data, written: make(chan error, 1)}
+	select {
+	case c.outbox <- m:
+	case <-c.closed:
+		return ErrClientClosed
+	}
+	select {
+	case err := <-m.written:
+		// outside the write pump, which would wait on itself for the messages onWrite sends
+		if err == nil && c.onWrite != nil && messageType != websocket.PingMessage {
+			c.onWrite(len(data))
+		}
+		return err
+	case <-c.closed:
+		return ErrClientClosed
+	}
+}
+
+// Send writes v to the client as a JSON text message. It is safe to call from any goroutine.
+func (c *Client) Send(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.send(websocket.TextMessage, data)
+}
+
+// SendBinary writes data to the client as a binary message. It is safe to call from any goroutine.
+func (c *Client) SendBinary(data []byte) error {
+	return c.send(websocket.BinaryMessage, data)
+}
+
+// StartPingTicker starts sending periodic pings to the client. A client that has not answered for
+// longer than the pong wait is disconnected. As a backstop for half-open connections whose close
+// never completes, reads also fail once nothing, not even a pong, has been read for a ping interval
+// and a pong wait.
+func (c *Client) StartPingTicker(ctx context.Context) {
+	pingInterval, pongWait := c.pingInterval, c.pongWait
+	var err error
+	if pingInterval <= 0 {
+		if pingInterval, err = time.ParseDuration(c.config.Websocket.PingInterval); err != nil {
+			c.logger.Error("Invalid ping interval", "error", err)
+			return
+		}
+	}
+	if pongWait <= 0 {
+		if pongWait, err = time.ParseDuration(c.config.Websocket.PongWait); err != nil {
+			c.logger.Error("Invalid pong wait", "error", err)
+			return
+		}
+	}
+
+	clk := c.clock
+	if clk == nil {
+		clk = clock.Real()
+	}
+	c.lastPong.Store(clk.Now().UnixNano())
+	c.readWait = pingInterval + pongWait
+	c.extendReadDeadline()
+	ticker := clk.NewTicker(pingInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				// the wait runs from the oldest ping still unanswered, not from the last pong, so a
+				// device is never timed out before it has been pinged
+				now := clk.Now()
+				if sent := c.lastPing.Load(); sent != 0 {
+					if since := now.Sub(time.Unix(0, sent)); since > pongWait {
+						c.logger.Warn("Client stopped answering pings, closing connection", "since_ping", since)
+						c.closeFor(pixaerrors.New(pixaerrors.Unresponsive, "keepalive timeout"))
+						return
+					}
+				} else {
+					c.lastPing.Store(now.UnixNano())
+				}
+				if err := c.send(websocket.PingMessage, nil); err != nil {
+					c.logger.Error("Failed to write ping", "error", err)
+					return
+				}
+			}
+		}
+	}()
+
+	// Set up pong handler
+	c.conn.SetPongHandler(func(appData string) error {
+		c.traceFrame(trace.FromDevice, websocket.PongMessage, []byte(appData))
+		c.extendReadDeadline()
+		now := clk.Now()
+		c.lastPong.Store(now.UnixNano())
+		if sent := c.lastPing.Swap(0); sent != 0 && c.onPong != nil {
+			c.onPong(now.Sub(time.Unix(0, sent)))
+		}
+		return nil
+	})
+}
+
+// extendReadDeadline pushes back the read deadline of the connection by the read wait, once the
+// keepalive has started
+func (c *Client) extendReadDeadline() {
+	if c.readWait > 0 && !c.readInterrupted.Load() {
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.readWait))
+	}
+}
+
+// interruptRead fails the read in progress, and every read after it, without closing the
+// connection, so the reader returns at once rather than with the device's next message
+func (c *Client) interruptRead() {
+	c.readInterrupted.Store(true)
+	_ = c.conn.SetReadDeadline(time.Now())
+}
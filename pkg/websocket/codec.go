@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+)
+
+const (
+	// CodecHeader carries the codec of the audio frames the device sends: pcm16, the default,
+	// pcm24, pcm32, float32, g711_ulaw, g711_alaw, or a codec the handler has a decoder for, such as opus. Each binary
+	// frame then holds one packet of the codec. Devices that cannot set headers use the codec query
+	// parameter.
+	CodecHeader = "X-Pixa-Audio-Codec"
+
+	// Codecs of the audio frames from devices
+	PCM16Codec    = "pcm16"
+	PCM24Codec    = "pcm24"
+	PCM32Codec    = "pcm32"
+	Float32Codec  = "float32"
+	OpusCodec     = "opus"
+	G711ULawCodec = "g711_ulaw"
+	G711ALawCodec = "g711_alaw"
+)
+
+// builtinDecoders decode the codecs every handler supports. G.711 frames are at audio.sample_rate,
+// usually 8khz for telephony devices, and are sent to providers that take G.711 as they are. 24
+// and 32 bit PCM, packed little endian, and float32 PCM are rounded to 16 bit for the pipeline,
+// and their samples sent on as they are when the pipeline leaves the audio unchanged.
+var builtinDecoders = map[string]audio.Decoder{
+	PCM24Codec:    audio.PCM24Decoder{},
+	PCM32Codec:    audio.PCM32Decoder{},
+	Float32Codec:  audio.Float32Decoder{},
+	G711ULawCodec: audio.ULawDecoder{},
+	G711ALawCodec: audio.ALawDecoder{},
+}
+
+// WithDecoder lets devices send audio frames compressed with codec, which are decoded to 16 bit
+// PCM at the device's sample rate before they go through the rest of the pipeline. The relay only bundles
+// G.711 decoders, so that it builds without cgo; Opus decoders usually wrap libopus.
+func WithDecoder(codec string, factory audio.DecoderFactory) Option {
+	return func(h *Handler) {
+		if h.decoders == nil {
+			h.decoders = make(map[string]audio.DecoderFactory)
+		}
+		h.decoders[strings.ToLower(codec)] = factory
+	}
+}
+
+// requestCodec returns the codec of the audio frames a device sends
+func requestCodec(r *http.Request) string {
+	if codec := strings.ToLower(strings.TrimSpace(headerOrQuery(r, CodecHeader, "codec"))); codec != "" {
+		return codec
+	}
+	return PCM16Codec
+}
+
+// newDecoder returns the decoder of the audio frames of a device sending codec at sampleRate with
+// the given channels, nil for pcm16.
+// Codecs the handler has no decoder for are refused, so the device learns at upgrade time rather
+// than from a provider hearing noise.
+func (h *Handler) newDecoder(codec string, sampleRate, channels int) (audio.Decoder, error) {
+	if codec == PCM16Codec {
+		return nil, nil
+	}
+	factory, ok := h.decoders[codec]
+	if !ok {
+		if dec, ok := builtinDecoders[codec]; ok {
+			return dec, nil
+		}
+		return nil, &RejectError{StatusCode: http.StatusUnsupportedMediaType, Reason: fmt.Sprintf("unsupported audio codec %q", codec)}
+	}
+	dec, err := factory(sampleRate, channels)
+	if err != nil {
+		return nil, &RejectError{StatusCode: http.StatusUnsupportedMediaType, Reason: fmt.Sprintf("could not set up %s decoder: %v", codec, err)}
+	}
+	return dec, nil
+}
+
+// inputCodec returns the codec of the device's audio for providers, empty for pcm16
+func (s *Session) inputCodec() string {
+	if s.codec == PCM16Codec {
+		return ""
+	}
+	return s.codec
+}
+
+// decodeFrame decodes an audio frame from a device that sends compressed audio. Frames that
+// cannot be decoded are dropped.
+func (h *Handler) decodeFrame(session *Session, data []byte) ([]byte, bool) {
+	if session.decoder == nil {
+		return data, true
+	}
+	pcm, err := session.decoder.Decode(data)
+	if err != nil {
+		h.metrics.decodeError(session.codec)
+		session.Client.logger.Debug("Dropping audio frame that could not be decoded", "codec", session.codec, "size", len(data), "error", err)
+		return nil, false
+	}
+	return pcm, true
+}
+
+// decodeSamples decodes an audio frame from a device that sends audio finer than 16 bit PCM to its
+// samples as they are. It returns nil for other devices, and for devices whose channels are mixed
+// down, as the pipeline's audio then no longer matches the frame.
+func (h *Handler) decodeSamples(session *Session, data []byte) *audio.Audio {
+	dec, ok := session.decoder.(audio.SampleDecoder)
+	if !ok || session.downmix != nil {
+		return nil
+	}
+	a, err := dec.DecodeAudio(data, session.sampleRate, h.config.Audio.Channels)
+	if err != nil {
+		return nil
+	}
+	return &a
+}
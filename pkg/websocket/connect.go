@@ -0,0 +1,156 @@
+package websocket
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/version"
+)
+
+// ConnectToken is a short lived token a device connects with, and the URL carrying it
+type ConnectToken struct {
+	URL       string
+	Token     string
+	ExpiresAt time.Time
+}
+
+// ConnectTokenFunc mints the connect token of an authenticated device, such as a signed URL
+type ConnectTokenFunc func(deviceID, tenantID string) (ConnectToken, error)
+
+// WithConnectTokens sends devices calling the connect info endpoint a token minted by f. By default
+// they get none and connect with the credentials they called it with.
+func WithConnectTokens(f ConnectTokenFunc) Option {
+	return func(h *Handler) {
+		h.connectTokens = f
+	}
+}
+
+// ConnectInfo is what a device is told before the websocket upgrade
+type ConnectInfo struct {
+	// URL is the websocket URL to connect to
+	URL                string `json:"url"`
+	ProtocolVersion    int    `json:"protocol_version"`
+	MinProtocolVersion int    `json:"min_protocol_version"`
+	// Audio lists the audio formats the relay takes, and the one it assumes
+	Audio       ConnectAudio `json:"audio"`
+	Token       string       `json:"token,omitempty"`
+	TokenExpiry *time.Time   `json:"expires_at,omitempty"`
+}
+
+// ConnectAudio are the audio formats a device may negotiate on the upgrade
+type ConnectAudio struct {
+	// SampleRate, Channels and Codec are what the relay assumes when the device does not say
+	SampleRate int    `json:"sample_rate"`
+	Channels   int    `json:"channels"`
+	Codec      string `json:"codec"`
+	// Codecs and SampleRates are the values of the codec and sample rate headers the relay takes
+	Codecs      []string `json:"codecs"`
+	SampleRates []int    `json:"sample_rates"`
+	// MaxChannels is the most channels the input channels header takes
+	MaxChannels int `json:"max_channels"`
+	// FrameFormats are the values of the frame format header the relay takes
+	FrameFormats []string `json:"frame_formats"`
+}
+
+// ConnectInfoHandler returns the handler of GET /connect/info. Devices call it before the upgrade,
+// authenticating as they would to connect, so that discovery can be served by an instance other
+// than the relay handling their media. The OnConnect middleware runs on the request, so rate limits
+// count it like a connection. Devices without an identity attached by middleware are refused, as
+// the token would otherwise be minted for whoever they claim to be.
+func (h *Handler) ConnectInfoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.checkOrigin(w, r) {
+			return
+		}
+		req, err := h.middleware.onConnect(r)
+		if err != nil {
+			h.logger.Info("Connect info rejected by middleware", "remote_addr", r.RemoteAddr, "error", err)
+			h.metrics.connectInfo("rejected")
+			setRetryAfter(w, err)
+			http.Error(w, err.Error(), rejectStatus(err))
+			return
+		}
+		device, ok := DeviceIDFromContext(req.Context())
+		if !ok {
+			h.metrics.connectInfo("rejected")
+			http.Error(w, "device not authenticated", http.StatusUnauthorized)
+			return
+		}
+		tenant, _ := TenantIDFromContext(req.Context())
+		if h.refuseDraining(w) {
+			h.metrics.connectInfo("rejected")
+			return
+		}
+		if err := h.checkRegion(req.Context(), tenant); err != nil {
+			h.metrics.connectInfo("rejected")
+			http.Error(w, err.Error(), rejectStatus(err))
+			return
+		}
+
+		info := h.connectInfo(req)
+		if h.connectTokens != nil {
+			tok, err := h.connectTokens(device, tenant)
+			if err != nil {
+				h.logger.Error("Could not mint connect token", "device_id", device, "tenant_id", tenant, "error", err)
+				h.metrics.connectInfo("error")
+				http.Error(w, "could not mint connect token", http.StatusInternalServerError)
+				return
+			}
+			if tok.URL != "" {
+				info.URL = tok.URL
+			}
+			expires := tok.ExpiresAt.UTC()
+			info.Token, info.TokenExpiry = tok.Token, &expires
+		}
+		h.metrics.connectInfo("ok")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(info)
+	})
+}
+
+// connectInfo returns what devices are told to connect with, but the token
+func (h *Handler) connectInfo(r *http.Request) ConnectInfo {
+	codecs := []string{PCM16Codec}
+	codecs = append(codecs, slices.Sorted(maps.Keys(builtinDecoders))...)
+	for _, codec := range slices.Sorted(maps.Keys(h.decoders)) {
+		if !slices.Contains(codecs, codec) {
+			codecs = append(codecs, codec)
+		}
+	}
+	rates := slices.Clone(InputSampleRates)
+	if !slices.Contains(rates, h.config.Audio.SampleRate) {
+		rates = append(rates, h.config.Audio.SampleRate)
+		slices.Sort(rates)
+	}
+	return ConnectInfo{
+		URL:                h.connectURL(r),
+		ProtocolVersion:    version.Protocol,
+		MinProtocolVersion: h.minProtocol(),
+		Audio: ConnectAudio{
+			SampleRate:  h.config.Audio.SampleRate,
+			Channels:    h.config.Audio.Channels,
+			Codec:       PCM16Codec,
+			Codecs:      codecs,
+			SampleRates: rates,
+			MaxChannels: MaxInputChannels,
+
+			FrameFormats: []string{"raw", "1"},
+		},
+	}
+}
+
+// connectURL returns connect.url, or else the websocket URL of the host the request came to
+func (h *Handler) connectURL(r *http.Request) string {
+	if h.config.Connect.URL != "" {
+		return h.config.Connect.URL
+	}
+	scheme := "ws"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "wss"
+	}
+	return scheme + "://" + r.Host + "/"
+}
@@ -0,0 +1,155 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// handleControlMessage processes a JSON control message sent by the device. Messages that do not
+// follow the schema are answered with control.error and otherwise ignored.
+func (h *Handler) handleControlMessage(ctx context.Context, session *Session, data []byte) {
+	if invalid := validateControl(data, session.ProtocolVersion()); invalid != nil {
+		h.rejectControl(session, invalid)
+		return
+	}
+	var msg controlMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		session.Client.logger.Error("Could not parse control message", "error", err)
+		return
+	}
+
+	switch msg.Type {
+	case PlaybackAckMessage:
+		var ack playbackAckMessage
+		if err := json.Unmarshal(data, &ack); err != nil {
+			session.Client.logger.Error("Could not parse playback ack", "error", err)
+			return
+		}
+		session.Cursor.Ack(ack.PlayedMs)
+
+	case SessionHelloMessage:
+		var hello sessionHelloMessage
+		if err := json.Unmarshal(data, &hello); err != nil {
+			session.Client.logger.Error("Could not parse session hello", "error", err)
+			return
+		}
+		h.handleHello(session, hello)
+
+	case TurnMetadataMessage:
+		var metadata turnMetadataMessage
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			session.Client.logger.Error("Could not parse turn metadata", "error", err)
+			return
+		}
+		h.handleTurnMetadata(ctx, session, metadata)
+
+	case PttBeginMessage:
+		var begin pttBeginMessage
+		if err := json.Unmarshal(data, &begin); err != nil {
+			session.Client.logger.Error("Could not parse push-to-talk press", "error", err)
+			return
+		}
+		h.handlePTTBegin(ctx, session, begin)
+
+	case PttEndMessage:
+		h.handlePTTEnd(ctx, session)
+
+	case AudioTestMessage:
+		var test audioTestMessage
+		if err := json.Unmarshal(data, &test); err != nil {
+			session.Client.logger.Error("Could not parse audio test", "error", err)
+			return
+		}
+		h.handleAudioTest(ctx, session, test)
+
+	case DeviceHelloMessage:
+		session.Client.logger.Info("Ignoring device hello, the session is already set up")
+		h.sendConfigured(session)
+
+	default:
+		session.Client.logger.Info("Unknown control message", "type", msg.Type)
+	}
+}
+
+// handleHello agrees on the keys audio frames are encrypted with for the rest of the session
+func (h *Handler) handleHello(session *Session, hello sessionHelloMessage) {
+	if !h.config.Encryption.Enabled {
+		session.Client.logger.Info("Ignoring session hello, encryption is disabled")
+		return
+	}
+	if session.frames.Load() != nil {
+		session.Client.logger.Info("Ignoring repeated session hello")
+		return
+	}
+
+	frames, resp, err := handshake(session.ID, hello.PublicKey, h.signingKey)
+	if err != nil {
+		session.Client.logger.Error("Could not complete session hello", "error", err)
+		return
+	}
+	session.helloMu.Lock()
+	defer session.helloMu.Unlock()
+	err = session.Client.Send(sessionWelcomeEvent{
+		Type:      SessionWelcomeEvent,
+		SessionID: session.ID,
+		PublicKey: resp.relayPublic,
+		Signature: resp.signature,
+	})
+	if err != nil {
+		session.Client.logger.Error("Could not send session welcome", "error", err)
+		return
+	}
+	session.frames.Store(frames)
+	session.Client.logger.Info("Audio frame encryption enabled")
+}
+
+// openFrame decrypts an audio frame from the device. Frames are passed through as they are until
+// the device says hello, unless encryption is required, in which case they are dropped.
+func (h *Handler) openFrame(session *Session, data []byte) ([]byte, bool) {
+	frames := session.frames.Load()
+	if frames == nil {
+		return data, !h.config.Encryption.Required
+	}
+	plain, err := frames.open(data)
+	if err != nil {
+		session.Client.logger.Warn("Dropping audio frame that could not be decrypted", "error", err)
+		return nil, false
+	}
+	return plain, true
+}
+
+// writeAudio sends audio of source to the device, encrypted with the same rules as openFrame. It
+// reports whether the audio was sent. Devices taking Opus get a frame per 20ms packet, and the
+// audio left over is held for the next write unless end is set, as it is for the last of an
+// answer or clip.
+func (h *Handler) writeAudio(session *Session, data []byte, source downlinkSource, end bool) (bool, error) {
+	session.helloMu.RLock()
+	defer session.helloMu.RUnlock()
+
+	frames := session.frames.Load()
+	if frames == nil && h.config.Encryption.Required {
+		return false, nil
+	}
+	rate := session.DownlinkSampleRate()
+	packets := [][]byte{data}
+	if session.downlinkEnc != nil {
+		var err error
+		if packets, err = session.downlinkEnc.encode(data, rate, source, end); err != nil {
+			h.metrics.encodeError(session.downlinkCodec)
+			return false, fmt.Errorf("encoding audio as %s: %w", session.downlinkCodec, err)
+		}
+	}
+	start := session.clock.Now()
+	for _, packet := range packets {
+		if frames != nil {
+			packet = frames.seal(packet)
+		}
+		if err := session.Client.SendBinary(h.chaos.corruptFrame(session, packet)); err != nil {
+			return false, err
+		}
+	}
+	session.live.downlink(data, rate)
+	session.heat.observe(StageDeviceWrite, session.clock.Now().Sub(start))
+	return true, nil
+}
@@ -0,0 +1,164 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+)
+
+// AudioCursor tracks how much audio has moved through a session in both directions. The downlink
+// position is kept in samples so that on interruption the assistant's item can be truncated at the
+// exact point the device has played up to.
+type AudioCursor struct {
+	mu sync.Mutex
+
+	// uplink audio appended to the provider's input buffer, and the part of it committed as user turns
+	appended  time.Duration
+	committed time.Duration
+
+	// assistant item currently being relayed to the device
+	itemID          string
+	sampleRate      int
+	receivedSamples int64
+	sentSamples     int64
+	ackedSamples    int64
+	acked           bool
+	// interruptedItemID is the last item that was cut off; late audio for it is discarded
+	interruptedItemID string
+}
+
+// NewAudioCursor creates a cursor for a session whose downlink audio runs at sampleRate
+func NewAudioCursor(sampleRate int) *AudioCursor {
+	return &AudioCursor{sampleRate: sampleRate}
+}
+
+// SetSampleRate changes the downlink sample rate, converting the current positions to the new rate
+func (c *AudioCursor) SetSampleRate(rate int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sampleRate > 0 && rate > 0 {
+		convert := func(samples int64) int64 { return samples * int64(rate) / int64(c.sampleRate) }
+		c.receivedSamples = convert(c.receivedSamples)
+		c.sentSamples = convert(c.sentSamples)
+		c.ackedSamples = convert(c.ackedSamples)
+	}
+	c.sampleRate = rate
+}
+
+// Append records uplink audio appended to the provider
+func (c *AudioCursor) Append(d time.Duration) {
+	c.mu.Lock()
+	c.appended += d
+	c.mu.Unlock()
+}
+
+// Commit marks all appended audio as committed
+func (c *AudioCursor) Commit() {
+	c.mu.Lock()
+	c.committed = c.appended
+	c.mu.Unlock()
+}
+
+// Receive is called for every chunk of assistant audio and reports whether it should be relayed.
+// Audio for a new item resets the downlink position.
+func (c *AudioCursor) Receive(itemID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if itemID != "" && itemID == c.interruptedItemID {
+		return false
+	}
+	if itemID != c.itemID {
+		c.itemID = itemID
+		c.receivedSamples = 0
+		c.sentSamples = 0
+		c.ackedSamples = 0
+		c.acked = false
+	}
+	return true
+}
+
+// Received records samples of the current item received from the provider
+func (c *AudioCursor) Received(samples int) {
+	c.mu.Lock()
+	c.receivedSamples += int64(samples)
+	c.mu.Unlock()
+}
+
+// ReceivedMs returns how much audio of itemID has been received from the provider
+func (c *AudioCursor) ReceivedMs(itemID string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if itemID != c.itemID {
+		return 0
+	}
+	return c.samplesToMs(c.receivedSamples)
+}
+
+// Sent records samples of the current item written to the device
+func (c *AudioCursor) Sent(samples int) {
+	c.mu.Lock()
+	c.sentSamples += int64(samples)
+	c.mu.Unlock()
+}
+
+// Ack records the playback position the device reports for the current item
+func (c *AudioCursor) Ack(playedMs int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	samples := playedMs * int64(c.sampleRate) / 1000
+	if samples > c.sentSamples {
+		samples = c.sentSamples
+	}
+	c.ackedSamples = samples
+	c.acked = true
+}
+
+// Interrupt ends the current item and returns the position it should be truncated at. ok is false
+// when no assistant audio is being played. The item stays current after all of its audio was sent,
+// until the device reports it fully played or a new item starts.
+func (c *AudioCursor) Interrupt() (itemID string, audioEndMs int64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.itemID == "" || c.sentSamples == 0 || (c.acked && c.ackedSamples >= c.sentSamples) {
+		return "", 0, false
+	}
+	// without a playback report from the device, everything sent is the best estimate of what was heard
+	end := c.sentSamples
+	if c.acked {
+		end = c.ackedSamples
+	}
+
+	itemID = c.itemID
+	c.interruptedItemID = c.itemID
+	c.itemID = ""
+	c.receivedSamples = 0
+	c.sentSamples = 0
+	c.ackedSamples = 0
+	c.acked = false
+	return itemID, c.samplesToMs(end), true
+}
+
+// Status returns a snapshot of the cursor
+func (c *AudioCursor) Status() CursorStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CursorStatus{
+		AppendedMs:  c.appended.Milliseconds(),
+		CommittedMs: c.committed.Milliseconds(),
+		ItemID:      c.itemID,
+		SentMs:      c.samplesToMs(c.sentSamples),
+		AckedMs:     c.samplesToMs(c.ackedSamples),
+	}
+}
+
+func (c *AudioCursor) samplesToMs(samples int64) int64 {
+	if c.sampleRate <= 0 {
+		return 0
+	}
+	return samples * 1000 / int64(c.sampleRate)
+}
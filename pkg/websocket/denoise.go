@@ -0,0 +1,44 @@
+package websocket
+
+import (
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+)
+
+// WithDenoiser replaces the built-in spectral denoiser of sessions with noise suppression, which
+// only suppresses steady noise such as machines and fans. The relay builds without cgo, so trained
+// denoisers that also suppress chatter and clatter, such as RNNoise, are plugged in here.
+func WithDenoiser(factory audio.DenoiserFactory) Option {
+	return func(h *Handler) {
+		h.denoisers = factory
+	}
+}
+
+// newDenoiser returns the denoiser of a session whose device sends audio at sampleRate, or nil if
+// its audio is not denoised. Sessions whose denoiser cannot be set up go on with their audio as it
+// is, since noise is no reason to refuse a device.
+func (h *Handler) newDenoiser(session *Session, sampleRate int) audio.Denoiser {
+	if !h.config.DenoiseFor(session.deviceProfile) {
+		return nil
+	}
+	factory := h.denoisers
+	if factory == nil {
+		factory = audio.SpectralDenoisers(h.config.Denoise.MaxAttenuation)
+	}
+	d, err := factory(sampleRate, h.config.Audio.Channels)
+	if err != nil {
+		h.metrics.sessionDenoised("error")
+		session.Client.logger.Warn("Could not set up denoiser, audio is relayed as it is", "error", err)
+		return nil
+	}
+	h.metrics.sessionDenoised("ok")
+	return d
+}
+
+// denoise suppresses the noise in a frame of the device's audio, right after it was decoded, so
+// calibration, echo detection and the provider hear the user over less of it
+func (s *Session) denoise(pcm []byte) []byte {
+	if s.denoiser == nil {
+		return pcm
+	}
+	return s.denoiser.Denoise(pcm)
+}
@@ -0,0 +1,52 @@
+package websocket
+
+import (
+	"context"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+// WithDeviceStore keeps the presence of devices in s: when each device was first and last seen,
+// and its latest sessions. By default device presence is not kept.
+func WithDeviceStore(s store.DeviceStore) Option {
+	return func(h *Handler) {
+		h.devices = s
+	}
+}
+
+// connection is the session as kept in its device's connection history
+func (s *Session) connection() store.Connection {
+	return store.Connection{SessionID: s.ID, ConnectedAt: s.StartedAt, FirmwareVersion: s.FirmwareVersion()}
+}
+
+// deviceConnected records the session starting in the presence of its device
+func (h *Handler) deviceConnected(session *Session) {
+	if h.devices == nil || session.DeviceID == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.devices.DeviceConnected(ctx, session.DeviceID, session.TenantID, session.connection()); err != nil {
+		session.Client.logger.Error("Could not record device connection", "error", err)
+	}
+}
+
+// deviceDisconnected records the end of the session, and the error it ended with, in the presence
+// of its device
+func (h *Handler) deviceDisconnected(session *Session, at time.Time, err error) {
+	if h.devices == nil || session.DeviceID == "" {
+		return
+	}
+	c := session.connection()
+	c.DisconnectedAt = &at
+	if err != nil {
+		c.Error = err.Error()
+	}
+	// the request context is gone by now, so the update gets a bounded context of its own
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.devices.DeviceDisconnected(ctx, session.DeviceID, c); err != nil {
+		session.Client.logger.Error("Could not record device disconnection", "error", err)
+	}
+}
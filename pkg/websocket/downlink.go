@@ -0,0 +1,165 @@
+package websocket
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+)
+
+const (
+	// DownlinkCodecHeader carries the codec a device would like the answers in: pcm16, the default,
+	// or opus. The relay answers the codec it picked in the same header of the upgrade response, as
+	// it falls back to pcm16 without an Opus encoder. Devices that cannot set headers use the
+	// downlink_codec query parameter.
+	DownlinkCodecHeader = "X-Pixa-Downlink-Codec"
+
+	// downlinkChunk is the size of the chunks answers are sent to the device in as 16 bit PCM
+	downlinkChunk = 4096
+)
+
+// WithOpusEncoder lets devices take the answers as Opus, much lighter than 16 bit PCM, and
+// supervisors listen to live sessions as Ogg/Opus rather than WAV. The relay does not bundle an
+// Opus encoder, so that it builds without cgo; they usually wrap libopus.
+func WithOpusEncoder(factory audio.EncoderFactory) Option {
+	return func(h *Handler) {
+		h.opusEncoder = factory
+	}
+}
+
+// downlinkCodec returns the codec of the audio sent to the device and, for opus, its encoder.
+// Devices asking for a codec the relay cannot encode get pcm16.
+func (h *Handler) downlinkCodec(r *http.Request, sampleRate int) (string, *downlinkEncoder) {
+	codec := strings.ToLower(strings.TrimSpace(headerOrQuery(r, DownlinkCodecHeader, "downlink_codec")))
+	if codec == "" || codec == PCM16Codec {
+		return PCM16Codec, nil
+	}
+	if codec != OpusCodec || h.opusEncoder == nil {
+		h.logger.Info("Sending answers as pcm16, the downlink codec is not supported", "remote_addr", r.RemoteAddr, "downlink_codec", codec)
+		return PCM16Codec, nil
+	}
+	enc := &downlinkEncoder{factory: h.opusEncoder}
+	if err := enc.setRate(sampleRate); err != nil {
+		h.logger.Warn("Sending answers as pcm16, could not set up the Opus encoder", "remote_addr", r.RemoteAddr, "error", err)
+		return PCM16Codec, nil
+	}
+	return OpusCodec, enc
+}
+
+// downlinkSource is what the audio sent to a device is: an answer, or a clip the relay plays
+type downlinkSource int
+
+const (
+	sourceAnswer downlinkSource = iota
+	sourceFiller
+	sourceAnnouncement
+	sourceAudioTest
+)
+
+// downlinkEncoder encodes the audio sent to a device to 20ms Opus packets. Audio arrives in
+// chunks of any length, so what is left over of a chunk is held and encoded with the next one,
+// and the end of an answer or clip is padded with silence to a whole packet.
+type downlinkEncoder struct {
+	factory audio.EncoderFactory
+
+	mu   sync.Mutex
+	enc  audio.Encoder
+	rate int
+	// pending is the audio held back, of source
+	pending []byte
+	source  downlinkSource
+}
+
+// setRate sets up a new encoder for audio at sampleRate, dropping the audio held for the old one;
+// the mutex must be held, or the encoder not yet shared
+func (e *downlinkEncoder) setRate(sampleRate int) error {
+	enc, err := e.factory(sampleRate, 1)
+	if err != nil {
+		return err
+	}
+	e.enc, e.rate, e.pending = enc, sampleRate, nil
+	return nil
+}
+
+// encode encodes mono 16 bit PCM of source at sampleRate to the packets it completes. With end
+// set, the audio left over is padded with silence and encoded as well. The audio held of another
+// source, such as an answer a filler started playing over, is padded and encoded first, so that
+// it is not sent in the packets of this one.
+func (e *downlinkEncoder) encode(pcm []byte, sampleRate int, source downlinkSource, end bool) ([][]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if sampleRate != e.rate {
+		if err := e.setRate(sampleRate); err != nil {
+			return nil, err
+		}
+	}
+	frame := sampleRate / 50 * 2
+	if source != e.source {
+		e.pending = padPacket(e.pending, frame)
+		e.source = source
+	}
+	e.pending = append(e.pending, pcm...)
+	if end {
+		e.pending = padPacket(e.pending, frame)
+	}
+	var packets [][]byte
+	for len(e.pending) >= frame {
+		packet, err := e.enc.Encode(e.pending[:frame])
+		e.pending = e.pending[frame:]
+		if err != nil {
+			return packets, err
+		}
+		packets = append(packets, packet)
+	}
+	e.pending = append([]byte(nil), e.pending...)
+	return packets, nil
+}
+
+// padPacket pads pcm with silence to a whole number of packets of frame bytes
+func padPacket(pcm []byte, frame int) []byte {
+	if len(pcm)%frame == 0 {
+		return pcm
+	}
+	return append(pcm, make([]byte, frame-len(pcm)%frame)...)
+}
+
+// reset drops the audio held back, as the answer it is from was interrupted
+func (e *downlinkEncoder) reset() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending = nil
+}
+
+// answerResampler converts the answers of a session to the downlink rate. Answers arrive in chunks
+// of any length, so it keeps one resampler from chunk to chunk, carrying its position and filter
+// history so that the chunks join without clicks or drift.
+type answerResampler struct {
+	mu sync.Mutex
+	r  *audio.Resampler
+}
+
+// resample converts the next chunk of an answer to the rate to at quality q. A chunk at another
+// rate than the chunks before it gets a new resampler.
+func (r *answerResampler) resample(a audio.Audio, to int, q audio.ResampleQuality) audio.Audio {
+	if a.GetSampleRate() == to {
+		return a
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if from, rate := r.r.Rates(); from != a.GetSampleRate() || rate != to {
+		r.r = audio.NewResamplerQuality(q, a.GetSampleRate(), to, a.GetChannels())
+	}
+	return r.r.Resample(a)
+}
+
+// reset drops the state carried over, as the answer it is from was interrupted or the downlink
+// rate changed
+func (r *answerResampler) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.r = nil
+}
@@ -0,0 +1,145 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	pixaerrors "github.com/pixaverse-studios/websocket-server/pkg/errors"
+)
+
+// drainPoll is how often draining sessions are checked for the end of their answer
+const drainPoll = 50 * time.Millisecond
+
+// errRestarting is what sessions are closed for at shutdown
+var errRestarting = pixaerrors.New(pixaerrors.Restarting, "server restarting")
+
+// DrainReport summarizes how the sessions of a handler were drained at shutdown, so deploy
+// tooling can tell a clean drain from one that cut conversations off
+type DrainReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	// Sessions were active when the drain started
+	Sessions int `json:"sessions"`
+	// SessionsDrained ended once their answer had been played, or were closed by their device
+	SessionsDrained int `json:"sessions_drained"`
+	// SessionsForceClosed were still answering at the drain timeout and were cut off
+	SessionsForceClosed int `json:"sessions_force_closed"`
+	// SessionsUnfinished had not shut down when the drain gave up
+	SessionsUnfinished int `json:"sessions_unfinished"`
+	// BytesFlushed is what was written to devices while draining, mostly buffered response audio
+	BytesFlushed int64 `json:"bytes_flushed"`
+	// RecordsFinalized counts the session records saved while draining
+	RecordsFinalized int `json:"records_finalized"`
+	// Clean is set when every session finished without being cut off
+	Clean bool `json:"clean"`
+}
+
+// Drain ends the handler's sessions for a shutdown. New connections are refused; each active
+// session finishes the answer being given and the audio buffered for its device, up to timeout,
+// and is then closed with a service restart close code so the device reconnects elsewhere. Drain
+// returns once every session has shut down and saved its record, or when ctx is done.
+func (h *Handler) Drain(ctx context.Context, timeout time.Duration) DrainReport {
+	report := DrainReport{StartedAt: h.clock.Now()}
+	h.draining.Store(true)
+	flushedBefore := h.bytesOut.Load()
+	recordsBefore := h.recordsSaved.Load()
+
+	sessions := h.sessions.List()
+	report.Sessions = len(sessions)
+	drainCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, s := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.drainSession(drainCtx, s)
+		}()
+	}
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = h.clock.After(timeout)
+	}
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-deadline:
+	case <-ctx.Done():
+	}
+	cancel()
+	<-drained
+
+	for _, s := range h.sessions.List() {
+		if s.teardownAt.Load() != 0 {
+			continue
+		}
+		s.Client.logger.Warn("Session still answering at the end of the drain, closing it")
+		report.SessionsForceClosed++
+		s.Close()
+		s.Client.abortFor(errRestarting)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		h.active.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		report.SessionsUnfinished = h.sessions.Count()
+	}
+	report.SessionsDrained = max(report.Sessions-report.SessionsForceClosed-report.SessionsUnfinished, 0)
+	report.BytesFlushed = h.bytesOut.Load() - flushedBefore
+	report.RecordsFinalized = int(h.recordsSaved.Load() - recordsBefore)
+	report.DurationMs = h.clock.Now().Sub(report.StartedAt).Milliseconds()
+	report.Clean = report.SessionsForceClosed == 0 && report.SessionsUnfinished == 0
+	return report
+}
+
+// drainSession closes a session once no answer is being given and its downlink buffer is empty,
+// or leaves it to be force-closed when ctx is done first
+func (h *Handler) drainSession(ctx context.Context, s *Session) {
+	ticker := h.clock.NewTicker(drainPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.answerDone():
+			if s.teardownAt.Load() != 0 {
+				return
+			}
+			if s.MemoryUsage().Pools[MemoryDownlink].UsedBytes == 0 {
+				s.Client.logger.Info("Closing session for shutdown")
+				s.Client.closeFor(errRestarting)
+				s.Close()
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// Draining reports whether the handler drains its sessions and refuses new connections
+func (h *Handler) Draining() bool {
+	return h.draining.Load()
+}
+
+// refuseDraining rejects connections arriving while the handler drains, reporting whether it did
+func (h *Handler) refuseDraining(w http.ResponseWriter) bool {
+	if !h.draining.Load() {
+		return false
+	}
+	http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+	return true
+}
@@ -0,0 +1,99 @@
+package websocket
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+const (
+	// DuplexHeader carries whether the device can hear the user while it plays the assistant:
+	// "full" for devices that let the user talk over the assistant, "half" for devices that
+	// cannot, whose audio the relay mutes while the assistant speaks. Devices that cannot set
+	// headers use the duplex query parameter; without either, websocket.duplex applies.
+	DuplexHeader = "X-Pixa-Duplex"
+
+	// Duplex modes
+	FullDuplex = "full"
+	HalfDuplex = "half"
+)
+
+// halfDuplex mutes the audio of a half-duplex device while the assistant speaks, so the user
+// cannot talk over it and the device's speaker is not heard by the provider. The device is taken
+// to play the response audio as it is sent, back to back; the uplink is heard again tail after the
+// device has played all of it. A nil *halfDuplex mutes nothing, as for full-duplex devices.
+type halfDuplex struct {
+	tail time.Duration
+
+	mu sync.Mutex
+	// playhead is where the device's playback of the response audio sent so far ends
+	playhead time.Time
+}
+
+// duplexMode returns the duplex mode a device connected with, websocket.duplex if it named none
+// or an unknown one
+func duplexMode(cfg *config.Config, r *http.Request) string {
+	switch mode := strings.ToLower(strings.TrimSpace(headerOrQuery(r, DuplexHeader, "duplex"))); mode {
+	case FullDuplex, HalfDuplex:
+		return mode
+	}
+	return cfg.Websocket.Duplex
+}
+
+// newHalfDuplex returns the muting of a session in mode, or nil for full duplex
+func newHalfDuplex(cfg *config.Config, mode string) *halfDuplex {
+	if mode != HalfDuplex {
+		return nil
+	}
+	tail, _ := time.ParseDuration(cfg.Websocket.HalfDuplexTail)
+	return &halfDuplex{tail: tail}
+}
+
+// downlink records response audio of duration d sent to the device at now
+func (h *halfDuplex) downlink(now time.Time, d time.Duration) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.playhead.Before(now) {
+		h.playhead = now
+	}
+	h.playhead = h.playhead.Add(d)
+}
+
+// stopPlayback hears the device again once the response audio is cut off
+func (h *halfDuplex) stopPlayback(now time.Time) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.playhead = now.Add(-h.tail)
+	h.mu.Unlock()
+}
+
+// muted reports whether the device's audio is muted at now
+func (h *halfDuplex) muted(now time.Time) bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return now.Before(h.playhead.Add(h.tail))
+}
+
+// muteHalfDuplex replaces an audio frame from a half-duplex device with silence while the assistant
+// speaks. The frame is kept as silence rather than dropped, so the provider's input stays in step
+// with the device's.
+func (h *Handler) muteHalfDuplex(session *Session, pcm []byte) []byte {
+	if !session.duplex.muted(session.clock.Now()) {
+		return pcm
+	}
+	if rate, channels := session.sampleRate, h.config.Audio.Channels; rate > 0 && channels > 0 {
+		h.metrics.halfDuplexMuted(time.Duration(len(pcm)/2/channels) * time.Second / time.Duration(rate))
+	}
+	return make([]byte, len(pcm))
+}
@@ -0,0 +1,273 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+const (
+	// echoBin is the resolution of the loudness envelopes correlated to detect echo loops
+	echoBin = 20 * time.Millisecond
+	// echoCheckEvery is how often the envelopes are correlated
+	echoCheckEvery = 500 * time.Millisecond
+	// echoHorizon is how far ahead of the device's playback response audio is tracked; audio the
+	// device buffers for longer is not correlated
+	echoHorizon = 10 * time.Second
+	// echoSilence is the RMS, in 16 bit sample units, under which a bin of response audio is
+	// taken as silent
+	echoSilence = 100
+)
+
+// envelope is a ring of the loudness of an audio stream, in echoBin bins along the session clock
+type envelope struct {
+	sum   []float64
+	count []int
+	// index is the bin each slot holds, so slots reused by later bins read as empty
+	index []int64
+}
+
+func newEnvelope(bins int) envelope {
+	return envelope{sum: make([]float64, bins), count: make([]int, bins), index: make([]int64, bins)}
+}
+
+func (e *envelope) slot(bin int64) int {
+	n := int64(len(e.index))
+	return int((bin%n + n) % n)
+}
+
+func (e *envelope) add(bin int64, sumSquares float64, samples int) {
+	i := e.slot(bin)
+	if e.index[i] != bin || e.count[i] == 0 {
+		e.index[i], e.sum[i], e.count[i] = bin, 0, 0
+	}
+	e.sum[i] += sumSquares
+	e.count[i] += samples
+}
+
+// rms returns the loudness of a bin, 0 if nothing was heard in it
+func (e *envelope) rms(bin int64) float64 {
+	i := e.slot(bin)
+	if e.index[i] != bin || e.count[i] == 0 {
+		return 0
+	}
+	return math.Sqrt(e.sum[i] / float64(e.count[i]))
+}
+
+// clearAfter forgets the bins after bin
+func (e *envelope) clearAfter(bin int64) {
+	for i, b := range e.index {
+		if b > bin {
+			e.count[i] = 0
+		}
+	}
+}
+
+// echoLoop is a detected echo of the response audio in the audio from the device
+type echoLoop struct {
+	correlation float64
+	delay       time.Duration
+}
+
+// echoDetector detects devices whose microphone picks up the response audio from their speaker,
+// which makes the assistant answer itself. The loudness of the audio from the device is correlated
+// with that of the response audio as the device plays it, at delays up to maxDelay. A nil
+// *echoDetector detects nothing.
+type echoDetector struct {
+	threshold float64
+	window    time.Duration
+	maxDelay  time.Duration
+	muteFor   time.Duration
+
+	mu     sync.Mutex
+	origin time.Time
+	down   envelope
+	up     envelope
+	// playhead is where the device's playback of the response audio sent so far ends
+	playhead time.Time
+	// checked is when the envelopes were last correlated, quietUntil when the next loop may be
+	// reported and mutedUntil when the uplink is heard again
+	checked    time.Time
+	quietUntil time.Time
+	mutedUntil time.Time
+}
+
+// newEchoDetector returns a detector for a session started at now, or nil if detection is disabled
+func newEchoDetector(cfg config.EchoConfig, now time.Time) *echoDetector {
+	if !cfg.Enabled {
+		return nil
+	}
+	window, _ := time.ParseDuration(cfg.Window)
+	maxDelay, _ := time.ParseDuration(cfg.MaxDelay)
+	muteFor, _ := time.ParseDuration(cfg.MuteFor)
+	bins := int((window + maxDelay + echoCheckEvery + echoHorizon) / echoBin)
+	return &echoDetector{
+		threshold: cfg.Threshold,
+		window:    window,
+		maxDelay:  maxDelay,
+		muteFor:   muteFor,
+		origin:    now,
+		down:      newEnvelope(bins),
+		up:        newEnvelope(bins),
+		playhead:  now,
+		checked:   now,
+	}
+}
+
+// place adds 16 bit PCM audio starting at at to an envelope, returning how long it plays
+func (d *echoDetector) place(e *envelope, at time.Time, pcm []byte, sampleRate, channels int) time.Duration {
+	if sampleRate <= 0 || channels <= 0 {
+		return 0
+	}
+	perBin := max(sampleRate*int(echoBin/time.Millisecond)/1000, 1) * channels
+	samples := len(pcm) / 2
+	for i := 0; i < samples; i += perBin {
+		var sum float64
+		n := min(perBin, samples-i)
+		for j := i; j < i+n; j++ {
+			s := float64(int16(binary.LittleEndian.Uint16(pcm[2*j:])))
+			sum += s * s
+		}
+		offset := time.Duration(i/channels) * time.Second / time.Duration(sampleRate)
+		e.add(int64(at.Add(offset).Sub(d.origin)/echoBin), sum, n)
+	}
+	return time.Duration(samples/channels) * time.Second / time.Duration(sampleRate)
+}
+
+// downlink records response audio sent to the device at now. The device plays it once what was
+// sent before has played.
+func (d *echoDetector) downlink(now time.Time, pcm []byte, sampleRate int) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	start := now
+	if d.playhead.After(now) {
+		start = d.playhead
+	}
+	d.playhead = start.Add(d.place(&d.down, start, pcm, sampleRate, 1))
+}
+
+// stopPlayback forgets the response audio the device has not played yet, when it is interrupted
+func (d *echoDetector) stopPlayback(now time.Time) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.down.clearAfter(int64(now.Sub(d.origin) / echoBin))
+	d.playhead = now
+}
+
+// uplink records audio received from the device at now, captured over the time before. It returns
+// the loop if one is detected, and whether the audio is to be muted.
+func (d *echoDetector) uplink(now time.Time, pcm []byte, sampleRate, channels int) (*echoLoop, bool) {
+	if d == nil {
+		return nil, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	captured := now
+	if sampleRate > 0 && channels > 0 {
+		captured = now.Add(-time.Duration(len(pcm)/2/channels) * time.Second / time.Duration(sampleRate))
+	}
+	d.place(&d.up, captured, pcm, sampleRate, channels)
+
+	if now.Sub(d.checked) < echoCheckEvery || now.Before(d.quietUntil) || now.Sub(d.origin) < d.window {
+		return nil, now.Before(d.mutedUntil)
+	}
+	d.checked = now
+	loop := d.correlate(int64(now.Sub(d.origin) / echoBin))
+	if loop == nil || loop.correlation < d.threshold {
+		return nil, now.Before(d.mutedUntil)
+	}
+	d.quietUntil = now.Add(d.window)
+	if d.muteFor > 0 {
+		d.mutedUntil = now.Add(d.muteFor)
+	}
+	return loop, d.muteFor > 0
+}
+
+// correlate finds the delay at which the loudness of the uplink over the window ending before bin
+// end best follows the response audio, and how closely. It returns nil if the response audio was
+// mostly silent or either side did not change.
+func (d *echoDetector) correlate(end int64) *echoLoop {
+	n := int64(d.window / echoBin)
+	up := make([]float64, n)
+	for i := range up {
+		up[i] = d.up.rms(end - n + int64(i))
+	}
+	var best *echoLoop
+	down := make([]float64, n)
+	for lag := int64(0); lag <= int64(d.maxDelay/echoBin); lag++ {
+		audible := 0
+		for i := range down {
+			down[i] = d.down.rms(end - n + int64(i) - lag)
+			if down[i] >= echoSilence {
+				audible++
+			}
+		}
+		if int64(audible) < n/2 {
+			continue
+		}
+		r, ok := pearson(up, down)
+		if ok && (best == nil || r > best.correlation) {
+			best = &echoLoop{correlation: r, delay: time.Duration(lag) * echoBin}
+		}
+	}
+	return best
+}
+
+// pearson returns the correlation coefficient of x and y, which fails if either is constant
+func pearson(x, y []float64) (float64, bool) {
+	var mx, my float64
+	for i := range x {
+		mx += x[i]
+		my += y[i]
+	}
+	mx /= float64(len(x))
+	my /= float64(len(y))
+	var cov, vx, vy float64
+	for i := range x {
+		dx, dy := x[i]-mx, y[i]-my
+		cov += dx * dy
+		vx += dx * dx
+		vy += dy * dy
+	}
+	if vx == 0 || vy == 0 {
+		return 0, false
+	}
+	return cov / math.Sqrt(vx*vy), true
+}
+
+// checkEcho looks for the response audio in an audio frame from the device. Once a loop is
+// detected the device is told, and the frame is replaced with silence while the uplink is muted.
+func (h *Handler) checkEcho(session *Session, pcm []byte) []byte {
+	loop, muted := session.echo.uplink(session.clock.Now(), pcm, session.sampleRate, h.config.Audio.Channels)
+	if loop != nil {
+		mutedFor := time.Duration(0)
+		if muted {
+			mutedFor = session.echo.muteFor
+		}
+		h.metrics.echoLoop()
+		session.Client.logger.Warn("Device microphone picks up the assistant, relay loop detected",
+			"correlation", loop.correlation, "delay", loop.delay, "muted_for", mutedFor)
+		err := session.Client.Send(echoDetectedEvent{
+			Type:               EchoDetectedEvent,
+			CorrelationPercent: int(math.Round(loop.correlation * 100)),
+			DelayMs:            loop.delay.Milliseconds(),
+			MutedMs:            mutedFor.Milliseconds(),
+		})
+		if err != nil {
+			session.Client.logger.Error("Could not send echo detection to client", "error", err)
+		}
+	}
+	if muted {
+		return make([]byte, len(pcm))
+	}
+	return pcm
+}
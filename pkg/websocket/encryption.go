@@ -0,0 +1,131 @@
+package websocket
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted audio frames are laid out as an 8 byte big endian sequence number, a 24 byte random
+// nonce and the XChaCha20-Poly1305 sealed audio. The sequence number is authenticated as additional
+// data and must increase from frame to frame, so frames cannot be replayed or reordered.
+const (
+	frameSeqSize    = 8
+	frameHeaderSize = frameSeqSize + chacha20poly1305.NonceSizeX
+	encryptionInfo  = "pixa audio frames v1"
+)
+
+var errFrameReplayed = errors.New("encrypted frame replayed or out of order")
+
+// frameCipher encrypts the audio frames of a session once the device and the relay have agreed on
+// keys during hello. Each direction has a key of its own.
+type frameCipher struct {
+	uplink   cipher.AEAD
+	downlink cipher.AEAD
+
+	mu      sync.Mutex
+	sendSeq uint64
+	recvSeq uint64
+}
+
+// handshake answers the device's hello: it derives the session's frame keys from an ephemeral X25519
+// exchange with the device's public key and returns the relay's public key along with, when a
+// signing key is set, an Ed25519 signature the device can verify the relay with
+func handshake(sessionID string, devicePublic []byte, signingKey ed25519.PrivateKey) (*frameCipher, helloResponse, error) {
+	curve := ecdh.X25519()
+	peer, err := curve.NewPublicKey(devicePublic)
+	if err != nil {
+		return nil, helloResponse{}, err
+	}
+	private, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, helloResponse{}, err
+	}
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, helloResponse{}, err
+	}
+
+	c, err := newFrameCipher(shared, sessionID)
+	if err != nil {
+		return nil, helloResponse{}, err
+	}
+	resp := helloResponse{relayPublic: private.PublicKey().Bytes()}
+	if signingKey != nil {
+		resp.signature = ed25519.Sign(signingKey, helloTranscript(sessionID, devicePublic, resp.relayPublic))
+	}
+	return c, resp, nil
+}
+
+// helloResponse is the relay's half of the hello
+type helloResponse struct {
+	relayPublic []byte
+	signature   []byte
+}
+
+// helloTranscript is what the relay signs: the session and both public keys
+func helloTranscript(sessionID string, devicePublic, relayPublic []byte) []byte {
+	t := make([]byte, 0, len(sessionID)+len(devicePublic)+len(relayPublic))
+	t = append(t, sessionID...)
+	t = append(t, devicePublic...)
+	return append(t, relayPublic...)
+}
+
+func newFrameCipher(shared []byte, sessionID string) (*frameCipher, error) {
+	kdf := hkdf.New(sha256.New, shared, []byte(sessionID), []byte(encryptionInfo))
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(kdf, keys); err != nil {
+		return nil, err
+	}
+	uplink, err := chacha20poly1305.NewX(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, err
+	}
+	downlink, err := chacha20poly1305.NewX(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return nil, err
+	}
+	return &frameCipher{uplink: uplink, downlink: downlink}, nil
+}
+
+// seal encrypts a frame sent to the device
+func (c *frameCipher) seal(plain []byte) []byte {
+	c.mu.Lock()
+	c.sendSeq++
+	seq := c.sendSeq
+	c.mu.Unlock()
+
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(plain)+c.downlink.Overhead())
+	binary.BigEndian.PutUint64(frame, seq)
+	rand.Read(frame[frameSeqSize:frameHeaderSize])
+	return c.downlink.Seal(frame, frame[frameSeqSize:frameHeaderSize], plain, frame[:frameSeqSize])
+}
+
+// open decrypts a frame received from the device
+func (c *frameCipher) open(frame []byte) ([]byte, error) {
+	if len(frame) < frameHeaderSize+c.uplink.Overhead() {
+		return nil, errors.New("encrypted frame too short")
+	}
+	plain, err := c.uplink.Open(nil, frame[frameSeqSize:frameHeaderSize], frame[frameHeaderSize:], frame[:frameSeqSize])
+	if err != nil {
+		return nil, err
+	}
+
+	seq := binary.BigEndian.Uint64(frame)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq <= c.recvSeq {
+		return nil, errFrameReplayed
+	}
+	c.recvSeq = seq
+	return plain, nil
+}
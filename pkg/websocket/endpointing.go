@@ -0,0 +1,106 @@
+package websocket
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// DeviceProfileHeader carries the device profile the device asks for, one of device_profiles,
+// such as a profile for kiosks whose users speak slowly. Devices that cannot set headers use the
+// device_profile query parameter; devices that ask for none, or for an unknown one, get the
+// profile of their tenant.
+const DeviceProfileHeader = "X-Pixa-Device-Profile"
+
+// utteranceCapMargin is how much longer than the silence the provider waits for the uplink is
+// muted when a turn is cut, so the provider's endpointing surely ends it
+const utteranceCapMargin = 200 * time.Millisecond
+
+// utteranceCap ends user turns that run longer than the max_utterance of the device's profile.
+// The provider ends turns on silence, so once the user has spoken for too long the uplink is
+// replaced with silence for as long as the provider waits before it ends a turn, as push-to-talk
+// does when the button is released. A nil *utteranceCap leaves turns unbounded.
+type utteranceCap struct {
+	max     time.Duration
+	silence time.Duration
+
+	mu sync.Mutex
+	// speakingSince is when the provider heard the user start speaking, zero while the user is silent
+	speakingSince time.Time
+	mutedUntil    time.Time
+}
+
+// deviceProfile returns the name of the profile of the session's device: the one it asked for, or
+// the one of its tenant
+func (h *Handler) deviceProfile(session *Session, r *http.Request) string {
+	requested := strings.TrimSpace(headerOrQuery(r, DeviceProfileHeader, "device_profile"))
+	profile := h.config.DeviceProfileFor(session.TenantID, requested)
+	if requested != "" && !strings.EqualFold(requested, profile) {
+		session.Client.logger.Warn("Ignoring unknown device profile", "device_profile", requested)
+	}
+	return profile
+}
+
+// newUtteranceCap returns the turn limit of a device with the given endpointing settings, or nil
+// if its turns are unbounded
+func newUtteranceCap(e config.EndpointingConfig) *utteranceCap {
+	limit, _ := time.ParseDuration(e.MaxUtterance)
+	if limit <= 0 {
+		return nil
+	}
+	silence, _ := time.ParseDuration(e.SilenceDuration)
+	return &utteranceCap{max: limit, silence: silence + utteranceCapMargin}
+}
+
+// started records that the provider heard the user start speaking at now
+func (u *utteranceCap) started(now time.Time) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	u.speakingSince = now
+	u.mu.Unlock()
+}
+
+// stopped records that the user's turn ended
+func (u *utteranceCap) stopped() {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	u.speakingSince = time.Time{}
+	u.mu.Unlock()
+}
+
+// mute reports whether the uplink is muted at now to end the user's turn, and whether the turn was
+// cut just now
+func (u *utteranceCap) mute(now time.Time) (muted, cut bool) {
+	if u == nil {
+		return false, false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.speakingSince.IsZero() && now.Sub(u.speakingSince) >= u.max {
+		u.speakingSince = time.Time{}
+		u.mutedUntil = now.Add(u.silence)
+		cut = true
+	}
+	return now.Before(u.mutedUntil), cut
+}
+
+// capUtterance replaces an audio frame from the device with silence while a turn that ran past
+// max_utterance is being ended
+func (h *Handler) capUtterance(session *Session, pcm []byte) []byte {
+	muted, cut := session.utterance.mute(session.clock.Now())
+	if cut {
+		h.metrics.utteranceCut()
+		session.Client.logger.Info("Ending user turn that ran past max_utterance", "max_utterance", session.utterance.max, "device_profile", session.deviceProfile)
+	}
+	if !muted {
+		return pcm
+	}
+	return make([]byte, len(pcm))
+}
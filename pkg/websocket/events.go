@@ -0,0 +1,135 @@
+package websocket
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pixaverse-studios/websocket-server/internal/utils"
+	"github.com/pixaverse-studios/websocket-server/pkg/ai"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+// handleAIEvent reacts to important events from the AI model
+func (h *Handler) handleAIEvent(ctx context.Context, session *Session, aiClient ai.AIClient, ab *utils.BufferSizeController, e ai.Event) {
+	switch e.Type {
+	case ai.ResponseAudioDoneEventType:
+		session.stopFiller()
+		h.cacheAnswer(session, e.ItemID, false, "")
+		ab.Flush()
+		h.sendStatus(session)
+		session.speech.audioDone(e.ItemID, session.Cursor.ReceivedMs(e.ItemID))
+		h.sendSpeechEstimate(session)
+
+	case ai.AudioTranscriptDeltaEventType:
+		session.speech.text(e.ItemID, e.Text)
+		h.sendSentences(ctx, session, session.sentences.write(e.ItemID, e.Text, session.Cursor.ReceivedMs(e.ItemID)))
+
+	case ai.InputTranscriptionCompletedType:
+		session.addTurn(store.UserRole, e.ItemID, e.Text)
+		h.answerTurn(ctx, session, aiClient, ab, e.Text)
+
+	case ai.AudioTranscriptDoneEventType:
+		// the last sentence goes first, so the turn is recorded with the timing of all its sentences
+		h.sendSentences(ctx, session, session.sentences.flush(e.ItemID, session.Cursor.ReceivedMs(e.ItemID)))
+		session.addTurn(store.AssistantRole, e.ItemID, e.Text)
+		session.speech.textDone(e.ItemID, e.Text)
+		h.cacheAnswer(session, e.ItemID, true, e.Text)
+		session.answerFinished()
+
+	case ai.FunctionCallEventType:
+		if e.Call != nil {
+			go h.runTool(ctx, session, aiClient, *e.Call)
+		}
+
+	case ai.SpeechStoppedEventType:
+		session.speechStopped(session.clock.Now())
+		session.verifySample.setSpeaking(false)
+		session.speaker.setSpeaking(false)
+		session.utterance.stopped()
+		session.heat.speechStoppedAt(session.clock.Now())
+		h.startFiller(ctx, session)
+
+	case ai.AudioBufferCommittedType:
+		session.Cursor.Commit()
+		h.sendStatus(session)
+
+	case ai.SpeechStartedEventType:
+		session.speechStarted(session.clock.Now())
+		session.verifySample.setSpeaking(true)
+		session.speaker.setSpeaking(true)
+		session.stopFiller()
+		// half-duplex devices are muted while the assistant speaks, there is no barge-in
+		if session.duplex.muted(session.clock.Now()) {
+			return
+		}
+		session.utterance.started(session.clock.Now())
+		// the user started speaking over the assistant, so cut the response where the device stopped playing it
+		itemID, audioEndMs, ok := session.Cursor.Interrupt()
+		if !ok {
+			return
+		}
+		session.interruptions.Add(1)
+		session.answerFinished()
+		ab.Reset()
+		session.downlinkEnc.reset()
+		session.downlinkResampler.reset()
+		session.echo.stopPlayback(session.clock.Now())
+		session.aec.stopPlayback(session.clock.Now())
+		session.duplex.stopPlayback(session.clock.Now())
+		session.live.stopPlayback()
+		session.discardAnswer()
+		// cached answers are not in the provider's conversation as audio, there is nothing to cut
+		if !strings.HasPrefix(itemID, faqItemPrefix) {
+			if err := aiClient.Truncate(ctx, itemID, audioEndMs); err != nil {
+				session.Client.logger.Error("Could not truncate interrupted item", "item_id", itemID, "error", err)
+			}
+		}
+		err := session.Client.Send(responseInterruptedEvent{
+			Type:       ResponseInterruptedEvent,
+			ItemID:     itemID,
+			AudioEndMs: audioEndMs,
+		})
+		if err != nil {
+			session.Client.logger.Error("Could not send interruption to client", "error", err)
+		}
+		h.sendStatus(session)
+	}
+}
+
+// sendSentences sends completed transcript sentences to the device, through translation if the
+// device displays another language
+func (h *Handler) sendSentences(ctx context.Context, session *Session, events []sentenceCompletedEvent) {
+	if len(events) == 0 {
+		return
+	}
+	session.noteSentences(events)
+	if session.captions != nil {
+		select {
+		case session.captions <- events:
+		case <-ctx.Done():
+		}
+		return
+	}
+	h.writeSentences(session, events)
+}
+
+func (h *Handler) writeSentences(session *Session, events []sentenceCompletedEvent) {
+	for _, e := range events {
+		if err := session.Client.Send(e); err != nil {
+			session.Client.logger.Error("Could not send sentence to client", "error", err)
+		}
+	}
+}
+
+// sendStatus sends the session's audio cursor to the device
+func (h *Handler) sendStatus(session *Session) {
+	err := session.Client.Send(sessionStatusEvent{
+		Type:          SessionStatusEvent,
+		SessionID:     session.ID,
+		CorrelationID: session.CorrelationID,
+		Cursor:        session.Cursor.Status(),
+	})
+	if err != nil {
+		session.Client.logger.Error("Could not send status to client", "error", err)
+	}
+}
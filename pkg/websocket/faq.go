@@ -0,0 +1,166 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/utils"
+	"github.com/pixaverse-studios/websocket-server/pkg/ai"
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/faq"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+// faqItemPrefix starts the item IDs of cached answers, which the provider does not know about
+const faqItemPrefix = "faq_"
+
+// faqRecording collects the model's answer to a question that missed the FAQ cache
+type faqRecording struct {
+	question  string
+	itemID    string
+	text      string
+	pcm       []byte
+	rate      int
+	audioDone bool
+	textDone  bool
+}
+
+// answerTurn answers the user's finalized question in FAQ mode: a cached answer is played and
+// added to the conversation, otherwise the model is asked and its answer recorded for next time
+func (h *Handler) answerTurn(ctx context.Context, session *Session, aiClient ai.AIClient, ab *utils.BufferSizeController, question string) {
+	responder, ok := aiClient.(ai.Responder)
+	if h.faq == nil || !ok {
+		return
+	}
+
+	if answer, hit := h.faq.Lookup(session.TenantID, question); hit {
+		h.metrics.faqLookup(true)
+		session.Client.logger.Debug("Answering from the FAQ cache", "question", question, "cached_question", answer.Question)
+		h.playAnswer(ctx, session, ab, answer)
+		if err := responder.AddAnswer(ctx, answer.Text); err != nil {
+			session.Client.logger.Error("Could not add cached answer to the conversation", "error", err)
+		}
+		return
+	}
+
+	h.metrics.faqLookup(false)
+	session.faqMu.Lock()
+	session.faqRecording = &faqRecording{question: question}
+	session.faqMu.Unlock()
+	if err := responder.CreateResponse(ctx); err != nil {
+		session.Client.logger.Error("Could not request a response", "error", err)
+	}
+}
+
+// playAnswer relays a cached answer to the device as if the model had just given it
+func (h *Handler) playAnswer(ctx context.Context, session *Session, ab *utils.BufferSizeController, answer faq.Answer) {
+	session.faqMu.Lock()
+	session.faqAnswers++
+	itemID := fmt.Sprintf("%s%d", faqItemPrefix, session.faqAnswers)
+	session.faqMu.Unlock()
+
+	pcm := answer.Audio
+	if rate := session.DownlinkSampleRate(); answer.SampleRate != rate {
+		a := session.downlinkResampler.resample(audio.FromPCM16(pcm, answer.SampleRate, 1), rate, h.resampleQuality)
+		pcm = a.AsPCM16()
+	}
+	durationMs := int64(len(pcm)/2) * 1000 / int64(session.DownlinkSampleRate())
+
+	session.itemAudioStarted(itemID, session.clock.Now())
+	h.sendSentences(ctx, session, session.sentences.write(itemID, answer.Text, 0))
+	h.sendSentences(ctx, session, session.sentences.flush(itemID, durationMs))
+	session.addTurn(store.AssistantRole, itemID, answer.Text)
+	session.speech.textDone(itemID, answer.Text)
+	session.speech.audioDone(itemID, durationMs)
+
+	session.Cursor.Receive(itemID)
+	go func() {
+		for len(pcm) > 0 && ctx.Err() == nil {
+			n := min(len(pcm), 4096)
+			// the user may interrupt the answer like any other response
+			if !session.Cursor.Receive(itemID) || !h.reserveDownlink(session, ab, n) {
+				return
+			}
+			session.Cursor.Received(n / 2)
+			if err := ab.Write(pcm[:n]); err != nil {
+				session.Client.logger.Error("Cannot write to BufferSizeController buffer", "error", err)
+			}
+			session.memory.set(MemoryDownlink, int64(ab.Len()))
+			pcm = pcm[n:]
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		ab.Flush()
+		h.sendStatus(session)
+	}()
+}
+
+// recordAnswerAudio adds response audio at rate to the answer being recorded. Answers longer than
+// maxAnswer are not cached.
+func (s *Session) recordAnswerAudio(itemID string, pcm []byte, rate int, maxAnswer time.Duration) {
+	s.faqMu.Lock()
+	defer s.faqMu.Unlock()
+	r := s.faqRecording
+	if r == nil {
+		return
+	}
+	if r.itemID == "" {
+		r.itemID, r.rate = itemID, rate
+	}
+	if r.itemID != itemID || r.rate != rate {
+		// another item or a downgraded link, the answer would not be clean
+		s.faqRecording = nil
+		return
+	}
+	if time.Duration(len(r.pcm)+len(pcm))*time.Second/time.Duration(2*rate) > maxAnswer {
+		s.faqRecording = nil
+		return
+	}
+	r.pcm = append(r.pcm, pcm...)
+}
+
+// finishAnswer records that the answer's audio or its transcript is complete, text being the
+// transcript. It returns the recording once both are.
+func (s *Session) finishAnswer(itemID string, transcript bool, text string) *faqRecording {
+	s.faqMu.Lock()
+	defer s.faqMu.Unlock()
+	r := s.faqRecording
+	if r != nil && r.itemID == "" {
+		r.itemID = itemID
+	}
+	if r == nil || r.itemID != itemID {
+		return nil
+	}
+	if transcript {
+		r.text, r.textDone = text, true
+	} else {
+		r.audioDone = true
+	}
+	if !r.audioDone || !r.textDone {
+		return nil
+	}
+	s.faqRecording = nil
+	return r
+}
+
+// discardAnswer drops the answer being recorded, when the user interrupts it
+func (s *Session) discardAnswer() {
+	s.faqMu.Lock()
+	s.faqRecording = nil
+	s.faqMu.Unlock()
+}
+
+// cacheAnswer stores a completely recorded answer
+func (h *Handler) cacheAnswer(session *Session, itemID string, transcript bool, text string) {
+	if h.faq == nil {
+		return
+	}
+	r := session.finishAnswer(itemID, transcript, text)
+	if r == nil || strings.TrimSpace(r.text) == "" || len(r.pcm) == 0 {
+		return
+	}
+	h.faq.Store(session.TenantID, r.question, faq.Answer{Text: r.text, Audio: r.pcm, SampleRate: r.rate})
+}
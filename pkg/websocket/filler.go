@@ -0,0 +1,81 @@
+package websocket
+
+import (
+	"context"
+	"time"
+)
+
+// fillerChunk is the length of each frame of filler audio written to the device
+const fillerChunk = 100 * time.Millisecond
+
+// startFiller plays the filler clip to the device, looped, from the filler delay after the user
+// stops speaking until the response starts
+func (h *Handler) startFiller(ctx context.Context, session *Session) {
+	cfg := h.config.Filler
+	if !cfg.Enabled || h.assets == nil {
+		return
+	}
+	pcm, err := h.assets.PCM16(cfg.Asset, session.DownlinkSampleRate())
+	if err != nil {
+		session.Client.logger.Error("Could not load filler audio", "asset", cfg.Asset, "error", err)
+		return
+	}
+	if len(pcm) == 0 {
+		return
+	}
+	delay, _ := time.ParseDuration(cfg.Delay)
+	maxDuration, _ := time.ParseDuration(cfg.MaxDuration)
+
+	ctx, cancel := context.WithCancel(ctx)
+	session.fillerMu.Lock()
+	if session.cancelFiller != nil {
+		session.cancelFiller()
+	}
+	session.cancelFiller = cancel
+	session.fillerMu.Unlock()
+
+	go h.playFiller(ctx, session, pcm, delay, maxDuration)
+}
+
+// stopFiller stops the filler if it is playing
+func (s *Session) stopFiller() {
+	s.fillerMu.Lock()
+	defer s.fillerMu.Unlock()
+	if s.cancelFiller != nil {
+		s.cancelFiller()
+		s.cancelFiller = nil
+	}
+}
+
+// playFiller writes the filler in real time until ctx is done or it has played for maxDuration.
+// Filler audio bypasses the audio cursor, so it does not shift where interrupted responses are cut.
+func (h *Handler) playFiller(ctx context.Context, session *Session, pcm []byte, delay, maxDuration time.Duration) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-session.clock.After(delay):
+	}
+	session.Client.logger.Debug("Playing thinking filler")
+
+	frameBytes := int(fillerChunk*time.Duration(session.DownlinkSampleRate())/time.Second) * 2
+	ticker := session.clock.NewTicker(fillerChunk)
+	defer ticker.Stop()
+	pos := 0
+	for played := time.Duration(0); played < maxDuration; played += fillerChunk {
+		end := min(pos+frameBytes, len(pcm))
+		if ctx.Err() != nil {
+			return
+		}
+		if _, err := h.writeAudio(session, pcm[pos:end], sourceFiller, played+fillerChunk >= maxDuration); err != nil {
+			session.Client.logger.Error("Could not write filler audio to client", "error", err)
+			return
+		}
+		pos = end % len(pcm)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+// FrameFormatHeader carries the format of the binary frames the device sends: raw, the default,
+// frames of audio alone, or 1, frames that start with a version 1 frame header. Devices that
+// cannot set headers use the frame_format query parameter.
+const FrameFormatHeader = "X-Pixa-Frame-Format"
+
+// FrameHeaderSize is the length of the version 1 frame header. Its fields are big endian:
+//
+//	0     version, 1
+//	1     codec, 0 for the codec negotiated on the upgrade or the index of one in FrameCodecs
+//	2-3   length of the payload that follows
+//	4-7   sequence number, going up by one with every frame and wrapping around
+//	8-15  capture timestamp of the frame's first sample, in µs since the Unix epoch, 0 if unknown
+//
+// The header comes after the checksum and inside the encryption, so both cover it.
+const FrameHeaderSize = 16
+
+// FrameCodecs are the codecs of frame headers by their index
+var FrameCodecs = []string{"", PCM16Codec, PCM24Codec, PCM32Codec, Float32Codec, G711ULawCodec, G711ALawCodec, OpusCodec}
+
+// Kinds of audio frame anomalies detected from frame headers
+const (
+	// FrameLost is a frame that never arrived, or arrived too late to be waited for
+	FrameLost = "lost"
+	// FrameReordered is a frame that arrived after frames following it and was put back in order
+	FrameReordered = "reordered"
+	// FrameLate is a frame that arrived after the relay gave up on it, or arrived twice, and was
+	// dropped
+	FrameLate = "late"
+	// FrameInvalid is a frame whose header could not be read, or did not match the frame or the
+	// session, and was dropped
+	FrameInvalid = "invalid"
+)
+
+// maxDeviceLatency is the longest a frame is taken to have been on its way. Longer latencies,
+// like negative ones, point at a device clock that is not synchronized and are not tracked.
+const maxDeviceLatency = 10 * time.Second
+
+// inboundFrame is an audio frame from the device on its way through the pipeline. seq and
+// captured are from its header, captured zero when the device did not give it; lost counts the
+// frames given up on just before it.
+type inboundFrame struct {
+	data     []byte
+	seq      uint32
+	captured time.Time
+	lost     int
+}
+
+// frameResync is how far a sequence number may jump, back or ahead, before it is taken as the
+// device starting its sequence again rather than as lost or late frames
+const frameResync = 1000
+
+// frameSequence puts the audio frames of a device sending frame headers back in order, counting
+// those that are lost, reordered or late. It is only used by the session's read pump, except for
+// its counts. A nil *frameSequence passes frames through, as for devices sending raw frames.
+type frameSequence struct {
+	// window is how many frames are held back waiting for a missing one
+	window  int
+	started bool
+	next    uint32
+	held    map[uint32]inboundFrame
+
+	lost      atomic.Int64
+	reordered atomic.Int64
+	late      atomic.Int64
+	invalid   atomic.Int64
+}
+
+// frameFormat returns the frame sequence of a device sending frame headers, nil for raw frames.
+// Formats the relay cannot read are refused, so the device learns at upgrade time rather than
+// from a provider hearing its headers as noise.
+func (h *Handler) frameFormat(r *http.Request) (*frameSequence, error) {
+	switch value := strings.ToLower(strings.TrimSpace(headerOrQuery(r, FrameFormatHeader, "frame_format"))); value {
+	case "", "raw":
+		return nil, nil
+	case "1":
+		return &frameSequence{window: h.config.Websocket.FrameReorder, held: make(map[uint32]inboundFrame)}, nil
+	default:
+		return nil, &RejectError{StatusCode: http.StatusBadRequest, Reason: fmt.Sprintf("unsupported frame format %q", value)}
+	}
+}
+
+// readFrameHeader validates and strips the header of a frame. It returns the payload, the
+// sequence number and the capture time, zero when the device did not give one.
+func readFrameHeader(data []byte, codec string) ([]byte, uint32, time.Time, error) {
+	if len(data) < FrameHeaderSize || data[0] != 1 {
+		return nil, 0, time.Time{}, fmt.Errorf("no version 1 frame header")
+	}
+	if id := int(data[1]); id != 0 && (id >= len(FrameCodecs) || FrameCodecs[id] != codec) {
+		return nil, 0, time.Time{}, fmt.Errorf("frame of codec %d in a session of %s", id, codec)
+	}
+	payload := data[FrameHeaderSize:]
+	if n := int(binary.BigEndian.Uint16(data[2:])); n != len(payload) {
+		return nil, 0, time.Time{}, fmt.Errorf("frame header gives %d bytes of payload, frame has %d", n, len(payload))
+	}
+	var captured time.Time
+	if us := binary.BigEndian.Uint64(data[8:]); us != 0 {
+		captured = time.UnixMicro(int64(us))
+	}
+	return payload, binary.BigEndian.Uint32(data[4:]), captured, nil
+}
+
+// push adds a frame and returns the frames that are due, in order
+func (f *frameSequence) push(frame inboundFrame) []inboundFrame {
+	seq := frame.seq
+	if !f.started {
+		f.started, f.next = true, seq
+	}
+	ahead := int32(seq - f.next)
+	if ahead < -frameResync || ahead > frameResync {
+		due := f.flush()
+		f.next = seq + 1
+		return append(due, frame)
+	}
+	if _, held := f.held[seq]; ahead < 0 || held {
+		f.late.Add(1)
+		return nil
+	}
+	if ahead > 0 {
+		f.held[seq] = frame
+		if len(f.held) <= f.window {
+			return nil
+		}
+		// give up on the frames missing before the first one held
+		first := seq
+		for s := range f.held {
+			if s-f.next < first-f.next {
+				first = s
+			}
+		}
+		f.lost.Add(int64(first - f.next))
+		frame := f.held[first]
+		frame.lost = int(first - f.next)
+		f.held[first], f.next = frame, first
+		return f.release(nil)
+	}
+	if len(f.held) > 0 {
+		f.reordered.Add(1)
+	}
+	f.next++
+	return f.release([]inboundFrame{frame})
+}
+
+// release appends the held frames that are next in order to due
+func (f *frameSequence) release(due []inboundFrame) []inboundFrame {
+	for frame, ok := f.held[f.next]; ok; frame, ok = f.held[f.next] {
+		delete(f.held, f.next)
+		due = append(due, frame)
+		f.next++
+	}
+	return due
+}
+
+// flush returns the held frames in order, giving up on those missing between them
+func (f *frameSequence) flush() []inboundFrame {
+	var due []inboundFrame
+	for len(f.held) > 0 {
+		missing := 0
+		for _, ok := f.held[f.next]; !ok; _, ok = f.held[f.next] {
+			missing++
+			f.next++
+		}
+		f.lost.Add(int64(missing))
+		frame := f.held[f.next]
+		frame.lost = missing
+		f.held[f.next] = frame
+		due = f.release(due)
+	}
+	return due
+}
+
+// orderFrame strips the header of a frame from a device sending frame headers, tracks how long
+// the frame was on its way, and returns the frames due for the rest of the pipeline
+func (h *Handler) orderFrame(session *Session, data []byte) []inboundFrame {
+	f := session.frameSeq
+	if f == nil {
+		return []inboundFrame{{data: data}}
+	}
+	payload, seq, captured, err := readFrameHeader(data, session.codec)
+	if err != nil {
+		f.invalid.Add(1)
+		h.metrics.frameAnomaly(FrameInvalid, 1)
+		session.Client.logger.Debug("Dropping audio frame with an invalid header", "size", len(data), "error", err)
+		return nil
+	}
+	if !captured.IsZero() {
+		if latency := session.clock.Now().Sub(captured); latency >= 0 && latency <= maxDeviceLatency {
+			session.heat.observe(StageDeviceUplink, latency)
+		}
+	}
+	lost, reordered, late := f.lost.Load(), f.reordered.Load(), f.late.Load()
+	due := f.push(inboundFrame{data: payload, seq: seq, captured: captured})
+	h.metrics.frameAnomaly(FrameLost, f.lost.Load()-lost)
+	h.metrics.frameAnomaly(FrameReordered, f.reordered.Load()-reordered)
+	h.metrics.frameAnomaly(FrameLate, f.late.Load()-late)
+	return due
+}
+
+// stats returns the frame anomalies so far, nil for devices sending raw frames
+func (f *frameSequence) stats() *store.FrameStats {
+	if f == nil {
+		return nil
+	}
+	return &store.FrameStats{Lost: f.lost.Load(), Reordered: f.reordered.Load(), Late: f.late.Load(), Invalid: f.invalid.Load()}
+}
@@ -0,0 +1,36 @@
+package websocket
+
+import (
+	"hash/fnv"
+	"log/slog"
+	"slices"
+)
+
+// WithProviderFrameLog logs the raw frames the sessions provider_log samples exchange with their
+// provider to logger, apart from the handler's own log. By default no frames are logged.
+func WithProviderFrameLog(logger *slog.Logger) Option {
+	return func(h *Handler) {
+		h.frameLog = logger
+	}
+}
+
+// providerFrameLog returns the log of the frames a session exchanges with its provider, or nil if
+// the session is not sampled. Sessions are sampled by their ID, so that a session reconnecting to
+// its provider stays logged.
+func (h *Handler) providerFrameLog(session *Session) *slog.Logger {
+	cfg := h.config.ProviderLog
+	if h.frameLog == nil || !cfg.Enabled {
+		return nil
+	}
+	if !slices.Contains(cfg.SessionIDs, session.ID) && !sampled(session.ID, cfg.Sample) {
+		return nil
+	}
+	return h.frameLog.With("session_id", session.ID, "device_id", session.DeviceID, "tenant_id", session.TenantID)
+}
+
+// sampled reports whether an ID falls in the sampled fraction of IDs
+func sampled(id string, fraction float64) bool {
+	f := fnv.New64a()
+	f.Write([]byte(id))
+	return float64(f.Sum64()%10000) < fraction*10000
+}
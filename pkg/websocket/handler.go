@@ -0,0 +1,906 @@
+// websocket/handler.go
+package websocket
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/utils"
+	"github.com/pixaverse-studios/websocket-server/pkg/ai"
+	"github.com/pixaverse-studios/websocket-server/pkg/assets"
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/events"
+	"github.com/pixaverse-studios/websocket-server/pkg/faq"
+	"github.com/pixaverse-studios/websocket-server/pkg/metrics"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+	"github.com/pixaverse-studios/websocket-server/pkg/tools"
+	"github.com/pixaverse-studios/websocket-server/pkg/trace"
+
+	"github.com/gorilla/websocket"
+)
+
+// Handler manages WebSocket connections and message routing
+type Handler struct {
+	upgrader   websocket.Upgrader
+	logger     *slog.Logger
+	config     *config.Config
+	middleware chain
+	providers  *ai.Registry
+	sessions   *SessionManager
+	aiMetrics  *ai.Metrics
+	metrics    *handlerMetrics
+	usage      UsageStore
+	// transcripts keeps records of finished sessions; nil disables them
+	transcripts store.TranscriptStore
+	// signingKey signs the relay's half of the session hello, if set
+	signingKey ed25519.PrivateKey
+	// assets holds the clips the relay plays itself; nil without an assets directory
+	assets *assets.Manager
+	// faq caches answers in FAQ mode; nil when it is disabled
+	faq          *faq.Cache
+	faqMaxAnswer time.Duration
+	// tools are the functions the model can call; nil when there are none
+	tools            *tools.Registry
+	toolTimeout      time.Duration
+	toolSlowAfter    time.Duration
+	toolInstructions string
+	// translator translates captions into the display language of devices; nil sends them as spoken
+	translator Translator
+	tagLabels  *tagLabels
+	// turnProcessors run after every completed assistant turn of every session
+	turnProcessors []TurnProcessor
+	// chaos injects faults for resilience testing; nil when it is disabled
+	chaos *faultInjector
+	// heat keeps the stage latencies of recently finished sessions
+	heat  *HeatHistory
+	clock clock.Clock
+	// seeds derives the seeds of new sessions in deterministic mode; nil gives every session a random seed
+	seedMu sync.Mutex
+	seeds  *rand.Rand
+	// ids generates session IDs; by default the generator of websocket.session_ids
+	ids IDGenerator
+	// origins are the browser origins allowed to connect, websocket.allowed_origins by default
+	origins originAllowlist
+	// decoders decode the audio of devices sending compressed frames, by codec
+	decoders map[string]audio.DecoderFactory
+	// announcements are the announcements scheduled through the admin API; nil when disabled
+	announcements *Announcements
+	// queue caps the provider sessions open at once, nil when they are not capped
+	queue *providerQueue
+	// pipeline shares the audio pipeline fairly between sessions; nil runs every frame at once
+	pipeline *pipelineScheduler
+	// voiceLevels brings the voices of the provider to the same loudness; nil leaves them as they are
+	voiceLevels *voiceLevels
+	// waker connects the devices announcements are for; nil when devices are not woken
+	waker DeviceWaker
+	// events publishes the normalized stream of session events; nil when they are not published
+	events *events.Publisher
+	// pingInterval and pongWait drive the keepalive of device connections; zero takes
+	// websocket.ping_interval and websocket.pong_wait
+	pingInterval time.Duration
+	pongWait     time.Duration
+	// speakerVerifier verifies the speakers of sessions when speaker_verification.enabled is set
+	speakerVerifier SpeakerVerifier
+	// speakerClassifier classifies the voice of users when speaker.enabled is set, and
+	// speakerAuditor receives its classifications; nil logs them
+	speakerClassifier SpeakerClassifier
+	speakerAuditor    SpeakerAuditor
+	// connectTokens mints the tokens of GET /connect/info; nil sends none
+	connectTokens ConnectTokenFunc
+	// regionCheck reports whether the region of pinned tenants is available; nil only checks the config
+	regionCheck RegionCheck
+	// denoisers create the denoisers of sessions with noise suppression; nil uses the built-in one
+	denoisers audio.DenoiserFactory
+	// opusEncoder encodes the answers of devices taking Opus and the live audio supervisors listen
+	// to as Ogg/Opus; nil sends them pcm16 and only offers WAV
+	opusEncoder audio.EncoderFactory
+	// resampleQuality is how device audio is resampled to the provider's rate, and answers to the
+	// downlink rate; empty interpolates
+	resampleQuality audio.ResampleQuality
+	// frameLog receives the frames of the sessions whose provider frames are logged; nil logs none
+	frameLog *slog.Logger
+	// devices keeps the presence of devices; nil keeps none
+	devices store.DeviceStore
+
+	// active counts the connections being served, until their record is saved; draining refuses
+	// new ones for a shutdown
+	active   sync.WaitGroup
+	draining atomic.Bool
+	// bytesOut and recordsSaved count what was written to devices and the session records saved,
+	// for the drain report
+	bytesOut     atomic.Int64
+	recordsSaved atomic.Int64
+}
+
+// Option configures a Handler
+type Option func(*Handler)
+
+// WithMiddleware adds middleware to the handler. Middleware run in the order they are added.
+func WithMiddleware(m ...Middleware) Option {
+	return func(h *Handler) {
+		h.middleware = append(h.middleware, m...)
+	}
+}
+
+// WithLogger sets the logger used by the handler and its sessions. By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(h *Handler) {
+		h.logger = logger
+	}
+}
+
+// WithProviderRegistry sets the registry the AI provider named in the config is looked up from.
+// By default the registry returned by ai.NewDefaultRegistry is used.
+func WithProviderRegistry(r *ai.Registry) Option {
+	return func(h *Handler) {
+		h.providers = r
+	}
+}
+
+// WithSessionManager sets the session manager active sessions are tracked in
+func WithSessionManager(m *SessionManager) Option {
+	return func(h *Handler) {
+		h.sessions = m
+	}
+}
+
+// WithMetrics records the handler's metrics in the given registry
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(h *Handler) {
+		h.aiMetrics = ai.NewMetrics(reg)
+		h.metrics = newHandlerMetrics(reg)
+	}
+}
+
+// WithTranscriptStore keeps a record of every finished session, including its transcript, in s
+func WithTranscriptStore(s store.TranscriptStore) Option {
+	return func(h *Handler) {
+		h.transcripts = s
+	}
+}
+
+// WithSigningKey sets the key the relay signs its session hello key with, so devices that pin the
+// public key can tell the relay from a middlebox
+func WithSigningKey(key ed25519.PrivateKey) Option {
+	return func(h *Handler) {
+		h.signingKey = key
+	}
+}
+
+// WithUsageStore sets the store monthly bandwidth usage of devices is kept in. By default usage is
+// kept in memory and lost on restart.
+func WithUsageStore(s UsageStore) Option {
+	return func(h *Handler) {
+		h.usage = s
+	}
+}
+
+// WithAssets sets the manager the relay's own audio clips, such as the thinking filler, are loaded
+// from. By default they are loaded from the configured assets directory.
+func WithAssets(m *assets.Manager) Option {
+	return func(h *Handler) {
+		h.assets = m
+	}
+}
+
+// WithFAQCache sets the cache answers are kept in in FAQ mode, so it can be shared between handlers
+// or purged by the embedding application. By default each handler has its own.
+func WithFAQCache(c *faq.Cache) Option {
+	return func(h *Handler) {
+		h.faq = c
+	}
+}
+
+// WithTools sets the tools the model can call, which the relay runs for it. By default the model
+// has no tools.
+func WithTools(r *tools.Registry) Option {
+	return func(h *Handler) {
+		h.tools = r
+	}
+}
+
+// WithEvents publishes the events of sessions: their start and end, provider outages, the turns of
+// their transcripts and their quality of service
+func WithEvents(p *events.Publisher) Option {
+	return func(h *Handler) {
+		h.events = p
+	}
+}
+
+// WithKeepalive sets how often devices are pinged and how long they may leave pings unanswered
+// before their connection is closed, instead of websocket.ping_interval and websocket.pong_wait.
+// Zero keeps the configured value. A pong wait no longer than the ping interval would time out
+// devices answering every ping, so such a pair is rejected and the configured values kept.
+func WithKeepalive(pingInterval, pongWait time.Duration) Option {
+	return func(h *Handler) {
+		if pingInterval > 0 && pongWait > 0 && pongWait <= pingInterval {
+			return
+		}
+		h.pingInterval, h.pongWait = pingInterval, pongWait
+	}
+}
+
+// WithClock sets the clock sessions take their timestamps and timers from. By default the real
+// clock is used; tests and replays can pass a clock.Fake.
+func WithClock(c clock.Clock) Option {
+	return func(h *Handler) {
+		h.clock = c
+	}
+}
+
+// WithSeed makes the handler deterministic: the seeds of its sessions, which decide their IDs and
+// retry jitter, are derived from seed in the order sessions start. By default every session gets a
+// random seed, which is logged so a session can still be reproduced.
+func WithSeed(seed uint64) Option {
+	return func(h *Handler) {
+		h.seeds = rand.New(rand.NewPCG(seed, seedStream))
+	}
+}
+
+// WithIDGenerator replaces the generator of session IDs chosen by websocket.session_ids, e.g. to
+// use the ID scheme of the customer's systems. IDs must be unique among the active sessions.
+func WithIDGenerator(g IDGenerator) Option {
+	return func(h *Handler) {
+		h.ids = g
+	}
+}
+
+// WithAllowedOrigins replaces websocket.allowed_origins, the browser origins allowed to connect.
+// Patterns are hosts such as app.example.com or origins such as https://app.example.com, and may
+// use * as a wildcard, as in *.example.com.
+func WithAllowedOrigins(patterns ...string) Option {
+	return func(h *Handler) {
+		h.origins.patterns = patterns
+	}
+}
+
+// WithStrictOrigins replaces websocket.strict_origins: whether connections from origins that are
+// not allowed are rejected with 403, or only logged
+func WithStrictOrigins(strict bool) Option {
+	return func(h *Handler) {
+		h.origins.strict = strict
+	}
+}
+
+// WithResampleQuality sets how the audio of devices is resampled to the provider's rate, and the
+// answers to the downlink rate. The default, audio.ResampleLinear, interpolates, which is cheap but
+// lets the upper frequencies of 44.1 and 48 kHz audio fold back into the speech;
+// audio.ResampleSinc filters them out first, for deployments where transcription accuracy matters
+// more than CPU.
+func WithResampleQuality(q audio.ResampleQuality) Option {
+	return func(h *Handler) {
+		h.resampleQuality = q
+	}
+}
+
+// nextSeed returns the seed of a new session
+func (h *Handler) nextSeed() uint64 {
+	if h.seeds == nil {
+		return rand.Uint64()
+	}
+	h.seedMu.Lock()
+	defer h.seedMu.Unlock()
+	return h.seeds.Uint64()
+}
+
+// NewHandler creates a new WebSocket handler with the provided options
+func NewHandler(cfg *config.Config, opts ...Option) *Handler {
+	pingInterval, _ := time.ParseDuration(cfg.Websocket.PingInterval)
+
+	h := &Handler{
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true // origins are checked by checkOrigin, before the middleware
+			},
+			HandshakeTimeout: pingInterval,
+			WriteBufferPool:  nil, // Use default pool
+		},
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		config:    cfg,
+		providers: ai.NewDefaultRegistry(),
+		sessions:  NewSessionManager(),
+		usage:     NewMemoryUsageStore(),
+		tagLabels: newTagLabels(cfg.Tags),
+		heat:      NewHeatHistory(cfg.Admin.HeatSessions),
+		clock:     clock.Real(),
+		origins:   originAllowlist{patterns: cfg.Websocket.AllowedOrigins, strict: cfg.Websocket.StrictOrigins},
+	}
+	if cfg.Assets.Dir != "" {
+		h.assets = assets.NewManager(cfg.Assets.Dir)
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.ids == nil {
+		h.ids = idGenerator(cfg.Websocket.SessionIDs)
+	}
+	h.sessions.ids = h.ids
+	if cfg.FAQ.Enabled {
+		if h.faq == nil {
+			h.faq = faq.NewCache(cfg.FAQ, h.clock)
+		}
+		h.faqMaxAnswer, _ = time.ParseDuration(cfg.FAQ.MaxAnswer)
+	} else {
+		h.faq = nil
+	}
+	h.toolTimeout, _ = time.ParseDuration(cfg.Tools.Timeout)
+	h.toolSlowAfter, _ = time.ParseDuration(cfg.Tools.SlowAfter)
+	h.toolInstructions = cfg.Tools.SlowInstructions
+	if cfg.Announcements.Enabled && h.assets != nil {
+		h.announcements = newAnnouncements()
+	}
+	h.queue = newProviderQueue(cfg.ProviderQueue)
+	h.pipeline = newPipelineScheduler(cfg.PipelineScheduler, h.metrics)
+	h.voiceLevels = newVoiceLevels(cfg.VoiceGain, h.metrics)
+	h.chaos = newFaultInjector(cfg.Chaos, h.metrics)
+	if h.chaos != nil {
+		h.logger.Warn("Fault injection is enabled", "environment", cfg.Server.Environment)
+	}
+
+	return h
+}
+
+// FAQ returns the cache of answers kept in FAQ mode, or nil if it is disabled
+func (h *Handler) FAQ() *faq.Cache {
+	return h.faq
+}
+
+// Providers returns the registry the handler's AI providers are created from
+func (h *Handler) Providers() *ai.Registry {
+	return h.providers
+}
+
+// Sessions returns the session manager tracking the handler's active sessions
+func (h *Handler) Sessions() *SessionManager {
+	return h.sessions
+}
+
+// HeatHistory returns the stage latencies of the handler's recently finished sessions
+func (h *Handler) HeatHistory() *HeatHistory {
+	return h.heat
+}
+
+// ServeHTTP handles WebSocket connections
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.checkOrigin(w, r) {
+		return
+	}
+	req, err := h.middleware.onConnect(r)
+	if err != nil {
+		h.logger.Info("Connection rejected by middleware", "remote_addr", r.RemoteAddr, "error", err)
+		setRetryAfter(w, err)
+		http.Error(w, err.Error(), rejectStatus(err))
+		return
+	}
+	r = req
+
+	h.active.Add(1)
+	defer h.active.Done()
+	if h.refuseDraining(w) || h.refuseQueueFull(w) {
+		return
+	}
+	if err := h.checkRegion(r.Context(), tenantID(r)); err != nil {
+		h.logger.Info("Connection rejected", "remote_addr", r.RemoteAddr, "tenant_id", tenantID(r), "error", err)
+		http.Error(w, err.Error(), rejectStatus(err))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	clientVer, verErr := requestVersion(r)
+	outcome, upgrade := h.checkVersion(clientVer)
+	format, err := h.deviceFormat(r)
+	if err != nil {
+		h.logger.Info("Connection rejected", "remote_addr", r.RemoteAddr, "error", err)
+		http.Error(w, err.Error(), rejectStatus(err))
+		return
+	}
+
+	downlinkRate := h.config.Audio.SampleRate
+	downlinkCodec, downlinkEnc := h.downlinkCodec(r, downlinkRate)
+	header := h.versionHeader()
+	header.Set(DownlinkCodecHeader, downlinkCodec)
+
+	conn, err := h.upgrader.Upgrade(w, r, header)
+	if err != nil {
+		h.logger.Error("Failed to upgrade connection", "error", err)
+		return
+	}
+	h.metrics.versionChecked(outcome)
+	if outcome == VersionRejected {
+		h.rejectOutdated(conn, r, clientVer, upgrade)
+		return
+	}
+	// devices declaring their audio in a hello are set up from it instead of their request
+	hello, firstRead := h.awaitHello(conn)
+	if hello != nil {
+		r = hello.request(r)
+		if format, err = h.deviceFormat(r); err == nil {
+			downlinkRate, err = h.downlinkSampleRate(hello)
+		}
+		if err != nil {
+			h.rejectHello(conn, r, err)
+			return
+		}
+		h.metrics.deviceHello(HelloConfigured)
+		clientVer.firmware = cmp.Or(hello.FirmwareVersion, clientVer.firmware)
+		downlinkCodec, downlinkEnc = h.downlinkCodec(r, downlinkRate)
+	}
+	sampleRate, mix, frameSeq, codec, decoder := format.sampleRate, format.mix, format.frameSeq, format.codec, format.decoder
+
+	session := h.sessions.create(NewClient(conn, h.logger, h.config), deviceID(r), tenantID(r), cancel, h.nextSeed(), h.clock)
+	defer h.sessions.remove(session.ID)
+	client := session.Client
+	client.clock = h.clock
+	client.pingInterval, client.pongWait = h.pingInterval, h.pongWait
+	client.logger = h.logger.With("session_id", session.ID, "device_id", session.DeviceID, "tenant_id", session.TenantID, "seed", session.Seed)
+	corrID, corrErr := correlationID(r)
+	if corrID != "" {
+		session.CorrelationID = corrID
+		client.logger = client.logger.With("correlation_id", corrID)
+	}
+	if corrErr != nil {
+		client.logger.Warn("Ignoring correlation ID", "error", corrErr)
+	}
+	tags, tagErrs := requestTags(r)
+	for _, err := range tagErrs {
+		client.logger.Warn("Ignoring session tag", "error", err)
+	}
+	session.tags.mu.Lock()
+	session.tags.tags = tags
+	session.tags.mu.Unlock()
+	session.version.Store(&clientVer)
+	if verErr != nil {
+		client.logger.Warn("Ignoring reported version", "error", verErr)
+	}
+	h.metrics.sessionTagged(h.tagLabels.labels(tags))
+	session.bandwidth = newBandwidthMeter(h.config.Bandwidth, h.usage, session.DeviceID)
+	session.bandwidth.now = h.clock.Now
+	client.onWrite = func(n int) { h.countLinkBytes(session, n, false) }
+	client.onPong = func(rtt time.Duration) { session.heat.observe(StageDeviceRTT, rtt) }
+	session.heat.onObserve = func(stage string, d time.Duration) { h.metrics.stageDuration(session.ID, stage, d) }
+	session.echo = newEchoDetector(h.config.Echo, h.clock.Now())
+	session.speech = newSpeechEstimator(h.config.SpeechEstimate)
+	session.sampleRate = sampleRate
+	session.ptt = newPushToTalk(h.config, r, sampleRate)
+	session.duplexMode = duplexMode(h.config, r)
+	session.duplex = newHalfDuplex(h.config, session.duplexMode)
+	session.deviceProfile = h.deviceProfile(session, r)
+	session.utterance = newUtteranceCap(h.config.EndpointingFor(session.deviceProfile))
+	session.aec = newEchoCanceller(h.config, session.deviceProfile, session.duplexMode, sampleRate, h.clock.Now())
+	session.denoiser = h.newDenoiser(session, sampleRate)
+	session.vad = newVADGate(h.config, h.config.EndpointingFor(session.deviceProfile), session.ptt != nil, sampleRate)
+	session.agc = newGainControl(h.config, session.deviceProfile, sampleRate)
+	session.calibration = newCalibration(h.config, sampleRate, session.agc == nil)
+	session.codec, session.decoder = codec, decoder
+	session.downmix = mix
+	session.frameSeq = frameSeq
+	session.playout = newJitterBuffer(h.config.Jitter)
+	session.plc = newConcealer(h.config.PLC, frameSeq, sampleRate, h.config.Audio.Channels)
+	session.verifySample = newVerificationSampler(h.config, h.speakerVerifier, sampleRate)
+	session.speaker = newSpeakerSampler(h.config, h.speakerClassifier, sampleRate)
+	session.downlinkCodec, session.downlinkEnc = downlinkCodec, downlinkEnc
+	if downlinkRate != h.config.Audio.SampleRate {
+		session.setDownlinkSampleRate(downlinkRate)
+	}
+	session.firstRead = firstRead
+	session.displayLanguage = displayLanguage(r)
+	h.startCaptions(ctx, session, session.displayLanguage)
+	h.startTurnProcessors(ctx, session)
+	h.chaos.scheduleDisconnects(session)
+	go h.chaos.cutDevice(ctx, session)
+	if session.playout != nil {
+		go h.playJitter(ctx, session)
+	}
+	h.startTrace(session)
+	session.events = h.events
+	session.publish(events.SessionStarted, session.StartedAt, events.SessionStart{
+		CorrelationID:   session.CorrelationID,
+		Tags:            session.Tags(),
+		ProtocolVersion: session.ProtocolVersion(),
+		FirmwareVersion: session.FirmwareVersion(),
+		Codec:           session.codec,
+		SampleRate:      sampleRate,
+	})
+	h.deviceConnected(session)
+
+	if upgrade != nil {
+		client.logger.Info("Telling device to upgrade", "protocol_version", clientVer.protocol, "firmware_version", clientVer.firmware, "reason", upgrade.Reason)
+		if err := client.Send(upgrade); err != nil {
+			client.logger.Error("Could not send upgrade event", "error", err)
+		}
+	}
+
+	if hello != nil {
+		client.logger.Info("Device configured by its hello", "sample_rate", sampleRate, "codec", codec, "downlink_codec", downlinkCodec, "downlink_sample_rate", downlinkRate)
+		h.sendConfigured(session)
+	}
+
+	// Start sending pings to the client
+	client.StartPingTicker(ctx)
+
+	err = h.handleClient(ctx, session)
+	// a session the relay closed for a failure ends with it, not the read error that followed
+	if closeErr := client.Err(); closeErr != nil {
+		err = closeErr
+	}
+	session.beginTeardown()
+	if err != nil {
+		client.logger.Error("Client handling error", "error", err)
+	}
+	if corrupted, total := session.CorruptedFrames(); corrupted > 0 {
+		client.logger.Warn("Session received corrupted audio frames", "corrupted_frames", corrupted, "audio_frames", total)
+	}
+	client.Close()
+	h.stopTrace(session)
+	session.live.close()
+	if session.agc != nil {
+		h.metrics.agcGain(session.agc.gainDB())
+	}
+	if st := session.aec.status(); st != nil && st.DelayMs >= 0 {
+		h.metrics.echoCancelled(st.ERLEDB)
+	}
+	heat := session.Heat()
+	heat.EndedAt = h.clock.Now()
+	h.heat.add(heat)
+	h.saveSession(session, err)
+	h.middleware.onDisconnect(client, err)
+}
+
+// saveSession stores the record of a finished session. Sessions closed by the device or the
+// server normally, including at shutdown, are not flagged.
+func (h *Handler) saveSession(session *Session, err error) {
+	if h.transcripts == nil && h.events == nil && h.devices == nil {
+		return
+	}
+	// a reaped session may be saved by the reaper and by its own teardown, only the first counts
+	session.saveOnce.Do(func() { h.storeSession(session, err) })
+}
+
+func (h *Handler) storeSession(session *Session, err error) {
+	if r := session.reaped.Load(); r != nil {
+		err = reapedError(r.reason)
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, errRestarting) || websocket.IsCloseError(errors.Unwrap(err), websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		err = nil
+	}
+	record := session.Record(h.clock.Now(), err)
+	h.publishEnd(session, record)
+	h.deviceDisconnected(session, record.EndedAt, err)
+	if h.transcripts == nil {
+		return
+	}
+	// the request context is gone by now, so the save gets a bounded context of its own
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := h.transcripts.SaveSession(ctx, record); err != nil {
+		session.Client.logger.Error("Could not save session record", "error", err)
+		return
+	}
+	h.recordsSaved.Add(1)
+}
+
+// readPumpStop is how long a session being closed waits for its read pump to return with the frame
+// it is processing
+const readPumpStop = time.Second
+
+// handleClient manages the client connection and message routing
+func (h *Handler) handleClient(ctx context.Context, session *Session) error {
+	client := session.Client
+	ab := utils.NewBufferSizeController(downlinkChunk)
+
+	// Listen to the buffer controller output channel
+	go h.relayAnswers(ctx, session, &ab)
+
+	if h.config.Offline.Enabled {
+		session.offline = newOfflineBuffer(h.config.Offline, session.memory)
+	}
+
+	// Create error channel for goroutines
+	errChan := make(chan error, 2)
+
+	// Start handling messages from the client. Audio that arrives while the provider is not connected
+	// is buffered when offline buffering is enabled, and dropped otherwise.
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		if err := h.readPump(ctx, session); err != nil {
+			errChan <- fmt.Errorf("client message handling error: %w", err)
+		}
+	}()
+
+	providerErr := make(chan error, 1)
+	go func() {
+		providerErr <- h.superviseProvider(ctx, session, &ab)
+	}()
+
+	// Wait for context cancellation or error
+	select {
+	case <-ctx.Done():
+		// the read pump is interrupted and returns with the frame it is processing, so the session
+		// is not torn down under it
+		select {
+		case <-readDone:
+		case <-time.After(readPumpStop):
+			client.logger.Warn("Read pump did not stop in time", "wait", readPumpStop)
+		}
+		return ctx.Err()
+	case err := <-errChan:
+		return err
+	case err := <-providerErr:
+		return err
+	}
+}
+
+// relayAnswers sends the answer audio of the buffer controller to the device until ctx ends. The
+// chunk of a flush ends an answer.
+func (h *Handler) relayAnswers(ctx context.Context, session *Session, ab *utils.BufferSizeController) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case chunk := <-ab.GetOutputChannel():
+			audio := chunk.Data
+			session.memory.set(MemoryDownlink, int64(ab.Len()))
+			sent, err := h.writeAudio(session, audio, sourceAnswer, chunk.Last)
+			if err != nil {
+				session.Client.logger.Error("Could not write audio to client", "error", err)
+				continue
+			}
+			if !sent {
+				continue
+			}
+			session.echo.downlink(session.clock.Now(), audio, session.DownlinkSampleRate())
+			session.aec.downlink(session.clock.Now(), audio, session.DownlinkSampleRate())
+			session.duplex.downlink(session.clock.Now(), time.Duration(len(audio)/2)*time.Second/time.Duration(session.DownlinkSampleRate()))
+			// response audio is relayed as mono 16 bit PCM
+			session.Cursor.Sent(len(audio) / 2)
+			h.sendSpeechEstimate(session)
+		}
+	}
+}
+
+// runProvider connects a new AI client for the session and relays between it and the device until
+// the connection with the provider fails or ctx is done
+func (h *Handler) runProvider(ctx context.Context, session *Session, ab *utils.BufferSizeController) error {
+	client := session.Client
+	profile := session.providerProfile()
+	provider := h.config.AIConfig.Provider
+	if profile.Provider != "" {
+		provider = profile.Provider
+	}
+	aiClient, err := h.providers.New(provider, ai.ProviderParams{
+		Config:          h.config,
+		Logger:          client.logger,
+		Metrics:         h.aiMetrics.ForSession(session.ID),
+		Clock:           h.clock,
+		Tools:           h.toolDefinitions(),
+		TenantID:        session.TenantID,
+		DeviceProfile:   session.deviceProfile,
+		Model:           profile.Model,
+		Instructions:    profile.Instructions,
+		Voice:           profile.Voice,
+		InputCodec:      session.inputCodec(),
+		InputSampleRate: session.sampleRate,
+		FrameLog:        h.providerFrameLog(session),
+		ResampleQuality: h.resampleQuality,
+	})
+	if err != nil {
+		return fmt.Errorf("Could not create AI Client: %w", err)
+	}
+	defer aiClient.Close()
+	// an answer cut off with the connection is never finished
+	defer session.answerFinished()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Listen for critical events from the AI model
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-aiClient.GetEventsStream():
+				session.heat.depth(QueueProviderEvents, float64(len(aiClient.GetEventsStream())))
+				if h.chaos.dropEvent(session) {
+					continue
+				}
+				h.handleAIEvent(ctx, session, aiClient, ab, e)
+			}
+		}
+	}()
+
+	// Start handling AI responses
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case r := <-aiClient.GetResponseStream():
+				received := session.clock.Now()
+				session.heat.depth(QueueProviderResponses, float64(len(aiClient.GetResponseStream())))
+				session.stopFiller()
+				if !session.Cursor.Receive(r.ItemID) {
+					// the item was interrupted, drop the rest of it
+					continue
+				}
+				session.heat.responseAudioAt(received)
+				session.answerStarted()
+				session.itemAudioStarted(r.ItemID, received)
+				a := session.downlinkResampler.resample(r.Audio, session.DownlinkSampleRate(), h.resampleQuality)
+				pcm := h.normalizeVoice(session, a.AsPCM16())
+				session.heat.observe(StageDownlinkDSP, session.clock.Now().Sub(received))
+				if !h.reserveDownlink(session, ab, len(pcm)) {
+					continue
+				}
+				if h.faq != nil {
+					session.recordAnswerAudio(r.ItemID, pcm, a.GetSampleRate(), h.faqMaxAnswer)
+				}
+				session.Cursor.Received(len(pcm) / 2)
+				err := ab.Write(pcm)
+				if err != nil {
+					client.logger.Error("Cannot write to BufferSizeController buffer", "error", err)
+				}
+				session.memory.set(MemoryDownlink, int64(ab.Len()))
+				session.heat.depth(QueueDownlinkBuffer, float64(ab.Len()/2*1000/session.DownlinkSampleRate()))
+			}
+
+		}
+	}()
+
+	err = aiClient.Initialize(ctx)
+	if err != nil {
+		return fmt.Errorf("Could not initialize AI Client: %w", err)
+	}
+
+	h.restoreConversation(ctx, session, aiClient)
+	h.attachProvider(ctx, session, aiClient)
+	defer session.setProvider(nil)
+	h.applyCalibration(ctx, session, aiClient)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-aiClient.Errors():
+		return fmt.Errorf("AI client error: %w", err)
+	case <-h.chaos.cutProvider(session):
+		h.metrics.faultInjected(FaultProviderDisconnect)
+		client.logger.Info("Injecting fault", "fault", FaultProviderDisconnect)
+		return errChaosDisconnect
+	case <-session.refresh:
+		return h.drainForRefresh(ctx, session)
+	}
+}
+
+// uplinkFrame takes an audio frame from the device, checked and in order, through the rest of the
+// pipeline to the provider
+func (h *Handler) uplinkFrame(ctx context.Context, session *Session, frame inboundFrame, start time.Time) {
+	message, ok := h.decodeFrame(session, frame.data)
+	if !ok {
+		return
+	}
+	message = session.downmix.apply(message)
+	h.conceal(ctx, session, frame, message, start)
+	h.uplinkPCM(ctx, session, message, h.decodeSamples(session, frame.data), frame.captured, start)
+}
+
+// uplinkPCM runs decoded audio from the device, captured at captured if the device said, through
+// the rest of the pipeline and on to the provider. The pipeline works in 16 bit PCM; samples, the
+// audio as the device sent it when it is finer than that, are sent in its place unless the
+// pipeline changed the audio.
+func (h *Handler) uplinkPCM(ctx context.Context, session *Session, message []byte, samples *audio.Audio, captured time.Time, start time.Time) {
+	frame := len(message)
+	var in []byte
+	if samples != nil {
+		in = slices.Clone(message)
+	}
+	if message = h.uplinkDSP(ctx, session, message); message == nil {
+		return
+	}
+	a := audio.FromPCM16(message, session.sampleRate, h.config.Audio.Channels)
+	if samples != nil && bytes.Equal(message, in) {
+		a = *samples
+	}
+	if preRoll := len(message) - frame; preRoll > 0 && !captured.IsZero() {
+		captured = captured.Add(-a.Duration() * time.Duration(preRoll) / time.Duration(len(message)))
+	}
+	session.heat.observe(StageUplinkDSP, session.clock.Now().Sub(start))
+	if h.bufferAudio(session, a, captured) {
+		return
+	}
+	if err := h.sendAudio(ctx, session, a); err != nil {
+		session.Client.logger.Error("Could not send audio to AI Client", "error", err)
+	}
+}
+
+// uplinkDSP processes decoded audio from the device in a slot of the pipeline scheduler. It returns
+// the audio to send the provider, nil for none.
+func (h *Handler) uplinkDSP(ctx context.Context, session *Session, message []byte) []byte {
+	defer h.pipeline.run(session)()
+	message = session.hearTest(session.clock.Now(), message, h.config.Audio.Channels)
+	message = h.cancelEcho(session, message)
+	message = session.denoise(message)
+	message = h.calibrate(ctx, session, message)
+	message = session.agc.apply(message)
+	message = h.checkEcho(session, message)
+	message = h.muteHalfDuplex(session, message)
+	message = h.capUtterance(session, message)
+	if session.ptt.hold(session.clock.Now(), message) {
+		return nil
+	}
+	h.sampleSpeaker(ctx, session, message)
+	h.sampleVerification(ctx, session, message)
+	return h.gateSpeech(session, message)
+}
+
+// readPump handles incoming messages from the WebSocket client until ctx is done or the connection
+// fails. Reads block until the device sends something, so ctx being done interrupts the read in
+// progress.
+func (h *Handler) readPump(ctx context.Context, session *Session) error {
+	client := session.Client
+	stop := context.AfterFunc(ctx, client.interruptRead)
+	defer stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			typ, message, err := session.nextMessage()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				client.traceReadError(err)
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+					client.logger.Error("WebSocket read error", "error", err)
+				}
+				return err
+			}
+			session.lastRead.Store(session.clock.Now().UnixNano())
+			client.extendReadDeadline()
+			h.countLinkBytes(session, len(message), true)
+			client.traceFrame(trace.FromDevice, typ, message)
+
+			message, ok := h.middleware.onMessage(ctx, client, typ, message)
+			if !ok {
+				continue
+			}
+
+			switch typ {
+			case websocket.BinaryMessage:
+				h.chaos.delayFrame(ctx, session)
+				start := session.clock.Now()
+				message, ok := h.checkFrame(session, h.chaos.corruptFrame(session, message))
+				if !ok {
+					continue
+				}
+				message, ok = h.openFrame(session, message)
+				if !ok {
+					continue
+				}
+				for _, frame := range h.orderFrame(session, message) {
+					h.uplinkFrame(ctx, session, frame, start)
+				}
+
+			case websocket.TextMessage:
+				h.handleControlMessage(ctx, session, message)
+			}
+		}
+	}
+}
@@ -0,0 +1,3873 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"math"
+	mrand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pixaverse-studios/websocket-server/internal/utils"
+	"github.com/pixaverse-studios/websocket-server/pkg/ai"
+	"github.com/pixaverse-studios/websocket-server/pkg/assets"
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	pixaerrors "github.com/pixaverse-studios/websocket-server/pkg/errors"
+	"github.com/pixaverse-studios/websocket-server/pkg/events"
+	"github.com/pixaverse-studios/websocket-server/pkg/metrics"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+	"github.com/pixaverse-studios/websocket-server/pkg/tools"
+	"github.com/pixaverse-studios/websocket-server/pkg/trace"
+)
+
+func TestWebSocketHandler(t *testing.T) {
+	t.Run("test connection handling", func(t *testing.T) {
+		// TODO: Implement connection handling test
+		t.Skip("Test not implemented")
+	})
+
+	t.Run("test message relay", func(t *testing.T) {
+		// TODO: Implement message relay test
+		t.Skip("Test not implemented")
+	})
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Run("test connect rejection", func(t *testing.T) {
+		h := NewHandler(&config.Config{}, WithMiddleware(Middleware{
+			OnConnect: func(r *http.Request) (*http.Request, error) {
+				return nil, &RejectError{StatusCode: http.StatusUnauthorized, Reason: "missing token"}
+			},
+		}))
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+		}
+	})
+
+	t.Run("test message chain order", func(t *testing.T) {
+		appendByte := func(b byte) Middleware {
+			return Middleware{
+				OnMessage: func(ctx context.Context, c *Client, typ int, data []byte) ([]byte, bool) {
+					return append(data, b), true
+				},
+			}
+		}
+		drop := Middleware{
+			OnMessage: func(ctx context.Context, c *Client, typ int, data []byte) ([]byte, bool) {
+				return nil, false
+			},
+		}
+
+		out, ok := chain{appendByte(1), appendByte(2)}.onMessage(context.Background(), nil, 0, nil)
+		if !ok || len(out) != 2 || out[0] != 1 || out[1] != 2 {
+			t.Fatalf("unexpected chain output: %v, %v", out, ok)
+		}
+
+		if _, ok := (chain{drop, appendByte(1)}).onMessage(context.Background(), nil, 0, nil); ok {
+			t.Fatal("expected message to be dropped")
+		}
+	})
+}
+
+func TestAudioCursor(t *testing.T) {
+	t.Run("test interruption uses playback ack", func(t *testing.T) {
+		c := NewAudioCursor(16000)
+		c.Receive("item_1")
+		c.Sent(16000) // one second sent
+		c.Ack(250)
+
+		itemID, endMs, ok := c.Interrupt()
+		if !ok || itemID != "item_1" || endMs != 250 {
+			t.Fatalf("unexpected truncation point: %q %d %v", itemID, endMs, ok)
+		}
+		if c.Receive("item_1") {
+			t.Fatal("expected audio of interrupted item to be dropped")
+		}
+		if !c.Receive("item_2") {
+			t.Fatal("expected audio of a new item to be relayed")
+		}
+	})
+
+	t.Run("test interruption without ack uses sent position", func(t *testing.T) {
+		c := NewAudioCursor(24000)
+		c.Receive("item_1")
+		c.Sent(12000)
+
+		if _, endMs, ok := c.Interrupt(); !ok || endMs != 500 {
+			t.Fatalf("expected truncation at 500ms, got %d %v", endMs, ok)
+		}
+	})
+
+	t.Run("test nothing to interrupt once fully played", func(t *testing.T) {
+		c := NewAudioCursor(16000)
+		c.Receive("item_1")
+		c.Sent(1600)
+		c.Ack(100)
+
+		if _, _, ok := c.Interrupt(); ok {
+			t.Fatal("expected no interruption after the item was fully played")
+		}
+	})
+}
+
+func TestBandwidthMeter(t *testing.T) {
+	cfg := config.BandwidthConfig{
+		SessionCapBytes:    1000,
+		MonthlyCapBytes:    1500,
+		WarningThreshold:   0.5,
+		DowngradeThreshold: 0.8,
+	}
+
+	t.Run("test session cap levels", func(t *testing.T) {
+		m := newBandwidthMeter(cfg, nil, "")
+		for _, step := range []struct {
+			n     int
+			level bandwidthLevel
+			ok    bool
+		}{
+			{400, levelNormal, false},
+			{200, levelWarning, true},
+			{100, levelWarning, false},
+			{100, levelDowngrade, true},
+			{300, levelExceeded, true},
+		} {
+			c, ok, _ := m.add(step.n, true)
+			if ok != step.ok || (ok && c.level != step.level) {
+				t.Fatalf("after %d bytes: got level %d (%v), want %d (%v)", step.n, c.level, ok, step.level, step.ok)
+			}
+		}
+	})
+
+	t.Run("test monthly cap spans sessions", func(t *testing.T) {
+		store := NewMemoryUsageStore()
+		newBandwidthMeter(cfg, store, "device-1").add(900, false)
+
+		c, ok, _ := newBandwidthMeter(cfg, store, "device-1").add(300, false)
+		if !ok || c.scope != monthlyScope || c.level != levelDowngrade {
+			t.Fatalf("expected monthly downgrade, got %+v (%v)", c, ok)
+		}
+	})
+}
+
+func TestBandwidthCapOnWrite(t *testing.T) {
+	cfg := config.Default()
+	cfg.Bandwidth.SessionCapBytes = 1000
+	cfg.Bandwidth.WarningThreshold = 0.5
+	cfg.Bandwidth.DowngradeThreshold = 0.8
+	cfg.Bandwidth.DowngradeSampleRate = 8000
+	h := NewHandler(cfg)
+
+	sessions := make(chan *Session, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		session := h.sessions.create(NewClient(conn, h.logger, cfg), "", "", nil, h.nextSeed(), h.clock)
+		session.bandwidth = newBandwidthMeter(cfg.Bandwidth, nil, "")
+		session.Client.onWrite = func(n int) { h.countLinkBytes(session, n, false) }
+		sessions <- session
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session := <-sessions
+
+	// the events of the levels are sent while the write that crossed them is being completed, which
+	// must not wait on the write pump writing it
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, step := range []struct {
+		n     int
+		event string
+	}{
+		{600, BandwidthWarningEvent},
+		{150, BandwidthDowngradedEvent},
+		{200, BandwidthExceededEvent},
+	} {
+		sent := make(chan error, 1)
+		go func() { sent <- session.Client.SendBinary(make([]byte, step.n)) }()
+		select {
+		case err := <-sent:
+			if err != nil {
+				t.Fatalf("could not send %d bytes: %v", step.n, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("sending %d bytes did not return, expected %s", step.n, step.event)
+		}
+		if typ, data, err := conn.ReadMessage(); err != nil || typ != websocket.BinaryMessage || len(data) != step.n {
+			t.Fatalf("expected %d bytes of audio, got %d (%v)", step.n, len(data), err)
+		}
+		var event bandwidthEvent
+		if _, data, err := conn.ReadMessage(); err != nil || json.Unmarshal(data, &event) != nil || event.Type != step.event {
+			t.Fatalf("expected %s, got %q (%v)", step.event, data, err)
+		}
+	}
+	if session.DownlinkSampleRate() != 8000 {
+		t.Fatalf("expected the downlink to be downgraded to 8 kHz, got %d", session.DownlinkSampleRate())
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected the session to be closed for its cap, got %v", err)
+	}
+}
+
+func TestOfflineBuffer(t *testing.T) {
+	b := newOfflineBuffer(config.OfflineConfig{MaxBuffer: "1s"}, newMemoryBudget(config.MemoryConfig{}))
+	// 400ms chunks of 16kHz mono audio
+	chunk := func() audio.Audio { return audio.FromPCM16(make([]byte, 6400*2), 16000, 1) }
+	for i := 0; i < 4; i++ {
+		b.add(chunk())
+	}
+
+	chunks, buffered, dropped := b.take()
+	if len(chunks) != 2 || buffered != 800*time.Millisecond || dropped != 800*time.Millisecond {
+		t.Fatalf("unexpected buffer state: %d chunks, %s buffered, %s dropped", len(chunks), buffered, dropped)
+	}
+	if chunks, _, _ := b.take(); len(chunks) != 0 {
+		t.Fatal("expected buffer to be empty after take")
+	}
+}
+
+func TestFrameCipher(t *testing.T) {
+	_, signingKey, _ := ed25519.GenerateKey(rand.Reader)
+	device, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	devicePublic := device.PublicKey().Bytes()
+
+	relay, resp, err := handshake("session-1", devicePublic, signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(signingKey.Public().(ed25519.PublicKey), helloTranscript("session-1", devicePublic, resp.relayPublic), resp.signature) {
+		t.Fatal("hello signature does not verify")
+	}
+
+	// the device derives the same keys, with the directions swapped
+	relayPublic, _ := ecdh.X25519().NewPublicKey(resp.relayPublic)
+	shared, _ := device.ECDH(relayPublic)
+	deviceCipher, _ := newFrameCipher(shared, "session-1")
+	deviceCipher.uplink, deviceCipher.downlink = deviceCipher.downlink, deviceCipher.uplink
+
+	audio := []byte("sixteen bit pcm!")
+	first := deviceCipher.seal(audio)
+	second := deviceCipher.seal(audio)
+	if bytes.Contains(first, audio) {
+		t.Fatal("frame is not encrypted")
+	}
+	if plain, err := relay.open(first); err != nil || !bytes.Equal(plain, audio) {
+		t.Fatalf("could not open frame: %v", err)
+	}
+	if _, err := relay.open(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := relay.open(first); err == nil {
+		t.Fatal("expected a replayed frame to be rejected")
+	}
+	tampered := deviceCipher.seal(audio)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := relay.open(tampered); err == nil {
+		t.Fatal("expected a tampered frame to be rejected")
+	}
+
+	if plain, err := deviceCipher.open(relay.seal(audio)); err != nil || !bytes.Equal(plain, audio) {
+		t.Fatalf("device could not open downlink frame: %v", err)
+	}
+}
+
+func TestFrameChecksum(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Websocket.FrameChecksum = true
+	h := NewHandler(cfg)
+	session := &Session{Client: &Client{logger: h.logger}}
+
+	payload := []byte("sixteen bit pcm!")
+	frame := binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(payload))
+	frame = append(frame, payload...)
+	if data, ok := h.checkFrame(session, frame); !ok || !bytes.Equal(data, payload) {
+		t.Fatalf("valid frame was not accepted: %q", data)
+	}
+
+	damaged := bytes.Clone(frame)
+	damaged[len(damaged)-1] ^= 0x01
+	for _, f := range [][]byte{damaged, frame[:2]} {
+		if _, ok := h.checkFrame(session, f); ok {
+			t.Fatalf("corrupted frame %x was accepted", f)
+		}
+	}
+	if corrupted, total := session.CorruptedFrames(); corrupted != 2 || total != 3 {
+		t.Fatalf("expected 2 of 3 frames to be corrupted, got %d of %d", corrupted, total)
+	}
+}
+
+func TestDeterministicSessions(t *testing.T) {
+	cfg := &config.Config{}
+	start := time.Unix(1700000000, 0)
+	sessions := func(seed uint64) []*Session {
+		h := NewHandler(cfg, WithSeed(seed), WithClock(clock.NewFake(start)))
+		var out []*Session
+		for i := 0; i < 3; i++ {
+			out = append(out, h.sessions.create(&Client{config: cfg}, "", "", nil, h.nextSeed(), h.clock))
+		}
+		return out
+	}
+
+	a, b, other := sessions(42), sessions(42), sessions(7)
+	for i := range a {
+		if a[i].ID != b[i].ID || a[i].jitter(time.Second) != b[i].jitter(time.Second) {
+			t.Fatalf("session %d differs between runs with the same seed", i)
+		}
+		if a[i].ID == other[i].ID {
+			t.Fatalf("session %d has the same ID with another seed", i)
+		}
+		if !a[i].StartedAt.Equal(start) {
+			t.Fatalf("session %d did not start at the fake clock's time", i)
+		}
+		if j := a[i].jitter(time.Second); j < 800*time.Millisecond || j > 1200*time.Millisecond {
+			t.Fatalf("jitter %s out of range", j)
+		}
+	}
+	if a[0].ID == a[1].ID {
+		t.Fatal("sessions of one handler share an ID")
+	}
+}
+
+func TestKeepaliveReadDeadline(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Websocket.PingInterval, cfg.Websocket.PongWait, cfg.Websocket.WriteWait = "30s", "60s", "1s"
+	h := NewHandler(cfg, WithKeepalive(50*time.Millisecond, 100*time.Millisecond))
+
+	read := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(conn, h.logger, cfg)
+		// the keepalive's clock is stopped, so only the read deadline can end the connection
+		client.clock = clock.NewFake(time.Unix(1700000000, 0))
+		client.pingInterval, client.pongWait = h.pingInterval, h.pongWait
+		client.StartPingTicker(context.Background())
+		_, _, err = conn.ReadMessage()
+		read <- err
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case err := <-read:
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatalf("expected the read to time out, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read of a silent connection did not time out")
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Websocket.PingInterval = "1s"
+	cfg.Websocket.PongWait = "2s"
+	cfg.Websocket.WriteWait = "1s"
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+
+	if h := NewHandler(cfg, WithKeepalive(time.Second, time.Second)); h.pingInterval != 0 || h.pongWait != 0 {
+		t.Fatal("expected a pong wait no longer than the ping interval to be rejected")
+	}
+
+	clients := make(chan *Client, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(conn, slog.New(slog.NewTextHandler(io.Discard, nil)), cfg)
+		client.clock = clk
+		client.StartPingTicker(context.Background())
+		clients <- client
+		// pongs are handled as the connection is read
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := <-clients
+
+	pings := make(chan struct{}, 1)
+	var answer atomic.Bool
+	answer.Store(true)
+	conn.SetPingHandler(func(data string) error {
+		if answer.Load() {
+			_ = conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		}
+		select {
+		case pings <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+	tick := func(d time.Duration, pinged bool) {
+		t.Helper()
+		clk.Advance(d)
+		if !pinged {
+			return
+		}
+		select {
+		case <-pings:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected a ping")
+		}
+	}
+
+	// a device answering every ping stays connected well past the pong wait
+	for range 4 {
+		tick(time.Second, true)
+		for deadline := time.Now().Add(5 * time.Second); client.lastPing.Load() != 0; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("pong was not handled")
+			}
+		}
+	}
+
+	// once it stops answering, the pong wait runs from the unanswered ping
+	answer.Store(false)
+	tick(time.Second, true)
+	tick(time.Second, false)
+	select {
+	case err := <-closed:
+		t.Fatalf("closed before the pong wait since the unanswered ping: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	tick(2*time.Second, false)
+	select {
+	case err := <-closed:
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Fatalf("expected a keepalive timeout close, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("unanswered pings did not time out")
+	}
+}
+
+func TestWritePump(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Websocket.WriteWait = "1s"
+
+	clients := make(chan *Client, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		clients <- NewClient(conn, slog.New(slog.NewTextHandler(io.Discard, nil)), cfg)
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := <-clients
+
+	// goroutines writing at once must not interleave their frames
+	const writers, each = 8, 50
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		go func() {
+			for i := 0; i < each; i++ {
+				var err error
+				if i%2 == 0 {
+					err = client.Send(map[string]int{"writer": w, "i": i})
+				} else {
+					err = client.SendBinary(bytes.Repeat([]byte{byte(w)}, 1024))
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for n := 0; n < writers*each; n++ {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType == websocket.TextMessage {
+			var m map[string]int
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Fatalf("corrupted text message %q: %v", data, err)
+			}
+		} else if len(data) != 1024 || !bytes.Equal(data, bytes.Repeat(data[:1], 1024)) {
+			t.Fatalf("corrupted binary message of %d bytes", len(data))
+		}
+	}
+	for w := 0; w < writers; w++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client.Close()
+	if err := client.Send(map[string]string{"type": "late"}); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("expected ErrClientClosed after close, got %v", err)
+	}
+}
+
+// fakeDecoder decodes packets by repeating each byte, and fails on empty packets
+type fakeDecoder struct{}
+
+func (fakeDecoder) Decode(packet []byte) ([]byte, error) {
+	if len(packet) == 0 {
+		return nil, errors.New("empty packet")
+	}
+	pcm := make([]byte, 0, 2*len(packet))
+	for _, b := range packet {
+		pcm = append(pcm, b, b)
+	}
+	return pcm, nil
+}
+
+func TestAudioCodec(t *testing.T) {
+	cfg := config.Default()
+	w := httptest.NewRecorder()
+	NewHandler(cfg).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?codec=opus", nil))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected a codec without a decoder to be refused, got %d", w.Code)
+	}
+
+	reg := metrics.NewRegistry()
+	var rates []int
+	h := NewHandler(cfg, WithMetrics(reg), WithDecoder("Opus", func(sampleRate, channels int) (audio.Decoder, error) {
+		rates = append(rates, sampleRate)
+		return fakeDecoder{}, nil
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if codec := requestCodec(r); codec != PCM16Codec {
+		t.Fatalf("expected devices to send pcm16 by default, got %q", codec)
+	}
+	if dec, err := h.newDecoder(PCM16Codec, cfg.Audio.SampleRate, cfg.Audio.Channels); dec != nil || err != nil {
+		t.Fatalf("pcm16 needs no decoder, got %v, %v", dec, err)
+	}
+	r.Header.Set(CodecHeader, "OPUS")
+	codec := requestCodec(r)
+	dec, err := h.newDecoder(codec, cfg.Audio.SampleRate, cfg.Audio.Channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != 1 || rates[0] != cfg.Audio.SampleRate {
+		t.Fatalf("expected a decoder at audio.sample_rate, got %v", rates)
+	}
+
+	session := &Session{Client: &Client{logger: h.logger}, codec: codec, decoder: dec}
+	if pcm, ok := h.decodeFrame(session, []byte{1, 2}); !ok || !bytes.Equal(pcm, []byte{1, 1, 2, 2}) {
+		t.Fatalf("unexpected decoded frame %v", pcm)
+	}
+	if _, ok := h.decodeFrame(session, nil); ok {
+		t.Fatal("expected a frame that cannot be decoded to be dropped")
+	}
+	var out strings.Builder
+	reg.WriteTo(&out)
+	if want := `pixa_uplink_decode_errors_total{codec="opus"} 1`; !strings.Contains(out.String(), want) {
+		t.Fatalf("expected %s in\n%s", want, out.String())
+	}
+	if rec := session.Record(time.Now(), nil); rec.AudioCodec != OpusCodec {
+		t.Fatalf("expected the record to keep the codec, got %q", rec.AudioCodec)
+	}
+
+	// G.711 needs no registered decoder
+	dec, err = NewHandler(cfg).newDecoder(G711ALawCodec, cfg.Audio.SampleRate, cfg.Audio.Channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session = &Session{Client: &Client{logger: h.logger}, codec: G711ALawCodec, decoder: dec}
+	if pcm, ok := h.decodeFrame(session, []byte{0xD5, 0x55}); !ok || !bytes.Equal(pcm, audio.Int16ToPCM([]int16{8, -8})) {
+		t.Fatalf("unexpected decoded A-law frame %v", pcm)
+	}
+	if codec := session.inputCodec(); codec != G711ALawCodec {
+		t.Fatalf("expected providers to be offered the device's codec, got %q", codec)
+	}
+
+	// so do 24 and 32 bit PCM
+	r = httptest.NewRequest(http.MethodGet, "/?codec=PCM24", nil)
+	if dec, err = h.newDecoder(requestCodec(r), cfg.Audio.SampleRate, cfg.Audio.Channels); err != nil {
+		t.Fatal(err)
+	}
+	session = &Session{Client: &Client{logger: h.logger}, codec: PCM24Codec, decoder: dec}
+	if pcm, ok := h.decodeFrame(session, []byte{0x80, 0x01, 0x00, 0x00, 0x00, 0x80}); !ok || !bytes.Equal(pcm, audio.Int16ToPCM([]int16{2, -32768})) {
+		t.Fatalf("unexpected decoded 24 bit frame %v", pcm)
+	}
+	if _, ok := h.decodeFrame(session, []byte{1, 2}); ok {
+		t.Fatal("expected a 24 bit frame with a partial sample to be dropped")
+	}
+	session.decoder, _ = h.newDecoder(Float32Codec, cfg.Audio.SampleRate, cfg.Audio.Channels)
+	frame := binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, math.Float32bits(0.5)), math.Float32bits(-2))
+	if pcm, ok := h.decodeFrame(session, frame); !ok || !bytes.Equal(pcm, audio.Int16ToPCM([]int16{16384, -32768})) {
+		t.Fatalf("unexpected decoded float32 frame %v", pcm)
+	}
+
+	// the pipeline leaving the audio unchanged, the samples go on without being rounded to 16 bit
+	frame = nil
+	for range 320 {
+		frame = binary.LittleEndian.AppendUint32(frame, math.Float32bits(0.1))
+	}
+	cfg.Audio.Channels, cfg.Jitter.Enabled = 1, true
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	session = &Session{Client: &Client{logger: h.logger}, clock: clk, codec: Float32Codec, decoder: session.decoder, sampleRate: 16000, playout: newJitterBuffer(cfg.Jitter)}
+	h.uplinkFrame(context.Background(), session, inboundFrame{data: frame}, clk.Now())
+	if frames := session.playout.frames; len(frames) != 1 || frames[0].audio.AsFloat32()[0] != 0.1 {
+		t.Fatalf("expected the float32 samples as they were sent, got %d frames", len(frames))
+	}
+}
+
+func TestInputSampleRate(t *testing.T) {
+	cfg := config.Default()
+	cfg.AIConfig.Provider = "fake"
+	providers := make(chan *fakeProvider, 1)
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(p ai.ProviderParams) (ai.AIClient, error) {
+		f := newFakeProvider(p)
+		providers <- f
+		return f, nil
+	})
+	h := NewHandler(cfg, WithProviderRegistry(reg))
+	for _, query := range []string{"?sample_rate=11025", "?sample_rate=fast"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected %s to be refused, got %d", query, w.Code)
+		}
+	}
+	if rate, err := h.inputSampleRate(httptest.NewRequest(http.MethodGet, "/", nil)); err != nil || rate != cfg.Audio.SampleRate {
+		t.Fatalf("expected devices to send audio at audio.sample_rate by default, got %d, %v", rate, err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	header := http.Header{InputSampleRateHeader: {"44100"}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var provider *fakeProvider
+	select {
+	case provider = <-providers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("provider not connected")
+	}
+	if provider.params.InputSampleRate != 44100 {
+		t.Fatalf("provider told the device's audio is at %d Hz", provider.params.InputSampleRate)
+	}
+	sessions := h.sessions.List()
+	if len(sessions) != 1 || sessions[0].Info().SampleRate != 44100 || sessions[0].Record(time.Now(), nil).SampleRate != 44100 {
+		t.Fatalf("expected the session to keep the device's sample rate")
+	}
+}
+
+func TestInputChannels(t *testing.T) {
+	cfg := config.Default()
+	cfg.Audio.Channels = 1
+	h := NewHandler(cfg)
+	for _, query := range []string{"?channels=0", "?channels=9", "?channels=two", "?channels=2&downmix=2", "?downmix=right", "?downmix=center"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected %s to be refused, got %d", query, w.Code)
+		}
+	}
+	if mix, err := h.inputDownmix(httptest.NewRequest(http.MethodGet, "/?channels=1", nil)); mix != nil || err != nil {
+		t.Fatalf("expected audio.channels to be passed through, got %v, %v", mix, err)
+	}
+
+	// stereo from an I2S board, its microphone on the right
+	stereo := audio.Int16ToPCM([]int16{0, 1000, 0, -1000})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(InputChannelsHeader, "2")
+	mix, err := h.inputDownmix(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mix.apply(stereo); !bytes.Equal(got, audio.Int16ToPCM([]int16{500, -500})) {
+		t.Fatalf("expected the channels to be averaged by default, got %v", got)
+	}
+	r.Header.Set(DownmixHeader, "Right")
+	if mix, err = h.inputDownmix(r); err != nil {
+		t.Fatal(err)
+	}
+	if got := mix.apply(stereo); !bytes.Equal(got, audio.Int16ToPCM([]int16{1000, -1000})) {
+		t.Fatalf("expected the right channel, got %v", got)
+	}
+	session := &Session{downmix: mix}
+	if rec := session.Record(time.Now(), nil); rec.InputChannels != 2 || rec.Downmix != "right" {
+		t.Fatalf("expected the record to keep the downmix, got %d, %q", rec.InputChannels, rec.Downmix)
+	}
+
+	// a downmix applies to devices sending audio.channels too
+	cfg.Audio.Channels, cfg.Audio.Downmix = 2, "left"
+	r = httptest.NewRequest(http.MethodGet, "/?downmix=0", nil)
+	if mix, err = h.inputDownmix(r); err != nil {
+		t.Fatal(err)
+	}
+	if got := mix.apply(audio.Int16ToPCM([]int16{7, 0})); !bytes.Equal(got, audio.Int16ToPCM([]int16{7, 7})) {
+		t.Fatalf("expected the left channel on both channels, got %v", got)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/?channels=4", nil)
+	if mix, err = h.inputDownmix(r); err != nil || mix.channel != 0 || mix.name() != "left" {
+		t.Fatalf("expected audio.downmix for devices that do not choose one, got %+v, %v", mix, err)
+	}
+}
+
+func TestFrameHeaders(t *testing.T) {
+	cfg := config.Default()
+	cfg.Websocket.FrameReorder = 2
+	reg := metrics.NewRegistry()
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	h := NewHandler(cfg, WithMetrics(reg), WithClock(clk))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?frame_format=2", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown frame format to be refused, got %d", w.Code)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if seq, err := h.frameFormat(r); seq != nil || err != nil {
+		t.Fatalf("expected raw frames by default, got %v, %v", seq, err)
+	}
+	r.Header.Set(FrameFormatHeader, "1")
+	seq, err := h.frameFormat(r)
+	if err != nil || seq == nil {
+		t.Fatalf("expected frame headers, got %v", err)
+	}
+
+	var latencies []time.Duration
+	session := &Session{Client: &Client{logger: h.logger}, clock: clk, codec: PCM16Codec, frameSeq: seq}
+	session.heat.onObserve = func(stage string, d time.Duration) {
+		if stage == StageDeviceUplink {
+			latencies = append(latencies, d)
+		}
+	}
+	frame := func(n uint32, codec byte, captured time.Time) []byte {
+		header := []byte{1, codec, 0, 2}
+		header = binary.BigEndian.AppendUint32(header, n)
+		var us uint64
+		if !captured.IsZero() {
+			us = uint64(captured.UnixMicro())
+		}
+		return append(binary.BigEndian.AppendUint64(header, us), byte(n), 0)
+	}
+	order := func(data []byte) []byte {
+		var got []byte
+		for _, f := range h.orderFrame(session, data) {
+			got = append(got, f.data[0])
+		}
+		return got
+	}
+
+	// 7 arrives after 8, and 10 is lost: the relay waits two frames for it before giving up
+	for _, tt := range []struct {
+		seq  uint32
+		want []byte
+	}{{6, []byte{6}}, {8, nil}, {7, []byte{7, 8}}, {7, nil}, {11, nil}, {12, nil}, {13, []byte{11, 12, 13}}, {9, nil}, {14, []byte{14}}} {
+		if got := order(frame(tt.seq, 0, clk.Now().Add(-40*time.Millisecond))); !bytes.Equal(got, tt.want) {
+			t.Fatalf("frame %d: got frames %v, want %v", tt.seq, got, tt.want)
+		}
+	}
+	if len(latencies) != 9 || latencies[0] != 40*time.Millisecond {
+		t.Fatalf("expected the uplink latency of every frame, got %v", latencies)
+	}
+
+	// a device starting its sequence again is followed
+	if got := order(frame(5000, 1, time.Time{})); !bytes.Equal(got, []byte{5000 % 256}) {
+		t.Fatalf("expected a restarted sequence to be followed, got %v", got)
+	}
+	for _, data := range [][]byte{frame(5001, 2, time.Time{}), frame(5001, 0, time.Time{})[:17], {2, 0}} {
+		if got := h.orderFrame(session, data); got != nil {
+			t.Fatalf("expected invalid frame %v to be dropped", data)
+		}
+	}
+	if len(latencies) != 9 {
+		t.Fatal("expected frames without a timestamp not to be timed")
+	}
+	if got := *session.Record(time.Now(), nil).Frames; got != (store.FrameStats{Lost: 2, Reordered: 1, Late: 2, Invalid: 3}) {
+		t.Fatalf("unexpected frame stats %+v", got)
+	}
+	var out strings.Builder
+	reg.WriteTo(&out)
+	for _, want := range []string{`pixa_uplink_frame_anomalies_total{kind="lost"} 2`, `pixa_uplink_frame_anomalies_total{kind="invalid"} 3`} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %s in\n%s", want, out.String())
+		}
+	}
+}
+
+func TestJitterBuffer(t *testing.T) {
+	cfg := config.Default()
+	if newJitterBuffer(cfg.Jitter) != nil {
+		t.Fatal("expected no jitter buffer by default")
+	}
+	cfg.Jitter.Enabled, cfg.Jitter.Delay, cfg.Jitter.MaxDelay = true, "60ms", "200ms"
+	j := newJitterBuffer(cfg.Jitter)
+	start := time.Unix(1700000000, 0)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	// 20ms frames at 16 kHz
+	frame := func() audio.Audio { return audio.FromPCM16(make([]byte, 640), 16000, 1) }
+
+	// five frames captured 20ms apart arrive in a burst 90ms after the first
+	for i, arrival := range []int{0, 90, 90, 90, 90} {
+		if late, _ := j.push(at(arrival), frame(), time.Time{}); late != (i == 1) {
+			t.Fatalf("frame %d: late %v", i, late)
+		}
+	}
+	if due, ok := j.next(); !ok || !due.Equal(at(60)) {
+		t.Fatalf("expected the first frame due after the delay, got %v", due)
+	}
+	// frame 1 was due before it came, so the buffer started over from it
+	var dues []time.Time
+	for _, f := range j.frames {
+		dues = append(dues, f.due)
+	}
+	if want := []time.Time{at(60), at(150), at(170), at(190), at(210)}; !slices.EqualFunc(dues, want, time.Time.Equal) {
+		t.Fatalf("unexpected playout times %v, want %v", dues, want)
+	}
+	if got := j.pop(at(180)); len(got) != 3 {
+		t.Fatalf("expected three frames due, got %d", len(got))
+	}
+	if _, held := j.push(at(180), frame(), time.Time{}); held != 60*time.Millisecond {
+		t.Fatalf("expected 60ms held, got %v", held)
+	}
+
+	// capture times place frames, and a device clock running ahead is caught up on
+	j = newJitterBuffer(cfg.Jitter)
+	j.push(at(0), frame(), at(-30))
+	j.push(at(10), frame(), at(-10))
+	j.push(at(20), frame(), at(500))
+	dues = dues[:0]
+	for _, f := range j.frames {
+		dues = append(dues, f.due)
+	}
+	if want := []time.Time{at(60), at(80), at(80)}; !slices.EqualFunc(dues, want, time.Time.Equal) {
+		t.Fatalf("unexpected playout times %v, want %v", dues, want)
+	}
+
+	reg := metrics.NewRegistry()
+	h := NewHandler(cfg, WithMetrics(reg))
+	session := &Session{clock: clock.NewFake(start), playout: newJitterBuffer(cfg.Jitter)}
+	if !h.bufferAudio(session, frame(), time.Time{}) || h.bufferAudio(&Session{clock: session.clock}, frame(), time.Time{}) {
+		t.Fatal("expected audio to be held only with a jitter buffer")
+	}
+	var out strings.Builder
+	reg.WriteTo(&out)
+	if want := `pixa_jitter_buffer_depth_seconds_count 1`; !strings.Contains(out.String(), want) {
+		t.Fatalf("expected %s in\n%s", want, out.String())
+	}
+}
+
+func TestPacketLossConcealment(t *testing.T) {
+	cfg := config.Default()
+	if newConcealer(cfg.PLC, &frameSequence{}, 16000, 1) != nil {
+		t.Fatal("expected no concealment by default")
+	}
+	cfg.Audio.Channels = 1
+	cfg.PLC.Enabled, cfg.PLC.Fade = true, "20ms"
+	cfg.Jitter.Enabled = true
+	if newConcealer(cfg.PLC, nil, 16000, 1) != nil {
+		t.Fatal("expected no concealment of raw frames")
+	}
+	reg := metrics.NewRegistry()
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	h := NewHandler(cfg, WithMetrics(reg), WithClock(clk))
+	seq := &frameSequence{held: make(map[uint32]inboundFrame)}
+	session := &Session{
+		Client: &Client{logger: h.logger}, clock: clk, codec: PCM16Codec, sampleRate: 16000, frameSeq: seq,
+		plc: newConcealer(cfg.PLC, seq, 16000, 1), playout: newJitterBuffer(cfg.Jitter),
+	}
+	// 20ms frames of a 200 Hz tone
+	tone := func(i int) int16 { return int16(10000 * math.Sin(2*math.Pi*200*float64(i)/16000)) }
+	frame := func(n uint32) []byte {
+		samples := make([]int16, 320)
+		for i := range samples {
+			samples[i] = tone(int(n)*320 + i)
+		}
+		header := binary.BigEndian.AppendUint32([]byte{1, 0, 2, 128}, n)
+		return append(binary.BigEndian.AppendUint64(header, 0), audio.Int16ToPCM(samples)...)
+	}
+
+	// frame 2 is lost
+	for _, n := range []uint32{0, 1, 3} {
+		for _, f := range h.orderFrame(session, frame(n)) {
+			h.uplinkFrame(context.Background(), session, f, clk.Now())
+		}
+	}
+	frames := session.playout.frames
+	if len(frames) != 4 || frames[2].duration != 20*time.Millisecond {
+		t.Fatalf("expected 20ms of concealment between frames 1 and 3, got %d frames", len(frames))
+	}
+	gap, _ := audio.Pcm16ToInt16Slice(frames[2].audio.AsPCM16())
+	if got, want := gap[0], tone(640); math.Abs(float64(got)-float64(want)) > 10 {
+		t.Fatalf("expected the gap to continue the tone at %d, got %d", want, got)
+	}
+	if last := gap[len(gap)-1]; math.Abs(float64(last)) > 100 {
+		t.Fatalf("expected the gap to fade out, ended at %d", last)
+	}
+	var out strings.Builder
+	reg.WriteTo(&out)
+	if want := "pixa_plc_concealed_seconds_total 0.02"; !strings.Contains(out.String(), want) {
+		t.Fatalf("expected %s in\n%s", want, out.String())
+	}
+}
+
+func TestListen(t *testing.T) {
+	cfg := config.Default()
+	reg := metrics.NewRegistry()
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	h := NewHandler(cfg, WithMetrics(reg), WithClock(clk))
+	session := h.sessions.create(&Client{config: cfg, logger: h.logger}, "", "", nil, h.nextSeed(), clk)
+	for url, want := range map[string]int{"/": http.StatusNotFound, "/?format=ogg": http.StatusNotAcceptable, "/?format=mp3": http.StatusBadRequest} {
+		id := session.ID
+		if want == http.StatusNotFound {
+			id = "unknown"
+		}
+		w := httptest.NewRecorder()
+		h.Listen(w, httptest.NewRequest(http.MethodGet, url, nil), id)
+		if w.Code != want {
+			t.Fatalf("%s: got %d, want %d", url, w.Code, want)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Listen(listenRecorder{pw, http.Header{}}, httptest.NewRequest(http.MethodGet, "/", nil), session.ID)
+	}()
+	chunk := func() []int16 {
+		for clk.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clk.Advance(listenChunk)
+		pcm := make([]byte, 640)
+		if _, err := io.ReadFull(pr, pcm); err != nil {
+			t.Fatal(err)
+		}
+		samples, _ := audio.Pcm16ToInt16Slice(pcm)
+		return samples
+	}
+	for clk.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// stereo audio of the user, and an answer at 24 kHz
+	session.live.uplink(audio.FromPCM16(audio.Int16ToPCM(slices.Repeat([]int16{1000}, 2*1600)), 16000, 2))
+	session.live.downlink(audio.Int16ToPCM(slices.Repeat([]int16{500}, 2400)), 24000)
+	header := make([]byte, 44)
+	clk.Advance(listenDelay)
+	if _, err := io.ReadFull(pr, header); err != nil || string(header[:4]) != "RIFF" {
+		t.Fatalf("expected a WAV header, got %q, %v", header, err)
+	}
+	pcm := make([]byte, 640)
+	io.ReadFull(pr, pcm)
+	samples, _ := audio.Pcm16ToInt16Slice(pcm)
+	if s := samples[len(samples)/2]; s < 1495 || s > 1500 {
+		t.Fatalf("expected the user and the answer mixed, got %d", s)
+	}
+	// the answer stops when the user interrupts it
+	session.live.stopPlayback()
+	if s := chunk()[100]; s < 995 || s > 1000 {
+		t.Fatalf("expected the user alone after an interruption, got %d", s)
+	}
+	var out strings.Builder
+	reg.WriteTo(&out)
+	if !strings.Contains(out.String(), "pixa_admin_listeners 1") {
+		t.Fatalf("expected a listener in\n%s", out.String())
+	}
+
+	// the stream ends with the session
+	go io.Copy(io.Discard, pr)
+	session.live.close()
+	<-done
+	h.Listen(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), session.ID)
+	out.Reset()
+	reg.WriteTo(&out)
+	if !strings.Contains(out.String(), "pixa_admin_listeners 0") {
+		t.Fatalf("expected no listener in\n%s", out.String())
+	}
+}
+
+func TestListenOgg(t *testing.T) {
+	cfg := config.Default()
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	var frames int
+	h := NewHandler(cfg, WithClock(clk), WithOpusEncoder(func(sampleRate, channels int) (audio.Encoder, error) {
+		if sampleRate != ListenSampleRate || channels != 1 {
+			t.Errorf("expected an encoder of mono audio at %d Hz, got %d channels at %d Hz", ListenSampleRate, channels, sampleRate)
+		}
+		return fakeEncoder{&frames}, nil
+	}))
+	session := h.sessions.create(&Client{config: cfg, logger: h.logger}, "", "", nil, h.nextSeed(), clk)
+
+	pr, pw := io.Pipe()
+	header := http.Header{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Listen(listenRecorder{pw, header}, httptest.NewRequest(http.MethodGet, "/?format=ogg", nil), session.ID)
+	}()
+	for clk.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	session.live.uplink(audio.FromPCM16(audio.Int16ToPCM(slices.Repeat([]int16{1000}, 1600)), 16000, 1))
+	clk.Advance(listenDelay)
+
+	// the Opus headers come first, then a packet of the encoder for every 20ms
+	page := func() []byte {
+		head := make([]byte, 27)
+		if _, err := io.ReadFull(pr, head); err != nil || string(head[:4]) != "OggS" {
+			t.Fatalf("expected an Ogg page, got %q, %v", head, err)
+		}
+		segments := make([]byte, head[26])
+		io.ReadFull(pr, segments)
+		size := 0
+		for _, n := range segments {
+			size += int(n)
+		}
+		packet := make([]byte, size)
+		io.ReadFull(pr, packet)
+		return packet
+	}
+	if p := page(); string(p[:8]) != "OpusHead" {
+		t.Fatalf("expected OpusHead, got %q", p)
+	}
+	if p := page(); string(p[:8]) != "OpusTags" {
+		t.Fatalf("expected OpusTags, got %q", p)
+	}
+	if p := page(); !bytes.Equal(p, audio.Int16ToPCM([]int16{1000})) || frames != 1 {
+		t.Fatalf("expected the packet of the user's audio, got %v after %d frames", p, frames)
+	}
+	if ct := header.Get("Content-Type"); ct != "audio/ogg" {
+		t.Fatalf("expected audio/ogg, got %q", ct)
+	}
+
+	go io.Copy(io.Discard, pr)
+	session.live.close()
+	<-done
+}
+
+// listenRecorder is a response writer streaming to a pipe, as a supervisor's browser reads it
+type listenRecorder struct {
+	*io.PipeWriter
+	header http.Header
+}
+
+func (l listenRecorder) Header() http.Header { return l.header }
+func (l listenRecorder) WriteHeader(int)     {}
+
+type fakeDenoiser struct{}
+
+func (fakeDenoiser) Denoise(pcm []byte) []byte {
+	return make([]byte, len(pcm))
+}
+
+func TestDenoise(t *testing.T) {
+	cfg := config.Default()
+	off, on := false, true
+	cfg.DeviceProfiles = map[string]config.DeviceProfile{"quiet": {Denoise: &off}, "kitchen": {Denoise: &on}}
+	reg := metrics.NewRegistry()
+	var setUp error
+	h := NewHandler(cfg, WithMetrics(reg), WithDenoiser(func(sampleRate, channels int) (audio.Denoiser, error) {
+		if sampleRate != 16000 {
+			t.Errorf("denoiser set up at %d Hz, want the device's rate", sampleRate)
+		}
+		return fakeDenoiser{}, setUp
+	}))
+	newSession := func(profile string) *Session {
+		s := &Session{Client: &Client{logger: h.logger}, deviceProfile: profile}
+		s.denoiser = h.newDenoiser(s, 16000)
+		return s
+	}
+
+	// only the profile that asks for it is denoised while denoise.enabled is off
+	if s := newSession(""); s.denoiser != nil || !bytes.Equal(s.denoise([]byte{1, 2}), []byte{1, 2}) {
+		t.Fatal("expected audio to be relayed as it is by default")
+	}
+	s := newSession("kitchen")
+	if !bytes.Equal(s.denoise([]byte{1, 2}), []byte{0, 0}) {
+		t.Fatal("expected the kitchen profile to be denoised")
+	}
+	cfg.Denoise.Enabled = true
+	if s := newSession("quiet"); s.denoiser != nil {
+		t.Fatal("expected a profile to turn denoising off")
+	}
+	if s := newSession(""); s.denoiser == nil {
+		t.Fatal("expected denoise.enabled to denoise sessions without a profile")
+	}
+	// a denoiser that cannot be set up leaves the audio as it is
+	setUp = errors.New("no model")
+	if s := newSession("kitchen"); s.denoiser != nil {
+		t.Fatal("expected no denoiser when it could not be set up")
+	}
+	var out strings.Builder
+	reg.WriteTo(&out)
+	for _, want := range []string{`pixa_denoised_sessions_total{outcome="ok"} 2`, `pixa_denoised_sessions_total{outcome="error"} 1`} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %s in\n%s", want, out.String())
+		}
+	}
+
+	// without a denoiser plugged in, the built-in one is used
+	if dec := NewHandler(cfg).newDenoiser(&Session{Client: &Client{logger: h.logger}}, 16000); dec == nil {
+		t.Fatal("expected the built-in denoiser")
+	} else if _, ok := dec.(*audio.SpectralDenoiser); !ok {
+		t.Fatalf("unexpected denoiser %T", dec)
+	}
+}
+
+func TestRegionPinning(t *testing.T) {
+	cfg := config.Default()
+	cfg.Regions = map[string]config.RegionConfig{"eu": {TraceDir: t.TempDir()}}
+	cfg.Tenants = map[string]config.TenantConfig{"acme": {Region: "eu"}, "initech": {Region: "apac"}}
+	reg := metrics.NewRegistry()
+	regionErr := errors.New("bucket unreachable")
+	h := NewHandler(cfg, WithMetrics(reg), WithRegionCheck(func(ctx context.Context, region string) error {
+		if region != "eu" {
+			t.Errorf("unexpected region %s checked", region)
+		}
+		return regionErr
+	}))
+
+	connect := func(tenant string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(TenantIDHeader, tenant)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	// a region that is down, or not configured at all, refuses its tenants' sessions
+	for _, tenant := range []string{"acme", "initech"} {
+		if code := connect(tenant); code != http.StatusServiceUnavailable {
+			t.Fatalf("expected the sessions of %s to be refused, got %d", tenant, code)
+		}
+	}
+	if code := connect("globex"); code == http.StatusServiceUnavailable {
+		t.Fatal("expected tenants not pinned to a region to connect")
+	}
+	regionErr = nil
+	if code := connect("acme"); code == http.StatusServiceUnavailable {
+		t.Fatal("expected the sessions of an available region to start")
+	}
+	if dir := cfg.TraceDirFor("acme"); dir != cfg.Regions["eu"].TraceDir {
+		t.Fatalf("expected traces of the region to be kept in its directory, got %s", dir)
+	}
+
+	var out strings.Builder
+	reg.WriteTo(&out)
+	for _, want := range []string{`pixa_region_refusals_total{region="eu"} 1`, `pixa_region_refusals_total{region="apac"} 1`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %s in\n%s", want, out.String())
+		}
+	}
+}
+
+func TestConnectInfo(t *testing.T) {
+	cfg := config.Default()
+	cfg.Connect.URL = "wss://media.example.com/"
+	reg := metrics.NewRegistry()
+	authenticate := Middleware{OnConnect: func(r *http.Request) (*http.Request, error) {
+		if r.Header.Get("Authorization") != "Bearer device-key" {
+			return r, nil
+		}
+		return r.WithContext(WithTenantID(WithDeviceID(r.Context(), "speaker-1"), "acme")), nil
+	}}
+	expires := time.Now().Add(time.Minute)
+	h := NewHandler(cfg, WithMetrics(reg), WithMiddleware(authenticate),
+		WithDecoder("opus", func(sampleRate, channels int) (audio.Decoder, error) { return nil, nil }),
+		WithConnectTokens(func(deviceID, tenantID string) (ConnectToken, error) {
+			return ConnectToken{URL: "wss://media.example.com/?token=" + deviceID + "." + tenantID, Token: deviceID + "." + tenantID, ExpiresAt: expires}, nil
+		}))
+
+	// devices claiming an identity they did not authenticate get no token
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/connect/info", nil)
+	r.Header.Set(DeviceIDHeader, "speaker-1")
+	h.ConnectInfoHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected an unauthenticated device to be refused, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/connect/info", nil)
+	r.Header.Set("Authorization", "Bearer device-key")
+	h.ConnectInfoHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	var info ConnectInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Token != "speaker-1.acme" || info.URL != "wss://media.example.com/?token=speaker-1.acme" || info.TokenExpiry == nil || !info.TokenExpiry.Equal(expires) {
+		t.Fatalf("unexpected token %+v", info)
+	}
+	if info.ProtocolVersion == 0 || info.Audio.SampleRate != cfg.Audio.SampleRate || info.Audio.Codec != PCM16Codec {
+		t.Fatalf("unexpected connection parameters %+v", info)
+	}
+	if want := []string{PCM16Codec, Float32Codec, G711ALawCodec, G711ULawCodec, PCM24Codec, PCM32Codec, OpusCodec}; !slices.Equal(info.Audio.Codecs, want) {
+		t.Fatalf("expected codecs %v, got %v", want, info.Audio.Codecs)
+	}
+	if !slices.Contains(info.Audio.SampleRates, cfg.Audio.SampleRate) || !slices.Contains(info.Audio.SampleRates, 8000) {
+		t.Fatalf("unexpected sample rates %v", info.Audio.SampleRates)
+	}
+
+	// without connect.url, devices are sent to the host they asked
+	cfg.Connect.URL = ""
+	r = httptest.NewRequest(http.MethodGet, "http://relay.example.com/connect/info", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	if got := NewHandler(cfg).connectURL(r); got != "wss://relay.example.com/" {
+		t.Fatalf("unexpected connect URL %q", got)
+	}
+
+	var out strings.Builder
+	reg.WriteTo(&out)
+	for _, want := range []string{`pixa_connect_info_requests_total{outcome="ok"} 1`, `pixa_connect_info_requests_total{outcome="rejected"} 1`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %s in\n%s", want, out.String())
+		}
+	}
+}
+
+// fakeEncoder encodes a frame to its first sample, and counts the frames it encoded
+type fakeEncoder struct{ frames *int }
+
+func (e fakeEncoder) Encode(pcm []byte) ([]byte, error) {
+	*e.frames++
+	return pcm[:2], nil
+}
+
+func TestDownlinkCodec(t *testing.T) {
+	cfg := config.Default()
+	r := httptest.NewRequest(http.MethodGet, "/?downlink_codec=opus", nil)
+	if codec, enc := NewHandler(cfg).downlinkCodec(r, cfg.Audio.SampleRate); codec != PCM16Codec || enc != nil {
+		t.Fatalf("expected pcm16 without an Opus encoder, got %q", codec)
+	}
+
+	var frames int
+	var rates []int
+	h := NewHandler(cfg, WithOpusEncoder(func(sampleRate, channels int) (audio.Encoder, error) {
+		rates = append(rates, sampleRate)
+		return fakeEncoder{&frames}, nil
+	}))
+	if codec, _ := h.downlinkCodec(httptest.NewRequest(http.MethodGet, "/", nil), cfg.Audio.SampleRate); codec != PCM16Codec {
+		t.Fatalf("expected answers in pcm16 by default, got %q", codec)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(DownlinkCodecHeader, "Opus")
+	codec, enc := h.downlinkCodec(r, cfg.Audio.SampleRate)
+	if codec != OpusCodec || enc == nil || len(rates) != 1 || rates[0] != cfg.Audio.SampleRate {
+		t.Fatalf("expected an Opus encoder at audio.sample_rate, got %q at %v", codec, rates)
+	}
+
+	sessions := make(chan *Session, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sessions <- h.sessions.create(NewClient(conn, h.logger, cfg), "", "", nil, h.nextSeed(), h.clock)
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session := <-sessions
+	session.downlinkCodec, session.downlinkEnc = codec, enc
+
+	// 20ms is 640 bytes at 16 kHz: the first write completes one packet and holds 360 bytes back,
+	// which the end of the answer pads to a second
+	frame := cfg.Audio.SampleRate / 50 * 2
+	pcm := make([]byte, frame+360)
+	pcm[frame] = 7
+	if sent, err := h.writeAudio(session, pcm, sourceAnswer, false); !sent || err != nil {
+		t.Fatalf("expected the audio to be sent, got %v, %v", sent, err)
+	}
+	if sent, err := h.writeAudio(session, make([]byte, 100), sourceAnswer, true); !sent || err != nil {
+		t.Fatalf("expected the audio to be sent, got %v, %v", sent, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i, want := range [][]byte{{0, 0}, {7, 0}} {
+		if typ, packet, err := conn.ReadMessage(); err != nil || typ != websocket.BinaryMessage || !bytes.Equal(packet, want) {
+			t.Fatalf("expected packet %d to be %v, got %v (%v)", i, want, packet, err)
+		}
+	}
+	if frames != 2 {
+		t.Fatalf("expected 2 frames encoded, got %d", frames)
+	}
+
+	// an interruption drops the audio held back
+	h.writeAudio(session, make([]byte, 100), sourceAnswer, false)
+	enc.reset()
+	h.writeAudio(session, make([]byte, 100), sourceAnswer, true)
+	if frames != 3 {
+		t.Fatalf("expected the interrupted audio to be dropped, got %d frames", frames)
+	}
+	conn.ReadMessage() // the packet of the answer after the interruption
+
+	// a filler playing over an answer gets packets of its own: the answer's audio held back is
+	// finished before the filler's, and the filler's before the answer goes on
+	answer, filler, rest := make([]byte, 360), make([]byte, 1000), make([]byte, frame)
+	answer[0], filler[0], filler[frame], rest[0] = 9, 5, 6, 8
+	h.writeAudio(session, answer, sourceAnswer, false)
+	h.writeAudio(session, filler, sourceFiller, false)
+	h.writeAudio(session, rest, sourceAnswer, true)
+	for i, want := range [][]byte{{9, 0}, {5, 0}, {6, 0}, {8, 0}} {
+		if _, packet, err := conn.ReadMessage(); err != nil || !bytes.Equal(packet, want) {
+			t.Fatalf("expected packet %d to be %v, got %v (%v)", i, want, packet, err)
+		}
+	}
+	if frames != 7 {
+		t.Fatalf("expected 7 frames encoded, got %d", frames)
+	}
+
+	// an answer of whole chunks is ended by the flush after its last chunk, which pads the 512
+	// bytes of the last packet
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ab := utils.NewBufferSizeController(downlinkChunk)
+	go h.relayAnswers(ctx, session, &ab)
+	answer = make([]byte, 2*downlinkChunk)
+	answer[len(answer)-512] = 4
+	ab.Write(answer)
+	ab.Flush()
+	for packets := 0; packets < 13; {
+		typ, packet, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("expected 13 packets of the answer, got %d (%v)", packets, err)
+		}
+		if typ != websocket.BinaryMessage {
+			continue
+		}
+		if packets++; packets == 13 && !bytes.Equal(packet, []byte{4, 0}) {
+			t.Fatalf("expected the last packet to hold the end of the answer, got %v", packet)
+		}
+	}
+	cancel()
+
+	// a new downlink rate gets a new encoder
+	session.setDownlinkSampleRate(8000)
+	h.writeAudio(session, make([]byte, 320), sourceAnswer, false)
+	if len(rates) != 2 || rates[1] != 8000 || frames != 21 {
+		t.Fatalf("expected an encoder at the new rate, got %v and %d frames", rates, frames)
+	}
+}
+
+func TestAnswerResampler(t *testing.T) {
+	// a 440 Hz sine from a 24 kHz provider, in chunks of uneven lengths
+	sine := func(from, n int) []byte {
+		pcm := make([]byte, 0, n*2)
+		for i := from; i < from+n; i++ {
+			pcm = binary.LittleEndian.AppendUint16(pcm, uint16(int16(16000*math.Sin(2*math.Pi*440*float64(i)/24000))))
+		}
+		return pcm
+	}
+	var r answerResampler
+	var out []int16
+	at := 0
+	for _, n := range []int{480, 333, 1021, 7, 2400, 999} {
+		a := r.resample(audio.FromPCM16(sine(at, n), 24000, 1), 16000, audio.ResampleLinear)
+		for pcm := a.AsPCM16(); len(pcm) >= 2; pcm = pcm[2:] {
+			out = append(out, int16(binary.LittleEndian.Uint16(pcm)))
+		}
+		at += n
+	}
+	if want := at * 16000 / 24000; len(out) < want-1 || len(out) > want {
+		t.Fatalf("expected %d samples at 16 kHz, got %d", want, len(out))
+	}
+	// no step between two samples is larger than the sine's steepest at 16 kHz, at the joins of the
+	// chunks as elsewhere
+	steepest := 16000 * 2 * math.Pi * 440 / 16000
+	for i := 1; i < len(out); i++ {
+		if d := math.Abs(float64(out[i]) - float64(out[i-1])); d > steepest*1.05 {
+			t.Fatalf("discontinuity of %.0f at sample %d", d, i)
+		}
+	}
+
+}
+
+func TestProviderFrameLog(t *testing.T) {
+	cfg := config.Default()
+	cfg.ProviderLog = config.ProviderLogConfig{Enabled: true, SessionIDs: []string{"s1"}}
+	session := &Session{ID: "s1"}
+	if NewHandler(cfg).providerFrameLog(session) != nil {
+		t.Fatal("expected no frame log without a logger")
+	}
+	h := NewHandler(cfg, WithProviderFrameLog(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if h.providerFrameLog(session) == nil {
+		t.Fatal("expected a listed session to be logged")
+	}
+	if h.providerFrameLog(&Session{ID: "s2"}) != nil {
+		t.Fatal("expected no other session logged at a sample of 0")
+	}
+	var logged int
+	cfg.ProviderLog.Sample = 0.25
+	for i := range 1000 {
+		if h.providerFrameLog(&Session{ID: "session-" + strconv.Itoa(i)}) != nil {
+			logged++
+		}
+	}
+	if logged < 200 || logged > 300 {
+		t.Fatalf("expected about a quarter of the sessions logged, got %d of 1000", logged)
+	}
+}
+
+func TestDevicePresence(t *testing.T) {
+	cfg := config.Default()
+	cfg.AIConfig.Provider = "fake"
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(p ai.ProviderParams) (ai.AIClient, error) { return newFakeProvider(p), nil })
+	devices := store.NewMemoryDeviceStore(5)
+	h := NewHandler(cfg, WithProviderRegistry(reg), WithDeviceStore(devices))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), http.Header{DeviceIDHeader: {"lamp-1"}, FirmwareVersionHeader: {"2.1.0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	d, err := devices.GetDevice(context.Background(), "lamp-1")
+	for err != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		d, err = devices.GetDevice(context.Background(), "lamp-1")
+	}
+	if err != nil || d.Online != 1 || d.History[0].FirmwareVersion != "2.1.0" {
+		t.Fatalf("expected the device online, got %+v, %v", d, err)
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.Close()
+	for time.Now().Before(deadline) {
+		if d, _ := devices.GetDevice(context.Background(), "lamp-1"); d.Online == 0 {
+			if c := d.History[0]; c.DisconnectedAt == nil || c.Error != "" {
+				t.Fatalf("unexpected connection %+v", c)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expected the device offline once its session ended")
+}
+
+func TestVADGate(t *testing.T) {
+	cfg := config.Default()
+	cfg.VADGate.Enabled = true
+	cfg.Audio.Channels = 1
+	if newVADGate(cfg, cfg.Endpointing, true, 16000) != nil {
+		t.Fatal("expected push-to-talk devices to be gated by their button")
+	}
+	g := newVADGate(cfg, cfg.Endpointing, false, 16000)
+	// 20ms frames of faint noise or speech
+	frame := func(amplitude float64) []byte {
+		pcm := make([]byte, 640)
+		for i := 0; i < 320; i++ {
+			binary.LittleEndian.PutUint16(pcm[2*i:], uint16(int16(amplitude*math.Sin(float64(i)*0.3))))
+		}
+		return pcm
+	}
+	var sent int
+	var dropped time.Duration
+	feed := func(amplitude float64, frames int) {
+		for range frames {
+			out, d := g.pass(frame(amplitude))
+			sent += len(out)
+			dropped += d
+		}
+	}
+
+	feed(30, 50)
+	if sent != 0 || dropped != 700*time.Millisecond {
+		t.Fatalf("expected the noise held back, beyond the pre-roll dropped, got %d bytes sent and %s dropped", sent, dropped)
+	}
+	feed(6000, 1)
+	if sent != 15*640+640 {
+		t.Fatalf("expected speech sent with 300ms of pre-roll, got %d bytes", sent)
+	}
+	// the silence after speech is sent for the provider to end the turn, 500ms and a margin
+	sent = 0
+	feed(30, 100)
+	if want := 35 * 640; sent != want {
+		t.Fatalf("expected %d bytes of hangover, got %d", want, sent)
+	}
+	if out, _ := (*vadGate)(nil).pass(frame(30)); len(out) != 640 {
+		t.Fatal("expected ungated sessions to send everything")
+	}
+}
+
+func TestPipelineScheduler(t *testing.T) {
+	reg := metrics.NewRegistry()
+	p := newPipelineScheduler(config.PipelineSchedulerConfig{Enabled: true, Slots: 1, StarvedAfter: "100ms"}, newHandlerMetrics(reg))
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+	p.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		now = now.Add(d)
+		mu.Unlock()
+	}
+	chatty, quiet := &Session{ID: "chatty"}, &Session{ID: "quiet"}
+
+	// the chatty session used the pipeline for 300ms of the window, the quiet one not at all
+	done := p.run(chatty)
+	advance(300 * time.Millisecond)
+	done()
+	done = p.run(chatty)
+
+	// the chatty session gets in line first
+	order := make(chan string, 2)
+	for i, s := range []*Session{chatty, quiet} {
+		go func() {
+			p.run(s)()
+			order <- s.ID
+		}()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			p.mu.Lock()
+			queued := len(p.waiting)
+			p.mu.Unlock()
+			if queued > i {
+				break
+			}
+		}
+	}
+	advance(200 * time.Millisecond)
+	done()
+	if first, second := <-order, <-order; first != "quiet" || second != "chatty" {
+		t.Fatalf("expected the quiet session served first, got %s then %s", first, second)
+	}
+	var out strings.Builder
+	reg.WriteTo(&out)
+	if !strings.Contains(out.String(), "pixa_pipeline_starved_frames_total 2") {
+		t.Fatalf("expected the frames that waited 200ms counted as starved in\n%s", out.String())
+	}
+	(*pipelineScheduler)(nil).run(quiet)()
+}
+
+func TestReadPumpCancellation(t *testing.T) {
+	cfg := config.Default()
+	h := NewHandler(cfg)
+	sessions := make(chan *Session, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sessions <- h.sessions.create(NewClient(conn, h.logger, cfg), "", "", nil, h.nextSeed(), h.clock)
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session := <-sessions
+
+	// the device sends nothing, so the read pump is blocked reading when ctx is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- h.readPump(ctx, session) }()
+	time.Sleep(20 * time.Millisecond)
+	cancelled := time.Now()
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the read pump to return with ctx, got %v", err)
+		}
+		if waited := time.Since(cancelled); waited > 100*time.Millisecond {
+			t.Fatalf("read pump took %s to stop", waited)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the read pump to stop without a message from the device")
+	}
+}
+
+func TestSessionCloseLatency(t *testing.T) {
+	cfg := config.Default()
+	cfg.AIConfig.Provider = "fake"
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(p ai.ProviderParams) (ai.AIClient, error) { return newFakeProvider(p), nil })
+	h := NewHandler(cfg, WithProviderRegistry(reg))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.sessions.List()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sessions := h.sessions.List()
+	if len(sessions) != 1 {
+		t.Fatal("expected a session")
+	}
+
+	// a silent device is closed at once, not when it next sends something
+	closed := time.Now()
+	sessions[0].Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Fatalf("expected the connection closed, got %v", err)
+			}
+			break
+		}
+	}
+	if waited := time.Since(closed); waited > 500*time.Millisecond {
+		t.Fatalf("session took %s to close", waited)
+	}
+	for len(h.sessions.List()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(h.sessions.List()) > 0 {
+		t.Fatal("expected the session torn down")
+	}
+}
+
+func TestVoiceGain(t *testing.T) {
+	cfg := config.Default()
+	cfg.VoiceGain.Enabled = true
+	cfg.VoiceGain.Gains = map[string]float64{"Alloy": 6}
+	reg := metrics.NewRegistry()
+	v := newVoiceLevels(cfg.VoiceGain, newHandlerMetrics(reg))
+	// 100ms of answer audio at 16 kHz, at a level in dBFS
+	answer := func(dbfs float64) []byte {
+		pcm := make([]byte, 3200)
+		amplitude := fromDBFS(dbfs)
+		for i := 0; i < 1600; i++ {
+			binary.LittleEndian.PutUint16(pcm[2*i:], uint16(int16(amplitude*float64(1-2*(i%2)))))
+		}
+		return pcm
+	}
+
+	if level := toDBFS(rms(v.apply("ALLOY", answer(-26), 16000))); math.Abs(level+20) > 0.1 {
+		t.Fatalf("expected the configured gain of 6 dB, got %.1f dBFS", level)
+	}
+	var out []byte
+	for range 19 {
+		out = v.apply("", answer(-30), 16000)
+	}
+	if level := toDBFS(rms(out)); math.Abs(level+30) > 0.1 {
+		t.Fatalf("expected a voice to be left alone until measured, got %.1f dBFS", level)
+	}
+	// pauses are not measured
+	if silence := v.apply("", make([]byte, 3200), 16000); rms(silence) != 0 {
+		t.Fatal("silence amplified")
+	}
+	out = v.apply("", answer(-30), 16000)
+	if level := toDBFS(rms(out)); math.Abs(level+20) > 0.1 {
+		t.Fatalf("expected the measured voice brought to -20 dBFS, got %.1f dBFS", level)
+	}
+	for range 20 {
+		out = v.apply("shimmer", answer(-45), 16000)
+	}
+	if level := toDBFS(rms(out)); math.Abs(level+33) > 0.1 {
+		t.Fatalf("expected a quiet voice amplified by at most 12 dB, got %.1f dBFS", level)
+	}
+
+	h := NewHandler(cfg)
+	session := h.sessions.create(&Client{config: cfg, logger: h.logger}, "", "", nil, h.nextSeed(), h.clock)
+	session.profile.Store(&ProviderProfile{Voice: "alloy"})
+	if voice := h.voice(session); voice != "alloy" {
+		t.Fatalf("expected the voice of the session's profile, got %q", voice)
+	}
+
+	var text strings.Builder
+	reg.WriteTo(&text)
+	for _, want := range []string{
+		`pixa_voice_gain_db{voice="alloy"} 6`,
+		`pixa_voice_gain_db{voice="default"} 10`,
+		`pixa_voice_gain_db{voice="shimmer"} 12`,
+	} {
+		if !strings.Contains(text.String(), want) {
+			t.Fatalf("expected %s in\n%s", want, text.String())
+		}
+	}
+}
+
+func TestControlValidation(t *testing.T) {
+	for _, tc := range []struct {
+		msg      string
+		version  int
+		code     string
+		path     string
+		expected string
+	}{
+		{`{"type":"playback.ack","played_ms":1200}`, 1, "", "", ""},
+		{`{"type":"playback.ack","played_ms":1200,"added_later":true}`, 1, "", "", ""},
+		{`[1,2]`, 1, controlInvalidJSON, "", "object"},
+		{`{"played_ms":1200}`, 1, controlMissingField, "/type", "string"},
+		{`{"type":"playback.nack"}`, 1, controlUnknownType, "/type", ""},
+		{`{"type":"playback.ack"}`, 1, controlMissingField, "/played_ms", "integer"},
+		{`{"type":"playback.ack","played_ms":"1200"}`, 1, controlInvalidType, "/played_ms", "integer"},
+		{`{"type":"playback.ack","played_ms":12.5}`, 1, controlInvalidValue, "/played_ms", "64 bit integer"},
+		{`{"type":"audio.test","kind":"beep"}`, 1, controlInvalidValue, "/kind", "one of tone, sweep"},
+		{`{"type":"audio.test","frequency_hz":4294967296}`, 1, controlInvalidValue, "/frequency_hz", "32 bit integer"},
+		{`{"type":"audio.test","verify":1}`, 1, controlInvalidType, "/verify", "boolean"},
+		{`{"type":"session.hello","public_key":"not base64"}`, 1, controlInvalidValue, "/public_key", "base64 string"},
+		{`{"type":"turn.metadata","metadata":{"screen":"menu","a/b":3}}`, 1, controlInvalidType, "/metadata/a~1b", "string"},
+	} {
+		got := validateControl([]byte(tc.msg), tc.version)
+		if tc.code == "" {
+			if got != nil {
+				t.Errorf("%s: unexpected error %+v", tc.msg, got)
+			}
+			continue
+		}
+		if got == nil || got.Code != tc.code || got.Path != tc.path || got.Expected != tc.expected || got.ProtocolVersion != tc.version {
+			t.Errorf("%s: expected %s at %q (%s), got %+v", tc.msg, tc.code, tc.path, tc.expected, got)
+		}
+	}
+
+	// messages and required fields of later protocol versions
+	defer func(schemas map[string]messageSchema) { deviceSchemas = schemas }(deviceSchemas)
+	deviceSchemas = map[string]messageSchema{
+		"wake.word": {since: 2, fields: []fieldSchema{{name: "word", kind: stringField, required: true, since: 2}}},
+		"ptt.begin": {since: 1, fields: []fieldSchema{{name: "sent_at_ms", kind: int64Field, required: true, since: 3}}},
+	}
+	if got := validateControl([]byte(`{"type":"wake.word","word":"pixa"}`), 1); got == nil || got.Code != controlUnsupportedVersion || got.Expected != "protocol version 2" {
+		t.Fatalf("message of a later version accepted: %+v", got)
+	}
+	if got := validateControl([]byte(`{"type":"wake.word"}`), 2); got == nil || got.Code != controlMissingField {
+		t.Fatalf("missing field accepted: %+v", got)
+	}
+	if got := validateControl([]byte(`{"type":"ptt.begin"}`), 2); got != nil {
+		t.Fatalf("field of a later version required: %+v", got)
+	}
+}
+
+func TestControlError(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Websocket.WriteWait = "1s"
+	cfg.Audio.SampleRate = 16000
+	reg := metrics.NewRegistry()
+	h := NewHandler(cfg, WithMetrics(reg))
+
+	sessions := make(chan *Session, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sessions <- h.sessions.create(NewClient(conn, h.logger, cfg), "", "", nil, h.nextSeed(), h.clock)
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session := <-sessions
+
+	h.handleControlMessage(context.Background(), session, []byte(`{"type":"playback.ack","played_ms":"soon"}`))
+	var e controlErrorEvent
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != ControlErrorEvent || e.MessageType != PlaybackAckMessage || e.Code != controlInvalidType || e.Path != "/played_ms" || e.Expected != "integer" || e.Reason == "" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if got := session.Cursor.Status().AckedMs; got != 0 {
+		t.Fatalf("invalid ack applied: %d", got)
+	}
+	var out strings.Builder
+	reg.WriteTo(&out)
+	if want := `pixa_control_errors_total{code="invalid_type"} 1`; !strings.Contains(out.String(), want) {
+		t.Fatalf("expected %s in:\n%s", want, out.String())
+	}
+}
+
+func TestTurnProcessors(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Audio.SampleRate = 16000
+	cfg.TurnProcessors = config.TurnProcessorsConfig{Timeout: "50ms", Queue: 4}
+	reg := metrics.NewRegistry()
+	turns := make(chan CompletedTurn, 4)
+	h := NewHandler(cfg, WithMetrics(reg), WithTurnProcessors(
+		TurnProcessorFunc(func(ctx context.Context, turn CompletedTurn) error { panic("crm down") }),
+		// ignores its context, so it is given up on
+		TurnProcessorFunc(func(ctx context.Context, turn CompletedTurn) error { time.Sleep(time.Second); return nil }),
+		TurnProcessorFunc(func(ctx context.Context, turn CompletedTurn) error { return errors.New("flagged") }),
+		TurnProcessorFunc(func(ctx context.Context, turn CompletedTurn) error { turns <- turn; return nil }),
+	))
+	ctx, cancel := context.WithCancel(context.Background())
+	session := h.sessions.create(&Client{config: cfg, logger: h.logger}, "device-1", "acme", nil, 1, h.clock)
+	h.startTurnProcessors(ctx, session)
+	moderated := make(chan string, 4)
+	session.AddTurnProcessor(TurnProcessorFunc(func(ctx context.Context, turn CompletedTurn) error {
+		moderated <- turn.Turn.Text
+		return nil
+	}))
+
+	session.addTurn(store.AssistantRole, "item-0", "Hi, how can I help?")
+	session.addTurn(store.UserRole, "item-1", "Where is my order?")
+	session.addTurn(store.AssistantRole, "item-2", "It ships tomorrow.")
+	for i, want := range []string{"", "Where is my order?"} {
+		select {
+		case turn := <-turns:
+			if turn.SessionID != session.ID || turn.TenantID != "acme" || turn.Audio.SampleRate != 16000 || turn.Audio.ItemID != turn.Turn.ItemID {
+				t.Fatalf("unexpected turn %+v", turn)
+			}
+			if (turn.UserTurn == nil) != (want == "") || turn.UserTurn != nil && turn.UserTurn.Text != want {
+				t.Fatalf("turn %d answered %+v, want %q", i, turn.UserTurn, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("turn %d not processed past failing processors", i)
+		}
+		if got := <-moderated; got == "" {
+			t.Fatal("session processor not run")
+		}
+	}
+
+	// turns still queued when the session ends are processed
+	session.addTurn(store.AssistantRole, "item-3", "Bye.")
+	cancel()
+	select {
+	case turn := <-turns:
+		if turn.Turn.Text != "Bye." {
+			t.Fatalf("unexpected last turn %q", turn.Turn.Text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("last turn not processed")
+	}
+	<-moderated
+	// the last run is counted once it returned
+	var out strings.Builder
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		out.Reset()
+		reg.WriteTo(&out)
+		if strings.Contains(out.String(), `pixa_turn_processors_total{outcome="ok"} 6`) {
+			break
+		}
+	}
+	for _, want := range []string{
+		`pixa_turn_processors_total{outcome="ok"} 6`,
+		`pixa_turn_processors_total{outcome="panic"} 3`,
+		`pixa_turn_processors_total{outcome="timeout"} 3`,
+		`pixa_turn_processors_total{outcome="error"} 3`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %s in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, origin string
+		want            bool
+	}{
+		{"app.example.com", "https://app.example.com", true},
+		{"app.example.com", "http://APP.example.com:8443", true},
+		{"app.example.com", "https://example.com", false},
+		{"*.example.com", "https://eu.app.example.com", true},
+		{"*.example.com", "https://example.com", false},
+		{"*.example.com", "https://example.com.evil.net", false},
+		{"https://*.example.com", "http://app.example.com", false},
+		{"localhost:3000", "http://localhost:3000", true},
+		{"localhost:3000", "http://localhost:4000", false},
+		{"*", "null", false},
+	} {
+		if got := matchOrigin(tc.pattern, tc.origin); got != tc.want {
+			t.Errorf("matchOrigin(%q, %q) = %v, want %v", tc.pattern, tc.origin, got, tc.want)
+		}
+	}
+
+	cfg := config.Default()
+	cfg.Websocket.AllowedOrigins = []string{"*.example.com"}
+	for _, strict := range []bool{false, true} {
+		reg := metrics.NewRegistry()
+		h := NewHandler(cfg, WithMetrics(reg), WithStrictOrigins(strict))
+		for origin, allowed := range map[string]bool{"": true, "https://app.example.com": true, "https://evil.net": !strict} {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if origin != "" {
+				r.Header.Set("Origin", origin)
+			}
+			w := httptest.NewRecorder()
+			if got := h.checkOrigin(w, r); got != allowed || (!allowed && w.Code != http.StatusForbidden) {
+				t.Errorf("strict %v: origin %q allowed %v with status %d", strict, origin, got, w.Code)
+			}
+		}
+		outcome := OriginAccepted
+		if strict {
+			outcome = OriginRejected
+		}
+		var out strings.Builder
+		reg.WriteTo(&out)
+		if want := `pixa_unknown_origins_total{outcome="` + outcome + `"} 1`; !strings.Contains(out.String(), want) {
+			t.Errorf("strict %v: expected %s in\n%s", strict, want, out.String())
+		}
+	}
+
+	// options replace the configured patterns
+	h := NewHandler(cfg, WithAllowedOrigins("https://kiosk.example.org"), WithStrictOrigins(true))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	if h.checkOrigin(httptest.NewRecorder(), r) {
+		t.Error("expected the configured patterns to be replaced")
+	}
+}
+
+func TestDeviceHello(t *testing.T) {
+	cfg := config.Default()
+	cfg.AIConfig.Provider = "fake"
+	cfg.DeviceHello = config.DeviceHelloConfig{Enabled: true, Timeout: "5s"}
+	providers := make(chan *fakeProvider, 2)
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(p ai.ProviderParams) (ai.AIClient, error) {
+		f := newFakeProvider(p)
+		providers <- f
+		return f, nil
+	})
+	metricsReg := metrics.NewRegistry()
+	h := NewHandler(cfg, WithProviderRegistry(reg), WithMetrics(metricsReg))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(map[string]any{"type": DeviceHelloMessage, "sample_rate": 44100, "firmware_version": "2.1.0", "downlink_sample_rate": 8000})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var configured deviceConfiguredEvent
+	for configured.Type != DeviceConfiguredEvent {
+		if err := conn.ReadJSON(&configured); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if configured.SampleRate != 44100 || configured.Codec != PCM16Codec || configured.DownlinkSampleRate != 8000 || configured.DownlinkCodec != PCM16Codec {
+		t.Fatalf("unexpected configuration %+v", configured)
+	}
+	provider := <-providers
+	if provider.params.InputSampleRate != 44100 {
+		t.Fatalf("provider told the device's audio is at %d Hz", provider.params.InputSampleRate)
+	}
+	sessions := h.sessions.List()
+	if len(sessions) != 1 || sessions[0].FirmwareVersion() != "2.1.0" || sessions[0].DownlinkSampleRate() != 8000 {
+		t.Fatal("expected the session to be set up from the hello")
+	}
+
+	// a hello the relay cannot take closes the connection as the upgrade would have been refused
+	rejected, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	rejected.WriteJSON(map[string]any{"type": DeviceHelloMessage, "codec": "speex"})
+	rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := rejected.ReadMessage(); !websocket.IsCloseError(err, 4000+http.StatusUnsupportedMediaType) {
+		t.Fatalf("expected the connection closed with 4415, got %v", err)
+	}
+
+	// devices sending audio first are set up from their request, and their audio is not lost
+	plain, _, err := websocket.DefaultDialer.Dial(url, http.Header{InputSampleRateHeader: {"48000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.WriteMessage(websocket.BinaryMessage, make([]byte, 960))
+	provider = <-providers
+	if provider.params.InputSampleRate != 48000 {
+		t.Fatalf("provider told the device's audio is at %d Hz", provider.params.InputSampleRate)
+	}
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		i := slices.IndexFunc(h.sessions.List(), func(s *Session) bool { return s.sampleRate == 48000 })
+		if _, frames := h.sessions.List()[i].CorruptedFrames(); frames == 1 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the first audio frame was not read")
+		}
+	}
+	var out strings.Builder
+	metricsReg.WriteTo(&out)
+	for _, want := range []string{`pixa_device_hellos_total{outcome="configured"} 1`, `pixa_device_hellos_total{outcome="rejected"} 1`, `pixa_device_hellos_total{outcome="missing"} 1`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %s in\n%s", want, out.String())
+		}
+	}
+}
+
+func TestAudioTest(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	sweep := audio.TestSignal{From: 300, To: 3400, Duration: 400 * time.Millisecond}
+	// the device plays the sweep at 24 kHz and its microphone hears it back 120ms later, at half
+	// the level, at 16 kHz
+	run := func(back []byte) audioTestResultEvent {
+		cfg := &config.Config{}
+		cfg.Audio.SampleRate = 16000
+		session := &Session{sampleRate: 16000}
+		test := &audioTest{signal: sweep, pcm: sweep.PCM(24000, -12), downRate: 24000, verify: true, started: start}
+		session.audioTest.Store(test)
+		for pos := 0; pos < len(back); pos += 640 {
+			now := start.Add(time.Duration(pos/640+1) * 20 * time.Millisecond)
+			silenced := session.hearTest(now, back[pos:pos+640], 1)
+			if !bytes.Equal(silenced, make([]byte, 640)) {
+				t.Fatal("expected the device's audio to be silenced during the test")
+			}
+		}
+		return test.result(time.Second, 0.8)
+	}
+	back := append(make([]byte, 2*1920), sweep.PCM(16000, -18)...)
+	back = append(back, make([]byte, 2*16000-len(back)/2)...)
+	result := run(back)
+	if !result.Verified || !result.Passed || result.LatencyMs != 120 {
+		t.Fatalf("expected the sweep heard back after 120ms, got %+v", result)
+	}
+	if result.MatchedPercent < 90 || result.LevelDb > -20 || result.LevelDb < -26 {
+		t.Fatalf("expected most of the sweep heard back at about -22 dBFS, got %+v", result)
+	}
+
+	rng := mrand.New(mrand.NewPCG(1, 2))
+	noise := make([]int16, 16000)
+	for i := range noise {
+		noise[i] = int16(rng.IntN(8000) - 4000)
+	}
+	if result := run(audio.Int16ToPCM(noise)); result.Passed {
+		t.Fatalf("expected noise to fail the test, got %+v", result)
+	}
+}
+
+func TestAnnouncements(t *testing.T) {
+	dir := t.TempDir()
+	// a WAV file holding 200ms of silence at 16kHz
+	pcm := make([]byte, 3200*2)
+	clip := append([]byte("RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00\x01\x00\x01\x00\x80\x3e\x00\x00\x00\x7d\x00\x00\x02\x00\x10\x00data"),
+		binary.LittleEndian.AppendUint32(nil, uint32(len(pcm)))...)
+	if err := os.WriteFile(filepath.Join(dir, "closing.wav"), append(clip, pcm...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Audio.SampleRate = 16000
+	cfg.Websocket.WriteWait = "1s"
+	cfg.Assets.Dir = dir
+	cfg.Announcements = config.AnnouncementsConfig{Enabled: true, Interval: "1s", IdleFor: "2s", MaxConcurrent: 10, Retention: "1h"}
+	reg := metrics.NewRegistry()
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	woken := make(chan string, 1)
+	h := NewHandler(cfg, WithClock(clk), WithMetrics(reg), WithDeviceWaker(func(_ context.Context, deviceID string) error {
+		woken <- deviceID
+		return nil
+	}))
+
+	sessions := make(chan *Session, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sessions <- h.sessions.create(NewClient(conn, h.logger, cfg), "kiosk-1", "acme", nil, h.nextSeed(), h.clock)
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session := <-sessions
+
+	if _, err := h.ScheduleAnnouncement(kioskAnnouncement("closing.wav", time.Time{})); err == nil {
+		t.Fatal("expected an announcement without a window to be refused")
+	}
+	if _, err := h.ScheduleAnnouncement(kioskAnnouncement("missing.wav", clk.Now().Add(time.Minute))); err == nil {
+		t.Fatal("expected an announcement of a missing clip to be refused")
+	}
+	first, err := h.ScheduleAnnouncement(kioskAnnouncement("closing.wav", clk.Now().Add(time.Minute)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := func(id, deviceID string) Delivery {
+		status, _ := h.Announcements().Get(id)
+		return status.Deliveries[deviceID]
+	}
+	readFrame := func() {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if typ, frame, err := conn.ReadMessage(); err != nil || typ != websocket.BinaryMessage || len(frame) != 1600*2 {
+			t.Fatalf("expected a 100ms announcement frame, got %d bytes (%v)", len(frame), err)
+		}
+	}
+	waitFor := func(id, state string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); delivery(id, "kiosk-1").State != state; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the delivery to kiosk-1 %s, got %+v", state, delivery(id, "kiosk-1"))
+			}
+		}
+	}
+
+	// the session must be idle for 2s; the device that is not connected is woken
+	h.announce(context.Background())
+	if d := delivery(first.ID, "kiosk-1"); d.State != DeliveryPending {
+		t.Fatalf("expected the delivery to wait for the session to be idle, got %+v", d)
+	}
+	if got := <-woken; got != "kiosk-2" {
+		t.Fatalf("expected kiosk-2 to be woken, got %s", got)
+	}
+	clk.Advance(2 * time.Second)
+	h.announce(context.Background())
+	readFrame()
+	clk.Advance(announceChunk)
+	readFrame()
+	clk.Advance(announceChunk)
+	waitFor(first.ID, DeliveryDelivered)
+	if d := delivery(first.ID, "kiosk-1"); d.SessionID != session.ID || d.Attempts != 1 {
+		t.Fatalf("expected one delivery in the session, got %+v", d)
+	}
+
+	// an announcement the user speaks over is played again later
+	second, err := h.ScheduleAnnouncement(kioskAnnouncement("closing.wav", clk.Now().Add(time.Minute)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.announce(context.Background())
+	clk.Advance(2 * time.Second)
+	h.announce(context.Background())
+	readFrame()
+	session.speechStarted(clk.Now())
+	clk.Advance(announceChunk)
+	waitFor(second.ID, DeliveryPending)
+	if d := delivery(first.ID, "kiosk-1"); d.Attempts != 1 {
+		t.Fatalf("expected the first announcement not to be played again, got %+v", d)
+	}
+
+	clk.Advance(time.Minute)
+	h.announce(context.Background())
+	for _, id := range []string{first.ID, second.ID} {
+		if status, _ := h.Announcements().Get(id); status.State != AnnouncementFinished {
+			t.Fatalf("expected announcement %s finished, got %s", id, status.State)
+		}
+	}
+	if d := delivery(first.ID, "kiosk-2"); d.State != DeliveryExpired {
+		t.Fatalf("expected kiosk-2 never connecting to expire, got %+v", d)
+	}
+	if d := delivery(second.ID, "kiosk-1"); d.State != DeliveryExpired || d.Attempts != 1 {
+		t.Fatalf("expected the interrupted delivery to expire, got %+v", d)
+	}
+	var out strings.Builder
+	reg.WriteTo(&out)
+	for _, want := range []string{
+		`pixa_announcement_deliveries_total{result="delivered"} 1`,
+		`pixa_announcement_deliveries_total{result="interrupted"} 1`,
+		`pixa_announcement_deliveries_total{result="expired"} 3`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %s in\n%s", want, out.String())
+		}
+	}
+}
+
+// kioskAnnouncement returns an announcement of a clip to the kiosks of acme until notAfter
+func kioskAnnouncement(asset string, notAfter time.Time) Announcement {
+	return Announcement{Asset: asset, TenantID: "acme", DeviceIDs: []string{"kiosk-1", "kiosk-2"}, NotAfter: notAfter}
+}
+
+// chanProducer hands the events produced to the test
+type chanProducer chan map[string]any
+
+func (c chanProducer) Produce(_ context.Context, topic string, key, value []byte) error {
+	var event map[string]any
+	if err := json.Unmarshal(value, &event); err != nil {
+		return err
+	}
+	event["topic"], event["key"] = topic, string(key)
+	c <- event
+	return nil
+}
+
+func TestSessionEvents(t *testing.T) {
+	cfg := config.Default()
+	cfg.Events = config.EventsConfig{Enabled: true, Topics: config.EventTopics{State: "sessions", Transcript: "transcripts", QoS: "qos"}, Queue: 10, Timeout: "1s"}
+	produced := make(chanProducer, 10)
+	pub := events.New(cfg.Events, produced)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pub.Run(ctx)
+
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	h := NewHandler(cfg, WithClock(clk), WithEvents(pub))
+	session := h.sessions.create(&Client{config: cfg, logger: h.logger}, "kiosk-1", "acme", nil, h.nextSeed(), clk)
+	session.events = h.events
+	session.heat.observe(StageDeviceWrite, 4*time.Millisecond)
+	session.audioFrames.Store(25)
+	session.addTurn(store.UserRole, "item-1", "what time do you close")
+	clk.Advance(time.Minute)
+	h.saveSession(session, nil)
+
+	next := func() map[string]any {
+		t.Helper()
+		select {
+		case e := <-produced:
+			if e["key"] != session.ID || e["device_id"] != "kiosk-1" || e["tenant_id"] != "acme" {
+				t.Fatalf("expected an event of the session, got %v", e)
+			}
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event produced")
+			return nil
+		}
+	}
+	if e := next(); e["type"] != events.TurnTranscribed || e["topic"] != "transcripts" || e["data"].(map[string]any)["text"] != "what time do you close" {
+		t.Fatalf("expected the user's turn, got %v", e)
+	}
+	if e := next(); e["type"] != events.SessionEnded || e["topic"] != "sessions" || e["data"].(map[string]any)["duration_ms"] != 60000.0 {
+		t.Fatalf("expected the session's end after a minute, got %v", e)
+	}
+	e := next()
+	data, _ := e["data"].(map[string]any)
+	if e["type"] != events.SessionQoS || e["topic"] != "qos" || data["audio_frames"] != 25.0 || data["stages"].(map[string]any)[StageDeviceWrite] == nil {
+		t.Fatalf("expected the session's quality of service, got %v", e)
+	}
+}
+
+func TestProviderQueue(t *testing.T) {
+	cfg := config.Default()
+	cfg.ProviderQueue = config.ProviderQueueConfig{Enabled: true, MaxSessions: 1, MaxWaiting: 1, MaxWait: "1m"}
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	h := NewHandler(cfg, WithClock(clk))
+
+	sessions := make(chan *Session, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sessions <- h.sessions.create(NewClient(conn, h.logger, cfg), "", "", nil, h.nextSeed(), h.clock)
+	}))
+	defer srv.Close()
+	dial := func() (*websocket.Conn, *Session) {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, <-sessions
+	}
+	read := func(conn *websocket.Conn) map[string]any {
+		t.Helper()
+		var e map[string]any
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.ReadJSON(&e); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	// the first session takes the only slot, the second waits for it
+	if h.queue.join() != nil {
+		t.Fatal("expected the first session to get a slot")
+	}
+	conn, session := dial()
+	defer conn.Close()
+	waited := make(chan error, 1)
+	go func() { waited <- h.waitForProvider(context.Background(), session) }()
+	if e := read(conn); e["type"] != QueuePositionEvent || e["position"] != 1.0 || e["waiting"] != 1.0 {
+		t.Fatalf("expected to be first in line, got %v", e)
+	}
+	if !session.queued.Load() {
+		t.Fatal("expected the session to be marked as waiting")
+	}
+	rec := httptest.NewRecorder()
+	if !h.refuseQueueFull(rec) || rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected a device connecting to a full line to be refused, got %d", rec.Code)
+	}
+
+	clk.Advance(10 * time.Second)
+	h.queue.release()
+	if e := read(conn); e["type"] != QueueAdmittedEvent || e["waited_ms"] != 10000.0 {
+		t.Fatalf("expected to be admitted after 10s, got %v", e)
+	}
+	if err := <-waited; err != nil || session.queued.Load() {
+		t.Fatalf("expected the session to go ahead with the provider, got %v", err)
+	}
+
+	// a session waiting longer than max_wait ends
+	conn2, session2 := dial()
+	defer conn2.Close()
+	go func() { waited <- h.waitForProvider(context.Background(), session2) }()
+	read(conn2)
+	for clk.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clk.Advance(time.Minute)
+	if err := <-waited; !errors.Is(err, errQueueTimeout) {
+		t.Fatalf("expected the wait to time out, got %v", err)
+	}
+	if h.queue.waitingCount() != 0 {
+		t.Fatal("expected the line to be empty")
+	}
+}
+
+func TestReaper(t *testing.T) {
+	cfg := &config.Config{}
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	transcripts := store.NewMemoryStore(10)
+	h := NewHandler(cfg, WithClock(clk), WithTranscriptStore(transcripts))
+	limits := reapLimits{device: 2 * time.Minute, provider: 5 * time.Minute, teardown: 30 * time.Second}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	newSession := func() (*Session, *bool) {
+		cancelled := new(bool)
+		s := h.sessions.create(&Client{config: cfg, logger: logger}, "", "", func() { *cancelled = true }, h.nextSeed(), h.clock)
+		return s, cancelled
+	}
+
+	silent, silentCancelled := newSession()
+	alive, _ := newSession()
+	alive.setProvider(&ai.MockClient{})
+	clk.Advance(90 * time.Second)
+	alive.lastRead.Store(clk.Now().UnixNano())
+	if reaped := h.reap(limits); len(reaped) != 0 {
+		t.Fatalf("live sessions were reaped: %v", reaped)
+	}
+
+	clk.Advance(time.Minute)
+	if reaped := h.reap(limits); reaped[ReapDeviceSilent] != 1 || len(reaped) != 1 || !*silentCancelled {
+		t.Fatalf("expected the silent session to be reaped, got %v", reaped)
+	}
+	if _, ok := h.sessions.Get(alive.ID); !ok {
+		t.Fatal("live session was removed")
+	}
+
+	// the silent session never finishes closing, so it is dropped and its record saved
+	clk.Advance(time.Minute)
+	alive.lastRead.Store(clk.Now().UnixNano())
+	if reaped := h.reap(limits); reaped[ReapUnresponsive] != 1 {
+		t.Fatalf("expected the stuck session to be dropped, got %v", reaped)
+	}
+	if _, ok := h.sessions.Get(silent.ID); ok {
+		t.Fatal("stuck session is still registered")
+	}
+	record, err := transcripts.GetSession(context.Background(), silent.ID)
+	if err != nil || !record.Flagged || record.FlagReason != "session reaped: "+ReapDeviceSilent {
+		t.Fatalf("unexpected record of the reaped session: %+v, %v", record, err)
+	}
+
+	alive.setProvider(nil)
+	clk.Advance(6 * time.Minute)
+	alive.lastRead.Store(clk.Now().UnixNano())
+	if reaped := h.reap(limits); reaped[ReapProviderLost] != 1 {
+		t.Fatalf("expected the session without a provider to be reaped, got %v", reaped)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	// 400ms chunks of 16kHz mono audio, 12800 bytes each
+	chunk := func() audio.Audio { return audio.FromPCM16(make([]byte, 6400*2), 16000, 1) }
+
+	t.Run("offline buffer sheds the oldest audio", func(t *testing.T) {
+		mem := newMemoryBudget(config.MemoryConfig{SessionBudgetBytes: 40000, ShedPolicy: ShedDropOldest})
+		b := newOfflineBuffer(config.OfflineConfig{MaxBuffer: "1m"}, mem)
+		for i := 0; i < 3; i++ {
+			if !b.add(chunk()) {
+				t.Fatalf("chunk %d did not fit", i)
+			}
+		}
+		if b.add(chunk()) {
+			t.Fatal("expected the fourth chunk to go over budget")
+		}
+		usage := mem.usage()
+		if pool := usage.Pools[MemoryOffline]; pool.UsedBytes != 3*12800 || pool.ShedBytes != 12800 || pool.PeakBytes != 3*12800 {
+			t.Fatalf("unexpected offline accounting: %+v", pool)
+		}
+		if chunks, _, dropped := b.take(); len(chunks) != 3 || dropped != 400*time.Millisecond {
+			t.Fatalf("expected 3 chunks and 400ms dropped, got %d and %s", len(chunks), dropped)
+		}
+		if mem.usage().UsedBytes != 0 {
+			t.Fatal("taking the buffer did not release its memory")
+		}
+	})
+
+	t.Run("pool limit drops the newest audio", func(t *testing.T) {
+		mem := newMemoryBudget(config.MemoryConfig{OfflineBytes: 20000, ShedPolicy: ShedDropNewest})
+		b := newOfflineBuffer(config.OfflineConfig{MaxBuffer: "1m"}, mem)
+		b.add(chunk())
+		if b.add(chunk()) {
+			t.Fatal("expected the second chunk to be dropped")
+		}
+		if chunks, _, dropped := b.take(); len(chunks) != 1 || dropped != 400*time.Millisecond {
+			t.Fatalf("expected the first chunk to be kept, got %d chunks and %s dropped", len(chunks), dropped)
+		}
+	})
+
+	t.Run("close policy ends the session", func(t *testing.T) {
+		cfg := &config.Config{}
+		cfg.Memory = config.MemoryConfig{DownlinkBytes: 4096, ShedPolicy: ShedClose}
+		h := NewHandler(cfg)
+		closed := false
+		session := h.sessions.create(&Client{config: cfg, logger: h.logger}, "", "", func() { closed = true }, h.nextSeed(), h.clock)
+		ab := utils.NewBufferSizeController(4096)
+		if !h.reserveDownlink(session, &ab, 4000) {
+			t.Fatal("audio within budget was refused")
+		}
+		if h.reserveDownlink(session, &ab, 8000) || !closed {
+			t.Fatal("expected audio over budget to close the session")
+		}
+	})
+}
+
+func TestThinkingFiller(t *testing.T) {
+	dir := t.TempDir()
+	// a WAV file holding 300ms of silence at 16kHz
+	pcm := make([]byte, 4800*2)
+	clip := append([]byte("RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00\x01\x00\x01\x00\x80\x3e\x00\x00\x00\x7d\x00\x00\x02\x00\x10\x00data"),
+		binary.LittleEndian.AppendUint32(nil, uint32(len(pcm)))...)
+	if err := os.WriteFile(filepath.Join(dir, "thinking.wav"), append(clip, pcm...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Audio.SampleRate = 16000
+	cfg.Websocket.WriteWait = "1s"
+	cfg.Filler = config.FillerConfig{Enabled: true, Asset: "thinking.wav", Delay: "500ms", MaxDuration: "10s"}
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	h := NewHandler(cfg, WithClock(clk), WithAssets(assets.NewManager(dir)))
+
+	sessions := make(chan *Session, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sessions <- h.sessions.create(NewClient(conn, h.logger, cfg), "", "", nil, h.nextSeed(), h.clock)
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session := <-sessions
+
+	h.startFiller(context.Background(), session)
+	for clk.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clk.Advance(500 * time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if typ, frame, err := conn.ReadMessage(); err != nil || typ != websocket.BinaryMessage || len(frame) != 1600*2 {
+		t.Fatalf("expected a 100ms filler frame, got %d bytes (%v)", len(frame), err)
+	}
+
+	session.stopFiller()
+	clk.Advance(time.Second)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, frame, err := conn.ReadMessage(); err == nil {
+		t.Fatalf("filler kept playing after the response started: %d bytes", len(frame))
+	}
+}
+
+// fakeResponder records what the relay asks of the model and adds to its conversation
+type fakeResponder struct {
+	ai.AIClient
+	responses int
+	answers   []string
+	contexts  []string
+}
+
+func (f *fakeResponder) AddContext(_ context.Context, text string) error {
+	f.contexts = append(f.contexts, text)
+	return nil
+}
+
+func (f *fakeResponder) CreateResponse(context.Context) error {
+	f.responses++
+	return nil
+}
+
+func (f *fakeResponder) AddAnswer(_ context.Context, text string) error {
+	f.answers = append(f.answers, text)
+	return nil
+}
+
+func TestFAQAnswers(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Audio.SampleRate = 16000
+	cfg.Websocket.WriteWait = "1s"
+	cfg.FAQ = config.FAQConfig{Enabled: true, TTL: "1h", MaxEntries: 10, MinSimilarity: 0.8, MaxAnswer: "30s"}
+	h := NewHandler(cfg, WithClock(clock.NewFake(time.Unix(1700000000, 0))))
+
+	sessions := make(chan *Session, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sessions <- h.sessions.create(NewClient(conn, h.logger, cfg), "", "acme", nil, h.nextSeed(), h.clock)
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session := <-sessions
+
+	model := &fakeResponder{}
+	ab := utils.NewBufferSizeController(3200)
+	answer := bytes.Repeat([]byte{1, 2}, 1600)
+
+	// the first time the model answers and the answer is recorded
+	h.answerTurn(context.Background(), session, model, &ab, "What are the opening hours?")
+	if model.responses != 1 {
+		t.Fatal("expected a response to be requested on a miss")
+	}
+	session.recordAnswerAudio("item_1", answer, 16000, h.faqMaxAnswer)
+	h.cacheAnswer(session, "item_1", true, "We open at nine.")
+	h.cacheAnswer(session, "item_1", false, "")
+	if len(h.FAQ().Entries()) != 1 {
+		t.Fatal("expected the answer to be cached")
+	}
+
+	// the next time the cached answer is played without asking the model
+	h.answerTurn(context.Background(), session, model, &ab, "um, what are your opening hours")
+	if model.responses != 1 || len(model.answers) != 1 || model.answers[0] != "We open at nine." {
+		t.Fatalf("expected the cached answer to be given, got %d responses and answers %q", model.responses, model.answers)
+	}
+	select {
+	case chunk := <-ab.GetOutputChannel():
+		if !bytes.Equal(chunk.Data, answer) || !chunk.Last {
+			t.Fatalf("unexpected answer audio of %d bytes", len(chunk.Data))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cached answer audio was not played")
+	}
+}
+
+func TestTurnMetadata(t *testing.T) {
+	cfg := &config.Config{}
+	h := NewHandler(cfg)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	session := h.sessions.create(&Client{config: cfg, logger: logger}, "", "", nil, h.nextSeed(), h.clock)
+	model := &fakeResponder{}
+	ctx := context.Background()
+
+	// metadata sent before the provider is connected is added once it is
+	h.handleControlMessage(ctx, session, []byte(`{"type":"turn.metadata","metadata":{"screen":"menu","location":"lobby"}}`))
+	h.attachProvider(ctx, session, model)
+	if len(model.contexts) != 1 || !strings.HasSuffix(model.contexts[0], "\nlocation: lobby\nscreen: menu") {
+		t.Fatalf("unexpected context %q", model.contexts)
+	}
+	session.addTurn(store.UserRole, "item_1", "what is on the menu")
+
+	h.handleControlMessage(ctx, session, []byte(`{"type":"turn.metadata","metadata":{"order_id":"A17"}}`))
+	h.handleControlMessage(ctx, session, []byte(`{"type":"turn.metadata","metadata":{"":"no key"}}`))
+	if len(model.contexts) != 2 || !strings.HasSuffix(model.contexts[1], "\norder_id: A17") {
+		t.Fatalf("unexpected context %q", model.contexts)
+	}
+	session.addTurn(store.AssistantRole, "item_2", "soup")
+	session.addTurn(store.UserRole, "item_3", "where is my order")
+	session.addTurn(store.UserRole, "item_4", "thanks")
+
+	turns := session.Record(time.Now(), nil).Turns
+	if turns[0].Metadata["location"] != "lobby" || turns[1].Metadata != nil || turns[2].Metadata["order_id"] != "A17" || turns[3].Metadata != nil {
+		t.Fatalf("metadata not stored with its turn: %+v", turns)
+	}
+}
+
+// fakeToolCaller reports what the relay tells the model about tool calls
+type fakeToolCaller struct {
+	ai.AIClient
+	announced chan string
+	results   chan string
+}
+
+func (f *fakeToolCaller) Announce(_ context.Context, instructions string) error {
+	f.announced <- instructions
+	return nil
+}
+
+func (f *fakeToolCaller) SendToolResult(_ context.Context, callID, output string) error {
+	f.results <- callID + " " + output
+	return nil
+}
+
+func TestSlowToolCall(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Tools = config.ToolsConfig{Timeout: "30s", SlowAfter: "1s", SlowInstructions: "say you are checking"}
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	release := make(chan struct{})
+	registry := tools.NewRegistry()
+	registry.Register(tools.Tool{Name: "order_status", Run: func(ctx context.Context, args json.RawMessage) (string, error) {
+		<-release
+		return `{"status":"shipped"}`, nil
+	}})
+	h := NewHandler(cfg, WithClock(clk), WithTools(registry))
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	session := h.sessions.create(&Client{config: cfg, logger: logger}, "", "", nil, h.nextSeed(), h.clock)
+	model := &fakeToolCaller{announced: make(chan string, 1), results: make(chan string, 1)}
+
+	if defs := h.toolDefinitions(); len(defs) != 1 || defs[0].Name != "order_status" {
+		t.Fatalf("unexpected tool definitions %v", defs)
+	}
+
+	go h.runTool(context.Background(), session, model, ai.FunctionCall{CallID: "call_1", Name: "order_status", Arguments: `{"order_id":"A17"}`})
+	for clk.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clk.Advance(time.Second)
+	select {
+	case got := <-model.announced:
+		if got != "say you are checking" {
+			t.Fatalf("unexpected announcement %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow tool call was not announced")
+	}
+	close(release)
+	if got := <-model.results; got != `call_1 {"status":"shipped"}` {
+		t.Fatalf("unexpected tool result %q", got)
+	}
+
+	h.runTool(context.Background(), session, model, ai.FunctionCall{CallID: "call_2", Name: "missing"})
+	if got := <-model.results; got != `call_2 {"error":"unknown tool"}` {
+		t.Fatalf("unexpected result for an unknown tool %q", got)
+	}
+}
+
+func TestSpeakerVerification(t *testing.T) {
+	cfg := config.Default()
+	cfg.SpeakerVerification = config.SpeakerVerificationConfig{Enabled: true, Sample: "100ms", Timeout: "1s", MinScore: 0.8,
+		ProtectedTools: []string{"account_balance"}, Instructions: "You may discuss the account."}
+	registry := tools.NewRegistry()
+	registry.Register(tools.Tool{Name: "account_balance", Run: func(ctx context.Context, args json.RawMessage) (string, error) {
+		return `{"balance":42}`, nil
+	}})
+	var match SpeakerMatch
+	var claims map[string]any
+	reg := metrics.NewRegistry()
+	h := NewHandler(cfg, WithMetrics(reg), WithTools(registry),
+		WithSpeakerVerifier(SpeakerVerifierFunc(func(ctx context.Context, deviceID, tenantID string, pcm []byte, sampleRate, channels int) (SpeakerMatch, error) {
+			claims, _ = TokenClaimsFromContext(ctx)
+			if deviceID != "kiosk-1" || len(pcm) == 0 {
+				return SpeakerMatch{}, errors.New("unexpected request")
+			}
+			return match, nil
+		})))
+	session := h.sessions.create(&Client{config: cfg, logger: h.logger}, "kiosk-1", "acme", nil, h.nextSeed(), h.clock)
+	session.sampleRate = cfg.Audio.SampleRate
+	session.verifySample = newVerificationSampler(h.config, h.speakerVerifier, cfg.Audio.SampleRate)
+	model := &fakeToolCaller{announced: make(chan string, 1), results: make(chan string, 1)}
+	call := ai.FunctionCall{CallID: "call_1", Name: "account_balance"}
+
+	h.runTool(context.Background(), session, model, call)
+	if got := <-model.results; got != `call_1 {"error":"the speaker must be verified to use this tool"}` {
+		t.Fatalf("expected the protected tool to be refused to an unverified speaker, got %q", got)
+	}
+
+	ctx := WithTokenClaims(context.Background(), map[string]any{"sub": "user-7"})
+	frame := make([]byte, cfg.Audio.SampleRate*cfg.Audio.Channels*2/10)
+	session.verifySample.setSpeaking(true)
+	sample := session.verifySample.add(frame)
+	match = SpeakerMatch{SpeakerID: "user-9", Score: 0.4}
+	h.verifySpeaker(ctx, session, sample)
+	if session.speakerVerified() || session.profile.Load() != nil || claims["sub"] != "user-7" {
+		t.Fatalf("expected a speaker matching poorly not to be verified, got %+v", session.verification.Load())
+	}
+	match = SpeakerMatch{SpeakerID: "user-7", Score: 0.93}
+	h.verifySpeaker(ctx, session, sample)
+	if !session.speakerVerified() || session.providerProfile().Instructions != "You may discuss the account." {
+		t.Fatalf("expected the speaker to be verified and the session switched to the verified profile, got %+v", session.verification.Load())
+	}
+	h.runTool(context.Background(), session, model, call)
+	if got := <-model.results; got != `call_1 {"balance":42}` {
+		t.Fatalf("expected the protected tool to run for a verified speaker, got %q", got)
+	}
+	if v := session.Record(time.Now(), nil).Verification; v == nil || !v.Verified || v.SpeakerID != "user-7" || v.Score != 0.93 {
+		t.Fatalf("verification not kept in the record: %+v", v)
+	}
+	var out strings.Builder
+	reg.WriteTo(&out)
+	for _, want := range []string{
+		`pixa_speaker_verifications_total{result="rejected"} 1`,
+		`pixa_speaker_verifications_total{result="verified"} 1`,
+		`pixa_tool_calls_total{tool="account_balance",outcome="unverified"} 1`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %s in\n%s", want, out.String())
+		}
+	}
+}
+
+func TestSessionTags(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/?tags=ignored%3D1", nil)
+	r.Header.Set(TagsHeader, "campaign=summer, store=17,variant=a,Bad=1")
+	ctx := WithTags(r.Context(), map[string]string{"variant": "b"})
+	tags, errs := requestTags(r.WithContext(WithTags(ctx, map[string]string{"experiment": "filler"})))
+	want := map[string]string{"campaign": "summer", "store": "17", "variant": "b", "experiment": "filler"}
+	if len(errs) != 1 || len(tags) != len(want) || !store.MatchTags(tags, want) {
+		t.Fatalf("unexpected tags %v (errors %v)", tags, errs)
+	}
+
+	labels := newTagLabels(config.TagsConfig{MetricLabels: []string{"campaign"}, MaxLabelValues: 2})
+	for _, campaign := range []string{"summer", "winter", "summer"} {
+		if got := labels.labels(map[string]string{"campaign": campaign, "store": "17"}); len(got) != 1 || got["campaign"] != campaign {
+			t.Fatalf("unexpected labels %v", got)
+		}
+	}
+	if got := labels.labels(map[string]string{"campaign": "spring"}); got["campaign"] != OtherTagValue {
+		t.Fatalf("expected values beyond the limit to be counted as other, got %v", got)
+	}
+}
+
+func TestSessionIDs(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Websocket.SessionIDs = UUIDv7IDFormat
+	clk := clock.NewFake(time.UnixMilli(1700000000123))
+	h := NewHandler(cfg, WithClock(clk))
+	newSession := func(seed uint64) *Session {
+		return h.sessions.create(&Client{config: cfg, logger: h.logger}, "", "", nil, seed, h.clock)
+	}
+	a, b := newSession(7), newSession(7)
+	if a.ID != b.ID || !strings.HasPrefix(a.ID, "018bcfe5-687b-7") || len(a.ID) != 36 || !strings.ContainsRune("89ab", rune(a.ID[19])) {
+		t.Fatalf("unexpected UUIDv7 session IDs %s and %s", a.ID, b.ID)
+	}
+
+	// ULIDs sort by start time
+	first := ULID(clk.Now(), a.rand)
+	later := ULID(clk.Now().Add(time.Millisecond), a.rand)
+	if len(first) != 26 || strings.Trim(first, crockford) != "" || later <= first {
+		t.Fatalf("unexpected ULIDs %s and %s", first, later)
+	}
+
+	h = NewHandler(cfg, WithIDGenerator(func(time.Time, *mrand.Rand) string { return "call-42" }))
+	if id := h.sessions.create(&Client{config: cfg, logger: h.logger}, "", "", nil, 1, h.clock).ID; id != "call-42" {
+		t.Fatalf("custom generator ignored, got %s", id)
+	}
+
+	for _, tt := range []struct {
+		header, query, want string
+		valid               bool
+	}{
+		{"trace-9f2c", "ignored", "trace-9f2c", true},
+		{"", "crm%3A1234", "crm:1234", true},
+		{"has space", "", "", false},
+		{strings.Repeat("x", 129), "", "", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/?correlation_id="+tt.query, nil)
+		r.Header.Set(CorrelationIDHeader, tt.header)
+		if got, err := correlationID(r); got != tt.want || (err == nil) != tt.valid {
+			t.Fatalf("header %q query %q: got %q, %v", tt.header, tt.query, got, err)
+		}
+	}
+}
+
+func TestSpeechEstimate(t *testing.T) {
+	e := newSpeechEstimator(config.SpeechEstimateConfig{Enabled: true, Interval: "500ms", CharsPerSecond: 10})
+	now := time.Unix(1700000000, 0)
+	if _, ok := e.estimate(now, "item_1", 0, 0); ok {
+		t.Fatal("estimated an item with no transcript")
+	}
+
+	// 30 characters at 10 per second
+	e.text("item_1", "Your order ships ")
+	e.text("item_1", "tomorrow all.")
+	if got, ok := e.estimate(now, "item_1", 400, 200); !ok || got.TotalMs != 3000 || got.RemainingMs != 2800 || got.Final {
+		t.Fatalf("unexpected estimate %+v", got)
+	}
+	if _, ok := e.estimate(now.Add(100*time.Millisecond), "item_1", 600, 400); ok {
+		t.Fatal("estimate sent before speech_estimate.interval")
+	}
+
+	// the item turns out to speak faster, which the next answer is estimated with
+	e.textDone("item_1", "Your order ships tomorrow all.")
+	e.audioDone("item_1", 2000)
+	if got, ok := e.estimate(now.Add(200*time.Millisecond), "item_1", 2000, 900); !ok || got.TotalMs != 2000 || got.RemainingMs != 1100 || !got.Final {
+		t.Fatalf("unexpected final estimate %+v", got)
+	}
+	if _, ok := e.estimate(now.Add(time.Second), "item_1", 2000, 2000); ok {
+		t.Fatal("estimate sent after the final one")
+	}
+	e.text("item_2", strings.Repeat("x", 30))
+	if got, _ := e.estimate(now.Add(time.Second), "item_2", 0, 0); got.TotalMs != 2700 {
+		t.Fatalf("expected the measured speech rate to shorten the estimate to 2700ms, got %+v", got)
+	}
+
+	var off *speechEstimator
+	off.text("item_1", "ignored")
+	if _, ok := off.estimate(now, "item_1", 0, 0); ok {
+		t.Fatal("a disabled estimator estimated")
+	}
+}
+
+func TestHalfDuplex(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Audio.SampleRate = 16000
+	cfg.Audio.Channels = 1
+	cfg.Websocket.Duplex = FullDuplex
+	cfg.Websocket.HalfDuplexTail = "300ms"
+	for _, tt := range []struct{ header, query, want string }{
+		{"", "", FullDuplex},
+		{"Half", "", HalfDuplex},
+		{"", "half", HalfDuplex},
+		{"simplex", "", FullDuplex},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/?duplex="+tt.query, nil)
+		r.Header.Set(DuplexHeader, tt.header)
+		if got := duplexMode(cfg, r); got != tt.want {
+			t.Fatalf("header %q query %q: got mode %s, want %s", tt.header, tt.query, got, tt.want)
+		}
+	}
+
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	h := NewHandler(cfg, WithClock(clk))
+	session := h.sessions.create(&Client{config: cfg, logger: h.logger}, "", "", nil, 1, h.clock)
+	speech := []byte{0x10, 0x27, 0x10, 0x27}
+	if got := h.muteHalfDuplex(session, speech); !bytes.Equal(got, speech) {
+		t.Fatal("a full-duplex device was muted")
+	}
+
+	session.duplex = newHalfDuplex(cfg, HalfDuplex)
+	session.duplex.downlink(clk.Now(), time.Second)
+	session.duplex.downlink(clk.Now(), 500*time.Millisecond)
+	clk.Advance(1700 * time.Millisecond)
+	if got := h.muteHalfDuplex(session, speech); !bytes.Equal(got, make([]byte, len(speech))) {
+		t.Fatal("the device was heard while the assistant spoke")
+	}
+	clk.Advance(100 * time.Millisecond)
+	if got := h.muteHalfDuplex(session, speech); !bytes.Equal(got, speech) {
+		t.Fatal("the device was still muted after the assistant finished and the tail passed")
+	}
+}
+
+func TestEndpointing(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Endpointing = config.EndpointingConfig{SilenceDuration: "500ms", PrefixPadding: "300ms", Threshold: 0.5, MaxUtterance: "0s"}
+	cfg.DeviceProfiles = map[string]config.DeviceProfile{
+		"kiosk": {Endpointing: config.EndpointingConfig{SilenceDuration: "1500ms", MaxUtterance: "30s"}},
+	}
+	cfg.Tenants = map[string]config.TenantConfig{"clinic": {DeviceProfile: "kiosk"}}
+	for _, tt := range []struct{ tenant, requested, want string }{
+		{"", "Kiosk", "kiosk"},
+		{"", "unknown", ""},
+		{"Clinic", "", "kiosk"},
+		{"other", "", ""},
+	} {
+		if got := cfg.DeviceProfileFor(tt.tenant, tt.requested); got != tt.want {
+			t.Fatalf("tenant %q asking for %q: got profile %q, want %q", tt.tenant, tt.requested, got, tt.want)
+		}
+	}
+	e := cfg.EndpointingFor("kiosk")
+	if e.SilenceDuration != "1500ms" || e.PrefixPadding != "300ms" || e.Threshold != 0.5 || e.MaxUtterance != "30s" {
+		t.Fatalf("unexpected endpointing of the kiosk profile %+v", e)
+	}
+	if newUtteranceCap(cfg.EndpointingFor("")) != nil {
+		t.Fatal("turns without max_utterance were capped")
+	}
+
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	h := NewHandler(cfg, WithClock(clk))
+	session := h.sessions.create(&Client{config: cfg, logger: h.logger}, "", "", nil, 1, h.clock)
+	session.utterance = newUtteranceCap(e)
+	speech := []byte{0x10, 0x27, 0x10, 0x27}
+	session.utterance.started(clk.Now())
+	clk.Advance(29 * time.Second)
+	if got := h.capUtterance(session, speech); !bytes.Equal(got, speech) {
+		t.Fatal("the user was cut off before max_utterance")
+	}
+	clk.Advance(time.Second)
+	if got := h.capUtterance(session, speech); !bytes.Equal(got, make([]byte, len(speech))) {
+		t.Fatal("the turn was not ended at max_utterance")
+	}
+	// muted for the profile's silence duration, for the provider to end the turn
+	clk.Advance(1600 * time.Millisecond)
+	if got := h.capUtterance(session, speech); !bytes.Equal(got, make([]byte, len(speech))) {
+		t.Fatal("the uplink was heard again before the provider could end the turn")
+	}
+	clk.Advance(200 * time.Millisecond)
+	if got := h.capUtterance(session, speech); !bytes.Equal(got, speech) {
+		t.Fatal("the uplink stayed muted after the turn was ended")
+	}
+}
+
+func TestCalibration(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Audio.SampleRate = 16000
+	cfg.Audio.Channels = 1
+	cfg.Calibration = config.CalibrationConfig{Enabled: true, Duration: "1s", MinThreshold: 0.4, MaxThreshold: 0.8, TargetLevel: -20, MaxGain: 4, NoiseCeiling: -50}
+	// 10ms frames of a tone with the given RMS, in dBFS
+	frame := func(dbfs float64) []byte {
+		pcm := make([]byte, 320)
+		amplitude := 32768 * math.Pow(10, dbfs/20) * math.Sqrt2
+		for i := 0; i < 160; i++ {
+			binary.LittleEndian.PutUint16(pcm[2*i:], uint16(int16(amplitude*math.Sin(float64(i)*0.3))))
+		}
+		return pcm
+	}
+	calibrate := func(dbfs float64) (*calibration, *CalibrationResult) {
+		c := newCalibration(cfg, cfg.Audio.SampleRate, true)
+		for i := 0; i < 100; i++ {
+			if _, result := c.process(frame(dbfs)); result != nil {
+				if i != 99 {
+					t.Fatalf("calibrated after %d frames", i+1)
+				}
+				return c, result
+			}
+		}
+		t.Fatal("calibration did not finish")
+		return nil, nil
+	}
+
+	quiet, result := calibrate(-70)
+	if math.Abs(result.NoiseFloorDBFS+70) > 0.5 || result.Threshold != 0.4 || result.MaxGain != 4 {
+		t.Fatalf("unexpected calibration of a quiet room %+v", result)
+	}
+	// speech at -32 dBFS is brought towards -20 dBFS
+	var out []byte
+	for i := 0; i < 50; i++ {
+		out, _ = quiet.process(frame(-32))
+	}
+	if level := toDBFS(rms(out)); level < -21 || level > -19 {
+		t.Fatalf("speech amplified to %.1f dBFS", level)
+	}
+
+	loud, result := calibrate(-30)
+	if result.Threshold != 0.8 || result.MaxGain != 1 {
+		t.Fatalf("unexpected calibration of a loud lobby %+v", result)
+	}
+	speech := frame(-25)
+	if got, _ := loud.process(speech); !bytes.Equal(got, speech) {
+		t.Fatal("the noise of a loud lobby was amplified")
+	}
+}
+
+func TestGainControl(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Audio.SampleRate = 16000
+	cfg.Audio.Channels = 1
+	cfg.AGC = config.AGCConfig{TargetLevel: -20, MaxGain: 8, Attack: "10ms", Release: "1s", Gate: -50}
+	off, on := false, true
+	cfg.DeviceProfiles = map[string]config.DeviceProfile{"studio": {AGC: &off}, "mems": {AGC: &on}}
+	if newGainControl(cfg, "", 16000) != nil || newGainControl(cfg, "mems", 16000) == nil {
+		t.Fatal("expected only the profile that asks for it to be gain controlled")
+	}
+	cfg.AGC.Enabled = true
+	if newGainControl(cfg, "studio", 16000) != nil {
+		t.Fatal("expected a profile to turn gain control off")
+	}
+	// 10ms frames of a tone with the given RMS, in dBFS
+	frame := func(dbfs float64) []byte {
+		pcm := make([]byte, 320)
+		amplitude := 32768 * math.Pow(10, dbfs/20) * math.Sqrt2
+		for i := 0; i < 160; i++ {
+			binary.LittleEndian.PutUint16(pcm[2*i:], uint16(int16(amplitude*math.Sin(float64(i)*0.3))))
+		}
+		return pcm
+	}
+	level := func(g *gainControl, dbfs float64, frames int) float64 {
+		var out []byte
+		for range frames {
+			out = g.apply(frame(dbfs))
+		}
+		return toDBFS(rms(out))
+	}
+
+	// a quiet microphone is brought up to the target, and a loud one down to it
+	g := newGainControl(cfg, "", 16000)
+	if got := level(g, -38, 300); got < -24 || got > -18 {
+		t.Fatalf("quiet speech brought to %.1f dBFS, want about -20", got)
+	}
+	quietGain := g.gainDB()
+	if got := level(newGainControl(cfg, "", 16000), -6, 100); got < -24 || got > -18 {
+		t.Fatalf("loud speech brought to %.1f dBFS, want about -20", got)
+	}
+	// pauses keep the gain of the speech before them
+	level(g, -70, 300)
+	if gain := g.gainDB(); math.Abs(gain-quietGain) > 0.5 {
+		t.Fatalf("gain moved from %.1f to %.1f dB in a pause", quietGain, gain)
+	}
+	// and the gain starts at unity and is bounded by max_gain
+	if g = newGainControl(cfg, "", 16000); g.gainDB() != 0 {
+		t.Fatal("expected gain control to start at unity gain")
+	}
+	level(g, -48, 300)
+	if gain := g.gainDB(); math.Abs(gain-20*math.Log10(8)) > 0.1 {
+		t.Fatalf("gain of %.1f dB, want it capped at max_gain", gain)
+	}
+
+	// calibration leaves the gain to gain control
+	cfg.Calibration = config.CalibrationConfig{Enabled: true, Duration: "100ms", MinThreshold: 0.4, MaxThreshold: 0.8, TargetLevel: -20, MaxGain: 4, NoiseCeiling: -50}
+	c := newCalibration(cfg, 16000, false)
+	for range 10 {
+		c.process(frame(-70))
+	}
+	speech := frame(-40)
+	if got, _ := c.process(speech); c.calibrated() == nil || !bytes.Equal(got, speech) {
+		t.Fatal("expected calibration not to amplify sessions with gain control")
+	}
+}
+
+func TestEchoCancellation(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Audio.Channels = 1
+	cfg.AEC = config.AECConfig{Tail: "64ms", MaxDelay: "500ms"}
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	if newEchoCanceller(cfg, "", FullDuplex, 16000, clk.Now()) != nil {
+		t.Fatal("expected no echo cancellation by default")
+	}
+	cfg.AEC.Enabled = true
+	if newEchoCanceller(cfg, "", HalfDuplex, 16000, clk.Now()) != nil {
+		t.Fatal("expected half duplex devices to need no echo cancellation")
+	}
+	a := newEchoCanceller(cfg, "", FullDuplex, 16000, clk.Now())
+
+	// the device plays the response audio as it is sent, and its microphone picks it up 160ms
+	// later, with a reflection
+	rng := mrand.New(mrand.NewPCG(1, 2))
+	response := make([]int16, 16000*12)
+	for i := range response {
+		response[i] = int16(3000 * rng.NormFloat64())
+	}
+	const frame, delay = 320, 2560
+	echo := func(pos int) float64 {
+		var e float64
+		if i := pos - delay; i >= 0 {
+			e += 0.5 * float64(response[i])
+		}
+		if i := pos - delay - 37; i >= 0 {
+			e -= 0.2 * float64(response[i])
+		}
+		return e
+	}
+	power := func(pcm []byte) float64 {
+		var sum float64
+		for i := 0; i+1 < len(pcm); i += 2 {
+			s := float64(int16(binary.LittleEndian.Uint16(pcm[i:])))
+			sum += s * s
+		}
+		return sum
+	}
+	// run relays the response audio and the device's audio from step to step, with the user saying
+	// the given tone over it, and returns the power of the uplink before and after cancellation
+	step := 0
+	run := func(steps int, tone float64) (heard, left float64) {
+		for range steps {
+			a.downlink(clk.Now(), audio.Int16ToPCM(response[step*frame:(step+1)*frame]), 16000)
+			clk.Advance(20 * time.Millisecond)
+			mic := make([]int16, frame)
+			for i := range mic {
+				pos := step*frame + i
+				mic[i] = int16(echo(pos) + tone*math.Sin(2*math.Pi*440*float64(pos)/16000))
+			}
+			pcm := audio.Int16ToPCM(mic)
+			out := a.cancel(clk.Now(), pcm)
+			heard, left = heard+power(pcm), left+power(out)
+			step++
+		}
+		return heard, left
+	}
+
+	run(250, 0)
+	if st := a.status(); st.DelayMs < 140 || st.DelayMs > 170 {
+		t.Fatalf("echo found %d ms late, want about 160", st.DelayMs)
+	}
+	if heard, left := run(50, 0); 10*math.Log10(heard/left) < 15 {
+		t.Fatalf("echo lowered by %.1f dB, want at least 15", 10*math.Log10(heard/left))
+	}
+	// the user is heard over the assistant, and the filter does not adapt to them
+	var tone float64
+	for i := 0; i < frame*50; i++ {
+		s := 6000 * math.Sin(2*math.Pi*440*float64(step*frame+i)/16000)
+		tone += s * s
+	}
+	if _, left := run(50, 6000); math.Abs(10*math.Log10(left/tone)) > 1 {
+		t.Fatalf("the user was heard %.1f dB off over the assistant", 10*math.Log10(left/tone))
+	}
+	if heard, left := run(50, 0); 10*math.Log10(heard/left) < 15 {
+		t.Fatalf("echo lowered by %.1f dB after the user talked, want at least 15", 10*math.Log10(heard/left))
+	}
+	if st := a.status(); st.ERLEDB < 10 {
+		t.Fatalf("unexpected echo cancellation status %+v", st)
+	}
+	// an interrupted answer is not played, so there is no echo of it to cancel
+	a.downlink(clk.Now(), audio.Int16ToPCM(response[:frame]), 16000)
+	a.stopPlayback(clk.Now())
+	if a.reference(a.position(clk.Now())) != 0 {
+		t.Fatal("expected the response audio after the interruption to be forgotten")
+	}
+}
+
+func TestClientVersions(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Websocket.WriteWait = "1s"
+	cfg.Versions = config.VersionsConfig{MinProtocol: 1, MinFirmware: "2.0.0", RecommendedFirmware: "2.4"}
+	h := NewHandler(cfg)
+
+	for _, tt := range []struct {
+		firmware string
+		outcome  string
+	}{
+		{"", VersionOutdated},
+		{"1.9.7", VersionOutdated},
+		{"not-a-version", VersionOutdated},
+		{"2.1.0", VersionRecommended},
+		{"v2.4.0-rc.1", VersionCurrent},
+		{"2.10", VersionCurrent},
+	} {
+		outcome, event := h.checkVersion(clientVersion{protocol: 1, firmware: tt.firmware})
+		if outcome != tt.outcome || (event == nil) != (outcome == VersionCurrent) {
+			t.Fatalf("firmware %q: got outcome %s and event %+v, want %s", tt.firmware, outcome, event, tt.outcome)
+		}
+	}
+
+	cfg.Versions.Enforce = true
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	header := http.Header{FirmwareVersionHeader: {"1.9.7"}}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?protocol_version=1", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := resp.Header.Get(ProtocolVersionHeader); got != "1" {
+		t.Fatalf("relay advertised protocol version %q", got)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var event upgradeEvent
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != UpgradeRequiredEvent || event.MinFirmwareVersion != "2.0.0" || !strings.Contains(event.Reason, "1.9.7") {
+		t.Fatalf("unexpected upgrade event %+v", event)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, CloseUpgradeRequired) {
+		t.Fatalf("expected the session to be closed with %d, got %v", CloseUpgradeRequired, err)
+	}
+	if n := len(h.sessions.List()); n != 0 {
+		t.Fatalf("rejected device got a session, %d sessions registered", n)
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Chaos = config.ChaosConfig{Enabled: true, DropEvents: 1, CorruptFrames: 1, ProviderDisconnects: 1, FrameDelay: "100ms", DisconnectWithin: "10s"}
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	h := NewHandler(cfg, WithSeed(3), WithClock(clk))
+	newSession := func(seed uint64) *Session {
+		return h.sessions.create(&Client{config: cfg, logger: h.logger}, "", "", nil, seed, h.clock)
+	}
+
+	a, b := newSession(11), newSession(11)
+	h.chaos.scheduleDisconnects(a)
+	h.chaos.scheduleDisconnects(b)
+	if a.chaosProviderCut == nil || a.chaosDeviceCut != nil {
+		t.Fatal("expected only the provider disconnect to be scheduled")
+	}
+	if !h.chaos.dropEvent(a) || !h.chaos.dropEvent(b) {
+		t.Fatal("expected the provider event to be dropped")
+	}
+
+	frame := []byte("sixteen bit pcm!")
+	ca, cb := h.chaos.corruptFrame(a, frame), h.chaos.corruptFrame(b, frame)
+	if string(frame) != "sixteen bit pcm!" {
+		t.Fatal("the original frame was modified")
+	}
+	diff := 0
+	for i := range frame {
+		for x := frame[i] ^ ca[i]; x != 0; x &= x - 1 {
+			diff++
+		}
+	}
+	if diff != 1 {
+		t.Fatalf("expected one flipped bit, got %d", diff)
+	}
+	if !bytes.Equal(ca, cb) {
+		t.Fatal("sessions with the same seed were corrupted differently")
+	}
+
+	clk.Advance(10 * time.Second)
+	select {
+	case <-h.chaos.cutProvider(a):
+	default:
+		t.Fatal("provider disconnect did not fire within chaos.disconnect_within")
+	}
+
+	// without chaos nothing is injected
+	var off *faultInjector
+	if off.dropEvent(a) || !bytes.Equal(off.corruptFrame(a, frame), frame) || off.cutProvider(a) != nil {
+		t.Fatal("a disabled fault injector injected a fault")
+	}
+}
+
+func TestHeatReport(t *testing.T) {
+	cfg := &config.Config{}
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	h := NewHandler(cfg, WithSeed(5), WithClock(clk))
+	a := h.sessions.create(&Client{config: cfg, logger: h.logger}, "", "acme", nil, 1, h.clock)
+	b := h.sessions.create(&Client{config: cfg, logger: h.logger}, "", "acme", nil, 2, h.clock)
+
+	for s, answer := range map[*Session]time.Duration{a: 800 * time.Millisecond, b: 1200 * time.Millisecond} {
+		s.heat.speechStoppedAt(clk.Now())
+		s.heat.responseAudioAt(clk.Now().Add(answer))
+		// only the first audio of an answer counts
+		s.heat.responseAudioAt(clk.Now().Add(2 * answer))
+		s.heat.observe(StageUplinkDSP, time.Millisecond)
+	}
+	a.heat.observe(StageDeviceRTT, 40*time.Millisecond)
+	b.heat.depth(QueueDownlinkBuffer, 300)
+	b.heat.depth(QueueDownlinkBuffer, 100)
+	a.heat.depth(QueueProviderEvents, 2)
+
+	report := NewHeatReport([]SessionHeat{a.Heat(), b.Heat()}, clk.Now())
+	if report.Bottleneck != CategoryProvider || report.ActiveSessions != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	var stages []string
+	for _, s := range report.Stages {
+		stages = append(stages, s.Stage)
+	}
+	if strings.Join(stages, ",") != "provider_response,device_rtt,uplink_dsp" {
+		t.Fatalf("stages ranked %v", stages)
+	}
+	slowest := report.Stages[0]
+	if slowest.Samples != 2 || slowest.Sessions != 2 || slowest.MaxMs != 1200 || slowest.WorstSessionID != b.ID {
+		t.Fatalf("unexpected provider stage: %+v", slowest)
+	}
+	if slowest.P50Ms != 1000 || slowest.P95Ms != 1200 || slowest.MeanMs != 1000 {
+		t.Fatalf("unexpected provider percentiles: %+v", slowest)
+	}
+	if q := report.Queues[0]; q.Queue != QueueDownlinkBuffer || q.Max != 300 || q.Mean != 200 || q.Unit != "ms" {
+		t.Fatalf("unexpected queue: %+v", q)
+	}
+
+	history := NewHeatHistory(1)
+	for _, s := range []*Session{a, b} {
+		heat := s.Heat()
+		heat.EndedAt = clk.Now()
+		history.add(heat)
+	}
+	recent := history.Recent()
+	if len(recent) != 1 || recent[0].SessionID != b.ID {
+		t.Fatalf("expected only the last session to be kept, got %+v", recent)
+	}
+	if report := NewHeatReport(recent, clk.Now()); report.ActiveSessions != 0 || report.Sessions != 1 {
+		t.Fatalf("unexpected report of finished sessions: %+v", report)
+	}
+}
+
+func TestCaptionTranslation(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Websocket.WriteWait = "1s"
+	cfg.Translation.Timeout = "50ms"
+	cfg.AIConfig.Transcription.Language = "en"
+	translator := TranslatorFunc(func(ctx context.Context, text, from, to string) (string, error) {
+		switch text {
+		case "Unknown.":
+			return "", errors.New("no translation")
+		case "Slow.":
+			<-ctx.Done()
+			return "", ctx.Err()
+		}
+		return "[" + from + ">" + to + "] " + text, nil
+	})
+	h := NewHandler(cfg, WithTranslator(translator), WithClock(clock.NewFake(time.Unix(1700000000, 0))))
+
+	sessions := make(chan *Session, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sessions <- h.sessions.create(NewClient(conn, h.logger, cfg), "", "", nil, h.nextSeed(), h.clock)
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session := <-sessions
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// a device displaying the language spoken gets its captions as they are
+	h.startCaptions(ctx, session, "en-GB")
+	if session.captions != nil {
+		t.Fatal("captions in the spoken language should not be translated")
+	}
+
+	h.startCaptions(ctx, session, "de")
+	var tracker sentenceTracker
+	h.sendSentences(ctx, session, tracker.write("item_1", "Hello there. Unknown. Slow. ", 100))
+	h.sendSentences(ctx, session, tracker.flush("item_1", 200))
+
+	want := []sentenceCompletedEvent{
+		{Text: "[en>de] Hello there.", OriginalText: "Hello there.", Language: "de"},
+		{Text: "Unknown."},
+		{Text: "Slow."},
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i, w := range want {
+		var got sentenceCompletedEvent
+		if err := conn.ReadJSON(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Index != i || got.Text != w.Text || got.OriginalText != w.OriginalText || got.Language != w.Language {
+			t.Fatalf("sentence %d: got %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+func TestTranscriptTimeline(t *testing.T) {
+	cfg := &config.Config{}
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	h := NewHandler(cfg, WithClock(clk))
+	session := h.sessions.create(&Client{config: cfg, logger: h.logger}, "", "", nil, 1, h.clock)
+
+	clk.Advance(time.Second)
+	session.speechStarted(clk.Now())
+	clk.Advance(2 * time.Second)
+	session.speechStopped(clk.Now())
+	clk.Advance(500 * time.Millisecond)
+	session.addTurn(store.UserRole, "item_1", "where is my order")
+
+	session.itemAudioStarted("item_2", clk.Now())
+	clk.Advance(time.Second)
+	session.itemAudioStarted("item_2", clk.Now())
+	var tracker sentenceTracker
+	session.noteSentences(tracker.write("item_2", "It ships ", 0))
+	session.noteSentences(tracker.write("item_2", "today. Bye.", 1200))
+	session.noteSentences(tracker.flush("item_2", 2000))
+	session.addTurn(store.AssistantRole, "item_2", "It ships today. Bye.")
+
+	turns := session.Record(clk.Now(), nil).Turns
+	if turns[0].StartMs != 1000 || turns[0].EndMs != 3000 {
+		t.Fatalf("user turn placed at %d-%d ms", turns[0].StartMs, turns[0].EndMs)
+	}
+	a := turns[1]
+	if a.StartMs != 3500 || a.EndMs != 5500 || len(a.Sentences) != 2 || a.Sentences[1].StartMs != 4700 || a.Sentences[1].Text != "Bye." {
+		t.Fatalf("unexpected assistant turn: %+v", a)
+	}
+}
+
+func TestEchoDetection(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Websocket.WriteWait = "1s"
+	cfg.Audio.SampleRate = 16000
+	cfg.Audio.Channels = 1
+	cfg.Echo = config.EchoConfig{Enabled: true, Threshold: 0.8, Window: "2s", MaxDelay: "500ms", MuteFor: "1s"}
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	h := NewHandler(cfg, WithClock(clk))
+
+	sessions := make(chan *Session, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sessions <- h.sessions.create(NewClient(conn, h.logger, cfg), "", "", nil, h.nextSeed(), h.clock)
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session := <-sessions
+	session.echo = newEchoDetector(cfg.Echo, clk.Now())
+
+	// loudness changing every 100ms, like speech
+	loudness := func(step int, phase float64) float64 {
+		return 500 + 8000*math.Abs(math.Sin(float64(step/5)*1.7+phase))
+	}
+	frame := func(amplitude float64) []byte {
+		pcm := make([]byte, 640)
+		for i := 0; i < 320; i++ {
+			binary.LittleEndian.PutUint16(pcm[2*i:], uint16(int16(amplitude*math.Sin(float64(i)*0.3))))
+		}
+		return pcm
+	}
+	const delay = 10 // 200ms of 20ms frames
+	muted := -1
+	for step := 0; step < 400 && muted < 0; step++ {
+		clk.Advance(20 * time.Millisecond)
+		session.echo.downlink(clk.Now(), frame(loudness(step, 0)), 16000)
+		// the first 4s the user talks over the assistant, then the speaker is heard at a third of its loudness
+		up := frame(loudness(step, 2))
+		if step >= 200 {
+			up = frame(loudness(step-delay, 0) / 3)
+		}
+		if got := h.checkEcho(session, up); !bytes.Equal(got, up) {
+			if step < 200 || !bytes.Equal(got, make([]byte, len(up))) {
+				t.Fatalf("frame %d altered", step)
+			}
+			muted = step
+		}
+	}
+	if muted < 0 {
+		t.Fatal("echo loop not detected")
+	}
+
+	var e echoDetectedEvent
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != EchoDetectedEvent || e.CorrelationPercent < 80 || e.DelayMs < 160 || e.DelayMs > 240 || e.MutedMs != 1000 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	// the uplink is heard again after a second
+	for step := muted + 1; step <= muted+50; step++ {
+		clk.Advance(20 * time.Millisecond)
+		up := frame(1000)
+		if got := h.checkEcho(session, up); bytes.Equal(got, up) != (step == muted+50) {
+			t.Fatalf("frame %d muted: %v", step-muted, !bytes.Equal(got, up))
+		}
+	}
+}
+
+type fakeUplink struct {
+	ai.AIClient
+	sent []byte
+}
+
+func (f *fakeUplink) SendAudio(_ context.Context, a audio.Audio) error {
+	f.sent = append(f.sent, a.AsPCM16()...)
+	return nil
+}
+
+func TestPushToTalk(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Audio.SampleRate = 16000
+	cfg.Audio.Channels = 1
+	cfg.PTT = config.PTTConfig{PreBuffer: "1s", EndSilence: "600ms"}
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	h := NewHandler(cfg, WithClock(clk))
+	session := h.sessions.create(&Client{config: cfg, logger: h.logger}, "", "", nil, 1, h.clock)
+	provider := &fakeUplink{}
+	session.setProvider(provider)
+
+	if newPushToTalk(cfg, httptest.NewRequest("GET", "/", nil), cfg.Audio.SampleRate) != nil {
+		t.Fatal("hands-free devices should not be in push-to-talk mode")
+	}
+	session.ptt = newPushToTalk(cfg, httptest.NewRequest("GET", "/?input_mode=push_to_talk", nil), cfg.Audio.SampleRate)
+
+	// 2s of 20ms frames with the button up
+	frame := func() []byte { return bytes.Repeat([]byte{1}, 640) }
+	for i := 0; i < 100; i++ {
+		clk.Advance(20 * time.Millisecond)
+		if !session.ptt.hold(clk.Now(), frame()) {
+			t.Fatal("audio relayed with the button up")
+		}
+	}
+	// the press was reported 250ms late
+	h.handleControlMessage(context.Background(), session, []byte(`{"type":"ptt.begin","captured_at_ms":1000,"sent_at_ms":1250}`))
+	if len(provider.sent) != 8000 {
+		t.Fatalf("relayed %d bytes of the pre-buffer, want 250ms", len(provider.sent))
+	}
+	if session.ptt.hold(clk.Now(), frame()) {
+		t.Fatal("audio held back with the button down")
+	}
+	provider.sent = nil
+	h.handleControlMessage(context.Background(), session, []byte(`{"type":"ptt.end"}`))
+	if len(provider.sent) != 19200 || !bytes.Equal(provider.sent, make([]byte, 19200)) {
+		t.Fatalf("sent %d bytes at the release, want 600ms of silence", len(provider.sent))
+	}
+
+	// compensation is capped at the pre-buffer
+	for i := 0; i < 100; i++ {
+		clk.Advance(20 * time.Millisecond)
+		session.ptt.hold(clk.Now(), frame())
+	}
+	provider.sent = nil
+	h.handleControlMessage(context.Background(), session, []byte(`{"type":"ptt.begin","captured_at_ms":0,"sent_at_ms":5000}`))
+	if len(provider.sent) != 32000 {
+		t.Fatalf("relayed %d bytes of the pre-buffer, want 1s", len(provider.sent))
+	}
+}
+
+// fakeProvider is a provider connection driven by the test
+type fakeProvider struct {
+	params    ai.ProviderParams
+	responses chan ai.ResponseAudio
+	events    chan ai.Event
+	errs      chan error
+	history   chan []ai.HistoryItem
+	closed    chan struct{}
+}
+
+func newFakeProvider(p ai.ProviderParams) *fakeProvider {
+	return &fakeProvider{
+		params:    p,
+		responses: make(chan ai.ResponseAudio),
+		events:    make(chan ai.Event),
+		errs:      make(chan error, 1),
+		history:   make(chan []ai.HistoryItem, 1),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (f *fakeProvider) Initialize(context.Context) error              { return nil }
+func (f *fakeProvider) GetResponseStream() <-chan ai.ResponseAudio    { return f.responses }
+func (f *fakeProvider) GetEventsStream() <-chan ai.Event              { return f.events }
+func (f *fakeProvider) Errors() <-chan error                          { return f.errs }
+func (f *fakeProvider) SendAudio(context.Context, audio.Audio) error  { return nil }
+func (f *fakeProvider) Truncate(context.Context, string, int64) error { return nil }
+func (f *fakeProvider) Close()                                        { close(f.closed) }
+func (f *fakeProvider) LoadHistory(_ context.Context, items []ai.HistoryItem) error {
+	f.history <- items
+	return nil
+}
+
+func TestProviderRefresh(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Websocket.WriteWait = "1s"
+	cfg.Audio.SampleRate = 16000
+	cfg.Audio.Channels = 1
+	cfg.AIConfig.Provider = "fake"
+	cfg.AIConfig.RefreshDrainTimeout = "5s"
+	providers := make(chan *fakeProvider, 2)
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(p ai.ProviderParams) (ai.AIClient, error) {
+		f := newFakeProvider(p)
+		providers <- f
+		return f, nil
+	})
+	h := NewHandler(cfg, WithProviderRegistry(reg))
+
+	sessions := make(chan *Session, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sessions <- h.sessions.create(NewClient(conn, h.logger, cfg), "", "", nil, h.nextSeed(), h.clock)
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	session := <-sessions
+
+	if err := h.RefreshProvider("missing", ProviderProfile{}); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("refreshing an unknown session: %v", err)
+	}
+	if err := h.RefreshProvider(session.ID, ProviderProfile{Provider: "other"}); err == nil {
+		t.Fatal("refreshing to an unknown provider should fail")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ab := utils.NewBufferSizeController(4096)
+	go h.superviseProvider(ctx, session, &ab)
+	first := <-providers
+	session.addTurn(store.UserRole, "item_1", "hello")
+	// the second chunk is taken once the first was relayed
+	for i := 0; i < 2; i++ {
+		first.responses <- ai.ResponseAudio{ItemID: "item_2", Audio: audio.FromPCM16(make([]byte, 640), 16000, 1)}
+	}
+
+	profile := ProviderProfile{Model: "gpt-x", Instructions: "You are a pirate."}
+	if err := h.RefreshProvider(session.ID, profile); err != nil {
+		t.Fatal(err)
+	}
+	// the answer being given is finished on the old provider session first
+	select {
+	case <-providers:
+		t.Fatal("provider replaced while answering")
+	case <-time.After(100 * time.Millisecond):
+	}
+	first.events <- ai.Event{Type: ai.AudioTranscriptDoneEventType, ItemID: "item_2", Text: "Ahoy."}
+
+	var second *fakeProvider
+	select {
+	case second = <-providers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("provider not refreshed")
+	}
+	<-first.closed
+	if second.params.Model != profile.Model || second.params.Instructions != profile.Instructions {
+		t.Fatalf("new provider session created with %+v", second.params)
+	}
+	history := <-second.history
+	if len(history) != 2 || history[0] != (ai.HistoryItem{Role: "user", Text: "hello"}) || history[1] != (ai.HistoryItem{Role: "assistant", Text: "Ahoy."}) {
+		t.Fatalf("conversation restored as %+v", history)
+	}
+	if info := session.Info(); info.ProviderProfile == nil || info.ProviderProfile.Model != "gpt-x" {
+		t.Fatalf("profile not shown in session info: %+v", info.ProviderProfile)
+	}
+}
+
+func TestSpeakerPolicy(t *testing.T) {
+	cfg := config.Default()
+	cfg.Speaker.Enabled = true
+	cfg.Speaker.Sample = "100ms"
+	cfg.Speaker.Policies = map[string]config.SpeakerPolicy{
+		ChildSpeaker: {Action: SpeakerRestrict, Instructions: "Keep it suitable for children."},
+		TeenSpeaker:  {Action: SpeakerEnd},
+	}
+	if h := NewHandler(cfg); newSpeakerSampler(h.config, h.speakerClassifier, cfg.Audio.SampleRate) != nil {
+		t.Fatal("speakers should not be sampled without a classifier")
+	}
+
+	var attrs SpeakerAttributes
+	var audits []SpeakerAudit
+	reg := metrics.NewRegistry()
+	h := NewHandler(cfg, WithMetrics(reg),
+		WithSpeakerClassifier(SpeakerClassifierFunc(func(ctx context.Context, pcm []byte, sampleRate, channels int) (SpeakerAttributes, error) {
+			if attrs.AgeGroup == "" {
+				return attrs, errors.New("classifier unavailable")
+			}
+			return attrs, nil
+		})),
+		WithSpeakerAuditor(func(a SpeakerAudit) { audits = append(audits, a) }))
+
+	sessions := make(chan *Session, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		session := h.sessions.create(NewClient(conn, h.logger, cfg), "device", "acme", nil, h.nextSeed(), h.clock)
+		session.speaker = newSpeakerSampler(h.config, h.speakerClassifier, cfg.Audio.SampleRate)
+		sessions <- session
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session := <-sessions
+
+	// only the user's speech is sampled, until there is enough of it
+	frame := make([]byte, cfg.Audio.SampleRate*cfg.Audio.Channels*2/20)
+	if session.speaker.add(frame) != nil {
+		t.Fatal("sampled audio while the user was silent")
+	}
+	session.speaker.setSpeaking(true)
+	if session.speaker.add(frame) != nil {
+		t.Fatal("sample complete too early")
+	}
+	sample := session.speaker.add(frame)
+	if len(sample) != 2*len(frame) || session.speaker.add(frame) != nil {
+		t.Fatalf("expected a single sample of 100ms, got %d bytes", len(sample))
+	}
+
+	ctx := context.Background()
+	h.classifySpeaker(ctx, session, sample)
+	// classifications that are not sure enough are audited but apply no policy
+	attrs = SpeakerAttributes{AgeGroup: ChildSpeaker, Confidence: 0.5}
+	h.classifySpeaker(ctx, session, sample)
+	if session.profile.Load() != nil {
+		t.Fatal("policy applied to an unsure classification")
+	}
+	attrs.Confidence = 0.9
+	h.classifySpeaker(ctx, session, sample)
+	if p := session.providerProfile(); p.Instructions != "Keep it suitable for children." {
+		t.Fatalf("session not restricted, profile %+v", p)
+	}
+	if len(audits) != 3 || audits[0].Error == nil || audits[1].Action != "" || audits[2].Action != SpeakerRestrict || audits[2].TenantID != "acme" {
+		t.Fatalf("unexpected audits %+v", audits)
+	}
+	rec := session.Record(time.Now(), nil)
+	if rec.Speaker == nil || rec.Speaker.AgeGroup != ChildSpeaker || rec.Speaker.Action != SpeakerRestrict {
+		t.Fatalf("classification not kept in the record: %+v", rec.Speaker)
+	}
+	var out strings.Builder
+	reg.WriteTo(&out)
+	for _, want := range []string{
+		`pixa_speaker_classifications_total{age_group="",action="error"} 1`,
+		`pixa_speaker_classifications_total{age_group="child",action="none"} 1`,
+		`pixa_speaker_classifications_total{age_group="child",action="restrict"} 1`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %s in\n%s", want, out.String())
+		}
+	}
+
+	attrs = SpeakerAttributes{AgeGroup: TeenSpeaker, Confidence: 1}
+	h.classifySpeaker(ctx, session, sample)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Fatalf("expected the session to be ended by its policy, got %v", err)
+			}
+			break
+		}
+	}
+	if err := session.Client.Err(); !pixaerrors.HasCode(err, pixaerrors.PolicyViolation) {
+		t.Fatalf("expected the session to end with a policy violation, got %v", err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Websocket.WriteWait = "1s"
+	h := NewHandler(cfg)
+	idle := h.sessions.create(&Client{config: cfg, logger: h.logger}, "", "", nil, h.nextSeed(), h.clock)
+	answering := h.sessions.create(&Client{config: cfg, logger: h.logger}, "", "", nil, h.nextSeed(), h.clock)
+	answering.answerStarted()
+
+	report := h.Drain(context.Background(), 200*time.Millisecond)
+	if report.Sessions != 2 || report.SessionsDrained != 1 || report.SessionsForceClosed != 1 || report.Clean {
+		t.Fatalf("drain reported %+v", report)
+	}
+	if idle.teardownAt.Load() == 0 || answering.teardownAt.Load() == 0 {
+		t.Fatal("sessions left open by the drain")
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("connection during the drain answered with %d", rec.Code)
+	}
+}
+
+func TestSessionTrace(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Websocket.WriteWait = "1s"
+	cfg.Trace = config.TraceConfig{Enabled: true, Dir: t.TempDir(), Devices: []string{"dev-1"}}
+	h := NewHandler(cfg)
+
+	traced := make(chan *Session, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		session := h.sessions.create(NewClient(conn, h.logger, cfg), deviceID(r), "", nil, h.nextSeed(), h.clock)
+		h.startTrace(session)
+		session.Client.Send(map[string]string{"type": "session.welcome"})
+		session.Client.SendBinary(make([]byte, 640))
+		typ, message, err := conn.ReadMessage()
+		if err == nil {
+			session.Client.traceFrame(trace.FromDevice, typ, message)
+		}
+		session.Client.closeWith(websocket.CloseNormalClosure, "bye")
+		h.stopTrace(session)
+		traced <- session
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	for _, device := range []string{"dev-2", "dev-1"} {
+		conn, _, err := websocket.DefaultDialer.Dial(url+"?device_id="+device, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.ReadMessage()
+		conn.ReadMessage()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"ptt.end"}`))
+		conn.ReadMessage()
+		conn.Close()
+		<-traced
+	}
+
+	files, _ := filepath.Glob(filepath.Join(cfg.Trace.Dir, "*.pxtrace"))
+	if len(files) != 1 {
+		t.Fatalf("expected only the listed device to be traced, got %v", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := trace.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Header().DeviceID != "dev-1" || r.Header().Audio {
+		t.Fatalf("trace header %+v", r.Header())
+	}
+	want := []struct {
+		dir     trace.Direction
+		op      trace.Opcode
+		payload string
+	}{
+		{trace.ToDevice, trace.Text, `{"type":"session.welcome"}`},
+		{trace.ToDevice, trace.Binary, ""},
+		{trace.FromDevice, trace.Text, `{"type":"ptt.end"}`},
+		{trace.ToDevice, trace.Close, "\x03\xe8bye"},
+	}
+	for i, w := range want {
+		rec, err := r.Next()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if rec.Direction != w.dir || rec.Opcode != w.op || string(rec.Data) != w.payload {
+			t.Errorf("frame %d: got %v %v %q", i, rec.Direction, rec.Opcode, rec.Data)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("expected the end of the trace, got %v", err)
+	}
+}
@@ -0,0 +1,369 @@
+package websocket
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Stages of the relay pipeline whose latency is tracked for the heat report
+const (
+	// StageUplinkDSP is checking, decrypting and decoding an audio frame from the device
+	StageUplinkDSP = "uplink_dsp"
+	// StageProviderSend is sending uplink audio to the provider
+	StageProviderSend = "provider_send"
+	// StageProviderResponse is the time from the end of the user's speech to the first audio of
+	// the answer, the provider's round trip
+	StageProviderResponse = "provider_response"
+	// StageDownlinkDSP is resampling and encoding response audio for the device
+	StageDownlinkDSP = "downlink_dsp"
+	// StageDeviceWrite is writing an audio frame to the device
+	StageDeviceWrite = "device_write"
+	// StageDeviceRTT is the round trip of a keepalive ping to the device
+	StageDeviceRTT = "device_rtt"
+	// StageDeviceUplink is the time from the capture of an audio frame on the device to its arrival,
+	// from the timestamps of frame headers
+	StageDeviceUplink = "device_uplink"
+)
+
+// Where the time of a stage goes
+const (
+	CategoryDSP      = "dsp"
+	CategoryProvider = "provider"
+	CategoryNetwork  = "network"
+)
+
+var stageCategories = map[string]string{
+	StageUplinkDSP:        CategoryDSP,
+	StageProviderSend:     CategoryNetwork,
+	StageProviderResponse: CategoryProvider,
+	StageDownlinkDSP:      CategoryDSP,
+	StageDeviceWrite:      CategoryNetwork,
+	StageDeviceRTT:        CategoryNetwork,
+	StageDeviceUplink:     CategoryNetwork,
+}
+
+// Queues of a session whose depth is sampled for the heat report
+const (
+	// QueueDownlinkBuffer is the response audio waiting to be written to the device, in ms
+	QueueDownlinkBuffer = "downlink_buffer"
+	// QueueProviderResponses is the response audio chunks received from the provider and not yet
+	// relayed
+	QueueProviderResponses = "provider_responses"
+	// QueueProviderEvents is the provider events not yet handled
+	QueueProviderEvents = "provider_events"
+	// QueueJitterBuffer is the device audio held in the jitter buffer, in ms
+	QueueJitterBuffer = "jitter_buffer"
+)
+
+var queueUnits = map[string]string{
+	QueueDownlinkBuffer:    "ms",
+	QueueProviderResponses: "chunks",
+	QueueProviderEvents:    "events",
+	QueueJitterBuffer:      "ms",
+}
+
+// heatBuckets are the upper bounds, in ms, of the buckets stage latencies are counted in. Bucket
+// counts are kept rather than samples so that sessions can be merged in bounded memory.
+var heatBuckets = [...]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// stageStats summarizes the latencies of a stage
+type stageStats struct {
+	count   uint64
+	sumMs   float64
+	maxMs   float64
+	buckets [len(heatBuckets) + 1]uint64
+}
+
+func (s *stageStats) observe(ms float64) {
+	s.count++
+	s.sumMs += ms
+	s.maxMs = max(s.maxMs, ms)
+	s.buckets[sort.SearchFloat64s(heatBuckets[:], ms)]++
+}
+
+func (s *stageStats) merge(o stageStats) {
+	s.count += o.count
+	s.sumMs += o.sumMs
+	s.maxMs = max(s.maxMs, o.maxMs)
+	for i, n := range o.buckets {
+		s.buckets[i] += n
+	}
+}
+
+// quantile estimates the q quantile as the upper bound of the bucket it falls in, which the
+// maximum caps
+func (s *stageStats) quantile(q float64) float64 {
+	rank := uint64(q*float64(s.count) + 0.5)
+	rank = max(rank, 1)
+	var seen uint64
+	for i, n := range s.buckets {
+		seen += n
+		if seen >= rank && i < len(heatBuckets) {
+			return min(heatBuckets[i], s.maxMs)
+		}
+	}
+	return s.maxMs
+}
+
+// queueStats summarizes the sampled depths of a queue
+type queueStats struct {
+	count uint64
+	sum   float64
+	max   float64
+}
+
+func (q *queueStats) observe(depth float64) {
+	q.count++
+	q.sum += depth
+	q.max = max(q.max, depth)
+}
+
+// sessionHeat collects the stage latencies and queue depths of a session
+type sessionHeat struct {
+	mu     sync.Mutex
+	stages map[string]*stageStats
+	queues map[string]*queueStats
+	// speechStopped is when the user last stopped speaking, until the answer's first audio
+	speechStopped time.Time
+	// onObserve is called with every stage latency, outside the lock
+	onObserve func(stage string, d time.Duration)
+}
+
+// observe records that a stage took d
+func (h *sessionHeat) observe(stage string, d time.Duration) {
+	if h.onObserve != nil {
+		h.onObserve(stage, d)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stages == nil {
+		h.stages = make(map[string]*stageStats)
+	}
+	s, ok := h.stages[stage]
+	if !ok {
+		s = &stageStats{}
+		h.stages[stage] = s
+	}
+	s.observe(float64(d) / float64(time.Millisecond))
+}
+
+// depth records the depth of a queue
+func (h *sessionHeat) depth(queue string, depth float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.queues == nil {
+		h.queues = make(map[string]*queueStats)
+	}
+	q, ok := h.queues[queue]
+	if !ok {
+		q = &queueStats{}
+		h.queues[queue] = q
+	}
+	q.observe(depth)
+}
+
+// speechStoppedAt starts timing the provider's response
+func (h *sessionHeat) speechStoppedAt(t time.Time) {
+	h.mu.Lock()
+	h.speechStopped = t
+	h.mu.Unlock()
+}
+
+// responseAudioAt records the provider's response time if this is the first audio since the user
+// stopped speaking
+func (h *sessionHeat) responseAudioAt(t time.Time) {
+	h.mu.Lock()
+	stopped := h.speechStopped
+	h.speechStopped = time.Time{}
+	h.mu.Unlock()
+	if !stopped.IsZero() {
+		h.observe(StageProviderResponse, t.Sub(stopped))
+	}
+}
+
+// SessionHeat is a snapshot of the latencies and queue depths of a session
+type SessionHeat struct {
+	SessionID string
+	TenantID  string
+	// EndedAt is zero while the session is active
+	EndedAt time.Time
+
+	stages map[string]stageStats
+	queues map[string]queueStats
+}
+
+// Heat returns a snapshot of the session's stage latencies and queue depths
+func (s *Session) Heat() SessionHeat {
+	s.heat.mu.Lock()
+	defer s.heat.mu.Unlock()
+	snap := SessionHeat{
+		SessionID: s.ID,
+		TenantID:  s.TenantID,
+		stages:    make(map[string]stageStats, len(s.heat.stages)),
+		queues:    make(map[string]queueStats, len(s.heat.queues)),
+	}
+	for name, st := range s.heat.stages {
+		snap.stages[name] = *st
+	}
+	for name, q := range s.heat.queues {
+		snap.queues[name] = *q
+	}
+	return snap
+}
+
+// HeatHistory keeps the heat of the most recently finished sessions
+type HeatHistory struct {
+	mu       sync.Mutex
+	capacity int
+	sessions []SessionHeat
+	next     int
+}
+
+// NewHeatHistory creates a history keeping up to capacity sessions; 0 keeps none
+func NewHeatHistory(capacity int) *HeatHistory {
+	return &HeatHistory{capacity: capacity}
+}
+
+func (h *HeatHistory) add(heat SessionHeat) {
+	if h.capacity <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.sessions) < h.capacity {
+		h.sessions = append(h.sessions, heat)
+		return
+	}
+	h.sessions[h.next] = heat
+	h.next = (h.next + 1) % h.capacity
+}
+
+// Recent returns the kept sessions, most recently finished first
+func (h *HeatHistory) Recent() []SessionHeat {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	recent := make([]SessionHeat, 0, len(h.sessions))
+	for i := range h.sessions {
+		j := (h.next - 1 - i + 2*len(h.sessions)) % len(h.sessions)
+		recent = append(recent, h.sessions[j])
+	}
+	return recent
+}
+
+// HeatReport ranks the stages of the relay pipeline by how slow they were across sessions, so
+// on-call engineers can tell whether slowness is in DSP, the provider or the network
+type HeatReport struct {
+	GeneratedAt    time.Time `json:"generated_at"`
+	Sessions       int       `json:"sessions"`
+	ActiveSessions int       `json:"active_sessions"`
+	// Bottleneck is the category of the slowest stage, empty without samples
+	Bottleneck string `json:"bottleneck,omitempty"`
+	// Stages are ordered slowest first, by their p95 latency
+	Stages []StageHeat `json:"stages"`
+	// Queues are ordered deepest first, by their maximum depth
+	Queues []QueueHeat `json:"queues"`
+}
+
+// StageHeat is the latency of a stage across sessions. Percentiles are estimated from buckets and
+// are at most the bucket's upper bound above the true value.
+type StageHeat struct {
+	Stage    string  `json:"stage"`
+	Category string  `json:"category"`
+	Samples  uint64  `json:"samples"`
+	Sessions int     `json:"sessions"`
+	MeanMs   float64 `json:"mean_ms"`
+	P50Ms    float64 `json:"p50_ms"`
+	P95Ms    float64 `json:"p95_ms"`
+	MaxMs    float64 `json:"max_ms"`
+	// WorstSessionID is the session the maximum was seen in
+	WorstSessionID string `json:"worst_session_id"`
+}
+
+// QueueHeat is the sampled depth of a queue across sessions
+type QueueHeat struct {
+	Queue          string  `json:"queue"`
+	Unit           string  `json:"unit"`
+	Samples        uint64  `json:"samples"`
+	Sessions       int     `json:"sessions"`
+	Mean           float64 `json:"mean"`
+	Max            float64 `json:"max"`
+	WorstSessionID string  `json:"worst_session_id"`
+}
+
+// NewHeatReport aggregates the heat of sessions into a ranked report
+func NewHeatReport(sessions []SessionHeat, now time.Time) HeatReport {
+	report := HeatReport{GeneratedAt: now, Sessions: len(sessions), Stages: []StageHeat{}, Queues: []QueueHeat{}}
+	stages := make(map[string]*stageStats)
+	stageHeat := make(map[string]*StageHeat)
+	queues := make(map[string]*queueStats)
+	queueHeat := make(map[string]*QueueHeat)
+	for _, s := range sessions {
+		if s.EndedAt.IsZero() {
+			report.ActiveSessions++
+		}
+		for name, st := range s.stages {
+			if stages[name] == nil {
+				stages[name] = &stageStats{}
+				stageHeat[name] = &StageHeat{Stage: name, Category: stageCategories[name]}
+			}
+			if st.maxMs > stages[name].maxMs || stageHeat[name].WorstSessionID == "" {
+				stageHeat[name].WorstSessionID = s.SessionID
+			}
+			stages[name].merge(st)
+			stageHeat[name].Sessions++
+		}
+		for name, q := range s.queues {
+			if queues[name] == nil {
+				queues[name] = &queueStats{}
+				queueHeat[name] = &QueueHeat{Queue: name, Unit: queueUnits[name]}
+			}
+			if q.max > queues[name].max || queueHeat[name].WorstSessionID == "" {
+				queueHeat[name].WorstSessionID = s.SessionID
+			}
+			queues[name].count += q.count
+			queues[name].sum += q.sum
+			queues[name].max = max(queues[name].max, q.max)
+			queueHeat[name].Sessions++
+		}
+	}
+
+	for name, st := range stages {
+		h := stageHeat[name]
+		h.Samples = st.count
+		h.MeanMs = st.sumMs / float64(st.count)
+		h.P50Ms = st.quantile(0.5)
+		h.P95Ms = st.quantile(0.95)
+		h.MaxMs = st.maxMs
+		report.Stages = append(report.Stages, *h)
+	}
+	sort.Slice(report.Stages, func(i, j int) bool {
+		a, b := report.Stages[i], report.Stages[j]
+		if a.P95Ms != b.P95Ms {
+			return a.P95Ms > b.P95Ms
+		}
+		if a.MeanMs != b.MeanMs {
+			return a.MeanMs > b.MeanMs
+		}
+		return a.Stage < b.Stage
+	})
+	if len(report.Stages) > 0 {
+		report.Bottleneck = report.Stages[0].Category
+	}
+
+	for name, q := range queues {
+		h := queueHeat[name]
+		h.Samples = q.count
+		h.Mean = q.sum / float64(q.count)
+		h.Max = q.max
+		report.Queues = append(report.Queues, *h)
+	}
+	sort.Slice(report.Queues, func(i, j int) bool {
+		a, b := report.Queues[i], report.Queues[j]
+		if a.Max != b.Max {
+			return a.Max > b.Max
+		}
+		return a.Queue < b.Queue
+	})
+	return report
+}
@@ -0,0 +1,163 @@
+package websocket
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+)
+
+// Outcomes of waiting for device.hello, as counted in pixa_device_hellos_total
+const (
+	HelloConfigured = "configured"
+	HelloRejected   = "rejected"
+	// HelloMissing devices sent another message first, or nothing within device_hello.timeout
+	HelloMissing = "missing"
+)
+
+// deviceFormat is the audio a device sends, as declared in its upgrade request or device.hello
+type deviceFormat struct {
+	sampleRate int
+	mix        *downmix
+	frameSeq   *frameSequence
+	codec      string
+	decoder    audio.Decoder
+}
+
+// deviceFormat reads the format of a device's audio from its request, refusing formats the relay
+// cannot take
+func (h *Handler) deviceFormat(r *http.Request) (deviceFormat, error) {
+	var f deviceFormat
+	var err error
+	if f.sampleRate, err = h.inputSampleRate(r); err != nil {
+		return f, err
+	}
+	if f.mix, err = h.inputDownmix(r); err != nil {
+		return f, err
+	}
+	if f.frameSeq, err = h.frameFormat(r); err != nil {
+		return f, err
+	}
+	f.codec = requestCodec(r)
+	f.decoder, err = h.newDecoder(f.codec, f.sampleRate, cmp.Or(f.mix.channels(), h.config.Audio.Channels))
+	return f, err
+}
+
+// deviceRead is a message read from a device
+type deviceRead struct {
+	typ  int
+	data []byte
+	err  error
+}
+
+// awaitHello waits up to device_hello.timeout for the device's first message when device_hello is
+// enabled. It returns the device.hello if that is what came, or else the read of the first message,
+// which readPump takes on from.
+func (h *Handler) awaitHello(conn *websocket.Conn) (*deviceHelloMessage, chan deviceRead) {
+	if !h.config.DeviceHello.Enabled {
+		return nil, nil
+	}
+	first := make(chan deviceRead, 1)
+	go func() {
+		typ, data, err := conn.ReadMessage()
+		first <- deviceRead{typ: typ, data: data, err: err}
+	}()
+	timeout, _ := time.ParseDuration(h.config.DeviceHello.Timeout)
+	select {
+	case read := <-first:
+		var hello deviceHelloMessage
+		var msg controlMessage
+		if read.err == nil && read.typ == websocket.TextMessage && json.Unmarshal(read.data, &msg) == nil && msg.Type == DeviceHelloMessage {
+			if err := json.Unmarshal(read.data, &hello); err == nil {
+				return &hello, nil
+			}
+		}
+		first <- read
+	case <-h.clock.After(timeout):
+	}
+	h.metrics.deviceHello(HelloMissing)
+	return nil, first
+}
+
+// request returns r with the formats the hello declares in place of those of its headers and
+// query, so that the session is set up from them as from any upgrade request
+func (hello *deviceHelloMessage) request(r *http.Request) *http.Request {
+	r = r.Clone(r.Context())
+	for header, value := range map[string]string{
+		InputSampleRateHeader: itoa(hello.SampleRate),
+		CodecHeader:           hello.Codec,
+		InputChannelsHeader:   itoa(hello.Channels),
+		DownmixHeader:         hello.Downmix,
+		FirmwareVersionHeader: hello.FirmwareVersion,
+		DownlinkCodecHeader:   hello.DownlinkCodec,
+	} {
+		if value != "" {
+			r.Header.Set(header, value)
+		}
+	}
+	return r
+}
+
+func itoa(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// downlinkSampleRate returns the rate the device takes answers at, refusing rates the relay does
+// not serve
+func (h *Handler) downlinkSampleRate(hello *deviceHelloMessage) (int, error) {
+	rate := h.config.Audio.SampleRate
+	if hello == nil || hello.DownlinkSampleRate == 0 || hello.DownlinkSampleRate == rate {
+		return rate, nil
+	}
+	if !slices.Contains(InputSampleRates, hello.DownlinkSampleRate) {
+		return 0, &RejectError{StatusCode: http.StatusBadRequest, Reason: fmt.Sprintf("unsupported downlink sample rate %d", hello.DownlinkSampleRate)}
+	}
+	return hello.DownlinkSampleRate, nil
+}
+
+// rejectHello closes the connection of a device whose hello declared audio the relay cannot take.
+// The close code is 4000 plus the status the upgrade would have been refused with, such as 4415
+// for an unsupported codec.
+func (h *Handler) rejectHello(conn *websocket.Conn, r *http.Request, err error) {
+	h.metrics.deviceHello(HelloRejected)
+	client := NewClient(conn, h.logger.With("device_id", deviceID(r), "tenant_id", tenantID(r)), h.config)
+	client.logger.Info("Connection rejected", "remote_addr", r.RemoteAddr, "error", err)
+	client.closeFor(rejection(err))
+	h.middleware.onDisconnect(client, err)
+}
+
+// sendConfigured tells the device the audio formats its session uses, in answer to its hello
+func (h *Handler) sendConfigured(session *Session) {
+	err := session.Client.Send(deviceConfiguredEvent{
+		Type:               DeviceConfiguredEvent,
+		SampleRate:         session.sampleRate,
+		Codec:              session.codec,
+		Channels:           cmp.Or(session.downmix.channels(), h.config.Audio.Channels),
+		DownlinkCodec:      session.downlinkCodec,
+		DownlinkSampleRate: session.DownlinkSampleRate(),
+	})
+	if err != nil {
+		session.Client.logger.Error("Could not send device configuration", "error", err)
+	}
+}
+
+// nextMessage reads the device's next message, starting with the one read while waiting for its
+// hello
+func (s *Session) nextMessage() (int, []byte, error) {
+	if first := s.firstRead; first != nil {
+		s.firstRead = nil
+		read := <-first
+		return read.typ, read.data, read.err
+	}
+	return s.Client.conn.ReadMessage()
+}
@@ -0,0 +1,87 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+)
+
+// Headers devices can identify themselves with
+const (
+	DeviceIDHeader = "X-Pixa-Device-ID"
+	TenantIDHeader = "X-Pixa-Tenant-ID"
+)
+
+type contextKey int
+
+const (
+	deviceIDKey contextKey = iota
+	tenantIDKey
+	tagsKey
+	tokenClaimsKey
+)
+
+// WithDeviceID returns a copy of ctx carrying the identity of the device. An OnConnect middleware
+// that authenticates devices can use it to attach the authenticated identity to the request.
+func WithDeviceID(ctx context.Context, deviceID string) context.Context {
+	return context.WithValue(ctx, deviceIDKey, deviceID)
+}
+
+// DeviceIDFromContext returns the device identity attached with WithDeviceID
+func DeviceIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(deviceIDKey).(string)
+	return id, ok && id != ""
+}
+
+// deviceID identifies the device making the request: an identity attached to the request context
+// takes precedence over the device ID header, which takes precedence over the device_id query parameter
+func deviceID(r *http.Request) string {
+	if id, ok := DeviceIDFromContext(r.Context()); ok {
+		return id
+	}
+	if id := r.Header.Get(DeviceIDHeader); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("device_id")
+}
+
+// WithTenantID returns a copy of ctx carrying the tenant the device belongs to
+func WithTenantID(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantIDKey, tenantID)
+}
+
+// TenantIDFromContext returns the tenant attached with WithTenantID
+func TenantIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(tenantIDKey).(string)
+	return id, ok && id != ""
+}
+
+// tenantID returns the tenant of the device making the request, with the same precedence as deviceID
+func tenantID(r *http.Request) string {
+	if id, ok := TenantIDFromContext(r.Context()); ok {
+		return id
+	}
+	if id := r.Header.Get(TenantIDHeader); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("tenant_id")
+}
+
+// WithTokenClaims returns a copy of ctx carrying the claims of the token the device authenticated
+// with. Sessions run in the context of their request, so tools and providers can read the claims
+// with TokenClaimsFromContext.
+func WithTokenClaims(ctx context.Context, claims map[string]any) context.Context {
+	return context.WithValue(ctx, tokenClaimsKey, claims)
+}
+
+// TokenClaimsFromContext returns the claims attached with WithTokenClaims
+func TokenClaimsFromContext(ctx context.Context) (map[string]any, bool) {
+	claims, ok := ctx.Value(tokenClaimsKey).(map[string]any)
+	return claims, ok
+}
+
+// RequestIdentity returns the device and tenant a connection request is made for, resolved the same
+// way the handler does. OnConnect middleware registered after the one attaching an authenticated
+// identity see that identity.
+func RequestIdentity(r *http.Request) (string, string) {
+	return deviceID(r), tenantID(r)
+}
@@ -0,0 +1,101 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CorrelationIDHeader carries an ID of the customer's system the session belongs to, such as a
+// trace or call ID. It is attached to the session's logs, events and records next to the session
+// ID. Devices that cannot set headers use the correlation_id query parameter.
+const CorrelationIDHeader = "X-Pixa-Correlation-ID"
+
+// maxCorrelationID bounds the length of correlation IDs
+const maxCorrelationID = 128
+
+// Session ID formats of websocket.session_ids
+const (
+	HexIDFormat    = "hex"
+	ULIDFormat     = "ulid"
+	UUIDv7IDFormat = "uuidv7"
+)
+
+// IDGenerator returns the ID of a session started at now. Random parts must be drawn from r, the
+// session's random source, so sessions started with the same seed get the same ID.
+type IDGenerator func(now time.Time, r *rand.Rand) string
+
+// HexID generates 32 random hex digits
+func HexID(_ time.Time, r *rand.Rand) string {
+	b := binary.BigEndian.AppendUint64(nil, r.Uint64())
+	b = binary.BigEndian.AppendUint64(b, r.Uint64())
+	return hex.EncodeToString(b)
+}
+
+// crockford is the alphabet of ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID generates ULIDs: a millisecond timestamp and 80 random bits in 26 Crockford base32
+// characters, which sort by start time
+func ULID(now time.Time, r *rand.Rand) string {
+	var b [16]byte
+	ms := uint64(now.UnixMilli())
+	binary.BigEndian.PutUint16(b[0:], uint16(ms>>32))
+	binary.BigEndian.PutUint32(b[2:], uint32(ms))
+	binary.BigEndian.PutUint16(b[6:], uint16(r.Uint32()))
+	binary.BigEndian.PutUint64(b[8:], r.Uint64())
+
+	// 128 bits in 26 characters of 5 bits, the first holding the top 3
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// UUIDv7 generates version 7 UUIDs (RFC 9562): a millisecond timestamp and 74 random bits, which
+// sort by start time
+func UUIDv7(now time.Time, r *rand.Rand) string {
+	var b [16]byte
+	ms := uint64(now.UnixMilli())
+	binary.BigEndian.PutUint16(b[0:], uint16(ms>>32))
+	binary.BigEndian.PutUint32(b[2:], uint32(ms))
+	binary.BigEndian.PutUint16(b[6:], uint16(r.Uint32()))
+	binary.BigEndian.PutUint64(b[8:], r.Uint64())
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// idGenerator returns the generator of a websocket.session_ids format, HexID for unknown ones
+func idGenerator(format string) IDGenerator {
+	switch format {
+	case ULIDFormat:
+		return ULID
+	case UUIDv7IDFormat:
+		return UUIDv7
+	}
+	return HexID
+}
+
+// correlationID returns the correlation ID the device connected with, if it is valid: up to 128
+// printable ASCII characters without spaces
+func correlationID(r *http.Request) (string, error) {
+	id := strings.TrimSpace(headerOrQuery(r, CorrelationIDHeader, "correlation_id"))
+	if len(id) > maxCorrelationID {
+		return "", fmt.Errorf("correlation ID longer than %d characters", maxCorrelationID)
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return "", fmt.Errorf("correlation ID %q contains %q", id, c)
+		}
+	}
+	return id, nil
+}
@@ -0,0 +1,150 @@
+package websocket
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// jitterBuffer holds the device's audio, after the pipeline and before it is resampled and sent to
+// the provider, for jitter.delay, and releases it at the pace it was captured, so frames arriving
+// in bursts reach the provider as a steady stream. Frames are placed by the capture times of their
+// headers, or else one after the other, in the order the frame sequence put them in. A frame
+// arriving after it was due, as after a stall, is late: the buffer starts over from it, so the
+// frames after it are held for jitter.delay again. A frame that would be held longer than
+// jitter.max_delay, as from a device clock running fast, is caught up on the same way. The read
+// pump pushes frames and the session's playout goroutine releases them. A nil *jitterBuffer holds
+// nothing.
+type jitterBuffer struct {
+	delay    time.Duration
+	maxDelay time.Duration
+	// wake tells the playout goroutine that a frame was pushed
+	wake chan struct{}
+
+	mu      sync.Mutex
+	frames  []jitterFrame
+	held    time.Duration
+	started bool
+	// anchor is when audio captured at base, or at media time 0 without capture times, is due,
+	// before the delay; media is the media time of the next frame without a capture time
+	anchor time.Time
+	base   time.Time
+	media  time.Duration
+	last   time.Time
+}
+
+// jitterFrame is audio held in the jitter buffer until it is due
+type jitterFrame struct {
+	audio    audio.Audio
+	due      time.Time
+	duration time.Duration
+}
+
+// newJitterBuffer returns the jitter buffer of a session, or nil if audio is not buffered
+func newJitterBuffer(cfg config.JitterConfig) *jitterBuffer {
+	if !cfg.Enabled {
+		return nil
+	}
+	delay, _ := time.ParseDuration(cfg.Delay)
+	maxDelay, _ := time.ParseDuration(cfg.MaxDelay)
+	return &jitterBuffer{delay: delay, maxDelay: max(maxDelay, delay), wake: make(chan struct{}, 1)}
+}
+
+// push holds audio that arrived at now, captured at captured if the device said. It reports
+// whether the audio was late, and how much audio the buffer holds.
+func (j *jitterBuffer) push(now time.Time, a audio.Audio, captured time.Time) (bool, time.Duration) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.started {
+		j.started, j.anchor, j.base = true, now, captured
+	}
+	media := j.media
+	if !captured.IsZero() && !j.base.IsZero() {
+		media = captured.Sub(j.base)
+	}
+	due := j.anchor.Add(media + j.delay)
+	late := due.Before(now)
+	if late || due.After(now.Add(j.maxDelay)) {
+		// start over from this frame
+		moved := now.Add(j.delay)
+		j.anchor = j.anchor.Add(moved.Sub(due))
+		due = moved
+	}
+	if due.Before(j.last) {
+		due = j.last
+	}
+	duration := a.Duration()
+	j.media, j.last = media+duration, due
+	j.frames = append(j.frames, jitterFrame{audio: a, due: due, duration: duration})
+	j.held += duration
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+	return late, j.held
+}
+
+// next returns when the first frame held is due, false when none is held
+func (j *jitterBuffer) next() (time.Time, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.frames) == 0 {
+		return time.Time{}, false
+	}
+	return j.frames[0].due, true
+}
+
+// pop returns the audio due at now, in order
+func (j *jitterBuffer) pop(now time.Time) []audio.Audio {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var due []audio.Audio
+	for len(j.frames) > 0 && !j.frames[0].due.After(now) {
+		due = append(due, j.frames[0].audio)
+		j.held -= j.frames[0].duration
+		j.frames = j.frames[1:]
+	}
+	return due
+}
+
+// bufferAudio holds audio from the pipeline in the session's jitter buffer. It reports whether the
+// audio was held, false without a jitter buffer, when it is sent at once.
+func (h *Handler) bufferAudio(session *Session, a audio.Audio, captured time.Time) bool {
+	j := session.playout
+	if j == nil {
+		return false
+	}
+	late, held := j.push(session.clock.Now(), a, captured)
+	if late {
+		h.metrics.jitterLate()
+	}
+	h.metrics.jitterDepth(held)
+	session.heat.depth(QueueJitterBuffer, float64(held.Milliseconds()))
+	return true
+}
+
+// playJitter sends the audio of the session's jitter buffer to the provider as it falls due,
+// until ctx is done. Audio still held then is dropped with the session.
+func (h *Handler) playJitter(ctx context.Context, session *Session) {
+	j := session.playout
+	for {
+		var due <-chan time.Time
+		if at, ok := j.next(); ok {
+			due = session.clock.After(at.Sub(session.clock.Now()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-j.wake:
+		case <-due:
+		}
+		for _, a := range j.pop(session.clock.Now()) {
+			if err := h.sendAudio(ctx, session, a); err != nil {
+				session.Client.logger.Error("Could not send audio to AI Client", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package websocket
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+)
+
+const (
+	// ListenSampleRate is the sample rate of the mono audio supervisors listen to
+	ListenSampleRate = 16000
+	// listenChunk is how much audio is written to a listener at a time
+	listenChunk = 20 * time.Millisecond
+	// listenDelay is how long the user's audio is held before it is mixed, so frames arriving a
+	// little late are not heard as gaps
+	listenDelay = 100 * time.Millisecond
+	// maxListenUplink and maxListenDownlink are the most audio held for a listener that is not
+	// keeping up; answers arrive faster than they are played, so more of them is held
+	maxListenUplink   = time.Second
+	maxListenDownlink = time.Minute
+)
+
+// liveAudio mixes the audio of a session for the supervisors listening to it: what the provider
+// hears of the user, as it is sent, and the answers, as they are played on the device. Both are
+// converted to ListenSampleRate mono once, and queued for every listener. The zero value has no
+// listeners, and taps cost nothing until one is added.
+type liveAudio struct {
+	mu        sync.Mutex
+	listeners map[*liveListener]struct{}
+	ended     chan struct{}
+	closed    bool
+	up, down  *audio.Resampler
+}
+
+// liveListener is the audio queued for a supervisor, at ListenSampleRate
+type liveListener struct {
+	up, down []int16
+}
+
+// add registers a listener, returning the channel closed when the session ends. It reports false
+// when the session has ended already.
+func (l *liveAudio) add() (*liveListener, <-chan struct{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, nil, false
+	}
+	if l.listeners == nil {
+		l.listeners = make(map[*liveListener]struct{})
+		l.ended = make(chan struct{})
+	}
+	ll := &liveListener{}
+	l.listeners[ll] = struct{}{}
+	return ll, l.ended, true
+}
+
+// remove unregisters a listener
+func (l *liveAudio) remove(ll *liveListener) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.listeners, ll)
+}
+
+// close ends the session's listening, once it ends
+func (l *liveAudio) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed && l.ended != nil {
+		close(l.ended)
+	}
+	l.closed, l.listeners = true, nil
+}
+
+// uplink queues the user's audio, as sent to the provider
+func (l *liveAudio) uplink(a audio.Audio) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.listeners) == 0 {
+		return
+	}
+	pcm := a.AsPCM16()
+	if ch := a.GetChannels(); ch > 1 {
+		pcm = audio.Downmix(pcm, ch, 1, audio.MixChannels)
+	}
+	l.up = listenResampler(l.up, a.GetSampleRate())
+	samples := listenSamples(l.up, pcm, a.GetSampleRate())
+	for ll := range l.listeners {
+		ll.up = queueListen(ll.up, samples, maxListenUplink)
+	}
+}
+
+// downlink queues the answer's audio, mono 16 bit PCM at rate, as written to the device
+func (l *liveAudio) downlink(pcm []byte, rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.listeners) == 0 {
+		return
+	}
+	l.down = listenResampler(l.down, rate)
+	samples := listenSamples(l.down, pcm, rate)
+	for ll := range l.listeners {
+		ll.down = queueListen(ll.down, samples, maxListenDownlink)
+	}
+}
+
+// stopPlayback drops the answer queued for listeners, as the device stops playing it when the
+// user interrupts
+func (l *liveAudio) stopPlayback() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ll := range l.listeners {
+		ll.down = nil
+	}
+}
+
+// mix takes the next chunk of a listener's audio, the user's and the answer's added together, as
+// 16 bit PCM. Audio that has not arrived yet is silence.
+func (l *liveAudio) mix(ll *liveListener, samples int) []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]int16, samples)
+	for _, queue := range []*[]int16{&ll.up, &ll.down} {
+		n := min(samples, len(*queue))
+		for i, s := range (*queue)[:n] {
+			out[i] = int16(max(min(int32(out[i])+int32(s), 32767), -32768))
+		}
+		*queue = (*queue)[n:]
+	}
+	return audio.Int16ToPCM(out)
+}
+
+// listenResampler returns the resampler of a stream at rate, replacing r when the rate changed
+func listenResampler(r *audio.Resampler, rate int) *audio.Resampler {
+	if from, _ := r.Rates(); from != rate {
+		return audio.NewResampler(rate, ListenSampleRate, 1)
+	}
+	return r
+}
+
+// listenSamples converts mono 16 bit PCM at rate to ListenSampleRate
+func listenSamples(r *audio.Resampler, pcm []byte, rate int) []int16 {
+	a := r.Resample(audio.FromPCM16(pcm, rate, 1))
+	samples, _ := audio.Pcm16ToInt16Slice(a.AsPCM16())
+	return samples
+}
+
+// queueListen appends samples to a listener's queue, dropping its oldest audio beyond limit
+func queueListen(queue, samples []int16, limit time.Duration) []int16 {
+	queue = append(queue, samples...)
+	if n := int(limit * ListenSampleRate / time.Second); len(queue) > n {
+		queue = append(queue[:0], queue[len(queue)-n:]...)
+	}
+	return queue
+}
+
+// Listen streams the live audio of a session to a supervisor over HTTP until the session ends or
+// the request is cancelled: the user and the answers mixed, mono at ListenSampleRate, as WAV, the
+// default, or with format=ogg as Ogg/Opus when the handler has an Opus encoder. The stream starts
+// when the request is made; what was said before is not heard.
+func (h *Handler) Listen(w http.ResponseWriter, r *http.Request, sessionID string) {
+	session, ok := h.sessions.Get(sessionID)
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	var write func(pcm []byte) error
+	switch format := strings.ToLower(r.URL.Query().Get("format")); format {
+	case "", "wav":
+		w.Header().Set("Content-Type", "audio/wav")
+		header := audio.StreamingWAVHeader(ListenSampleRate, 1)
+		write = func(pcm []byte) error {
+			if header != nil {
+				pcm, header = append(header, pcm...), nil
+			}
+			_, err := w.Write(pcm)
+			return err
+		}
+	case "ogg":
+		if h.opusEncoder == nil {
+			http.Error(w, "listening as Ogg/Opus needs an Opus encoder", http.StatusNotAcceptable)
+			return
+		}
+		enc, err := h.opusEncoder(ListenSampleRate, 1)
+		if err != nil {
+			http.Error(w, "could not set up Opus encoder: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "audio/ogg")
+		var ogg *audio.OggOpusWriter
+		write = func(pcm []byte) error {
+			if ogg == nil {
+				if ogg, err = audio.NewOggOpusWriter(w, uint32(session.clock.Now().UnixNano()), ListenSampleRate, 1); err != nil {
+					return err
+				}
+			}
+			packet, err := enc.Encode(pcm)
+			if err != nil {
+				return err
+			}
+			return ogg.WritePacket(packet, len(pcm)/2)
+		}
+	default:
+		http.Error(w, "unsupported listen format "+format, http.StatusBadRequest)
+		return
+	}
+	ll, ended, ok := session.live.add()
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	defer session.live.remove(ll)
+	w.Header().Set("Cache-Control", "no-store")
+	rc := http.NewResponseController(w)
+	// the stream lasts as long as the session, whatever the server's write timeout
+	_ = rc.SetWriteDeadline(time.Time{})
+	h.metrics.listening(1)
+	defer h.metrics.listening(-1)
+	session.Client.logger.Info("Supervisor listening to session", "remote_addr", r.RemoteAddr)
+	defer session.Client.logger.Info("Supervisor stopped listening to session", "remote_addr", r.RemoteAddr)
+
+	next := session.clock.Now().Add(listenDelay)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ended:
+			return
+		case <-session.clock.After(next.Sub(session.clock.Now())):
+		}
+		if err := write(session.live.mix(ll, int(listenChunk*ListenSampleRate/time.Second))); err != nil {
+			return
+		}
+		_ = rc.Flush()
+		next = next.Add(listenChunk)
+		// a listener that fell far behind skips ahead rather than catching up in a burst
+		if now := session.clock.Now(); now.Sub(next) > maxListenUplink {
+			next = now
+		}
+	}
+}
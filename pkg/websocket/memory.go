@@ -0,0 +1,163 @@
+package websocket
+
+import (
+	"sync"
+
+	"github.com/pixaverse-studios/websocket-server/internal/utils"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	pixaerrors "github.com/pixaverse-studios/websocket-server/pkg/errors"
+)
+
+// Memory pools of a session, the buffers its memory budget is spread over
+const (
+	// MemoryDownlink is the response audio waiting to be written to the device
+	MemoryDownlink = "downlink"
+	// MemoryOffline is the uplink audio buffered while the provider is unreachable
+	MemoryOffline = "offline"
+)
+
+// What happens when a buffer would go over its memory budget
+const (
+	// ShedDropOldest drops the oldest audio in the buffer until the new audio fits
+	ShedDropOldest = "drop_oldest"
+	// ShedDropNewest drops the new audio
+	ShedDropNewest = "drop_newest"
+	// ShedClose ends the session
+	ShedClose = "close"
+)
+
+// MemoryUsage is a snapshot of a session's buffer memory
+type MemoryUsage struct {
+	UsedBytes int64 `json:"used_bytes"`
+	// BudgetBytes bounds all pools together; 0 means unlimited
+	BudgetBytes int64                `json:"budget_bytes"`
+	ShedPolicy  string               `json:"shed_policy"`
+	Pools       map[string]PoolUsage `json:"pools"`
+}
+
+// PoolUsage is the memory held by one of a session's buffers
+type PoolUsage struct {
+	UsedBytes int64 `json:"used_bytes"`
+	PeakBytes int64 `json:"peak_bytes"`
+	// LimitBytes bounds the pool on its own; 0 means only the session budget applies
+	LimitBytes int64 `json:"limit_bytes"`
+	// ShedBytes is the audio dropped to keep the pool within budget
+	ShedBytes int64 `json:"shed_bytes"`
+}
+
+// memoryBudget accounts for the memory held by a session's buffers. Each buffer reports what it
+// holds and asks before growing; the budget only decides, shedding is up to the buffer.
+type memoryBudget struct {
+	total  int64
+	policy string
+
+	mu    sync.Mutex
+	pools map[string]*PoolUsage
+}
+
+func newMemoryBudget(cfg config.MemoryConfig) *memoryBudget {
+	policy := cfg.ShedPolicy
+	if policy == "" {
+		policy = ShedDropOldest
+	}
+	return &memoryBudget{
+		total:  cfg.SessionBudgetBytes,
+		policy: policy,
+		pools: map[string]*PoolUsage{
+			MemoryDownlink: {LimitBytes: cfg.DownlinkBytes},
+			MemoryOffline:  {LimitBytes: cfg.OfflineBytes},
+		},
+	}
+}
+
+// fits reports whether pool can hold n bytes, within its own limit and the session budget
+func (b *memoryBudget) fits(pool string, n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if limit := b.pools[pool].LimitBytes; limit > 0 && n > limit {
+		return false
+	}
+	if b.total <= 0 {
+		return true
+	}
+	others := int64(0)
+	for name, p := range b.pools {
+		if name != pool {
+			others += p.UsedBytes
+		}
+	}
+	return others+n <= b.total
+}
+
+// set records that pool now holds n bytes
+func (b *memoryBudget) set(pool string, n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := b.pools[pool]
+	p.UsedBytes = n
+	p.PeakBytes = max(p.PeakBytes, n)
+}
+
+// shed records that n bytes were dropped from pool to stay within budget
+func (b *memoryBudget) shed(pool string, n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pools[pool].ShedBytes += n
+}
+
+// usage returns a snapshot of the budget
+func (b *memoryBudget) usage() MemoryUsage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	u := MemoryUsage{BudgetBytes: b.total, ShedPolicy: b.policy, Pools: make(map[string]PoolUsage, len(b.pools))}
+	for name, p := range b.pools {
+		u.Pools[name] = *p
+		u.UsedBytes += p.UsedBytes
+	}
+	return u
+}
+
+// MemoryUsage returns how much memory the session's buffers hold
+func (s *Session) MemoryUsage() MemoryUsage {
+	return s.memory.usage()
+}
+
+// overBudget reacts to a session buffer that could not stay within its memory budget by shedding.
+// With the close policy the session is ended instead.
+func (h *Handler) overBudget(session *Session, pool string) {
+	policy := session.memory.policy
+	h.metrics.memoryBudgetExceeded(pool, policy)
+	if policy != ShedClose {
+		session.Client.logger.Debug("Session buffer over memory budget, shedding audio", "pool", pool, "policy", policy)
+		return
+	}
+	session.Client.logger.Warn("Session buffer over memory budget, closing session", "pool", pool)
+	session.Client.closeFor(pixaerrors.New(pixaerrors.Overloaded, "memory budget exceeded"))
+	session.Close()
+}
+
+// reserveDownlink makes room for n more bytes of response audio in the downlink buffer, shedding
+// per the session's policy if needed. It reports whether the audio should be relayed.
+func (h *Handler) reserveDownlink(session *Session, ab *utils.BufferSizeController, n int) bool {
+	mem := session.memory
+	staged := ab.Len()
+	if mem.fits(MemoryDownlink, int64(staged+n)) {
+		return true
+	}
+	h.overBudget(session, MemoryDownlink)
+
+	switch mem.policy {
+	case ShedDropOldest:
+		ab.Reset()
+		mem.shed(MemoryDownlink, int64(staged))
+		if mem.fits(MemoryDownlink, int64(n)) {
+			return true
+		}
+	case ShedClose:
+		return false
+	}
+	mem.shed(MemoryDownlink, int64(n))
+	return false
+}
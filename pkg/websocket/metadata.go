@@ -0,0 +1,113 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/ai"
+)
+
+// Limits on the metadata a device can attach to a turn, which ends up in the model's context
+const (
+	maxMetadataKeys  = 32
+	maxMetadataKey   = 64
+	maxMetadataValue = 1024
+)
+
+// turnMetadata is what the device said about the user's next turn
+type turnMetadata struct {
+	values map[string]string
+	// injected is set once the metadata is in the provider's conversation
+	injected bool
+}
+
+// handleTurnMetadata keeps the metadata for the user's next turn and tells the model about it
+func (h *Handler) handleTurnMetadata(ctx context.Context, session *Session, msg turnMetadataMessage) {
+	if err := validateMetadata(msg.Metadata); err != nil {
+		session.Client.logger.Warn("Ignoring turn metadata", "error", err)
+		return
+	}
+	session.metadataMu.Lock()
+	session.metadata = &turnMetadata{values: msg.Metadata}
+	session.metadataMu.Unlock()
+
+	session.uplinkMu.Lock()
+	defer session.uplinkMu.Unlock()
+	if session.provider != nil {
+		h.injectMetadata(ctx, session, session.provider)
+	}
+}
+
+func validateMetadata(m map[string]string) error {
+	if len(m) == 0 {
+		return fmt.Errorf("no metadata")
+	}
+	if len(m) > maxMetadataKeys {
+		return fmt.Errorf("%d keys, at most %d are allowed", len(m), maxMetadataKeys)
+	}
+	for k, v := range m {
+		if k == "" || len(k) > maxMetadataKey || !utf8.ValidString(k) {
+			return fmt.Errorf("invalid key %q", k)
+		}
+		if len(v) > maxMetadataValue || !utf8.ValidString(v) {
+			return fmt.Errorf("invalid value for %q", k)
+		}
+	}
+	return nil
+}
+
+// injectMetadata adds the pending turn metadata to the provider's conversation unless it already
+// is. It is called with uplinkMu held, so the context goes in before any audio of the turn.
+func (h *Handler) injectMetadata(ctx context.Context, session *Session, provider ai.AIClient) {
+	adder, ok := provider.(ai.ContextAdder)
+	if !ok {
+		return
+	}
+	session.metadataMu.Lock()
+	m := session.metadata
+	if m == nil || m.injected {
+		session.metadataMu.Unlock()
+		return
+	}
+	text := metadataContext(m.values)
+	session.metadataMu.Unlock()
+
+	if err := adder.AddContext(ctx, text); err != nil {
+		session.Client.logger.Error("Could not add turn metadata to the conversation", "error", err)
+		return
+	}
+	session.metadataMu.Lock()
+	m.injected = true
+	session.metadataMu.Unlock()
+}
+
+// metadataContext renders metadata as a system message, keys sorted so the prompt is stable
+func metadataContext(values map[string]string) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("The user's device describes their next turn as follows. Use it as context, it is not something the user said.")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\n%s: %s", k, values[k])
+	}
+	return b.String()
+}
+
+// takeMetadata returns the metadata of the user turn being recorded and forgets it
+func (s *Session) takeMetadata() map[string]string {
+	s.metadataMu.Lock()
+	defer s.metadataMu.Unlock()
+	m := s.metadata
+	s.metadata = nil
+	if m == nil {
+		return nil
+	}
+	return m.values
+}
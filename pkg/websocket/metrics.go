@@ -0,0 +1,503 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/metrics"
+)
+
+// stageBuckets are the buckets of stage latencies, in seconds, which go from DSP taking well under
+// a millisecond to provider round trips of seconds
+var stageBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// noiseFloorBuckets are the buckets of the noise floors of devices, in dBFS, from quiet rooms to
+// loud lobbies
+var noiseFloorBuckets = []float64{-80, -70, -60, -55, -50, -45, -40, -35, -30, -20}
+
+// agcGainBuckets are the buckets of the gains of gain control, in dB, from loud microphones that
+// are attenuated to quiet ones amplified to agc.max_gain
+var agcGainBuckets = []float64{-12, -6, -3, 0, 3, 6, 9, 12, 18, 24}
+
+// jitterBuckets are the buckets of the audio held in jitter buffers, in seconds
+var jitterBuckets = []float64{0.01, 0.02, 0.04, 0.06, 0.08, 0.1, 0.15, 0.2, 0.3, 0.5}
+
+// erleBuckets are the buckets of how much echo cancellation lowers the echo, in dB
+var erleBuckets = []float64{0, 3, 6, 10, 15, 20, 25, 30, 40}
+
+// pttBuckets are the buckets of the audio recovered from push-to-talk pre-buffers, in seconds
+var pttBuckets = []float64{0.025, 0.05, 0.1, 0.2, 0.3, 0.5, 0.75, 1, 2}
+
+// handlerMetrics are the metrics recorded by the handler. A nil *handlerMetrics records nothing.
+type handlerMetrics struct {
+	linkBytes      *metrics.CounterVec
+	bandwidthCaps  *metrics.CounterVec
+	outages        *metrics.CounterVec
+	corrupted      *metrics.CounterVec
+	reaped         *metrics.CounterVec
+	budgetExceeded *metrics.CounterVec
+	faqLookups     *metrics.CounterVec
+	toolCalls      *metrics.CounterVec
+	toolAnnounces  *metrics.CounterVec
+	taggedSessions *metrics.CounterVec
+	versionChecks  *metrics.CounterVec
+	faults         *metrics.CounterVec
+	stages         *metrics.HistogramVec
+	translations   *metrics.CounterVec
+	echoLoops      *metrics.CounterVec
+	pttRecovered   *metrics.HistogramVec
+	refreshes      *metrics.CounterVec
+	duplexMuted    *metrics.CounterVec
+	vadGatedAudio  *metrics.CounterVec
+	pipelineWaits  *metrics.HistogramVec
+	voiceGains     *metrics.GaugeVec
+	pipelineStarve *metrics.CounterVec
+	utterancesCut  *metrics.CounterVec
+	noiseFloors    *metrics.HistogramVec
+	unknownOrigins *metrics.CounterVec
+	decodeErrors   *metrics.CounterVec
+	encodeErrors   *metrics.CounterVec
+	deviceHellos   *metrics.CounterVec
+	controlErrors  *metrics.CounterVec
+	turnProcessors *metrics.CounterVec
+	audioTests     *metrics.CounterVec
+	announcements  *metrics.CounterVec
+	queueWaits     *metrics.CounterVec
+	verifications  *metrics.CounterVec
+	queueDepth     *metrics.GaugeVec
+	speakerClasses *metrics.CounterVec
+	connectInfos   *metrics.CounterVec
+	regionRefusals *metrics.CounterVec
+	denoised       *metrics.CounterVec
+	agcGains       *metrics.HistogramVec
+	aecERLE        *metrics.HistogramVec
+	frameAnomalies *metrics.CounterVec
+	jitterDepths   *metrics.HistogramVec
+	jitterLates    *metrics.CounterVec
+	concealed      *metrics.CounterVec
+	listeners      *metrics.GaugeVec
+}
+
+func newHandlerMetrics(reg *metrics.Registry) *handlerMetrics {
+	return &handlerMetrics{
+		linkBytes: reg.Counter("pixa_device_link_bytes_total",
+			"Bytes moved over device links.", "direction"),
+		bandwidthCaps: reg.Counter("pixa_bandwidth_cap_events_total",
+			"Sessions reaching a level of a bandwidth cap.", "scope", "level"),
+		outages: reg.Counter("pixa_provider_outages_total",
+			"Sessions that lost their provider connection and went offline."),
+		corrupted: reg.Counter("pixa_corrupted_frames_total",
+			"Binary frames from devices that failed their checksum."),
+		reaped: reg.Counter("pixa_sessions_reaped_total",
+			"Orphaned sessions force-closed by the reaper, by reason.", "reason"),
+		budgetExceeded: reg.Counter("pixa_memory_budget_exceeded_total",
+			"Session buffers that would have gone over their memory budget, by buffer and shed policy.", "pool", "policy"),
+		faqLookups: reg.Counter("pixa_faq_lookups_total",
+			"Questions looked up in the FAQ cache, by result.", "result"),
+		toolCalls: reg.Counter("pixa_tool_calls_total",
+			"Tool calls run for the model, by tool and outcome.", "tool", "outcome"),
+		toolAnnounces: reg.Counter("pixa_tool_announcements_total",
+			"Tool calls slow enough for the model to tell the user it is working on them, by tool.", "tool"),
+		taggedSessions: reg.Counter("pixa_tagged_sessions_total",
+			"Sessions started with a tag configured in tags.metric_labels, by tag and value.", "tag", "value"),
+		versionChecks: reg.Counter("pixa_client_version_checks_total",
+			"Connecting devices by how their versions compare with versions.min_* and versions.recommended_firmware.", "outcome"),
+		faults: reg.Counter("pixa_chaos_faults_total",
+			"Faults injected into sessions by chaos testing, by fault.", "fault"),
+		stages: reg.Histogram("pixa_stage_duration_seconds",
+			"Latency of the stages of the relay pipeline, with the session as exemplar.", stageBuckets, "stage"),
+		translations: reg.Counter("pixa_caption_translations_total",
+			"Captions translated into the display language of devices, by outcome.", "outcome"),
+		echoLoops: reg.Counter("pixa_echo_loops_total",
+			"Relay loops detected, devices whose microphone picks up the assistant from their speaker."),
+		pttRecovered: reg.Histogram("pixa_ptt_compensation_seconds",
+			"Audio captured before push-to-talk devices reported the press, relayed from the pre-buffer.", pttBuckets),
+		refreshes: reg.Counter("pixa_provider_refreshes_total",
+			"Provider sessions replaced to switch the model or persona of a session, by outcome.", "outcome"),
+		duplexMuted: reg.Counter("pixa_half_duplex_muted_seconds_total",
+			"Audio from half-duplex devices replaced with silence while the assistant spoke."),
+		vadGatedAudio: reg.Counter("pixa_vad_gated_seconds_total",
+			"Audio from devices not sent to the provider because the voice activity gate detected no speech in it."),
+		voiceGains: reg.Gauge("pixa_voice_gain_db",
+			"Gain applied to the answers of each voice of the provider to bring them to voice_gain.target_level, in dB.", "voice"),
+		pipelineWaits: reg.Histogram("pixa_pipeline_wait_seconds",
+			"How long frames of device audio waited for a slot of the pipeline scheduler.", stageBuckets),
+		pipelineStarve: reg.Counter("pixa_pipeline_starved_frames_total",
+			"Frames of device audio that waited longer than pipeline_scheduler.starved_after for a slot of the pipeline scheduler."),
+		utterancesCut: reg.Counter("pixa_utterances_cut_total",
+			"User turns ended by the relay because they ran past the max_utterance of the device profile."),
+		noiseFloors: reg.Histogram("pixa_noise_floor_dbfs",
+			"Ambient noise measured around devices when their sessions were calibrated, in dBFS.", noiseFloorBuckets),
+		unknownOrigins: reg.Counter("pixa_unknown_origins_total",
+			"Connections from browser origins not in websocket.allowed_origins, by whether they were rejected or accepted.", "outcome"),
+		decodeErrors: reg.Counter("pixa_uplink_decode_errors_total",
+			"Compressed audio frames from devices that could not be decoded and were dropped, by codec.", "codec"),
+		encodeErrors: reg.Counter("pixa_downlink_encode_errors_total",
+			"Audio for devices that could not be compressed and was not sent, by codec.", "codec"),
+		deviceHellos: reg.Counter("pixa_device_hellos_total",
+			"Devices waited on for device.hello, by outcome: configured, rejected or missing.", "outcome"),
+		controlErrors: reg.Counter("pixa_control_errors_total",
+			"Control messages from devices ignored for not following the protocol schema, by the code of the control.error sent.", "code"),
+		turnProcessors: reg.Counter("pixa_turn_processors_total",
+			"Runs of turn processors on completed assistant turns, by outcome: ok, error, timeout or panic, and turns dropped because a session's queue was full.", "outcome"),
+		audioTests: reg.Counter("pixa_audio_tests_total",
+			"Audio tests played to devices, by result.", "result"),
+		announcements: reg.Counter("pixa_announcement_deliveries_total",
+			"Announcements played to devices, by result: delivered, interrupted or expired.", "result"),
+		verifications: reg.Counter("pixa_speaker_verifications_total",
+			"Speakers of sessions verified, by result: verified, rejected or error.", "result"),
+		queueWaits: reg.Counter("pixa_provider_queue_total",
+			"Devices that found provider sessions at capacity, by result: admitted, timed_out, abandoned or refused.", "result"),
+		queueDepth: reg.Gauge("pixa_provider_queue_waiting",
+			"Sessions waiting in line for a provider session."),
+		speakerClasses: reg.Counter("pixa_speaker_classifications_total",
+			"Speakers classified, by age group and the policy action applied: none, error, log, restrict or end.", "age_group", "action"),
+		connectInfos: reg.Counter("pixa_connect_info_requests_total",
+			"Requests to the connect info endpoint, by outcome: ok, rejected or error.", "outcome"),
+		regionRefusals: reg.Counter("pixa_region_refusals_total",
+			"Connections of tenants pinned to a region that were refused because the region was not available, by region.", "region"),
+		denoised: reg.Counter("pixa_denoised_sessions_total",
+			"Sessions whose audio was to be denoised, by outcome: ok, or error when no denoiser could be set up.", "outcome"),
+		agcGains: reg.Histogram("pixa_agc_gain_db",
+			"Gain the gain control of sessions applied to the audio of their device when they ended, in dB.", agcGainBuckets),
+		aecERLE: reg.Histogram("pixa_aec_erle_db",
+			"Echo return loss enhancement of sessions whose echo was cancelled, how much the echo in the audio of their device was lowered when they ended, in dB.", erleBuckets),
+		frameAnomalies: reg.Counter("pixa_uplink_frame_anomalies_total",
+			"Audio frames from devices sending frame headers that were lost, reordered, late or invalid, by kind.", "kind"),
+		jitterDepths: reg.Histogram("pixa_jitter_buffer_depth_seconds",
+			"Device audio held in the jitter buffer as frames arrived, in seconds.", jitterBuckets),
+		jitterLates: reg.Counter("pixa_jitter_late_frames_total",
+			"Audio frames that reached the jitter buffer after they were due, restarting it."),
+		concealed: reg.Counter("pixa_plc_concealed_seconds_total",
+			"Seconds of audio synthesized for the gaps of frames lost by devices."),
+		listeners: reg.Gauge("pixa_admin_listeners",
+			"Supervisors listening to live sessions."),
+	}
+}
+
+func (m *handlerMetrics) linkTraffic(inbound bool, n int) {
+	if m == nil {
+		return
+	}
+	direction := "out"
+	if inbound {
+		direction = "in"
+	}
+	m.linkBytes.With(direction).Add(float64(n))
+}
+
+func (m *handlerMetrics) bandwidthCap(scope, level string) {
+	if m == nil {
+		return
+	}
+	m.bandwidthCaps.With(scope, level).Inc()
+}
+
+func (m *handlerMetrics) providerOutage() {
+	if m == nil {
+		return
+	}
+	m.outages.With().Inc()
+}
+
+func (m *handlerMetrics) corruptedFrame() {
+	if m == nil {
+		return
+	}
+	m.corrupted.With().Inc()
+}
+
+func (m *handlerMetrics) sessionReaped(reason string) {
+	if m == nil {
+		return
+	}
+	m.reaped.With(reason).Inc()
+}
+
+func (m *handlerMetrics) memoryBudgetExceeded(pool, policy string) {
+	if m == nil {
+		return
+	}
+	m.budgetExceeded.With(pool, policy).Inc()
+}
+
+func (m *handlerMetrics) faqLookup(hit bool) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.faqLookups.With(result).Inc()
+}
+
+func (m *handlerMetrics) toolCall(tool, outcome string) {
+	if m == nil {
+		return
+	}
+	m.toolCalls.With(tool, outcome).Inc()
+}
+
+func (m *handlerMetrics) toolAnnounced(tool string) {
+	if m == nil {
+		return
+	}
+	m.toolAnnounces.With(tool).Inc()
+}
+
+func (m *handlerMetrics) sessionTagged(labels map[string]string) {
+	if m == nil {
+		return
+	}
+	for tag, value := range labels {
+		m.taggedSessions.With(tag, value).Inc()
+	}
+}
+
+func (m *handlerMetrics) versionChecked(outcome string) {
+	if m == nil {
+		return
+	}
+	m.versionChecks.With(outcome).Inc()
+}
+
+func (m *handlerMetrics) faultInjected(fault string) {
+	if m == nil {
+		return
+	}
+	m.faults.With(fault).Inc()
+}
+
+func (m *handlerMetrics) stageDuration(sessionID, stage string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.stages.With(stage).ObserveWithExemplar(d.Seconds(), "session_id", sessionID)
+}
+
+func (m *handlerMetrics) captionTranslated(outcome string) {
+	if m == nil {
+		return
+	}
+	m.translations.With(outcome).Inc()
+}
+
+func (m *handlerMetrics) echoLoop() {
+	if m == nil {
+		return
+	}
+	m.echoLoops.With().Inc()
+}
+
+func (m *handlerMetrics) pttCompensation(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.pttRecovered.With().Observe(d.Seconds())
+}
+
+func (m *handlerMetrics) providerRefreshed(outcome string) {
+	if m == nil {
+		return
+	}
+	m.refreshes.With(outcome).Inc()
+}
+
+func (m *handlerMetrics) halfDuplexMuted(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.duplexMuted.With().Add(d.Seconds())
+}
+
+func (m *handlerMetrics) vadGated(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.vadGatedAudio.With().Add(d.Seconds())
+}
+
+func (m *handlerMetrics) voiceGain(voice string, db float64) {
+	if m == nil {
+		return
+	}
+	m.voiceGains.With(voice).Set(db)
+}
+
+func (m *handlerMetrics) pipelineWaited(d, starvedAfter time.Duration) {
+	if m == nil {
+		return
+	}
+	m.pipelineWaits.With().Observe(d.Seconds())
+	if d >= starvedAfter {
+		m.pipelineStarve.With().Inc()
+	}
+}
+
+func (m *handlerMetrics) utteranceCut() {
+	if m == nil {
+		return
+	}
+	m.utterancesCut.With().Inc()
+}
+
+func (m *handlerMetrics) noiseFloor(dbfs float64) {
+	if m == nil {
+		return
+	}
+	m.noiseFloors.With().Observe(dbfs)
+}
+
+func (m *handlerMetrics) unknownOrigin(outcome string) {
+	if m == nil {
+		return
+	}
+	m.unknownOrigins.With(outcome).Inc()
+}
+
+func (m *handlerMetrics) decodeError(codec string) {
+	if m == nil {
+		return
+	}
+	m.decodeErrors.With(codec).Inc()
+}
+
+func (m *handlerMetrics) encodeError(codec string) {
+	if m == nil {
+		return
+	}
+	m.encodeErrors.With(codec).Inc()
+}
+
+func (m *handlerMetrics) deviceHello(outcome string) {
+	if m == nil {
+		return
+	}
+	m.deviceHellos.With(outcome).Inc()
+}
+
+func (m *handlerMetrics) controlError(code string) {
+	if m == nil {
+		return
+	}
+	m.controlErrors.With(code).Inc()
+}
+
+func (m *handlerMetrics) turnProcessed(outcome string) {
+	if m == nil {
+		return
+	}
+	m.turnProcessors.With(outcome).Inc()
+}
+
+func (m *handlerMetrics) audioTest(result string) {
+	if m == nil {
+		return
+	}
+	m.audioTests.With(result).Inc()
+}
+
+func (m *handlerMetrics) announcementDelivery(result string) {
+	if m == nil {
+		return
+	}
+	m.announcements.With(result).Inc()
+}
+
+func (m *handlerMetrics) providerQueue(result string) {
+	if m == nil {
+		return
+	}
+	m.queueWaits.With(result).Inc()
+}
+
+func (m *handlerMetrics) queueWaiting(delta float64) {
+	if m == nil {
+		return
+	}
+	m.queueDepth.With().Add(delta)
+}
+
+func (m *handlerMetrics) speakerVerified(result string) {
+	if m == nil {
+		return
+	}
+	m.verifications.With(result).Inc()
+}
+
+func (m *handlerMetrics) speakerClassified(ageGroup, action string) {
+	if m == nil {
+		return
+	}
+	m.speakerClasses.With(ageGroup, action).Inc()
+}
+
+func (m *handlerMetrics) connectInfo(outcome string) {
+	if m == nil {
+		return
+	}
+	m.connectInfos.With(outcome).Inc()
+}
+
+func (m *handlerMetrics) regionRefused(region string) {
+	if m == nil {
+		return
+	}
+	m.regionRefusals.With(region).Inc()
+}
+
+func (m *handlerMetrics) sessionDenoised(outcome string) {
+	if m == nil {
+		return
+	}
+	m.denoised.With(outcome).Inc()
+}
+
+func (m *handlerMetrics) agcGain(db float64) {
+	if m == nil {
+		return
+	}
+	m.agcGains.With().Observe(db)
+}
+
+func (m *handlerMetrics) echoCancelled(erleDB float64) {
+	if m == nil {
+		return
+	}
+	m.aecERLE.With().Observe(erleDB)
+}
+
+func (m *handlerMetrics) frameAnomaly(kind string, n int64) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.frameAnomalies.With(kind).Add(float64(n))
+}
+
+func (m *handlerMetrics) jitterDepth(held time.Duration) {
+	if m == nil {
+		return
+	}
+	m.jitterDepths.With().Observe(held.Seconds())
+}
+
+func (m *handlerMetrics) jitterLate() {
+	if m == nil {
+		return
+	}
+	m.jitterLates.With().Inc()
+}
+
+func (m *handlerMetrics) concealedAudio(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.concealed.With().Add(d.Seconds())
+}
+
+func (m *handlerMetrics) listening(delta float64) {
+	if m == nil {
+		return
+	}
+	m.listeners.With().Add(delta)
+}
@@ -0,0 +1,115 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	pixaerrors "github.com/pixaverse-studios/websocket-server/pkg/errors"
+)
+
+// Middleware lets embedding applications hook into the lifecycle of a client connection
+// (custom auth, request mutation, metrics, message filtering) without modifying the handler.
+// Any of the hooks can be left nil.
+type Middleware struct {
+	// OnConnect runs before the connection is upgraded. It can return a modified request which is
+	// then used for the upgrade and passed on to the next middleware. Returning an error rejects
+	// the connection; use a *RejectError to control the HTTP status code sent back.
+	OnConnect func(r *http.Request) (*http.Request, error)
+
+	// OnMessage runs for every message read from the client, before the handler processes it.
+	// It can return a modified payload. Returning ok = false drops the message.
+	OnMessage func(ctx context.Context, c *Client, messageType int, data []byte) (out []byte, ok bool)
+
+	// OnDisconnect runs once the client connection has been closed, with the error that ended
+	// the connection, if any.
+	OnDisconnect func(c *Client, err error)
+}
+
+// RejectError can be returned from an OnConnect hook to reject a connection with a specific
+// HTTP status code.
+type RejectError struct {
+	StatusCode int
+	Reason     string
+	// RetryAfter is sent in the Retry-After header when set
+	RetryAfter time.Duration
+}
+
+func (e *RejectError) Error() string {
+	return e.Reason
+}
+
+// ErrorCode puts the rejection in the category of its status code
+func (e *RejectError) ErrorCode() pixaerrors.Code {
+	if e.StatusCode == 0 {
+		return pixaerrors.Forbidden
+	}
+	return pixaerrors.ForStatus(e.StatusCode)
+}
+
+// chain runs middleware in the order they were registered
+type chain []Middleware
+
+func (ch chain) onConnect(r *http.Request) (*http.Request, error) {
+	for _, m := range ch {
+		if m.OnConnect == nil {
+			continue
+		}
+		next, err := m.OnConnect(r)
+		if err != nil {
+			return nil, err
+		}
+		if next != nil {
+			r = next
+		}
+	}
+	return r, nil
+}
+
+func (ch chain) onMessage(ctx context.Context, c *Client, messageType int, data []byte) ([]byte, bool) {
+	for _, m := range ch {
+		if m.OnMessage == nil {
+			continue
+		}
+		var ok bool
+		data, ok = m.OnMessage(ctx, c, messageType, data)
+		if !ok {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+func (ch chain) onDisconnect(c *Client, err error) {
+	for _, m := range ch {
+		if m.OnDisconnect != nil {
+			m.OnDisconnect(c, err)
+		}
+	}
+}
+
+// setRetryAfter tells the client when to retry a connection rejected with a RetryAfter
+func setRetryAfter(w http.ResponseWriter, err error) {
+	var rejectErr *RejectError
+	if errors.As(err, &rejectErr) && rejectErr.RetryAfter > 0 {
+		seconds := (rejectErr.RetryAfter + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(seconds), 10))
+	}
+}
+
+// rejection returns the failure of a connection refused for err after the upgrade, in the
+// category of the status the upgrade would have been refused with
+func rejection(err error) *pixaerrors.Error {
+	return &pixaerrors.Error{Code: pixaerrors.ForStatus(rejectStatus(err)), Message: err.Error(), Err: err}
+}
+
+// rejectStatus returns the HTTP status code to use when an OnConnect hook rejects a connection
+func rejectStatus(err error) int {
+	var rejectErr *RejectError
+	if errors.As(err, &rejectErr) && rejectErr.StatusCode != 0 {
+		return rejectErr.StatusCode
+	}
+	return http.StatusForbidden
+}
@@ -0,0 +1,219 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/internal/utils"
+	"github.com/pixaverse-studios/websocket-server/pkg/ai"
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/events"
+)
+
+// What happens to audio buffered during an outage once the provider is reachable again
+const (
+	ReplayOnRecovery  = "replay"
+	DiscardOnRecovery = "discard"
+)
+
+// offlineBuffer holds uplink audio while the provider is unreachable. It is bounded by duration;
+// once full, the oldest audio is dropped. It is also bounded by the session's memory budget, which
+// sheds per its policy. It is guarded by the session's uplink mutex.
+type offlineBuffer struct {
+	maxDuration time.Duration
+	memory      *memoryBudget
+	chunks      []audio.Audio
+	buffered    time.Duration
+	bytes       int64
+	dropped     time.Duration
+}
+
+func newOfflineBuffer(cfg config.OfflineConfig, memory *memoryBudget) *offlineBuffer {
+	maxDuration, _ := time.ParseDuration(cfg.MaxBuffer)
+	return &offlineBuffer{maxDuration: maxDuration, memory: memory}
+}
+
+// add buffers a chunk of audio. It reports false when the chunk did not fit in the memory budget
+// and had to be shed, or was refused under the close policy.
+func (b *offlineBuffer) add(a audio.Audio) bool {
+	n := int64(len(a.AsPCM16()))
+	fits := b.memory.fits(MemoryOffline, b.bytes+n)
+	if !fits && b.memory.policy != ShedDropOldest {
+		if b.memory.policy == ShedDropNewest {
+			b.dropped += a.Duration()
+			b.memory.shed(MemoryOffline, n)
+		}
+		return false
+	}
+
+	b.chunks = append(b.chunks, a)
+	b.buffered += a.Duration()
+	b.bytes += n
+	for len(b.chunks) > 0 && (b.buffered > b.maxDuration || !b.memory.fits(MemoryOffline, b.bytes)) {
+		if b.buffered <= b.maxDuration {
+			b.memory.shed(MemoryOffline, int64(len(b.chunks[0].AsPCM16())))
+		}
+		b.dropOldest()
+	}
+	b.memory.set(MemoryOffline, b.bytes)
+	return fits
+}
+
+func (b *offlineBuffer) dropOldest() {
+	d := b.chunks[0].Duration()
+	b.bytes -= int64(len(b.chunks[0].AsPCM16()))
+	b.chunks = b.chunks[1:]
+	b.buffered -= d
+	b.dropped += d
+}
+
+// take empties the buffer, returning its audio along with how much was dropped for lack of space
+func (b *offlineBuffer) take() (chunks []audio.Audio, buffered, dropped time.Duration) {
+	chunks, buffered, dropped = b.chunks, b.buffered, b.dropped
+	b.chunks, b.buffered, b.bytes, b.dropped = nil, 0, 0, 0
+	b.memory.set(MemoryOffline, 0)
+	return chunks, buffered, dropped
+}
+
+// sendAudio forwards uplink audio to the session's provider, or buffers it while the provider is
+// not connected. Audio of sessions waiting in line for a provider is dropped.
+func (h *Handler) sendAudio(ctx context.Context, session *Session, a audio.Audio) error {
+	session.live.uplink(a)
+	if session.queued.Load() {
+		return nil
+	}
+	session.uplinkMu.Lock()
+	if session.provider == nil {
+		fits := session.offline == nil || session.offline.add(a)
+		session.uplinkMu.Unlock()
+		if !fits {
+			h.overBudget(session, MemoryOffline)
+		}
+		return nil
+	}
+	defer session.uplinkMu.Unlock()
+	return session.forwardAudio(ctx, a)
+}
+
+// forwardAudio sends audio to the provider; the uplink mutex must be held
+func (s *Session) forwardAudio(ctx context.Context, a audio.Audio) error {
+	duration := a.Duration()
+	start := s.clock.Now()
+	if err := s.provider.SendAudio(ctx, a); err != nil {
+		return err
+	}
+	s.heat.observe(StageProviderSend, s.clock.Now().Sub(start))
+	s.Cursor.Append(duration)
+	return nil
+}
+
+// attachProvider makes a connected provider the target of the session's uplink audio. Audio
+// buffered while the provider was unreachable is replayed or discarded first, per the recovery
+// policy; audio buffered before the first connection is always replayed.
+func (h *Handler) attachProvider(ctx context.Context, session *Session, provider ai.AIClient) {
+	session.uplinkMu.Lock()
+	defer session.uplinkMu.Unlock()
+
+	session.provider = provider
+	session.detachedAt = time.Time{}
+	// metadata sent while the provider was unreachable goes ahead of the turn's buffered audio
+	h.injectMetadata(ctx, session, provider)
+	if session.offline == nil {
+		return
+	}
+
+	chunks, buffered, dropped := session.offline.take()
+	recovering := session.outageStarted != (time.Time{})
+	session.outageStarted = time.Time{}
+
+	action := ReplayOnRecovery
+	if recovering && h.config.Offline.OnRecovery == DiscardOnRecovery {
+		action = DiscardOnRecovery
+	}
+	if action == ReplayOnRecovery {
+		for _, a := range chunks {
+			if err := session.forwardAudio(ctx, a); err != nil {
+				session.Client.logger.Error("Could not replay buffered audio", "error", err)
+				break
+			}
+		}
+	}
+
+	if !recovering {
+		return
+	}
+	session.Client.logger.Info("Provider recovered", "buffered", buffered, "dropped", dropped, "action", action)
+	session.publish(events.ProviderRecovered, session.clock.Now(), events.ProviderState{Action: action, BufferedMs: buffered.Milliseconds(), DroppedMs: dropped.Milliseconds()})
+	err := session.Client.Send(providerRecoveredEvent{
+		Type:       ProviderRecoveredEvent,
+		Action:     action,
+		BufferedMs: buffered.Milliseconds(),
+		DroppedMs:  dropped.Milliseconds(),
+	})
+	if err != nil {
+		session.Client.logger.Error("Could not send recovery to client", "error", err)
+	}
+}
+
+// setProvider changes the provider uplink audio is forwarded to; nil means it is unreachable
+func (s *Session) setProvider(p ai.AIClient) {
+	s.uplinkMu.Lock()
+	s.provider = p
+	if p == nil {
+		s.detachedAt = s.clock.Now()
+	} else {
+		s.detachedAt = time.Time{}
+	}
+	s.uplinkMu.Unlock()
+}
+
+// superviseProvider keeps the session connected to the provider. Without offline buffering the
+// first failure ends the session; with it, the relay keeps accepting audio and reconnects until the
+// outage exceeds its maximum duration.
+func (h *Handler) superviseProvider(ctx context.Context, session *Session, ab *utils.BufferSizeController) error {
+	retryInterval, _ := time.ParseDuration(h.config.Offline.RetryInterval)
+	maxOutage, _ := time.ParseDuration(h.config.Offline.MaxOutage)
+	if retryInterval <= 0 {
+		retryInterval = time.Second
+	}
+	if err := h.waitForProvider(ctx, session); err != nil {
+		return err
+	}
+	defer h.queue.release()
+
+	for {
+		err := h.runProvider(ctx, session, ab)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, errProviderRefresh) {
+			continue
+		}
+		if session.offline == nil {
+			return err
+		}
+
+		session.uplinkMu.Lock()
+		if session.outageStarted.IsZero() {
+			session.outageStarted = session.clock.Now()
+			h.metrics.providerOutage()
+			session.Client.logger.Error("Provider unreachable, buffering audio", "error", err)
+			session.Client.Send(providerOfflineEvent{Type: ProviderOfflineEvent, Reason: err.Error()})
+			session.publish(events.ProviderOffline, session.outageStarted, events.ProviderState{Reason: err.Error()})
+		}
+		outage := session.clock.Now().Sub(session.outageStarted)
+		session.uplinkMu.Unlock()
+
+		if maxOutage > 0 && outage >= maxOutage {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-session.clock.After(session.jitter(retryInterval)):
+		}
+	}
+}
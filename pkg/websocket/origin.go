@@ -0,0 +1,76 @@
+package websocket
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Outcomes of connections from origins that are not allowed
+const (
+	OriginRejected = "rejected"
+	OriginAccepted = "accepted"
+)
+
+// originAllowlist decides which browser origins may connect. Devices send no Origin header and are
+// always let in; browsers always send one, so it keeps web pages of other sites from opening
+// sessions with the credentials of their visitors. Without patterns every origin is allowed.
+type originAllowlist struct {
+	patterns []string
+	// strict rejects origins that match no pattern with 403; otherwise they are only logged and
+	// counted, to find the origins to allow before turning strict mode on
+	strict bool
+}
+
+// allowed reports whether a connection from origin may be upgraded
+func (o originAllowlist) allowed(origin string) bool {
+	if origin == "" || len(o.patterns) == 0 {
+		return true
+	}
+	for _, p := range o.patterns {
+		if matchOrigin(p, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin reports whether origin, as browsers send it (scheme://host[:port]), matches pattern.
+// Patterns are either origins with their scheme or hosts, and may use * as a wildcard, as in
+// *.example.com, which matches the subdomains of example.com but not example.com itself. Host
+// patterns without a port match any port.
+func matchOrigin(pattern, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	pattern = strings.ToLower(pattern)
+	target := u.Scheme + "://" + u.Host
+	if !strings.Contains(pattern, "://") {
+		target = u.Host
+		if !strings.Contains(pattern, ":") {
+			target = u.Hostname()
+		}
+	}
+	ok, _ := path.Match(pattern, strings.ToLower(target))
+	return ok
+}
+
+// checkOrigin answers connections from origins that are not allowed with 403 in strict mode,
+// before they are upgraded or reach the middleware. It reports whether the connection may go on.
+func (h *Handler) checkOrigin(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if h.origins.allowed(origin) {
+		return true
+	}
+	if !h.origins.strict {
+		h.metrics.unknownOrigin(OriginAccepted)
+		h.logger.Warn("Accepting connection from an origin that is not allowed", "origin", origin, "remote_addr", r.RemoteAddr)
+		return true
+	}
+	h.metrics.unknownOrigin(OriginRejected)
+	h.logger.Info("Rejecting connection from an origin that is not allowed", "origin", origin, "remote_addr", r.RemoteAddr)
+	http.Error(w, "origin not allowed", http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,43 @@
+package websocket
+
+import (
+	"context"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// newConcealer returns the packet loss concealer of a session, nil when plc is disabled or the
+// device sends raw frames, whose losses cannot be told
+func newConcealer(cfg config.PLCConfig, frames *frameSequence, sampleRate, channels int) *audio.Concealer {
+	if !cfg.Enabled || frames == nil {
+		return nil
+	}
+	fade, _ := time.ParseDuration(cfg.Fade)
+	maxDuration, _ := time.ParseDuration(cfg.MaxDuration)
+	return audio.NewConcealer(sampleRate, channels, cfg.Mode != "hold", fade, maxDuration)
+}
+
+// conceal takes audio synthesized for the frames lost just before a frame through the pipeline
+// ahead of it, as long as the frame's audio for each, so the stages after it and the provider
+// hear a fade rather than the audio on either side of the gap run together. pcm is the frame's
+// decoded audio, which the concealment of later gaps is synthesized from.
+func (h *Handler) conceal(ctx context.Context, session *Session, frame inboundFrame, pcm []byte, start time.Time) {
+	c := session.plc
+	if c == nil {
+		return
+	}
+	if frame.lost > 0 {
+		if gap := c.Conceal(frame.lost * len(pcm)); len(gap) > 0 {
+			a := audio.FromPCM16(gap, session.sampleRate, h.config.Audio.Channels)
+			captured := frame.captured
+			if !captured.IsZero() {
+				captured = captured.Add(-a.Duration())
+			}
+			h.metrics.concealedAudio(a.Duration())
+			h.uplinkPCM(ctx, session, gap, nil, captured, start)
+		}
+	}
+	c.Observe(pcm)
+}
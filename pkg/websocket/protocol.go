@@ -0,0 +1,12 @@
+package websocket
+
+// Besides binary audio frames, the device and the relay exchange JSON control messages in text
+// frames. Every message has a "type" field identifying it. The messages are defined in
+// protocol/protocol.schema.json, from which protocol_gen.go and the client SDKs are generated.
+
+//go:generate go run ../../cmd/protogen -root ../..
+
+// controlMessage is the envelope shared by all control messages
+type controlMessage struct {
+	Type string `json:"type"`
+}
@@ -0,0 +1,156 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+const (
+	// InputModeHeader carries how the device captures the user: "push_to_talk" for devices that
+	// stream their microphone continuously and report when their talk button is held, anything
+	// else for hands-free devices. Devices that cannot set headers use the input_mode query
+	// parameter.
+	InputModeHeader = "X-Pixa-Input-Mode"
+
+	// PushToTalkMode is the input mode of push-to-talk devices
+	PushToTalkMode = "push_to_talk"
+)
+
+// pttFrame is an audio frame from the device received while the talk button was up
+type pttFrame struct {
+	// capturedAt is when the device started capturing the frame, on the session clock
+	capturedAt time.Time
+	pcm        []byte
+}
+
+// pushToTalk holds back the audio of a push-to-talk device while its button is up. The audio of the
+// last preBuffer is kept, so that the speech captured between the press and the firmware reporting
+// it is relayed instead of clipping the first word. It is only used by the session's read pump. A
+// nil *pushToTalk relays all audio, as for hands-free devices.
+type pushToTalk struct {
+	preBuffer  time.Duration
+	endSilence time.Duration
+	sampleRate int
+	channels   int
+
+	pressed bool
+	frames  []pttFrame
+}
+
+// newPushToTalk returns the push-to-talk state of a session whose device sends audio at sampleRate,
+// or nil if the device is hands-free
+func newPushToTalk(cfg *config.Config, r *http.Request, sampleRate int) *pushToTalk {
+	if !strings.EqualFold(strings.TrimSpace(headerOrQuery(r, InputModeHeader, "input_mode")), PushToTalkMode) {
+		return nil
+	}
+	preBuffer, _ := time.ParseDuration(cfg.PTT.PreBuffer)
+	endSilence, _ := time.ParseDuration(cfg.PTT.EndSilence)
+	return &pushToTalk{
+		preBuffer:  preBuffer,
+		endSilence: endSilence,
+		sampleRate: sampleRate,
+		channels:   cfg.Audio.Channels,
+	}
+}
+
+// duration returns how long 16 bit PCM in the device's format plays
+func (p *pushToTalk) duration(pcm []byte) time.Duration {
+	if p.sampleRate <= 0 || p.channels <= 0 {
+		return 0
+	}
+	return time.Duration(len(pcm)/2/p.channels) * time.Second / time.Duration(p.sampleRate)
+}
+
+// hold keeps a frame received at now if the button is up, reporting whether it was held back
+func (p *pushToTalk) hold(now time.Time, pcm []byte) bool {
+	if p == nil || p.pressed {
+		return false
+	}
+	p.frames = append(p.frames, pttFrame{capturedAt: now.Add(-p.duration(pcm)), pcm: pcm})
+	// drop the frames that ended before the pre-buffer
+	drop := 0
+	for drop < len(p.frames) && p.frames[drop].capturedAt.Add(p.duration(p.frames[drop].pcm)).Before(now.Add(-p.preBuffer)) {
+		drop++
+	}
+	p.frames = p.frames[drop:]
+	return true
+}
+
+// press starts relaying the user at now. It returns the audio held back that was captured since
+// capturedAt, which is at most the pre-buffer ago, cutting the frame it falls in.
+func (p *pushToTalk) press(now, capturedAt time.Time) []byte {
+	p.pressed = true
+	if earliest := now.Add(-p.preBuffer); capturedAt.Before(earliest) {
+		capturedAt = earliest
+	}
+	var pcm []byte
+	frameSize := 2 * p.channels
+	for _, f := range p.frames {
+		data := f.pcm
+		if skip := capturedAt.Sub(f.capturedAt); skip > 0 {
+			n := int(skip*time.Duration(p.sampleRate)/time.Second) * frameSize
+			if n >= len(data) {
+				continue
+			}
+			data = data[n:]
+		}
+		pcm = append(pcm, data...)
+	}
+	p.frames = nil
+	return pcm
+}
+
+// release stops relaying the user
+func (p *pushToTalk) release() {
+	p.pressed = false
+	p.frames = nil
+}
+
+// handlePTTBegin relays the user from when the device reports it pressed the talk button. The
+// device's clock is not the relay's: the time from the press to the message leaving the device is
+// taken back from when the message arrived, which leaves out the time it spent on the network.
+func (h *Handler) handlePTTBegin(ctx context.Context, session *Session, msg pttBeginMessage) {
+	if session.ptt == nil {
+		session.Client.logger.Info("Ignoring push-to-talk press, the device is not in push-to-talk mode")
+		return
+	}
+	if session.ptt.pressed {
+		return
+	}
+	now := session.clock.Now()
+	lead := max(time.Duration(msg.SentAtMs-msg.CapturedAtMs)*time.Millisecond, 0)
+	pcm := session.ptt.press(now, now.Add(-lead))
+	compensated := session.ptt.duration(pcm)
+	h.metrics.pttCompensation(compensated)
+	session.Client.logger.Debug("Push-to-talk pressed", "reported_lead", lead, "compensated", compensated)
+	if len(pcm) == 0 {
+		return
+	}
+	a := audio.FromPCM16(pcm, session.sampleRate, h.config.Audio.Channels)
+	if err := h.sendAudio(ctx, session, a); err != nil {
+		session.Client.logger.Error("Could not send push-to-talk pre-buffer to AI Client", "error", err)
+	}
+}
+
+// handlePTTEnd stops relaying the user once the talk button is released. The provider detects the
+// end of turns in the audio, so it is sent silence to take the turn as over.
+func (h *Handler) handlePTTEnd(ctx context.Context, session *Session) {
+	if session.ptt == nil || !session.ptt.pressed {
+		return
+	}
+	session.ptt.release()
+	samples := int(session.ptt.endSilence * time.Duration(session.sampleRate) / time.Second)
+	if samples == 0 {
+		return
+	}
+	silence := make([]byte, samples*2*h.config.Audio.Channels)
+	a := audio.FromPCM16(silence, session.sampleRate, h.config.Audio.Channels)
+	if err := h.sendAudio(ctx, session, a); err != nil {
+		session.Client.logger.Error("Could not send end of push-to-talk turn to AI Client", "error", err)
+	}
+}
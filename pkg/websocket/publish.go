@@ -0,0 +1,30 @@
+package websocket
+
+import (
+	"github.com/pixaverse-studios/websocket-server/pkg/events"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+// publishEnd publishes the end of a session and its quality of service, from its record
+func (h *Handler) publishEnd(session *Session, r store.SessionRecord) {
+	if h.events == nil {
+		return
+	}
+	session.publish(events.SessionEnded, r.EndedAt, events.SessionEnd{
+		DurationMs: r.EndedAt.Sub(r.StartedAt).Milliseconds(),
+		Turns:      len(r.Turns),
+		Flagged:    r.Flagged,
+		FlagReason: r.FlagReason,
+	})
+	qos := events.QoS{AudioFrames: r.AudioFrames, CorruptedFrames: r.CorruptedFrames}
+	if f := r.Frames; f != nil {
+		qos.Lost, qos.Reordered, qos.Late = f.Lost, f.Reordered, f.Late
+	}
+	if report := NewHeatReport([]SessionHeat{session.Heat()}, r.EndedAt); len(report.Stages) > 0 {
+		qos.Stages = make(map[string]events.StageQoS, len(report.Stages))
+		for _, st := range report.Stages {
+			qos.Stages[st.Stage] = events.StageQoS{Samples: st.Samples, MeanMs: st.MeanMs, P95Ms: st.P95Ms, MaxMs: st.MaxMs}
+		}
+	}
+	session.publish(events.SessionQoS, r.EndedAt, qos)
+}
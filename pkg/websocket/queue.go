@@ -0,0 +1,202 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	pixaerrors "github.com/pixaverse-studios/websocket-server/pkg/errors"
+)
+
+// Results of waiting for a provider session, as counted in pixa_provider_queue_total
+const (
+	QueueAdmitted = "admitted"
+	// QueueTimedOut sessions waited for longer than provider_queue.max_wait
+	QueueTimedOut  = "timed_out"
+	QueueAbandoned = "abandoned"
+	// QueueRefused devices connected while the line was full
+	QueueRefused = "refused"
+)
+
+var errQueueTimeout = pixaerrors.New(pixaerrors.Unavailable, "waited too long for a provider session")
+
+// providerQueue caps the provider sessions open at once. Sessions beyond the cap wait in line, in
+// the order they connected, and a session ending hands its slot to the first in line.
+type providerQueue struct {
+	maxSessions int
+	maxWaiting  int
+
+	mu      sync.Mutex
+	active  int
+	waiting []*queueTicket
+}
+
+// queueTicket is a session's place in line. admitted is closed when the session gets its slot, and
+// positions carries the latest position in line when it changes.
+type queueTicket struct {
+	admitted  chan struct{}
+	positions chan int
+}
+
+func newProviderQueue(cfg config.ProviderQueueConfig) *providerQueue {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &providerQueue{maxSessions: cfg.MaxSessions, maxWaiting: cfg.MaxWaiting}
+}
+
+// full reports whether a device connecting now would find no room in line
+func (q *providerQueue) full() bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.active >= q.maxSessions && len(q.waiting) >= q.maxWaiting
+}
+
+// join takes a slot, returning a nil ticket, or a place in line when there is none free
+func (q *providerQueue) join() *queueTicket {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.active < q.maxSessions && len(q.waiting) == 0 {
+		q.active++
+		return nil
+	}
+	t := &queueTicket{admitted: make(chan struct{}), positions: make(chan int, 1)}
+	q.waiting = append(q.waiting, t)
+	t.positions <- len(q.waiting)
+	return t
+}
+
+// leave takes a ticket out of line. It reports false when the ticket was admitted meanwhile, and
+// holds a slot.
+func (q *providerQueue) leave(t *queueTicket) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, w := range q.waiting {
+		if w == t {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			q.notify(i)
+			return true
+		}
+	}
+	return false
+}
+
+// release gives up a slot, to the first in line if any
+func (q *providerQueue) release() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) == 0 {
+		q.active--
+		return
+	}
+	close(q.waiting[0].admitted)
+	q.waiting = q.waiting[1:]
+	q.notify(0)
+}
+
+// notify sends the tickets in line from index from their new positions; the mutex must be held
+func (q *providerQueue) notify(from int) {
+	for i, t := range q.waiting[from:] {
+		select {
+		case <-t.positions:
+		default:
+		}
+		t.positions <- from + i + 1
+	}
+}
+
+// waitingCount returns how many sessions are in line
+func (q *providerQueue) waitingCount() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+// refuseQueueFull rejects connections arriving while the line is full, reporting whether it did
+func (h *Handler) refuseQueueFull(w http.ResponseWriter) bool {
+	if !h.queue.full() {
+		return false
+	}
+	h.metrics.providerQueue(QueueRefused)
+	http.Error(w, "too many sessions waiting", http.StatusServiceUnavailable)
+	return true
+}
+
+// waitForProvider holds the session until it gets a provider slot, telling the device its position
+// in line whenever it changes and looping the hold clip while it waits. Audio from the device is
+// dropped meanwhile. The slot is released with h.queue.release once the session is done with the
+// provider.
+func (h *Handler) waitForProvider(ctx context.Context, session *Session) error {
+	if h.queue == nil {
+		return nil
+	}
+	t := h.queue.join()
+	if t == nil {
+		return nil
+	}
+	session.queued.Store(true)
+	defer session.queued.Store(false)
+	h.metrics.queueWaiting(1)
+	defer h.metrics.queueWaiting(-1)
+	started := session.clock.Now()
+	session.Client.logger.Info("Provider sessions at capacity, waiting in line")
+
+	holdCtx, stopHold := context.WithCancel(ctx)
+	defer stopHold()
+	maxWait, _ := time.ParseDuration(h.config.ProviderQueue.MaxWait)
+	h.startHold(holdCtx, session, maxWait)
+	timeout := session.clock.After(maxWait)
+	for {
+		select {
+		case <-t.admitted:
+			stopHold()
+			waited := session.clock.Now().Sub(started)
+			h.metrics.providerQueue(QueueAdmitted)
+			session.Client.logger.Info("Admitted from the line", "waited", waited)
+			if err := session.Client.Send(queueAdmittedEvent{Type: QueueAdmittedEvent, WaitedMs: waited.Milliseconds()}); err != nil {
+				session.Client.logger.Error("Could not send queue admission to client", "error", err)
+			}
+			return nil
+		case position := <-t.positions:
+			if err := session.Client.Send(queuePositionEvent{Type: QueuePositionEvent, Position: position, Waiting: h.queue.waitingCount()}); err != nil {
+				session.Client.logger.Error("Could not send queue position to client", "error", err)
+			}
+		case <-timeout:
+			if !h.queue.leave(t) {
+				continue
+			}
+			h.metrics.providerQueue(QueueTimedOut)
+			return errQueueTimeout
+		case <-ctx.Done():
+			if !h.queue.leave(t) {
+				h.queue.release()
+			}
+			h.metrics.providerQueue(QueueAbandoned)
+			return ctx.Err()
+		}
+	}
+}
+
+// startHold loops the hold clip to a waiting device until ctx is done
+func (h *Handler) startHold(ctx context.Context, session *Session, maxWait time.Duration) {
+	asset := h.config.ProviderQueue.HoldAsset
+	if asset == "" || h.assets == nil {
+		return
+	}
+	pcm, err := h.assets.PCM16(asset, session.DownlinkSampleRate())
+	if err != nil {
+		session.Client.logger.Error("Could not load hold audio", "asset", asset, "error", err)
+		return
+	}
+	if len(pcm) > 0 {
+		go h.playFiller(ctx, session, pcm, 0, maxWait)
+	}
+}
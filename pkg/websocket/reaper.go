@@ -0,0 +1,122 @@
+package websocket
+
+import (
+	"context"
+	"time"
+
+	pixaerrors "github.com/pixaverse-studios/websocket-server/pkg/errors"
+)
+
+// Reasons a session is reaped, as counted in pixa_sessions_reaped_total
+const (
+	// ReapDeviceSilent sessions had not heard from their device, not even a pong, for the device timeout
+	ReapDeviceSilent = "device_silent"
+	// ReapProviderLost sessions had been without a provider connection for the provider timeout
+	ReapProviderLost = "provider_lost"
+	// ReapTeardownStuck sessions had started closing but were still registered after the teardown timeout
+	ReapTeardownStuck = "teardown_stuck"
+	// ReapUnresponsive sessions were still registered a teardown timeout after being reaped. They
+	// are dropped from the session list and their record is saved by the reaper.
+	ReapUnresponsive = "unresponsive"
+)
+
+// reaping records when and why the reaper force-closed a session
+type reaping struct {
+	at     time.Time
+	reason string
+}
+
+// reapLimits are the parsed reaper timeouts
+type reapLimits struct {
+	device   time.Duration
+	provider time.Duration
+	teardown time.Duration
+}
+
+// RunReaper force-closes orphaned sessions every reaper interval until ctx is done: sessions whose
+// device socket or provider connection died without the session noticing, and sessions stuck
+// closing. The relay server runs it when the reaper is enabled; embedding applications serving the
+// handler themselves can run it alongside.
+func (h *Handler) RunReaper(ctx context.Context) {
+	cfg := h.config.Reaper
+	interval, err := time.ParseDuration(cfg.Interval)
+	if err != nil || interval <= 0 {
+		h.logger.Error("Invalid reaper interval", "interval", cfg.Interval)
+		return
+	}
+	var limits reapLimits
+	limits.device, _ = time.ParseDuration(cfg.DeviceTimeout)
+	limits.provider, _ = time.ParseDuration(cfg.ProviderTimeout)
+	limits.teardown, _ = time.ParseDuration(cfg.TeardownTimeout)
+
+	ticker := h.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			h.reap(limits)
+		}
+	}
+}
+
+// reapedError is what a session reaped for reason ends with
+func reapedError(reason string) *pixaerrors.Error {
+	return pixaerrors.Errorf(pixaerrors.Overloaded, "session reaped: %s", reason)
+}
+
+// reap force-closes the orphaned sessions and returns how many were reaped by reason
+func (h *Handler) reap(limits reapLimits) map[string]int {
+	now := h.clock.Now()
+	reaped := make(map[string]int)
+	for _, s := range h.sessions.List() {
+		if r := s.reaped.Load(); r != nil {
+			if now.Sub(r.at) > limits.teardown {
+				h.dropSession(s)
+				reaped[ReapUnresponsive]++
+			}
+			continue
+		}
+
+		reason := s.orphaned(now, limits)
+		if reason == "" || !s.reaped.CompareAndSwap(nil, &reaping{at: now, reason: reason}) {
+			continue
+		}
+		s.Client.logger.Warn("Reaping orphaned session", "reason", reason)
+		h.metrics.sessionReaped(reason)
+		reaped[reason]++
+		s.Close()
+		s.Client.abortFor(reapedError(reason))
+	}
+	return reaped
+}
+
+// orphaned tells why the session should be reaped, or "" if it looks alive
+func (s *Session) orphaned(now time.Time, limits reapLimits) string {
+	if at := s.teardownAt.Load(); at != 0 && now.Sub(time.Unix(0, at)) > limits.teardown {
+		return ReapTeardownStuck
+	}
+
+	seen := max(s.lastRead.Load(), s.Client.lastPong.Load())
+	if limits.device > 0 && now.Sub(time.Unix(0, seen)) > limits.device {
+		return ReapDeviceSilent
+	}
+
+	s.uplinkMu.Lock()
+	detachedAt := s.detachedAt
+	s.uplinkMu.Unlock()
+	if limits.provider > 0 && !detachedAt.IsZero() && now.Sub(detachedAt) > limits.provider {
+		return ReapProviderLost
+	}
+	return ""
+}
+
+// dropSession removes a reaped session whose connection handling never returned, saving its
+// record in its place
+func (h *Handler) dropSession(s *Session) {
+	s.Client.logger.Error("Reaped session did not shut down, dropping it")
+	h.metrics.sessionReaped(ReapUnresponsive)
+	h.sessions.remove(s.ID)
+	h.saveSession(s, nil)
+}
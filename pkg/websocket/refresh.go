@@ -0,0 +1,142 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/ai"
+)
+
+// Outcomes of provider refreshes
+const (
+	// RefreshDrained is a refresh done once the answer being given was finished
+	RefreshDrained = "drained"
+	// RefreshCut is a refresh that cut the answer being given after ai.refresh_drain_timeout
+	RefreshCut = "cut"
+)
+
+var (
+	// ErrSessionNotFound is returned for sessions that are not active on the relay
+	ErrSessionNotFound = errors.New("session not found")
+
+	// errProviderRefresh ends a provider connection to replace it with a session of the new
+	// provider profile
+	errProviderRefresh = errors.New("provider session refreshed")
+)
+
+// ProviderProfile is the model and persona a session talks to. Empty fields keep the configured
+// ones.
+type ProviderProfile struct {
+	// Provider is the registered provider to use instead of ai.provider
+	Provider string `json:"provider,omitempty"`
+	// Model is the model the provider is asked for, such as an Azure deployment
+	Model string `json:"model,omitempty"`
+	// Instructions replace the system prompt to give the assistant another persona
+	Instructions string `json:"instructions,omitempty"`
+	// Voice is the voice the assistant answers in instead of ai.voice
+	Voice string `json:"voice,omitempty"`
+}
+
+// RefreshProvider switches an active session to another model or persona without the device
+// reconnecting. The answer being given is finished first, then the provider session is replaced
+// by one of the new profile, seeded with the conversation so far; the audio already sent on to
+// the device keeps playing.
+func (h *Handler) RefreshProvider(sessionID string, p ProviderProfile) error {
+	session, ok := h.sessions.Get(sessionID)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	if p.Provider != "" && !slices.Contains(h.providers.Names(), p.Provider) {
+		return fmt.Errorf("unknown provider %q", p.Provider)
+	}
+	session.profile.Store(&p)
+	select {
+	case session.refresh <- struct{}{}:
+	default:
+		// a refresh is already pending, it picks up the new profile
+	}
+	session.Client.logger.Info("Refreshing provider session", "provider", p.Provider, "model", p.Model, "voice", p.Voice, "persona_changed", p.Instructions != "")
+	return nil
+}
+
+// providerProfile returns the profile the session's next provider connection uses
+func (s *Session) providerProfile() ProviderProfile {
+	if p := s.profile.Load(); p != nil {
+		return *p
+	}
+	return ProviderProfile{}
+}
+
+// answerStarted records that the provider is giving an answer, until answerFinished
+func (s *Session) answerStarted() {
+	s.answerMu.Lock()
+	defer s.answerMu.Unlock()
+	if s.answered == nil {
+		s.answered = make(chan struct{})
+	}
+}
+
+// answerFinished records that the answer is complete, was interrupted or will not complete
+func (s *Session) answerFinished() {
+	s.answerMu.Lock()
+	defer s.answerMu.Unlock()
+	if s.answered != nil {
+		close(s.answered)
+		s.answered = nil
+	}
+}
+
+// answerDone returns a channel closed once no answer is being given
+func (s *Session) answerDone() <-chan struct{} {
+	s.answerMu.Lock()
+	defer s.answerMu.Unlock()
+	if s.answered == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return s.answered
+}
+
+// drainForRefresh waits for the answer being given to finish before the provider is replaced, up
+// to ai.refresh_drain_timeout
+func (h *Handler) drainForRefresh(ctx context.Context, session *Session) error {
+	timeout, _ := time.ParseDuration(h.config.AIConfig.RefreshDrainTimeout)
+	var cut <-chan time.Time
+	if timeout > 0 {
+		cut = session.clock.After(timeout)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-session.answerDone():
+		h.metrics.providerRefreshed(RefreshDrained)
+	case <-cut:
+		h.metrics.providerRefreshed(RefreshCut)
+		session.Client.logger.Warn("Answer still playing at the provider refresh, cutting it", "timeout", timeout)
+	}
+	return errProviderRefresh
+}
+
+// restoreConversation seeds a new provider session with the turns of the session so far
+func (h *Handler) restoreConversation(ctx context.Context, session *Session, aiClient ai.AIClient) {
+	loader, ok := aiClient.(ai.HistoryLoader)
+	if !ok {
+		return
+	}
+	session.transcriptMu.Lock()
+	items := make([]ai.HistoryItem, 0, len(session.transcript))
+	for _, t := range session.transcript {
+		items = append(items, ai.HistoryItem{Role: t.Role, Text: t.Text})
+	}
+	session.transcriptMu.Unlock()
+	if len(items) == 0 {
+		return
+	}
+	if err := loader.LoadHistory(ctx, items); err != nil {
+		session.Client.logger.Error("Could not restore the conversation in the new provider session", "error", err)
+	}
+}
@@ -0,0 +1,40 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// RegionCheck reports whether a region can take sessions, such as whether its transcript store is
+// reachable. It returns an error saying why a region is unavailable.
+type RegionCheck func(ctx context.Context, region string) error
+
+// WithRegionCheck checks the region of tenants pinned to one before their devices are upgraded, so
+// that no session starts whose data could not stay in its region. By default only the config of
+// the region is checked.
+func WithRegionCheck(c RegionCheck) Option {
+	return func(h *Handler) {
+		h.regionCheck = c
+	}
+}
+
+// checkRegion refuses the sessions of tenants pinned to a region that is not available
+func (h *Handler) checkRegion(ctx context.Context, tenantID string) error {
+	region, _, ok := h.config.RegionFor(tenantID)
+	if region == "" {
+		return nil
+	}
+	var err error
+	if !ok {
+		err = errors.New("region is not configured")
+	} else if h.regionCheck != nil {
+		err = h.regionCheck(ctx, region)
+	}
+	if err == nil {
+		return nil
+	}
+	h.metrics.regionRefused(region)
+	return &RejectError{StatusCode: http.StatusServiceUnavailable, Reason: fmt.Sprintf("region %s unavailable: %v", region, err)}
+}
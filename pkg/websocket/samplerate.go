@@ -0,0 +1,32 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// InputSampleRateHeader carries the sample rate of the audio the device sends, in Hz, for devices
+// that do not capture at audio.sample_rate. Devices that cannot set headers use the sample_rate
+// query parameter.
+const InputSampleRateHeader = "X-Pixa-Input-Sample-Rate"
+
+// InputSampleRates are the rates devices may send audio at, besides audio.sample_rate
+var InputSampleRates = []int{8000, 16000, 22050, 24000, 44100, 48000}
+
+// inputSampleRate returns the sample rate of the audio the device sends. Rates the relay does not
+// take are refused, so the device learns at upgrade time rather than from a provider hearing its
+// speech too fast or too slow.
+func (h *Handler) inputSampleRate(r *http.Request) (int, error) {
+	value := strings.TrimSpace(headerOrQuery(r, InputSampleRateHeader, "sample_rate"))
+	if value == "" {
+		return h.config.Audio.SampleRate, nil
+	}
+	rate, err := strconv.Atoi(value)
+	if err != nil || (rate != h.config.Audio.SampleRate && !slices.Contains(InputSampleRates, rate)) {
+		return 0, &RejectError{StatusCode: http.StatusBadRequest, Reason: fmt.Sprintf("unsupported input sample rate %q", value)}
+	}
+	return rate, nil
+}
@@ -0,0 +1,103 @@
+package websocket
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// pipelineWindow is the period the pipeline time of sessions is accounted over; each starts afresh
+// every window, so sessions are compared by their recent use rather than their age
+const pipelineWindow = time.Second
+
+// pipelineScheduler bounds the frames going through the audio pipeline at once. Frames beyond the
+// slots wait, and a slot freeing up goes to the waiting session with the least pipeline time in the
+// current window, the first in line among equals. A session has one frame in the pipeline at a
+// time, as its read pump processes them in order, so a chatty session waits behind the quiet ones
+// instead of crowding them out. A nil *pipelineScheduler runs every frame at once.
+type pipelineScheduler struct {
+	slots        int
+	starvedAfter time.Duration
+	metrics      *handlerMetrics
+	now          func() time.Time
+
+	mu      sync.Mutex
+	active  int
+	waiting []*pipelineTurn
+	// window is when the current window started, and used the pipeline time of the sessions in it
+	window time.Time
+	used   map[*Session]time.Duration
+}
+
+// pipelineTurn is a frame of a session waiting for a slot; ready is closed when it gets one
+type pipelineTurn struct {
+	session *Session
+	ready   chan struct{}
+}
+
+func newPipelineScheduler(cfg config.PipelineSchedulerConfig, m *handlerMetrics) *pipelineScheduler {
+	if !cfg.Enabled {
+		return nil
+	}
+	starvedAfter, _ := time.ParseDuration(cfg.StarvedAfter)
+	slots := cfg.Slots
+	if slots == 0 {
+		slots = runtime.NumCPU()
+	}
+	return &pipelineScheduler{
+		slots:        slots,
+		starvedAfter: starvedAfter,
+		metrics:      m,
+		now:          time.Now,
+		used:         make(map[*Session]time.Duration),
+	}
+}
+
+// run waits for a slot to process a frame of the session in, and returns the function giving it up
+func (p *pipelineScheduler) run(session *Session) (done func()) {
+	if p == nil {
+		return func() {}
+	}
+	queued := p.now()
+	p.mu.Lock()
+	if p.active < p.slots && len(p.waiting) == 0 {
+		p.active++
+		p.mu.Unlock()
+	} else {
+		t := &pipelineTurn{session: session, ready: make(chan struct{})}
+		p.waiting = append(p.waiting, t)
+		p.mu.Unlock()
+		<-t.ready
+	}
+	started := p.now()
+	p.metrics.pipelineWaited(started.Sub(queued), p.starvedAfter)
+	return func() { p.release(session, started) }
+}
+
+// release gives up the slot of a frame started at started, to the session in line that used the
+// pipeline least
+func (p *pipelineScheduler) release(session *Session, started time.Time) {
+	now := p.now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Sub(p.window) >= pipelineWindow {
+		p.window = now
+		clear(p.used)
+	}
+	p.used[session] += now.Sub(started)
+	if len(p.waiting) == 0 {
+		p.active--
+		return
+	}
+	next := 0
+	for i, t := range p.waiting {
+		if p.used[t.session] < p.used[p.waiting[next].session] {
+			next = i
+		}
+	}
+	t := p.waiting[next]
+	p.waiting = append(p.waiting[:next], p.waiting[next+1:]...)
+	close(t.ready)
+}
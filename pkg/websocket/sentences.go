@@ -0,0 +1,63 @@
+package websocket
+
+import (
+	"github.com/pixaverse-studios/websocket-server/internal/utils"
+)
+
+// sentenceTracker splits the assistant's streamed transcript into sentences and aligns each one
+// with the item's audio. Text deltas arrive interleaved with the audio deltas they describe, so a
+// sentence spans the audio received between its first delta and the delta completing it.
+// It is only used from the goroutine handling AI events.
+type sentenceTracker struct {
+	itemID   string
+	splitter utils.SentenceSplitter
+	index    int
+	startMs  int64
+	started  bool
+}
+
+// write adds a transcript delta and returns the sentences it completed
+func (t *sentenceTracker) write(itemID, delta string, receivedMs int64) []sentenceCompletedEvent {
+	t.reset(itemID)
+	if !t.started {
+		t.startMs = receivedMs
+		t.started = true
+	}
+	var events []sentenceCompletedEvent
+	for _, text := range t.splitter.Write(delta) {
+		events = append(events, t.complete(text, receivedMs))
+	}
+	return events
+}
+
+// flush completes the item's last sentence once its transcript is done
+func (t *sentenceTracker) flush(itemID string, receivedMs int64) []sentenceCompletedEvent {
+	t.reset(itemID)
+	text := t.splitter.Flush()
+	if text == "" {
+		return nil
+	}
+	return []sentenceCompletedEvent{t.complete(text, receivedMs)}
+}
+
+func (t *sentenceTracker) complete(text string, endMs int64) sentenceCompletedEvent {
+	e := sentenceCompletedEvent{
+		Type:         SentenceCompletedEvent,
+		ItemID:       t.itemID,
+		Index:        t.index,
+		Text:         text,
+		AudioStartMs: t.startMs,
+		AudioEndMs:   endMs,
+	}
+	t.index++
+	t.startMs = endMs
+	return e
+}
+
+// reset starts over when the transcript of a new item begins
+func (t *sentenceTracker) reset(itemID string) {
+	if itemID == t.itemID {
+		return
+	}
+	*t = sentenceTracker{itemID: itemID}
+}
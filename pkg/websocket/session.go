@@ -0,0 +1,434 @@
+package websocket
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/ai"
+	"github.com/pixaverse-studios/websocket-server/pkg/audio"
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/events"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+// seedStream selects the PCG stream session generators draw from
+const seedStream = 0x9e3779b97f4a7c15
+
+// Session represents a single device connection relayed to the AI provider
+type Session struct {
+	ID string
+	// DeviceID identifies the connected device, if it is known
+	DeviceID string
+	// TenantID is the tenant the device belongs to, if it is known
+	TenantID  string
+	Client    *Client
+	StartedAt time.Time
+	// Cursor tracks the audio relayed in both directions
+	Cursor *AudioCursor
+	// Seed seeds the session's random choices: its ID and retry jitter. A session started with the
+	// same seed against the same clock makes the same choices. Encryption keys are always random.
+	Seed uint64
+	// CorrelationID is the ID the device connected with to tie the session to the customer's
+	// systems, if any
+	CorrelationID string
+
+	clock  clock.Clock
+	randMu sync.Mutex
+	rand   *rand.Rand
+
+	cancel       context.CancelFunc
+	memory       *memoryBudget
+	sentences    sentenceTracker
+	bandwidth    *bandwidthMeter
+	downlinkRate atomic.Int64
+	// version is what the device reported about its versions
+	version atomic.Pointer[clientVersion]
+	// chaosProviderCut and chaosDeviceCut fire when fault injection cuts the provider or the device
+	// connection
+	chaosProviderCut <-chan time.Time
+	chaosDeviceCut   <-chan time.Time
+	// frames encrypts audio frames once the device has said hello. helloMu orders the welcome
+	// before the first sealed frame sent to the device.
+	frames  atomic.Pointer[frameCipher]
+	helloMu sync.RWMutex
+	// audioFrames and corruptedFrames count the binary frames received from the device and those
+	// that failed their checksum
+	audioFrames     atomic.Int64
+	corruptedFrames atomic.Int64
+	// interruptions counts the answers the user spoke over
+	interruptions atomic.Int64
+	// audioTest is the audio test running, if any
+	audioTest atomic.Pointer[audioTest]
+	// announcing is set while an announcement plays
+	announcing atomic.Bool
+	// queued is set while the session waits in line for a provider session
+	queued atomic.Bool
+
+	// lastRead is when the device last sent a message, in unix nanoseconds of the session clock
+	lastRead atomic.Int64
+	// teardownAt is when the session started closing, in unix nanoseconds; 0 while it runs
+	teardownAt atomic.Int64
+	// reaped is set once the reaper has force-closed the session
+	reaped   atomic.Pointer[reaping]
+	saveOnce sync.Once
+
+	// uplinkMu guards the provider uplink audio is forwarded to and the offline buffer
+	uplinkMu      sync.Mutex
+	provider      ai.AIClient
+	offline       *offlineBuffer
+	outageStarted time.Time
+	// detachedAt is when the session was last left without a provider; zero while it has one
+	detachedAt time.Time
+
+	// profile is the model and persona of the session's provider, refresh asks for the provider
+	// session to be replaced by one of the current profile
+	profile atomic.Pointer[ProviderProfile]
+	refresh chan struct{}
+	// answerMu guards answered, which is closed once the answer the provider is giving is over
+	answerMu sync.Mutex
+	answered chan struct{}
+
+	// faqMu guards the answer being recorded in FAQ mode and the count of cached answers played
+	faqMu        sync.Mutex
+	faqRecording *faqRecording
+	faqAnswers   int
+
+	// metadataMu guards the metadata the device attached to the user's next turn
+	metadataMu sync.Mutex
+	metadata   *turnMetadata
+
+	// fillerMu guards cancelFiller, which stops the thinking filler while it plays
+	fillerMu     sync.Mutex
+	cancelFiller context.CancelFunc
+
+	tags sessionTags
+	// displayLanguage is the language the device displays captions in, if it reported one
+	displayLanguage string
+	// captions queues sentences for translation; nil when they are sent as spoken
+	captions chan<- []sentenceCompletedEvent
+	heat     sessionHeat
+	// echo detects the response audio coming back from the device; nil when detection is disabled
+	echo *echoDetector
+	// speech predicts how long the assistant's answers play; nil when estimates are disabled
+	speech *speechEstimator
+	// duplexMode is the session's duplex mode, and duplex mutes the device while the assistant
+	// speaks in half duplex; nil in full duplex
+	duplexMode string
+	duplex     *halfDuplex
+	// deviceProfile is the name of the device's profile, empty for none, and utterance ends turns
+	// that run past its max_utterance; nil when turns are unbounded
+	deviceProfile string
+	utterance     *utteranceCap
+	// aec cancels the response audio the device picks up; nil when its echo is not cancelled
+	aec *echoCanceller
+	// denoiser suppresses the noise in the device's audio; nil when it is not denoised
+	denoiser audio.Denoiser
+	// agc brings the device's audio to a level; nil when it is not gain controlled
+	agc *gainControl
+	// vad holds back the device's audio while no speech is detected in it; nil when it is not gated
+	vad *vadGate
+	// calibration adapts the session to the noise around the device; nil when disabled
+	calibration *calibration
+	// ptt holds back the audio of push-to-talk devices while their button is up; nil for hands-free
+	// devices
+	ptt *pushToTalk
+	// codec is that of the device's audio frames, and decoder decodes them; nil for pcm16
+	codec   string
+	decoder audio.Decoder
+	// playout holds the device's audio in a jitter buffer to even out its delivery; nil when it is
+	// sent at once
+	playout *jitterBuffer
+	// frameSeq puts the device's frames in order by their headers; nil when it sends raw frames
+	frameSeq *frameSequence
+	// plc conceals the frames the device lost; nil when they are not concealed
+	plc *audio.Concealer
+	// live mixes the session's audio for the supervisors listening to it
+	live liveAudio
+	// downmix mixes the device's channels down to audio.channels; nil when it sends as many
+	downmix *downmix
+	// downlinkCodec is that of the audio sent to the device, and downlinkEnc encodes it; nil for
+	// pcm16
+	downlinkCodec string
+	downlinkEnc   *downlinkEncoder
+	// downlinkResampler converts the answers to the downlink rate
+	downlinkResampler answerResampler
+	// firstRead is the read of the device's first message when it was read waiting for a
+	// device.hello; nil once readPump took it
+	firstRead chan deviceRead
+	// verifySample samples the user's speech to verify the speaker, and verification is the result;
+	// the sampler is nil when speakers are not verified
+	verifySample *speakerSampler
+	verification atomic.Pointer[store.SpeakerVerification]
+
+	// events publishes the session's events; nil when they are not published
+	events *events.Publisher
+	// turns runs the turn processors on the session's completed assistant turns
+	turns *turnChain
+	// speaker samples the user's speech to classify their voice; nil when speakers are not classified
+	speaker *speakerSampler
+	// sampleRate is the rate of the device's audio, audio.sample_rate unless the device chose another
+	sampleRate int
+
+	transcriptMu sync.Mutex
+	transcript   []store.Turn
+	timeline     timeline
+}
+
+// SessionInfo is a snapshot of an active session, as shown in the admin API
+type SessionInfo struct {
+	ID                string            `json:"id"`
+	DeviceID          string            `json:"device_id,omitempty"`
+	TenantID          string            `json:"tenant_id,omitempty"`
+	CorrelationID     string            `json:"correlation_id,omitempty"`
+	StartedAt         time.Time         `json:"started_at"`
+	Seed              uint64            `json:"seed"`
+	ProviderConnected bool              `json:"provider_connected"`
+	Cursor            CursorStatus      `json:"cursor"`
+	Memory            MemoryUsage       `json:"memory"`
+	Tags              map[string]string `json:"tags,omitempty"`
+	ProtocolVersion   int               `json:"protocol_version"`
+	FirmwareVersion   string            `json:"firmware_version,omitempty"`
+	DisplayLanguage   string            `json:"display_language,omitempty"`
+	Duplex            string            `json:"duplex,omitempty"`
+	DeviceProfile     string            `json:"device_profile,omitempty"`
+	Codec             string            `json:"codec,omitempty"`
+	DownlinkCodec     string            `json:"downlink_codec,omitempty"`
+	SampleRate        int               `json:"sample_rate"`
+	InputChannels     int               `json:"input_channels,omitempty"`
+	Downmix           string            `json:"downmix,omitempty"`
+	Frames            *store.FrameStats `json:"frames,omitempty"`
+	Denoised          bool              `json:"denoised,omitempty"`
+	// GainDB is the gain control's current gain, set when the session's audio is gain controlled
+	GainDB *float64 `json:"agc_gain_db,omitempty"`
+	// EchoCancellation is set when the echo in the session's audio is cancelled
+	EchoCancellation *EchoCancellation `json:"echo_cancellation,omitempty"`
+	// Calibration is set once the session was calibrated to the noise around its device
+	Calibration *CalibrationResult `json:"calibration,omitempty"`
+	// ProviderProfile is set once the session was switched to another model or persona
+	ProviderProfile *ProviderProfile `json:"provider_profile,omitempty"`
+	// Verification is set once the speaker was verified, or failed to be
+	Verification *store.SpeakerVerification `json:"verification,omitempty"`
+	// Speaker is set once the user's voice was classified
+	Speaker *store.SpeakerClassification `json:"speaker,omitempty"`
+}
+
+// Info returns a snapshot of the session
+func (s *Session) Info() SessionInfo {
+	s.uplinkMu.Lock()
+	connected := s.provider != nil
+	s.uplinkMu.Unlock()
+	return SessionInfo{
+		ID:                s.ID,
+		DeviceID:          s.DeviceID,
+		TenantID:          s.TenantID,
+		CorrelationID:     s.CorrelationID,
+		StartedAt:         s.StartedAt,
+		Seed:              s.Seed,
+		ProviderConnected: connected,
+		Cursor:            s.Cursor.Status(),
+		Memory:            s.MemoryUsage(),
+		Tags:              s.Tags(),
+		ProtocolVersion:   s.ProtocolVersion(),
+		FirmwareVersion:   s.FirmwareVersion(),
+		DisplayLanguage:   s.displayLanguage,
+		Duplex:            s.duplexMode,
+		DeviceProfile:     s.deviceProfile,
+		Codec:             s.codec,
+		DownlinkCodec:     s.downlinkCodec,
+		SampleRate:        s.sampleRate,
+		InputChannels:     s.downmix.channels(),
+		Downmix:           s.downmix.name(),
+		Frames:            s.frameSeq.stats(),
+		Denoised:          s.denoiser != nil,
+		GainDB:            s.agc.info(),
+		EchoCancellation:  s.aec.status(),
+		Calibration:       s.calibration.calibrated(),
+		ProviderProfile:   s.profile.Load(),
+		Verification:      s.verification.Load(),
+		Speaker:           s.speaker.classification(),
+	}
+}
+
+// addTurn appends an utterance to the session's transcript
+func (s *Session) addTurn(role, itemID, text string) {
+	turn := store.Turn{Role: role, ItemID: itemID, Text: text, At: s.clock.Now()}
+	if role == store.UserRole {
+		turn.Metadata = s.takeMetadata()
+	}
+	s.transcriptMu.Lock()
+	s.place(&turn)
+	s.transcript = append(s.transcript, turn)
+	s.transcriptMu.Unlock()
+	s.publish(events.TurnTranscribed, turn.At, turn)
+	if role == store.AssistantRole {
+		s.turns.completed(s, turn)
+	}
+}
+
+// publish publishes an event of the session, if its events are published
+func (s *Session) publish(typ string, at time.Time, data any) {
+	s.events.Publish(events.Event{Type: typ, SessionID: s.ID, DeviceID: s.DeviceID, TenantID: s.TenantID, At: at, Data: data})
+}
+
+// Record returns what is kept of the session once it ends
+func (s *Session) Record(endedAt time.Time, err error) store.SessionRecord {
+	s.transcriptMu.Lock()
+	turns := append([]store.Turn(nil), s.transcript...)
+	s.transcriptMu.Unlock()
+
+	r := store.SessionRecord{
+		ID:        s.ID,
+		TenantID:  s.TenantID,
+		DeviceID:  s.DeviceID,
+		StartedAt: s.StartedAt,
+		EndedAt:   endedAt,
+		Turns:     turns,
+		Seed:      s.Seed,
+
+		CorrelationID:   s.CorrelationID,
+		AudioFrames:     s.audioFrames.Load(),
+		CorruptedFrames: s.corruptedFrames.Load(),
+		Frames:          s.frameSeq.stats(),
+		Tags:            s.Tags(),
+		ProtocolVersion: s.ProtocolVersion(),
+		FirmwareVersion: s.FirmwareVersion(),
+		Analytics:       store.Analyze(turns, int(s.interruptions.Load())),
+		Verification:    s.verification.Load(),
+		Speaker:         s.speaker.classification(),
+		SampleRate:      s.sampleRate,
+		InputChannels:   s.downmix.channels(),
+		Downmix:         s.downmix.name(),
+	}
+	if s.codec != PCM16Codec {
+		r.AudioCodec = s.codec
+	}
+	if err != nil {
+		r.Flagged = true
+		r.FlagReason = err.Error()
+	}
+	return r
+}
+
+// jitter spreads d by up to 20% either way, so sessions that failed together do not retry together
+func (s *Session) jitter(d time.Duration) time.Duration {
+	s.randMu.Lock()
+	defer s.randMu.Unlock()
+	return time.Duration(float64(d) * (0.8 + 0.4*s.rand.Float64()))
+}
+
+// CorruptedFrames returns how many binary frames from the device failed their checksum, out of how
+// many were received
+func (s *Session) CorruptedFrames() (corrupted, total int64) {
+	return s.corruptedFrames.Load(), s.audioFrames.Load()
+}
+
+// DownlinkSampleRate returns the sample rate audio is currently relayed to the device at
+func (s *Session) DownlinkSampleRate() int {
+	return int(s.downlinkRate.Load())
+}
+
+// setDownlinkSampleRate changes the sample rate audio is relayed to the device at
+func (s *Session) setDownlinkSampleRate(rate int) {
+	s.downlinkRate.Store(int64(rate))
+	s.Cursor.SetSampleRate(rate)
+	s.downlinkResampler.reset()
+}
+
+// Close ends the session
+func (s *Session) Close() {
+	s.beginTeardown()
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// beginTeardown records that the session has started closing
+func (s *Session) beginTeardown() {
+	s.teardownAt.CompareAndSwap(0, s.clock.Now().UnixNano())
+}
+
+// SessionManager keeps track of the active sessions of a handler. A SessionManager can be shared
+// between several handlers through the WithSessionManager option.
+type SessionManager struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+	// ids generates session IDs, HexID when nil
+	ids IDGenerator
+}
+
+// NewSessionManager creates an empty session manager
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions: make(map[string]*Session),
+	}
+}
+
+// create registers a new session for the client
+func (m *SessionManager) create(client *Client, deviceID, tenantID string, cancel context.CancelFunc, seed uint64, clk clock.Clock) *Session {
+	r := rand.New(rand.NewPCG(seed, seedStream))
+	ids := m.ids
+	if ids == nil {
+		ids = HexID
+	}
+	now := clk.Now()
+	s := &Session{
+		ID:        ids(now, r),
+		DeviceID:  deviceID,
+		TenantID:  tenantID,
+		Client:    client,
+		StartedAt: now,
+		Cursor:    NewAudioCursor(client.config.Audio.SampleRate),
+		Seed:      seed,
+		clock:     clk,
+		rand:      r,
+		cancel:    cancel,
+		memory:    newMemoryBudget(client.config.Memory),
+		refresh:   make(chan struct{}, 1),
+	}
+	s.detachedAt = s.StartedAt
+	s.lastRead.Store(s.StartedAt.UnixNano())
+	s.downlinkRate.Store(int64(client.config.Audio.SampleRate))
+	s.sampleRate = client.config.Audio.SampleRate
+
+	m.mu.Lock()
+	m.sessions[s.ID] = s
+	m.mu.Unlock()
+	return s
+}
+
+// remove unregisters the session with the given id
+func (m *SessionManager) remove(id string) {
+	m.mu.Lock()
+	delete(m.sessions, id)
+	m.mu.Unlock()
+}
+
+// Get returns the active session with the given id
+func (m *SessionManager) Get(id string) (*Session, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.sessions[id]
+	return s, ok
+}
+
+// List returns a snapshot of all active sessions
+func (m *SessionManager) List() []*Session {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// Count returns the number of active sessions
+func (m *SessionManager) Count() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.sessions)
+}
@@ -0,0 +1,231 @@
+package websocket
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	pixaerrors "github.com/pixaverse-studios/websocket-server/pkg/errors"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+// Age groups a speaker classifier reports
+const (
+	ChildSpeaker = "child"
+	TeenSpeaker  = "teen"
+	AdultSpeaker = "adult"
+)
+
+// Actions of speaker policies
+const (
+	SpeakerLog      = "log"
+	SpeakerRestrict = "restrict"
+	SpeakerEnd      = "end"
+)
+
+// SpeakerAttributes are the coarse attributes of a voice a speaker classifier reports
+type SpeakerAttributes struct {
+	// AgeGroup is ChildSpeaker, TeenSpeaker or AdultSpeaker, empty when the classifier cannot tell
+	AgeGroup string `json:"age_group,omitempty"`
+	// Confidence is how sure the classifier is of the age group, between 0 and 1
+	Confidence float64 `json:"confidence"`
+}
+
+// SpeakerClassifier classifies the voice of the user, such as by calling an external service.
+// pcm is speaker.sample of the user's speech, in 16 bit PCM of the given format. Deployments use it
+// to apply policies to sessions, such as restricting what is said to children.
+type SpeakerClassifier interface {
+	ClassifySpeaker(ctx context.Context, pcm []byte, sampleRate, channels int) (SpeakerAttributes, error)
+}
+
+// SpeakerClassifierFunc adapts a function to the SpeakerClassifier interface
+type SpeakerClassifierFunc func(ctx context.Context, pcm []byte, sampleRate, channels int) (SpeakerAttributes, error)
+
+// ClassifySpeaker calls f
+func (f SpeakerClassifierFunc) ClassifySpeaker(ctx context.Context, pcm []byte, sampleRate, channels int) (SpeakerAttributes, error) {
+	return f(ctx, pcm, sampleRate, channels)
+}
+
+// SpeakerAudit records the classification of a session's speaker and the policy applied to it
+type SpeakerAudit struct {
+	Time       time.Time
+	SessionID  string
+	DeviceID   string
+	TenantID   string
+	Attributes SpeakerAttributes
+	// Action is the policy applied, empty when none did
+	Action string
+	// Error is set when the classification failed
+	Error error
+}
+
+// SpeakerAuditor receives every speaker classification, to keep an audit trail
+type SpeakerAuditor func(SpeakerAudit)
+
+// WithSpeakerClassifier classifies the voice of the user of each session when speaker.enabled is
+// set, and applies speaker.policies to the result. By default speakers are not classified.
+func WithSpeakerClassifier(c SpeakerClassifier) Option {
+	return func(h *Handler) {
+		h.speakerClassifier = c
+	}
+}
+
+// WithSpeakerAuditor sends speaker classifications to the given auditor. By default they are
+// logged.
+func WithSpeakerAuditor(a SpeakerAuditor) Option {
+	return func(h *Handler) {
+		h.speakerAuditor = a
+	}
+}
+
+// speakerSampler collects the first speaker.sample of the user's speech for the classifier. It is
+// filled by the session's read pump while the provider hears the user. A nil *speakerSampler
+// collects nothing, as when speakers are not classified.
+type speakerSampler struct {
+	size     int
+	speaking atomic.Bool
+
+	mu     sync.Mutex
+	pcm    []byte
+	done   bool
+	result *store.SpeakerClassification
+}
+
+// newSpeakerSampler returns the speaker sampler of a session whose device sends audio at
+// sampleRate, or nil if speakers are not classified
+func newSpeakerSampler(cfg *config.Config, classifier SpeakerClassifier, sampleRate int) *speakerSampler {
+	if classifier == nil || !cfg.Speaker.Enabled {
+		return nil
+	}
+	sample, _ := time.ParseDuration(cfg.Speaker.Sample)
+	size := int(sample.Seconds()*float64(sampleRate)) * cfg.Audio.Channels * 2
+	return &speakerSampler{size: max(size, 2)}
+}
+
+// setSpeaking records whether the provider hears the user
+func (s *speakerSampler) setSpeaking(speaking bool) {
+	if s != nil {
+		s.speaking.Store(speaking)
+	}
+}
+
+// add collects a frame from the device if the user is speaking. It returns the sample once it is
+// complete, and nil before and after.
+func (s *speakerSampler) add(pcm []byte) []byte {
+	if s == nil || !s.speaking.Load() {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return nil
+	}
+	s.pcm = append(s.pcm, pcm...)
+	if len(s.pcm) < s.size {
+		return nil
+	}
+	sample := s.pcm[:s.size]
+	s.pcm, s.done = nil, true
+	return sample
+}
+
+// classified records the classification of the speaker
+func (s *speakerSampler) classified(c store.SpeakerClassification) {
+	s.mu.Lock()
+	s.result = &c
+	s.mu.Unlock()
+}
+
+// classification returns the classification of the speaker, nil until they were classified
+func (s *speakerSampler) classification() *store.SpeakerClassification {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.result
+}
+
+// sampleSpeaker collects the user's speech for the speaker classifier, and classifies the speaker
+// once enough was heard
+func (h *Handler) sampleSpeaker(ctx context.Context, session *Session, pcm []byte) {
+	if sample := session.speaker.add(pcm); sample != nil {
+		go h.classifySpeaker(ctx, session, sample)
+	}
+}
+
+// classifySpeaker classifies the speaker of a session from a sample of their speech and applies the
+// policy of their age group. Policies only apply to classifications of at least
+// speaker.min_confidence; every classification is audited. The sample is not kept.
+func (h *Handler) classifySpeaker(ctx context.Context, session *Session, sample []byte) {
+	cfg := h.config.Speaker
+	if timeout, _ := time.ParseDuration(cfg.Timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	attrs, err := h.speakerClassifier.ClassifySpeaker(ctx, sample, session.sampleRate, h.config.Audio.Channels)
+	audit := SpeakerAudit{
+		Time:       session.clock.Now(),
+		SessionID:  session.ID,
+		DeviceID:   session.DeviceID,
+		TenantID:   session.TenantID,
+		Attributes: attrs,
+		Error:      err,
+	}
+	if err != nil {
+		h.metrics.speakerClassified("", "error")
+		session.Client.logger.Warn("Could not classify speaker", "error", err)
+		h.auditSpeaker(audit)
+		return
+	}
+
+	policy, ok := cfg.Policies[attrs.AgeGroup]
+	if ok && attrs.AgeGroup != "" && attrs.Confidence >= cfg.MinConfidence {
+		audit.Action = policy.Action
+	}
+	session.speaker.classified(store.SpeakerClassification{
+		AgeGroup:   attrs.AgeGroup,
+		Confidence: attrs.Confidence,
+		Action:     audit.Action,
+		At:         audit.Time,
+	})
+	action := audit.Action
+	if action == "" {
+		action = "none"
+	}
+	h.metrics.speakerClassified(attrs.AgeGroup, action)
+	h.auditSpeaker(audit)
+
+	switch audit.Action {
+	case SpeakerRestrict:
+		p := session.providerProfile()
+		if policy.Model != "" {
+			p.Model = policy.Model
+		}
+		if policy.Instructions != "" {
+			p.Instructions = policy.Instructions
+		}
+		if err := h.RefreshProvider(session.ID, p); err != nil {
+			session.Client.logger.Error("Could not restrict session to speaker policy", "error", err)
+		}
+	case SpeakerEnd:
+		session.Client.closeFor(pixaerrors.New(pixaerrors.PolicyViolation, "speaker policy"))
+	}
+}
+
+// auditSpeaker sends a classification to the speaker auditor
+func (h *Handler) auditSpeaker(a SpeakerAudit) {
+	if h.speakerAuditor != nil {
+		h.speakerAuditor(a)
+		return
+	}
+	attrs := []any{"session_id", a.SessionID, "device_id", a.DeviceID, "tenant_id", a.TenantID,
+		"age_group", a.Attributes.AgeGroup, "confidence", a.Attributes.Confidence, "action", a.Action}
+	if a.Error != nil {
+		attrs = append(attrs, "error", a.Error)
+	}
+	h.logger.Info("Speaker classified", attrs...)
+}
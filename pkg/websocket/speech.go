@@ -0,0 +1,151 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// speechRateWeight is how much each answer moves the session's measured speech rate
+const speechRateWeight = 0.3
+
+// speechEstimator predicts how long the assistant's current answer plays. The transcript streams
+// ahead of the audio it describes, so its length, at the session's speech rate, predicts the
+// length of the item's audio before it was all received. The speech rate starts at
+// speech_estimate.chars_per_second and follows the answers of the session as they finish. A nil
+// *speechEstimator predicts nothing.
+type speechEstimator struct {
+	interval time.Duration
+
+	mu sync.Mutex
+	// msPerChar is the speech rate, in milliseconds of audio per transcript character
+	msPerChar float64
+	// cur is the item being estimated
+	cur speechItem
+}
+
+// speechItem is what is known of the length of an assistant item
+type speechItem struct {
+	id string
+	// chars is the length of the transcript so far, complete once textDone
+	chars    int
+	textDone bool
+	// audioMs is the length of the item's audio, set once audioDone
+	audioMs   int64
+	audioDone bool
+	measured  bool
+	// sentAt is when the last estimate was sent, sentFinal whether it was the item's final one
+	sentAt    time.Time
+	sentFinal bool
+}
+
+// newSpeechEstimator returns an estimator for a session, or nil if estimates are disabled
+func newSpeechEstimator(cfg config.SpeechEstimateConfig) *speechEstimator {
+	if !cfg.Enabled || cfg.CharsPerSecond <= 0 {
+		return nil
+	}
+	interval, _ := time.ParseDuration(cfg.Interval)
+	return &speechEstimator{interval: interval, msPerChar: 1000 / cfg.CharsPerSecond}
+}
+
+// item returns the estimated item, starting over when a new one is estimated. It must be called
+// with mu held.
+func (e *speechEstimator) item(itemID string) *speechItem {
+	if itemID != e.cur.id {
+		e.cur = speechItem{id: itemID}
+	}
+	return &e.cur
+}
+
+// text adds a delta of an item's transcript
+func (e *speechEstimator) text(itemID, delta string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.item(itemID).chars += utf8.RuneCountInString(delta)
+}
+
+// textDone records the full transcript of an item
+func (e *speechEstimator) textDone(itemID, transcript string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	it := e.item(itemID)
+	it.chars = utf8.RuneCountInString(transcript)
+	it.textDone = true
+	e.measure(it)
+}
+
+// audioDone records the length of an item's audio once the provider sent all of it
+func (e *speechEstimator) audioDone(itemID string, audioMs int64) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	it := e.item(itemID)
+	it.audioMs = audioMs
+	it.audioDone = true
+	e.measure(it)
+}
+
+// measure moves the speech rate towards that of the item once both its transcript and its audio
+// are complete. It must be called with mu held.
+func (e *speechEstimator) measure(it *speechItem) {
+	if it.measured || !it.textDone || !it.audioDone || it.chars == 0 || it.audioMs <= 0 {
+		return
+	}
+	it.measured = true
+	rate := float64(it.audioMs) / float64(it.chars)
+	e.msPerChar += speechRateWeight * (rate - e.msPerChar)
+}
+
+// estimate returns the estimate to send for itemID at now, of which receivedMs were received from
+// the provider and sentMs sent to the device. ok is false when no estimate is due: estimates are
+// sent at most every speech_estimate.interval, except for the item's final one.
+func (e *speechEstimator) estimate(now time.Time, itemID string, receivedMs, sentMs int64) (event speechEstimateEvent, ok bool) {
+	if e == nil || itemID == "" {
+		return speechEstimateEvent{}, false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	it := e.item(itemID)
+	if it.chars == 0 && !it.audioDone {
+		return speechEstimateEvent{}, false
+	}
+	if it.sentFinal || (!it.audioDone && !it.sentAt.IsZero() && now.Sub(it.sentAt) < e.interval) {
+		return speechEstimateEvent{}, false
+	}
+	total := max(int64(float64(it.chars)*e.msPerChar), receivedMs)
+	if it.audioDone {
+		// audio may still be on its way from the provider when it reports the item done
+		total = max(it.audioMs, receivedMs)
+	}
+	it.sentAt = now
+	it.sentFinal = it.audioDone
+	return speechEstimateEvent{
+		Type:        SpeechEstimateEvent,
+		ItemID:      itemID,
+		TotalMs:     total,
+		RemainingMs: max(total-sentMs, 0),
+		Final:       it.audioDone,
+	}, true
+}
+
+// sendSpeechEstimate sends the device an estimate of the current answer, when one is due
+func (h *Handler) sendSpeechEstimate(session *Session) {
+	status := session.Cursor.Status()
+	event, ok := session.speech.estimate(session.clock.Now(), status.ItemID, session.Cursor.ReceivedMs(status.ItemID), status.SentMs)
+	if !ok {
+		return
+	}
+	if err := session.Client.Send(event); err != nil {
+		session.Client.logger.Error("Could not send speech estimate to client", "error", err)
+	}
+}
@@ -0,0 +1,174 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// TagsHeader carries the tags a device attaches to its session, as comma separated key=value
+// pairs, e.g. "campaign=summer,store=17". The tags query parameter takes the same format.
+const TagsHeader = "X-Pixa-Tags"
+
+// Limits on session tags, which end up in records and, for configured keys, metric labels
+const (
+	maxTags     = 16
+	maxTagKey   = 32
+	maxTagValue = 64
+)
+
+// WithTags returns a copy of ctx carrying tags for the session, on top of the tags already
+// attached. An OnConnect middleware can use it to tag sessions, e.g. with an experiment variant;
+// these tags take precedence over the ones the device sends.
+func WithTags(ctx context.Context, tags map[string]string) context.Context {
+	merged := TagsFromContext(ctx)
+	if merged == nil {
+		merged = make(map[string]string, len(tags))
+	}
+	maps.Copy(merged, tags)
+	return context.WithValue(ctx, tagsKey, merged)
+}
+
+// TagsFromContext returns a copy of the tags attached with WithTags
+func TagsFromContext(ctx context.Context) map[string]string {
+	tags, _ := ctx.Value(tagsKey).(map[string]string)
+	return maps.Clone(tags)
+}
+
+// ParseTags reads tags in the format of the tags header
+func ParseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("tag %q is not key=value", pair)
+		}
+		tags[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// validateTag reports whether a tag can be attached to a session. Keys are lower case letters,
+// digits and underscores.
+func validateTag(key, value string) error {
+	if key == "" || len(key) > maxTagKey || strings.TrimLeft(key, "abcdefghijklmnopqrstuvwxyz0123456789_") != "" {
+		return fmt.Errorf("invalid tag key %q", key)
+	}
+	if len(value) > maxTagValue {
+		return fmt.Errorf("value of tag %s is longer than %d bytes", key, maxTagValue)
+	}
+	return nil
+}
+
+// requestTags returns the tags a connection request attaches to its session: the device's, from
+// the tags header or else the tags query parameter, overridden by the tags attached to the request
+// context. Invalid tags are left out and reported.
+func requestTags(r *http.Request) (map[string]string, []error) {
+	raw := r.Header.Get(TagsHeader)
+	if raw == "" {
+		raw = r.URL.Query().Get("tags")
+	}
+	var errs []error
+	tags, err := ParseTags(raw)
+	if err != nil {
+		errs = append(errs, err)
+		tags = make(map[string]string)
+	}
+	maps.Copy(tags, TagsFromContext(r.Context()))
+
+	for key, value := range tags {
+		if err := validateTag(key, value); err != nil {
+			errs = append(errs, err)
+			delete(tags, key)
+		}
+	}
+	if len(tags) > maxTags {
+		for _, key := range slices.Sorted(maps.Keys(tags))[maxTags:] {
+			errs = append(errs, fmt.Errorf("more than %d tags, dropping %s", maxTags, key))
+			delete(tags, key)
+		}
+	}
+	return tags, errs
+}
+
+// sessionTags are the tags of a session
+type sessionTags struct {
+	mu   sync.Mutex
+	tags map[string]string
+}
+
+// Tags returns a copy of the session's tags
+func (s *Session) Tags() map[string]string {
+	s.tags.mu.Lock()
+	defer s.tags.mu.Unlock()
+	return maps.Clone(s.tags.tags)
+}
+
+// SetTag tags the session, e.g. from a server hook once more is known about it. Tags set once the
+// session has started are kept in its record but not counted in metrics.
+func (s *Session) SetTag(key, value string) error {
+	if err := validateTag(key, value); err != nil {
+		return err
+	}
+	s.tags.mu.Lock()
+	defer s.tags.mu.Unlock()
+	if _, ok := s.tags.tags[key]; !ok && len(s.tags.tags) >= maxTags {
+		return fmt.Errorf("session already has %d tags", maxTags)
+	}
+	if s.tags.tags == nil {
+		s.tags.tags = make(map[string]string)
+	}
+	s.tags.tags[key] = value
+	return nil
+}
+
+// OtherTagValue replaces the values of metric tags beyond tags.max_label_values
+const OtherTagValue = "other"
+
+// tagLabels bounds the values of session tags used as metric labels: the values of each key
+// seen first are kept, later ones are counted as OtherTagValue
+type tagLabels struct {
+	keys      []string
+	maxValues int
+
+	mu   sync.Mutex
+	seen map[string]map[string]bool
+}
+
+func newTagLabels(cfg config.TagsConfig) *tagLabels {
+	return &tagLabels{keys: cfg.MetricLabels, maxValues: cfg.MaxLabelValues, seen: make(map[string]map[string]bool)}
+}
+
+// labels returns the metric label value of each configured key the tags have
+func (l *tagLabels) labels(tags map[string]string) map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make(map[string]string)
+	for _, key := range l.keys {
+		value, ok := tags[key]
+		if !ok {
+			continue
+		}
+		seen := l.seen[key]
+		if seen == nil {
+			seen = make(map[string]bool)
+			l.seen[key] = seen
+		}
+		if !seen[value] && l.maxValues > 0 && len(seen) >= l.maxValues {
+			value = OtherTagValue
+		} else {
+			seen[value] = true
+		}
+		out[key] = value
+	}
+	return out
+}
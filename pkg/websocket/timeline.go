@@ -0,0 +1,91 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+// timeline places the turns of a session's transcript in the session, so they can be subtitled.
+// User turns span the user's speech, assistant turns the audio of their sentences as relayed. It is
+// guarded by the session's transcriptMu.
+type timeline struct {
+	speechStart time.Time
+	speechEnd   time.Time
+	// itemStarts is when the first audio of each assistant item not yet in the transcript was received
+	itemStarts map[string]time.Time
+	// sentences are the sentences of assistant items not yet in the transcript
+	sentences map[string][]store.Sentence
+}
+
+// sinceStart returns t in ms since the session started
+func (s *Session) sinceStart(t time.Time) int64 {
+	return t.Sub(s.StartedAt).Milliseconds()
+}
+
+// speechStarted records that the user started speaking
+func (s *Session) speechStarted(t time.Time) {
+	s.transcriptMu.Lock()
+	s.timeline.speechStart, s.timeline.speechEnd = t, time.Time{}
+	s.transcriptMu.Unlock()
+}
+
+// speechStopped records that the user stopped speaking
+func (s *Session) speechStopped(t time.Time) {
+	s.transcriptMu.Lock()
+	s.timeline.speechEnd = t
+	s.transcriptMu.Unlock()
+}
+
+// itemAudioStarted records when the first audio of an assistant item was received
+func (s *Session) itemAudioStarted(itemID string, t time.Time) {
+	s.transcriptMu.Lock()
+	defer s.transcriptMu.Unlock()
+	if s.timeline.itemStarts == nil {
+		s.timeline.itemStarts = make(map[string]time.Time)
+	}
+	if _, ok := s.timeline.itemStarts[itemID]; !ok {
+		s.timeline.itemStarts[itemID] = t
+	}
+}
+
+// noteSentences keeps the timing of completed sentences for the transcript, before they are
+// translated
+func (s *Session) noteSentences(events []sentenceCompletedEvent) {
+	s.transcriptMu.Lock()
+	defer s.transcriptMu.Unlock()
+	if s.timeline.sentences == nil {
+		s.timeline.sentences = make(map[string][]store.Sentence)
+	}
+	for _, e := range events {
+		start, ok := s.timeline.itemStarts[e.ItemID]
+		if !ok {
+			start = s.clock.Now().Add(-time.Duration(e.AudioEndMs) * time.Millisecond)
+		}
+		offset := s.sinceStart(start)
+		s.timeline.sentences[e.ItemID] = append(s.timeline.sentences[e.ItemID], store.Sentence{
+			Text:    e.Text,
+			StartMs: offset + e.AudioStartMs,
+			EndMs:   offset + e.AudioEndMs,
+		})
+	}
+}
+
+// place sets the timing of a turn about to be added to the transcript
+func (s *Session) place(turn *store.Turn) {
+	t := &s.timeline
+	switch turn.Role {
+	case store.UserRole:
+		if !t.speechStart.IsZero() && !t.speechEnd.Before(t.speechStart) {
+			turn.StartMs, turn.EndMs = s.sinceStart(t.speechStart), s.sinceStart(t.speechEnd)
+		}
+		t.speechStart, t.speechEnd = time.Time{}, time.Time{}
+	case store.AssistantRole:
+		if sentences := t.sentences[turn.ItemID]; len(sentences) > 0 {
+			turn.Sentences = sentences
+			turn.StartMs, turn.EndMs = sentences[0].StartMs, sentences[len(sentences)-1].EndMs
+		}
+		delete(t.sentences, turn.ItemID)
+		delete(t.itemStarts, turn.ItemID)
+	}
+}
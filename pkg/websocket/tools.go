@@ -0,0 +1,122 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/ai"
+	"github.com/pixaverse-studios/websocket-server/pkg/tools"
+)
+
+// Outcomes of tool calls
+const (
+	ToolOK      = "ok"
+	ToolError   = "error"
+	ToolTimeout = "timeout"
+	ToolUnknown = "unknown"
+	// ToolUnverified calls were refused as the tool is protected and the speaker not verified
+	ToolUnverified = "unverified"
+)
+
+// toolDefinitions describes the registered tools to the provider
+func (h *Handler) toolDefinitions() []ai.ToolDefinition {
+	if h.tools == nil {
+		return nil
+	}
+	list := h.tools.List()
+	defs := make([]ai.ToolDefinition, len(list))
+	for i, t := range list {
+		defs[i] = ai.ToolDefinition{Name: t.Name, Description: t.Description, Parameters: t.Parameters}
+	}
+	return defs
+}
+
+// toolResult is what a tool call returned
+type toolResult struct {
+	output string
+	err    error
+}
+
+// runTool runs a tool the model called and gives it the result. If the call is slow, the model is
+// first asked to tell the user it is working on it, so the device does not sit in silence; the
+// provider holds the result back until that announcement is done.
+func (h *Handler) runTool(ctx context.Context, session *Session, aiClient ai.AIClient, call ai.FunctionCall) {
+	caller, ok := aiClient.(ai.ToolCaller)
+	if !ok {
+		return
+	}
+	logger := session.Client.logger.With("tool", call.Name, "call_id", call.CallID)
+
+	var result toolResult
+	var tool tools.Tool
+	if h.tools != nil {
+		tool, ok = h.tools.Get(call.Name)
+	}
+	if h.tools == nil || !ok {
+		result.err = errors.New("unknown tool")
+		h.metrics.toolCall(call.Name, ToolUnknown)
+	} else if h.protectedTool(session, call.Name) {
+		result.err = errors.New("the speaker must be verified to use this tool")
+		h.metrics.toolCall(call.Name, ToolUnverified)
+	} else {
+		result = h.callTool(ctx, session, caller, logger, tool, call)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	output := result.output
+	if result.err != nil {
+		logger.Warn("Tool call failed", "error", result.err)
+		b, _ := json.Marshal(map[string]string{"error": result.err.Error()})
+		output = string(b)
+	}
+	if err := caller.SendToolResult(ctx, call.CallID, output); err != nil {
+		logger.Error("Could not send tool result", "error", err)
+	}
+}
+
+// callTool runs a registered tool within the tool timeout, announcing it if it is slow
+func (h *Handler) callTool(ctx context.Context, session *Session, caller ai.ToolCaller, logger *slog.Logger, tool tools.Tool, call ai.FunctionCall) toolResult {
+	callCtx, cancel := ctx, context.CancelFunc(func() {})
+	if h.toolTimeout > 0 {
+		callCtx, cancel = context.WithTimeout(ctx, h.toolTimeout)
+	}
+	defer cancel()
+
+	done := make(chan toolResult, 1)
+	go func() {
+		output, err := tool.Run(callCtx, json.RawMessage(call.Arguments))
+		done <- toolResult{output, err}
+	}()
+
+	var slow <-chan time.Time
+	if h.toolSlowAfter > 0 {
+		slow = session.clock.After(h.toolSlowAfter)
+	}
+	for {
+		select {
+		case r := <-done:
+			outcome := ToolOK
+			if r.err != nil {
+				outcome = ToolError
+			}
+			h.metrics.toolCall(call.Name, outcome)
+			return r
+		case <-slow:
+			slow = nil
+			h.metrics.toolAnnounced(call.Name)
+			if err := caller.Announce(ctx, h.toolInstructions); err != nil {
+				logger.Error("Could not announce slow tool call", "error", err)
+			}
+		case <-callCtx.Done():
+			if ctx.Err() == nil {
+				h.metrics.toolCall(call.Name, ToolTimeout)
+			}
+			return toolResult{err: errors.New("tool call timed out")}
+		}
+	}
+}
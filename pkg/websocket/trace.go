@@ -0,0 +1,76 @@
+package websocket
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/gorilla/websocket"
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/trace"
+)
+
+// startTrace opens the wire trace of a session when its device is traced. A trace that cannot be
+// opened is logged and the session goes on untraced.
+func (h *Handler) startTrace(session *Session) {
+	cfg := h.config.Trace
+	if !cfg.Enabled || (len(cfg.Devices) > 0 && !slices.Contains(cfg.Devices, session.DeviceID)) {
+		return
+	}
+	// the traces of tenants pinned to a region are kept in the region
+	dir := h.config.TraceDirFor(session.TenantID)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		session.Client.logger.Error("Could not create trace directory", "error", err)
+		return
+	}
+	path := filepath.Join(dir, session.ID+".pxtrace")
+	f, err := os.Create(path)
+	if err != nil {
+		session.Client.logger.Error("Could not create session trace", "error", err)
+		return
+	}
+	w, err := trace.NewWriter(f, trace.Header{
+		SessionID: session.ID,
+		DeviceID:  session.DeviceID,
+		StartedAt: session.StartedAt,
+		Audio:     cfg.Audio,
+	})
+	if err != nil {
+		f.Close()
+		session.Client.logger.Error("Could not write session trace", "error", err)
+		return
+	}
+	session.Client.trace = w
+	session.Client.logger.Info("Tracing session", "path", path, "audio", cfg.Audio)
+}
+
+// stopTrace closes the wire trace of a session once its connection is closed
+func (h *Handler) stopTrace(session *Session) {
+	if w := session.Client.trace; w != nil {
+		if err := w.Close(); err != nil {
+			session.Client.logger.Error("Session trace incomplete", "error", err)
+		}
+	}
+}
+
+// traceFrame records a frame in the client's wire trace, if it is traced. Write errors are
+// reported when the trace is closed.
+func (c *Client) traceFrame(dir trace.Direction, messageType int, data []byte) {
+	if c.trace == nil {
+		return
+	}
+	clk := c.clock
+	if clk == nil {
+		clk = clock.Real()
+	}
+	c.trace.Write(clk.Now(), dir, trace.Opcode(messageType), data)
+}
+
+// traceReadError records the close frame of a device that closed the connection
+func (c *Client) traceReadError(err error) {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		c.traceFrame(trace.FromDevice, websocket.CloseMessage, websocket.FormatCloseMessage(closeErr.Code, closeErr.Text))
+	}
+}
@@ -0,0 +1,114 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DisplayLanguageHeader carries the language a device displays captions in, as a BCP 47 tag
+	// such as "de" or "pt-BR". Devices that cannot set headers use the display_language query
+	// parameter.
+	DisplayLanguageHeader = "X-Pixa-Display-Language"
+
+	// captionQueue is how many batches of sentences may wait for translation before the AI events
+	// of the session wait for them
+	captionQueue = 32
+)
+
+// Outcomes of caption translations
+const (
+	TranslationOK      = "ok"
+	TranslationError   = "error"
+	TranslationTimeout = "timeout"
+)
+
+// Translator translates the assistant's captions for devices that display another language than
+// the one spoken, such as multilingual signage. from is the language the tenant's speech is
+// transcribed in, empty when it is detected, and to the device's display language.
+type Translator interface {
+	Translate(ctx context.Context, text, from, to string) (string, error)
+}
+
+// TranslatorFunc adapts a function to the Translator interface
+type TranslatorFunc func(ctx context.Context, text, from, to string) (string, error)
+
+// Translate calls f
+func (f TranslatorFunc) Translate(ctx context.Context, text, from, to string) (string, error) {
+	return f(ctx, text, from, to)
+}
+
+// WithTranslator translates the sentences of the assistant's transcript into the display language
+// of devices that report one before they are sent. By default captions are sent as spoken.
+func WithTranslator(t Translator) Option {
+	return func(h *Handler) {
+		h.translator = t
+	}
+}
+
+// displayLanguage returns the display language the device reported, if any
+func displayLanguage(r *http.Request) string {
+	return strings.TrimSpace(headerOrQuery(r, DisplayLanguageHeader, "display_language"))
+}
+
+// sameLanguage reports whether two language tags name the same language, regardless of region
+func sameLanguage(a, b string) bool {
+	primary := func(tag string) string {
+		tag, _, _ = strings.Cut(strings.ReplaceAll(tag, "_", "-"), "-")
+		return strings.ToLower(tag)
+	}
+	return primary(a) == primary(b)
+}
+
+// startCaptions starts translating the session's captions if the device displays another language
+// than the one its tenant speaks. Sentences are translated in order on a goroutine of their own, so
+// a slow translator delays captions but not the reactions to the provider's events.
+func (h *Handler) startCaptions(ctx context.Context, session *Session, language string) {
+	spoken := h.config.TranscriptionFor(session.TenantID).Language
+	if h.translator == nil || language == "" || (spoken != "" && sameLanguage(spoken, language)) {
+		return
+	}
+	captions := make(chan []sentenceCompletedEvent, captionQueue)
+	session.captions = captions
+	timeout, _ := time.ParseDuration(h.config.Translation.Timeout)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case events := <-captions:
+				for i := range events {
+					h.translateCaption(ctx, session, &events[i], spoken, language, timeout)
+				}
+				h.writeSentences(session, events)
+			}
+		}
+	}()
+}
+
+// translateCaption replaces the text of a sentence with its translation. The sentence is left as
+// spoken if the translation fails or takes longer than timeout.
+func (h *Handler) translateCaption(ctx context.Context, session *Session, e *sentenceCompletedEvent, from, to string, timeout time.Duration) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	text, err := h.translator.Translate(ctx, e.Text, from, to)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		h.metrics.captionTranslated(TranslationTimeout)
+		session.Client.logger.Warn("Caption translation timed out, sending it as spoken", "item_id", e.ItemID, "display_language", to, "timeout", timeout)
+	case err != nil:
+		h.metrics.captionTranslated(TranslationError)
+		session.Client.logger.Warn("Could not translate caption, sending it as spoken", "item_id", e.ItemID, "display_language", to, "error", err)
+	default:
+		h.metrics.captionTranslated(TranslationOK)
+		e.OriginalText = e.Text
+		e.Text = text
+		e.Language = to
+	}
+}
@@ -0,0 +1,254 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+// Outcomes of turn processors; TurnDropped is a turn not processed because the session's queue
+// was full
+const (
+	TurnProcessed = "ok"
+	TurnError     = "error"
+	TurnTimeout   = "timeout"
+	TurnPanic     = "panic"
+	TurnDropped   = "dropped"
+)
+
+// defaultTurnQueue is how many turns of a session may wait for the processors when
+// turn_processors.queue is not set
+const defaultTurnQueue = 16
+
+// CompletedTurn is an assistant turn whose transcript is complete, as handed to turn processors
+type CompletedTurn struct {
+	SessionID string
+	DeviceID  string
+	TenantID  string
+	Tags      map[string]string
+	// Turn is the assistant's turn as kept in the session's transcript, with its sentences
+	Turn store.Turn
+	// UserTurn is the user's turn the assistant answered, nil for turns the assistant started,
+	// such as greetings
+	UserTurn *store.Turn
+	// Audio refers to the audio the turn was spoken in
+	Audio TurnAudio
+}
+
+// TurnAudio refers to the audio of an assistant turn
+type TurnAudio struct {
+	// ItemID is the provider's item of the audio, as in session.status cursors and interruptions
+	ItemID string
+	// Cached is set for answers replayed from the FAQ cache rather than spoken by the provider
+	Cached bool
+	// StartMs and EndMs place the audio on the session's timeline, from the session start, as in
+	// session records and subtitles; both are 0 when its sentences were not timed
+	StartMs int64
+	EndMs   int64
+	// SampleRate and Codec are the format the audio was sent to the device in
+	SampleRate int
+	Codec      string
+}
+
+// TurnProcessor runs after every completed assistant turn, such as to log the conversation to a
+// CRM, moderate answers or emit metrics of its own. The turns of a session are processed in order
+// on a goroutine of the session, so processors do not delay the conversation.
+type TurnProcessor interface {
+	ProcessTurn(ctx context.Context, turn CompletedTurn) error
+}
+
+// TurnProcessorFunc adapts a function to the TurnProcessor interface
+type TurnProcessorFunc func(ctx context.Context, turn CompletedTurn) error
+
+// ProcessTurn calls f
+func (f TurnProcessorFunc) ProcessTurn(ctx context.Context, turn CompletedTurn) error {
+	return f(ctx, turn)
+}
+
+// WithTurnProcessors runs the given processors, in order, after every completed assistant turn of
+// every session. By default turns are not processed.
+func WithTurnProcessors(p ...TurnProcessor) Option {
+	return func(h *Handler) {
+		h.turnProcessors = append(h.turnProcessors, p...)
+	}
+}
+
+// AddTurnProcessor runs p after the handler's processors for the turns of this session completed
+// from now on
+func (s *Session) AddTurnProcessor(p TurnProcessor) {
+	if s.turns == nil {
+		return
+	}
+	s.turns.mu.Lock()
+	s.turns.processors = append(s.turns.processors, p)
+	s.turns.mu.Unlock()
+}
+
+// panicError is a turn processor that panicked
+type panicError struct {
+	value any
+}
+
+func (e panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// turnChain runs the turn processors of a session. Each processor runs on its own goroutine for
+// up to turn_processors.timeout, and the chain goes on without it when it fails, panics or is
+// late, so one processor cannot hold up or break the others. A nil *turnChain processes nothing.
+type turnChain struct {
+	timeout time.Duration
+	metrics *handlerMetrics
+	logger  *slog.Logger
+	queue   chan CompletedTurn
+
+	mu         sync.Mutex
+	processors []TurnProcessor
+}
+
+// startTurnProcessors starts processing the completed turns of the session. Turns still queued when
+// the session ends are processed, so the last answer of a session is not lost.
+func (h *Handler) startTurnProcessors(ctx context.Context, session *Session) {
+	timeout, _ := time.ParseDuration(h.config.TurnProcessors.Timeout)
+	queue := h.config.TurnProcessors.Queue
+	if queue <= 0 {
+		queue = defaultTurnQueue
+	}
+	c := &turnChain{
+		timeout:    timeout,
+		metrics:    h.metrics,
+		logger:     session.Client.logger,
+		queue:      make(chan CompletedTurn, queue),
+		processors: slices.Clone(h.turnProcessors),
+	}
+	session.turns = c
+	detached := context.WithoutCancel(ctx)
+	go func() {
+		for {
+			select {
+			case turn := <-c.queue:
+				c.process(detached, turn)
+			case <-ctx.Done():
+				for {
+					select {
+					case turn := <-c.queue:
+						c.process(detached, turn)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// completed queues a completed assistant turn of the session for the processors
+func (c *turnChain) completed(s *Session, turn store.Turn) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	none := len(c.processors) == 0
+	c.mu.Unlock()
+	if none {
+		return
+	}
+	select {
+	case c.queue <- s.completedTurn(turn):
+	default:
+		c.metrics.turnProcessed(TurnDropped)
+		c.logger.Warn("Turn processors are behind, not processing turn", "item_id", turn.ItemID)
+	}
+}
+
+// completedTurn describes an assistant turn of the session for the processors
+func (s *Session) completedTurn(turn store.Turn) CompletedTurn {
+	turn.Sentences = slices.Clone(turn.Sentences)
+	t := CompletedTurn{
+		SessionID: s.ID,
+		DeviceID:  s.DeviceID,
+		TenantID:  s.TenantID,
+		Tags:      s.Tags(),
+		Turn:      turn,
+		Audio: TurnAudio{
+			ItemID:     turn.ItemID,
+			Cached:     strings.HasPrefix(turn.ItemID, faqItemPrefix),
+			StartMs:    turn.StartMs,
+			EndMs:      turn.EndMs,
+			SampleRate: s.DownlinkSampleRate(),
+			Codec:      s.downlinkCodec,
+		},
+	}
+	s.transcriptMu.Lock()
+	defer s.transcriptMu.Unlock()
+	// the user's turn answered is the last one before the answer, unless the assistant spoke since
+	for i := len(s.transcript) - 1; i >= 0; i-- {
+		prev := s.transcript[i]
+		if prev.ItemID == turn.ItemID && prev.Role == turn.Role {
+			continue
+		}
+		if prev.Role == store.UserRole {
+			prev.Metadata = maps.Clone(prev.Metadata)
+			t.UserTurn = &prev
+		}
+		break
+	}
+	return t
+}
+
+// process runs the processors on a turn, in order
+func (c *turnChain) process(ctx context.Context, turn CompletedTurn) {
+	c.mu.Lock()
+	processors := slices.Clone(c.processors)
+	c.mu.Unlock()
+	for i, p := range processors {
+		err := c.run(ctx, p, turn)
+		var panicked panicError
+		switch {
+		case err == nil:
+			c.metrics.turnProcessed(TurnProcessed)
+		case errors.Is(err, context.DeadlineExceeded):
+			c.metrics.turnProcessed(TurnTimeout)
+			c.logger.Warn("Turn processor timed out", "processor", i, "item_id", turn.Turn.ItemID, "timeout", c.timeout)
+		case errors.As(err, &panicked):
+			c.metrics.turnProcessed(TurnPanic)
+			c.logger.Error("Turn processor panicked", "processor", i, "item_id", turn.Turn.ItemID, "error", err)
+		default:
+			c.metrics.turnProcessed(TurnError)
+			c.logger.Warn("Turn processor failed", "processor", i, "item_id", turn.Turn.ItemID, "error", err)
+		}
+	}
+}
+
+// run runs a processor on a turn, giving up on it once the timeout is over, even if it does not
+// return
+func (c *turnChain) run(ctx context.Context, p TurnProcessor, turn CompletedTurn) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- panicError{r}
+			}
+		}()
+		done <- p.ProcessTurn(ctx, turn)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,107 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+// vadFloorRise is how fast the noise floor of the gate rises with louder audio, in dB per second,
+// so it follows noise that sets in, such as a fan, without taking a sentence for noise
+const vadFloorRise = 2
+
+// vadGate only lets the audio of a session through while the user speaks. Frames are taken as
+// speech when they are threshold above the noise floor, and not quieter than minLevel; the floor
+// drops to the quietest audio heard and rises slowly with louder audio. Once speech is detected,
+// audio goes through until none was heard for hangover, and the preRoll of audio held back before
+// it goes along with it. It is only used by the session's read pump. A nil *vadGate lets everything
+// through.
+type vadGate struct {
+	threshold float64
+	minLevel  float64
+	// preRoll and hangover are in bytes of the session's audio, and bytesPerSecond converts them
+	preRoll        int
+	hangover       int
+	bytesPerSecond int
+
+	floor float64
+	heard bool
+	open  bool
+	// silent is how much audio went through since speech was last detected, and held the audio
+	// of the pre-roll while the gate is shut
+	silent int
+	held   []byte
+}
+
+// newVADGate returns the gate of a session whose device sends audio at sampleRate with the given
+// endpointing, or nil if its audio is not gated
+func newVADGate(cfg *config.Config, e config.EndpointingConfig, pushToTalk bool, sampleRate int) *vadGate {
+	g := cfg.VADGate
+	if !g.Enabled || pushToTalk || sampleRate <= 0 {
+		return nil
+	}
+	hangover, _ := time.ParseDuration(g.Hangover)
+	if g.Hangover == "" {
+		silence, _ := time.ParseDuration(e.SilenceDuration)
+		hangover = silence + utteranceCapMargin
+	}
+	preRoll, _ := time.ParseDuration(g.PreRoll)
+	frame := 2 * max(cfg.Audio.Channels, 1)
+	bytesPerSecond := sampleRate * frame
+	return &vadGate{
+		threshold:      g.Threshold,
+		minLevel:       g.MinLevel,
+		preRoll:        int(preRoll.Seconds()*float64(sampleRate)) * frame,
+		hangover:       int(hangover.Seconds()*float64(sampleRate)) * frame,
+		bytesPerSecond: bytesPerSecond,
+	}
+}
+
+// pass returns the audio to send the provider for a frame: nothing while the gate is shut, the
+// frame while it is open, or the pre-roll and the frame when speech opens it. dropped is how much
+// pre-roll audio fell out of it meanwhile, never to be sent.
+func (g *vadGate) pass(pcm []byte) (out []byte, dropped time.Duration) {
+	if g == nil {
+		return pcm, 0
+	}
+	level := toDBFS(rms(pcm))
+	// the first frame gives the floor, which drops to the quiet between words if it was speech
+	speech := g.heard && level >= g.minLevel && level >= g.floor+g.threshold
+	if !g.heard || level < g.floor {
+		g.floor, g.heard = level, true
+	} else {
+		rise := vadFloorRise * float64(len(pcm)) / float64(g.bytesPerSecond)
+		g.floor = min(level, g.floor+rise)
+	}
+
+	if speech {
+		g.silent = 0
+	} else {
+		g.silent += len(pcm)
+	}
+	switch {
+	case speech && !g.open:
+		g.open = true
+		out, g.held = append(g.held, pcm...), nil
+		return out, 0
+	case g.open && g.silent <= g.hangover:
+		return pcm, 0
+	}
+	g.open = false
+	g.held = append(g.held, pcm...)
+	if over := len(g.held) - g.preRoll; over > 0 {
+		g.held = append(g.held[:0], g.held[over:]...)
+		dropped = time.Duration(over) * time.Second / time.Duration(g.bytesPerSecond)
+	}
+	return nil, dropped
+}
+
+// gateSpeech passes a frame of the session's audio through its voice activity gate, counting the
+// audio the provider is never sent
+func (h *Handler) gateSpeech(session *Session, pcm []byte) []byte {
+	out, dropped := session.vad.pass(pcm)
+	if dropped > 0 {
+		h.metrics.vadGated(dropped)
+	}
+	return out
+}
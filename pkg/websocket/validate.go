@@ -0,0 +1,200 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Codes of control.error events
+const (
+	controlInvalidJSON        = "invalid_json"
+	controlUnknownType        = "unknown_type"
+	controlUnsupportedVersion = "unsupported_version"
+	controlMissingField       = "missing_field"
+	controlInvalidType        = "invalid_type"
+	controlInvalidValue       = "invalid_value"
+)
+
+// fieldKind is what a field of a control message holds
+type fieldKind int
+
+const (
+	stringField fieldKind = iota
+	intField
+	int64Field
+	boolField
+	// bytesField is a base64 encoded string
+	bytesField
+	// mapField is an object of strings
+	mapField
+)
+
+// expected names the JSON values of a kind, as control.error events report them
+func (k fieldKind) expected() string {
+	switch k {
+	case intField, int64Field:
+		return "integer"
+	case boolField:
+		return "boolean"
+	case bytesField:
+		return "base64 string"
+	case mapField:
+		return "object of strings"
+	}
+	return "string"
+}
+
+// messageSchema is the schema of a control message sent by the device, generated from
+// protocol/protocol.schema.json into deviceSchemas
+type messageSchema struct {
+	// since is the protocol version the message was introduced in
+	since  int
+	fields []fieldSchema
+}
+
+type fieldSchema struct {
+	name     string
+	kind     fieldKind
+	required bool
+	// since is the protocol version the field was introduced in; devices speaking an older
+	// version need not send it even when it is required
+	since int
+	enum  []string
+}
+
+// validateControl checks a control message against the schema of the protocol version the device
+// speaks. It returns the control.error event telling the device what is wrong with the first value
+// at fault, or nil for a valid message. Fields the schema does not know are left alone, so devices
+// can send the fields of later versions.
+func validateControl(data []byte, version int) *controlErrorEvent {
+	invalid := func(msgType, code, path, expected, reason string) *controlErrorEvent {
+		return &controlErrorEvent{
+			Type:            ControlErrorEvent,
+			MessageType:     msgType,
+			Code:            code,
+			Path:            path,
+			Expected:        expected,
+			ProtocolVersion: version,
+			Reason:          reason,
+		}
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+		return invalid("", controlInvalidJSON, "", "object", "control messages must be JSON objects")
+	}
+	var msgType string
+	switch raw, ok := fields["type"]; {
+	case !ok || isNull(raw):
+		return invalid("", controlMissingField, "/type", "string", "type is missing")
+	case json.Unmarshal(raw, &msgType) != nil:
+		return invalid("", controlInvalidType, "/type", "string", "type: expected string")
+	}
+	schema, ok := deviceSchemas[msgType]
+	if !ok {
+		return invalid(msgType, controlUnknownType, "/type", "", fmt.Sprintf("unknown message type %q", msgType))
+	}
+	if schema.since > version {
+		return invalid(msgType, controlUnsupportedVersion, "/type", fmt.Sprintf("protocol version %d", schema.since),
+			fmt.Sprintf("%s needs protocol version %d, the session speaks %d", msgType, schema.since, version))
+	}
+
+	for _, f := range schema.fields {
+		path := "/" + pointerToken(f.name)
+		raw, ok := fields[f.name]
+		if !ok || isNull(raw) {
+			if f.required && f.since <= version {
+				return invalid(msgType, controlMissingField, path, f.kind.expected(), f.name+" is missing")
+			}
+			continue
+		}
+		if code, within, expected, reason := checkField(f, raw); code != "" {
+			return invalid(msgType, code, path+within, expected, reason)
+		}
+	}
+	return nil
+}
+
+// checkField checks the value of a field against its schema. within is the path of the value at
+// fault inside the field, such as the key of an object of strings holding another value.
+func checkField(f fieldSchema, raw json.RawMessage) (code, within, expected, reason string) {
+	mistyped := func() (string, string, string, string) {
+		return controlInvalidType, "", f.kind.expected(), fmt.Sprintf("%s: expected %s", f.name, f.kind.expected())
+	}
+	switch f.kind {
+	case stringField:
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			return mistyped()
+		}
+		if len(f.enum) > 0 && !slices.Contains(f.enum, s) {
+			values := "one of " + strings.Join(f.enum, ", ")
+			return controlInvalidValue, "", values, fmt.Sprintf("%s: expected %s, got %q", f.name, values, s)
+		}
+	case intField, int64Field:
+		if raw[0] != '-' && (raw[0] < '0' || raw[0] > '9') {
+			return mistyped()
+		}
+		bits := 64
+		if f.kind == intField {
+			bits = 32
+		}
+		if _, err := strconv.ParseInt(string(raw), 10, bits); err != nil {
+			expected := fmt.Sprintf("%d bit integer", bits)
+			return controlInvalidValue, "", expected, fmt.Sprintf("%s: expected %s, got %s", f.name, expected, raw)
+		}
+	case boolField:
+		if !bytes.Equal(raw, []byte("true")) && !bytes.Equal(raw, []byte("false")) {
+			return mistyped()
+		}
+	case bytesField:
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			return mistyped()
+		}
+		if _, err := base64.StdEncoding.DecodeString(s); err != nil {
+			return controlInvalidValue, "", f.kind.expected(), fmt.Sprintf("%s: expected %s", f.name, f.kind.expected())
+		}
+	case mapField:
+		var values map[string]json.RawMessage
+		if raw[0] != '{' || json.Unmarshal(raw, &values) != nil {
+			return mistyped()
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			if v := values[key]; len(v) == 0 || v[0] != '"' {
+				return controlInvalidType, "/" + pointerToken(key), "string", fmt.Sprintf("%s.%s: expected string", f.name, key)
+			}
+		}
+	}
+	return "", "", "", ""
+}
+
+func isNull(raw json.RawMessage) bool {
+	return bytes.Equal(raw, []byte("null"))
+}
+
+// pointerToken escapes a name for a JSON pointer (RFC 6901)
+func pointerToken(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
+
+// rejectControl tells the device a control message it sent was ignored for not following the
+// schema, so firmware developers see what to fix instead of the message silently doing nothing
+func (h *Handler) rejectControl(session *Session, event *controlErrorEvent) {
+	session.Client.logger.Warn("Ignoring invalid control message",
+		"type", event.MessageType, "code", event.Code, "path", event.Path, "reason", event.Reason)
+	h.metrics.controlError(event.Code)
+	if err := session.Client.Send(event); err != nil {
+		session.Client.logger.Error("Could not send control error", "error", err)
+	}
+}
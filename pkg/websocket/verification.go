@@ -0,0 +1,122 @@
+package websocket
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+)
+
+// Results of speaker verifications, as counted in pixa_speaker_verifications_total
+const (
+	SpeakerVerified = "verified"
+	SpeakerRejected = "rejected"
+	// SpeakerVerifyError verifications failed, and the speaker stays unverified
+	SpeakerVerifyError = "error"
+)
+
+// SpeakerMatch is how closely the user's voice matches the speaker a session is for
+type SpeakerMatch struct {
+	// SpeakerID identifies the enrolled speaker matched, when the verifier tells
+	SpeakerID string
+	// Score is how closely the voice matches, between 0 and 1
+	Score float64
+}
+
+// SpeakerVerifier checks that the user of a session is the speaker it is for, such as by comparing
+// their voice with the voice print an external service enrolled for the device's account, or with
+// a local model. pcm is speaker_verification.sample of the user's speech, in 16 bit PCM of the
+// given format. ctx carries the claims of the session's token, see TokenClaimsFromContext, for
+// verifiers matching the speaker the token names.
+type SpeakerVerifier interface {
+	VerifySpeaker(ctx context.Context, deviceID, tenantID string, pcm []byte, sampleRate, channels int) (SpeakerMatch, error)
+}
+
+// SpeakerVerifierFunc adapts a function to the SpeakerVerifier interface
+type SpeakerVerifierFunc func(ctx context.Context, deviceID, tenantID string, pcm []byte, sampleRate, channels int) (SpeakerMatch, error)
+
+// VerifySpeaker calls f
+func (f SpeakerVerifierFunc) VerifySpeaker(ctx context.Context, deviceID, tenantID string, pcm []byte, sampleRate, channels int) (SpeakerMatch, error) {
+	return f(ctx, deviceID, tenantID, pcm, sampleRate, channels)
+}
+
+// WithSpeakerVerifier verifies the speaker of each session when speaker_verification.enabled is
+// set, unlocking speaker_verification.protected_tools and the verified provider profile for
+// verified speakers. By default speakers are not verified.
+func WithSpeakerVerifier(v SpeakerVerifier) Option {
+	return func(h *Handler) {
+		h.speakerVerifier = v
+	}
+}
+
+// newVerificationSampler returns the sampler of the speech a session's speaker is verified from,
+// or nil if speakers are not verified
+func newVerificationSampler(cfg *config.Config, verifier SpeakerVerifier, sampleRate int) *speakerSampler {
+	if verifier == nil || !cfg.SpeakerVerification.Enabled {
+		return nil
+	}
+	sample, _ := time.ParseDuration(cfg.SpeakerVerification.Sample)
+	size := int(sample.Seconds()*float64(sampleRate)) * cfg.Audio.Channels * 2
+	return &speakerSampler{size: max(size, 2)}
+}
+
+// speakerVerified reports whether the session's speaker was verified
+func (s *Session) speakerVerified() bool {
+	v := s.verification.Load()
+	return v != nil && v.Verified
+}
+
+// sampleVerification collects the user's speech for the speaker verifier, and verifies the speaker
+// once enough was heard
+func (h *Handler) sampleVerification(ctx context.Context, session *Session, pcm []byte) {
+	if sample := session.verifySample.add(pcm); sample != nil {
+		go h.verifySpeaker(ctx, session, sample)
+	}
+}
+
+// verifySpeaker verifies the speaker of a session from a sample of their speech. Speakers matching
+// with a score of at least speaker_verification.min_score are verified, and the session switches
+// to the verified provider profile, if one is configured. The sample is not kept.
+func (h *Handler) verifySpeaker(ctx context.Context, session *Session, sample []byte) {
+	cfg := h.config.SpeakerVerification
+	if timeout, _ := time.ParseDuration(cfg.Timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	match, err := h.speakerVerifier.VerifySpeaker(ctx, session.DeviceID, session.TenantID, sample, session.sampleRate, h.config.Audio.Channels)
+	v := store.SpeakerVerification{SpeakerID: match.SpeakerID, Score: match.Score, At: session.clock.Now()}
+	result := SpeakerRejected
+	switch {
+	case err != nil:
+		v.Error, result = err.Error(), SpeakerVerifyError
+		session.Client.logger.Warn("Could not verify speaker", "error", err)
+	case match.Score >= cfg.MinScore:
+		v.Verified, result = true, SpeakerVerified
+	}
+	session.verification.Store(&v)
+	h.metrics.speakerVerified(result)
+	if err == nil {
+		session.Client.logger.Info("Speaker verified", "result", result, "speaker_id", match.SpeakerID, "score", match.Score)
+	}
+
+	if v.Verified && (cfg.Model != "" || cfg.Instructions != "") {
+		p := session.providerProfile()
+		if cfg.Model != "" {
+			p.Model = cfg.Model
+		}
+		if cfg.Instructions != "" {
+			p.Instructions = cfg.Instructions
+		}
+		if err := h.RefreshProvider(session.ID, p); err != nil {
+			session.Client.logger.Error("Could not switch session to verified profile", "error", err)
+		}
+	}
+}
+
+// protectedTool reports whether a tool is refused to the session until its speaker is verified
+func (h *Handler) protectedTool(session *Session, name string) bool {
+	return h.config.SpeakerVerification.Enabled && slices.Contains(h.config.SpeakerVerification.ProtectedTools, name) && !session.speakerVerified()
+}
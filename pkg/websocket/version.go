@@ -0,0 +1,160 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	pixaerrors "github.com/pixaverse-studios/websocket-server/pkg/errors"
+	"github.com/pixaverse-studios/websocket-server/pkg/version"
+)
+
+// Headers devices report their versions with. The protocol_version and firmware_version query
+// parameters take the same values.
+const (
+	ProtocolVersionHeader = "X-Pixa-Protocol-Version"
+	FirmwareVersionHeader = "X-Pixa-Firmware-Version"
+	// MinProtocolVersionHeader is set on the upgrade response along with ProtocolVersionHeader,
+	// advertising the protocol versions the relay serves
+	MinProtocolVersionHeader = "X-Pixa-Min-Protocol-Version"
+)
+
+// CloseUpgradeRequired is the close code of sessions ended because the device is below a minimum
+// version, mirroring HTTP's 426 Upgrade Required
+const CloseUpgradeRequired = 4426
+
+// Outcomes of checking a device's versions
+const (
+	VersionCurrent     = "current"
+	VersionRecommended = "recommended"
+	VersionOutdated    = "outdated"
+	VersionRejected    = "rejected"
+)
+
+// clientVersion is what a device reported about its versions
+type clientVersion struct {
+	protocol int
+	// firmware is the firmware version as reported, empty if it was not
+	firmware string
+}
+
+// requestVersion reads the versions a connection request reports, from the version headers or
+// else the query parameters. A device that does not report a protocol version speaks version 1.
+func requestVersion(r *http.Request) (clientVersion, error) {
+	v := clientVersion{protocol: 1, firmware: headerOrQuery(r, FirmwareVersionHeader, "firmware_version")}
+	raw := headerOrQuery(r, ProtocolVersionHeader, "protocol_version")
+	if raw == "" {
+		return v, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		return v, fmt.Errorf("invalid protocol version %q", raw)
+	}
+	v.protocol = n
+	return v, nil
+}
+
+func headerOrQuery(r *http.Request, header, param string) string {
+	if v := r.Header.Get(header); v != "" {
+		return v
+	}
+	return r.URL.Query().Get(param)
+}
+
+// versionHeader advertises the protocol versions the relay serves on the upgrade response
+func (h *Handler) versionHeader() http.Header {
+	header := make(http.Header)
+	header.Set(ProtocolVersionHeader, strconv.Itoa(version.Protocol))
+	header.Set(MinProtocolVersionHeader, strconv.Itoa(h.minProtocol()))
+	return header
+}
+
+func (h *Handler) minProtocol() int {
+	return max(h.config.Versions.MinProtocol, 1)
+}
+
+// checkVersion compares a device's versions with the configured ones. It returns the outcome and,
+// unless the device is current, the event telling it to upgrade.
+func (h *Handler) checkVersion(v clientVersion) (string, *upgradeEvent) {
+	cfg := h.config.Versions
+	event := &upgradeEvent{
+		ProtocolVersion:            version.Protocol,
+		MinProtocolVersion:         h.minProtocol(),
+		MinFirmwareVersion:         cfg.MinFirmware,
+		RecommendedFirmwareVersion: cfg.RecommendedFirmware,
+	}
+
+	var reasons []string
+	if v.protocol < h.minProtocol() {
+		reasons = append(reasons, fmt.Sprintf("protocol version %d is older than %d", v.protocol, h.minProtocol()))
+	}
+	if reason, ok := firmwareBelow(v.firmware, cfg.MinFirmware); ok {
+		reasons = append(reasons, reason)
+	}
+	if len(reasons) > 0 {
+		event.Type = UpgradeRequiredEvent
+		event.Reason = strings.Join(reasons, "; ")
+		if cfg.Enforce {
+			return VersionRejected, event
+		}
+		return VersionOutdated, event
+	}
+
+	if reason, ok := firmwareBelow(v.firmware, cfg.RecommendedFirmware); ok {
+		event.Type = UpgradeRecommendedEvent
+		event.Reason = reason
+		return VersionRecommended, event
+	}
+	return VersionCurrent, nil
+}
+
+// firmwareBelow reports whether the reported firmware is older than want, and why. Firmware that
+// is not reported or cannot be read is older than any version; an empty want is met by any.
+func firmwareBelow(reported, want string) (string, bool) {
+	if want == "" {
+		return "", false
+	}
+	// the configured versions are validated when the config is loaded
+	minimum, _ := version.ParseFirmware(want)
+	if reported == "" {
+		return fmt.Sprintf("firmware version not reported, %s or newer is needed", want), true
+	}
+	firmware, err := version.ParseFirmware(reported)
+	if err != nil {
+		return fmt.Sprintf("firmware version %q cannot be read, %s or newer is needed", reported, want), true
+	}
+	if firmware.Less(minimum) {
+		return fmt.Sprintf("firmware version %s is older than %s", reported, want), true
+	}
+	return "", false
+}
+
+// rejectOutdated tells a device below a minimum version to upgrade and closes its connection
+// without starting a session
+func (h *Handler) rejectOutdated(conn *websocket.Conn, r *http.Request, v clientVersion, event *upgradeEvent) {
+	client := NewClient(conn, h.logger.With("device_id", deviceID(r), "tenant_id", tenantID(r)), h.config)
+	client.logger.Info("Rejecting outdated device", "protocol_version", v.protocol, "firmware_version", v.firmware, "reason", event.Reason)
+	if err := client.Send(event); err != nil {
+		client.logger.Error("Could not send upgrade event", "error", err)
+	}
+	client.closeFor(pixaerrors.Errorf(pixaerrors.UpgradeRequired, "upgrade required: %s", event.Reason))
+	h.middleware.onDisconnect(client, client.Err())
+}
+
+// ProtocolVersion returns the protocol version the device reported, 1 if it did not
+func (s *Session) ProtocolVersion() int {
+	if v := s.version.Load(); v != nil {
+		return v.protocol
+	}
+	return 1
+}
+
+// FirmwareVersion returns the firmware version the device reported, if any
+func (s *Session) FirmwareVersion() string {
+	if v := s.version.Load(); v != nil {
+		return v.firmware
+	}
+	return ""
+}
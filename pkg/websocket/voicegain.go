@@ -0,0 +1,135 @@
+package websocket
+
+import (
+	"cmp"
+	"encoding/binary"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+)
+
+const (
+	// defaultVoice is the name voices are measured and configured under for sessions that ask the
+	// provider for none
+	defaultVoice = "default"
+	// voiceBlock is the length of the blocks of answer audio whose level is measured
+	voiceBlock = 20 * time.Millisecond
+	// voiceSpeechLevel is the level, in dBFS, below which blocks are taken for the pauses between
+	// words and left out of the measurement
+	voiceSpeechLevel = -50
+	// voiceMeasureMin is how much speech of a voice is measured before its gain applies
+	voiceMeasureMin = 2 * time.Second
+	// voiceMeasureWindow is how much of the latest speech of a voice its level follows
+	voiceMeasureWindow = 30 * time.Second
+)
+
+// voiceLevels brings the answers of every voice of the provider to voice_gain.target_level. A voice
+// with a gain in voice_gain.gains gets that one; the others are measured from their answers, across
+// the sessions of the handler, and gain what takes them to the target, once enough of their speech
+// was heard. Their gain then follows the measurement slowly, so it does not pump within an answer.
+// A nil *voiceLevels changes nothing.
+type voiceLevels struct {
+	targetRMS float64
+	maxGain   float64
+	measure   bool
+	gains     map[string]float64
+	metrics   *handlerMetrics
+
+	mu     sync.Mutex
+	voices map[string]*voiceLevel
+}
+
+// voiceLevel is the measured level of a voice
+type voiceLevel struct {
+	// power is the mean square of the speech of the voice, over the window it follows
+	power float64
+	heard time.Duration
+}
+
+func newVoiceLevels(cfg config.VoiceGainConfig, m *handlerMetrics) *voiceLevels {
+	if !cfg.Enabled {
+		return nil
+	}
+	gains := make(map[string]float64, len(cfg.Gains))
+	for voice, db := range cfg.Gains {
+		gains[strings.ToLower(voice)] = db
+		m.voiceGain(strings.ToLower(voice), db)
+	}
+	return &voiceLevels{
+		targetRMS: fromDBFS(cfg.TargetLevel),
+		maxGain:   math.Pow(10, cfg.MaxGain/20),
+		measure:   cfg.Measure,
+		gains:     gains,
+		metrics:   m,
+		voices:    make(map[string]*voiceLevel),
+	}
+}
+
+// apply measures answer audio of a voice at sampleRate and returns it at the voice's gain
+func (v *voiceLevels) apply(voice string, pcm []byte, sampleRate int) []byte {
+	if v == nil || sampleRate <= 0 {
+		return pcm
+	}
+	voice = strings.ToLower(cmp.Or(voice, defaultVoice))
+	gain := v.gain(voice, pcm, sampleRate)
+	if math.Abs(gain-1) < 0.01 {
+		return pcm
+	}
+	out := make([]byte, len(pcm))
+	for i := 0; i+1 < len(pcm); i += 2 {
+		s := float64(int16(binary.LittleEndian.Uint16(pcm[i:]))) * gain
+		binary.LittleEndian.PutUint16(out[i:], uint16(int16(min(max(s, math.MinInt16), math.MaxInt16))))
+	}
+	return out
+}
+
+// gain returns the gain of a voice, taking the answer audio into its measurement first
+func (v *voiceLevels) gain(voice string, pcm []byte, sampleRate int) float64 {
+	if db, ok := v.gains[voice]; ok {
+		return math.Pow(10, db/20)
+	}
+	if !v.measure {
+		return 1
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	l := v.voices[voice]
+	if l == nil {
+		l = &voiceLevel{}
+		v.voices[voice] = l
+	}
+	// answers are relayed as mono 16 bit PCM
+	block := max(int(voiceBlock.Seconds()*float64(sampleRate)), 1) * 2
+	for i := 0; i+1 < len(pcm); i += block {
+		b := pcm[i:min(i+block, len(pcm))]
+		level := rms(b)
+		if toDBFS(level) < voiceSpeechLevel {
+			continue
+		}
+		// the level is the mean of the speech heard until the window is full, and follows the
+		// window after that
+		d := time.Duration(len(b)/2) * time.Second / time.Duration(sampleRate)
+		l.heard += d
+		l.power += (level*level - l.power) * d.Seconds() / min(l.heard, voiceMeasureWindow).Seconds()
+	}
+	if l.heard < voiceMeasureMin || l.power <= 0 {
+		return 1
+	}
+	gain := min(max(v.targetRMS/math.Sqrt(l.power), 1/v.maxGain), v.maxGain)
+	// rounded to a tenth, so the gain reported does not flicker with every chunk
+	v.metrics.voiceGain(voice, math.Round(200*math.Log10(gain))/10)
+	return gain
+}
+
+// voice returns the voice the session's provider answers in, "" for the provider's default
+func (h *Handler) voice(session *Session) string {
+	return cmp.Or(session.providerProfile().Voice, h.config.AIConfig.Voice)
+}
+
+// normalizeVoice brings answer audio of the session to the loudness of the other voices
+func (h *Handler) normalizeVoice(session *Session, pcm []byte) []byte {
+	return h.voiceLevels.apply(h.voice(session), pcm, session.DownlinkSampleRate())
+}
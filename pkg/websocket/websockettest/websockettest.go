@@ -0,0 +1,242 @@
+// Package websockettest runs a complete relay on a loopback port for black-box tests: the mock AI
+// provider answers the devices, finished sessions are kept in an in-memory store and every timer
+// of the relay runs on a fake clock the test moves forward.
+package websockettest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/pixaverse-studios/websocket-server/pkg/ai"
+	"github.com/pixaverse-studios/websocket-server/pkg/clock"
+	"github.com/pixaverse-studios/websocket-server/pkg/config"
+	"github.com/pixaverse-studios/websocket-server/pkg/server"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+	"github.com/pixaverse-studios/websocket-server/pkg/websocket"
+)
+
+// AdminAPIKey authenticates requests to the test server's admin API
+const AdminAPIKey = "websockettest-admin-api-key"
+
+// StartTime is the time the fake clock of a test server starts at, unless WithStartTime is used
+var StartTime = time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+
+// TestServer is a relay listening on a loopback port
+type TestServer struct {
+	// URL is the websocket URL devices connect to, e.g. ws://127.0.0.1:41234/
+	URL string
+	// HTTPURL is the base URL of the server's HTTP endpoints, such as /metrics and /admin/sessions
+	HTTPURL string
+	// Config is the configuration the relay runs with
+	Config *config.Config
+	// Clock drives the relay's timers: keepalives, the mock provider's responses, retries and the reaper
+	Clock *clock.Fake
+	// Transcripts holds the records of finished sessions
+	Transcripts *store.MemoryStore
+	Server      *server.Server
+
+	tb       testing.TB
+	serveErr chan error
+	closed   bool
+}
+
+type options struct {
+	configure   []func(*config.Config)
+	serverOpts  []server.Option
+	handlerOpts []websocket.Option
+	start       time.Time
+}
+
+// Option configures a TestServer
+type Option func(*options)
+
+// WithConfig changes the configuration before the relay starts. It starts from the defaults of
+// config.Default with the mock provider, transcripts and the admin API enabled.
+func WithConfig(configure func(cfg *config.Config)) Option {
+	return func(o *options) {
+		o.configure = append(o.configure, configure)
+	}
+}
+
+// WithServerOptions passes options to server.New, after the test server's own
+func WithServerOptions(opts ...server.Option) Option {
+	return func(o *options) {
+		o.serverOpts = append(o.serverOpts, opts...)
+	}
+}
+
+// WithHandlerOptions passes options to the websocket handler, after the test server's own. The
+// handler runs on the fake clock with seed 1 unless these say otherwise.
+func WithHandlerOptions(opts ...websocket.Option) Option {
+	return func(o *options) {
+		o.handlerOpts = append(o.handlerOpts, opts...)
+	}
+}
+
+// WithStartTime sets the time the fake clock starts at
+func WithStartTime(t time.Time) Option {
+	return func(o *options) {
+		o.start = t
+	}
+}
+
+// NewTestServer starts a relay and closes it when the test ends. It fails the test if the relay
+// cannot be started, e.g. because the configuration is invalid.
+func NewTestServer(tb testing.TB, opts ...Option) *TestServer {
+	tb.Helper()
+	o := &options{start: StartTime}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	cfg := config.Default()
+	cfg.Server.Environment = "test"
+	cfg.AIConfig.Provider = ai.MockProvider
+	cfg.AIConfig.Mock.TurnAfter = "500ms"
+	cfg.AIConfig.Mock.ResponseLength = "500ms"
+	cfg.Transcripts.Enabled = true
+	cfg.Admin.Enabled = true
+	cfg.Admin.APIKey = AdminAPIKey
+	for _, configure := range o.configure {
+		configure(cfg)
+	}
+	if err := config.ValidateConfig(cfg); err != nil {
+		tb.Fatalf("websockettest: invalid configuration: %v", err)
+	}
+
+	s := &TestServer{
+		Config:      cfg,
+		Clock:       clock.NewFake(o.start),
+		Transcripts: store.NewMemoryStore(cfg.Transcripts.MaxSessions),
+		tb:          tb,
+		serveErr:    make(chan error, 1),
+	}
+	handlerOpts := append([]websocket.Option{websocket.WithClock(s.Clock), websocket.WithSeed(1)}, o.handlerOpts...)
+	serverOpts := append([]server.Option{
+		server.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		server.WithTranscriptStore(s.Transcripts),
+		server.WithHandlerOptions(handlerOpts...),
+	}, o.serverOpts...)
+	srv, err := server.New(cfg, serverOpts...)
+	if err != nil {
+		tb.Fatalf("websockettest: could not create relay: %v", err)
+	}
+	s.Server = srv
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("websockettest: could not listen: %v", err)
+	}
+	s.HTTPURL = "http://" + l.Addr().String()
+	s.URL = "ws://" + l.Addr().String() + "/"
+	go func() { s.serveErr <- srv.Serve(l) }()
+	tb.Cleanup(s.Close)
+	return s
+}
+
+// Dial connects a device to the relay with the given request headers, e.g. websocket.DeviceIDHeader.
+// The connection is closed when the test ends.
+func (s *TestServer) Dial(header http.Header) *gorilla.Conn {
+	s.tb.Helper()
+	return s.DialURL(s.URL, header)
+}
+
+// DialURL is like Dial but connects to url, which may add query parameters to URL
+func (s *TestServer) DialURL(url string, header http.Header) *gorilla.Conn {
+	s.tb.Helper()
+	conn, resp, err := gorilla.DefaultDialer.Dial(url, header)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%w (status %s)", err, resp.Status)
+		}
+		s.tb.Fatalf("websockettest: could not connect: %v", err)
+	}
+	s.tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Silence returns d of silent device audio in the relay's uplink format
+func (s *TestServer) Silence(d time.Duration) []byte {
+	a := s.Config.Audio
+	samples := int(d * time.Duration(a.SampleRate) / time.Second)
+	return make([]byte, samples*a.Channels*2)
+}
+
+// AdminRequest sends an authenticated request to the admin API, path being e.g. "/admin/sessions"
+func (s *TestServer) AdminRequest(method, path string, body io.Reader) *http.Response {
+	s.tb.Helper()
+	req, err := http.NewRequest(method, s.HTTPURL+path, body)
+	if err != nil {
+		s.tb.Fatalf("websockettest: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+AdminAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.tb.Fatalf("websockettest: admin request failed: %v", err)
+	}
+	s.tb.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// WaitForSessions waits until n sessions are active, failing the test if that takes longer than
+// timeout in real time
+func (s *TestServer) WaitForSessions(n int, timeout time.Duration) {
+	s.tb.Helper()
+	if !s.waitFor(func() bool { return s.Server.Sessions().Count() == n }, timeout) {
+		s.tb.Fatalf("websockettest: %d sessions active after %s, want %d", s.Server.Sessions().Count(), timeout, n)
+	}
+}
+
+// Record waits for the record of the finished session with the given ID, failing the test if it
+// is not saved within timeout in real time
+func (s *TestServer) Record(sessionID string, timeout time.Duration) store.SessionRecord {
+	s.tb.Helper()
+	var record store.SessionRecord
+	found := s.waitFor(func() bool {
+		r, err := s.Transcripts.GetSession(context.Background(), sessionID)
+		record = r
+		return err == nil
+	}, timeout)
+	if !found {
+		s.tb.Fatalf("websockettest: no record of session %s after %s", sessionID, timeout)
+	}
+	return record
+}
+
+func (s *TestServer) waitFor(cond func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
+// Close ends the active sessions and shuts the relay down. It is called when the test ends.
+func (s *TestServer) Close() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	sessions := s.Server.Sessions()
+	for _, session := range sessions.List() {
+		session.Close()
+	}
+	// sessions tear down on their own goroutines, the relay's connections are hijacked from
+	// the HTTP server and not closed with it
+	s.waitFor(func() bool { return sessions.Count() == 0 }, 5*time.Second)
+	s.Server.Close()
+	if err := <-s.serveErr; !errors.Is(err, http.ErrServerClosed) {
+		s.tb.Errorf("websockettest: relay stopped with %v", err)
+	}
+}
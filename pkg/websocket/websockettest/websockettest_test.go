@@ -0,0 +1,73 @@
+package websockettest
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/pixaverse-studios/websocket-server/pkg/store"
+	"github.com/pixaverse-studios/websocket-server/pkg/websocket"
+)
+
+func TestTestServer(t *testing.T) {
+	srv := NewTestServer(t)
+	conn := srv.Dial(http.Header{websocket.DeviceIDHeader: {"device-1"}})
+	srv.WaitForSessions(1, 5*time.Second)
+	sessionID := srv.Server.Sessions().List()[0].ID
+
+	// one turn of the mock provider
+	if err := conn.WriteMessage(gorilla.BinaryMessage, srv.Silence(600*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan []byte)
+	go func() {
+		for {
+			typ, data, err := conn.ReadMessage()
+			if err != nil {
+				close(messages)
+				return
+			}
+			if typ == gorilla.TextMessage {
+				messages <- data
+			}
+		}
+	}()
+	deadline := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case data, ok := <-messages:
+			if !ok {
+				t.Fatal("connection closed before the response was complete")
+			}
+			var msg struct{ Type string }
+			json.Unmarshal(data, &msg)
+			done = msg.Type == websocket.SentenceCompletedEvent
+		case <-time.After(10 * time.Millisecond):
+			// the mock provider paces its response on the fake clock
+			srv.Clock.Advance(100 * time.Millisecond)
+		case <-deadline:
+			t.Fatal("no sentence of the response within 5s")
+		}
+	}
+
+	resp := srv.AdminRequest(http.MethodGet, "/admin/sessions", nil)
+	var list struct{ Sessions []websocket.SessionInfo }
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil || len(list.Sessions) != 1 || list.Sessions[0].DeviceID != "device-1" {
+		t.Fatalf("unexpected admin sessions %+v (%v)", list.Sessions, err)
+	}
+
+	conn.WriteMessage(gorilla.CloseMessage, gorilla.FormatCloseMessage(gorilla.CloseNormalClosure, ""))
+	record := srv.Record(sessionID, 5*time.Second)
+	if record.DeviceID != "device-1" || record.Flagged || !record.StartedAt.Equal(StartTime) {
+		t.Fatalf("unexpected record %+v", record)
+	}
+	var roles []string
+	for _, turn := range record.Turns {
+		roles = append(roles, turn.Role)
+	}
+	if len(roles) != 2 || roles[0] != store.UserRole || roles[1] != store.AssistantRole {
+		t.Fatalf("expected a user and an assistant turn, got %v", roles)
+	}
+}
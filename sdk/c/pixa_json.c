@@ -0,0 +1,436 @@
+#include "pixa_json.h"
+
+#include <inttypes.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+static const char *skip_ws(const char *p)
+{
+    while (*p == ' ' || *p == '\t' || *p == '\n' || *p == '\r') {
+        p++;
+    }
+    return p;
+}
+
+/* skip_string returns the character after the closing quote of the string starting at p */
+static const char *skip_string(const char *p)
+{
+    for (p++; *p && *p != '"'; p++) {
+        if (*p == '\\' && p[1]) {
+            p++;
+        }
+    }
+    return *p == '"' ? p + 1 : NULL;
+}
+
+/* skip_value returns the character after the value starting at p */
+static const char *skip_value(const char *p)
+{
+    int depth = 0;
+
+    p = skip_ws(p);
+    for (;;) {
+        switch (*p) {
+        case '\0':
+            return NULL;
+        case '"':
+            p = skip_string(p);
+            if (!p || depth == 0) {
+                return p;
+            }
+            continue;
+        case '{':
+        case '[':
+            depth++;
+            break;
+        case '}':
+        case ']':
+            if (depth == 0) {
+                return p;
+            }
+            if (--depth == 0) {
+                return p + 1;
+            }
+            break;
+        case ',':
+        case ' ':
+        case '\t':
+        case '\n':
+        case '\r':
+            if (depth == 0) {
+                return p;
+            }
+            break;
+        }
+        p++;
+    }
+}
+
+/* find_member returns the value of key in the object starting at p */
+static const char *find_member(const char *p, const char *key, size_t key_len)
+{
+    p = skip_ws(p);
+    if (*p != '{') {
+        return NULL;
+    }
+    p++;
+    for (;;) {
+        const char *name, *end;
+
+        p = skip_ws(p);
+        if (*p != '"') {
+            return NULL;
+        }
+        name = p + 1;
+        end = skip_string(p);
+        if (!end) {
+            return NULL;
+        }
+        p = skip_ws(end);
+        if (*p != ':') {
+            return NULL;
+        }
+        p = skip_ws(p + 1);
+        if ((size_t)(end - 1 - name) == key_len && memcmp(name, key, key_len) == 0) {
+            return p;
+        }
+        p = skip_value(p);
+        if (!p) {
+            return NULL;
+        }
+        p = skip_ws(p);
+        if (*p != ',') {
+            return NULL;
+        }
+        p++;
+    }
+}
+
+static const char *find_path(const char *json, const char *path)
+{
+    const char *p = json;
+
+    while (p) {
+        const char *dot = strchr(path, '.');
+        size_t len = dot ? (size_t)(dot - path) : strlen(path);
+
+        p = find_member(p, path, len);
+        if (!dot) {
+            return p;
+        }
+        path = dot + 1;
+    }
+    return NULL;
+}
+
+static int hex_value(char c)
+{
+    if (c >= '0' && c <= '9') return c - '0';
+    if (c >= 'a' && c <= 'f') return c - 'a' + 10;
+    if (c >= 'A' && c <= 'F') return c - 'A' + 10;
+    return -1;
+}
+
+static long read_hex4(const char *p)
+{
+    long v = 0;
+    int i;
+
+    for (i = 0; i < 4; i++) {
+        int h = hex_value(p[i]);
+        if (h < 0) {
+            return -1;
+        }
+        v = v << 4 | h;
+    }
+    return v;
+}
+
+static size_t put_utf8(char *out, size_t room, unsigned long cp)
+{
+    char tmp[4];
+    size_t n;
+
+    if (cp < 0x80) {
+        tmp[0] = (char)cp;
+        n = 1;
+    } else if (cp < 0x800) {
+        tmp[0] = (char)(0xC0 | cp >> 6);
+        tmp[1] = (char)(0x80 | (cp & 0x3F));
+        n = 2;
+    } else if (cp < 0x10000) {
+        tmp[0] = (char)(0xE0 | cp >> 12);
+        tmp[1] = (char)(0x80 | (cp >> 6 & 0x3F));
+        tmp[2] = (char)(0x80 | (cp & 0x3F));
+        n = 3;
+    } else {
+        tmp[0] = (char)(0xF0 | cp >> 18);
+        tmp[1] = (char)(0x80 | (cp >> 12 & 0x3F));
+        tmp[2] = (char)(0x80 | (cp >> 6 & 0x3F));
+        tmp[3] = (char)(0x80 | (cp & 0x3F));
+        n = 4;
+    }
+    if (n > room) {
+        return 0;
+    }
+    memcpy(out, tmp, n);
+    return n;
+}
+
+int pixa_json_get_string(const char *json, const char *path, char *out, size_t cap)
+{
+    const char *p = find_path(json, path);
+    size_t n = 0;
+
+    if (!p || *p != '"' || cap == 0) {
+        return -1;
+    }
+    for (p++; *p && *p != '"'; p++) {
+        unsigned long cp = (unsigned char)*p;
+
+        if (*p == '\\') {
+            p++;
+            switch (*p) {
+            case 'b': cp = '\b'; break;
+            case 'f': cp = '\f'; break;
+            case 'n': cp = '\n'; break;
+            case 'r': cp = '\r'; break;
+            case 't': cp = '\t'; break;
+            case 'u': {
+                long hi = read_hex4(p + 1);
+                if (hi < 0) {
+                    return -1;
+                }
+                p += 4;
+                cp = (unsigned long)hi;
+                if (hi >= 0xD800 && hi < 0xDC00 && p[1] == '\\' && p[2] == 'u') {
+                    long lo = read_hex4(p + 3);
+                    if (lo >= 0xDC00 && lo < 0xE000) {
+                        cp = 0x10000 + ((unsigned long)(hi - 0xD800) << 10) + (unsigned long)(lo - 0xDC00);
+                        p += 6;
+                    }
+                }
+                n += put_utf8(out + n, cap - 1 - n, cp);
+                continue;
+            }
+            case '\0': return -1;
+            default: cp = (unsigned char)*p; break;
+            }
+        }
+        if (n < cap - 1) {
+            out[n++] = (char)cp;
+        }
+    }
+    out[n] = '\0';
+    return *p == '"' ? 0 : -1;
+}
+
+int pixa_json_get_int64(const char *json, const char *path, int64_t *out)
+{
+    const char *p = find_path(json, path);
+    char *end;
+    long long v;
+
+    if (!p) {
+        return -1;
+    }
+    v = strtoll(p, &end, 10);
+    if (end == p) {
+        return -1;
+    }
+    *out = (int64_t)v;
+    return 0;
+}
+
+int pixa_json_get_int32(const char *json, const char *path, int32_t *out)
+{
+    int64_t v;
+
+    if (pixa_json_get_int64(json, path, &v) < 0 || v < INT32_MIN || v > INT32_MAX) {
+        return -1;
+    }
+    *out = (int32_t)v;
+    return 0;
+}
+
+int pixa_json_get_bool(const char *json, const char *path, bool *out)
+{
+    const char *p = find_path(json, path);
+
+    if (p && strncmp(p, "true", 4) == 0) {
+        *out = true;
+        return 0;
+    }
+    if (p && strncmp(p, "false", 5) == 0) {
+        *out = false;
+        return 0;
+    }
+    return -1;
+}
+
+static int base64_value(char c)
+{
+    if (c >= 'A' && c <= 'Z') return c - 'A';
+    if (c >= 'a' && c <= 'z') return c - 'a' + 26;
+    if (c >= '0' && c <= '9') return c - '0' + 52;
+    if (c == '+') return 62;
+    if (c == '/') return 63;
+    return -1;
+}
+
+int pixa_json_get_base64(const char *json, const char *path, uint8_t *out, size_t cap, size_t *len)
+{
+    const char *p = find_path(json, path);
+    unsigned long acc = 0;
+    int bits = 0;
+    size_t n = 0;
+
+    if (!p || *p != '"') {
+        return -1;
+    }
+    for (p++; *p && *p != '"' && *p != '='; p++) {
+        int v;
+
+        if (*p == '\\' && p[1] == '/') {
+            p++;
+        }
+        v = base64_value(*p);
+        if (v < 0) {
+            return -1;
+        }
+        acc = (acc << 6 | (unsigned long)v) & 0xFFFFFF;
+        bits += 6;
+        if (bits >= 8) {
+            bits -= 8;
+            if (n == cap) {
+                return -1;
+            }
+            out[n++] = (uint8_t)(acc >> bits);
+        }
+    }
+    *len = n;
+    return 0;
+}
+
+int pixa_json_message_type(const char *json, char *out, size_t cap)
+{
+    return pixa_json_get_string(json, "type", out, cap);
+}
+
+static void put(pixa_json_writer *w, const char *s, size_t n)
+{
+    if (w->err || w->len + n >= w->cap) {
+        w->err = 1;
+        return;
+    }
+    memcpy(w->buf + w->len, s, n);
+    w->len += n;
+}
+
+static void put_key(pixa_json_writer *w, const char *key)
+{
+    put(w, w->len > 1 ? ",\"" : "\"", w->len > 1 ? 2 : 1);
+    put(w, key, strlen(key));
+    put(w, "\":", 2);
+}
+
+void pixa_json_begin(pixa_json_writer *w, char *buf, size_t cap)
+{
+    w->buf = buf;
+    w->cap = cap;
+    w->len = 0;
+    w->err = 0;
+    put(w, "{", 1);
+}
+
+static void put_string(pixa_json_writer *w, const char *value)
+{
+    put(w, "\"", 1);
+    for (; *value; value++) {
+        unsigned char c = (unsigned char)*value;
+        char esc[7];
+
+        if (c == '"' || c == '\\') {
+            esc[0] = '\\';
+            esc[1] = (char)c;
+            put(w, esc, 2);
+        } else if (c < 0x20) {
+            snprintf(esc, sizeof(esc), "\\u%04x", c);
+            put(w, esc, 6);
+        } else {
+            put(w, value, 1);
+        }
+    }
+    put(w, "\"", 1);
+}
+
+void pixa_json_add_string(pixa_json_writer *w, const char *key, const char *value)
+{
+    put_key(w, key);
+    put_string(w, value);
+}
+
+void pixa_json_add_string_map(pixa_json_writer *w, const char *key, const pixa_json_pair *pairs, size_t len)
+{
+    size_t i;
+
+    put_key(w, key);
+    put(w, "{", 1);
+    for (i = 0; i < len; i++) {
+        if (i > 0) {
+            put(w, ",", 1);
+        }
+        put_string(w, pairs[i].key);
+        put(w, ":", 1);
+        put_string(w, pairs[i].value);
+    }
+    put(w, "}", 1);
+}
+
+void pixa_json_add_int64(pixa_json_writer *w, const char *key, int64_t value)
+{
+    char num[24];
+    int n = snprintf(num, sizeof(num), "%" PRId64, value);
+
+    put_key(w, key);
+    put(w, num, (size_t)n);
+}
+
+void pixa_json_add_bool(pixa_json_writer *w, const char *key, bool value)
+{
+    put_key(w, key);
+    put(w, value ? "true" : "false", value ? 4 : 5);
+}
+
+void pixa_json_add_base64(pixa_json_writer *w, const char *key, const uint8_t *data, size_t len)
+{
+    static const char alphabet[] = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+    size_t i;
+
+    put_key(w, key);
+    put(w, "\"", 1);
+    for (i = 0; i < len; i += 3) {
+        unsigned long v = (unsigned long)data[i] << 16;
+        char quad[4];
+
+        if (i + 1 < len) v |= (unsigned long)data[i + 1] << 8;
+        if (i + 2 < len) v |= data[i + 2];
+        quad[0] = alphabet[v >> 18 & 0x3F];
+        quad[1] = alphabet[v >> 12 & 0x3F];
+        quad[2] = i + 1 < len ? alphabet[v >> 6 & 0x3F] : '=';
+        quad[3] = i + 2 < len ? alphabet[v & 0x3F] : '=';
+        put(w, quad, 4);
+    }
+    put(w, "\"", 1);
+}
+
+int pixa_json_end(pixa_json_writer *w)
+{
+    put(w, "}", 1);
+    if (w->err) {
+        return -1;
+    }
+    w->buf[w->len] = '\0';
+    return (int)w->len;
+}
@@ -0,0 +1,54 @@
+/*
+ * Minimal JSON support for the Pixa relay control protocol, used by the generated
+ * pixa_protocol.c. It does not allocate: readers look values up by dotted path in a
+ * NUL terminated message, the writer appends members to a caller supplied buffer.
+ */
+#ifndef PIXA_JSON_H
+#define PIXA_JSON_H
+
+#include <stdbool.h>
+#include <stddef.h>
+#include <stdint.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+/* Readers return 0 on success and -1 if the path is missing or holds another kind of value.
+ * Strings longer than cap - 1 bytes are truncated. */
+int pixa_json_get_string(const char *json, const char *path, char *out, size_t cap);
+int pixa_json_get_int64(const char *json, const char *path, int64_t *out);
+int pixa_json_get_int32(const char *json, const char *path, int32_t *out);
+int pixa_json_get_bool(const char *json, const char *path, bool *out);
+int pixa_json_get_base64(const char *json, const char *path, uint8_t *out, size_t cap, size_t *len);
+
+/* pixa_json_message_type copies the type of a control message into out */
+int pixa_json_message_type(const char *json, char *out, size_t cap);
+
+typedef struct {
+    char *buf;
+    size_t cap;
+    size_t len;
+    int err;
+} pixa_json_writer;
+
+/* pixa_json_pair is a member of an object of strings; the strings belong to the caller */
+typedef struct {
+    const char *key;
+    const char *value;
+} pixa_json_pair;
+
+void pixa_json_begin(pixa_json_writer *w, char *buf, size_t cap);
+void pixa_json_add_string(pixa_json_writer *w, const char *key, const char *value);
+void pixa_json_add_int64(pixa_json_writer *w, const char *key, int64_t value);
+void pixa_json_add_bool(pixa_json_writer *w, const char *key, bool value);
+void pixa_json_add_base64(pixa_json_writer *w, const char *key, const uint8_t *data, size_t len);
+void pixa_json_add_string_map(pixa_json_writer *w, const char *key, const pixa_json_pair *pairs, size_t len);
+/* pixa_json_end closes the object and returns its length, or -1 if buf was too small */
+int pixa_json_end(pixa_json_writer *w);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* PIXA_JSON_H */
@@ -0,0 +1,450 @@
+/* Code generated by protogen from protocol/protocol.schema.json. DO NOT EDIT. */
+#include "pixa_protocol.h"
+
+#include <string.h>
+
+#include "pixa_json.h"
+
+int pixa_encode_playback_ack_message(const pixa_playback_ack_message *m, char *buf, size_t cap)
+{
+    pixa_json_writer w;
+
+    pixa_json_begin(&w, buf, cap);
+    pixa_json_add_string(&w, "type", PIXA_TYPE_PLAYBACK_ACK);
+    pixa_json_add_int64(&w, "played_ms", m->played_ms);
+    return pixa_json_end(&w);
+}
+
+int pixa_encode_session_hello_message(const pixa_session_hello_message *m, char *buf, size_t cap)
+{
+    pixa_json_writer w;
+
+    pixa_json_begin(&w, buf, cap);
+    pixa_json_add_string(&w, "type", PIXA_TYPE_SESSION_HELLO);
+    pixa_json_add_base64(&w, "public_key", m->public_key, m->public_key_len);
+    return pixa_json_end(&w);
+}
+
+int pixa_encode_ptt_begin_message(const pixa_ptt_begin_message *m, char *buf, size_t cap)
+{
+    pixa_json_writer w;
+
+    pixa_json_begin(&w, buf, cap);
+    pixa_json_add_string(&w, "type", PIXA_TYPE_PTT_BEGIN);
+    pixa_json_add_int64(&w, "captured_at_ms", m->captured_at_ms);
+    pixa_json_add_int64(&w, "sent_at_ms", m->sent_at_ms);
+    return pixa_json_end(&w);
+}
+
+int pixa_encode_ptt_end_message(const pixa_ptt_end_message *m, char *buf, size_t cap)
+{
+    pixa_json_writer w;
+
+    pixa_json_begin(&w, buf, cap);
+    pixa_json_add_string(&w, "type", PIXA_TYPE_PTT_END);
+    return pixa_json_end(&w);
+}
+
+int pixa_encode_turn_metadata_message(const pixa_turn_metadata_message *m, char *buf, size_t cap)
+{
+    pixa_json_writer w;
+
+    pixa_json_begin(&w, buf, cap);
+    pixa_json_add_string(&w, "type", PIXA_TYPE_TURN_METADATA);
+    pixa_json_add_string_map(&w, "metadata", m->metadata, m->metadata_len);
+    return pixa_json_end(&w);
+}
+
+int pixa_encode_audio_test_message(const pixa_audio_test_message *m, char *buf, size_t cap)
+{
+    pixa_json_writer w;
+
+    pixa_json_begin(&w, buf, cap);
+    pixa_json_add_string(&w, "type", PIXA_TYPE_AUDIO_TEST);
+    if (m->kind[0] != '\0') {
+        pixa_json_add_string(&w, "kind", m->kind);
+    }
+    if (m->frequency_hz) {
+        pixa_json_add_int64(&w, "frequency_hz", m->frequency_hz);
+    }
+    if (m->from_hz) {
+        pixa_json_add_int64(&w, "from_hz", m->from_hz);
+    }
+    if (m->to_hz) {
+        pixa_json_add_int64(&w, "to_hz", m->to_hz);
+    }
+    if (m->duration_ms) {
+        pixa_json_add_int64(&w, "duration_ms", m->duration_ms);
+    }
+    if (m->level_db) {
+        pixa_json_add_int64(&w, "level_db", m->level_db);
+    }
+    if (m->verify) {
+        pixa_json_add_bool(&w, "verify", m->verify);
+    }
+    return pixa_json_end(&w);
+}
+
+int pixa_encode_device_hello_message(const pixa_device_hello_message *m, char *buf, size_t cap)
+{
+    pixa_json_writer w;
+
+    pixa_json_begin(&w, buf, cap);
+    pixa_json_add_string(&w, "type", PIXA_TYPE_DEVICE_HELLO);
+    if (m->sample_rate) {
+        pixa_json_add_int64(&w, "sample_rate", m->sample_rate);
+    }
+    if (m->codec[0] != '\0') {
+        pixa_json_add_string(&w, "codec", m->codec);
+    }
+    if (m->channels) {
+        pixa_json_add_int64(&w, "channels", m->channels);
+    }
+    if (m->downmix[0] != '\0') {
+        pixa_json_add_string(&w, "downmix", m->downmix);
+    }
+    if (m->firmware_version[0] != '\0') {
+        pixa_json_add_string(&w, "firmware_version", m->firmware_version);
+    }
+    if (m->downlink_codec[0] != '\0') {
+        pixa_json_add_string(&w, "downlink_codec", m->downlink_codec);
+    }
+    if (m->downlink_sample_rate) {
+        pixa_json_add_int64(&w, "downlink_sample_rate", m->downlink_sample_rate);
+    }
+    return pixa_json_end(&w);
+}
+
+int pixa_decode_session_status_event(const char *json, pixa_session_status_event *out)
+{
+    memset(out, 0, sizeof(*out));
+    if (pixa_json_get_string(json, "type", out->type, sizeof(out->type)) < 0) {
+        return -1;
+    }
+    if (strcmp(out->type, PIXA_TYPE_SESSION_STATUS) != 0) {
+        return -1;
+    }
+    if (pixa_json_get_string(json, "session_id", out->session_id, sizeof(out->session_id)) < 0) {
+        return -1;
+    }
+    pixa_json_get_string(json, "correlation_id", out->correlation_id, sizeof(out->correlation_id));
+    if (pixa_json_get_int64(json, "cursor.appended_ms", &out->cursor.appended_ms) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int64(json, "cursor.committed_ms", &out->cursor.committed_ms) < 0) {
+        return -1;
+    }
+    pixa_json_get_string(json, "cursor.item_id", out->cursor.item_id, sizeof(out->cursor.item_id));
+    if (pixa_json_get_int64(json, "cursor.sent_ms", &out->cursor.sent_ms) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int64(json, "cursor.acked_ms", &out->cursor.acked_ms) < 0) {
+        return -1;
+    }
+    return 0;
+}
+
+int pixa_decode_response_interrupted_event(const char *json, pixa_response_interrupted_event *out)
+{
+    memset(out, 0, sizeof(*out));
+    if (pixa_json_get_string(json, "type", out->type, sizeof(out->type)) < 0) {
+        return -1;
+    }
+    if (strcmp(out->type, PIXA_TYPE_RESPONSE_INTERRUPTED) != 0) {
+        return -1;
+    }
+    if (pixa_json_get_string(json, "item_id", out->item_id, sizeof(out->item_id)) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int64(json, "audio_end_ms", &out->audio_end_ms) < 0) {
+        return -1;
+    }
+    return 0;
+}
+
+int pixa_decode_sentence_completed_event(const char *json, pixa_sentence_completed_event *out)
+{
+    memset(out, 0, sizeof(*out));
+    if (pixa_json_get_string(json, "type", out->type, sizeof(out->type)) < 0) {
+        return -1;
+    }
+    if (strcmp(out->type, PIXA_TYPE_SENTENCE_COMPLETED) != 0) {
+        return -1;
+    }
+    if (pixa_json_get_string(json, "item_id", out->item_id, sizeof(out->item_id)) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int32(json, "index", &out->index) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_string(json, "text", out->text, sizeof(out->text)) < 0) {
+        return -1;
+    }
+    pixa_json_get_string(json, "language", out->language, sizeof(out->language));
+    pixa_json_get_string(json, "original_text", out->original_text, sizeof(out->original_text));
+    if (pixa_json_get_int64(json, "audio_start_ms", &out->audio_start_ms) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int64(json, "audio_end_ms", &out->audio_end_ms) < 0) {
+        return -1;
+    }
+    return 0;
+}
+
+int pixa_decode_bandwidth_event(const char *json, pixa_bandwidth_event *out)
+{
+    memset(out, 0, sizeof(*out));
+    if (pixa_json_get_string(json, "type", out->type, sizeof(out->type)) < 0) {
+        return -1;
+    }
+    if (strcmp(out->type, PIXA_TYPE_BANDWIDTH_WARNING) != 0 && strcmp(out->type, PIXA_TYPE_BANDWIDTH_DOWNGRADED) != 0 && strcmp(out->type, PIXA_TYPE_BANDWIDTH_EXCEEDED) != 0) {
+        return -1;
+    }
+    if (pixa_json_get_string(json, "scope", out->scope, sizeof(out->scope)) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int64(json, "used_bytes", &out->used_bytes) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int64(json, "cap_bytes", &out->cap_bytes) < 0) {
+        return -1;
+    }
+    pixa_json_get_int32(json, "sample_rate", &out->sample_rate);
+    return 0;
+}
+
+int pixa_decode_provider_offline_event(const char *json, pixa_provider_offline_event *out)
+{
+    memset(out, 0, sizeof(*out));
+    if (pixa_json_get_string(json, "type", out->type, sizeof(out->type)) < 0) {
+        return -1;
+    }
+    if (strcmp(out->type, PIXA_TYPE_PROVIDER_OFFLINE) != 0) {
+        return -1;
+    }
+    if (pixa_json_get_string(json, "reason", out->reason, sizeof(out->reason)) < 0) {
+        return -1;
+    }
+    return 0;
+}
+
+int pixa_decode_provider_recovered_event(const char *json, pixa_provider_recovered_event *out)
+{
+    memset(out, 0, sizeof(*out));
+    if (pixa_json_get_string(json, "type", out->type, sizeof(out->type)) < 0) {
+        return -1;
+    }
+    if (strcmp(out->type, PIXA_TYPE_PROVIDER_RECOVERED) != 0) {
+        return -1;
+    }
+    if (pixa_json_get_string(json, "action", out->action, sizeof(out->action)) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int64(json, "buffered_ms", &out->buffered_ms) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int64(json, "dropped_ms", &out->dropped_ms) < 0) {
+        return -1;
+    }
+    return 0;
+}
+
+int pixa_decode_session_welcome_event(const char *json, pixa_session_welcome_event *out)
+{
+    memset(out, 0, sizeof(*out));
+    if (pixa_json_get_string(json, "type", out->type, sizeof(out->type)) < 0) {
+        return -1;
+    }
+    if (strcmp(out->type, PIXA_TYPE_SESSION_WELCOME) != 0) {
+        return -1;
+    }
+    if (pixa_json_get_string(json, "session_id", out->session_id, sizeof(out->session_id)) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_base64(json, "public_key", out->public_key, sizeof(out->public_key), &out->public_key_len) < 0) {
+        return -1;
+    }
+    pixa_json_get_base64(json, "signature", out->signature, sizeof(out->signature), &out->signature_len);
+    return 0;
+}
+
+int pixa_decode_upgrade_event(const char *json, pixa_upgrade_event *out)
+{
+    memset(out, 0, sizeof(*out));
+    if (pixa_json_get_string(json, "type", out->type, sizeof(out->type)) < 0) {
+        return -1;
+    }
+    if (strcmp(out->type, PIXA_TYPE_UPGRADE_RECOMMENDED) != 0 && strcmp(out->type, PIXA_TYPE_UPGRADE_REQUIRED) != 0) {
+        return -1;
+    }
+    if (pixa_json_get_int32(json, "protocol_version", &out->protocol_version) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int32(json, "min_protocol_version", &out->min_protocol_version) < 0) {
+        return -1;
+    }
+    pixa_json_get_string(json, "min_firmware_version", out->min_firmware_version, sizeof(out->min_firmware_version));
+    pixa_json_get_string(json, "recommended_firmware_version", out->recommended_firmware_version, sizeof(out->recommended_firmware_version));
+    if (pixa_json_get_string(json, "reason", out->reason, sizeof(out->reason)) < 0) {
+        return -1;
+    }
+    return 0;
+}
+
+int pixa_decode_echo_detected_event(const char *json, pixa_echo_detected_event *out)
+{
+    memset(out, 0, sizeof(*out));
+    if (pixa_json_get_string(json, "type", out->type, sizeof(out->type)) < 0) {
+        return -1;
+    }
+    if (strcmp(out->type, PIXA_TYPE_ECHO_DETECTED) != 0) {
+        return -1;
+    }
+    if (pixa_json_get_int32(json, "correlation_percent", &out->correlation_percent) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int64(json, "delay_ms", &out->delay_ms) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int64(json, "muted_ms", &out->muted_ms) < 0) {
+        return -1;
+    }
+    return 0;
+}
+
+int pixa_decode_speech_estimate_event(const char *json, pixa_speech_estimate_event *out)
+{
+    memset(out, 0, sizeof(*out));
+    if (pixa_json_get_string(json, "type", out->type, sizeof(out->type)) < 0) {
+        return -1;
+    }
+    if (strcmp(out->type, PIXA_TYPE_SPEECH_ESTIMATE) != 0) {
+        return -1;
+    }
+    if (pixa_json_get_string(json, "item_id", out->item_id, sizeof(out->item_id)) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int64(json, "total_ms", &out->total_ms) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int64(json, "remaining_ms", &out->remaining_ms) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_bool(json, "final", &out->final) < 0) {
+        return -1;
+    }
+    return 0;
+}
+
+int pixa_decode_audio_test_result_event(const char *json, pixa_audio_test_result_event *out)
+{
+    memset(out, 0, sizeof(*out));
+    if (pixa_json_get_string(json, "type", out->type, sizeof(out->type)) < 0) {
+        return -1;
+    }
+    if (strcmp(out->type, PIXA_TYPE_AUDIO_TEST_RESULT) != 0) {
+        return -1;
+    }
+    if (pixa_json_get_bool(json, "verified", &out->verified) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_bool(json, "passed", &out->passed) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int64(json, "latency_ms", &out->latency_ms) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int32(json, "level_db", &out->level_db) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int32(json, "matched_percent", &out->matched_percent) < 0) {
+        return -1;
+    }
+    return 0;
+}
+
+int pixa_decode_queue_position_event(const char *json, pixa_queue_position_event *out)
+{
+    memset(out, 0, sizeof(*out));
+    if (pixa_json_get_string(json, "type", out->type, sizeof(out->type)) < 0) {
+        return -1;
+    }
+    if (strcmp(out->type, PIXA_TYPE_QUEUE_POSITION) != 0) {
+        return -1;
+    }
+    if (pixa_json_get_int32(json, "position", &out->position) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int32(json, "waiting", &out->waiting) < 0) {
+        return -1;
+    }
+    return 0;
+}
+
+int pixa_decode_queue_admitted_event(const char *json, pixa_queue_admitted_event *out)
+{
+    memset(out, 0, sizeof(*out));
+    if (pixa_json_get_string(json, "type", out->type, sizeof(out->type)) < 0) {
+        return -1;
+    }
+    if (strcmp(out->type, PIXA_TYPE_QUEUE_ADMITTED) != 0) {
+        return -1;
+    }
+    if (pixa_json_get_int64(json, "waited_ms", &out->waited_ms) < 0) {
+        return -1;
+    }
+    return 0;
+}
+
+int pixa_decode_device_configured_event(const char *json, pixa_device_configured_event *out)
+{
+    memset(out, 0, sizeof(*out));
+    if (pixa_json_get_string(json, "type", out->type, sizeof(out->type)) < 0) {
+        return -1;
+    }
+    if (strcmp(out->type, PIXA_TYPE_DEVICE_CONFIGURED) != 0) {
+        return -1;
+    }
+    if (pixa_json_get_int32(json, "sample_rate", &out->sample_rate) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_string(json, "codec", out->codec, sizeof(out->codec)) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int32(json, "channels", &out->channels) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_string(json, "downlink_codec", out->downlink_codec, sizeof(out->downlink_codec)) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_int32(json, "downlink_sample_rate", &out->downlink_sample_rate) < 0) {
+        return -1;
+    }
+    return 0;
+}
+
+int pixa_decode_control_error_event(const char *json, pixa_control_error_event *out)
+{
+    memset(out, 0, sizeof(*out));
+    if (pixa_json_get_string(json, "type", out->type, sizeof(out->type)) < 0) {
+        return -1;
+    }
+    if (strcmp(out->type, PIXA_TYPE_CONTROL_ERROR) != 0) {
+        return -1;
+    }
+    pixa_json_get_string(json, "message_type", out->message_type, sizeof(out->message_type));
+    if (pixa_json_get_string(json, "code", out->code, sizeof(out->code)) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_string(json, "path", out->path, sizeof(out->path)) < 0) {
+        return -1;
+    }
+    pixa_json_get_string(json, "expected", out->expected, sizeof(out->expected));
+    if (pixa_json_get_int32(json, "protocol_version", &out->protocol_version) < 0) {
+        return -1;
+    }
+    if (pixa_json_get_string(json, "reason", out->reason, sizeof(out->reason)) < 0) {
+        return -1;
+    }
+    return 0;
+}
@@ -0,0 +1,301 @@
+/* Code generated by protogen from protocol/protocol.schema.json. DO NOT EDIT. */
+#ifndef PIXA_PROTOCOL_H
+#define PIXA_PROTOCOL_H
+
+#include <stdbool.h>
+#include <stddef.h>
+#include <stdint.h>
+
+#include "pixa_json.h"
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+/* Sizes of the string and byte fields, including the terminating NUL of strings */
+#ifndef PIXA_MAX_STRING
+#define PIXA_MAX_STRING 256
+#endif
+#ifndef PIXA_MAX_BYTES
+#define PIXA_MAX_BYTES 64
+#endif
+#define PIXA_MAX_TYPE 32
+
+/* Control messages sent by the device */
+#define PIXA_TYPE_PLAYBACK_ACK "playback.ack"
+#define PIXA_TYPE_SESSION_HELLO "session.hello"
+#define PIXA_TYPE_PTT_BEGIN "ptt.begin"
+#define PIXA_TYPE_PTT_END "ptt.end"
+#define PIXA_TYPE_TURN_METADATA "turn.metadata"
+#define PIXA_TYPE_AUDIO_TEST "audio.test"
+#define PIXA_TYPE_DEVICE_HELLO "device.hello"
+
+/* Events sent by the relay */
+#define PIXA_TYPE_SESSION_STATUS "session.status"
+#define PIXA_TYPE_RESPONSE_INTERRUPTED "response.interrupted"
+#define PIXA_TYPE_SENTENCE_COMPLETED "sentence.completed"
+#define PIXA_TYPE_BANDWIDTH_WARNING "bandwidth.warning"
+#define PIXA_TYPE_BANDWIDTH_DOWNGRADED "bandwidth.downgraded"
+#define PIXA_TYPE_BANDWIDTH_EXCEEDED "bandwidth.exceeded"
+#define PIXA_TYPE_PROVIDER_OFFLINE "provider.offline"
+#define PIXA_TYPE_PROVIDER_RECOVERED "provider.recovered"
+#define PIXA_TYPE_SESSION_WELCOME "session.welcome"
+#define PIXA_TYPE_UPGRADE_RECOMMENDED "upgrade.recommended"
+#define PIXA_TYPE_UPGRADE_REQUIRED "upgrade.required"
+#define PIXA_TYPE_ECHO_DETECTED "echo.detected"
+#define PIXA_TYPE_SPEECH_ESTIMATE "speech.estimate"
+#define PIXA_TYPE_AUDIO_TEST_RESULT "audio.test_result"
+#define PIXA_TYPE_QUEUE_POSITION "queue.position"
+#define PIXA_TYPE_QUEUE_ADMITTED "queue.admitted"
+#define PIXA_TYPE_DEVICE_CONFIGURED "device.configured"
+#define PIXA_TYPE_CONTROL_ERROR "control.error"
+
+typedef struct {
+    int64_t played_ms;
+} pixa_playback_ack_message;
+
+typedef struct {
+    /* the device's ephemeral X25519 public key, base64 encoded */
+    uint8_t public_key[PIXA_MAX_BYTES];
+    size_t public_key_len;
+} pixa_session_hello_message;
+
+typedef struct {
+    /* when the device started capturing the user's speech, in unix ms of the device's clock */
+    int64_t captured_at_ms;
+    /* when the device sent this message, in unix ms of the device's clock */
+    int64_t sent_at_ms;
+} pixa_ptt_begin_message;
+
+typedef struct {
+} pixa_ptt_end_message;
+
+typedef struct {
+    /* what the model should know about the turn, by name */
+    const pixa_json_pair *metadata;
+    size_t metadata_len;
+} pixa_turn_metadata_message;
+
+typedef struct {
+    /* tone, the default, or sweep, "tone" or "sweep" */
+    char kind[PIXA_MAX_STRING];
+    /* the frequency of a tone, 1000 by default */
+    int32_t frequency_hz;
+    /* where a sweep starts, 300 by default */
+    int32_t from_hz;
+    /* where a sweep ends, 3400 by default */
+    int32_t to_hz;
+    /* how long the signal plays, 2000 by default, up to audio_test.max_duration */
+    int64_t duration_ms;
+    /* the level of the signal in dBFS, -12 by default */
+    int32_t level_db;
+    /* set to check that the device's microphone hears the signal back from its speaker */
+    bool verify;
+} pixa_audio_test_message;
+
+typedef struct {
+    /* the rate of the device's audio, audio.sample_rate by default */
+    int32_t sample_rate;
+    /* the codec of the device's audio frames, pcm16 by default */
+    char codec[PIXA_MAX_STRING];
+    /* the channels of the device's audio, audio.channels by default */
+    int32_t channels;
+    /* how the channels are mixed down to audio.channels */
+    char downmix[PIXA_MAX_STRING];
+    char firmware_version[PIXA_MAX_STRING];
+    /* the codec the device takes answers in, pcm16 by default, or opus */
+    char downlink_codec[PIXA_MAX_STRING];
+    /* the rate the device takes answers at, audio.sample_rate by default */
+    int32_t downlink_sample_rate;
+} pixa_device_hello_message;
+
+/* pixa_cursor_status is a snapshot of an AudioCursor, sent to the device in status frames */
+typedef struct {
+    int64_t appended_ms;
+    int64_t committed_ms;
+    char item_id[PIXA_MAX_STRING];
+    int64_t sent_ms;
+    int64_t acked_ms;
+} pixa_cursor_status;
+
+typedef struct {
+    char type[PIXA_MAX_TYPE];
+    char session_id[PIXA_MAX_STRING];
+    /* the correlation ID the device connected with, if any */
+    char correlation_id[PIXA_MAX_STRING];
+    pixa_cursor_status cursor;
+} pixa_session_status_event;
+
+typedef struct {
+    char type[PIXA_MAX_TYPE];
+    char item_id[PIXA_MAX_STRING];
+    int64_t audio_end_ms;
+} pixa_response_interrupted_event;
+
+typedef struct {
+    char type[PIXA_MAX_TYPE];
+    char item_id[PIXA_MAX_STRING];
+    /* the position of the sentence within the item */
+    int32_t index;
+    char text[PIXA_MAX_STRING];
+    /* the display language text was translated into, unset when it is as spoken */
+    char language[PIXA_MAX_STRING];
+    /* the sentence as spoken, when text is a translation */
+    char original_text[PIXA_MAX_STRING];
+    /* the start of the sentence within the item's audio */
+    int64_t audio_start_ms;
+    /* the end of the sentence within the item's audio */
+    int64_t audio_end_ms;
+} pixa_sentence_completed_event;
+
+typedef struct {
+    char type[PIXA_MAX_TYPE];
+    /* the cap the event refers to, "session" or "monthly" */
+    char scope[PIXA_MAX_STRING];
+    int64_t used_bytes;
+    int64_t cap_bytes;
+    int32_t sample_rate;
+} pixa_bandwidth_event;
+
+typedef struct {
+    char type[PIXA_MAX_TYPE];
+    char reason[PIXA_MAX_STRING];
+} pixa_provider_offline_event;
+
+typedef struct {
+    char type[PIXA_MAX_TYPE];
+    /* "replay" or "discard" */
+    char action[PIXA_MAX_STRING];
+    int64_t buffered_ms;
+    int64_t dropped_ms;
+} pixa_provider_recovered_event;
+
+typedef struct {
+    char type[PIXA_MAX_TYPE];
+    char session_id[PIXA_MAX_STRING];
+    uint8_t public_key[PIXA_MAX_BYTES];
+    size_t public_key_len;
+    /* the relay's Ed25519 signature of the session ID, the device's and the relay's public keys, when the relay has a signing key */
+    uint8_t signature[PIXA_MAX_BYTES];
+    size_t signature_len;
+} pixa_session_welcome_event;
+
+typedef struct {
+    char type[PIXA_MAX_TYPE];
+    /* the protocol version the relay speaks */
+    int32_t protocol_version;
+    /* the oldest protocol version the relay serves */
+    int32_t min_protocol_version;
+    /* the oldest firmware version the relay serves */
+    char min_firmware_version[PIXA_MAX_STRING];
+    /* the firmware version devices should upgrade to */
+    char recommended_firmware_version[PIXA_MAX_STRING];
+    /* what is out of date, for logs on the device */
+    char reason[PIXA_MAX_STRING];
+} pixa_upgrade_event;
+
+typedef struct {
+    char type[PIXA_MAX_TYPE];
+    /* how closely the audio from the device followed the assistant's, from 0 to 100 */
+    int32_t correlation_percent;
+    /* how late the echo came back */
+    int64_t delay_ms;
+    /* how long the relay replaces the device's audio with silence, 0 when it does not */
+    int64_t muted_ms;
+} pixa_echo_detected_event;
+
+typedef struct {
+    char type[PIXA_MAX_TYPE];
+    char item_id[PIXA_MAX_STRING];
+    /* the predicted length of the item's audio */
+    int64_t total_ms;
+    /* the predicted audio still to be sent after what was sent so far; with what the device has buffered, the time until the assistant stops speaking */
+    int64_t remaining_ms;
+    /* set once all of the item's audio was received, when total_ms is exact */
+    bool final;
+} pixa_speech_estimate_event;
+
+typedef struct {
+    char type[PIXA_MAX_TYPE];
+    /* set when the test checked what the device heard; the other fields are zero otherwise */
+    bool verified;
+    /* set when the signal came back, at least audio_test.min_match of it */
+    bool passed;
+    /* how late the signal came back, from when the relay sent it */
+    int64_t latency_ms;
+    /* the level the signal came back at, in dBFS */
+    int32_t level_db;
+    /* how much of the signal was heard back at the frequency played, from 0 to 100 */
+    int32_t matched_percent;
+} pixa_audio_test_result_event;
+
+typedef struct {
+    char type[PIXA_MAX_TYPE];
+    /* 1 for the next session admitted */
+    int32_t position;
+    /* how many sessions are waiting */
+    int32_t waiting;
+} pixa_queue_position_event;
+
+typedef struct {
+    char type[PIXA_MAX_TYPE];
+    int64_t waited_ms;
+} pixa_queue_admitted_event;
+
+typedef struct {
+    char type[PIXA_MAX_TYPE];
+    int32_t sample_rate;
+    char codec[PIXA_MAX_STRING];
+    int32_t channels;
+    /* pcm16 when the relay cannot encode the codec asked for */
+    char downlink_codec[PIXA_MAX_STRING];
+    int32_t downlink_sample_rate;
+} pixa_device_configured_event;
+
+typedef struct {
+    char type[PIXA_MAX_TYPE];
+    /* the type of the message, if it could be read */
+    char message_type[PIXA_MAX_STRING];
+    /* what is wrong with the message, "invalid_json", "unknown_type", "unsupported_version", "missing_field", "invalid_type" or "invalid_value" */
+    char code[PIXA_MAX_STRING];
+    /* the JSON pointer of the value at fault, such as /played_ms, empty for the whole message */
+    char path[PIXA_MAX_STRING];
+    /* what the value should be, such as integer, string or one of tone, sweep */
+    char expected[PIXA_MAX_STRING];
+    /* the protocol version the message was validated against */
+    int32_t protocol_version;
+    /* the error, for logs on the device */
+    char reason[PIXA_MAX_STRING];
+} pixa_control_error_event;
+
+/* Encoders write the message as JSON into buf and return its length, or -1 if buf is too small */
+int pixa_encode_playback_ack_message(const pixa_playback_ack_message *m, char *buf, size_t cap);
+int pixa_encode_session_hello_message(const pixa_session_hello_message *m, char *buf, size_t cap);
+int pixa_encode_ptt_begin_message(const pixa_ptt_begin_message *m, char *buf, size_t cap);
+int pixa_encode_ptt_end_message(const pixa_ptt_end_message *m, char *buf, size_t cap);
+int pixa_encode_turn_metadata_message(const pixa_turn_metadata_message *m, char *buf, size_t cap);
+int pixa_encode_audio_test_message(const pixa_audio_test_message *m, char *buf, size_t cap);
+int pixa_encode_device_hello_message(const pixa_device_hello_message *m, char *buf, size_t cap);
+
+/* Decoders parse an event and return 0, or -1 if json is not that event or misses a required field */
+int pixa_decode_session_status_event(const char *json, pixa_session_status_event *out);
+int pixa_decode_response_interrupted_event(const char *json, pixa_response_interrupted_event *out);
+int pixa_decode_sentence_completed_event(const char *json, pixa_sentence_completed_event *out);
+int pixa_decode_bandwidth_event(const char *json, pixa_bandwidth_event *out);
+int pixa_decode_provider_offline_event(const char *json, pixa_provider_offline_event *out);
+int pixa_decode_provider_recovered_event(const char *json, pixa_provider_recovered_event *out);
+int pixa_decode_session_welcome_event(const char *json, pixa_session_welcome_event *out);
+int pixa_decode_upgrade_event(const char *json, pixa_upgrade_event *out);
+int pixa_decode_echo_detected_event(const char *json, pixa_echo_detected_event *out);
+int pixa_decode_speech_estimate_event(const char *json, pixa_speech_estimate_event *out);
+int pixa_decode_audio_test_result_event(const char *json, pixa_audio_test_result_event *out);
+int pixa_decode_queue_position_event(const char *json, pixa_queue_position_event *out);
+int pixa_decode_queue_admitted_event(const char *json, pixa_queue_admitted_event *out);
+int pixa_decode_device_configured_event(const char *json, pixa_device_configured_event *out);
+int pixa_decode_control_error_event(const char *json, pixa_control_error_event *out);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* PIXA_PROTOCOL_H */
@@ -0,0 +1,9 @@
+// Package pixa holds the control protocol types for Go and TinyGo device firmware talking to the
+// relay. Messages are JSON encoded in websocket text frames; read the envelope first to find out
+// which message a frame holds.
+package pixa
+
+// Envelope is the part shared by all control messages
+type Envelope struct {
+	Type string `json:"type"`
+}